@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/kataras/iris/v12"
+)
+
+// registerAdminRoutes registers the operator-facing endpoints, all behind
+// the admin credentials; see adminauth.go.
+func registerAdminRoutes(app *iris.Application) {
+	root := app.Party("/", requireAdminAuth, auditAdminActions)
+	admin := root.Party("/admin")
+
+	// Reports the state of every HTTP listener independently.
+	documentRoute(admin.Get("/listeners", func(ctx iris.Context) {
+		ctx.JSON(iris.Map{"listeners": listenerStatuses()})
+	}), apiDoc{Summary: "State of every HTTP listener", Response: struct {
+		Listeners []listenerStatus `json:"listeners"`
+	}{}})
+
+	// Days until expiry for every monitored TLS certificate.
+	documentRoute(admin.Get("/certificates", func(ctx iris.Context) {
+		ctx.JSON(iris.Map{"certificates": monitoredCerts()})
+	}), apiDoc{Summary: "Expiry of every monitored TLS certificate", Response: struct {
+		Certificates []monitoredCert `json:"certificates"`
+	}{}})
+
+	// Jobs parked in memory by any component, oldest first.
+	documentRoute(admin.Get("/holds", func(ctx iris.Context) {
+		ctx.JSON(iris.Map{"holds": heldJobs()})
+	}), apiDoc{Summary: "Jobs held by any component, oldest first", Response: struct {
+		Holds []heldJob `json:"holds"`
+	}{}})
+
+	registerApprovalRoutes(root)
+	registerJobRoutes(root)
+	registerJobCancelRoutes(root)
+	registerReportRoutes(root)
+	registerPairCacheRoutes(root)
+	registerDeadLetterRoutes(root)
+	registerErrorClusterRoutes(root)
+	registerOpenAPIRoutes(root)
+	registerBackfillRoutes(admin)
+	registerFaultRoutes(admin)
+	registerSLARoutes(admin)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/kataras/iris/v12"
+)
+
+// Every route of the admin route group requires credentials, checked before
+// the handler runs. ADMIN_AUTH_TOKEN and ADMIN_BASIC_USER/PASS grant the
+// manage scope, which allows every admin request. ADMIN_READ_TOKEN and
+// ADMIN_READ_BASIC_USER/PASS grant the read scope, which allows GET and HEAD
+// only. A request without accepted credentials gets 401, and one whose
+// credentials lack the scope gets 403; both emit an admin_rejected security
+// event. With no admin credentials set, every admin request is refused.
+//
+// The principal a request authenticated as, the basic auth user or the name
+// of the token, is the actor of its security events and log lines.
+
+// Admin scopes.
+const (
+	adminScopeRead   = "read"
+	adminScopeManage = "manage"
+)
+
+// Principals of the bearer tokens, which carry no user name.
+const (
+	adminTokenPrincipal     = "admin-token"
+	adminReadTokenPrincipal = "read-token"
+)
+
+// adminPrincipalKey is the context key of the authenticated adminPrincipal.
+const adminPrincipalKey = "adminPrincipal"
+
+// adminPrincipal is who an admin request authenticated as.
+type adminPrincipal struct {
+	Name  string
+	Scope string
+}
+
+// allows reports whether the principal may make a request needing scope.
+func (p adminPrincipal) allows(scope string) bool {
+	return p.Scope == adminScopeManage || scope == adminScopeRead
+}
+
+// adminCredential is one accepted set of admin credentials.
+type adminCredential struct {
+	auth      webhookAuth
+	scope     string
+	tokenName string
+}
+
+func adminCredentials() []adminCredential {
+	cfg := config()
+	return []adminCredential{
+		{auth: webhookAuth{token: cfg.AdminAuthToken, user: cfg.AdminBasicUser, password: cfg.AdminBasicPass},
+			scope: adminScopeManage, tokenName: adminTokenPrincipal},
+		{auth: webhookAuth{token: cfg.AdminReadToken, user: cfg.AdminReadUser, password: cfg.AdminReadPass},
+			scope: adminScopeRead, tokenName: adminReadTokenPrincipal},
+	}
+}
+
+// adminAuth returns the credentials the replay tool reads the admin routes
+// with: the read-only ones when set.
+func adminAuth() webhookAuth {
+	creds := adminCredentials()
+	if creds[1].auth.configured() {
+		return creds[1].auth
+	}
+	return creds[0].auth
+}
+
+// authenticateAdmin returns the principal whose credentials r carries.
+func authenticateAdmin(r *http.Request) (adminPrincipal, bool) {
+	for _, cred := range adminCredentials() {
+		if !cred.auth.configured() {
+			continue
+		}
+		if user, ok := cred.auth.authenticate(r); ok {
+			if user == "" {
+				user = cred.tokenName
+			}
+			return adminPrincipal{Name: user, Scope: cred.scope}, true
+		}
+	}
+	return adminPrincipal{}, false
+}
+
+// requiredAdminScope is the scope a request with method needs.
+func requiredAdminScope(method string) string {
+	switch method {
+	case iris.MethodGet, iris.MethodHead, iris.MethodOptions:
+		return adminScopeRead
+	}
+	return adminScopeManage
+}
+
+// logAdminAuth reports at startup how the admin routes are protected.
+func logAdminAuth() {
+	configured := false
+	for _, cred := range adminCredentials() {
+		if cred.auth.configured() {
+			configured = true
+			slog.Info("Admin routes accept credentials", "scope", cred.scope, "accepts", cred.auth.describe())
+		}
+	}
+	if !configured {
+		slog.Warn("Admin routes refuse every request; set ADMIN_AUTH_TOKEN or ADMIN_BASIC_USER to use them")
+	}
+}
+
+// requireAdminAuth refuses admin requests without credentials for the scope
+// their method needs, and records the principal of the others.
+func requireAdminAuth(ctx iris.Context) {
+	principal, ok := authenticateAdmin(ctx.Request())
+	if !ok {
+		for _, cred := range adminCredentials() {
+			if cred.auth.user != "" {
+				ctx.Header("WWW-Authenticate", `Basic realm="synergymattersfax admin"`)
+				break
+			}
+		}
+		rejectAdmin(ctx, iris.StatusUnauthorized, "missing or invalid admin credentials")
+		return
+	}
+	ctx.Values().Set(adminPrincipalKey, principal)
+	if _, ok := requireAdminScope(ctx, requiredAdminScope(ctx.Method())); !ok {
+		return
+	}
+	ctx.Next()
+}
+
+// requireAdminScope returns the principal of an admin request if it has
+// scope, and otherwise refuses the request. Handlers whose decisions must
+// not rest on their method alone, like approvals, check their scope with it.
+func requireAdminScope(ctx iris.Context, scope string) (adminPrincipal, bool) {
+	principal, ok := ctx.Values().Get(adminPrincipalKey).(adminPrincipal)
+	if !ok {
+		rejectAdmin(ctx, iris.StatusUnauthorized, "missing or invalid admin credentials")
+		return adminPrincipal{}, false
+	}
+	if !principal.allows(scope) {
+		rejectAdmin(ctx, iris.StatusForbidden, "the "+scope+" scope is required")
+		return adminPrincipal{}, false
+	}
+	return principal, true
+}
+
+// rejectAdmin emits an admin_rejected event and answers with status.
+func rejectAdmin(ctx iris.Context, status int, message string) {
+	emitSecurityEvent(securityEventForRequest(ctx, secEventAdminRejected, "denied", message))
+	ctx.StopWithJSON(status, iris.Map{"error": message})
+}
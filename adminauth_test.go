@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/kataras/iris/v12"
+)
+
+// testAdminToken is the ADMIN_AUTH_TOKEN of useTestConfig.
+const testAdminToken = "test-admin-token"
+
+// asAdmin adds the manage-scope test credentials to req.
+func asAdmin(req *http.Request) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+func TestAdminAuth(t *testing.T) {
+	env := map[string]string{"ADMIN_BASIC_USER": "ops", "ADMIN_BASIC_PASS": "pw",
+		"ADMIN_READ_TOKEN": "read-secret", "ADMIN_READ_BASIC_USER": "auditor", "ADMIN_READ_BASIC_PASS": "pw2"}
+	tests := []struct {
+		name   string
+		env    map[string]string // replaces env when set
+		method string
+		auth   func(req *http.Request)
+		status int
+		event  string // security event type
+		actor  string
+	}{
+		{name: "no credentials", method: "GET", status: 401, event: secEventAdminRejected},
+		{name: "wrong token", method: "GET", auth: bearer("wrong"), status: 401, event: secEventAdminRejected},
+		{name: "wrong password", method: "DELETE", auth: basic("ops", "guess"), status: 401, event: secEventAdminRejected},
+		{name: "claimed user", method: "GET", auth: basic("ops", ""), status: 401, event: secEventAdminRejected},
+		{name: "nothing configured", env: map[string]string{"ADMIN_AUTH_TOKEN": ""}, method: "GET", auth: bearer(""),
+			status: 401, event: secEventAdminRejected},
+		{name: "manage token read", method: "GET", auth: bearer(testAdminToken), status: 200},
+		{name: "manage token change", method: "DELETE", auth: bearer(testAdminToken), status: 404,
+			event: secEventAdminAction, actor: adminTokenPrincipal},
+		{name: "manage user change", method: "DELETE", auth: basic("ops", "pw"), status: 404,
+			event: secEventAdminAction, actor: "ops"},
+		{name: "read token read", method: "GET", auth: bearer("read-secret"), status: 200},
+		{name: "read user read", method: "GET", auth: basic("auditor", "pw2"), status: 200},
+		{name: "read token change", method: "DELETE", auth: bearer("read-secret"), status: 403,
+			event: secEventAdminRejected, actor: adminReadTokenPrincipal},
+		{name: "read user change", method: "DELETE", auth: basic("auditor", "pw2"), status: 403,
+			event: secEventAdminRejected, actor: "auditor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := env
+			if tt.env != nil {
+				settings = tt.env
+			}
+			useTestConfig(t, settings)
+			events := captureSecurityEvents(t)
+			path := "/cache"
+			if tt.method == "DELETE" {
+				path = "/cache/fax0001.pdf"
+			}
+			req := httptest.NewRequest(tt.method, path, nil)
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := serveTestRequest(t, registerAdminRoutes, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == 401 && rec.Header().Get("WWW-Authenticate") == "" && tt.env == nil {
+				t.Error("401 without WWW-Authenticate")
+			}
+			got := events()
+			if tt.event == "" {
+				if len(got) != 0 {
+					t.Errorf("events %+v, want none", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Type != tt.event || got[0].Actor != tt.actor {
+				t.Errorf("events %+v, want one %s by %q", got, tt.event, tt.actor)
+			}
+		})
+	}
+}
+
+func bearer(token string) func(req *http.Request) {
+	return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func basic(user, password string) func(req *http.Request) {
+	return func(req *http.Request) { req.SetBasicAuth(user, password) }
+}
+
+// TestAdminRoutesRequireAuth calls every route of the admin route group
+// without credentials, and checks that each is refused before its handler runs.
+func TestAdminRoutesRequireAuth(t *testing.T) {
+	useTestConfig(t, map[string]string{"FAULTS_ENABLED": "true"})
+	prev := faultsEnabled
+	initFaults()
+	t.Cleanup(func() { faultsEnabled = prev })
+
+	app := iris.New()
+	registerAdminRoutes(app)
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+	params := regexp.MustCompile(`\{[^}]*\}`)
+	routes := app.GetRoutes()
+	if len(routes) < 20 {
+		t.Fatalf("only %d admin routes registered", len(routes))
+	}
+	for _, r := range routes {
+		path := params.ReplaceAllString(r.Path, "x")
+		t.Run(r.Method+" "+path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			app.ServeHTTP(rec, httptest.NewRequest(r.Method, path, nil))
+			if rec.Code != 401 {
+				t.Errorf("status %d, want 401: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errAwaitingApproval is returned by submitFax when a job was held for approval.
+var errAwaitingApproval = errors.New("fax is awaiting approval")
+
+// pendingApproval is an outbound job held until an approver releases or rejects it.
+type pendingApproval struct {
+	HylaJobID   string    `json:"hyla_job_id"`
+	JobID       string    `json:"job_id"` // Synergy job ID (.sfc name without extension)
+	FaxNumber   string    `json:"fax_number"`
+	PdfFile     string    `json:"pdf_file"`
+	PdfPath     string    `json:"pdf_path"`
+	SfcFileName string    `json:"sfc_file_name"`
+	User        string    `json:"user,omitempty"`
+	CallerID    string    `json:"caller_id,omitempty"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Alerted     bool      `json:"alerted,omitempty"` // stale-approval warning already logged
+}
+
+// approvals holds the pending jobs, keyed by Hylafax job ID. Each one is
+// also recorded as an "approval" hold so it survives restarts.
+var approvals = struct {
+	sync.Mutex
+	pending map[string]*pendingApproval
+}{pending: make(map[string]*pendingApproval)}
+
+// startApprovalChecks starts the stale-approval checker.
+func startApprovalChecks() {
+	go checkStaleApprovals()
+}
+
+// persistApproval records the job's approval hold.
+func persistApproval(job pendingApproval) {
+	putHold(heldJob{
+		Component: holdApproval,
+		ID:        job.HylaJobID,
+		HylaJobID: job.HylaJobID,
+		SfcPath:   jobFile(job.HylaJobID, job.SfcFileName),
+		PdfPath:   job.PdfPath,
+		Reason:    "awaiting approval",
+		Release:   "POST /jobs/{id}/approve or /jobs/{id}/reject",
+		HeldAt:    job.QueuedAt,
+	}, job)
+}
+
+// approvalRequired reports whether jobs from the queue folder dir wait for
+// approval: APPROVAL_REQUIRED holds every folder's, and a FAX_QUEUE_DIRS
+// entry's approval option holds its own.
+func approvalRequired(dir string) bool {
+	return config().ApprovalRequired || queueDirFor(dir).Approval
+}
+
+// restoreApprovalHold puts a persisted approval back in the pending list.
+func restoreApprovalHold(h heldJob) error {
+	if !approvalRequired(filepath.Dir(h.SfcPath)) {
+		return errors.New("approval is no longer required (APPROVAL_REQUIRED and the queue folder's approval option are off); resubmit the fax")
+	}
+	var job pendingApproval
+	if err := json.Unmarshal(h.Data, &job); err != nil {
+		return fmt.Errorf("unreadable approval: %w", err)
+	}
+	approvals.Lock()
+	approvals.pending[job.HylaJobID] = &job
+	approvals.Unlock()
+	cache.Lock()
+	cache.inFlight[job.SfcFileName] = true
+	cache.Unlock()
+	return nil
+}
+
+// approvalAutoApproved reports whether a job may bypass the hold: the
+// destination starts with an APPROVAL_TRUSTED_PREFIXES entry, or the document
+// is no larger than APPROVAL_AUTO_MAX_BYTES.
+func approvalAutoApproved(faxNumber, pdfPath string) (bool, string) {
+	for _, prefix := range config().approvalTrustedPrefixes {
+		if strings.HasPrefix(faxNumber, prefix) {
+			return true, "trusted destination " + prefix
+		}
+	}
+	if max := config().ApprovalAutoMaxBytes; max > 0 {
+		if info, err := os.Stat(pdfPath); err == nil && info.Size() <= max {
+			return true, fmt.Sprintf("document size %d <= %d bytes", info.Size(), max)
+		}
+	}
+	return false, ""
+}
+
+// holdForApproval parks the job when its queue folder requires approval and
+// no auto-approval rule matches. It reports whether the job was held.
+func holdForApproval(job pendingApproval) bool {
+	if !approvalRequired(jobDir(job.HylaJobID)) {
+		return false
+	}
+	if ok, reason := approvalAutoApproved(job.FaxNumber, job.PdfPath); ok {
+		slog.Info("Fax job auto-approved", "job_id", job.HylaJobID, "reason", reason)
+		return false
+	}
+
+	job.QueuedAt = time.Now()
+	approvals.Lock()
+	approvals.pending[job.HylaJobID] = &job
+	approvals.Unlock()
+	persistApproval(job)
+
+	// State 1 (suspended) is non-terminal, so Synergy keeps waiting.
+	createStsFile(job.HylaJobID, stsStateSuspended, "", "", "awaiting approval")
+	return true
+}
+
+// takeApproval removes and returns a pending approval.
+func takeApproval(hylaJobID string) (*pendingApproval, bool) {
+	approvals.Lock()
+	job, ok := approvals.pending[hylaJobID]
+	delete(approvals.pending, hylaJobID)
+	approvals.Unlock()
+	if ok {
+		releaseHold(holdApproval, hylaJobID)
+	}
+	return job, ok
+}
+
+// approveJob releases a held job to the webhook.
+func approveJob(job *pendingApproval) {
+	defer releaseInFlight(job.SfcFileName)
+	createStsFile(job.HylaJobID, stsStateSleeping, "", "", "approved, submitting")
+	fax, err := deliverFax(job.FaxNumber, job.CallerID, job.PdfFile, job.PdfPath, job.SfcFileName, job.User, job.JobID, job.HylaJobID, 1, 0)
+	if err != nil {
+		slog.Error("Unable to send approved fax", "job_id", job.HylaJobID, "err", err)
+		return
+	}
+	slog.Info("Approved fax submitted", "job_id", job.HylaJobID, "uuid", fax)
+}
+
+// rejectJob fails a held job locally without contacting the webhook.
+func rejectJob(job *pendingApproval, reason string) {
+	defer releaseInFlight(job.SfcFileName)
+	failJob(job.HylaJobID, reason, jobFile(job.HylaJobID, job.SfcFileName), jobFile(job.HylaJobID, job.PdfFile))
+}
+
+// checkStaleApprovals warns about approvals older than APPROVAL_ALERT_AFTER
+// (default 4h) and rejects those older than APPROVAL_AUTO_REJECT_AFTER, if set.
+func checkStaleApprovals() {
+	for range time.Tick(time.Minute) {
+		alertAfter, rejectAfter := config().ApprovalAlertAfter, config().ApprovalAutoRejectAfter
+		var expired []*pendingApproval
+		var alerted []pendingApproval
+		approvals.Lock()
+		for id, job := range approvals.pending {
+			age := time.Since(job.QueuedAt)
+			if rejectAfter > 0 && age > rejectAfter {
+				expired = append(expired, job)
+				delete(approvals.pending, id)
+				continue
+			}
+			if alertAfter > 0 && age > alertAfter && !job.Alerted {
+				job.Alerted = true
+				alerted = append(alerted, *job)
+				slog.Warn("Fax job has been awaiting approval", "job_id", id, "number", job.FaxNumber, "age", age.Round(time.Minute))
+			}
+		}
+		approvals.Unlock()
+
+		for _, job := range alerted {
+			persistApproval(job)
+		}
+		for _, job := range expired {
+			releaseHold(holdApproval, job.HylaJobID)
+			slog.Info("Fax job auto-rejected after waiting for approval", "job_id", job.HylaJobID, "after", rejectAfter)
+			emitSecurityEvent(SecurityEvent{Type: secEventApprovalDecision, Actor: "system", Target: job.HylaJobID, Outcome: "denied", Detail: "approval timed out"})
+			rejectJob(job, "rejected: approval timed out")
+		}
+	}
+}
+
+// approvalDecision is the optional body of the approve/reject endpoints.
+// The approver is the authenticated principal, not something the caller
+// names.
+type approvalDecision struct {
+	Comment string `json:"comment"`
+}
+
+// registerApprovalRoutes adds the approval endpoints to the admin route group.
+func registerApprovalRoutes(admin iris.Party) {
+	documentRoute(admin.Get("/approvals", func(ctx iris.Context) {
+		approvals.Lock()
+		list := make([]iris.Map, 0, len(approvals.pending))
+		for id, job := range approvals.pending {
+			list = append(list, iris.Map{
+				"hyla_job_id":  id,
+				"job_id":       job.JobID,
+				"fax_number":   job.FaxNumber,
+				"pdf_file":     job.PdfFile,
+				"user":         job.User,
+				"queued_at":    job.QueuedAt,
+				"document_url": "/approvals/" + id + "/document",
+			})
+		}
+		approvals.Unlock()
+		sort.Slice(list, func(i, j int) bool {
+			return list[i]["queued_at"].(time.Time).Before(list[j]["queued_at"].(time.Time))
+		})
+		ctx.JSON(iris.Map{"approvals": list})
+	}), apiDoc{Summary: "Outbound faxes awaiting approval, oldest first", Response: struct {
+		Approvals []struct {
+			HylaJobID   string    `json:"hyla_job_id"`
+			JobID       string    `json:"job_id"`
+			FaxNumber   string    `json:"fax_number"`
+			PdfFile     string    `json:"pdf_file"`
+			User        string    `json:"user"`
+			QueuedAt    time.Time `json:"queued_at"`
+			DocumentURL string    `json:"document_url"`
+		} `json:"approvals"`
+	}{}})
+
+	documentRoute(admin.Get("/approvals/{id}/document", func(ctx iris.Context) {
+		approvals.Lock()
+		job, ok := approvals.pending[ctx.Params().Get("id")]
+		var path string
+		if ok {
+			path = job.PdfPath
+		}
+		approvals.Unlock()
+		if !ok {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "no pending approval with that id"})
+			return
+		}
+		ctx.ContentType(contentTypePDF)
+		if err := ctx.ServeFile(path); err != nil {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "document not found"})
+		}
+	}), apiDoc{Summary: "Document of a fax awaiting approval", ContentType: contentTypePDF})
+
+	decide := func(approve bool) iris.Handler {
+		return func(ctx iris.Context) {
+			principal, ok := requireAdminScope(ctx, adminScopeManage)
+			if !ok {
+				return
+			}
+			approver := principal.Name
+			var decision approvalDecision
+			if ctx.GetContentLength() > 0 {
+				if err := ctx.ReadJSON(&decision); err != nil {
+					ctx.StatusCode(iris.StatusBadRequest)
+					ctx.JSON(iris.Map{"error": err.Error()})
+					return
+				}
+			}
+
+			job, ok := takeApproval(ctx.Params().Get("id"))
+			if !ok {
+				ctx.StatusCode(iris.StatusNotFound)
+				ctx.JSON(iris.Map{"error": "no pending approval with that id"})
+				return
+			}
+
+			outcome, verb := "success", "approved"
+			if !approve {
+				outcome, verb = "denied", "rejected"
+			}
+			slog.Info("Fax job "+verb, "job_id", job.HylaJobID, "number", job.FaxNumber, "approver", approver, "comment", decision.Comment)
+			noteJobStatus(job.HylaJobID, verb+" by "+approver, statusSourceManual)
+			ev := securityEventForRequest(ctx, secEventApprovalDecision, outcome, decision.Comment)
+			ev.Target = job.HylaJobID
+			emitSecurityEvent(ev)
+
+			if approve {
+				goSubmit(func() { approveJob(job) })
+			} else {
+				reason := "rejected by " + approver
+				if decision.Comment != "" {
+					reason += ": " + decision.Comment
+				}
+				rejectJob(job, reason)
+			}
+			ctx.JSON(iris.Map{"hyla_job_id": job.HylaJobID, "decision": verb, "approver": approver})
+		}
+	}
+	decided := struct {
+		HylaJobID string `json:"hyla_job_id"`
+		Decision  string `json:"decision"`
+		Approver  string `json:"approver"`
+	}{}
+	documentRoute(admin.Post("/jobs/{id}/approve", decide(true)),
+		apiDoc{Summary: "Approve a held fax and submit it", Request: approvalDecision{}, Response: decided})
+	documentRoute(admin.Post("/jobs/{id}/reject", decide(false)),
+		apiDoc{Summary: "Reject a held fax", Request: approvalDecision{}, Response: decided})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kataras/iris/v12"
+)
+
+func TestHoldForApproval(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		dir    string // queue folder under FTP_ROOT, or "" for the default
+		number string
+		held   bool
+	}{
+		{name: "approval off", number: "6045551234"},
+		{name: "APPROVAL_REQUIRED", env: map[string]string{"APPROVAL_REQUIRED": "true"}, number: "6045551234", held: true},
+		{name: "supervised folder", env: map[string]string{"FAX_QUEUE_DIRS": "clinic-a;approval=true"},
+			dir: "clinic-a", number: "6045551234", held: true},
+		{name: "other folder", env: map[string]string{"FAX_QUEUE_DIRS": "clinic-a;approval=true,clinic-b"},
+			dir: "clinic-b", number: "6045551234"},
+		{name: "default folder not supervised", env: map[string]string{"FAX_QUEUE_DIRS": "clinic-a;approval=true"},
+			number: "6045551234"},
+		{name: "trusted destination", env: map[string]string{"FAX_QUEUE_DIRS": "clinic-a;approval=true", "APPROVAL_TRUSTED_PREFIXES": "604555"},
+			dir: "clinic-a", number: "6045551234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, tt.env)
+			t.Cleanup(func() {
+				approvals.Lock()
+				approvals.pending = make(map[string]*pendingApproval)
+				approvals.Unlock()
+			})
+			dir := cfg.FTPRoot + FaxDir
+			if tt.dir != "" {
+				dir = filepath.Join(cfg.FTPRoot, tt.dir)
+			}
+			setJobDir("42", dir)
+			pdfPath := filepath.Join(dir, "fax0001.pdf")
+			writeTestFile(t, pdfPath, "%PDF-1.4\n")
+
+			job := pendingApproval{HylaJobID: "42", JobID: "fax0001", FaxNumber: tt.number,
+				PdfFile: "fax0001.pdf", PdfPath: pdfPath, SfcFileName: "fax0001.sfc"}
+			if got := holdForApproval(job); got != tt.held {
+				t.Fatalf("holdForApproval() = %v, want %v", got, tt.held)
+			}
+			if !tt.held {
+				return
+			}
+			if sts := stsFields(t, "42"); sts["state"] != stsStateSuspended {
+				t.Errorf(".sts state %q, want %q", sts["state"], stsStateSuspended)
+			}
+			holds.Lock()
+			h, ok := holds.entries[holdApproval+"/42"]
+			holds.Unlock()
+			if !ok {
+				t.Fatal("held job has no approval hold")
+			}
+			if err := restoreApprovalHold(h); err != nil {
+				t.Errorf("restoreApprovalHold() = %v", err)
+			}
+		})
+	}
+}
+
+func TestApprovalDecisionScope(t *testing.T) {
+	// withoutMiddleware serves the approval routes to a read-scope principal
+	// without requireAdminAuth, so the handlers' own check is what refuses.
+	withoutMiddleware := func(app *iris.Application) {
+		registerApprovalRoutes(app.Party("/", func(ctx iris.Context) {
+			ctx.Values().Set(adminPrincipalKey, adminPrincipal{Name: "auditor", Scope: adminScopeRead})
+			ctx.Next()
+		}))
+	}
+	tests := []struct {
+		name     string
+		register func(app *iris.Application)
+		path     string
+		auth     func(req *http.Request)
+		status   int
+		approver string // of a decision that was made
+	}{
+		{name: "approve without credentials", register: registerAdminRoutes, path: "/jobs/42/approve", status: 401},
+		{name: "approve with read scope", register: registerAdminRoutes, path: "/jobs/42/approve", auth: bearer("read-secret"), status: 403},
+		{name: "reject with read scope", register: registerAdminRoutes, path: "/jobs/42/reject", auth: basic("auditor", "pw"), status: 403},
+		{name: "approve handler with read scope", register: withoutMiddleware, path: "/jobs/42/approve", status: 403},
+		{name: "reject handler with read scope", register: withoutMiddleware, path: "/jobs/42/reject", status: 403},
+		{name: "reject with manage scope", register: registerAdminRoutes, path: "/jobs/42/reject", auth: basic("supervisor", "pw"),
+			status: 200, approver: "supervisor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "APPROVAL_REQUIRED": "true",
+				"ADMIN_BASIC_USER": "supervisor", "ADMIN_BASIC_PASS": "pw",
+				"ADMIN_READ_TOKEN": "read-secret", "ADMIN_READ_BASIC_USER": "auditor", "ADMIN_READ_BASIC_PASS": "pw"})
+			t.Cleanup(func() {
+				approvals.Lock()
+				approvals.pending = make(map[string]*pendingApproval)
+				approvals.Unlock()
+			})
+			dir := cfg.FTPRoot + FaxDir
+			setJobDir("42", dir)
+			pdfPath := filepath.Join(dir, "fax0001.pdf")
+			writeTestFile(t, pdfPath, "%PDF-1.4\n")
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+			if !holdForApproval(pendingApproval{HylaJobID: "42", JobID: "fax0001", FaxNumber: "6045551234",
+				PdfFile: "fax0001.pdf", PdfPath: pdfPath, SfcFileName: "fax0001.sfc"}) {
+				t.Fatal("job not held")
+			}
+			stsPath := jobFile("42", "q42.sts")
+			sts := readTestFile(t, stsPath)
+			events := captureSecurityEvents(t)
+
+			// A caller-named approver is ignored.
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(`{"approver":"jsmith","comment":"wrong number"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := serveTestRequest(t, tt.register, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			approvals.Lock()
+			_, pending := approvals.pending["42"]
+			approvals.Unlock()
+			decided := tt.approver != ""
+			if pending == decided {
+				t.Errorf("job still pending = %v, want %v", pending, !decided)
+			}
+			if failed := fileExists(jobFile("42", "q42.fail")); failed != decided {
+				t.Errorf(".fail written = %v, want %v", failed, decided)
+			}
+			if !decided {
+				if got := readTestFile(t, stsPath); got != sts {
+					t.Errorf(".sts changed from %q to %q", sts, got)
+				}
+				for _, ev := range events() {
+					if ev.Type == secEventApprovalDecision {
+						t.Errorf("refused request emitted %+v", ev)
+					}
+				}
+				return
+			}
+			if !strings.Contains(rec.Body.String(), `"approver":"`+tt.approver+`"`) {
+				t.Errorf("response %s, want approver %q", rec.Body, tt.approver)
+			}
+			var decisions []SecurityEvent
+			for _, ev := range events() {
+				if ev.Type == secEventApprovalDecision {
+					decisions = append(decisions, ev)
+				}
+			}
+			if len(decisions) != 1 || decisions[0].Actor != tt.approver {
+				t.Errorf("approval decisions %+v, want one by %q", decisions, tt.approver)
+			}
+		})
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With ARCHIVE_S3_BUCKET set, every fax that reaches a final state is
+// uploaded to S3-compatible object storage for long-term retention: a
+// received fax when it is saved, a sent fax when it completes and a failed
+// one when it fails. The PDF goes to the key ARCHIVE_KEY_TEMPLATE names and
+// a JSON sidecar with the fax's metadata to the same key with .json in place
+// of its extension. The template's placeholders are {year}, {month}, {day},
+// {direction} (inbound or outbound), {uuid} (the provider UUID of a received
+// fax, the Hylafax job ID of a sent one) and {jobid}.
+//
+// Uploads go through a journal, DATA_DIR/archive-journal/, which holds a
+// copy of the PDF and a <name>.json entry for each pending upload, so an
+// archive is not lost when the queue file is removed or the service
+// restarts. Failed uploads are retried ARCHIVE_RETRIES times, ARCHIVE_RETRY_BACKOFF apart and
+// doubling; an upload that runs out of retries keeps its files and is tried
+// again at the next start. Archived entries are kept for JOB_STATE_TTL so
+// GET /jobs/{id} can show them. Requests are signed with AWS Signature
+// Version 4.
+
+// Archive states kept in archiveEntry.Status and FaxJobRecord.ArchiveStatus.
+const (
+	archivePending  = "pending"
+	archiveUploaded = "archived"
+	archiveFailed   = "failed"
+)
+
+const archiveJournalDirName = "archive-journal"
+
+// maxArchiveBackoff caps the wait between upload attempts.
+const maxArchiveBackoff = 30 * time.Minute
+
+var (
+	archiveUploads        = expvar.NewInt("archive_uploads")
+	archiveUploadFailures = expvar.NewInt("archive_upload_failures") // attempts that failed
+	archiveGivenUp        = expvar.NewInt("archive_failed")          // uploads that ran out of retries
+)
+
+func init() {
+	expvar.Publish("archive_pending", expvar.Func(func() any {
+		archiver.Lock()
+		defer archiver.Unlock()
+		return archiver.pending
+	}))
+}
+
+// archiveMetadata is the JSON sidecar uploaded next to the PDF.
+type archiveMetadata struct {
+	Direction  string    `json:"direction"`
+	UUID       string    `json:"uuid,omitempty"`
+	CallUUID   string    `json:"call_uuid,omitempty"`
+	HylaJobID  string    `json:"hyla_job_id,omitempty"`
+	JobID      string    `json:"job_id,omitempty"` // Synergy job ID
+	User       string    `json:"user,omitempty"`
+	Number     string    `json:"number,omitempty"` // the number dialled, or the one a received fax was sent to
+	CIDNum     string    `json:"cidnum,omitempty"`
+	CIDName    string    `json:"cidname,omitempty"`
+	Pages      int       `json:"pages,omitempty"`
+	Status     string    `json:"status"` // "received", "success" or the failure status
+	Error      string    `json:"error,omitempty"`
+	File       string    `json:"file"` // original file name
+	SHA256     string    `json:"sha256"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// archiveEntry is a journal entry, DATA_DIR/archive-journal/<name>.json.
+type archiveEntry struct {
+	Name        string          `json:"name"`
+	Key         string          `json:"key"` // object key of the PDF
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	Error       string          `json:"error,omitempty"`
+	QueuedAt    time.Time       `json:"queued_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	ArchivedAt  time.Time       `json:"archived_at"`
+	Metadata    archiveMetadata `json:"metadata"`
+}
+
+var archiver = struct {
+	sync.Mutex
+	pending int
+	wake    chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+func archiveDir() string {
+	return filepath.Join(config().DataDir, archiveJournalDirName)
+}
+
+func archiveEntryPath(name string) string {
+	return filepath.Join(archiveDir(), name+".json")
+}
+
+func archivePDFPath(name string) string {
+	return filepath.Join(archiveDir(), name+".pdf")
+}
+
+// archiveReceivedFax journals a received fax for archiving.
+func archiveReceivedFax(fax FaxReceive, pdfPath string, pages int, contentHash string) {
+	archiveFax("inbound-"+fax.UUID, fax.UUID, pdfPath, archiveMetadata{
+		Direction: "inbound",
+		UUID:      fax.UUID,
+		CallUUID:  fax.CallUUID,
+		Number:    fax.Number,
+		CIDNum:    fax.CIDNum,
+		CIDName:   fax.CIDName,
+		Pages:     pages,
+		Status:    "received",
+		SHA256:    contentHash,
+	})
+}
+
+// archiveSentJob journals an outbound job that completed or failed, before
+// its files leave the queue directory.
+func archiveSentJob(hylaJobID, sfcPath, pdfPath, status, reason string) {
+	if config().ArchiveS3Bucket == "" || pdfPath == "" {
+		return
+	}
+	meta := archiveMetadata{
+		Direction: "outbound",
+		HylaJobID: hylaJobID,
+		JobID:     strings.TrimSuffix(filepath.Base(sfcPath), ".sfc"),
+		Pages:     countFilePages(pdfPath),
+		Status:    status,
+	}
+	if reason != status {
+		meta.Error = reason
+	}
+	if content, err := os.ReadFile(sfcPath); err == nil {
+		if job, err := parseSfcFile(sfcPath, string(content)); err == nil {
+			meta.Number = job.FaxNumber
+			meta.User = job.User
+		}
+	}
+	archiveFax("outbound-"+hylaJobID, hylaJobID, pdfPath, meta)
+}
+
+// archiveFax copies the PDF into the journal and queues its upload.
+func archiveFax(name, id, pdfPath string, meta archiveMetadata) {
+	cfg := config()
+	if cfg.ArchiveS3Bucket == "" {
+		return
+	}
+	data, err := os.ReadFile(pdfPath)
+	if err != nil {
+		slog.Error("Unable to archive fax", "job_id", id, "direction", meta.Direction, "file", pdfPath, "err", err)
+		return
+	}
+	now := time.Now()
+	if _, err := os.Stat(archiveEntryPath(name)); err == nil {
+		// A Hylafax job ID that wrapped around; keep the earlier entry.
+		name += "-" + now.Format("20060102150405")
+	}
+	meta.File = filepath.Base(pdfPath)
+	if meta.SHA256 == "" {
+		sum := sha256.Sum256(data)
+		meta.SHA256 = hex.EncodeToString(sum[:])
+	}
+	meta.FinishedAt = now.UTC()
+	entry := archiveEntry{
+		Name:     name,
+		Key:      archiveKey(cfg.ArchiveKeyTemplate, meta.Direction, id, meta.HylaJobID, now),
+		Status:   archivePending,
+		QueuedAt: now,
+		Metadata: meta,
+	}
+	if err := os.MkdirAll(archiveDir(), 0755); err != nil {
+		slog.Error("Unable to archive fax", "job_id", id, "direction", meta.Direction, "file", archiveDir(), "err", err)
+		return
+	}
+	if err := writeQueueFile(archivePDFPath(name), data, 0644); err != nil {
+		slog.Error("Unable to archive fax", "job_id", id, "direction", meta.Direction, "file", archivePDFPath(name), "err", err)
+		return
+	}
+	if err := writeArchiveEntry(entry); err != nil {
+		slog.Error("Unable to archive fax", "job_id", id, "direction", meta.Direction, "file", archiveEntryPath(name), "err", err)
+		os.Remove(archivePDFPath(name))
+		return
+	}
+	if meta.Direction == "inbound" {
+		setRecordArchive(meta.UUID, entry)
+	}
+	slog.Debug("Fax queued for archiving", "job_id", id, "direction", meta.Direction, "key", entry.Key)
+	select {
+	case archiver.wake <- struct{}{}:
+	default:
+	}
+}
+
+// archiveKey fills in ARCHIVE_KEY_TEMPLATE.
+func archiveKey(template, direction, id, hylaJobID string, t time.Time) string {
+	t = t.In(config().faxLocation)
+	return strings.NewReplacer(
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{direction}", direction,
+		"{uuid}", id,
+		"{jobid}", hylaJobID,
+	).Replace(template)
+}
+
+// sidecarKey is the key of the metadata next to the PDF at key.
+func sidecarKey(key string) string {
+	return strings.TrimSuffix(key, filepath.Ext(key)) + ".json"
+}
+
+func writeArchiveEntry(entry archiveEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeQueueFile(archiveEntryPath(entry.Name), data, 0644)
+}
+
+// readArchiveEntry reads the journal entry of a fax by UUID or Hylafax job ID.
+func readArchiveEntry(id string) (archiveEntry, error) {
+	var entry archiveEntry
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return entry, os.ErrNotExist
+	}
+	var data []byte
+	var err error
+	for _, direction := range []string{"outbound", "inbound"} {
+		if data, err = os.ReadFile(archiveEntryPath(direction + "-" + id)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// setRecordArchive copies an entry's state to the received fax's record.
+func setRecordArchive(uuid string, entry archiveEntry) {
+	faxRecordsMutex.Lock()
+	if record, ok := faxRecords[uuid]; ok {
+		record.ArchiveStatus = entry.Status
+		record.ArchiveKey = entry.Key
+		record.ArchiveError = entry.Error
+	}
+	faxRecordsMutex.Unlock()
+}
+
+// startArchiver uploads the journal in the background. Uploads that ran out
+// of retries before the last shutdown are tried again.
+func startArchiver() {
+	entries := readArchiveJournal()
+	retried := 0
+	for _, entry := range entries {
+		if entry.Status == archiveFailed {
+			entry.Status, entry.Attempts, entry.NextAttempt = archivePending, 0, time.Time{}
+			if err := writeArchiveEntry(entry); err == nil {
+				retried++
+			}
+		}
+	}
+	if retried > 0 {
+		slog.Info("Retrying archive uploads that failed before the restart", "faxes", retried)
+	}
+	if len(entries) > 0 && config().ArchiveS3Bucket == "" {
+		slog.Warn("Faxes are waiting to be archived, but ARCHIVE_S3_BUCKET is no longer set", "file", archiveDir())
+		return
+	}
+	go func() {
+		for {
+			wait := runArchiver(pipelineCtx, time.Now())
+			select {
+			case <-archiver.wake:
+			case <-time.After(wait):
+			case <-pipelineCtx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// readArchiveJournal returns the journal entries, oldest first.
+func readArchiveJournal() []archiveEntry {
+	files, err := os.ReadDir(archiveDir())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Unable to read archive journal", "file", archiveDir(), "err", err)
+		}
+		return nil
+	}
+	var entries []archiveEntry
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" || isQueueTempFile(f.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(archiveDir(), f.Name()))
+		if err != nil {
+			continue
+		}
+		var entry archiveEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Name == "" {
+			slog.Warn("Skipping unreadable archive journal entry", "file", f.Name(), "err", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].QueuedAt.Before(entries[j].QueuedAt) })
+	return entries
+}
+
+// runArchiver makes one pass over the journal: due uploads are tried and
+// archived entries past JOB_STATE_TTL are removed. It returns how long to
+// wait before the next pass.
+func runArchiver(ctx context.Context, now time.Time) time.Duration {
+	cfg := config()
+	wait := time.Hour
+	pending := 0
+	for _, entry := range readArchiveJournal() {
+		switch entry.Status {
+		case archiveUploaded:
+			if now.Sub(entry.ArchivedAt) > cfg.JobStateTTL {
+				os.Remove(archiveEntryPath(entry.Name))
+			}
+			continue
+		case archiveFailed:
+			continue
+		}
+		if entry.NextAttempt.After(now) {
+			pending++
+			wait = min(wait, entry.NextAttempt.Sub(now))
+			continue
+		}
+
+		entry.Attempts++
+		err := uploadArchive(ctx, entry)
+		if err != nil && ctx.Err() != nil {
+			// Stopped by shutdown; the attempt does not count.
+			break
+		}
+		switch {
+		case err == nil:
+			entry.Status, entry.Error, entry.ArchivedAt = archiveUploaded, "", time.Now()
+			archiveUploads.Add(1)
+			os.Remove(archivePDFPath(entry.Name))
+			slog.Info("Archived fax", "job_id", entry.Metadata.HylaJobID, "uuid", entry.Metadata.UUID, "direction", entry.Metadata.Direction,
+				"key", entry.Key, "attempt", entry.Attempts)
+		case entry.Attempts > cfg.ArchiveRetries:
+			entry.Status, entry.Error = archiveFailed, err.Error()
+			archiveUploadFailures.Add(1)
+			archiveGivenUp.Add(1)
+			slog.Error("Giving up archiving fax until the next start; its copy is kept", "job_id", entry.Metadata.HylaJobID,
+				"uuid", entry.Metadata.UUID, "direction", entry.Metadata.Direction, "file", archivePDFPath(entry.Name),
+				"attempts", entry.Attempts, "err", err)
+		default:
+			entry.Error = err.Error()
+			entry.NextAttempt = time.Now().Add(archiveBackoff(entry.Attempts))
+			archiveUploadFailures.Add(1)
+			pending++
+			wait = min(wait, archiveBackoff(entry.Attempts))
+			slog.Warn("Archiving fax failed; retrying", "job_id", entry.Metadata.HylaJobID, "uuid", entry.Metadata.UUID,
+				"direction", entry.Metadata.Direction, "attempt", entry.Attempts, "retry_in", archiveBackoff(entry.Attempts), "err", err)
+		}
+		if err := writeArchiveEntry(entry); err != nil {
+			slog.Error("Unable to update archive journal", "file", archiveEntryPath(entry.Name), "err", err)
+		}
+		if entry.Metadata.Direction == "inbound" {
+			setRecordArchive(entry.Metadata.UUID, entry)
+			saveState()
+		}
+	}
+	archiver.Lock()
+	archiver.pending = pending
+	archiver.Unlock()
+	return wait
+}
+
+// archiveBackoff is the wait after the given attempt.
+func archiveBackoff(attempt int) time.Duration {
+	delay := config().ArchiveRetryBackoff
+	for i := 1; i < attempt && delay < maxArchiveBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxArchiveBackoff)
+}
+
+// uploadArchive puts the PDF and its sidecar. The sidecar goes last, so its
+// presence in the bucket means the fax is archived.
+func uploadArchive(ctx context.Context, entry archiveEntry) error {
+	data, err := os.ReadFile(archivePDFPath(entry.Name))
+	if err != nil {
+		return err
+	}
+	if err := s3PutObject(ctx, entry.Key, "application/pdf", data); err != nil {
+		return err
+	}
+	meta, err := json.MarshalIndent(entry.Metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s3PutObject(ctx, sidecarKey(entry.Key), "application/json", meta)
+}
+
+// s3ObjectURL returns the URL of an object in ARCHIVE_S3_BUCKET, and its host
+// and path.
+func s3ObjectURL(key string) (target, host, path string, err error) {
+	cfg := config()
+	endpoint, err := url.Parse(cfg.ArchiveS3Endpoint)
+	if err != nil {
+		return "", "", "", err
+	}
+	host = endpoint.Host
+	path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s3Escape(cfg.ArchiveS3Bucket) + "/" + s3Escape(key)
+	if !cfg.ArchiveS3PathStyle {
+		host = cfg.ArchiveS3Bucket + "." + endpoint.Host
+		path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s3Escape(key)
+	}
+	return endpoint.Scheme + "://" + host + path, host, path, nil
+}
+
+// s3PutObject uploads one object, signed with AWS Signature Version 4.
+func s3PutObject(ctx context.Context, key, contentType string, body []byte) error {
+	cfg := config()
+	target, host, path, err := s3ObjectURL(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	headers := map[string]string{
+		"content-type":         contentType,
+		"host":                 host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if cfg.ArchiveS3SessionToken != "" {
+		headers["x-amz-security-token"] = cfg.ArchiveS3SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut, path, "", canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := now.Format("20060102") + "/" + cfg.ArchiveS3Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	signingKey := []byte("AWS4" + cfg.ArchiveS3SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), cfg.ArchiveS3Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.ArchiveS3AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, stringToSign))))
+	req.Host = host
+
+	client := &http.Client{Transport: proxiedTransport(), Timeout: cfg.ArchiveTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<12))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s returned %s: %s", key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes an object key as Signature Version 4 expects,
+// keeping the slashes.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
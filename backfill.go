@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backfillTask computes data that is missing from an existing fax record.
+// It must be idempotent: records that already have the data are left alone
+// and reported as not changed.
+type backfillTask func(key string) (changed bool, err error)
+
+// backfillTasks lists the tasks that can be run through POST /admin/backfill.
+var backfillTasks = map[string]backfillTask{
+	"hashes": backfillContentHash,
+	"pages":  backfillPageCount,
+}
+
+// backfillJob is the persisted state of one backfill run.
+type backfillJob struct {
+	ID          string    `json:"id"`
+	Task        string    `json:"task"`
+	From        time.Time `json:"from,omitempty"`
+	To          time.Time `json:"to,omitempty"`
+	Direction   string    `json:"direction,omitempty"`
+	Concurrency int       `json:"concurrency"`
+	RatePerSec  float64   `json:"rate_per_sec"` // 0 means unlimited
+
+	State     string    `json:"state"` // "running" or "completed"
+	Total     int       `json:"total"`
+	Processed int       `json:"processed"`
+	Updated   int       `json:"updated"`
+	Errors    []string  `json:"errors,omitempty"`
+	Done      []string  `json:"done,omitempty"` // checkpoint: record keys already processed
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at,omitempty"`
+	ETA       string    `json:"eta,omitempty"`
+
+	unsaved int       // records processed since the last checkpoint
+	savedAt time.Time // of the last checkpoint
+}
+
+const maxBackfillErrors = 100
+
+// A running backfill is checkpointed every backfillCheckpointRecords records
+// or backfillCheckpointInterval, whichever comes first, rather than after
+// every record, since each checkpoint rewrites the whole Done set. Records
+// processed after the last checkpoint are run again on resume, which the
+// tasks being idempotent makes harmless.
+const (
+	backfillCheckpointRecords  = 500
+	backfillCheckpointInterval = 5 * time.Second
+)
+
+var backfills = struct {
+	sync.Mutex
+	jobs    map[string]*backfillJob
+	running map[string]string // task -> running job ID
+}{jobs: make(map[string]*backfillJob), running: make(map[string]string)}
+
+func backfillDir() string {
+	return filepath.Join(config().DataDir, "backfill")
+}
+
+// resumeBackfills reloads persisted backfills and restarts the unfinished ones.
+func resumeBackfills() {
+	entries, err := os.ReadDir(backfillDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(backfillDir(), entry.Name()))
+		if err != nil {
+			slog.Error("Error reading backfill checkpoint", "file", entry.Name(), "err", err)
+			continue
+		}
+		var job backfillJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			slog.Error("Error parsing backfill checkpoint", "file", entry.Name(), "err", err)
+			continue
+		}
+
+		backfills.Lock()
+		backfills.jobs[job.ID] = &job
+		resume := job.State == "running" && backfills.running[job.Task] == ""
+		if resume {
+			backfills.running[job.Task] = job.ID
+		}
+		backfills.Unlock()
+
+		if resume {
+			slog.Info("Resuming backfill", "backfill", job.ID, "task", job.Task, "processed", job.Processed, "total", job.Total)
+			go runBackfill(&job)
+		}
+	}
+}
+
+// saveBackfill checkpoints the job. Callers must hold backfills.
+func saveBackfill(job *backfillJob) {
+	job.unsaved, job.savedAt = 0, time.Now()
+	if err := os.MkdirAll(backfillDir(), 0755); err != nil {
+		slog.Error("Error creating backfill directory", "err", err)
+		return
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		slog.Error("Error encoding backfill", "backfill", job.ID, "err", err)
+		return
+	}
+	path := filepath.Join(backfillDir(), job.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		slog.Error("Error saving backfill", "backfill", job.ID, "err", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		slog.Error("Error saving backfill", "backfill", job.ID, "err", err)
+	}
+}
+
+// matchingRecordKeys returns the keys of the fax records selected by the job's filter.
+func matchingRecordKeys(job *backfillJob) []string {
+	faxRecordsMutex.Lock()
+	defer faxRecordsMutex.Unlock()
+
+	var keys []string
+	for key, record := range faxRecords {
+		if !job.From.IsZero() && record.ReceivedAt.Before(job.From) {
+			continue
+		}
+		if !job.To.IsZero() && !record.ReceivedAt.Before(job.To) {
+			continue
+		}
+		if job.Direction != "" && record.Direction != job.Direction {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func runBackfill(job *backfillJob) {
+	task := backfillTasks[job.Task]
+
+	backfills.Lock()
+	done := make(map[string]bool, len(job.Done))
+	for _, key := range job.Done {
+		done[key] = true
+	}
+	keys := matchingRecordKeys(job)
+	job.Total = len(keys)
+	backfills.Unlock()
+
+	var limiter <-chan time.Time
+	if job.RatePerSec > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / job.RatePerSec))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < job.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				changed, err := task(key)
+
+				backfills.Lock()
+				job.Processed++
+				job.Done = append(job.Done, key)
+				if changed {
+					job.Updated++
+				}
+				if err != nil && len(job.Errors) < maxBackfillErrors {
+					job.Errors = append(job.Errors, fmt.Sprintf("%s: %v", key, err))
+				}
+				if elapsed := time.Since(job.StartedAt); job.Processed > 0 {
+					remaining := time.Duration(float64(elapsed) / float64(job.Processed) * float64(job.Total-job.Processed))
+					job.ETA = remaining.Round(time.Second).String()
+				}
+				if job.unsaved++; job.unsaved >= backfillCheckpointRecords || time.Since(job.savedAt) >= backfillCheckpointInterval {
+					saveBackfill(job)
+				}
+				backfills.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		if done[key] {
+			continue
+		}
+		if limiter != nil {
+			<-limiter
+		}
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+
+	backfills.Lock()
+	job.State = "completed"
+	job.EndedAt = time.Now()
+	job.ETA = ""
+	delete(backfills.running, job.Task)
+	saveBackfill(job)
+	backfills.Unlock()
+	if job.Updated > 0 {
+		saveState()
+	}
+	slog.Info("Backfill completed", "backfill", job.ID, "task", job.Task,
+		"processed", job.Processed, "updated", job.Updated, "errors", len(job.Errors))
+}
+
+// backfillContentHash fills in ContentHash for records whose document is still on disk.
+func backfillContentHash(key string) (bool, error) {
+	faxRecordsMutex.Lock()
+	record, ok := faxRecords[key]
+	var path string
+	if ok {
+		if record.ContentHash != "" {
+			faxRecordsMutex.Unlock()
+			return false, nil
+		}
+		path = record.PdfPath
+	}
+	faxRecordsMutex.Unlock()
+	if !ok {
+		return false, errors.New("record no longer exists")
+	}
+	if path == "" {
+		return false, errors.New("record has no stored document")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256Hex(data)
+
+	faxRecordsMutex.Lock()
+	defer faxRecordsMutex.Unlock()
+	if record.ContentHash != "" {
+		return false, nil
+	}
+	record.ContentHash = hash
+	return true, nil
+}
+
+// backfillPageCount fills in Pages for records whose document is still on
+// disk and has a countable number of pages.
+func backfillPageCount(key string) (bool, error) {
+	faxRecordsMutex.Lock()
+	record, ok := faxRecords[key]
+	var path string
+	if ok {
+		if record.Pages > 0 {
+			faxRecordsMutex.Unlock()
+			return false, nil
+		}
+		path = record.PdfPath
+	}
+	faxRecordsMutex.Unlock()
+	if !ok {
+		return false, errors.New("record no longer exists")
+	}
+	if path == "" {
+		return false, errors.New("record has no stored document")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	pages := countDocumentPages(data)
+	if pages == 0 {
+		return false, errors.New("page count of the document is unknown")
+	}
+
+	faxRecordsMutex.Lock()
+	defer faxRecordsMutex.Unlock()
+	if record.Pages > 0 {
+		return false, nil
+	}
+	record.Pages = pages
+	return true, nil
+}
+
+// backfillRequest is the body accepted by POST /admin/backfill.
+type backfillRequest struct {
+	Task        string  `json:"task"` // "hashes" or "pages"
+	From        string  `json:"from"` // RFC 3339
+	To          string  `json:"to"`   // RFC 3339
+	Direction   string  `json:"direction"`
+	Concurrency int     `json:"concurrency"`
+	RatePerSec  float64 `json:"rate_per_sec"`
+}
+
+// registerBackfillRoutes adds the backfill admin endpoints.
+func registerBackfillRoutes(admin iris.Party) {
+	documentRoute(admin.Post("/backfill", func(ctx iris.Context) {
+		var req backfillRequest
+		if err := ctx.ReadJSON(&req); err != nil {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": err.Error()})
+			return
+		}
+		if _, ok := backfillTasks[req.Task]; !ok {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": "unknown backfill task " + req.Task})
+			return
+		}
+
+		job := &backfillJob{
+			ID:          uuid.New().String(),
+			Task:        req.Task,
+			Direction:   req.Direction,
+			Concurrency: req.Concurrency,
+			RatePerSec:  req.RatePerSec,
+			State:       "running",
+			Done:        []string{},
+			StartedAt:   time.Now(),
+		}
+		if job.Concurrency <= 0 {
+			job.Concurrency = 1
+		}
+		for _, field := range []struct {
+			value string
+			dst   *time.Time
+		}{{req.From, &job.From}, {req.To, &job.To}} {
+			if field.value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, field.value)
+			if err != nil {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "invalid time " + field.value})
+				return
+			}
+			*field.dst = t
+		}
+
+		backfills.Lock()
+		if running, busy := backfills.running[job.Task]; busy {
+			backfills.Unlock()
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.JSON(iris.Map{"error": "backfill already running for task " + job.Task, "id": running})
+			return
+		}
+		backfills.running[job.Task] = job.ID
+		backfills.jobs[job.ID] = job
+		saveBackfill(job)
+		backfills.Unlock()
+
+		slog.Info("Backfill started", "backfill", job.ID, "task", job.Task, "actor", ctx.RemoteAddr())
+		go runBackfill(job)
+
+		ctx.StatusCode(iris.StatusAccepted)
+		ctx.JSON(iris.Map{"id": job.ID})
+	}), apiDoc{Summary: "Start a backfill over the fax records", Request: backfillRequest{}, Status: iris.StatusAccepted, Response: struct {
+		ID string `json:"id"`
+	}{}})
+
+	documentRoute(admin.Get("/backfill/{id}", func(ctx iris.Context) {
+		backfills.Lock()
+		defer backfills.Unlock()
+		job, ok := backfills.jobs[ctx.Params().Get("id")]
+		if !ok {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "backfill not found"})
+			return
+		}
+		status := *job
+		status.Done = nil // the checkpoint can be large and is not useful to callers
+		ctx.JSON(status)
+	}), apiDoc{Summary: "Progress of a backfill", Response: backfillJob{}})
+}
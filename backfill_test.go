@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillTasks(t *testing.T) {
+	doc := "%PDF-1.4\n" + strings.Repeat("<< /Type /Page >>\n", 3)
+	tests := []struct {
+		task  string
+		field func(r *FaxJobRecord) any
+		want  any
+	}{
+		{task: "hashes", field: func(r *FaxJobRecord) any { return r.ContentHash }, want: sha256Hex([]byte(doc))},
+		{task: "pages", field: func(r *FaxJobRecord) any { return r.Pages }, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.task, func(t *testing.T) {
+			cfg := useTestConfig(t, nil)
+			pdfPath := filepath.Join(cfg.FTPRoot, "recv", "fax.pdf")
+			writeTestFile(t, pdfPath, doc)
+			faxRecordsMutex.Lock()
+			faxRecords["missing"] = &FaxJobRecord{Direction: "inbound"}
+			faxRecords["stored"] = &FaxJobRecord{Direction: "inbound", PdfPath: pdfPath}
+			faxRecords["filled"] = &FaxJobRecord{Direction: "inbound", PdfPath: pdfPath, ContentHash: sha256Hex([]byte(doc)), Pages: 3}
+			faxRecordsMutex.Unlock()
+
+			job := &backfillJob{ID: "backfill-" + tt.task, Task: tt.task, Concurrency: 2, State: "running", StartedAt: time.Now()}
+			backfills.Lock()
+			backfills.jobs[job.ID] = job
+			backfills.running[job.Task] = job.ID
+			backfills.Unlock()
+			t.Cleanup(func() {
+				backfills.Lock()
+				delete(backfills.jobs, job.ID)
+				delete(backfills.running, job.Task)
+				backfills.Unlock()
+			})
+			runBackfill(job)
+
+			if job.Total != 3 || job.Processed != 3 || job.Updated != 1 || len(job.Errors) != 1 {
+				t.Errorf("total %d, processed %d, updated %d, errors %v; want 3, 3, 1 and one error",
+					job.Total, job.Processed, job.Updated, job.Errors)
+			}
+			faxRecordsMutex.Lock()
+			got := tt.field(faxRecords["stored"])
+			faxRecordsMutex.Unlock()
+			if got != tt.want {
+				t.Errorf("backfilled %v, want %v", got, tt.want)
+			}
+
+			var saved backfillJob
+			data, err := os.ReadFile(filepath.Join(backfillDir(), job.ID+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, &saved); err != nil {
+				t.Fatal(err)
+			}
+			if saved.State != "completed" || saved.Processed != 3 || len(saved.Done) != 3 {
+				t.Errorf("checkpoint state %q, processed %d, done %v; want completed, 3 and every record", saved.State, saved.Processed, saved.Done)
+			}
+
+			// Running it again finds nothing to do.
+			again := &backfillJob{ID: "again-" + tt.task, Task: tt.task, Concurrency: 1, State: "running", StartedAt: time.Now()}
+			runBackfill(again)
+			if again.Updated != 0 {
+				t.Errorf("second run updated %d records", again.Updated)
+			}
+		})
+	}
+}
+
+// TestBackfillCheckpoint checks that a run is checkpointed every
+// backfillCheckpointRecords records rather than after every record.
+func TestBackfillCheckpoint(t *testing.T) {
+	useTestConfig(t, nil)
+	faxRecordsMutex.Lock()
+	for i := 0; i < backfillCheckpointRecords*2+1; i++ {
+		faxRecords[fmt.Sprintf("fax-%04d", i)] = &FaxJobRecord{Direction: "inbound"}
+	}
+	faxRecordsMutex.Unlock()
+
+	job := &backfillJob{ID: "checkpoint", Task: "count-checkpoints", Concurrency: 1, State: "running", StartedAt: time.Now()}
+	var checkpoints []int // Processed at each checkpoint seen by the task
+	var last time.Time
+	backfillTasks[job.Task] = func(key string) (bool, error) {
+		backfills.Lock()
+		defer backfills.Unlock()
+		if job.savedAt != last {
+			last = job.savedAt
+			checkpoints = append(checkpoints, job.Processed)
+		}
+		return false, nil
+	}
+	t.Cleanup(func() {
+		delete(backfillTasks, job.Task)
+		backfills.Lock()
+		delete(backfills.jobs, job.ID)
+		delete(backfills.running, job.Task)
+		backfills.Unlock()
+	})
+	backfills.Lock()
+	backfills.jobs[job.ID] = job
+	saveBackfill(job)
+	backfills.Unlock()
+	runBackfill(job)
+
+	want := []int{0, backfillCheckpointRecords, backfillCheckpointRecords * 2}
+	if !slices.Equal(checkpoints, want) {
+		t.Errorf("checkpoints after %v records, want %v", checkpoints, want)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A .sfc whose number line lists several destinations, separated by commas or
+// semicolons, is a broadcast. It keeps the one Hylafax job ID Synergy knows
+// about, but the document is submitted once per destination and each accepted
+// submission is tracked in jobQueue on its own. While destinations are
+// outstanding the .sts shows how many have been sent and how many failed; once
+// every destination has a result the job ends with .done if all were sent, or
+// .fail if any failed.
+
+// Destination states.
+const (
+	broadcastPending   = "pending" // not yet submitted
+	broadcastSubmitted = "submitted"
+	broadcastSent      = "sent"
+	broadcastFailed    = "failed"
+)
+
+type broadcastDestination struct {
+	Number  string `json:"number"`
+	JobUUID string `json:"job_uuid,omitempty"`
+	State   string `json:"state"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type broadcastJob struct {
+	HylaJobID    string                  `json:"hyla_job_id"`
+	SfcPath      string                  `json:"sfc_path"`
+	PdfPath      string                  `json:"pdf_path"`
+	Pages        int                     `json:"pages,omitempty"`
+	Destinations []*broadcastDestination `json:"destinations"`
+}
+
+// counts returns how many destinations were sent, failed and are still open.
+func (b *broadcastJob) counts() (sent, failed, open int) {
+	for _, d := range b.Destinations {
+		switch d.State {
+		case broadcastSent:
+			sent++
+		case broadcastFailed:
+			failed++
+		default:
+			open++
+		}
+	}
+	return sent, failed, open
+}
+
+// broadcasts holds the broadcasts that still have open destinations, keyed by
+// Hylafax job ID.
+var broadcasts = struct {
+	sync.Mutex
+	jobs map[string]*broadcastJob
+}{jobs: make(map[string]*broadcastJob)}
+
+// splitFaxNumbers splits a .sfc number line into its destinations. A comma
+// is also a dial pause, so a few digits before one, as in "9,16045551234",
+// stay with the number that follows.
+func splitFaxNumbers(line string) []string {
+	var numbers []string
+	for _, group := range strings.Split(line, ";") {
+		pending := "" // dial prefix and pauses waiting for their number
+		for _, part := range strings.Split(group, ",") {
+			part = strings.TrimSpace(part)
+			switch {
+			case part == "":
+				if pending != "" {
+					pending += ","
+				}
+			case pending == "" && isDialPrefix(part):
+				pending = part + ","
+			default:
+				numbers = append(numbers, pending+part)
+				pending = ""
+			}
+		}
+		if pending = strings.TrimRight(pending, ","); pending != "" {
+			numbers = append(numbers, pending)
+		}
+	}
+	return numbers
+}
+
+// isDialPrefix reports whether s is too short to be a number, e.g. the "9"
+// dialled for an outside line.
+func isDialPrefix(s string) bool {
+	if len(s) > 4 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverBroadcast submits the document once per destination. It returns the
+// job UUID of the first accepted submission, or an error if none was accepted.
+func deliverBroadcast(numbers []string, callerID, pdfFile, pdfPath, sfcFileName, user, jobID, hylaJobID string) (string, error) {
+	ctx := startJobContext(hylaJobID)
+	defer endJobContext(hylaJobID)
+
+	b := &broadcastJob{HylaJobID: hylaJobID, SfcPath: jobFile(hylaJobID, sfcFileName), PdfPath: pdfPath}
+	for _, number := range numbers {
+		b.Destinations = append(b.Destinations, &broadcastDestination{Number: number, State: broadcastPending})
+	}
+	broadcasts.Lock()
+	broadcasts.jobs[hylaJobID] = b
+	broadcasts.Unlock()
+	slog.Info("Broadcasting fax", "job_id", hylaJobID, "synergy_job_id", jobID, "destinations", len(numbers), "file", pdfPath)
+
+	fileData, err := readFaxDocument(pdfPath)
+	if err != nil {
+		slog.Error("Error reading PDF file", "job_id", hylaJobID, "file", pdfPath, "err", err)
+		for i := range numbers {
+			resolveBroadcastDestination(hylaJobID, i, false, documentErrorStatus(err))
+		}
+		return "", err
+	}
+	pages := countDocumentPages(fileData)
+	broadcasts.Lock()
+	b.Pages = pages
+	broadcasts.Unlock()
+
+	var firstUUID string
+	for i, number := range numbers {
+		// Each destination is a fax against the user's quota.
+		reservation, err := reserveUserQuota(user, pages)
+		if err != nil {
+			slog.Warn("Broadcast destination rejected by user quota", "job_id", hylaJobID, "number", number, "user", user, "err", err)
+			resolveBroadcastDestination(hylaJobID, i, false, "failed: "+err.Error())
+			continue
+		}
+		sub, status, err := postFaxSubmission(ctx, number, callerID, pdfFile, pdfPath, hylaJobID, fileData)
+		if err != nil {
+			reservation.release()
+		}
+		if errors.Is(err, errJobCancelled) {
+			reason := cancelReason(ctx)
+			jobsCancelled.Add(1)
+			slaJobExcluded(hylaJobID, "cancelled")
+			slog.Info("Fax job cancelled", "job_id", hylaJobID, "reason", reason, "destinations_left", len(numbers)-i)
+			for j := i; j < len(numbers); j++ {
+				resolveBroadcastDestination(hylaJobID, j, false, reason)
+			}
+			return firstUUID, errJobCancelled
+		}
+		if err != nil {
+			if status == "" {
+				status = "failed: " + err.Error()
+			}
+			slog.Error("Broadcast destination not submitted", "job_id", hylaJobID, "number", number, "err", err)
+			recordDeliveryOutcome(false, false, 0)
+			resolveBroadcastDestination(hylaJobID, i, false, status)
+			continue
+		}
+
+		// Mark the destination before queueing it, since its notify may
+		// arrive as soon as it is in jobQueue.
+		broadcasts.Lock()
+		b.Destinations[i].State = broadcastSubmitted
+		b.Destinations[i].JobUUID = sub.resp.JobUUID
+		broadcasts.Unlock()
+		addFaxJob(sub.resp.JobUUID, jobID, hylaJobID, jobQ{
+			pdfPath:        pdfPath,
+			sfcPath:        jobFile(hylaJobID, sfcFileName),
+			user:           user,
+			partFilename:   sub.partFilename,
+			partType:       sub.partType,
+			credential:     sub.credential,
+			route:          sub.route,
+			pages:          pages,
+			faxUUID:        sub.resp.FaxUUID,
+			callUUID:       sub.resp.CallUUID,
+			broadcastIndex: i + 1,
+		})
+		if firstUUID == "" {
+			firstUUID = sub.resp.JobUUID
+			slaJobSubmitted(hylaJobID)
+		}
+		slog.Info("Fax submitted successfully", "job_id", hylaJobID, "synergy_job_id", jobID, "uuid", sub.resp.JobUUID,
+			"direction", "outbound", "number", number, "file", pdfPath, "user", user,
+			"destination", fmt.Sprintf("%d/%d", i+1, len(numbers)))
+	}
+	if firstUUID == "" {
+		return "", fmt.Errorf("none of the %d destinations accepted the fax", len(numbers))
+	}
+
+	broadcasts.Lock()
+	if _, open := broadcasts.jobs[hylaJobID]; open {
+		writeBroadcastStatus(b)
+	}
+	broadcasts.Unlock()
+	return firstUUID, nil
+}
+
+// writeBroadcastStatus writes the .sts for a broadcast that is still open.
+// Callers hold broadcasts, so a later progress .sts cannot overwrite the final
+// one.
+func writeBroadcastStatus(b *broadcastJob) {
+	sent, failed, _ := b.counts()
+	status := fmt.Sprintf("%d of %d destinations sent", sent, len(b.Destinations))
+	if failed > 0 {
+		status += fmt.Sprintf(", %d failed", failed)
+	}
+	if err := createStsFile(b.HylaJobID, stsStateSleeping, "", pagesField(b.Pages), status); err != nil {
+		slog.Error("Error updating .sts", "job_id", b.HylaJobID, "err", err)
+	}
+}
+
+// resolveBroadcastDestination records the result for destination index of a
+// broadcast. When it was the last open destination, the job's .done or .fail
+// is written. Callers must not hold broadcasts or the locks saveState takes.
+func resolveBroadcastDestination(hylaJobID string, index int, success bool, reason string) {
+	broadcasts.Lock()
+	b, ok := broadcasts.jobs[hylaJobID]
+	if !ok || index < 0 || index >= len(b.Destinations) {
+		broadcasts.Unlock()
+		slog.Warn("Result for unknown broadcast destination", "job_id", hylaJobID, "destination", index+1)
+		return
+	}
+	d := b.Destinations[index]
+	if d.State == broadcastSent || d.State == broadcastFailed {
+		broadcasts.Unlock()
+		return
+	}
+	if success {
+		d.State = broadcastSent
+	} else {
+		d.State, d.Reason = broadcastFailed, reason
+	}
+	sent, failed, open := b.counts()
+	if open > 0 {
+		writeBroadcastStatus(b)
+		broadcasts.Unlock()
+		return
+	}
+	delete(broadcasts.jobs, hylaJobID)
+	broadcasts.Unlock()
+
+	total := len(b.Destinations)
+	slaJobCompleted(hylaJobID, failed == 0)
+	if failed == 0 {
+		slog.Info("Broadcast completed", "job_id", hylaJobID, "destinations", total)
+		createStsFile(hylaJobID, stsStateDone, pagesField(b.Pages), pagesField(b.Pages), "success")
+		createFile(jobFile(hylaJobID, fmt.Sprintf("q%s.done", hylaJobID)), "\r")
+		cleanUpSentJob(hylaJobID, b.SfcPath, b.PdfPath)
+		return
+	}
+	slog.Info("Broadcast failed", "job_id", hylaJobID, "destinations", total, "sent", sent, "failed", failed)
+	var failedNumbers, reasons []string
+	for _, d := range b.Destinations {
+		if d.State == broadcastFailed {
+			failedNumbers = append(failedNumbers, d.Number)
+			reasons = append(reasons, d.Number+": "+d.Reason)
+		}
+	}
+	deadLetterJob(hylaJobID, fmt.Sprintf("failed: %d of %d destinations failed", failed, total), strings.Join(reasons, "; "),
+		b.SfcPath, b.PdfPath, failedNumbers...)
+}
+
+// completeBroadcastDestination handles the notify result for one destination
+// of a broadcast.
+func completeBroadcastDestination(jobQq jobQ, job FaxJob) {
+	job.Result.Success = mapNotifyStatus(job).success()
+	if job.Result.Success {
+		slog.Info("Notify indicates broadcast destination completed", "uuid", job.UUID, "job_id", jobQq.hylaJobID,
+			"direction", "outbound", "destination", jobQq.broadcastIndex)
+		recordDeliveryOutcome(false, true, time.Since(jobQq.acceptedAt))
+	} else {
+		slog.Info("Notify indicates broadcast destination failed", "uuid", job.UUID, "job_id", jobQq.hylaJobID,
+			"direction", "outbound", "destination", jobQq.broadcastIndex, "reason", job.Result.ResultText)
+		recordDeliveryOutcome(false, false, 0)
+	}
+	resolveBroadcastDestination(jobQq.hylaJobID, jobQq.broadcastIndex-1, job.Result.Success, job.Result.ResultText)
+}
+
+// snapshotBroadcasts returns the open broadcasts for saveState.
+func snapshotBroadcasts() []broadcastJob {
+	broadcasts.Lock()
+	defer broadcasts.Unlock()
+	out := make([]broadcastJob, 0, len(broadcasts.jobs))
+	for _, b := range broadcasts.jobs {
+		c := *b
+		c.Destinations = make([]*broadcastDestination, len(b.Destinations))
+		for i, d := range b.Destinations {
+			dc := *d
+			c.Destinations[i] = &dc
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// restoreBroadcasts puts saved broadcasts back. Destinations that were never
+// submitted before the restart are failed, since their submission was lost.
+func restoreBroadcasts(saved []broadcastJob) {
+	type destination struct {
+		hylaJobID string
+		index     int
+	}
+	var lost []destination
+	broadcasts.Lock()
+	for i := range saved {
+		b := &saved[i]
+		broadcasts.jobs[b.HylaJobID] = b
+		setJobDir(b.HylaJobID, filepath.Dir(b.SfcPath))
+		for j, d := range b.Destinations {
+			if d.State == broadcastPending {
+				lost = append(lost, destination{b.HylaJobID, j})
+			}
+		}
+	}
+	broadcasts.Unlock()
+
+	for _, l := range lost {
+		resolveBroadcastDestination(l.hylaJobID, l.index, false, "failed: not submitted before restart")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitFaxNumbers(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{line: "6045551234", want: []string{"6045551234"}},
+		{line: "6045551234,6045555678", want: []string{"6045551234", "6045555678"}},
+		{line: "6045551234; 6045555678 ;2505550000", want: []string{"6045551234", "6045555678", "2505550000"}},
+		{line: "9,16045551234", want: []string{"9,16045551234"}},
+		{line: "9,,16045551234,9,6045555678", want: []string{"9,,16045551234", "9,6045555678"}},
+		{line: "6045551234,,", want: []string{"6045551234"}},
+		{line: " ; ", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			if got := splitFaxNumbers(tt.line); !slices.Equal(got, tt.want) {
+				t.Errorf("splitFaxNumbers(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	tests := []struct {
+		name     string
+		numbers  []string
+		rejected string          // a number the webhook refuses
+		failed   map[string]bool // numbers whose notify reports a failure
+		done     bool
+		status   string // final .sts status
+	}{
+		{name: "one destination", numbers: []string{"+16045550001"}, done: true, status: "success"},
+		{name: "two destinations", numbers: []string{"+16045550001", "+16045550002"}, done: true, status: "success"},
+		{name: "five destinations", numbers: []string{"+16045550001", "+16045550002", "+16045550003", "+16045550004", "+16045550005"},
+			done: true, status: "success"},
+		{name: "one notify fails", numbers: []string{"+16045550001", "+16045550002", "+16045550003", "+16045550004"},
+			failed: map[string]bool{"+16045550003": true}, status: "failed: 1 of 4 destinations failed"},
+		{name: "one submission refused", numbers: []string{"+16045550001", "+16045550002", "+16045550003"},
+			rejected: "+16045550002", status: "failed: 1 of 3 destinations failed"},
+		{name: "every notify fails", numbers: []string{"+16045550001", "+16045550002"},
+			failed: map[string]bool{"+16045550001": true, "+16045550002": true}, status: "failed: 2 of 2 destinations failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				number := r.FormValue("callee_number")
+				if number == tt.rejected {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				fmt.Fprintf(w, `{"job_uuid":"job%s"}`, number)
+			}))
+			defer server.Close()
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL, "SEND_WEBHOOK_RETRIES": "1"})
+			dir := cfg.FTPRoot + FaxDir
+			line := strings.Join(tt.numbers, ",")
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), line+"\nfax0001.pdf\n")
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+			t.Cleanup(func() {
+				broadcasts.Lock()
+				delete(broadcasts.jobs, "42")
+				broadcasts.Unlock()
+			})
+
+			// submitFax has normalized the numbers by the time deliverFax runs.
+			if _, err := deliverFax(line, "", "fax0001.pdf", filepath.Join(dir, "fax0001.pdf"), "fax0001.sfc", "", "fax0001", "42", 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			sent, failed := 0, 0
+			if tt.rejected != "" {
+				failed++
+			}
+			for i, number := range tt.numbers {
+				if number == tt.rejected {
+					continue
+				}
+				if fileExists(filepath.Join(dir, "q42.done")) || fileExists(filepath.Join(dir, "q42.fail")) {
+					t.Fatalf("job finished with %d destinations open", len(tt.numbers)-i)
+				}
+				body := fmt.Sprintf(`{"fax_job_results":{"results":{"1":{"uuid":"job%s","status":"completed","result":{"success":true}}}}}`, number)
+				if tt.failed[number] {
+					body = fmt.Sprintf(`{"fax_job_results":{"results":{"1":{"uuid":"job%s","status":"failed","result":{"result_text":"REJECTED"}}}}}`, number)
+					failed++
+				} else {
+					sent++
+				}
+				req := httptest.NewRequest("POST", "/fax-notify", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				if rec := serveTestRequest(t, registerProviderRoutes, req); rec.Code != 200 {
+					t.Fatalf("notify status %d: %s", rec.Code, rec.Body)
+				}
+				if sent+failed == len(tt.numbers) {
+					break
+				}
+				want := fmt.Sprintf("%d of %d destinations sent", sent, len(tt.numbers))
+				if failed > 0 {
+					want += fmt.Sprintf(", %d failed", failed)
+				}
+				if sts := stsFields(t, "42"); sts["status"] != want {
+					t.Errorf("after %d notifies .sts status %q, want %q", i+1, sts["status"], want)
+				}
+			}
+
+			if got := fileExists(filepath.Join(dir, "q42.done")); got != tt.done {
+				t.Errorf("q42.done exists = %v, want %v", got, tt.done)
+			}
+			if got := fileExists(filepath.Join(dir, "q42.fail")); got == tt.done {
+				t.Errorf("q42.fail exists = %v, want %v", got, !tt.done)
+			}
+			if sts := stsFields(t, "42"); sts["status"] != tt.status {
+				t.Errorf(".sts status %q, want %q", sts["status"], tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// CAPTURE_DIR records the service's inputs for `synergymatters_fax replay`:
+// every authenticated /fax-receive and /fax-notify request, and the .sfc and
+// PDF of every job when the two are paired, each as one captureEntry in
+// <seq>.json. Sequence numbers continue from the files already in the
+// directory, so one capture can span restarts. Requests sent by the replay
+// tool are not captured again.
+
+// captureSeq numbers capture entries in the order they are written.
+var captureSeq = struct {
+	sync.Mutex
+	next   int
+	loaded bool
+}{}
+
+// writeCapture assigns entry the next sequence number and writes it to
+// CAPTURE_DIR. An entry without a key is keyed by its sequence number.
+func writeCapture(entry captureEntry) {
+	dir := config().CaptureDir
+	if dir == "" {
+		return
+	}
+	captureSeq.Lock()
+	defer captureSeq.Unlock()
+	if !captureSeq.loaded {
+		captureSeq.next = lastCaptureSeq(dir) + 1
+		captureSeq.loaded = true
+	}
+	entry.Seq = captureSeq.next
+	if entry.Key == "" {
+		entry.Key = strconv.Itoa(entry.Seq)
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%09d.json", entry.Seq))
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		slog.Warn("Error writing capture entry", "kind", entry.Kind, "key", entry.Key, "err", err)
+		return
+	}
+	captureSeq.next++
+}
+
+// lastCaptureSeq returns the highest sequence number in dir, or 0.
+func lastCaptureSeq(dir string) int {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	last := 0
+	for _, path := range paths {
+		if n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".json")); err == nil && n > last {
+			last = n
+		}
+	}
+	return last
+}
+
+// teeBody is a request body whose reads are copied to a buffer.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// captureWebhook records a provider request once its handler has read the
+// body. It goes after the route's authentication, so rejected callers are
+// not captured.
+func captureWebhook(kind string) iris.Handler {
+	return func(ctx iris.Context) {
+		if config().CaptureDir == "" || ctx.GetHeader("X-Replayed") == "true" {
+			ctx.Next()
+			return
+		}
+		arrived := time.Now()
+		var body bytes.Buffer
+		req := ctx.Request()
+		req.Body = teeBody{Reader: io.TeeReader(req.Body, &body), Closer: req.Body}
+		ctx.Next()
+
+		entry := captureEntry{Time: arrived, Kind: kind, ContentType: req.Header.Get("Content-Type"), Query: req.URL.RawQuery}
+		if json.Valid(body.Bytes()) {
+			entry.Body = json.RawMessage(body.Bytes())
+		} else {
+			entry.Data = base64.StdEncoding.EncodeToString(body.Bytes())
+		}
+		entry.Key = captureKey(kind, body.Bytes(), ctx.URLParam("uuid"))
+		writeCapture(entry)
+	}
+}
+
+// captureKey returns the UUID a request is about: the received fax's, or the
+// comma-separated job UUIDs of a notify.
+func captureKey(kind string, body []byte, queryUUID string) string {
+	if kind == "fax-notify" {
+		var payload WebhookPayload
+		if json.Unmarshal(body, &payload) != nil {
+			return ""
+		}
+		var uuids []string
+		for _, job := range payload.FaxJobResults.Results {
+			uuids = append(uuids, job.UUID)
+		}
+		if len(uuids) == 0 && payload.FaxJobResults.FaxJob.UUID != "" {
+			uuids = append(uuids, payload.FaxJobResults.FaxJob.UUID)
+		}
+		sort.Strings(uuids)
+		return strings.Join(uuids, ",")
+	}
+	var fax struct {
+		UUID string `json:"uuid"`
+	}
+	if json.Unmarshal(body, &fax) == nil && fax.UUID != "" {
+		return fax.UUID
+	}
+	return queryUUID
+}
+
+// captureJobFiles records the .sfc and PDF of a job as they are paired.
+func captureJobFiles(sfcPath, pdfPath string) {
+	if config().CaptureDir == "" {
+		return
+	}
+	for _, path := range []string{sfcPath, pdfPath} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("Error capturing queue file", "file", path, "err", err)
+			continue
+		}
+		entry := captureEntry{Time: time.Now(), Kind: "file", Key: filepath.Base(path), Name: filepath.Base(path),
+			Data: base64.StdEncoding.EncodeToString(data)}
+		if info, err := os.Stat(path); err == nil {
+			entry.Time = info.ModTime()
+		}
+		writeCapture(entry)
+	}
+}
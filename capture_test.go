@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kataras/iris/v12"
+)
+
+func TestCaptureKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  string
+		body  string
+		query string
+		want  string
+	}{
+		{name: "received fax", kind: "fax-receive", body: `{"uuid":"fax-uuid","cidnum":"6045551234"}`, want: "fax-uuid"},
+		{name: "raw PDF", kind: "fax-receive", body: "%PDF-1.4\n", query: "fax-uuid", want: "fax-uuid"},
+		{name: "notify results", kind: "fax-notify", body: `{"fax_job_results":{"results":{"2":{"uuid":"job-b"},"1":{"uuid":"job-a"}}}}`, want: "job-a,job-b"},
+		{name: "notify job", kind: "fax-notify", body: `{"fax_job_results":{"fax_job":{"uuid":"job-a"}}}`, want: "job-a"},
+		{name: "bad notify", kind: "fax-notify", body: "{", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := captureKey(tt.kind, []byte(tt.body), tt.query); got != tt.want {
+				t.Errorf("captureKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaptureWebhook(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		replayed    bool
+		want        captureEntry // Seq 0: nothing captured
+	}{
+		{name: "JSON", contentType: "application/json", body: `{"uuid":"fax-uuid"}`,
+			want: captureEntry{Seq: 1, Kind: "fax-receive", Key: "fax-uuid", ContentType: "application/json", Body: []byte(`{"uuid":"fax-uuid"}`)}},
+		{name: "raw PDF", contentType: "application/pdf", body: "%PDF-1.4\n",
+			want: captureEntry{Seq: 1, Kind: "fax-receive", Key: "1", ContentType: "application/pdf", Data: base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n"))}},
+		{name: "replayed", contentType: "application/json", body: `{"uuid":"fax-uuid"}`, replayed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"CAPTURE_DIR": filepath.Join(t.TempDir(), "capture")})
+			captureSeq.Lock()
+			captureSeq.loaded = false
+			captureSeq.Unlock()
+
+			app := iris.New()
+			app.Post("/fax-receive", captureWebhook("fax-receive"), func(ctx iris.Context) {
+				ctx.GetBody()
+			})
+			if err := app.Build(); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("POST", "/fax-receive", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.replayed {
+				req.Header.Set("X-Replayed", "true")
+			}
+			app.ServeHTTP(httptest.NewRecorder(), req)
+
+			entries, err := loadCapture(cfg.CaptureDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want.Seq == 0 {
+				if len(entries) != 0 {
+					t.Errorf("captured %d entries, want none", len(entries))
+				}
+				return
+			}
+			if len(entries) != 1 {
+				t.Fatalf("captured %d entries, want 1", len(entries))
+			}
+			got := entries[0]
+			if got.Time.IsZero() {
+				t.Error("entry has no time")
+			}
+			got.Time = tt.want.Time
+			if got.Seq != tt.want.Seq || got.Kind != tt.want.Kind || got.Key != tt.want.Key || got.ContentType != tt.want.ContentType ||
+				string(got.Body) != string(tt.want.Body) || got.Data != tt.want.Data {
+				t.Errorf("captured %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCaptureContinuesNumbering(t *testing.T) {
+	cfg := useTestConfig(t, map[string]string{"CAPTURE_DIR": t.TempDir()})
+	writeTestFile(t, filepath.Join(cfg.CaptureDir, "000000007.json"), `{"seq":7}`)
+	captureSeq.Lock()
+	captureSeq.loaded = false
+	captureSeq.Unlock()
+
+	writeCapture(captureEntry{Kind: "file", Key: "fax0001.sfc", Name: "fax0001.sfc"})
+	entries, err := loadCapture(cfg.CaptureDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Seq != 8 {
+		t.Errorf("entries = %+v, want the new one numbered 8", entries)
+	}
+}
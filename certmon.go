@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// monitoredCert is one certificate watched for expiry.
+type monitoredCert struct {
+	Source   string    `json:"source"` // where the certificate was found
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+	Error    string    `json:"error,omitempty"` // set when the source could not be read
+}
+
+// certMonitor tracks every configured TLS certificate and warns, in the log
+// and with a cert_expiring security event, as each one crosses the
+// CERT_WARN_DAYS thresholds.
+var certMonitor = struct {
+	sync.Mutex
+	listeners []listenerConfig
+	certs     []monitoredCert
+	warned    map[string]int // source+subject -> lowest threshold already warned about
+	refresh   chan struct{}
+}{warned: make(map[string]int), refresh: make(chan struct{}, 1)}
+
+func init() {
+	expvar.Publish("certificates", expvar.Func(func() any { return monitoredCerts() }))
+}
+
+// startCertMonitor checks the certificates now and then every CERT_CHECK_INTERVAL (default 12h).
+func startCertMonitor(listeners []listenerConfig) {
+	certMonitor.Lock()
+	certMonitor.listeners = listeners
+	certMonitor.Unlock()
+
+	interval := config().CertCheckInterval
+	checkCertificates()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-certMonitor.refresh:
+			}
+			checkCertificates()
+		}
+	}()
+}
+
+// refreshCertMonitor re-reads every certificate, e.g. after renewed certs are installed.
+func refreshCertMonitor() {
+	select {
+	case certMonitor.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func monitoredCerts() []monitoredCert {
+	certMonitor.Lock()
+	defer certMonitor.Unlock()
+	return append([]monitoredCert(nil), certMonitor.certs...)
+}
+
+func checkCertificates() {
+	certMonitor.Lock()
+	listeners := certMonitor.listeners
+	certMonitor.Unlock()
+
+	var certs []monitoredCert
+	for _, l := range listeners {
+		if l.TLSCertFile != "" {
+			certs = append(certs, certsFromFile(fmt.Sprintf("listener %s certificate", l.Name), l.TLSCertFile)...)
+		}
+		if l.ClientCAFile != "" {
+			certs = append(certs, certsFromFile(fmt.Sprintf("listener %s client CA", l.Name), l.ClientCAFile)...)
+		}
+	}
+	cfg := config()
+	if cfg.SendWebhookClientCert != "" {
+		certs = append(certs, certsFromFile("send webhook client certificate", cfg.SendWebhookClientCert)...)
+	}
+	if cfg.SendWebhookCAFile != "" {
+		certs = append(certs, certsFromFile("send webhook CA", cfg.SendWebhookCAFile)...)
+	}
+	certs = append(certs, providerCerts(cfg.SendWebhookURL)...)
+
+	thresholds := cfg.certWarnDays
+	now := time.Now()
+
+	certMonitor.Lock()
+	defer certMonitor.Unlock()
+	for i := range certs {
+		c := &certs[i]
+		if c.Error != "" {
+			slog.Error("Certificate monitor cannot read certificate", "source", c.Source, "err", c.Error)
+			continue
+		}
+		c.DaysLeft = int(c.NotAfter.Sub(now).Hours() / 24)
+
+		// Find the lowest threshold crossed and warn once per threshold.
+		key := c.Source + "|" + c.Subject
+		crossed, found := 0, false
+		for _, threshold := range thresholds {
+			if c.DaysLeft <= threshold {
+				crossed, found = threshold, true
+			}
+		}
+		if last, ok := certMonitor.warned[key]; found && (!ok || crossed < last) {
+			certMonitor.warned[key] = crossed
+			slog.Warn("Certificate expires soon", "subject", c.Subject, "source", c.Source,
+				"days_left", c.DaysLeft, "not_after", c.NotAfter.Format(time.RFC3339))
+			emitSecurityEvent(SecurityEvent{Type: secEventCertExpiring, Target: c.Source, Outcome: "failure",
+				Detail: fmt.Sprintf("%s expires in %d days (%s), past the %d-day warning", c.Subject, c.DaysLeft, c.NotAfter.Format(time.RFC3339), crossed)})
+		}
+		if len(thresholds) > 0 && c.DaysLeft > thresholds[0] {
+			// Renewed since the last warning; warn again next time it runs low.
+			delete(certMonitor.warned, key)
+		}
+	}
+	certMonitor.certs = certs
+}
+
+// certsFromFile parses every certificate in a PEM file.
+func certsFromFile(source, path string) []monitoredCert {
+	source = source + " (" + path + ")"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []monitoredCert{{Source: source, Error: err.Error()}}
+	}
+
+	var certs []monitoredCert
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			certs = append(certs, monitoredCert{Source: source, Error: err.Error()})
+			continue
+		}
+		certs = append(certs, monitoredCert{Source: source, Subject: cert.Subject.String(), NotAfter: cert.NotAfter})
+	}
+	if len(certs) == 0 {
+		return []monitoredCert{{Source: source, Error: "no certificates found"}}
+	}
+	return certs
+}
+
+// providerCerts fetches the chain served by the send webhook when it uses
+// HTTPS. The HEAD request goes through the send webhook's transport, so it
+// takes OUTBOUND_PROXY_URL and trusts SEND_WEBHOOK_CA_FILE as submissions do.
+func providerCerts(webhookURL string) []monitoredCert {
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Scheme != "https" {
+		return nil
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	source := "provider " + host
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, webhookURL, nil)
+	if err != nil {
+		return []monitoredCert{{Source: source, Error: err.Error()}}
+	}
+	client := &http.Client{
+		Transport: sendTransport(),
+		// The chain of interest is the webhook host's, not a redirect target's.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return []monitoredCert{{Source: source, Error: err.Error()}}
+	}
+	resp.Body.Close()
+	if resp.TLS == nil {
+		return []monitoredCert{{Source: source, Error: "response was not sent over TLS"}}
+	}
+
+	var certs []monitoredCert
+	for _, cert := range resp.TLS.PeerCertificates {
+		certs = append(certs, monitoredCert{Source: source, Subject: cert.Subject.String(), NotAfter: cert.NotAfter})
+	}
+	return certs
+}
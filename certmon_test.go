@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed PEM certificate for cn expiring at notAfter.
+func writeTestCert(t *testing.T, path, cn string, notAfter time.Time) {
+	t.Helper()
+	writeTestKeyPair(t, path, "", cn, notAfter)
+}
+
+// writeTestKeyPair writes a self-signed PEM certificate for cn expiring at
+// notAfter, and its key to keyPath unless it is "".
+func writeTestKeyPair(t *testing.T, path, keyPath, cn string, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: cn},
+		NotBefore: notAfter.AddDate(-1, 0, 0), NotAfter: notAfter}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	if keyPath != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, keyPath, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	}
+}
+
+func TestCertsFromFile(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second).UTC()
+	writeTestCert(t, filepath.Join(dir, "cert.pem"), "fax.example.com", notAfter)
+	writeTestFile(t, filepath.Join(dir, "empty.pem"), "not a certificate\n")
+
+	tests := []struct {
+		name    string
+		file    string
+		subject string
+		wantErr bool
+	}{
+		{name: "certificate", file: "cert.pem", subject: "CN=fax.example.com"},
+		{name: "missing file", file: "missing.pem", wantErr: true},
+		{name: "no certificates", file: "empty.pem", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certs := certsFromFile("test", filepath.Join(dir, tt.file))
+			if len(certs) != 1 {
+				t.Fatalf("certsFromFile() returned %d certificates, want 1", len(certs))
+			}
+			if (certs[0].Error != "") != tt.wantErr {
+				t.Fatalf("error %q, wantErr %v", certs[0].Error, tt.wantErr)
+			}
+			if !tt.wantErr && (certs[0].Subject != tt.subject || !certs[0].NotAfter.Equal(notAfter)) {
+				t.Errorf("certificate %s expiring %s, want %s expiring %s", certs[0].Subject, certs[0].NotAfter, tt.subject, notAfter)
+			}
+		})
+	}
+}
+
+func TestCheckCertificatesWarnings(t *testing.T) {
+	tests := []struct {
+		name     string
+		daysLeft []int // at each successive check
+		events   int
+	}{
+		{name: "far from expiry", daysLeft: []int{60}},
+		{name: "first threshold", daysLeft: []int{20}, events: 1},
+		{name: "same threshold twice", daysLeft: []int{20, 15}, events: 1},
+		{name: "next threshold", daysLeft: []int{20, 5}, events: 2},
+		{name: "renewed, then low again", daysLeft: []int{20, 60, 20}, events: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, map[string]string{"CERT_WARN_DAYS": "30,7,1"})
+			events := captureSecurityEvents(t)
+			path := filepath.Join(t.TempDir(), "cert.pem")
+			certMonitor.Lock()
+			certMonitor.listeners = []listenerConfig{{Name: "main", TLSCertFile: path}}
+			certMonitor.warned = make(map[string]int)
+			certMonitor.Unlock()
+			t.Cleanup(func() {
+				certMonitor.Lock()
+				certMonitor.listeners, certMonitor.certs = nil, nil
+				certMonitor.Unlock()
+			})
+
+			for _, days := range tt.daysLeft {
+				writeTestCert(t, path, "fax.example.com", time.Now().Add(time.Duration(days)*24*time.Hour+time.Hour))
+				checkCertificates()
+			}
+			if got := len(events()); got != tt.events {
+				t.Errorf("%d cert_expiring events, want %d", got, tt.events)
+			}
+			certs := monitoredCerts()
+			if len(certs) != 1 || certs[0].DaysLeft != tt.daysLeft[len(tt.daysLeft)-1] {
+				t.Errorf("monitored %+v, want %d days left", certs, tt.daysLeft[len(tt.daysLeft)-1])
+			}
+			if report := runHealthChecks(context.Background()); len(report.Certificates) != 1 || report.Certificates[0].DaysLeft != certs[0].DaysLeft {
+				t.Errorf("/healthz certificates %+v", report.Certificates)
+			}
+		})
+	}
+}
+
+func TestCheckCertificatesSendWebhookFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"), "fax-client", time.Now().Add(5*24*time.Hour+time.Hour))
+	writeTestCert(t, filepath.Join(dir, "ca.pem"), "provider-ca", time.Now().Add(90*24*time.Hour+time.Hour))
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		sources []string // prefixes of the monitored certificates' sources
+		events  int
+	}{
+		{name: "neither"},
+		{name: "client certificate", env: map[string]string{
+			"SEND_WEBHOOK_CLIENT_CERT": filepath.Join(dir, "client.pem"), "SEND_WEBHOOK_CLIENT_KEY": filepath.Join(dir, "client.key")},
+			sources: []string{"send webhook client certificate"}, events: 1},
+		{name: "CA bundle", env: map[string]string{"SEND_WEBHOOK_CA_FILE": filepath.Join(dir, "ca.pem")},
+			sources: []string{"send webhook CA"}},
+		{name: "both", env: map[string]string{
+			"SEND_WEBHOOK_CLIENT_CERT": filepath.Join(dir, "client.pem"), "SEND_WEBHOOK_CLIENT_KEY": filepath.Join(dir, "client.key"),
+			"SEND_WEBHOOK_CA_FILE": filepath.Join(dir, "ca.pem")},
+			sources: []string{"send webhook client certificate", "send webhook CA"}, events: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, tt.env)
+			events := captureSecurityEvents(t)
+			certMonitor.Lock()
+			certMonitor.warned = make(map[string]int)
+			certMonitor.Unlock()
+			t.Cleanup(func() {
+				certMonitor.Lock()
+				certMonitor.certs = nil
+				certMonitor.Unlock()
+			})
+
+			checkCertificates()
+			certs := monitoredCerts()
+			if len(certs) != len(tt.sources) {
+				t.Fatalf("monitored %+v, want %d certificates", certs, len(tt.sources))
+			}
+			for i, source := range tt.sources {
+				if !strings.HasPrefix(certs[i].Source, source) || certs[i].Error != "" {
+					t.Errorf("certificate %d from %q (error %q), want %q", i, certs[i].Source, certs[i].Error, source)
+				}
+			}
+			if got := len(events()); got != tt.events {
+				t.Errorf("%d cert_expiring events, want %d", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestProviderCerts(t *testing.T) {
+	provider := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer provider.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestFile(t, caFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: provider.Certificate().Raw})))
+
+	var tunnelled atomic.Bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tunnelled.Store(true)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(upstream, bufio.NewReader(rw))
+		io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		tunnelled bool
+		wantErr   bool
+	}{
+		{name: "SEND_WEBHOOK_CA_FILE", env: map[string]string{"SEND_WEBHOOK_CA_FILE": caFile}},
+		{name: "untrusted", wantErr: true},
+		{name: "OUTBOUND_PROXY_URL", env: map[string]string{"SEND_WEBHOOK_CA_FILE": caFile, "OUTBOUND_PROXY_URL": proxy.URL}, tunnelled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"SEND_WEBHOOK_URL": provider.URL + "/send"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			useTestConfig(t, env)
+			tunnelled.Store(false)
+
+			certs := providerCerts(config().SendWebhookURL)
+			if len(certs) == 0 {
+				t.Fatal("providerCerts() returned nothing")
+			}
+			if (certs[0].Error != "") != tt.wantErr {
+				t.Fatalf("error %q, wantErr %v", certs[0].Error, tt.wantErr)
+			}
+			if !tt.wantErr && !certs[0].NotAfter.Equal(provider.Certificate().NotAfter) {
+				t.Errorf("certificate expiring %s, want %s", certs[0].NotAfter, provider.Certificate().NotAfter)
+			}
+			if tunnelled.Load() != tt.tunnelled {
+				t.Errorf("tunnelled through proxy = %v, want %v", tunnelled.Load(), tt.tunnelled)
+			}
+		})
+	}
+}
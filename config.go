@@ -0,0 +1,855 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Config holds every setting. It is read once at startup from the
+// environment, which the .env file fills in, and from command-line flags,
+// which take precedence; nothing else reads the environment. Each field's env
+// tag names its variable and its flag is that name in lower case with dashes,
+// e.g. -ftp-root for FTP_ROOT.
+//
+// default is the value used when the setting is empty, required settings must
+// be given, secret values are masked in the startup log, and numbers and
+// durations must be positive unless tagged min:"0". Settings tagged
+// reload:"restart" only take effect at startup; the others are applied on SIGHUP.
+type Config struct {
+	FTPRoot   string `env:"FTP_ROOT" required:"true" reload:"restart"`
+	FaxNumber string `env:"FAX_NUMBER" required:"true"`
+	DataDir   string `env:"DATA_DIR" default:"./data" reload:"restart"`
+
+	QueueDirMode  string `env:"QUEUE_DIR_MODE" default:"0755"`
+	QueueFileMode string `env:"QUEUE_FILE_MODE"`
+	QueueOwner    string `env:"QUEUE_OWNER"` // uid:gid
+
+	SendWebhookURL                string        `env:"SEND_WEBHOOK_URL" required:"true"`
+	SendWebhookUsername           string        `env:"SEND_WEBHOOK_USERNAME"`
+	SendWebhookPassword           string        `env:"SEND_WEBHOOK_PASSWORD" secret:"true"`
+	SendWebhookUsernameSecondary  string        `env:"SEND_WEBHOOK_USERNAME_SECONDARY"`
+	SendWebhookPasswordSecondary  string        `env:"SEND_WEBHOOK_PASSWORD_SECONDARY" secret:"true"`
+	SendWebhookCredentialsFile    string        `env:"SEND_WEBHOOK_CREDENTIALS_FILE"`
+	SendWebhookClientCert         string        `env:"SEND_WEBHOOK_CLIENT_CERT"`
+	SendWebhookClientKey          string        `env:"SEND_WEBHOOK_CLIENT_KEY"`
+	SendWebhookCAFile             string        `env:"SEND_WEBHOOK_CA_FILE"`
+	SendWebhookInsecureSkipVerify bool          `env:"SEND_WEBHOOK_INSECURE_SKIP_VERIFY"` // lab use only
+	OutboundProxyURL              string        `env:"OUTBOUND_PROXY_URL" secret:"true"`  // may hold credentials
+	SendWebhookAuth               string        `env:"SEND_WEBHOOK_AUTH" default:"basic"` // basic, header or oauth2
+	SendWebhookOAuthTokenURL      string        `env:"SEND_WEBHOOK_OAUTH_TOKEN_URL"`
+	SendWebhookOAuthClientID      string        `env:"SEND_WEBHOOK_OAUTH_CLIENT_ID"`
+	SendWebhookOAuthClientSecret  string        `env:"SEND_WEBHOOK_OAUTH_CLIENT_SECRET" secret:"true"`
+	SendWebhookOAuthScopes        string        `env:"SEND_WEBHOOK_OAUTH_SCOPES"`
+	SendWebhookTimeout            time.Duration `env:"SEND_WEBHOOK_TIMEOUT" default:"60s"`
+	SendWebhookRetries            int           `env:"SEND_WEBHOOK_RETRIES" default:"3"` // attempts, including the first
+	SendWebhookRetryBackoff       time.Duration `env:"SEND_WEBHOOK_RETRY_BACKOFF" default:"2s"`
+	SendPartRename                bool          `env:"SEND_PART_RENAME"`
+	SendProtocol                  string        `env:"SEND_PROTOCOL" default:"multipart"` // multipart or put-binary
+	SendRoutesFile                string        `env:"SEND_ROUTES_FILE"`
+	SendWebhookHeaders            string        `env:"SEND_WEBHOOK_HEADERS" secret:"true"` // JSON object or "Key: Value" lines
+	SendWebhookHeadersFile        string        `env:"SEND_WEBHOOK_HEADERS_FILE"`
+	UserAgent                     string        `env:"USER_AGENT" default:"synergymattersfax"`
+	SendCancelURL                 string        `env:"SEND_CANCEL_URL"` // e.g. "{url}/{job_uuid}"
+	SendCancelMethod              string        `env:"SEND_CANCEL_METHOD" default:"DELETE"`
+	FaxQueueDirs                  string        `env:"FAX_QUEUE_DIRS" reload:"restart"`
+
+	HTTPListen        string `env:"HTTP_LISTEN" default:":8080" reload:"restart"`
+	HTTPListenersFile string `env:"HTTP_LISTENERS_FILE" reload:"restart"`
+	TLSCertFile       string `env:"TLS_CERT_FILE" reload:"restart"`
+	TLSKeyFile        string `env:"TLS_KEY_FILE" reload:"restart"`
+	HTTPSPort         int    `env:"HTTPS_PORT" default:"8443" reload:"restart"`
+	HTTPPlainEnabled  bool   `env:"HTTP_PLAIN_ENABLED" default:"true" reload:"restart"`
+
+	NotifyAuthToken   string `env:"NOTIFY_AUTH_TOKEN" secret:"true"`
+	NotifyBasicUser   string `env:"NOTIFY_BASIC_USER"`
+	NotifyBasicPass   string `env:"NOTIFY_BASIC_PASS" secret:"true"`
+	ReceiveAuthToken  string `env:"RECEIVE_AUTH_TOKEN" secret:"true"`
+	ReceiveBasicUser  string `env:"RECEIVE_BASIC_USER"`
+	ReceiveBasicPass  string `env:"RECEIVE_BASIC_PASS" secret:"true"`
+	AdminAuthToken    string `env:"ADMIN_AUTH_TOKEN" secret:"true"`
+	AdminBasicUser    string `env:"ADMIN_BASIC_USER"`
+	AdminBasicPass    string `env:"ADMIN_BASIC_PASS" secret:"true"`
+	AdminReadToken    string `env:"ADMIN_READ_TOKEN" secret:"true"`
+	AdminReadUser     string `env:"ADMIN_READ_BASIC_USER"`
+	AdminReadPass     string `env:"ADMIN_READ_BASIC_PASS" secret:"true"`
+	WebhookHMACSecret string `env:"WEBHOOK_HMAC_SECRET" secret:"true"`
+	WebhookHMACHeader string `env:"WEBHOOK_HMAC_HEADER" default:"X-Signature"`
+	MaxFaxSizeMB      int    `env:"MAX_FAX_SIZE_MB" default:"50"`
+	ReceiveMaxBytes   int64  `env:"RECEIVE_MAX_BYTES" min:"0"` // overrides MAX_FAX_SIZE_MB for received faxes
+	ReceiveAsync      bool   `env:"RECEIVE_ASYNC" default:"true"`
+
+	ReceiveForwardURL          string        `env:"RECEIVE_FORWARD_URL"`
+	ReceiveForwardUsername     string        `env:"RECEIVE_FORWARD_USERNAME"`
+	ReceiveForwardPassword     string        `env:"RECEIVE_FORWARD_PASSWORD" secret:"true"`
+	ReceiveForwardToken        string        `env:"RECEIVE_FORWARD_TOKEN" secret:"true"`
+	ReceiveForwardTimeout      time.Duration `env:"RECEIVE_FORWARD_TIMEOUT" default:"60s"`
+	ReceiveForwardRetries      int           `env:"RECEIVE_FORWARD_RETRIES" default:"5" min:"0"`
+	ReceiveForwardRetryBackoff time.Duration `env:"RECEIVE_FORWARD_RETRY_BACKOFF" default:"30s"`
+
+	ReceiveTenantMap         string        `env:"RECEIVE_TENANT_MAP"`
+	ReceiveEmailMap          string        `env:"RECEIVE_EMAIL_MAP"`
+	ReceiveEmailSubject      string        `env:"RECEIVE_EMAIL_SUBJECT" default:"Fax from {{.CIDNum}} ({{.Pages}} pages)"`
+	ReceiveEmailBody         string        `env:"RECEIVE_EMAIL_BODY" default:"A fax from {{.CIDNum}} to {{.Number}} was received at {{.ReceivedAt.Format \"2006-01-02 15:04:05\"}}. It is attached."`
+	ReceiveEmailRetries      int           `env:"RECEIVE_EMAIL_RETRIES" default:"5" min:"0"`
+	ReceiveEmailRetryBackoff time.Duration `env:"RECEIVE_EMAIL_RETRY_BACKOFF" default:"1m"`
+	SMTPHost                 string        `env:"SMTP_HOST"`
+	SMTPPort                 int           `env:"SMTP_PORT" default:"587"`
+	SMTPStartTLS             bool          `env:"SMTP_STARTTLS" default:"true"`
+	SMTPUsername             string        `env:"SMTP_USERNAME"`
+	SMTPPassword             string        `env:"SMTP_PASSWORD" secret:"true"`
+	SMTPFrom                 string        `env:"SMTP_FROM"`
+	SMTPTimeout              time.Duration `env:"SMTP_TIMEOUT" default:"60s"`
+
+	ArchiveS3Endpoint        string        `env:"ARCHIVE_S3_ENDPOINT" default:"https://s3.amazonaws.com"`
+	ArchiveS3Bucket          string        `env:"ARCHIVE_S3_BUCKET"`
+	ArchiveS3Region          string        `env:"ARCHIVE_S3_REGION" default:"us-east-1"`
+	ArchiveS3PathStyle       bool          `env:"ARCHIVE_S3_PATH_STYLE" default:"true"`
+	ArchiveS3AccessKeyID     string        `env:"ARCHIVE_S3_ACCESS_KEY_ID"`
+	ArchiveS3SecretAccessKey string        `env:"ARCHIVE_S3_SECRET_ACCESS_KEY" secret:"true"`
+	ArchiveS3SessionToken    string        `env:"ARCHIVE_S3_SESSION_TOKEN" secret:"true"`
+	ArchiveKeyTemplate       string        `env:"ARCHIVE_KEY_TEMPLATE" default:"{year}/{month}/{direction}/{uuid}.pdf"`
+	ArchiveTimeout           time.Duration `env:"ARCHIVE_TIMEOUT" default:"5m"`
+	ArchiveRetries           int           `env:"ARCHIVE_RETRIES" default:"10" min:"0"`
+	ArchiveRetryBackoff      time.Duration `env:"ARCHIVE_RETRY_BACKOFF" default:"1m"`
+
+	EventWebhookURL          string        `env:"EVENT_WEBHOOK_URL"`
+	EventWebhookTypes        string        `env:"EVENT_WEBHOOK_TYPES" default:"failed"`
+	EventWebhookSecret       string        `env:"EVENT_WEBHOOK_SECRET" secret:"true"`
+	EventWebhookTimeout      time.Duration `env:"EVENT_WEBHOOK_TIMEOUT" default:"30s"`
+	EventWebhookRetryBackoff time.Duration `env:"EVENT_WEBHOOK_RETRY_BACKOFF" default:"30s"`
+	EventWebhookQueueMax     int           `env:"EVENT_WEBHOOK_QUEUE_MAX" default:"1000"`
+
+	RemoteHost         string        `env:"REMOTE_HOST"` // host[:port]
+	RemoteUsername     string        `env:"REMOTE_USERNAME"`
+	RemotePassword     string        `env:"REMOTE_PASSWORD" secret:"true"`
+	RemoteDir          string        `env:"REMOTE_DIR" default:"/synergyfaxq"`
+	RemoteTLS          string        `env:"REMOTE_TLS" default:"none"` // none, explicit or implicit
+	RemoteKnownHosts   string        `env:"REMOTE_KNOWN_HOSTS"`        // sftp-client
+	RemotePrivateKey   string        `env:"REMOTE_PRIVATE_KEY"`        // sftp-client
+	RemoteTimeout      time.Duration `env:"REMOTE_TIMEOUT" default:"60s"`
+	RemotePollInterval time.Duration `env:"REMOTE_POLL_INTERVAL" default:"10s"`
+	RemoteRetryBackoff time.Duration `env:"REMOTE_RETRY_BACKOFF" default:"30s"`
+
+	TIFFConvertCommand string `env:"TIFF_CONVERT_COMMAND"`          // e.g. "tiff2pdf -o {out} {in}"
+	OutboundFormat     string `env:"OUTBOUND_FORMAT" default:"pdf"` // pdf or tiff
+	PDFToTIFFCommand   string `env:"PDF_TO_TIFF_COMMAND" default:"gs -q -dNOPAUSE -dBATCH -dSAFER -sDEVICE=tiffg3 -r204x196 -g1728x2200 -dPDFFitPage -sOutputFile={out} {in}"`
+
+	QFileSender     string `env:"QFILE_SENDER" default:"synergy"`
+	QFilePageWidth  int    `env:"QFILE_PAGE_WIDTH" default:"215"`  // mm
+	QFilePageLength int    `env:"QFILE_PAGE_LENGTH" default:"279"` // mm
+	QFileResolution int    `env:"QFILE_RESOLUTION" default:"196"`  // lines per inch
+
+	OutboundConcurrency    int `env:"OUTBOUND_CONCURRENCY" default:"4" reload:"restart"`
+	OutboundQueueWarnDepth int `env:"OUTBOUND_QUEUE_WARN_DEPTH" default:"50"`
+	OutboundRate           int `env:"OUTBOUND_RATE" min:"0"` // submissions per minute; 0 is unlimited
+	OutboundBurst          int `env:"OUTBOUND_BURST" default:"1"`
+
+	DeadLetterEnabled         bool   `env:"DEAD_LETTER_ENABLED" default:"true"`
+	DeadLetterResubmitOnStart bool   `env:"DEAD_LETTER_RESUBMIT_ON_START" reload:"restart"`
+	SentArchiveMode           string `env:"SENT_ARCHIVE_MODE" default:"delete"` // delete or archive
+
+	ReceivedRetentionDays  int           `env:"RECEIVED_RETENTION_DAYS" min:"0"`   // 0 keeps received faxes forever
+	MarkerRetentionDays    int           `env:"MARKER_RETENTION_DAYS" min:"0"`     // 0 keeps marker files forever
+	RetentionAction        string        `env:"RETENTION_ACTION" default:"delete"` // delete or archive
+	RetentionDryRun        bool          `env:"RETENTION_DRY_RUN"`
+	RetentionCheckInterval time.Duration `env:"RETENTION_CHECK_INTERVAL" default:"1h"`
+
+	MinFreeDiskMB  int `env:"MIN_FREE_DISK_MB" default:"100" min:"0"` // 0 disables the check
+	DiskWarnFreeMB int `env:"DISK_WARN_FREE_MB" default:"1024" min:"0"`
+
+	MaxDials   int           `env:"MAX_DIALS" default:"3"` // 1 never redials
+	RedialWait time.Duration `env:"REDIAL_WAIT" default:"5m"`
+
+	JobIDMax             int           `env:"JOB_ID_MAX" default:"999999999"`
+	JobTimeout           time.Duration `env:"JOB_TIMEOUT" default:"2h"`
+	PairTimeout          time.Duration `env:"PAIR_TIMEOUT" default:"15m" min:"0"`
+	PairAlertAfter       time.Duration `env:"PAIR_ALERT_AFTER" default:"5m" min:"0"`
+	JobStateTTL          time.Duration `env:"JOB_STATE_TTL" default:"24h" reload:"restart"`
+	NotifyBufferWindow   time.Duration `env:"NOTIFY_BUFFER_WINDOW" default:"60s"`
+	NotifyProgressStates string        `env:"NOTIFY_PROGRESS_STATES" default:"dialing=3,ringing=3,negotiating=6,training=6,sending=6,transmitting=6,in_progress=6"`
+	FileSettleTime       time.Duration `env:"FILE_SETTLE_TIME" default:"500ms" min:"0" reload:"restart"`
+	DeliveryMode         string        `env:"DELIVERY_MODE" default:"local" reload:"restart"` // local, ftp-client or sftp-client
+	WatchMode            string        `env:"WATCH_MODE" default:"fsnotify" reload:"restart"` // fsnotify, poll or auto
+	WatchPollInterval    time.Duration `env:"WATCH_POLL_INTERVAL" default:"5s" reload:"restart"`
+	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT" default:"10s"`
+	InboundDedupEnabled  bool          `env:"INBOUND_DEDUP_ENABLED" default:"true"`
+	InboundDedupWindow   time.Duration `env:"INBOUND_DEDUP_WINDOW" default:"10m"`
+	InboundUUIDWindow    time.Duration `env:"INBOUND_UUID_DEDUP_WINDOW" default:"24h" min:"0"`
+
+	QuotaMaxFaxesPerDay int    `env:"QUOTA_MAX_FAXES_PER_DAY" min:"0" reload:"restart"` // 0 is unlimited
+	QuotaMaxPagesPerDay int    `env:"QUOTA_MAX_PAGES_PER_DAY" min:"0" reload:"restart"` // 0 is unlimited
+	UserQuotas          string `env:"USER_QUOTAS" reload:"restart"`
+	UserPageQuotas      string `env:"USER_PAGE_QUOTAS" reload:"restart"`
+	QuotaResetTime      string `env:"QUOTA_RESET_TIME" reload:"restart"`
+
+	ApprovalRequired        bool          `env:"APPROVAL_REQUIRED"`
+	ApprovalTrustedPrefixes string        `env:"APPROVAL_TRUSTED_PREFIXES"`
+	ApprovalAutoMaxBytes    int64         `env:"APPROVAL_AUTO_MAX_BYTES" min:"0"` // 0 is off
+	ApprovalAlertAfter      time.Duration `env:"APPROVAL_ALERT_AFTER" default:"4h" min:"0"`
+	ApprovalAutoRejectAfter time.Duration `env:"APPROVAL_AUTO_REJECT_AFTER" min:"0"` // 0 is off
+
+	RecvTimeFormat            string `env:"RECV_TIME_FORMAT" reload:"restart"`
+	RecvDecimalMark           string `env:"RECV_DECIMAL_MARK" default:"point" reload:"restart"`
+	RecvThousandsSeparator    string `env:"RECV_THOUSANDS_SEPARATOR" default:"none" reload:"restart"`
+	RecvFilenameUseTimeFormat bool   `env:"RECV_FILENAME_USE_TIME_FORMAT" reload:"restart"`
+	RecvTemplate              string `env:"RECV_TEMPLATE" reload:"restart"`
+	RecvDeviceMap             string `env:"RECV_DEVICE_MAP" reload:"restart"` // number=device,...
+	ReceivedNameTemplate      string `env:"RECEIVED_NAME_TEMPLATE" reload:"restart"`
+	FaxTimezone               string `env:"FAX_TIMEZONE" default:"America/Vancouver" reload:"restart"`
+
+	NormalizeFaxNumbers bool   `env:"NORMALIZE_FAX_NUMBERS" default:"true"`
+	DialStripPrefixes   string `env:"DIAL_STRIP_PREFIXES"`
+	DefaultCountryCode  string `env:"DEFAULT_COUNTRY_CODE" default:"1"`
+	OutboundRulesFile   string `env:"OUTBOUND_RULES_FILE"`
+	StatusMapFile       string `env:"STATUS_MAP_FILE"`
+
+	SLAFile                string        `env:"SLA_FILE" reload:"restart"`
+	CertCheckInterval      time.Duration `env:"CERT_CHECK_INTERVAL" default:"12h" reload:"restart"`
+	CertWarnDays           string        `env:"CERT_WARN_DAYS" default:"30,7,1"`
+	ErrorClusterWindows    string        `env:"ERROR_CLUSTER_WINDOWS" default:"15m,1h,24h"`
+	ErrorClusterAlertCount int           `env:"ERROR_CLUSTER_ALERT_COUNT" default:"10"`
+	PublicStatusFields     string        `env:"PUBLIC_STATUS_FIELDS" default:"state,success_rate,median_delivery_seconds" reload:"restart"`
+	PublicStatusMinSamples int           `env:"PUBLIC_STATUS_MIN_SAMPLES" default:"20" reload:"restart"`
+	PublicStatusRateLimit  int           `env:"PUBLIC_STATUS_RATE_LIMIT" default:"60" reload:"restart"`
+	HealthFTPAddress       string        `env:"HEALTH_FTP_ADDRESS"`
+	HealthProbeWebhook     bool          `env:"HEALTH_PROBE_WEBHOOK"`
+
+	// Passed to SFTPGo by Docker Compose; validated and shown in /healthz here.
+	FTPPassivePortRange string `env:"FTP_PASSIVE_PORT_RANGE" default:"50000-50100"`
+	FTPPublicIP         string `env:"FTP_PUBLIC_IP"`
+
+	SIEMEventFile      string `env:"SIEM_EVENT_FILE" reload:"restart"`
+	SIEMEventFileMaxMB int    `env:"SIEM_EVENT_FILE_MAX_MB" default:"100" reload:"restart"`
+	SIEMSyslogAddr     string `env:"SIEM_SYSLOG_ADDR" reload:"restart"`
+
+	LogLevel     string `env:"LOG_LEVEL" default:"info"`
+	LogFormat    string `env:"LOG_FORMAT" default:"text"`
+	LogRedactPII bool   `env:"LOG_REDACT_PII" default:"true"`
+
+	FaultsEnabled bool   `env:"FAULTS_ENABLED" reload:"restart"`
+	CaptureDir    string `env:"CAPTURE_DIR" reload:"restart"`
+
+	// Parsed from the list settings above by validate.
+	approvalTrustedPrefixes []string
+	dialStripPrefixes       []string
+	certWarnDays            []int           // descending
+	errorClusterWindows     []time.Duration // ascending
+	publicStatusFields      []string
+	eventWebhookTypes       map[string]bool
+	faxLocation             *time.Location
+	maxFaxBytes             int64 // MAX_FAX_SIZE_MB
+	receiveMaxBytes         int64 // RECEIVE_MAX_BYTES, or MAX_FAX_SIZE_MB
+	notifyProgressStates    map[string]string
+	queueDirs               []queueDir // the default queue directory, then FAX_QUEUE_DIRS
+	ftpPassivePorts         [2]int     // first and last
+	queueDirMode            os.FileMode
+	queueFileMode           os.FileMode // 0 keeps each file's own mode
+	queueOwner              []int       // uid and gid, or nil
+	receiveEmailSubject     *template.Template
+	receiveEmailBody        *template.Template
+	webhookTLS              *tls.Config // nil for the defaults
+	outboundProxy           *url.URL    // OUTBOUND_PROXY_URL, or nil
+}
+
+// currentConfig holds the configuration in effect, which reloadConfig replaces.
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	currentConfig.Store(&Config{})
+}
+
+// config returns the configuration in effect. A caller that needs several
+// settings to agree should call it once and keep the result.
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// configSource remembers where the startup configuration came from, so that
+// reloadConfig reads the same places.
+var configSource struct {
+	envFile    string
+	flags      map[string]string // settings given as flags
+	processEnv map[string]string // environment before the .env file was loaded
+}
+
+// mustLoadConfig loads the configuration from args, the .env file and the
+// environment, initializes logging from it and exits listing every problem if
+// it is invalid.
+func mustLoadConfig(args []string) {
+	envFile, envFileSet, flags := parseConfigFlags(args)
+	configSource.envFile, configSource.flags = envFile, flags
+	configSource.processEnv = make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			configSource.processEnv[k] = v
+		}
+	}
+	envErr := godotenv.Load(envFile)
+
+	cfg, problems := readConfig(func(env string) string {
+		if v, ok := flags[env]; ok {
+			return v
+		}
+		return os.Getenv(env)
+	})
+	currentConfig.Store(&cfg)
+	initLogging()
+	if envErr != nil {
+		if envFileSet {
+			problems = append(problems, fmt.Errorf("-env-file: %w", envErr))
+		} else {
+			slog.Info("No .env file found; proceeding with defaults")
+		}
+	}
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		for _, err := range problems {
+			slog.Error("Invalid configuration", "err", err)
+		}
+		os.Exit(1)
+	}
+	cfg.log()
+}
+
+// reloadConfig re-reads the .env file and applies the settings that can
+// change at run time, logging each change. Changed restart-only settings are
+// logged and keep their running value. On any problem the configuration in
+// effect is kept as a whole.
+func reloadConfig() {
+	dotenv, err := godotenv.Read(configSource.envFile)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Configuration not reloaded", "err", err)
+		return
+	}
+	fresh, problems := readConfig(func(env string) string {
+		if v, ok := configSource.flags[env]; ok {
+			return v
+		}
+		if v, ok := configSource.processEnv[env]; ok {
+			return v
+		}
+		return dotenv[env]
+	})
+	problems = append(problems, fresh.validate()...)
+	if len(problems) > 0 {
+		for _, err := range problems {
+			slog.Error("Configuration not reloaded", "err", err)
+		}
+		return
+	}
+
+	old := config()
+	oldValue := reflect.ValueOf(old).Elem()
+	changed := 0
+	configFields(&fresh, func(field reflect.StructField, value reflect.Value) {
+		previous := oldValue.FieldByIndex(field.Index)
+		if reflect.DeepEqual(previous.Interface(), value.Interface()) {
+			return
+		}
+		env := field.Tag.Get("env")
+		if field.Tag.Get("reload") == "restart" {
+			slog.Warn("Setting changed but needs a restart to apply", "setting", env)
+			value.Set(previous)
+			return
+		}
+		changed++
+		if field.Tag.Get("secret") == "true" {
+			slog.Info("Setting changed", "setting", env)
+		} else {
+			slog.Info("Setting changed", "setting", env, "from", fmt.Sprint(previous.Interface()), "to", fmt.Sprint(value.Interface()))
+		}
+	})
+	// Derive the parsed fields again now that restart-only settings are back
+	// to their running values.
+	fresh.validate()
+	currentConfig.Store(&fresh)
+	initLogging()
+	slog.Info("Configuration reloaded", "changed", changed)
+}
+
+// configFields calls fn for every Config field that has an env tag.
+func configFields(c *Config, fn func(field reflect.StructField, value reflect.Value)) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Type().Field(i); field.Tag.Get("env") != "" {
+			fn(field, v.Field(i))
+		}
+	}
+}
+
+// configFlagName is the command-line flag for the setting env.
+func configFlagName(env string) string {
+	return strings.ToLower(strings.ReplaceAll(env, "_", "-"))
+}
+
+// parseConfigFlags parses a flag per setting plus -env-file. It returns the
+// .env path, whether -env-file was given, and the settings given as flags.
+func parseConfigFlags(args []string) (string, bool, map[string]string) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	envFile := fs.String("env-file", ".env", "file of KEY=value settings to load into the environment")
+	envNames := make(map[string]string) // flag name -> env name
+	configFields(&Config{}, func(field reflect.StructField, _ reflect.Value) {
+		env := field.Tag.Get("env")
+		envNames[configFlagName(env)] = env
+		fs.String(configFlagName(env), "", "overrides "+env)
+	})
+	fs.Parse(args)
+
+	envFileSet := false
+	overrides := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "env-file" {
+			envFileSet = true
+			return
+		}
+		overrides[envNames[f.Name]] = f.Value.String()
+	})
+	return *envFile, envFileSet, overrides
+}
+
+// readConfig reads every setting through lookup. A value that does not parse
+// is reported and replaced by the default.
+func readConfig(lookup func(env string) string) (Config, []error) {
+	var c Config
+	var problems []error
+	configFields(&c, func(field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+		raw := lookup(env)
+		def := field.Tag.Get("default")
+		if raw == "" {
+			raw = def
+		}
+		if raw == "" {
+			return
+		}
+		if err := setConfigValue(value, raw, field.Tag.Get("min") == "0"); err != nil {
+			problems = append(problems, fmt.Errorf("%s=%q: %w", env, raw, err))
+			if def != "" {
+				setConfigValue(value, def, true)
+			}
+		}
+	})
+	return c, problems
+}
+
+func setConfigValue(value reflect.Value, raw string, allowZero bool) error {
+	checkSign := func(n int64) error {
+		if n < 0 || (n == 0 && !allowZero) {
+			return errors.New("must be positive")
+		}
+		return nil
+	}
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return errors.New("must be a duration such as 30s or 2h")
+		}
+		if err := checkSign(int64(d)); err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+	case int, int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		if err := checkSign(n); err != nil {
+			return err
+		}
+		value.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
+
+// validate checks the settings that must be present or well-formed and
+// parses the list settings.
+func (c *Config) validate() []error {
+	var problems []error
+	configFields(c, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			problems = append(problems, fmt.Errorf("%s is required", field.Tag.Get("env")))
+		}
+	})
+
+	if c.FTPRoot != "" {
+		if info, err := os.Stat(c.FTPRoot); err != nil && !errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, fmt.Errorf("FTP_ROOT: %w", err))
+		} else if err == nil && !info.IsDir() {
+			problems = append(problems, fmt.Errorf("FTP_ROOT %q is not a directory", c.FTPRoot))
+		}
+	}
+	if c.SendWebhookURL != "" {
+		if u, err := url.Parse(c.SendWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("SEND_WEBHOOK_URL %q must be an http or https URL", c.SendWebhookURL))
+		}
+	}
+	c.outboundProxy = nil
+	if c.OutboundProxyURL != "" {
+		if proxy, err := parseProxyURL(c.OutboundProxyURL); err != nil {
+			problems = append(problems, err)
+		} else {
+			c.outboundProxy = proxy
+		}
+	}
+	if tlsConfig, err := loadWebhookTLS(c); err != nil {
+		problems = append(problems, err)
+	} else {
+		c.webhookTLS = tlsConfig
+	}
+	switch c.SendWebhookAuth {
+	case webhookAuthBasic, webhookAuthHeader:
+	case webhookAuthOAuth2:
+		if u, err := url.Parse(c.SendWebhookOAuthTokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("SEND_WEBHOOK_OAUTH_TOKEN_URL %q must be an http or https URL", c.SendWebhookOAuthTokenURL))
+		}
+		if c.SendWebhookOAuthClientID == "" || c.SendWebhookOAuthClientSecret == "" {
+			problems = append(problems, errors.New("SEND_WEBHOOK_AUTH oauth2 needs SEND_WEBHOOK_OAUTH_CLIENT_ID and SEND_WEBHOOK_OAUTH_CLIENT_SECRET"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("SEND_WEBHOOK_AUTH %q must be basic, header or oauth2", c.SendWebhookAuth))
+	}
+	switch c.SendProtocol {
+	case sendProtocolMultipart, sendProtocolPutBinary:
+	default:
+		problems = append(problems, fmt.Errorf("SEND_PROTOCOL %q must be multipart or put-binary", c.SendProtocol))
+	}
+	if c.SendCancelURL != "" {
+		probe := strings.NewReplacer("{url}", "http://provider", "{job_uuid}", "", "{call_uuid}", "", "{jobid}", "").Replace(c.SendCancelURL)
+		if u, err := url.Parse(probe); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("SEND_CANCEL_URL %q must be an http or https URL, or start with {url}", c.SendCancelURL))
+		}
+	}
+	switch c.SendCancelMethod {
+	case http.MethodDelete, http.MethodPost, http.MethodPut:
+	default:
+		problems = append(problems, fmt.Errorf("SEND_CANCEL_METHOD %q must be DELETE, POST or PUT", c.SendCancelMethod))
+	}
+	if c.ReceiveForwardURL != "" {
+		if u, err := url.Parse(c.ReceiveForwardURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("RECEIVE_FORWARD_URL %q must be an http or https URL", c.ReceiveForwardURL))
+		}
+	}
+	if c.EventWebhookURL != "" {
+		if u, err := url.Parse(c.EventWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("EVENT_WEBHOOK_URL %q must be an http or https URL", c.EventWebhookURL))
+		}
+	}
+	if c.ArchiveS3Bucket != "" {
+		if u, err := url.Parse(c.ArchiveS3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("ARCHIVE_S3_ENDPOINT %q must be an http or https URL", c.ArchiveS3Endpoint))
+		}
+		if c.ArchiveS3AccessKeyID == "" || c.ArchiveS3SecretAccessKey == "" {
+			problems = append(problems, fmt.Errorf("ARCHIVE_S3_BUCKET needs ARCHIVE_S3_ACCESS_KEY_ID and ARCHIVE_S3_SECRET_ACCESS_KEY"))
+		}
+		if !strings.Contains(c.ArchiveKeyTemplate, "{uuid}") {
+			problems = append(problems, fmt.Errorf("ARCHIVE_KEY_TEMPLATE %q must contain {uuid}", c.ArchiveKeyTemplate))
+		}
+	}
+	if c.ReceiveEmailMap != "" && (c.SMTPHost == "" || c.SMTPFrom == "") {
+		problems = append(problems, fmt.Errorf("RECEIVE_EMAIL_MAP needs SMTP_HOST and SMTP_FROM"))
+	}
+	if c.SMTPFrom != "" {
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			problems = append(problems, fmt.Errorf("SMTP_FROM %q: %w", c.SMTPFrom, err))
+		}
+	}
+	if c.SMTPPort < 1 || c.SMTPPort > 65535 {
+		problems = append(problems, fmt.Errorf("SMTP_PORT %d must be 1-65535", c.SMTPPort))
+	}
+	if subject, body, err := parseEmailTemplates(c.ReceiveEmailSubject, c.ReceiveEmailBody); err != nil {
+		problems = append(problems, err)
+	} else {
+		c.receiveEmailSubject, c.receiveEmailBody = subject, body
+	}
+	if err := validateListenAddress(c.HTTPListen); err != nil {
+		problems = append(problems, fmt.Errorf("HTTP_LISTEN: %w", err))
+	}
+	if c.HTTPSPort > 65535 {
+		problems = append(problems, fmt.Errorf("HTTPS_PORT %d must be 1-65535", c.HTTPSPort))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		problems = append(problems, fmt.Errorf("LOG_LEVEL %q must be debug, info, warn or error", c.LogLevel))
+	}
+	if format := strings.ToLower(c.LogFormat); format != "text" && format != "json" {
+		problems = append(problems, fmt.Errorf("LOG_FORMAT %q must be text or json", c.LogFormat))
+	}
+
+	loc, err := time.LoadLocation(c.FaxTimezone)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("FAX_TIMEZONE: %w", err))
+		loc = time.Local
+	}
+	c.faxLocation = loc
+
+	c.maxFaxBytes = int64(c.MaxFaxSizeMB) << 20
+	c.receiveMaxBytes = c.ReceiveMaxBytes
+	if c.receiveMaxBytes == 0 {
+		c.receiveMaxBytes = c.maxFaxBytes
+	}
+
+	if c.TIFFConvertCommand != "" && (!strings.Contains(c.TIFFConvertCommand, "{in}") || !strings.Contains(c.TIFFConvertCommand, "{out}")) {
+		problems = append(problems, fmt.Errorf("TIFF_CONVERT_COMMAND %q must contain {in} and {out}", c.TIFFConvertCommand))
+	}
+
+	switch c.OutboundFormat {
+	case outboundFormatPDF:
+	case outboundFormatTIFF:
+		if !strings.Contains(c.PDFToTIFFCommand, "{in}") || !strings.Contains(c.PDFToTIFFCommand, "{out}") {
+			problems = append(problems, fmt.Errorf("PDF_TO_TIFF_COMMAND %q must contain {in} and {out}", c.PDFToTIFFCommand))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("OUTBOUND_FORMAT %q must be pdf or tiff", c.OutboundFormat))
+	}
+
+	if mode, err := parseFileMode(c.QueueDirMode); err != nil {
+		problems = append(problems, fmt.Errorf("QUEUE_DIR_MODE %w", err))
+	} else {
+		c.queueDirMode = mode
+	}
+	if c.QueueFileMode != "" {
+		if mode, err := parseFileMode(c.QueueFileMode); err != nil {
+			problems = append(problems, fmt.Errorf("QUEUE_FILE_MODE %w", err))
+		} else {
+			c.queueFileMode = mode
+		}
+	}
+	if c.QueueOwner != "" {
+		uid, gid, ok := strings.Cut(c.QueueOwner, ":")
+		u, uErr := strconv.Atoi(uid)
+		g, gErr := strconv.Atoi(gid)
+		if !ok || uErr != nil || gErr != nil || u < 0 || g < 0 {
+			problems = append(problems, fmt.Errorf("QUEUE_OWNER %q must be numeric uid:gid, e.g. 1001:1001", c.QueueOwner))
+		} else {
+			c.queueOwner = []int{u, g}
+		}
+	}
+	if dirs, err := parseQueueDirs(c.FTPRoot, c.FaxQueueDirs); err != nil {
+		problems = append(problems, err)
+	} else {
+		c.queueDirs = dirs
+	}
+
+	switch c.DeliveryMode {
+	case deliveryLocal:
+	case deliveryFTPClient, deliverySFTPClient:
+		if c.RemoteHost == "" {
+			problems = append(problems, fmt.Errorf("DELIVERY_MODE %s needs REMOTE_HOST", c.DeliveryMode))
+		}
+		if c.DeliveryMode == deliverySFTPClient {
+			if c.RemoteKnownHosts == "" {
+				problems = append(problems, errors.New("DELIVERY_MODE sftp-client needs REMOTE_KNOWN_HOSTS"))
+			} else if _, err := knownhosts.New(c.RemoteKnownHosts); err != nil {
+				problems = append(problems, fmt.Errorf("REMOTE_KNOWN_HOSTS: %w", err))
+			}
+			if c.RemotePrivateKey == "" && c.RemotePassword == "" {
+				problems = append(problems, errors.New("DELIVERY_MODE sftp-client needs REMOTE_PRIVATE_KEY or REMOTE_PASSWORD"))
+			}
+		}
+	default:
+		problems = append(problems, fmt.Errorf("DELIVERY_MODE %q must be local, ftp-client or sftp-client", c.DeliveryMode))
+	}
+	switch c.RemoteTLS {
+	case "none", "explicit", "implicit":
+	default:
+		problems = append(problems, fmt.Errorf("REMOTE_TLS %q must be none, explicit or implicit", c.RemoteTLS))
+	}
+
+	switch c.WatchMode {
+	case watchFsnotify, watchPoll, watchAuto:
+	default:
+		problems = append(problems, fmt.Errorf("WATCH_MODE %q must be fsnotify, poll or auto", c.WatchMode))
+	}
+
+	if ports, err := parsePortRange(c.FTPPassivePortRange); err != nil {
+		problems = append(problems, fmt.Errorf("FTP_PASSIVE_PORT_RANGE %w", err))
+	} else {
+		c.ftpPassivePorts = ports
+	}
+	if c.FTPPublicIP != "" && net.ParseIP(c.FTPPublicIP).To4() == nil {
+		problems = append(problems, fmt.Errorf("FTP_PUBLIC_IP %q must be an IPv4 address", c.FTPPublicIP))
+	}
+
+	if states, err := parseProgressStates(c.NotifyProgressStates); err != nil {
+		problems = append(problems, err)
+	} else {
+		c.notifyProgressStates = states
+	}
+
+	if c.SentArchiveMode != cleanupDelete && c.SentArchiveMode != cleanupArchive {
+		problems = append(problems, fmt.Errorf("SENT_ARCHIVE_MODE %q must be delete or archive", c.SentArchiveMode))
+	}
+	if c.RetentionAction != cleanupDelete && c.RetentionAction != cleanupArchive {
+		problems = append(problems, fmt.Errorf("RETENTION_ACTION %q must be delete or archive", c.RetentionAction))
+	}
+
+	c.approvalTrustedPrefixes = splitConfigList(c.ApprovalTrustedPrefixes)
+
+	c.dialStripPrefixes = nil
+	for _, prefix := range splitConfigList(c.DialStripPrefixes) {
+		if !isDialPrefix(prefix) {
+			problems = append(problems, fmt.Errorf("DIAL_STRIP_PREFIXES entry %q must be 1-4 digits", prefix))
+			continue
+		}
+		c.dialStripPrefixes = append(c.dialStripPrefixes, prefix)
+	}
+	if n := len(c.DefaultCountryCode); n > 3 || strings.Trim(c.DefaultCountryCode, "0123456789") != "" || strings.HasPrefix(c.DefaultCountryCode, "0") {
+		problems = append(problems, fmt.Errorf("DEFAULT_COUNTRY_CODE %q must be a country calling code such as 1 or 44", c.DefaultCountryCode))
+	}
+
+	c.certWarnDays = nil
+	for _, field := range splitConfigList(c.CertWarnDays) {
+		days, err := strconv.Atoi(field)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("CERT_WARN_DAYS entry %q is not a number of days", field))
+			continue
+		}
+		c.certWarnDays = append(c.certWarnDays, days)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(c.certWarnDays)))
+
+	c.errorClusterWindows = nil
+	for _, field := range splitConfigList(c.ErrorClusterWindows) {
+		d, err := time.ParseDuration(field)
+		if err != nil || d <= 0 {
+			problems = append(problems, fmt.Errorf("ERROR_CLUSTER_WINDOWS entry %q is not a positive duration", field))
+			continue
+		}
+		c.errorClusterWindows = append(c.errorClusterWindows, d)
+	}
+	if len(c.errorClusterWindows) == 0 {
+		c.errorClusterWindows = []time.Duration{time.Hour}
+	}
+	sort.Slice(c.errorClusterWindows, func(i, j int) bool { return c.errorClusterWindows[i] < c.errorClusterWindows[j] })
+
+	c.publicStatusFields = nil
+	for _, field := range splitConfigList(c.PublicStatusFields) {
+		known := false
+		for _, f := range publicStatusFields {
+			known = known || f == field
+		}
+		if !known {
+			problems = append(problems, fmt.Errorf("PUBLIC_STATUS_FIELDS entry %q must be one of %s", field, strings.Join(publicStatusFields, ", ")))
+			continue
+		}
+		c.publicStatusFields = append(c.publicStatusFields, field)
+	}
+
+	c.eventWebhookTypes = make(map[string]bool)
+	for _, field := range splitConfigList(strings.ToLower(c.EventWebhookTypes)) {
+		if !slices.Contains(faxEventTypes, field) {
+			problems = append(problems, fmt.Errorf("EVENT_WEBHOOK_TYPES entry %q must be one of %s", field, strings.Join(faxEventTypes, ", ")))
+			continue
+		}
+		c.eventWebhookTypes[field] = true
+	}
+	return problems
+}
+
+// splitConfigList splits a comma-separated setting, dropping empty entries.
+func splitConfigList(v string) []string {
+	var entries []string
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// parsePortRange parses "first-last", e.g. "50000-50100".
+func parsePortRange(v string) ([2]int, error) {
+	first, last, ok := strings.Cut(strings.TrimSpace(v), "-")
+	if !ok {
+		return [2]int{}, fmt.Errorf("%q must be a range such as 50000-50100", v)
+	}
+	var ports [2]int
+	for i, field := range []string{first, last} {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 || n > 65535 {
+			return [2]int{}, fmt.Errorf("%q: ports must be 1-65535", v)
+		}
+		ports[i] = n
+	}
+	if ports[0] > ports[1] {
+		return [2]int{}, fmt.Errorf("%q: the first port is above the last", v)
+	}
+	return ports, nil
+}
+
+// parseFileMode parses octal permissions such as "0644".
+func parseFileMode(v string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(v), 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("%q must be octal permissions such as 0644", v)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validateListenAddress checks a "host:port" or "unix:/path" listen address.
+func validateListenAddress(address string) error {
+	if strings.HasPrefix(address, "unix:") {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid address %q: port must be 1-65535", address)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("invalid address %q: %w", address, err)
+		}
+	}
+	return nil
+}
+
+// log writes every resolved setting, with secrets masked.
+func (c *Config) log() {
+	var attrs []any
+	configFields(c, func(field reflect.StructField, value reflect.Value) {
+		resolved := fmt.Sprint(value.Interface())
+		if field.Tag.Get("secret") == "true" && resolved != "" {
+			resolved = "********"
+		}
+		attrs = append(attrs, field.Tag.Get("env"), resolved)
+	})
+	slog.Info("Configuration loaded", attrs...)
+	if c.SendWebhookInsecureSkipVerify {
+		slog.Warn("SEND_WEBHOOK_INSECURE_SKIP_VERIFY is set: the send webhook's certificate is NOT verified; use this only in a lab")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Documents are converted by an external command given as a template, e.g.
+// TIFF_CONVERT_COMMAND="tiff2pdf -o {out} {in}". {in} and {out} are replaced
+// by the input and output paths and the template is split on spaces; no shell
+// is involved. A converter that fails reports its stderr.
+//
+// With OUTBOUND_FORMAT=tiff, outbound PDFs are converted with
+// PDF_TO_TIFF_COMMAND, by default Ghostscript producing a Group 3 TIFF at fine
+// fax resolution (204x196 dpi, 1728 pixels wide), and the TIFF is uploaded
+// instead. The TIFF is a temporary file removed once it has been read.
+
+// Outbound upload formats.
+const (
+	outboundFormatPDF  = "pdf"
+	outboundFormatTIFF = "tiff"
+)
+
+const converterTimeout = 2 * time.Minute
+
+// maxConverterOutput bounds the stderr quoted in errors and .sts files.
+const maxConverterOutput = 300
+
+var errConversionFailed = errors.New("document conversion failed")
+
+// runConverter runs the converter template on in, writing out.
+func runConverter(template, in, out string) error {
+	args := strings.Fields(template)
+	if len(args) == 0 {
+		return fmt.Errorf("%w: no converter configured", errConversionFailed)
+	}
+	r := strings.NewReplacer("{in}", in, "{out}", out)
+	for i := range args {
+		args[i] = r.Replace(args[i])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), converterTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.Join(strings.Fields(stderr.String()), " ")
+		if len(msg) > maxConverterOutput {
+			msg = msg[:maxConverterOutput] + "..."
+		}
+		if msg == "" {
+			return fmt.Errorf("%w: %s: %v", errConversionFailed, args[0], err)
+		}
+		return fmt.Errorf("%w: %s: %v: %s", errConversionFailed, args[0], err, msg)
+	}
+	if info, err := os.Stat(out); err != nil || info.Size() == 0 {
+		return fmt.Errorf("%w: %s produced no output", errConversionFailed, args[0])
+	}
+	return nil
+}
+
+// convertDocument converts in with the converter template and returns the
+// path of the result, a temporary file in dir.
+func convertDocument(template, dir, in string) (string, error) {
+	out, err := os.CreateTemp(dir, ".convert.*.tmp")
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+	if err := runConverter(template, in, out.Name()); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// convertTIFFToPDF converts the TIFF at in with TIFF_CONVERT_COMMAND.
+func convertTIFFToPDF(dir, in string) (string, error) {
+	return convertDocument(config().TIFFConvertCommand, dir, in)
+}
+
+// convertOutbound converts an outbound document of contentType to the upload
+// format, or returns data unchanged when no conversion applies.
+func convertOutbound(path, contentType string, data []byte) ([]byte, error) {
+	cfg := config()
+	var template string
+	switch {
+	case cfg.OutboundFormat == outboundFormatTIFF && contentType == contentTypePDF:
+		template = cfg.PDFToTIFFCommand
+	case cfg.OutboundFormat == outboundFormatPDF && contentType == contentTypeTIFF && cfg.TIFFConvertCommand != "":
+		template = cfg.TIFFConvertCommand
+	default:
+		return data, nil
+	}
+	out, err := convertDocument(template, os.TempDir(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out)
+	converted, err := os.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+	if want := map[string]string{outboundFormatPDF: contentTypePDF, outboundFormatTIFF: contentTypeTIFF}[cfg.OutboundFormat]; sniffDocumentType(converted) != want {
+		return nil, fmt.Errorf("%w: converter output is not %s", errConversionFailed, want)
+	}
+	return converted, nil
+}
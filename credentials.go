@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// webhookCredential is one set of Basic Auth credentials for the send webhook.
+// Only the label is ever logged.
+type webhookCredential struct {
+	Label    string `json:"label"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// webhookCredentialsFile is the layout of SEND_WEBHOOK_CREDENTIALS_FILE.
+type webhookCredentialsFile struct {
+	Primary   *webhookCredential `json:"primary"`
+	Secondary *webhookCredential `json:"secondary"`
+}
+
+// webhookCredentials holds the credentials used for submissions. During a
+// rotation the new secret is staged as the secondary, the provider is switched
+// over, and the secondary is then promoted; each step is picked up on SIGHUP.
+var webhookCredentials = struct {
+	sync.Mutex
+	primary   webhookCredential
+	secondary *webhookCredential
+}{}
+
+var (
+	webhookCredentialUses      = expvar.NewMap("webhook_credential_uses")      // label -> accepted submissions
+	webhookCredentialFallbacks = expvar.NewInt("webhook_credential_fallbacks") // primary rejected, secondary tried
+)
+
+// loadWebhookCredentials reads SEND_WEBHOOK_CREDENTIALS_FILE if set, otherwise
+// SEND_WEBHOOK_USERNAME/PASSWORD and the optional *_SECONDARY pair.
+func loadWebhookCredentials() error {
+	var creds webhookCredentialsFile
+	if path := config().SendWebhookCredentialsFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", path, err)
+		}
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		if creds.Primary == nil {
+			return fmt.Errorf("%s: primary credential is required", path)
+		}
+	} else {
+		creds.Primary = &webhookCredential{
+			Username: config().SendWebhookUsername,
+			Password: config().SendWebhookPassword,
+		}
+		if config().SendWebhookPasswordSecondary != "" {
+			creds.Secondary = &webhookCredential{
+				Username: config().SendWebhookUsernameSecondary,
+				Password: config().SendWebhookPasswordSecondary,
+			}
+			if creds.Secondary.Username == "" {
+				creds.Secondary.Username = creds.Primary.Username
+			}
+		}
+	}
+	if creds.Primary.Label == "" {
+		creds.Primary.Label = "primary"
+	}
+	if creds.Secondary != nil && creds.Secondary.Label == "" {
+		creds.Secondary.Label = "secondary"
+	}
+	if creds.Secondary != nil && creds.Secondary.Label == creds.Primary.Label {
+		return errors.New("primary and secondary credentials must have different labels")
+	}
+
+	webhookCredentials.Lock()
+	webhookCredentials.primary = *creds.Primary
+	webhookCredentials.secondary = creds.Secondary
+	webhookCredentials.Unlock()
+
+	if creds.Secondary != nil {
+		slog.Info("Send webhook credentials loaded", "primary", creds.Primary.Label, "secondary", creds.Secondary.Label)
+	} else {
+		slog.Info("Send webhook credentials loaded", "primary", creds.Primary.Label)
+	}
+	return nil
+}
+
+// doWithCredentialFallback sends req with the primary credential and, if the
+// webhook answers 401 or 403 and a secondary is configured, resends it once
+// with the secondary. body must be the request body so it can be replayed.
+// It returns the label of the credential behind the returned response.
+func doWithCredentialFallback(client *http.Client, req *http.Request, body []byte, hylaJobID string) (*http.Response, string, error) {
+	webhookCredentials.Lock()
+	primary, secondary := webhookCredentials.primary, webhookCredentials.secondary
+	webhookCredentials.Unlock()
+
+	req.SetBasicAuth(primary.Username, primary.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, primary.Label, err
+	}
+	if secondary == nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		if resp.StatusCode == http.StatusOK {
+			webhookCredentialUses.Add(primary.Label, 1)
+		}
+		return resp, primary.Label, nil
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err := req.Context().Err(); err != nil {
+		return nil, primary.Label, err
+	}
+	slog.Warn("Send webhook credential rejected; retrying with secondary", "job_id", hylaJobID, "credential", primary.Label, "status", resp.Status, "secondary", secondary.Label)
+	webhookCredentialFallbacks.Add(1)
+
+	retry := req.Clone(req.Context())
+	retry.Body = io.NopCloser(bytes.NewReader(body))
+	retry.SetBasicAuth(secondary.Username, secondary.Password)
+	resp, err = client.Do(retry)
+	if err != nil {
+		return nil, secondary.Label, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		webhookCredentialUses.Add(secondary.Label, 1)
+	}
+	return resp, secondary.Label, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCredentialRotation(t *testing.T) {
+	var accepted atomic.Value // password the provider accepts
+	accepted.Store("old")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, _ := r.BasicAuth(); password != accepted.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	credsPath := filepath.Join(t.TempDir(), "credentials.json")
+	writeTestFile(t, credsPath, `{"primary":{"label":"2025","username":"fax","password":"old"}}`)
+	useTestConfig(t, map[string]string{"SEND_WEBHOOK_URL": server.URL, "SEND_WEBHOOK_CREDENTIALS_FILE": credsPath})
+	t.Cleanup(func() {
+		webhookCredentials.Lock()
+		webhookCredentials.primary, webhookCredentials.secondary = webhookCredential{}, nil
+		webhookCredentials.Unlock()
+	})
+	if err := loadWebhookCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each step changes the credentials file or the provider, then sends
+	// part of the batch.
+	steps := []struct {
+		name      string
+		file      string // new SEND_WEBHOOK_CREDENTIALS_FILE content, reloaded as on SIGHUP
+		provider  string // password the provider accepts from this step on
+		jobs      int
+		label     string // credential every job of the step is accepted with
+		fallbacks int64
+	}{
+		{name: "before the rotation", jobs: 3, label: "2025"},
+		{name: "new secret staged", file: `{"primary":{"label":"2025","username":"fax","password":"old"},
+			"secondary":{"label":"2026","username":"fax","password":"new"}}`, jobs: 3, label: "2025"},
+		{name: "provider switched", provider: "new", jobs: 3, label: "2026", fallbacks: 3},
+		{name: "new secret promoted", file: `{"primary":{"label":"2026","username":"fax","password":"new"}}`, jobs: 3, label: "2026"},
+	}
+	jobID := 0
+	for _, step := range steps {
+		if step.file != "" {
+			writeTestFile(t, credsPath, step.file)
+			if err := loadWebhookCredentials(); err != nil {
+				t.Fatalf("%s: loadWebhookCredentials() = %v", step.name, err)
+			}
+		}
+		if step.provider != "" {
+			accepted.Store(step.provider)
+		}
+		fallbacks := webhookCredentialFallbacks.Value()
+		for i := 0; i < step.jobs; i++ {
+			jobID++
+			body := []byte("job")
+			req, _ := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+			resp, label, err := doWithCredentialFallback(http.DefaultClient, req, body, "job")
+			if err != nil {
+				t.Fatalf("%s: job %d: %v", step.name, jobID, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || label != step.label {
+				t.Errorf("%s: job %d answered %d with credential %q, want 200 with %q", step.name, jobID, resp.StatusCode, label, step.label)
+			}
+		}
+		if got := webhookCredentialFallbacks.Value() - fallbacks; got != step.fallbacks {
+			t.Errorf("%s: %d fallbacks, want %d", step.name, got, step.fallbacks)
+		}
+	}
+}
+
+func TestLoadWebhookCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		file      string
+		primary   string // label
+		secondary string // label, or "" for none
+		wantErr   bool
+	}{
+		{name: "primary only", env: map[string]string{"SEND_WEBHOOK_USERNAME": "fax", "SEND_WEBHOOK_PASSWORD": "pw"}, primary: "primary"},
+		{name: "secondary pair", env: map[string]string{"SEND_WEBHOOK_USERNAME": "fax", "SEND_WEBHOOK_PASSWORD": "pw",
+			"SEND_WEBHOOK_PASSWORD_SECONDARY": "pw2"}, primary: "primary", secondary: "secondary"},
+		{name: "file", file: `{"primary":{"label":"a","password":"1"},"secondary":{"label":"b","password":"2"}}`, primary: "a", secondary: "b"},
+		{name: "file without primary", file: `{"secondary":{"password":"2"}}`, wantErr: true},
+		{name: "same labels", file: `{"primary":{"label":"a"},"secondary":{"label":"a"}}`, wantErr: true},
+		{name: "bad JSON", file: `{`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "credentials.json")
+				writeTestFile(t, path, tt.file)
+				env["SEND_WEBHOOK_CREDENTIALS_FILE"] = path
+			}
+			useTestConfig(t, env)
+			t.Cleanup(func() {
+				webhookCredentials.Lock()
+				webhookCredentials.primary, webhookCredentials.secondary = webhookCredential{}, nil
+				webhookCredentials.Unlock()
+			})
+
+			err := loadWebhookCredentials()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadWebhookCredentials() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			webhookCredentials.Lock()
+			primary, secondary := webhookCredentials.primary.Label, ""
+			if webhookCredentials.secondary != nil {
+				secondary = webhookCredentials.secondary.Label
+			}
+			webhookCredentials.Unlock()
+			if primary != tt.primary || secondary != tt.secondary {
+				t.Errorf("labels %q, %q; want %q, %q", primary, secondary, tt.primary, tt.secondary)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// Jobs that fail in submission or delivery keep their artifacts in
+// synergyfaxq/deadletter/<hylafax job id>/: the .sfc, the PDF and a
+// metadata.json with the error. Cancelled, rejected, invalid or blocked jobs
+// are not dead-lettered, since sending them again would fail the same way.
+// Resubmitting moves the files back into the queue directory, where the
+// watcher picks them up like a new upload: the job gets a fresh Hylafax job ID
+// and a new .jobid under its original Synergy job ID. A failed broadcast is
+// resubmitted to its failed destinations only. DEAD_LETTER_RESUBMIT_ON_START
+// resubmits every dead-lettered job at startup.
+
+const (
+	deadLetterDirName  = "deadletter"
+	deadLetterMetaFile = "metadata.json"
+)
+
+// deadLetter is the metadata.json of a dead-lettered job.
+type deadLetter struct {
+	HylaJobID     string    `json:"hyla_job_id"`
+	JobID         string    `json:"job_id"` // Synergy job ID (.sfc name without extension)
+	SfcFile       string    `json:"sfc_file"`
+	PdfFile       string    `json:"pdf_file,omitempty"`
+	FaxNumber     string    `json:"fax_number,omitempty"`
+	FailedNumbers []string  `json:"failed_numbers,omitempty"` // broadcasts: the destinations to send again
+	QueueDir      string    `json:"queue_dir,omitempty"`      // FAX_QUEUE_DIRS folder the job came from; empty for the default
+	Status        string    `json:"status"`
+	Error         string    `json:"error"`
+	FailedAt      time.Time `json:"failed_at"`
+}
+
+var (
+	jobsDeadLettered   = expvar.NewInt("jobs_dead_lettered")
+	jobsResubmitted    = expvar.NewInt("jobs_dead_letter_resubmitted")
+	errNoDeadLetter    = errors.New("no dead-lettered job with that ID")
+	errDeadLetterInUse = errors.New("the queue directory already has a job with this .sfc name")
+)
+
+// deadLetterDir returns the dead-letter directory, or the one of a job.
+func deadLetterDir(hylaJobID ...string) string {
+	return queueFile(filepath.Join(append([]string{deadLetterDirName}, hylaJobID...)...))
+}
+
+// deadLetterJob fails the job towards Synergy like failJob, but moves its
+// .sfc and PDF to the dead-letter directory instead of removing them. reason
+// is recorded as the error when it says more than status; failedNumbers
+// limits a resubmission to those destinations.
+func deadLetterJob(hylaJobID, status, reason, sfcPath, pdfPath string, failedNumbers ...string) {
+	defer recordFailedJobHistory(hylaJobID, status, sfcNumber([]string{sfcPath}))()
+	archiveSentJob(hylaJobID, sfcPath, pdfPath, status, cmp.Or(reason, status))
+	dir := deadLetterDir(hylaJobID)
+	if !config().DeadLetterEnabled || sfcPath == "" {
+		failJob(hylaJobID, status, sfcPath, pdfPath)
+		return
+	}
+	if err := makeQueueDir(dir); err != nil {
+		slog.Error("Unable to create dead-letter directory; removing job files", "job_id", hylaJobID, "file", dir, "err", err)
+		failJob(hylaJobID, status, sfcPath, pdfPath)
+		return
+	}
+	failJob(hylaJobID, status)
+	if reason == "" {
+		reason = status
+	}
+	meta := deadLetter{
+		HylaJobID:     hylaJobID,
+		JobID:         strings.TrimSuffix(filepath.Base(sfcPath), ".sfc"),
+		SfcFile:       filepath.Base(sfcPath),
+		FailedNumbers: failedNumbers,
+		Status:        status,
+		Error:         reason,
+		FailedAt:      time.Now().UTC(),
+	}
+	if queueDir := filepath.Dir(sfcPath); queueDir != filepath.Clean(queueFile("")) {
+		meta.QueueDir = queueDir
+	}
+	if content, err := os.ReadFile(sfcPath); err == nil {
+		if job, err := parseSfcFile(sfcPath, string(content)); err == nil {
+			meta.FaxNumber = job.FaxNumber
+		}
+	}
+	updateFailureInfo(hylaJobID, func(info *failureInfo) {
+		info.Number = cmp.Or(info.Number, meta.FaxNumber)
+		info.Error = reason
+	})
+	if err := os.Rename(sfcPath, filepath.Join(dir, meta.SfcFile)); err != nil {
+		slog.Error("Unable to dead-letter .sfc", "job_id", hylaJobID, "file", sfcPath, "err", err)
+	}
+	if pdfPath != "" {
+		meta.PdfFile = filepath.Base(pdfPath)
+		if err := os.Rename(pdfPath, filepath.Join(dir, meta.PdfFile)); err != nil {
+			slog.Error("Unable to dead-letter PDF", "job_id", hylaJobID, "file", pdfPath, "err", err)
+		}
+	}
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, deadLetterMetaFile), data, 0644); err != nil {
+		slog.Error("Unable to write dead-letter metadata", "job_id", hylaJobID, "file", dir, "err", err)
+	}
+	jobsDeadLettered.Add(1)
+	slog.Info("Fax job dead-lettered", "job_id", hylaJobID, "synergy_job_id", meta.JobID, "file", dir, "reason", reason)
+}
+
+// readDeadLetter reads the metadata of a dead-lettered job.
+func readDeadLetter(hylaJobID string) (deadLetter, error) {
+	var meta deadLetter
+	if hylaJobID == "" || hylaJobID != filepath.Base(hylaJobID) || hylaJobID == ".." {
+		return meta, errNoDeadLetter
+	}
+	data, err := os.ReadFile(filepath.Join(deadLetterDir(hylaJobID), deadLetterMetaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, errNoDeadLetter
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("unreadable %s: %w", deadLetterMetaFile, err)
+	}
+	return meta, nil
+}
+
+// listDeadLetters returns the dead-lettered jobs, oldest first.
+func listDeadLetters() []deadLetter {
+	entries, _ := os.ReadDir(deadLetterDir())
+	var jobs []deadLetter
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		meta, err := readDeadLetter(e.Name())
+		if err != nil {
+			slog.Warn("Skipping dead-letter entry", "file", deadLetterDir(e.Name()), "err", err)
+			continue
+		}
+		jobs = append(jobs, meta)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].FailedAt.Before(jobs[j].FailedAt) })
+	return jobs
+}
+
+// resubmitDeadLetter moves a dead-lettered job back into the queue directory
+// it came from. The PDF goes first, so the .sfc finds it when the watcher
+// picks it up.
+func resubmitDeadLetter(hylaJobID string) (deadLetter, error) {
+	meta, err := readDeadLetter(hylaJobID)
+	if err != nil {
+		return meta, err
+	}
+	dir := deadLetterDir(hylaJobID)
+	queueDir := queueDirFor(meta.QueueDir).Path
+	if _, err := os.Stat(filepath.Join(queueDir, meta.SfcFile)); err == nil {
+		return meta, errDeadLetterInUse
+	}
+
+	sfcPath := filepath.Join(dir, meta.SfcFile)
+	if len(meta.FailedNumbers) > 0 {
+		content, err := os.ReadFile(sfcPath)
+		if err != nil {
+			return meta, err
+		}
+		lines := strings.SplitN(string(content), "\n", 2)
+		lines[0] = strings.Join(meta.FailedNumbers, ", ") + "\r"
+		if err := os.WriteFile(sfcPath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+			return meta, err
+		}
+	}
+	// The startup scan skips a .sfc older than its .jobid, which the failed
+	// attempt left behind.
+	now := time.Now()
+	os.Chtimes(sfcPath, now, now)
+	if meta.PdfFile != "" {
+		if err := os.Rename(filepath.Join(dir, meta.PdfFile), filepath.Join(queueDir, meta.PdfFile)); err != nil {
+			return meta, fmt.Errorf("moving %s back: %w", meta.PdfFile, err)
+		}
+	}
+	if err := os.Rename(sfcPath, filepath.Join(queueDir, meta.SfcFile)); err != nil {
+		return meta, fmt.Errorf("moving %s back: %w", meta.SfcFile, err)
+	}
+	os.RemoveAll(dir)
+	jobsResubmitted.Add(1)
+	slog.Info("Dead-lettered fax job resubmitted", "job_id", hylaJobID, "synergy_job_id", meta.JobID, "file", filepath.Join(queueDir, meta.SfcFile))
+	return meta, nil
+}
+
+// resubmitDeadLetters resubmits every dead-lettered job. It runs at startup,
+// before the watcher scans the queue directory.
+func resubmitDeadLetters() {
+	jobs := listDeadLetters()
+	resubmitted := 0
+	for _, meta := range jobs {
+		if _, err := resubmitDeadLetter(meta.HylaJobID); err != nil {
+			slog.Error("Unable to resubmit dead-lettered job", "job_id", meta.HylaJobID, "err", err)
+			continue
+		}
+		resubmitted++
+	}
+	if len(jobs) > 0 {
+		slog.Info("Resubmitted dead-lettered jobs", "jobs", resubmitted, "failed", len(jobs)-resubmitted)
+	}
+}
+
+// registerDeadLetterRoutes adds the dead-letter listing and resubmission.
+func registerDeadLetterRoutes(admin iris.Party) {
+	documentRoute(admin.Get("/jobs/deadletter", func(ctx iris.Context) {
+		jobs := listDeadLetters()
+		if jobs == nil {
+			jobs = []deadLetter{}
+		}
+		ctx.JSON(jobs)
+	}), apiDoc{Summary: "List dead-lettered jobs, oldest first", Response: []deadLetter{}})
+
+	documentRoute(admin.Post("/jobs/deadletter/{id}/retry", func(ctx iris.Context) {
+		id := ctx.Params().Get("id")
+		meta, err := resubmitDeadLetter(id)
+		switch {
+		case errors.Is(err, errNoDeadLetter):
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": err.Error()})
+			return
+		case errors.Is(err, errDeadLetterInUse):
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.JSON(iris.Map{"error": err.Error()})
+			return
+		case err != nil:
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(iris.Map{"error": err.Error()})
+			return
+		}
+		actor := requestActor(ctx)
+		if actor == "" {
+			actor = ctx.RemoteAddr()
+		}
+		slog.Info("Dead-lettered job resubmitted by request", "job_id", id, "actor", actor)
+		ctx.StatusCode(iris.StatusAccepted)
+		ctx.JSON(iris.Map{"hyla_job_id": id, "job_id": meta.JobID, "resubmitted": true})
+	}), apiDoc{Summary: "Move a dead-lettered job back into the queue; it is sent again under a new Hylafax job ID", Response: struct {
+		HylaJobID   string `json:"hyla_job_id"`
+		JobID       string `json:"job_id"`
+		Resubmitted bool   `json:"resubmitted"`
+	}{}})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// inboundContent remembers the documents received per caller so that a
+// provider delivering the same fax twice under different UUIDs is detected.
+var inboundContent = struct {
+	sync.Mutex
+	seen map[string]inboundContentEntry // cidnum + "|" + sha256 -> first delivery
+}{seen: make(map[string]inboundContentEntry)}
+
+type inboundContentEntry struct {
+	UUID       string
+	ReceivedAt time.Time
+}
+
+var (
+	inboundDuplicatesByContent = expvar.NewInt("inbound_duplicates_by_content")
+	inboundDuplicatesByUUID    = expvar.NewInt("inbound_duplicates_by_uuid")
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's content.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// inboundDuplicateOf returns the UUID of an earlier fax from the same caller
+// with identical content received within the dedup window.
+func inboundDuplicateOf(cidNum, contentHash string) (string, bool) {
+	if !config().InboundDedupEnabled {
+		return "", false
+	}
+	window := config().InboundDedupWindow
+
+	inboundContent.Lock()
+	defer inboundContent.Unlock()
+	for key, entry := range inboundContent.seen {
+		if time.Since(entry.ReceivedAt) > window {
+			delete(inboundContent.seen, key)
+		}
+	}
+	entry, ok := inboundContent.seen[cidNum+"|"+contentHash]
+	if !ok {
+		return "", false
+	}
+	return entry.UUID, true
+}
+
+// inboundStored reports whether the fax with this UUID was stored within
+// INBOUND_UUID_DEDUP_WINDOW, so a provider's retry of a delivery that timed
+// out is not written again. A delivery that failed left no record, so its
+// retry is stored. Unlike the content check it does not depend on
+// INBOUND_DEDUP_ENABLED; a window of 0 turns it off.
+func inboundStored(uuid string) bool {
+	window := config().InboundUUIDWindow
+	if window <= 0 || uuid == "" {
+		return false
+	}
+	faxRecordsMutex.Lock()
+	defer faxRecordsMutex.Unlock()
+	record, ok := faxRecords[uuid]
+	return ok && record.Direction == "inbound" && record.PdfPath != "" &&
+		time.Since(record.ReceivedAt) <= window
+}
+
+// restoreInboundContent rebuilds the content index from the fax records
+// restored at startup. Callers hold faxRecordsMutex.
+func restoreInboundContent() {
+	inboundContent.Lock()
+	defer inboundContent.Unlock()
+	for uuid, record := range faxRecords {
+		if record.Direction == "inbound" && record.PdfPath != "" && record.ContentHash != "" {
+			inboundContent.seen[record.CIDNum+"|"+record.ContentHash] = inboundContentEntry{UUID: uuid, ReceivedAt: record.ReceivedAt}
+		}
+	}
+}
+
+// rememberInboundContent records a successfully stored fax for later dedup.
+func rememberInboundContent(cidNum, contentHash, uuid string) {
+	if !config().InboundDedupEnabled {
+		return
+	}
+	inboundContent.Lock()
+	defer inboundContent.Unlock()
+	inboundContent.seen[cidNum+"|"+contentHash] = inboundContentEntry{UUID: uuid, ReceivedAt: time.Now()}
+}
+
+// recordDuplicateReceive tracks a delivery that was skipped as a content duplicate.
+func recordDuplicateReceive(fax FaxReceive, contentHash, originalUUID string) {
+	inboundDuplicatesByContent.Add(1)
+
+	now := time.Now()
+	record := &FaxJobRecord{
+		ReceivedUUID: fax.UUID,
+		CallUUID:     fax.CallUUID,
+		Direction:    "inbound",
+		ContentHash:  contentHash,
+		DuplicateOf:  originalUUID,
+		ReceivedAt:   now,
+	}
+	record.setStatus("duplicate", statusSourceReceive, now)
+	faxRecordsMutex.Lock()
+	faxRecords[fax.UUID] = record
+	faxRecordsMutex.Unlock()
+	saveState()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestInboundStored(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		record *FaxJobRecord
+		want   bool
+	}{
+		{name: "stored", record: &FaxJobRecord{Direction: "inbound", PdfPath: "/in/fax.pdf", ReceivedAt: time.Now().Add(-time.Hour)}, want: true},
+		{name: "content dedup off", env: map[string]string{"INBOUND_DEDUP_ENABLED": "false"},
+			record: &FaxJobRecord{Direction: "inbound", PdfPath: "/in/fax.pdf", ReceivedAt: time.Now()}, want: true},
+		{name: "window off", env: map[string]string{"INBOUND_UUID_DEDUP_WINDOW": "0"},
+			record: &FaxJobRecord{Direction: "inbound", PdfPath: "/in/fax.pdf", ReceivedAt: time.Now()}},
+		{name: "outside the window", record: &FaxJobRecord{Direction: "inbound", PdfPath: "/in/fax.pdf", ReceivedAt: time.Now().Add(-25 * time.Hour)}},
+		{name: "delivery that failed", record: &FaxJobRecord{Direction: "inbound", ReceivedAt: time.Now()}},
+		{name: "outbound job", record: &FaxJobRecord{Direction: "outbound", PdfPath: "/out/fax.pdf", ReceivedAt: time.Now()}},
+		{name: "unknown UUID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, tt.env)
+			faxRecordsMutex.Lock()
+			delete(faxRecords, "fax-uuid")
+			if tt.record != nil {
+				faxRecords["fax-uuid"] = tt.record
+			}
+			faxRecordsMutex.Unlock()
+			t.Cleanup(func() {
+				faxRecordsMutex.Lock()
+				delete(faxRecords, "fax-uuid")
+				faxRecordsMutex.Unlock()
+			})
+
+			if got := inboundStored("fax-uuid"); got != tt.want {
+				t.Errorf("inboundStored() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInboundContentDedup(t *testing.T) {
+	const doc = "%PDF-1.4\n1 0 obj<<>>endobj\n%%EOF\n"
+	type delivery struct {
+		uuid, cidnum, doc string
+		raw               bool // sent as an application/pdf body instead of base64 JSON
+	}
+	tests := []struct {
+		name      string
+		env       map[string]string
+		second    delivery
+		duplicate bool
+	}{
+		{name: "same content, different UUID", second: delivery{uuid: "fax-b", cidnum: "6045551234", doc: doc}, duplicate: true},
+		{name: "same content, other encoding", second: delivery{uuid: "fax-b", cidnum: "6045551234", doc: doc, raw: true}, duplicate: true},
+		{name: "same content, different sender", second: delivery{uuid: "fax-b", cidnum: "6045559999", doc: doc}},
+		{name: "different content", second: delivery{uuid: "fax-b", cidnum: "6045551234", doc: doc + "%extra\n"}},
+		{name: "content dedup off", env: map[string]string{"INBOUND_DEDUP_ENABLED": "false"},
+			second: delivery{uuid: "fax-b", cidnum: "6045551234", doc: doc}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			cfg := useTestRecvFormat(t, env)
+
+			var got []map[string]any
+			for _, d := range []delivery{{uuid: "fax-a", cidnum: "6045551234", doc: doc}, tt.second} {
+				var rec *httptest.ResponseRecorder
+				if d.raw {
+					query := url.Values{"uuid": {d.uuid}, "cidnum": {d.cidnum}, "number": {"6045550100"}}
+					r := httptest.NewRequest("POST", "/fax-receive?"+query.Encode(), strings.NewReader(d.doc))
+					r.Header.Set("Content-Type", contentTypePDF)
+					rec = serveTestRequest(t, registerProviderRoutes, r)
+				} else {
+					body, _ := json.Marshal(FaxReceive{UUID: d.uuid, CIDNum: d.cidnum, Number: "6045550100",
+						FileData: base64.StdEncoding.EncodeToString([]byte(d.doc))})
+					r := httptest.NewRequest("POST", "/fax-receive", strings.NewReader(string(body)))
+					r.Header.Set("Content-Type", "application/json")
+					rec = serveTestRequest(t, registerProviderRoutes, r)
+				}
+				if rec.Code != 200 {
+					t.Fatalf("%s: status %d: %s", d.uuid, rec.Code, rec.Body)
+				}
+				var resp map[string]any
+				json.Unmarshal(rec.Body.Bytes(), &resp)
+				got = append(got, resp)
+			}
+
+			if dup, _ := got[1]["duplicate"].(bool); dup != tt.duplicate {
+				t.Fatalf("second delivery duplicate = %v, want %v (%v)", dup, tt.duplicate, got[1])
+			}
+			recvs, _ := filepath.Glob(filepath.Join(cfg.FTPRoot+FaxDir, "*.recv"))
+			want := 2
+			if tt.duplicate {
+				want = 1
+				if got[1]["duplicate_of"] != "fax-a" {
+					t.Errorf("duplicate_of = %v, want fax-a", got[1]["duplicate_of"])
+				}
+				faxRecordsMutex.Lock()
+				record := faxRecords["fax-b"]
+				faxRecordsMutex.Unlock()
+				if record == nil || record.DuplicateOf != "fax-a" || record.PdfPath != "" {
+					t.Errorf("duplicate record = %+v, want one linked to fax-a without a PDF", record)
+				}
+			}
+			if len(recvs) != want {
+				t.Errorf("%d .recv files, want %d", len(recvs), want)
+			}
+		})
+	}
+}
+
+func TestReceiveRedelivery(t *testing.T) {
+	const doc = "%PDF-1.4\n1 0 obj<<>>endobj\n%%EOF\n"
+	tests := []struct {
+		name      string
+		encoding  string // of the retry
+		restart   bool   // the service restarts between the deliveries
+		failRecv  bool   // writing the first delivery's .recv fails
+		duplicate bool
+	}{
+		{name: "retry of a stored fax", encoding: "json", duplicate: true},
+		{name: "retry in another encoding", encoding: "pdf", duplicate: true},
+		{name: "retry after a restart", encoding: "json", restart: true, duplicate: true},
+		{name: "retry after the .recv failed", encoding: "json", failRecv: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false"})
+			dir := cfg.FTPRoot + FaxDir
+			if tt.failRecv {
+				recvTemplate = template.Must(template.New("recv").Parse("{{.NoSuchField}}"))
+			}
+			first := receiveRequest(t, "json", []byte(doc))
+			if tt.failRecv {
+				if first.Code != 500 {
+					t.Fatalf("first delivery status %d, want 500: %s", first.Code, first.Body)
+				}
+				if pdfs, _ := filepath.Glob(filepath.Join(dir, "*.pdf")); len(pdfs) != 0 {
+					t.Fatalf("failed delivery left %q", pdfs)
+				}
+				if err := loadRecvFormat(); err != nil {
+					t.Fatal(err)
+				}
+			} else if first.Code != 200 {
+				t.Fatalf("first delivery status %d: %s", first.Code, first.Body)
+			}
+			if tt.restart {
+				restartService(t, nil)
+			}
+
+			before := inboundDuplicatesByUUID.Value()
+			rec := receiveRequest(t, tt.encoding, []byte(doc))
+			if rec.Code != 200 {
+				t.Fatalf("retry status %d: %s", rec.Code, rec.Body)
+			}
+			var resp map[string]any
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if dup, _ := resp["duplicate"].(bool); dup != tt.duplicate {
+				t.Errorf("retry duplicate = %v, want %v (%v)", dup, tt.duplicate, resp)
+			}
+			var wantCount int64
+			if tt.duplicate {
+				wantCount = 1
+			}
+			if got := inboundDuplicatesByUUID.Value() - before; got != wantCount {
+				t.Errorf("inbound_duplicates_by_uuid rose by %d, want %d", got, wantCount)
+			}
+			for _, ext := range []string{"*.pdf", "*.recv"} {
+				if files, _ := filepath.Glob(filepath.Join(dir, ext)); len(files) != 1 {
+					t.Errorf("queue folder has %q, want one %s", files, ext)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Writes to the queue directory are refused while the FTP_ROOT volume has
+// less than MIN_FREE_DISK_MB free: /fax-receive answers 507 Insufficient
+// Storage, so the provider retries later instead of leaving half a fax, and
+// no .sts or .jobid is written. Outbound jobs that arrive meanwhile are left
+// in the queue directory and picked up once space is freed. Free space is
+// published as disk_free_bytes, and a warning is logged when it drops below
+// DISK_WARN_FREE_MB.
+
+var errInsufficientDisk = errors.New("insufficient disk space")
+
+var diskGuard = struct {
+	sync.Mutex
+	low      bool            // below DISK_WARN_FREE_MB
+	deferred map[string]bool // .sfc paths waiting for space
+}{deferred: make(map[string]bool)}
+
+func init() {
+	expvar.Publish("disk_free_bytes", expvar.Func(func() any {
+		free, err := freeDiskBytes()
+		if err != nil {
+			return nil
+		}
+		return free
+	}))
+}
+
+// freeDiskBytes returns the space available to the service on FTP_ROOT.
+func freeDiskBytes() (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(config().FTPRoot, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// checkDiskSpace returns an error wrapping errInsufficientDisk when FTP_ROOT
+// has less than MIN_FREE_DISK_MB free. If the free space cannot be read the
+// write goes ahead.
+func checkDiskSpace() error {
+	minMB := uint64(config().MinFreeDiskMB)
+	if minMB == 0 {
+		return nil
+	}
+	free, err := freeDiskBytes()
+	if err != nil || free >= minMB<<20 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d MB free on %s, MIN_FREE_DISK_MB is %d", errInsufficientDisk, free>>20, config().FTPRoot, minMB)
+}
+
+// deferForDisk leaves an .sfc to be handled once disk space is freed.
+func deferForDisk(sfcPath string) {
+	diskGuard.Lock()
+	diskGuard.deferred[sfcPath] = true
+	diskGuard.Unlock()
+}
+
+// startDiskMonitor checks the free space every 30 seconds, warning when it
+// crosses DISK_WARN_FREE_MB and handling deferred jobs once it is back above
+// MIN_FREE_DISK_MB.
+func startDiskMonitor() {
+	go func() {
+		for {
+			checkDiskMonitor()
+			time.Sleep(30 * time.Second)
+		}
+	}()
+}
+
+func checkDiskMonitor() {
+	free, err := freeDiskBytes()
+	if err != nil {
+		slog.Warn("Unable to read free disk space", "file", config().FTPRoot, "err", err)
+		return
+	}
+	warnMB := uint64(config().DiskWarnFreeMB)
+	low := warnMB > 0 && free < warnMB<<20
+
+	diskGuard.Lock()
+	crossed := low != diskGuard.low
+	diskGuard.low = low
+	var retry []string
+	if checkDiskSpace() == nil {
+		for path := range diskGuard.deferred {
+			retry = append(retry, path)
+		}
+		clear(diskGuard.deferred)
+	}
+	diskGuard.Unlock()
+
+	if crossed && low {
+		slog.Warn("Free disk space is low", "file", config().FTPRoot, "free_mb", free>>20, "warn_mb", warnMB, "min_mb", config().MinFreeDiskMB)
+	} else if crossed {
+		slog.Info("Free disk space is back above the warning level", "file", config().FTPRoot, "free_mb", free>>20)
+	}
+	if len(retry) > 0 {
+		slog.Info("Disk space freed; handling deferred fax jobs", "jobs", len(retry))
+		for _, path := range retry {
+			handleSfcFile(path)
+		}
+	}
+}
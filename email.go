@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// RECEIVE_EMAIL_MAP sends received faxes for some numbers or tenants to email
+// instead of Synergy (fax-to-email). The file is a JSON array of entries:
+//
+//	[{"number": "6045550100", "to": ["frontdesk@clinic.example"]},
+//	 {"tenant_id": 12, "to": ["fax@tenant.example"], "queue": true}]
+//
+// An entry matches on the number the fax was sent to (digits only, a leading
+// country code optional) or on its dst_tenant_id; a number entry is tried
+// first. The PDF of a matching fax is mailed as an attachment through
+// SMTP_HOST, with RECEIVE_EMAIL_SUBJECT and RECEIVE_EMAIL_BODY as the
+// subject and body templates. A matching fax does not get a .recv: its PDF is
+// kept in the email/ folder of the queue directory until the mail is
+// accepted. With "queue": true it is also handed to Synergy as usual. Faxes
+// no entry matches go to the FTP folder as before. Like forwarding, sending
+// runs in the background and failures are retried RECEIVE_EMAIL_RETRIES
+// times; the outcome is kept in the fax record. The file is re-read on SIGHUP.
+
+// Email states kept in FaxJobRecord.EmailStatus.
+const (
+	emailPending   = "pending"
+	emailDelivered = "sent"
+	emailFailed    = "failed"
+)
+
+// emailDir is the folder under the queue directory holding the PDFs of
+// faxes that are only emailed.
+const emailDir = "email"
+
+var (
+	receiveEmailsSent   = expvar.NewInt("receive_emails_sent")
+	receiveEmailsFailed = expvar.NewInt("receive_emails_failed")
+)
+
+type emailRoute struct {
+	Number   string   `json:"number,omitempty"`
+	TenantID int      `json:"tenant_id,omitempty"`
+	To       []string `json:"to"`
+	Queue    bool     `json:"queue,omitempty"` // also deliver to Synergy
+}
+
+var emailRoutes = struct {
+	sync.Mutex
+	routes []emailRoute
+}{}
+
+// loadEmailMap reads RECEIVE_EMAIL_MAP, if set. On error the map in effect
+// is kept.
+func loadEmailMap() error {
+	path := config().ReceiveEmailMap
+	if path == "" {
+		emailRoutes.Lock()
+		emailRoutes.routes = nil
+		emailRoutes.Unlock()
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var routes []emailRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	for i := range routes {
+		r := &routes[i]
+		r.Number = digitsOnly(r.Number)
+		if (r.Number == "") == (r.TenantID == 0) {
+			return fmt.Errorf("%s: entry %d needs either a number or a tenant_id", path, i+1)
+		}
+		if len(r.To) == 0 {
+			return fmt.Errorf("%s: entry %d has no addresses", path, i+1)
+		}
+		for _, to := range r.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return fmt.Errorf("%s: entry %d: address %q: %w", path, i+1, to, err)
+			}
+		}
+	}
+
+	emailRoutes.Lock()
+	emailRoutes.routes = routes
+	emailRoutes.Unlock()
+	slog.Info("Loaded receive email map", "entries", len(routes), "file", path)
+	return nil
+}
+
+// matchEmailRoute returns the entry for a fax sent to number or tenantID.
+func matchEmailRoute(number string, tenantID int) (emailRoute, bool) {
+	number = digitsOnly(number)
+	emailRoutes.Lock()
+	defer emailRoutes.Unlock()
+	if number != "" {
+		for _, r := range emailRoutes.routes {
+			if r.Number != "" && sameNumber(r.Number, number) {
+				return r, true
+			}
+		}
+	}
+	if tenantID != 0 {
+		for _, r := range emailRoutes.routes {
+			if r.Number == "" && r.TenantID == tenantID {
+				return r, true
+			}
+		}
+	}
+	return emailRoute{}, false
+}
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// sameNumber compares digit strings, one of which may carry the country code.
+func sameNumber(a, b string) bool {
+	cc := digitsOnly(config().DefaultCountryCode)
+	return a == b || (cc != "" && (a == cc+b || cc+a == b))
+}
+
+// emailDirPath returns the folder of emailed faxes, creating it if need be.
+func emailDirPath(queueDir string) (string, error) {
+	dir := filepath.Join(queueDir, emailDir)
+	return dir, makeQueueDir(dir)
+}
+
+// emailReceivedFax starts mailing the received fax with the given record
+// key to the addresses of its entry.
+func emailReceivedFax(key string, route emailRoute) {
+	faxRecordsMutex.Lock()
+	record, ok := faxRecords[key]
+	if ok {
+		record.EmailStatus = emailPending
+		record.EmailTo = strings.Join(route.To, ", ")
+	}
+	faxRecordsMutex.Unlock()
+	if ok {
+		go runEmail(pipelineCtx, key)
+	}
+}
+
+// resumeEmails restarts the emails that were pending at the last shutdown.
+// It runs at startup, after loadState.
+func resumeEmails() {
+	var pending []string
+	faxRecordsMutex.Lock()
+	for key, record := range faxRecords {
+		if record.EmailStatus == emailPending {
+			pending = append(pending, key)
+		}
+	}
+	faxRecordsMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if config().SMTPHost == "" {
+		slog.Warn("Received faxes were waiting to be emailed, but SMTP_HOST is no longer set", "faxes", len(pending))
+		return
+	}
+	slog.Info("Resuming emails of received faxes", "faxes", len(pending))
+	for _, key := range pending {
+		go runEmail(pipelineCtx, key)
+	}
+}
+
+// runEmail sends the fax until the server accepts it or the retries run out.
+// When ctx is cancelled it stops, leaving the email pending for the next start.
+func runEmail(ctx context.Context, key string) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		faxRecordsMutex.Lock()
+		record, ok := faxRecords[key]
+		var snapshot FaxJobRecord
+		if ok {
+			snapshot = *record
+		}
+		faxRecordsMutex.Unlock()
+		if !ok || snapshot.EmailStatus != emailPending {
+			return
+		}
+
+		attempt := snapshot.EmailAttempts + 1
+		err := sendFaxEmail(ctx, key, snapshot)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		cfg := config()
+		status := emailPending
+		switch {
+		case err == nil:
+			status = emailDelivered
+			receiveEmailsSent.Add(1)
+			slog.Info("Emailed received fax", "uuid", key, "direction", "inbound", "to", snapshot.EmailTo, "attempt", attempt)
+			if snapshot.RecvPath == "" {
+				// Only emailed, so the copy in email/ is no longer needed.
+				if err := os.Remove(snapshot.PdfPath); err != nil && !os.IsNotExist(err) {
+					slog.Warn("Unable to remove emailed PDF", "uuid", key, "file", snapshot.PdfPath, "err", err)
+				}
+			}
+		case attempt > cfg.ReceiveEmailRetries:
+			status = emailFailed
+			receiveEmailsFailed.Add(1)
+			slog.Error("Giving up emailing received fax; its PDF is kept", "uuid", key, "direction", "inbound", "to", snapshot.EmailTo,
+				"file", snapshot.PdfPath, "attempts", attempt, "err", err)
+		default:
+			slog.Warn("Emailing received fax failed; retrying", "uuid", key, "direction", "inbound", "attempt", attempt,
+				"retry_in", emailBackoff(attempt), "err", err)
+		}
+
+		faxRecordsMutex.Lock()
+		if record, ok := faxRecords[key]; ok {
+			record.EmailStatus = status
+			record.EmailAttempts = attempt
+			record.EmailError = ""
+			if err != nil {
+				record.EmailError = err.Error()
+			}
+			if status == emailDelivered {
+				record.EmailedAt = time.Now()
+			}
+		}
+		faxRecordsMutex.Unlock()
+		saveState()
+		if status != emailPending {
+			return
+		}
+		select {
+		case <-time.After(emailBackoff(attempt)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// emailBackoff is the wait after the given attempt.
+func emailBackoff(attempt int) time.Duration {
+	delay := config().ReceiveEmailRetryBackoff
+	for i := 1; i < attempt && delay < maxForwardBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxForwardBackoff)
+}
+
+// faxEmailData is what the subject and body templates see.
+type faxEmailData struct {
+	UUID        string
+	CallUUID    string
+	CIDNum      string
+	CIDName     string
+	Number      string
+	DstTenantID int
+	Pages       int
+	ReceivedAt  time.Time
+}
+
+// parseEmailTemplates parses RECEIVE_EMAIL_SUBJECT and RECEIVE_EMAIL_BODY.
+func parseEmailTemplates(subject, body string) (*template.Template, *template.Template, error) {
+	subjectTmpl, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("RECEIVE_EMAIL_SUBJECT: %w", err)
+	}
+	bodyTmpl, err := template.New("body").Parse(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("RECEIVE_EMAIL_BODY: %w", err)
+	}
+	return subjectTmpl, bodyTmpl, nil
+}
+
+// sendFaxEmail makes one attempt at mailing the fax.
+func sendFaxEmail(ctx context.Context, key string, record FaxJobRecord) error {
+	cfg := config()
+	if cfg.SMTPHost == "" {
+		return fmt.Errorf("SMTP_HOST is not set")
+	}
+	var to []string
+	for _, addr := range strings.Split(record.EmailTo, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	data, err := os.ReadFile(record.PdfPath)
+	if err != nil {
+		return err
+	}
+
+	fields := faxEmailData{
+		UUID:        key,
+		CallUUID:    record.CallUUID,
+		CIDNum:      record.CIDNum,
+		CIDName:     record.CIDName,
+		Number:      record.Number,
+		DstTenantID: record.DstTenantID,
+		Pages:       record.Pages,
+		ReceivedAt:  record.ReceivedAt.In(recvLocation),
+	}
+	var subject, body bytes.Buffer
+	if err := cfg.receiveEmailSubject.Execute(&subject, fields); err != nil {
+		return fmt.Errorf("RECEIVE_EMAIL_SUBJECT: %w", err)
+	}
+	if err := cfg.receiveEmailBody.Execute(&body, fields); err != nil {
+		return fmt.Errorf("RECEIVE_EMAIL_BODY: %w", err)
+	}
+
+	var msg bytes.Buffer
+	writer := multipart.NewWriter(&msg)
+	headers := [][2]string{
+		{"From", cfg.SMTPFrom},
+		{"To", strings.Join(to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " "))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", key, cfg.SMTPHost)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/mixed; boundary=" + writer.Boundary()},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return err
+	}
+	part.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n")))
+
+	name := filepath.Base(record.PdfPath)
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType("application/pdf", map[string]string{"name": name})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		part.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	part.Write([]byte(encoded + "\r\n"))
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return sendMail(ctx, to, msg.Bytes())
+}
+
+// sendMail delivers one message through SMTP_HOST. Cancelling ctx closes
+// the connection.
+func sendMail(ctx context.Context, to []string, msg []byte) error {
+	cfg := config()
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+	dialer := net.Dialer{Timeout: cfg.SMTPTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	conn.SetDeadline(time.Now().Add(cfg.SMTPTimeout))
+	client, err := smtp.NewClient(conn, cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if cfg.SMTPStartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: cfg.SMTPHost, MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)); err != nil {
+			return fmt.Errorf("SMTP auth: %w", err)
+		}
+	}
+	if err := client.Mail(envelopeAddress(cfg.SMTPFrom)); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(envelopeAddress(rcpt)); err != nil {
+			return fmt.Errorf("recipient %s: %w", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// envelopeAddress returns the bare address of "Name <addr>".
+func envelopeAddress(s string) string {
+	if addr, err := mail.ParseAddress(s); err == nil {
+		return addr.Address
+	}
+	return s
+}
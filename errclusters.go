@@ -0,0 +1,200 @@
+package main
+
+import (
+	"expvar"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider failures are grouped by send route and by their ResultText with
+// numbers and IDs stripped, so that a new failure mode on one provider's side
+// shows up as one fast-growing cluster instead of dozens of unrelated job
+// records. Only failures no STATUS_MAP_FILE entry or built-in rule accounts
+// for are clustered: a busy line is not news.
+
+var (
+	clusterUUIDPattern   = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	clusterHexPattern    = regexp.MustCompile(`\b(0x)?[0-9a-f]*[0-9][0-9a-f]*[a-f][0-9a-f]*\b|\b(0x)?[0-9a-f]*[a-f][0-9a-f]*[0-9][0-9a-f]*\b`)
+	clusterNumberPattern = regexp.MustCompile(`\+?\d+(\.\d+)?`)
+	clusterSpacePattern  = regexp.MustCompile(`\s+`)
+	// SIP response codes and Q.850 causes tell failure modes apart, so
+	// they are kept.
+	clusterCodePattern = regexp.MustCompile(`\b(sip(/2\.0)?|cause) \d{2,3}\b`)
+)
+
+// normalizeResultText reduces a provider result text to its cluster key.
+func normalizeResultText(text string) string {
+	s := strings.ToLower(strings.TrimSpace(text))
+	s = clusterUUIDPattern.ReplaceAllString(s, "<id>")
+	s = clusterHexPattern.ReplaceAllString(s, "<id>")
+	s = clusterSpacePattern.ReplaceAllString(s, " ")
+	var b strings.Builder
+	last := 0
+	for _, code := range clusterCodePattern.FindAllStringIndex(s, -1) {
+		b.WriteString(clusterNumberPattern.ReplaceAllString(s[last:code[0]], "<n>"))
+		b.WriteString(s[code[0]:code[1]])
+		last = code[1]
+	}
+	b.WriteString(clusterNumberPattern.ReplaceAllString(s[last:], "<n>"))
+	s = b.String()
+	if s == "" {
+		return "<empty>"
+	}
+	return s
+}
+
+const maxClusterExamples = 5
+
+var errorClusterAlerts = expvar.NewInt("error_cluster_alerts")
+
+// errorClusterKey identifies a cluster: the send route the failed job went
+// to, empty for a notify that matched no job, and the normalized result text.
+type errorClusterKey struct {
+	provider string
+	text     string
+}
+
+// errorCluster is the rolling history of one normalized result text.
+type errorCluster struct {
+	key       errorClusterKey
+	sample    string // one original result text
+	firstSeen time.Time
+	events    []time.Time
+	examples  []string // most recent job UUIDs
+	alerted   bool
+}
+
+var errorClusters = struct {
+	sync.Mutex
+	clusters map[errorClusterKey]*errorCluster
+}{clusters: make(map[errorClusterKey]*errorCluster)}
+
+// recordProviderError adds a failed job's result text to the cluster of its
+// provider. A cluster first seen within the shortest window that reaches
+// ERROR_CLUSTER_ALERT_COUNT failures inside it is reported as a new systemic
+// error, with a warning and an error_cluster event.
+func recordProviderError(provider, resultText, jobUUID string) {
+	windows := config().errorClusterWindows
+	shortest, longest := windows[0], windows[len(windows)-1]
+	now := time.Now()
+	key := errorClusterKey{provider: provider, text: normalizeResultText(resultText)}
+
+	errorClusters.Lock()
+	c, ok := errorClusters.clusters[key]
+	if !ok {
+		c = &errorCluster{key: key, sample: resultText, firstSeen: now}
+		errorClusters.clusters[key] = c
+	}
+	c.events = append(c.events, now)
+	cut := 0
+	for cut < len(c.events) && now.Sub(c.events[cut]) > longest {
+		cut++
+	}
+	c.events = c.events[cut:]
+	c.examples = append(c.examples, jobUUID)
+	if len(c.examples) > maxClusterExamples {
+		c.examples = c.examples[len(c.examples)-maxClusterExamples:]
+	}
+
+	alert := !c.alerted && now.Sub(c.firstSeen) <= shortest && countSince(c.events, now.Add(-shortest)) >= config().ErrorClusterAlertCount
+	if alert {
+		c.alerted = true
+	}
+	failures, firstSeen, sample := len(c.events), c.firstSeen, c.sample
+	errorClusters.Unlock()
+
+	if alert {
+		slog.Warn("New provider error cluster", "provider", provider, "cluster", key.text, "failures", failures,
+			"since", firstSeen.Format(time.RFC3339), "sample", sample, "uuid", jobUUID)
+		errorClusterAlerts.Add(1)
+		queueFaxEvent(faxEvent{Type: eventErrorCluster, Direction: "outbound", UUID: jobUUID, Provider: provider,
+			Cluster: key.text, Failures: failures, Status: "new error cluster", Error: sample})
+	}
+}
+
+func countSince(events []time.Time, since time.Time) int {
+	i := sort.Search(len(events), func(i int) bool { return !events[i].Before(since) })
+	return len(events) - i
+}
+
+// errorClusterSummary lists clusters with failures in the longest window,
+// most frequent in the shortest window first.
+func errorClusterSummary(limit int) []iris.Map {
+	windows := config().errorClusterWindows
+	now := time.Now()
+
+	errorClusters.Lock()
+	defer errorClusters.Unlock()
+
+	type row struct {
+		counts []int
+		entry  iris.Map
+	}
+	var rows []row
+	for key, c := range errorClusters.clusters {
+		counts := make([]int, len(windows))
+		byWindow := iris.Map{}
+		for i, w := range windows {
+			counts[i] = countSince(c.events, now.Add(-w))
+			byWindow[w.String()] = counts[i]
+		}
+		if counts[len(counts)-1] == 0 {
+			delete(errorClusters.clusters, key)
+			continue
+		}
+		rows = append(rows, row{counts: counts, entry: iris.Map{
+			"provider":   key.provider,
+			"cluster":    key.text,
+			"sample":     c.sample,
+			"first_seen": c.firstSeen,
+			"counts":     byWindow,
+			"examples":   append([]string(nil), c.examples...),
+		}})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		for k := range windows {
+			if rows[i].counts[k] != rows[j].counts[k] {
+				return rows[i].counts[k] > rows[j].counts[k]
+			}
+		}
+		if pi, pj := rows[i].entry["provider"].(string), rows[j].entry["provider"].(string); pi != pj {
+			return pi < pj
+		}
+		return rows[i].entry["cluster"].(string) < rows[j].entry["cluster"].(string)
+	})
+
+	summary := make([]iris.Map, 0, len(rows))
+	for i, r := range rows {
+		if limit > 0 && i >= limit {
+			break
+		}
+		summary = append(summary, r.entry)
+	}
+	return summary
+}
+
+// registerErrorClusterRoutes adds GET /stats/errors?limit=N (default 20).
+func registerErrorClusterRoutes(admin iris.Party) {
+	documentRoute(admin.Get("/stats/errors", func(ctx iris.Context) {
+		limit := ctx.URLParamIntDefault("limit", 20)
+		ctx.JSON(iris.Map{"clusters": errorClusterSummary(limit)})
+	}), apiDoc{
+		Summary: "Provider failures grouped by send route and normalized result text",
+		Query:   map[string]string{"limit": "number of clusters to return, default 20"},
+		Response: struct {
+			Clusters []struct {
+				Provider  string         `json:"provider"` // send route; empty when the notify matched no job
+				Cluster   string         `json:"cluster"`
+				Sample    string         `json:"sample"`
+				FirstSeen time.Time      `json:"first_seen"`
+				Counts    map[string]int `json:"counts"` // window -> failures
+				Examples  []string       `json:"examples"`
+			} `json:"clusters"`
+		}{},
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestNormalizeResultTextCorpus runs result texts seen from FreeSWITCH
+// (mod_spandsp), SIP trunks and hosted fax providers through the normalizer.
+// Texts differing only in IDs, counts or addresses share a key; different
+// failure modes, including different SIP codes and Q.850 causes, do not.
+func TestNormalizeResultTextCorpus(t *testing.T) {
+	corpus := []struct {
+		text string
+		want string
+	}{
+		{"OK", "ok"},
+		{"Far end cannot receive at the resolution of the image", "far end cannot receive at the resolution of the image"},
+		{"Disconnected after permitted retries", "disconnected after permitted retries"},
+		{"Timed out waiting for initial communication", "timed out waiting for initial communication"},
+		{"Unexpected DCN after EOM or MPS sequence", "unexpected dcn after eom or mps sequence"},
+		{"Received no response to DCS or TCF", "received no response to dcs or tcf"},
+		{"Invalid ECM response received from receiver", "invalid ecm response received from receiver"},
+		{"NORMAL_TEMPORARY_FAILURE", "normal_temporary_failure"},
+		{"RECOVERY_ON_TIMER_EXPIRE", "recovery_on_timer_expire"},
+		{"INCOMPATIBLE_DESTINATION", "incompatible_destination"},
+		{"SIP 503 Service Unavailable", "sip 503 service unavailable"},
+		{"SIP 486 Busy Here", "sip 486 busy here"},
+		{"SIP/2.0 480 Temporarily Unavailable", "sip/2.0 480 temporarily unavailable"},
+		{"Hangup cause 41 (NORMAL_TEMPORARY_FAILURE)", "hangup cause 41 (normal_temporary_failure)"},
+		{"Hangup cause 127 (INTERWORKING)", "hangup cause 127 (interworking)"},
+		{"T.38 re-INVITE rejected (488 Not Acceptable Here)", "t.<n> re-invite rejected (<n> not acceptable here)"},
+		{"Fax failed on page 3 of 12: RTN received", "fax failed on page <n> of <n>: rtn received"},
+		{"Fax failed on page 11 of 40: RTN received", "fax failed on page <n> of <n>: rtn received"},
+		{"Call 3f2a9c1e-7b4d-4e21-9a0f-5c6d7e8f9a0b failed: gateway gw-east-2 unreachable", "call <id> failed: gateway gw-east-<n> unreachable"},
+		{"Call 8d1e2f3a-4b5c-4d6e-8f70-91a2b3c4d5e6 failed: gateway gw-west-1 unreachable", "call <id> failed: gateway gw-west-<n> unreachable"},
+		{"Media timeout after 30s from 10.20.0.14:16384", "media timeout after <n>s from <n>.<n>:<n>"},
+		{"Job 0x7f3a2b9c aborted by carrier", "job <id> aborted by carrier"},
+		{"Request id 5f2c9e1ab7 rate limited, retry after 120 seconds", "request id <id> rate limited, retry after <n> seconds"},
+		{"Error 500: upstream connect error or disconnect/reset before headers", "error <n>: upstream connect error or disconnect/reset before headers"},
+		{"Document conversion failed: unsupported PDF version 2.0", "document conversion failed: unsupported pdf version <n>"},
+		{"Number +16045551234 is on the do-not-call list", "number <n> is on the do-not-call list"},
+		{"Number  +17785550100   is on the do-not-call list ", "number <n> is on the do-not-call list"},
+		{"", "<empty>"},
+		{"   ", "<empty>"},
+	}
+	for _, c := range corpus {
+		if got := normalizeResultText(c.text); got != c.want {
+			t.Errorf("normalizeResultText(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
+
+// resetErrorClusters empties the error clusters and event queue for the test.
+func resetErrorClusters(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		errorClusters.Lock()
+		errorClusters.clusters = make(map[errorClusterKey]*errorCluster)
+		errorClusters.Unlock()
+		eventQueue.Lock()
+		eventQueue.events = nil
+		eventQueue.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+// queuedEvents returns the queued fax events of type eventType.
+func queuedEvents(eventType string) []faxEvent {
+	eventQueue.Lock()
+	defer eventQueue.Unlock()
+	var events []faxEvent
+	for _, e := range eventQueue.events {
+		if e.Type == eventType {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestRecordProviderError(t *testing.T) {
+	useTestConfig(t, map[string]string{"ERROR_CLUSTER_ALERT_COUNT": "3",
+		"EVENT_WEBHOOK_URL": "http://127.0.0.1:9/events", "EVENT_WEBHOOK_TYPES": "error_cluster"})
+	resetErrorClusters(t)
+
+	// Two failures on each provider stay below the alert count.
+	for _, provider := range []string{"local", "default"} {
+		recordProviderError(provider, "Fax failed on page 3 of 12: RTN received", "uuid-"+provider+"-1")
+		recordProviderError(provider, "Fax failed on page 7 of 9: RTN received", "uuid-"+provider+"-2")
+	}
+	if events := queuedEvents(eventErrorCluster); len(events) != 0 {
+		t.Fatalf("events %+v before any cluster reached the alert count", events)
+	}
+	summary := errorClusterSummary(0)
+	if len(summary) != 2 || summary[0]["provider"] != "default" || summary[1]["provider"] != "local" {
+		t.Fatalf("summary %v, want one cluster per provider", summary)
+	}
+
+	recordProviderError("local", "Fax failed on page 1 of 2: RTN received", "uuid-local-3")
+	recordProviderError("local", "Fax failed on page 2 of 2: RTN received", "uuid-local-4")
+	events := queuedEvents(eventErrorCluster)
+	if len(events) != 1 {
+		t.Fatalf("events %+v, want one error_cluster", events)
+	}
+	if e := events[0]; e.Provider != "local" || e.Cluster != "fax failed on page <n> of <n>: rtn received" ||
+		e.Failures != 3 || e.UUID != "uuid-local-3" || e.Error == "" {
+		t.Errorf("event %+v", e)
+	}
+}
+
+// TestNotifyErrorClusters checks that only failures the status mapping does
+// not account for are clustered, under the send route of their job.
+func TestNotifyErrorClusters(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		result   string
+		provider string // of the cluster, if any
+	}{
+		{name: "unmapped failure", status: "failed", result: "Gateway gw-east-2 unreachable", provider: "local"},
+		{name: "busy", status: "failed", result: "USER_BUSY"},
+		{name: "no answer status", status: "no_answer", result: "Call 3f2a9c1e-7b4d-4e21-9a0f-5c6d7e8f9a0b timed out"},
+		{name: "success", status: "completed", result: "OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			resetErrorClusters(t)
+			queueSentJob(t, cfg, "job-uuid", jobQ{route: "local"})
+
+			body := `{"fax_job_results":{"fax_job":{"uuid":"job-uuid","status":"completed"},` +
+				`"results":{"1":{"uuid":"job-uuid","status":"` + tt.status + `","result":{"success":` +
+				strconv.FormatBool(tt.status == "completed") + `,"result_text":"` + tt.result + `"}}}}}`
+			req := httptest.NewRequest("POST", "/fax-notify", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if rec := serveTestRequest(t, registerProviderRoutes, req); rec.Code != 200 {
+				t.Fatalf("notify status %d: %s", rec.Code, rec.Body)
+			}
+
+			summary := errorClusterSummary(0)
+			if tt.provider == "" {
+				if len(summary) != 0 {
+					t.Errorf("clusters %v, want none", summary)
+				}
+				return
+			}
+			if len(summary) != 1 || summary[0]["provider"] != tt.provider || summary[0]["cluster"] != normalizeResultText(tt.result) {
+				t.Errorf("clusters %v, want one for %s", summary, tt.provider)
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With EVENT_WEBHOOK_URL set, the fax lifecycle events named in
+// EVENT_WEBHOOK_TYPES are posted there as compact JSON, for a ticketing or
+// monitoring system: a fax received, a job accepted by the provider
+// (submitted), a dial that failed and will be redialled (retrying), a sent
+// fax's final outcome (sent or failed), and an .sfc or PDF left waiting for
+// the other past PAIR_ALERT_AFTER (unmatched), and a new cluster of provider
+// failures reaching ERROR_CLUSTER_ALERT_COUNT (error_cluster). With EVENT_WEBHOOK_SECRET set,
+// each request carries X-Signature: sha256=<hex HMAC-SHA256 of the body>.
+//
+// Events are delivered one at a time, oldest first. Each is kept in
+// DATA_DIR/events/<id>.json until the receiver answers 2xx, so events queued
+// while it is down survive a restart. A connection error, 5xx or 429 is
+// retried EVENT_WEBHOOK_RETRY_BACKOFF later, doubling; any other answer
+// drops the event. Past EVENT_WEBHOOK_QUEUE_MAX pending events the oldest is
+// dropped.
+
+// Event types, as named in EVENT_WEBHOOK_TYPES.
+const (
+	eventReceived     = "received"
+	eventSubmitted    = "submitted"
+	eventRetrying     = "retrying"
+	eventSent         = "sent"
+	eventFailed       = "failed"
+	eventUnmatched    = "unmatched"
+	eventErrorCluster = "error_cluster"
+)
+
+var faxEventTypes = []string{eventReceived, eventSubmitted, eventRetrying, eventSent, eventFailed, eventUnmatched, eventErrorCluster}
+
+const eventQueueDirName = "events"
+
+// maxEventBackoff caps the wait between delivery attempts.
+const maxEventBackoff = 10 * time.Minute
+
+var (
+	eventWebhookSent     = expvar.NewInt("event_webhook_sent")
+	eventWebhookFailures = expvar.NewInt("event_webhook_failures") // attempts that failed
+	eventWebhookDropped  = expvar.NewInt("event_webhook_dropped")  // refused, or pushed out of a full queue
+)
+
+func init() {
+	expvar.Publish("event_webhook_pending", expvar.Func(func() any {
+		eventQueue.Lock()
+		defer eventQueue.Unlock()
+		return len(eventQueue.events)
+	}))
+}
+
+// faxEvent is the body posted to EVENT_WEBHOOK_URL.
+type faxEvent struct {
+	ID           string     `json:"id"` // unique, for the receiver to spot a redelivery
+	Type         string     `json:"type"`
+	Direction    string     `json:"direction"`
+	UUID         string     `json:"uuid,omitempty"`   // of the received fax, or of the dial
+	JobID        string     `json:"job_id,omitempty"` // Hylafax job ID
+	SynergyJobID string     `json:"synergy_job_id,omitempty"`
+	User         string     `json:"user,omitempty"`
+	From         string     `json:"from,omitempty"`     // caller number
+	To           string     `json:"to,omitempty"`       // destination or called number
+	File         string     `json:"file,omitempty"`     // the .sfc or PDF of an unmatched event
+	Provider     string     `json:"provider,omitempty"` // send route of an error_cluster event
+	Cluster      string     `json:"cluster,omitempty"`  // normalized result text of an error_cluster event
+	Failures     int        `json:"failures,omitempty"` // failures in the cluster so far
+	Status       string     `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	ResultCode   int        `json:"result_code,omitempty"`
+	Pages        int        `json:"pages,omitempty"`
+	Dials        int        `json:"dials,omitempty"`
+	SubmittedAt  *time.Time `json:"submitted_at,omitempty"`
+	OccurredAt   time.Time  `json:"occurred_at"`
+}
+
+// eventQueue holds the pending events, oldest first, as also kept on disk.
+var eventQueue = struct {
+	sync.Mutex
+	events []faxEvent
+	wake   chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+func eventQueueDir() string {
+	return filepath.Join(config().DataDir, eventQueueDirName)
+}
+
+func eventPath(id string) string {
+	return filepath.Join(eventQueueDir(), id+".json")
+}
+
+// faxEventWanted reports whether events of type t are posted.
+func faxEventWanted(t string) bool {
+	cfg := config()
+	return cfg.EventWebhookURL != "" && cfg.eventWebhookTypes[t]
+}
+
+// queueFaxEvent queues e for delivery, if its type is wanted.
+func queueFaxEvent(e faxEvent) {
+	if !faxEventWanted(e.Type) {
+		return
+	}
+	e.ID = uuid.New().String()
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Error encoding fax event", "type", e.Type, "job_id", e.JobID, "uuid", e.UUID, "err", err)
+		return
+	}
+
+	eventQueue.Lock()
+	// Written under the lock, so a full queue drops the oldest file, not a newer one.
+	if err := os.MkdirAll(eventQueueDir(), 0755); err == nil {
+		err = writeQueueFile(eventPath(e.ID), data, 0644)
+	}
+	if err != nil {
+		// Still delivered, unless the service restarts first.
+		slog.Error("Unable to save fax event", "type", e.Type, "job_id", e.JobID, "uuid", e.UUID, "file", eventPath(e.ID), "err", err)
+	}
+	eventQueue.events = append(eventQueue.events, e)
+	dropOldEvents()
+	eventQueue.Unlock()
+
+	select {
+	case eventQueue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dropOldEvents trims the queue to EVENT_WEBHOOK_QUEUE_MAX. Callers hold
+// eventQueue.
+func dropOldEvents() {
+	for len(eventQueue.events) > config().EventWebhookQueueMax {
+		e := eventQueue.events[0]
+		eventQueue.events = eventQueue.events[1:]
+		os.Remove(eventPath(e.ID))
+		eventWebhookDropped.Add(1)
+		slog.Warn("Event webhook queue is full; dropping the oldest event", "event_id", e.ID, "type", e.Type,
+			"job_id", e.JobID, "uuid", e.UUID, "occurred_at", e.OccurredAt)
+	}
+}
+
+// historyEvent is the event of a fax entered in the fax history.
+func historyEvent(h faxHistoryEntry) faxEvent {
+	e := faxEvent{
+		Direction:   h.Direction,
+		From:        h.From,
+		To:          h.To,
+		Status:      h.Result,
+		ResultCode:  h.ResultCode,
+		Pages:       h.Pages,
+		Dials:       h.Dials,
+		SubmittedAt: h.SubmittedAt,
+		OccurredAt:  h.CompletedAt.UTC(),
+	}
+	switch {
+	case h.Direction == "inbound":
+		e.Type, e.Status, e.UUID = eventReceived, eventReceived, h.ID
+	case h.Result == "success":
+		e.Type, e.UUID, e.JobID, e.SynergyJobID, e.User = eventSent, h.JobUUID, h.ID, h.SynergyJobID, h.User
+	default:
+		e.Type, e.UUID, e.JobID, e.SynergyJobID, e.User = eventFailed, h.JobUUID, h.ID, h.SynergyJobID, h.User
+		e.Error = h.ResultText
+	}
+	return e
+}
+
+// queueJobEvent queues an event of an outbound job that has not finished:
+// submitted, or retrying after the dial of result.
+func queueJobEvent(eventType string, jobQq jobQ, result FaxJob, status string) {
+	if !faxEventWanted(eventType) {
+		return
+	}
+	acceptedAt := jobQq.acceptedAt.UTC()
+	e := faxEvent{
+		Type:         eventType,
+		Direction:    "outbound",
+		UUID:         result.UUID,
+		JobID:        jobQq.hylaJobID,
+		SynergyJobID: jobQq.synergyJobID,
+		User:         jobQq.user,
+		From:         result.CIDNum,
+		To:           jobDestination(jobQq, result.Number),
+		Status:       status,
+		ResultCode:   result.Result.ResultCode,
+		Pages:        jobQq.pages,
+		Dials:        max(jobQq.dials, 1),
+		SubmittedAt:  &acceptedAt,
+	}
+	if eventType == eventRetrying {
+		e.Error = result.Result.ResultText
+	}
+	queueFaxEvent(e)
+}
+
+// startEventWebhook loads the events pending at the last shutdown and starts
+// delivering them in the background.
+func startEventWebhook() {
+	events := readEventQueue()
+	eventQueue.Lock()
+	eventQueue.events = append(events, eventQueue.events...)
+	dropOldEvents()
+	pending := len(eventQueue.events)
+	eventQueue.Unlock()
+	if pending > 0 {
+		if config().EventWebhookURL == "" {
+			slog.Warn("Fax events are waiting to be posted, but EVENT_WEBHOOK_URL is no longer set", "events", pending, "file", eventQueueDir())
+		} else {
+			slog.Info("Resuming event webhook deliveries", "events", pending)
+		}
+	}
+	go runEventWebhook(pipelineCtx)
+}
+
+// readEventQueue returns the events saved on disk, oldest first.
+func readEventQueue() []faxEvent {
+	files, err := os.ReadDir(eventQueueDir())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Unable to read event webhook queue", "file", eventQueueDir(), "err", err)
+		}
+		return nil
+	}
+	var events []faxEvent
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" || isQueueTempFile(f.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(eventQueueDir(), f.Name()))
+		if err != nil {
+			continue
+		}
+		var e faxEvent
+		if err := json.Unmarshal(data, &e); err != nil || e.ID == "" {
+			slog.Warn("Skipping unreadable fax event", "file", f.Name(), "err", err)
+			continue
+		}
+		events = append(events, e)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].OccurredAt.Before(events[j].OccurredAt) })
+	return events
+}
+
+// runEventWebhook delivers the queue, waiting for new events when it is
+// empty or EVENT_WEBHOOK_URL is not set. It stops when ctx is cancelled; the
+// undelivered events stay on disk for the next start.
+func runEventWebhook(ctx context.Context) {
+	failures := 0
+	for {
+		eventQueue.Lock()
+		var e faxEvent
+		ok := len(eventQueue.events) > 0
+		if ok {
+			e = eventQueue.events[0]
+		}
+		eventQueue.Unlock()
+		if !ok || config().EventWebhookURL == "" {
+			select {
+			case <-eventQueue.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		retry, err := postFaxEvent(ctx, e)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err == nil:
+			eventWebhookSent.Add(1)
+			slog.Info("Posted fax event", "event_id", e.ID, "type", e.Type, "job_id", e.JobID, "uuid", e.UUID)
+		case !retry:
+			eventWebhookFailures.Add(1)
+			eventWebhookDropped.Add(1)
+			slog.Error("Event webhook refused fax event; dropping it", "event_id", e.ID, "type", e.Type, "job_id", e.JobID,
+				"uuid", e.UUID, "err", err)
+		default:
+			failures++
+			eventWebhookFailures.Add(1)
+			wait := eventBackoff(failures)
+			slog.Warn("Posting fax event failed; retrying", "event_id", e.ID, "type", e.Type, "job_id", e.JobID,
+				"uuid", e.UUID, "attempt", failures, "retry_in", wait, "err", err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		failures = 0
+		removeFaxEvent(e.ID)
+	}
+}
+
+// removeFaxEvent takes a delivered or refused event off the queue, unless a
+// full queue dropped it meanwhile.
+func removeFaxEvent(id string) {
+	eventQueue.Lock()
+	defer eventQueue.Unlock()
+	for i, e := range eventQueue.events {
+		if e.ID == id {
+			eventQueue.events = append(eventQueue.events[:i], eventQueue.events[i+1:]...)
+			os.Remove(eventPath(id))
+			return
+		}
+	}
+}
+
+// eventBackoff is the wait after the given number of failed attempts.
+func eventBackoff(failures int) time.Duration {
+	delay := config().EventWebhookRetryBackoff
+	for i := 1; i < failures && delay < maxEventBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxEventBackoff)
+}
+
+// postFaxEvent makes one delivery attempt. retry reports whether a failure
+// is worth retrying.
+func postFaxEvent(ctx context.Context, e faxEvent) (retry bool, err error) {
+	cfg := config()
+	body, err := json.Marshal(e)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.EventWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", e.ID)
+	req.Header.Set("X-Event-Type", e.Type)
+	if cfg.EventWebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.EventWebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := &http.Client{Transport: proxiedTransport(), Timeout: cfg.EventWebhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return retryableSubmit(resp, nil), fmt.Errorf("event webhook returned %s", resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A failed job gets a q<jobid>.info next to its .fail, so that front-line
+// staff can tell why a fax did not go without reading the service's logs. It
+// has key:value lines like the .sts:
+//
+//	jobid:42
+//	number:6045551234
+//	dials:3
+//	result_code:3
+//	status:no answer: NO ANSWER (code 3)
+//	error:NO ANSWER
+//	accepted:2026-01-02T15:04:05Z
+//	failed:2026-01-02T15:20:11Z
+//
+// failJob writes what every failure knows; the dead-letter and notify paths
+// add the destination, dial count and provider result. GET /jobs/{id} returns
+// it by Hylafax job ID.
+
+// failureInfo is the content of a q<jobid>.info file.
+type failureInfo struct {
+	HylaJobID  string    `json:"hyla_job_id"`
+	Number     string    `json:"number,omitempty"`
+	Dials      int       `json:"dials,omitempty"`
+	ResultCode int       `json:"result_code,omitempty"`
+	Status     string    `json:"status"` // the .sts status line
+	Error      string    `json:"error,omitempty"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+func failureInfoPath(hylaJobID string) string {
+	return jobFile(hylaJobID, fmt.Sprintf("q%s.info", hylaJobID))
+}
+
+// readFailureInfo reads the q<jobid>.info of a failed job.
+func readFailureInfo(hylaJobID string) (failureInfo, error) {
+	info := failureInfo{HylaJobID: hylaJobID}
+	if hylaJobID == "" || strings.ContainsAny(hylaJobID, `/\`) {
+		return info, os.ErrNotExist
+	}
+	content, err := os.ReadFile(failureInfoPath(hylaJobID))
+	if err != nil {
+		return info, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "number":
+			info.Number = value
+		case "dials":
+			info.Dials, _ = strconv.Atoi(value)
+		case "result_code":
+			info.ResultCode, _ = strconv.Atoi(value)
+		case "status":
+			info.Status = value
+		case "error":
+			info.Error = value
+		case "accepted":
+			info.AcceptedAt, _ = time.Parse(time.RFC3339, value)
+		case "failed":
+			info.FailedAt, _ = time.Parse(time.RFC3339, value)
+		}
+	}
+	return info, nil
+}
+
+// updateFailureInfo applies update to the job's q<jobid>.info, creating it
+// if need be.
+func updateFailureInfo(hylaJobID string, update func(*failureInfo)) {
+	info, err := readFailureInfo(hylaJobID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Unable to read .info; rewriting it", "job_id", hylaJobID, "err", err)
+	}
+	update(&info)
+	if info.FailedAt.IsZero() {
+		info.FailedAt = time.Now()
+	}
+
+	// Values are kept to one line.
+	line := func(v string) string { return strings.Join(strings.Fields(v), " ") }
+	var b strings.Builder
+	fmt.Fprintf(&b, "jobid:%s\n", hylaJobID)
+	if info.Number != "" {
+		fmt.Fprintf(&b, "number:%s\n", line(info.Number))
+	}
+	if info.Dials > 0 {
+		fmt.Fprintf(&b, "dials:%d\n", info.Dials)
+	}
+	if info.ResultCode != 0 {
+		fmt.Fprintf(&b, "result_code:%d\n", info.ResultCode)
+	}
+	fmt.Fprintf(&b, "status:%s\n", line(info.Status))
+	if info.Error != "" {
+		fmt.Fprintf(&b, "error:%s\n", line(info.Error))
+	}
+	if !info.AcceptedAt.IsZero() {
+		fmt.Fprintf(&b, "accepted:%s\n", info.AcceptedAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "failed:%s\n", info.FailedAt.UTC().Format(time.RFC3339))
+	if err := writeQueueFile(failureInfoPath(hylaJobID), []byte(b.String()), 0644); err != nil {
+		slog.Error("Error writing .info", "job_id", hylaJobID, "err", err)
+	}
+}
+
+// sfcNumber returns the destination of the .sfc among paths, if any.
+func sfcNumber(paths []string) string {
+	for _, path := range paths {
+		if filepath.Ext(path) != ".sfc" {
+			continue
+		}
+		if content, err := os.ReadFile(path); err == nil {
+			if job, err := parseSfcFile(path, string(content)); err == nil {
+				return job.FaxNumber
+			}
+		}
+	}
+	return ""
+}
+
+// failureStatus is the .sts status line for a failed notify result: the
+// mapped message with the provider's result text and code.
+func failureStatus(message string, result FaxResult) string {
+	status := message
+	if text := strings.TrimSpace(result.ResultText); text != "" && !strings.EqualFold(text, message) {
+		status += ": " + text
+	}
+	if result.ResultCode != 0 {
+		status += fmt.Sprintf(" (code %d)", result.ResultCode)
+	}
+	return status
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault injection for resilience testing in staging. Everything here is inert
+// unless FAULTS_ENABLED=true at startup; the injection points check
+// faultsEnabled first so disabled deployments pay nothing.
+
+const (
+	faultSubmitFail  = "submit-fail"  // fail the next Count provider submissions with Status
+	faultNotifyDelay = "notify-delay" // delay the next Count notify deliveries by Delay
+	faultFSWriteEIO  = "fs-write-eio" // fail the next Count queue file writes with EIO
+)
+
+var faultsEnabled bool
+
+// armedFault is a fault that fires Count more times or until ExpiresAt.
+type armedFault struct {
+	Name      string        `json:"name"`
+	Count     int           `json:"count"`
+	Status    int           `json:"status,omitempty"`
+	Delay     time.Duration `json:"delay,omitempty"`
+	ArmedBy   string        `json:"armed_by"`
+	ArmedAt   time.Time     `json:"armed_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// faultAuditEntry records every arm, disarm, and firing of a fault.
+type faultAuditEntry struct {
+	Time   time.Time `json:"time"`
+	Fault  string    `json:"fault"`
+	Action string    `json:"action"` // "armed", "fired", "disarmed", "expired"
+	Actor  string    `json:"actor,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+const maxFaultAudit = 500
+
+var faults = struct {
+	sync.Mutex
+	armed map[string]*armedFault
+	audit []faultAuditEntry
+}{armed: make(map[string]*armedFault)}
+
+func initFaults() {
+	faultsEnabled = config().FaultsEnabled
+	if faultsEnabled {
+		slog.Warn("Fault injection is enabled; do not run this configuration in production")
+	}
+}
+
+// auditFault appends to the audit trail. Callers must hold faults.
+func auditFault(fault, action, actor, detail string) {
+	entry := faultAuditEntry{Time: time.Now(), Fault: fault, Action: action, Actor: actor, Detail: detail}
+	faults.audit = append(faults.audit, entry)
+	if len(faults.audit) > maxFaultAudit {
+		faults.audit = faults.audit[len(faults.audit)-maxFaultAudit:]
+	}
+	slog.Info("Fault "+action, "fault", fault, "actor", actor, "detail", detail)
+}
+
+// takeFault consumes one firing of the named fault, if armed.
+func takeFault(name string) (armedFault, bool) {
+	faults.Lock()
+	defer faults.Unlock()
+
+	f, ok := faults.armed[name]
+	if !ok {
+		return armedFault{}, false
+	}
+	if time.Now().After(f.ExpiresAt) {
+		delete(faults.armed, name)
+		auditFault(name, "expired", "", "")
+		return armedFault{}, false
+	}
+	f.Count--
+	auditFault(name, "fired", "", fmt.Sprintf("(%d remaining)", f.Count))
+	if f.Count <= 0 {
+		delete(faults.armed, name)
+		auditFault(name, "disarmed", "", "count exhausted")
+	}
+	return *f, true
+}
+
+// faultTransport fails provider submissions while submit-fail is armed.
+type faultTransport struct {
+	next http.RoundTripper
+}
+
+func (t faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f, ok := takeFault(faultSubmitFail); ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		body := fmt.Sprintf(`{"error":"injected fault %s"}`, faultSubmitFail)
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+			StatusCode: f.Status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// submitTransport returns the transport for provider submissions: the send
+// webhook's, failing while submit-fail is armed. Health checks and cancels
+// use sendTransport so an armed fault only ever hits submissions.
+func submitTransport() http.RoundTripper {
+	if faultsEnabled {
+		return faultTransport{next: sendTransport()}
+	}
+	return sendTransport()
+}
+
+// injectNotifyDelay sleeps while notify-delay is armed.
+func injectNotifyDelay() {
+	if !faultsEnabled {
+		return
+	}
+	if f, ok := takeFault(faultNotifyDelay); ok {
+		time.Sleep(f.Delay)
+	}
+}
+
+// injectWriteFault returns EIO for path while fs-write-eio is armed.
+func injectWriteFault(path string) error {
+	if !faultsEnabled {
+		return nil
+	}
+	if _, ok := takeFault(faultFSWriteEIO); ok {
+		return &os.PathError{Op: "write", Path: path, Err: syscall.EIO}
+	}
+	return nil
+}
+
+// faultRequest is the body accepted by POST /admin/faults.
+type faultRequest struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	Status int    `json:"status"`
+	Delay  string `json:"delay"`
+	TTL    string `json:"ttl"` // automatic disarm, default 15m
+}
+
+// registerFaultRoutes adds the fault admin endpoints when fault injection is enabled.
+func registerFaultRoutes(admin iris.Party) {
+	if !faultsEnabled {
+		return
+	}
+
+	documentRoute(admin.Get("/faults", func(ctx iris.Context) {
+		faults.Lock()
+		defer faults.Unlock()
+		armed := make([]armedFault, 0, len(faults.armed))
+		for _, f := range faults.armed {
+			armed = append(armed, *f)
+		}
+		ctx.JSON(iris.Map{"armed": armed, "audit": faults.audit})
+	}), apiDoc{Summary: "Armed faults and the fault audit trail", Response: struct {
+		Armed []armedFault      `json:"armed"`
+		Audit []faultAuditEntry `json:"audit"`
+	}{}})
+
+	documentRoute(admin.Post("/faults", func(ctx iris.Context) {
+		var req faultRequest
+		if err := ctx.ReadJSON(&req); err != nil {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": err.Error()})
+			return
+		}
+
+		f := &armedFault{Name: req.Name, Count: req.Count, Status: req.Status, ArmedBy: faultActor(ctx), ArmedAt: time.Now()}
+		if f.Count <= 0 {
+			f.Count = 1
+		}
+		switch req.Name {
+		case faultSubmitFail:
+			if f.Status == 0 {
+				f.Status = http.StatusServiceUnavailable
+			}
+		case faultNotifyDelay:
+			delay, err := time.ParseDuration(req.Delay)
+			if err != nil || delay <= 0 {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "notify-delay requires a positive delay"})
+				return
+			}
+			f.Delay = delay
+		case faultFSWriteEIO:
+		default:
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": "unknown fault " + req.Name})
+			return
+		}
+
+		ttl := 15 * time.Minute
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "invalid ttl " + req.TTL})
+				return
+			}
+			ttl = d
+		}
+		f.ExpiresAt = f.ArmedAt.Add(ttl)
+
+		faults.Lock()
+		faults.armed[f.Name] = f
+		auditFault(f.Name, "armed", f.ArmedBy, fmt.Sprintf("count=%d status=%d delay=%s ttl=%s", f.Count, f.Status, f.Delay, ttl))
+		faults.Unlock()
+
+		ctx.JSON(f)
+	}), apiDoc{Summary: "Arm a fault", Request: faultRequest{}, Response: armedFault{}})
+
+	documentRoute(admin.Delete("/faults/{name}", func(ctx iris.Context) {
+		name := ctx.Params().Get("name")
+		faults.Lock()
+		defer faults.Unlock()
+		if _, ok := faults.armed[name]; !ok {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "fault not armed"})
+			return
+		}
+		delete(faults.armed, name)
+		auditFault(name, "disarmed", faultActor(ctx), "")
+		ctx.StatusCode(iris.StatusNoContent)
+	}), apiDoc{Summary: "Disarm a fault", Status: iris.StatusNoContent})
+}
+
+// faultActor identifies who made a fault admin request.
+func faultActor(ctx iris.Context) string {
+	if user, _, ok := ctx.Request().BasicAuth(); ok {
+		return user + "@" + ctx.RemoteAddr()
+	}
+	return ctx.RemoteAddr()
+}
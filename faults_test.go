@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// TestChaosNoJobLostOrDuplicated arms submit-fail, notify-delay and
+// fs-write-eio through /admin/faults, sends faxes through the watcher and
+// the workers, and answers each with a notify delivered twice. Every job
+// must reach the provider exactly once and complete exactly once.
+func TestChaosNoJobLostOrDuplicated(t *testing.T) {
+	const jobs = 5
+	var mu sync.Mutex
+	submitted := make(map[string]int) // by document name
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		_, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		submitted[header.Filename]++
+		mu.Unlock()
+		fmt.Fprintf(w, `{"job_uuid":"job-%s"}`, strings.TrimSuffix(header.Filename, ".pdf"))
+	}))
+	defer server.Close()
+
+	cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "FAULTS_ENABLED": "true",
+		"SEND_WEBHOOK_URL": server.URL, "SEND_WEBHOOK_RETRIES": "5", "SEND_WEBHOOK_RETRY_BACKOFF": "10ms",
+		"OUTBOUND_CONCURRENCY": "2"})
+	prev := faultsEnabled
+	initFaults()
+	t.Cleanup(func() {
+		faultsEnabled = prev
+		faults.Lock()
+		faults.armed = make(map[string]*armedFault)
+		faults.audit = nil
+		faults.Unlock()
+	})
+	for _, body := range []string{
+		`{"name":"submit-fail","count":3,"status":503}`,
+		`{"name":"fs-write-eio","count":3}`,
+		`{"name":"notify-delay","count":3,"delay":"50ms"}`,
+	} {
+		req := asAdmin(httptest.NewRequest("POST", "/admin/faults", strings.NewReader(body)))
+		req.Header.Set("Content-Type", "application/json")
+		if rec := serveTestRequest(t, registerAdminRoutes, req); rec.Code != 200 {
+			t.Fatalf("arming %s: status %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+
+	dir := cfg.FTPRoot + FaxDir
+	startTestWorkers(t)
+	for i := 1; i <= jobs; i++ {
+		for _, name := range []string{fmt.Sprintf("fax%04d.pdf", i), fmt.Sprintf("fax%04d.sfc", i)} {
+			content := "%PDF-1.4\n"
+			if strings.HasSuffix(name, ".sfc") {
+				content = fmt.Sprintf("604555%04d\nfax%04d.pdf\n", i, i)
+			}
+			writeTestFile(t, filepath.Join(dir, name), content)
+			processFile(filepath.Join(dir, name))
+		}
+	}
+
+	// Wait for every job to be registered for its notify.
+	accepted := make(map[string]string) // job UUID -> Hylafax job ID
+	deadline := time.Now().Add(10 * time.Second)
+	for len(accepted) < jobs {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d jobs accepted by the provider: %v", len(accepted), jobs, accepted)
+		}
+		time.Sleep(10 * time.Millisecond)
+		jobQueue.Lock()
+		for jobUUID, job := range jobQueue.entries {
+			accepted[jobUUID] = job.hylaJobID
+		}
+		jobQueue.Unlock()
+	}
+
+	// fs-write-eio has been spent on the jobs' .jobid and .sts writes by now,
+	// and a provider that sees the delayed notify time out sends it again.
+	app := iris.New()
+	registerProviderRoutes(app)
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for jobUUID := range accepted {
+		body := fmt.Sprintf(`{"fax_job_results":{"fax_job":{"uuid":%q,"status":"completed"},"results":{"1":{"uuid":%q,"status":"completed","result":{"success":true}}}}}`,
+			jobUUID, jobUUID)
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("POST", "/fax-notify", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				app.ServeHTTP(rec, req)
+				if rec.Code != 200 {
+					t.Errorf("notify for %s: status %d: %s", jobUUID, rec.Code, rec.Body)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	fired := make(map[string]int)
+	faults.Lock()
+	for _, e := range faults.audit {
+		if e.Action == "fired" {
+			fired[e.Fault]++
+		}
+	}
+	armed := len(faults.armed)
+	faults.Unlock()
+	for _, name := range []string{faultSubmitFail, faultFSWriteEIO, faultNotifyDelay} {
+		if fired[name] != 3 {
+			t.Errorf("%s fired %d times, want 3", name, fired[name])
+		}
+	}
+	if armed != 0 {
+		t.Errorf("%d faults still armed", armed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i <= jobs; i++ {
+		if name := fmt.Sprintf("fax%04d.pdf", i); submitted[name] != 1 {
+			t.Errorf("%s reached the provider %d times, want 1", name, submitted[name])
+		}
+	}
+	results := make(map[string][]string)
+	now := time.Now()
+	readFaxHistory(now.Add(-time.Hour), now.Add(time.Hour), func(e faxHistoryEntry) error {
+		results[e.ID] = append(results[e.ID], e.Result)
+		return nil
+	})
+	for jobUUID, jobID := range accepted {
+		if !fileExists(jobFile(jobID, "q"+jobID+".done")) || fileExists(jobFile(jobID, "q"+jobID+".fail")) {
+			t.Errorf("job %s (%s) has no .done, or a .fail", jobID, jobUUID)
+		}
+		if got := results[jobID]; len(got) != 1 || got[0] != "success" {
+			t.Errorf("job %s history results %v, want [success]", jobID, got)
+		}
+	}
+	jobQueue.Lock()
+	left := len(jobQueue.entries)
+	jobQueue.Unlock()
+	if left != 0 {
+		t.Errorf("%d jobs still waiting for their notify", left)
+	}
+}
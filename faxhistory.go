@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every fax that reaches a final outcome, received or sent, successful or
+// not, is appended to the fax history in DATA_DIR/history/<YYYY-MM>.jsonl,
+// one JSON line per fax, by month of completion in UTC. Fax records only
+// last for JOB_STATE_TTL, so billing and audit reports come from here:
+// GET /reports/faxes streams the entries completed in a time range as CSV or
+// JSON. A sent fax is entered once, when its last dial ends; a broadcast
+// gets one entry per destination.
+
+const faxHistoryDir = "history"
+
+// faxHistoryEntry is one line of the fax history. Fields may be added but
+// not renamed, since reports are kept by accounting.
+type faxHistoryEntry struct {
+	Direction       string     `json:"direction"`
+	ID              string     `json:"id"` // UUID of a received fax, Hylafax job ID of a sent one
+	JobUUID         string     `json:"job_uuid,omitempty"`
+	SynergyJobID    string     `json:"synergy_job_id,omitempty"`
+	User            string     `json:"user,omitempty"`
+	From            string     `json:"from,omitempty"` // caller number
+	To              string     `json:"to,omitempty"`   // destination or called number
+	Pages           int        `json:"pages"`          // pages sent or received
+	Result          string     `json:"result"`         // success or failed
+	ResultCode      int        `json:"result_code,omitempty"`
+	ResultText      string     `json:"result_text,omitempty"`
+	Dials           int        `json:"dials,omitempty"`
+	StartedAt       *time.Time `json:"started_at,omitempty"` // the provider's start_ts
+	EndedAt         *time.Time `json:"ended_at,omitempty"`   // the provider's end_ts
+	DurationSeconds float64    `json:"duration_seconds,omitempty"`
+	SubmittedAt     *time.Time `json:"submitted_at,omitempty"` // accepted by the provider, or received
+	CompletedAt     time.Time  `json:"completed_at"`
+}
+
+var faxHistoryCSVHeader = []string{"direction", "id", "job_uuid", "synergy_job_id", "user", "from", "to", "pages", "result",
+	"result_code", "result_text", "dials", "started_at", "ended_at", "duration_seconds", "submitted_at", "completed_at"}
+
+func (e faxHistoryEntry) csvRecord() []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	return []string{e.Direction, e.ID, e.JobUUID, e.SynergyJobID, e.User, e.From, e.To, strconv.Itoa(e.Pages), e.Result,
+		strconv.Itoa(e.ResultCode), e.ResultText, strconv.Itoa(e.Dials), formatTime(e.StartedAt), formatTime(e.EndedAt),
+		strconv.FormatFloat(e.DurationSeconds, 'f', -1, 64), formatTime(e.SubmittedAt), e.CompletedAt.UTC().Format(time.RFC3339)}
+}
+
+var faxHistory = struct {
+	sync.Mutex
+	// failJob does not enter the failures of jobs whose provider result
+	// was entered with its details, counted here by Hylafax job ID.
+	entered map[string]int
+}{entered: make(map[string]int)}
+
+func faxHistoryPath(month time.Time) string {
+	return filepath.Join(config().DataDir, faxHistoryDir, month.UTC().Format("2006-01")+".jsonl")
+}
+
+// recordFaxHistory appends e to the history of its month, and queues its
+// event for EVENT_WEBHOOK_URL. A cancelled job was cancelled on request, so
+// it has no event.
+func recordFaxHistory(e faxHistoryEntry) {
+	if e.Result != "cancelled" {
+		queueFaxEvent(historyEvent(e))
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Error encoding fax history entry", "id", e.ID, "err", err)
+		return
+	}
+	path := faxHistoryPath(e.CompletedAt)
+	faxHistory.Lock()
+	defer faxHistory.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.Error("Error writing fax history", "file", path, "err", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		slog.Error("Error writing fax history", "file", path, "err", err)
+		return
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		slog.Error("Error writing fax history", "file", path, "err", err)
+	}
+	f.Close()
+}
+
+// providerTimes parses the start and end times of a provider result.
+func providerTimes(result FaxResult) (start, end *time.Time, seconds float64) {
+	if t, err := parseFaxTime(result.StartTs); err == nil {
+		start = &t
+	}
+	if t, err := parseFaxTime(result.EndTs); err == nil {
+		end = &t
+	}
+	if start != nil && end != nil && end.After(*start) {
+		seconds = end.Sub(*start).Seconds()
+	}
+	return start, end, seconds
+}
+
+// recordReceivedFaxHistory enters a received fax that was stored.
+func recordReceivedFaxHistory(fax FaxReceive, pages int, receivedAt time.Time) {
+	start, end, seconds := providerTimes(fax.Result)
+	recordFaxHistory(faxHistoryEntry{
+		Direction:       "inbound",
+		ID:              fax.UUID,
+		From:            fax.CIDNum,
+		To:              fax.Number,
+		Pages:           pages,
+		Result:          "success",
+		ResultCode:      fax.Result.ResultCode,
+		ResultText:      fax.Result.ResultText,
+		StartedAt:       start,
+		EndedAt:         end,
+		DurationSeconds: seconds,
+		SubmittedAt:     &receivedAt,
+		CompletedAt:     time.Now(),
+	})
+}
+
+// recordSentFaxHistory enters the final result of a sent fax, or of one
+// broadcast destination. The failure entry failJob would make is suppressed
+// until the returned function is called, once the result is handled.
+func recordSentFaxHistory(jobQq jobQ, job FaxJob, success bool) func() {
+	to := jobDestination(jobQq, job.Number)
+	result := "failed"
+	if success {
+		result = "success"
+	}
+	start, end, seconds := providerTimes(job.Result)
+	acceptedAt := jobQq.acceptedAt
+	recordFaxHistory(faxHistoryEntry{
+		Direction:       "outbound",
+		ID:              jobQq.hylaJobID,
+		JobUUID:         job.UUID,
+		SynergyJobID:    jobQq.synergyJobID,
+		User:            jobQq.user,
+		From:            job.CIDNum,
+		To:              to,
+		Pages:           pagesSent(jobQq.pages, job.Result),
+		Result:          result,
+		ResultCode:      job.Result.ResultCode,
+		ResultText:      cmp.Or(job.Result.ResultText, job.Status),
+		Dials:           max(jobQq.dials, 1),
+		StartedAt:       start,
+		EndedAt:         end,
+		DurationSeconds: seconds,
+		SubmittedAt:     &acceptedAt,
+		CompletedAt:     time.Now(),
+	})
+
+	return suppressFailedJobHistory(jobQq.hylaJobID)
+}
+
+// jobDestination returns number, or when it is empty the job's destination
+// from its .sfc: the one it was sent to, for a broadcast.
+func jobDestination(jobQq jobQ, number string) string {
+	if number != "" {
+		return number
+	}
+	numbers := strings.FieldsFunc(sfcNumber([]string{jobQq.sfcPath}), func(r rune) bool { return r == ',' || r == ';' })
+	if i := max(jobQq.broadcastIndex, 1) - 1; i < len(numbers) {
+		return strings.TrimSpace(numbers[i])
+	}
+	return ""
+}
+
+// suppressFailedJobHistory keeps failJob and deadLetterJob from entering
+// hylaJobID again until the returned function is called.
+func suppressFailedJobHistory(hylaJobID string) func() {
+	faxHistory.Lock()
+	faxHistory.entered[hylaJobID]++
+	faxHistory.Unlock()
+	return func() {
+		faxHistory.Lock()
+		if faxHistory.entered[hylaJobID]--; faxHistory.entered[hylaJobID] <= 0 {
+			delete(faxHistory.entered, hylaJobID)
+		}
+		faxHistory.Unlock()
+	}
+}
+
+// recordFailedJobHistory enters a job failed by failJob or deadLetterJob,
+// unless its failure was entered already, and suppresses further entries
+// until the returned function is called.
+func recordFailedJobHistory(hylaJobID, status, number string) func() {
+	faxHistory.Lock()
+	entered := faxHistory.entered[hylaJobID] > 0
+	faxHistory.Unlock()
+	if !entered {
+		recordFaxHistory(faxHistoryEntry{
+			Direction:   "outbound",
+			ID:          hylaJobID,
+			To:          number,
+			Result:      "failed",
+			ResultText:  status,
+			CompletedAt: time.Now(),
+		})
+	}
+	return suppressFailedJobHistory(hylaJobID)
+}
+
+// readFaxHistory calls fn for each entry completed in [from, to), month by
+// month. Lines that cannot be parsed are skipped.
+func readFaxHistory(from, to time.Time, fn func(faxHistoryEntry) error) error {
+	for month := time.Date(from.UTC().Year(), from.UTC().Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(to); month = month.AddDate(0, 1, 0) {
+		f, err := os.Open(faxHistoryPath(month))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var e faxHistoryEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil || e.CompletedAt.Before(from) || !e.CompletedAt.Before(to) {
+				continue
+			}
+			if err := fn(e); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseReportTime accepts an RFC 3339 time or a date, taken as midnight UTC.
+func parseReportTime(v string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// userStats is one user's outbound faxes in GET /stats.
+type userStats struct {
+	User           string `json:"user"`
+	Sent           int    `json:"sent"`
+	Failed         int    `json:"failed"`
+	Pages          int    `json:"pages"` // pages sent
+	Queued         int    `json:"queued"`
+	FaxesToday     int    `json:"faxes_today"` // counted against the daily quota
+	PagesToday     int    `json:"pages_today"`
+	MaxFaxesPerDay int    `json:"max_faxes_per_day,omitempty"`
+	MaxPagesPerDay int    `json:"max_pages_per_day,omitempty"`
+}
+
+// outboundStats totals the outbound faxes completed in [from, to) per user,
+// with the jobs still waiting for their result and today's quota use. With
+// user set, only that user is counted.
+func outboundStats(from, to time.Time, user string) ([]userStats, error) {
+	byUser := make(map[string]*userStats)
+	stats := func(u string) *userStats {
+		if byUser[u] == nil {
+			byUser[u] = &userStats{User: u}
+		}
+		return byUser[u]
+	}
+	if user != "" {
+		stats(user)
+	}
+	err := readFaxHistory(from, to, func(e faxHistoryEntry) error {
+		if e.Direction != "outbound" || (user != "" && e.User != user) {
+			return nil
+		}
+		st := stats(e.User)
+		switch e.Result {
+		case "success":
+			st.Sent++
+		case "cancelled":
+		default:
+			st.Failed++
+		}
+		st.Pages += e.Pages
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	jobQueue.Lock()
+	for _, job := range jobQueue.entries {
+		if user == "" || job.user == user {
+			stats(job.user).Queued++
+		}
+	}
+	jobQueue.Unlock()
+
+	list := make([]userStats, 0, len(byUser))
+	for u, st := range byUser {
+		if u != "" {
+			st.FaxesToday, st.PagesToday, st.MaxFaxesPerDay, st.MaxPagesPerDay = quotaUsage(u)
+		}
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].User < list[j].User })
+	return list, nil
+}
+
+// faxReportFlushEvery is how many rows are written between flushes.
+const faxReportFlushEvery = 500
+
+func registerReportRoutes(admin iris.Party) {
+	documentRoute(admin.Get("/reports/faxes", func(ctx iris.Context) {
+		from, okFrom := parseReportTime(ctx.URLParam("from"))
+		to, okTo := parseReportTime(ctx.URLParam("to"))
+		if !okFrom || !okTo || !from.Before(to) {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": "from and to must be RFC 3339 times or dates, with from before to"})
+			return
+		}
+		format := strings.ToLower(ctx.URLParamDefault("format", "csv"))
+		if format != "csv" && format != "json" {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": `format must be "csv" or "json"`})
+			return
+		}
+
+		w := ctx.ResponseWriter()
+		name := fmt.Sprintf("faxes-%s-%s.%s", from.UTC().Format("20060102"), to.UTC().Format("20060102"), format)
+		ctx.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+		rows := 0
+		var err error
+		if format == "csv" {
+			ctx.ContentType("text/csv; charset=utf-8")
+			cw := csv.NewWriter(w)
+			cw.Write(faxHistoryCSVHeader)
+			err = readFaxHistory(from, to, func(e faxHistoryEntry) error {
+				rows++
+				if err := cw.Write(e.csvRecord()); err != nil {
+					return err
+				}
+				if rows%faxReportFlushEvery == 0 {
+					cw.Flush()
+					w.Flush()
+				}
+				return cw.Error()
+			})
+			cw.Flush()
+		} else {
+			ctx.ContentType("application/json")
+			io.WriteString(w, "[")
+			enc := json.NewEncoder(w)
+			err = readFaxHistory(from, to, func(e faxHistoryEntry) error {
+				if rows > 0 {
+					io.WriteString(w, ",")
+				}
+				rows++
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+				if rows%faxReportFlushEvery == 0 {
+					w.Flush()
+				}
+				return nil
+			})
+			io.WriteString(w, "]\n")
+		}
+		if err != nil {
+			// The status has been sent; the truncated report is all that can be done.
+			slog.Error("Error streaming fax report", "from", from, "to", to, "rows", rows, "err", err)
+			return
+		}
+		slog.Info("Fax report streamed", "from", from, "to", to, "format", format, "rows", rows, "actor", requestActor(ctx))
+	}), apiDoc{
+		Summary: "Stream the faxes sent and received in a time range, as CSV (the default) or a JSON array",
+		Query: map[string]string{
+			"from":   "start of the range, an RFC 3339 time or a date (midnight UTC), inclusive",
+			"to":     "end of the range, exclusive",
+			"format": "csv or json",
+		},
+		Response: []faxHistoryEntry{},
+	})
+
+	documentRoute(admin.Get("/stats", func(ctx iris.Context) {
+		now := time.Now()
+		from, to := now.Add(-24*time.Hour), now
+		if v := ctx.URLParam("from"); v != "" {
+			t, ok := parseReportTime(v)
+			if !ok {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "from must be an RFC 3339 time or a date"})
+				return
+			}
+			from = t
+		}
+		if v := ctx.URLParam("to"); v != "" {
+			t, ok := parseReportTime(v)
+			if !ok {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "to must be an RFC 3339 time or a date"})
+				return
+			}
+			to = t
+		}
+		if !from.Before(to) {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": "from must be before to"})
+			return
+		}
+		users, err := outboundStats(from, to, ctx.URLParam("user"))
+		if err != nil {
+			slog.Error("Error reading fax history for stats", "err", err)
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(iris.Map{"error": "unable to read the fax history"})
+			return
+		}
+		ctx.JSON(iris.Map{"from": from, "to": to, "users": users})
+	}), apiDoc{
+		Summary: "Outbound faxes sent and failed per originating user, with queued jobs and today's quota use",
+		Query: map[string]string{
+			"from": "start of the range, an RFC 3339 time or a date (midnight UTC), default 24 hours ago",
+			"to":   "end of the range, exclusive, default now",
+			"user": "only this originating user",
+		},
+		Response: struct {
+			From  time.Time   `json:"from"`
+			To    time.Time   `json:"to"`
+			Users []userStats `json:"users"`
+		}{},
+	})
+}
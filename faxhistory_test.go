@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboundStats(t *testing.T) {
+	useTestQuotas(t, map[string]string{"QUOTA_MAX_FAXES_PER_DAY": "20"})
+	now := time.Now()
+	for _, e := range []faxHistoryEntry{
+		{Direction: "outbound", ID: "1", User: "alice", Pages: 2, Result: "success", CompletedAt: now.Add(-time.Hour)},
+		{Direction: "outbound", ID: "2", User: "alice", Pages: 0, Result: "failed", CompletedAt: now.Add(-time.Hour)},
+		{Direction: "outbound", ID: "3", User: "bob", Pages: 5, Result: "success", CompletedAt: now.Add(-time.Hour)},
+		{Direction: "outbound", ID: "4", User: "alice", Pages: 9, Result: "success", CompletedAt: now.Add(-48 * time.Hour)},
+		{Direction: "inbound", ID: "fax-uuid", Pages: 1, Result: "success", CompletedAt: now.Add(-time.Hour)},
+	} {
+		recordFaxHistory(e)
+	}
+	if _, err := reserveUserQuota("alice", 2); err != nil {
+		t.Fatal(err)
+	}
+	jobQueue.Lock()
+	jobQueue.entries["job-uuid"] = jobQ{hylaJobID: "5", user: "alice"}
+	jobQueue.Unlock()
+	t.Cleanup(func() {
+		jobQueue.Lock()
+		delete(jobQueue.entries, "job-uuid")
+		jobQueue.Unlock()
+	})
+
+	tests := []struct {
+		name string
+		user string
+		want []userStats
+	}{
+		{name: "every user", want: []userStats{
+			{User: "alice", Sent: 1, Failed: 1, Pages: 2, Queued: 1, FaxesToday: 1, PagesToday: 2, MaxFaxesPerDay: 20},
+			{User: "bob", Sent: 1, Pages: 5, MaxFaxesPerDay: 20},
+		}},
+		{name: "one user", user: "bob", want: []userStats{{User: "bob", Sent: 1, Pages: 5, MaxFaxesPerDay: 20}}},
+		{name: "user without faxes", user: "carol", want: []userStats{{User: "carol", MaxFaxesPerDay: 20}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := outboundStats(now.Add(-24*time.Hour), now, tt.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("outboundStats() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("outboundStats()[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFaxReportAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   func(req *http.Request)
+		status int
+	}{
+		{name: "no credentials", status: 401},
+		{name: "wrong token", auth: bearer("wrong"), status: 401},
+		{name: "claimed user", auth: basic("billing", ""), status: 401},
+		{name: "read token", auth: bearer("read-secret"), status: 200},
+		{name: "manage token", auth: bearer(testAdminToken), status: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, map[string]string{"ADMIN_READ_TOKEN": "read-secret"})
+			recordFaxHistory(faxHistoryEntry{Direction: "inbound", ID: "fax-uuid", From: "6045551234", Result: "success",
+				CompletedAt: time.Date(2026, 9, 15, 12, 0, 0, 0, time.UTC)})
+
+			req := httptest.NewRequest("GET", "/reports/faxes?from=2026-09-01&to=2026-10-01", nil)
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := serveTestRequest(t, registerAdminRoutes, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if listed := strings.Contains(rec.Body.String(), "6045551234"); listed != (tt.status == 200) {
+				t.Errorf("fax listed = %v with status %d: %s", listed, rec.Code, rec.Body)
+			}
+		})
+	}
+}
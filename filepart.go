@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	contentTypePDF  = "application/pdf"
+	contentTypeTIFF = "image/tiff"
+)
+
+// pdfHeaderWindow is how far into a file readers look for the %PDF- header.
+const pdfHeaderWindow = 1024
+
+// sniffDocumentType returns the MIME type of a fax document from its leading bytes.
+func sniffDocumentType(data []byte) string {
+	switch {
+	case bytes.Contains(data[:min(len(data), pdfHeaderWindow)], []byte("%PDF-")):
+		return contentTypePDF
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return contentTypeTIFF
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// errNotPDF is returned for a fax document that is neither a PDF nor a TIFF.
+var errNotPDF = errors.New("document is not a PDF")
+
+// documentSignatures name the formats most often mistaken for a fax document.
+var documentSignatures = []struct {
+	prefix, name string
+}{
+	{"\xD0\xCF\x11\xE0", "a Word or other legacy Office document"},
+	{"PK\x03\x04", "a ZIP archive, such as a .docx"},
+	{"{\\rtf", "an RTF document"},
+	{"\x89PNG", "a PNG image"},
+	{"\xFF\xD8\xFF", "a JPEG image"},
+	{"GIF8", "a GIF image"},
+	{"<", "HTML or XML"},
+}
+
+// checkDocumentType returns the MIME type of a fax document, which must be a
+// PDF or a TIFF. Anything else is an errNotPDF error saying what it looks like.
+func checkDocumentType(data []byte) (string, error) {
+	if contentType := sniffDocumentType(data); contentType != "application/octet-stream" {
+		return contentType, nil
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("%w: it is empty", errNotPDF)
+	}
+	lead := bytes.TrimLeft(data, " \t\r\n")
+	for _, sig := range documentSignatures {
+		if bytes.HasPrefix(lead, []byte(sig.prefix)) {
+			return "", fmt.Errorf("%w: it looks like %s", errNotPDF, sig.name)
+		}
+	}
+	return "", fmt.Errorf("%w: no %%PDF- header", errNotPDF)
+}
+
+func extensionForType(contentType string) string {
+	switch contentType {
+	case contentTypePDF:
+		return ".pdf"
+	case contentTypeTIFF:
+		return ".tif"
+	default:
+		return filepath.Ext(contentType)
+	}
+}
+
+// partFilenames returns the ASCII filename and the original filename to
+// advertise for the uploaded document. When SEND_PART_RENAME=true the part is
+// always named after the Hylafax job ID, for providers that key on it.
+func partFilenames(pdfFile, hylaJobID, contentType string) (ascii, original string) {
+	ext := extensionForType(contentType)
+	if config().SendPartRename {
+		name := hylaJobID + ext
+		return name, name
+	}
+
+	original = filepath.Base(strings.ReplaceAll(pdfFile, "\\", "/"))
+	base := strings.TrimSuffix(original, filepath.Ext(original))
+
+	var b strings.Builder
+	for _, r := range base {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	ascii = strings.Trim(b.String(), "._")
+	if ascii == "" {
+		ascii = hylaJobID
+	}
+	// The extension always follows the content so a .tif name never carries PDF bytes.
+	return ascii + ext, original
+}
+
+// formDataDisposition builds a Content-Disposition header for a file part,
+// adding an RFC 5987 filename* when the original name differs from the ASCII one.
+func formDataDisposition(field, ascii, original string) string {
+	disposition := fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, ascii)
+	if original != "" && original != ascii {
+		disposition += "; filename*=UTF-8''" + rfc5987Escape(original)
+	}
+	return disposition
+}
+
+// rfc5987Escape percent-encodes every byte outside RFC 5987's attr-char set.
+func rfc5987Escape(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// createDocumentPart adds the fax document to writer with an explicit
+// Content-Type and filename, returning the filename and type used.
+func createDocumentPart(writer *multipart.Writer, pdfFile, hylaJobID string, data []byte) (string, string, error) {
+	contentType := sniffDocumentType(data)
+	ascii, original := partFilenames(pdfFile, hylaJobID, contentType)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", formDataDisposition("file", ascii, original))
+	h.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", "", err
+	}
+	return ascii, contentType, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestCreateDocumentPart(t *testing.T) {
+	const (
+		pdf  = "%PDF-1.4\n"
+		tiff = "II*\x00\x08\x00\x00\x00"
+	)
+	tests := []struct {
+		name        string
+		env         map[string]string
+		pdfFile     string
+		data        string
+		disposition string
+		contentType string
+	}{
+		{name: "plain name", pdfFile: "fax0001.pdf", data: pdf,
+			disposition: `form-data; name="file"; filename="fax0001.pdf"`, contentType: "application/pdf"},
+		{name: "spaces", pdfFile: "Lab Results.pdf", data: pdf,
+			disposition: `form-data; name="file"; filename="Lab_Results.pdf"; filename*=UTF-8''Lab%20Results.pdf`, contentType: "application/pdf"},
+		{name: "non-ASCII", pdfFile: "résumé.pdf", data: pdf,
+			disposition: `form-data; name="file"; filename="r_sum.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`, contentType: "application/pdf"},
+		{name: "no ASCII at all", pdfFile: "日本.pdf", data: pdf,
+			disposition: `form-data; name="file"; filename="42.pdf"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.pdf`, contentType: "application/pdf"},
+		{name: "quote", pdfFile: `a"b.pdf`, data: pdf,
+			disposition: `form-data; name="file"; filename="a_b.pdf"; filename*=UTF-8''a%22b.pdf`, contentType: "application/pdf"},
+		{name: "Windows path", pdfFile: `C:\scans\fax 1.pdf`, data: pdf,
+			disposition: `form-data; name="file"; filename="fax_1.pdf"; filename*=UTF-8''fax%201.pdf`, contentType: "application/pdf"},
+		{name: ".tif name with PDF bytes", pdfFile: "scan.tif", data: pdf,
+			disposition: `form-data; name="file"; filename="scan.pdf"; filename*=UTF-8''scan.tif`, contentType: "application/pdf"},
+		{name: ".pdf name with TIFF bytes", pdfFile: "scan.pdf", data: tiff,
+			disposition: `form-data; name="file"; filename="scan.tif"; filename*=UTF-8''scan.pdf`, contentType: "image/tiff"},
+		{name: "SEND_PART_RENAME", env: map[string]string{"SEND_PART_RENAME": "true"}, pdfFile: "Lab Results.pdf", data: pdf,
+			disposition: `form-data; name="file"; filename="42.pdf"`, contentType: "application/pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, tt.env)
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			if _, _, err := createDocumentPart(writer, tt.pdfFile, "42", []byte(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+			writer.Close()
+
+			part, err := multipart.NewReader(&body, writer.Boundary()).NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := part.Header.Get("Content-Disposition"); got != tt.disposition {
+				t.Errorf("Content-Disposition = %s\nwant %s", got, tt.disposition)
+			}
+			if got := part.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %s, want %s", got, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestCheckDocumentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		contentType string
+		wantErr     string // substring of the error, for documents that are refused
+	}{
+		{name: "PDF", data: "%PDF-1.7\n%\xE2\xE3\xCF\xD3\n", contentType: contentTypePDF},
+		{name: "PDF after junk", data: "\r\n\r\n%PDF-1.4\n", contentType: contentTypePDF},
+		{name: "PDF header past the window", data: strings.Repeat(" ", pdfHeaderWindow) + "%PDF-1.4\n", wantErr: "no %PDF- header"},
+		{name: "little-endian TIFF", data: "II*\x00\x08\x00\x00\x00", contentType: contentTypeTIFF},
+		{name: "big-endian TIFF", data: "MM\x00*\x00\x00\x00\x08", contentType: contentTypeTIFF},
+		{name: "TIFF magic in the wrong order", data: "II\x00*\x08\x00", wantErr: "no %PDF- header"},
+		{name: "Word", data: "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1", wantErr: "legacy Office document"},
+		{name: "docx", data: "PK\x03\x04\x14\x00\x06\x00", wantErr: "ZIP archive"},
+		{name: "RTF", data: "{\\rtf1\\ansi", wantErr: "RTF document"},
+		{name: "PNG", data: "\x89PNG\r\n\x1a\n", wantErr: "PNG image"},
+		{name: "JPEG", data: "\xFF\xD8\xFF\xE0", wantErr: "JPEG image"},
+		{name: "GIF", data: "GIF89a", wantErr: "GIF image"},
+		{name: "HTML error page", data: "\n  <!DOCTYPE html><html>", wantErr: "HTML or XML"},
+		{name: "text", data: "Please fax this to 604-555-1234", wantErr: "no %PDF- header"},
+		{name: "empty", data: "", wantErr: "it is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, err := checkDocumentType([]byte(tt.data))
+			if tt.wantErr == "" {
+				if err != nil || contentType != tt.contentType {
+					t.Errorf("checkDocumentType() = %q, %v; want %q", contentType, err, tt.contentType)
+				}
+				return
+			}
+			if !errors.Is(err, errNotPDF) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkDocumentType() = %q, %v; want an errNotPDF saying %q", contentType, err, tt.wantErr)
+			}
+		})
+	}
+}
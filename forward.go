@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// With RECEIVE_FORWARD_URL set, every received fax is also posted to a
+// downstream system once its PDF and .recv are in the queue directory. The
+// multipart/form-data request has the fields uuid, call_uuid, caller,
+// caller_name, callee, received_at (RFC 3339) and pages, and the PDF as the
+// "file" part. It is sent with basic auth (RECEIVE_FORWARD_USERNAME and
+// RECEIVE_FORWARD_PASSWORD) or a bearer token (RECEIVE_FORWARD_TOKEN).
+// Forwarding runs in the background: /fax-receive has already answered, and a
+// forward that fails does not touch the delivery to Synergy. Failures are
+// retried RECEIVE_FORWARD_RETRIES times, RECEIVE_FORWARD_RETRY_BACKOFF apart
+// and doubling. The outcome is kept in the fax record, and forwards still
+// pending at shutdown are resumed at startup.
+
+// Forward states kept in FaxJobRecord.ForwardStatus.
+const (
+	forwardPending   = "pending"
+	forwardDelivered = "forwarded"
+	forwardFailed    = "failed"
+)
+
+// maxForwardBackoff caps the wait between forward attempts.
+const maxForwardBackoff = 10 * time.Minute
+
+var (
+	receiveForwardsSent   = expvar.NewInt("receive_forwards_sent")
+	receiveForwardsFailed = expvar.NewInt("receive_forwards_failed")
+)
+
+// forwardReceivedFax starts forwarding the received fax with the given
+// record key, if RECEIVE_FORWARD_URL is set.
+func forwardReceivedFax(key string) {
+	if config().ReceiveForwardURL == "" {
+		return
+	}
+	faxRecordsMutex.Lock()
+	record, ok := faxRecords[key]
+	if ok {
+		record.ForwardStatus = forwardPending
+	}
+	faxRecordsMutex.Unlock()
+	if ok {
+		go runForward(pipelineCtx, key)
+	}
+}
+
+// resumeForwards restarts the forwards that were pending at the last
+// shutdown. It runs at startup, after loadState.
+func resumeForwards() {
+	var pending []string
+	faxRecordsMutex.Lock()
+	for key, record := range faxRecords {
+		if record.ForwardStatus == forwardPending {
+			pending = append(pending, key)
+		}
+	}
+	faxRecordsMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if config().ReceiveForwardURL == "" {
+		slog.Warn("Received faxes were waiting to be forwarded, but RECEIVE_FORWARD_URL is no longer set", "faxes", len(pending))
+		return
+	}
+	slog.Info("Resuming forwards of received faxes", "faxes", len(pending))
+	for _, key := range pending {
+		go runForward(pipelineCtx, key)
+	}
+}
+
+// runForward posts the fax until it is accepted or the retries run out.
+// When ctx is cancelled it stops, leaving the forward pending for the next start.
+func runForward(ctx context.Context, key string) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		faxRecordsMutex.Lock()
+		record, ok := faxRecords[key]
+		var snapshot FaxJobRecord
+		if ok {
+			snapshot = *record
+		}
+		faxRecordsMutex.Unlock()
+		if !ok || snapshot.ForwardStatus != forwardPending {
+			return
+		}
+
+		attempt := snapshot.ForwardAttempts + 1
+		err := postForward(ctx, key, snapshot)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		cfg := config()
+		status := forwardPending
+		switch {
+		case err == nil:
+			status = forwardDelivered
+			receiveForwardsSent.Add(1)
+			slog.Info("Forwarded received fax", "uuid", key, "direction", "inbound", "url", cfg.ReceiveForwardURL, "attempt", attempt)
+		case attempt > cfg.ReceiveForwardRetries:
+			status = forwardFailed
+			receiveForwardsFailed.Add(1)
+			slog.Error("Giving up forwarding received fax", "uuid", key, "direction", "inbound", "url", cfg.ReceiveForwardURL,
+				"attempts", attempt, "err", err)
+		default:
+			slog.Warn("Forwarding received fax failed; retrying", "uuid", key, "direction", "inbound", "attempt", attempt,
+				"retry_in", forwardBackoff(attempt), "err", err)
+		}
+
+		faxRecordsMutex.Lock()
+		if record, ok := faxRecords[key]; ok {
+			record.ForwardStatus = status
+			record.ForwardAttempts = attempt
+			record.ForwardError = ""
+			if err != nil {
+				record.ForwardError = err.Error()
+			}
+			if status == forwardDelivered {
+				record.ForwardedAt = time.Now()
+			}
+		}
+		faxRecordsMutex.Unlock()
+		saveState()
+		if status != forwardPending {
+			return
+		}
+		select {
+		case <-time.After(forwardBackoff(attempt)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forwardBackoff is the wait after the given attempt.
+func forwardBackoff(attempt int) time.Duration {
+	delay := config().ReceiveForwardRetryBackoff
+	for i := 1; i < attempt && delay < maxForwardBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxForwardBackoff)
+}
+
+// postForward makes one forward attempt.
+func postForward(ctx context.Context, key string, record FaxJobRecord) error {
+	cfg := config()
+	data, err := os.ReadFile(record.PdfPath)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+	fields := [][2]string{
+		{"uuid", key},
+		{"call_uuid", record.CallUUID},
+		{"caller", record.CIDNum},
+		{"caller_name", record.CIDName},
+		{"callee", record.Number},
+		{"received_at", record.ReceivedAt.UTC().Format(time.RFC3339)},
+		{"pages", strconv.Itoa(record.Pages)},
+	}
+	for _, f := range fields {
+		if err := writer.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	part, err := writer.CreateFormFile("file", filepath.Base(record.PdfPath))
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.ReceiveForwardURL, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	switch {
+	case cfg.ReceiveForwardToken != "":
+		req.Header.Set("Authorization", "Bearer "+cfg.ReceiveForwardToken)
+	case cfg.ReceiveForwardUsername != "":
+		req.SetBasicAuth(cfg.ReceiveForwardUsername, cfg.ReceiveForwardPassword)
+	}
+	client := &http.Client{Transport: proxiedTransport(), Timeout: cfg.ReceiveForwardTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("forward URL returned %s", resp.Status)
+	}
+	return nil
+}
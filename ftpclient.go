@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ftpClient is the small FTP client DELIVERY_MODE=ftp-client needs: passive
+// binary transfers, listing, rename and delete, over plain FTP or FTPS. Every
+// command, and every transfer as a whole, must finish within the timeout.
+
+// ftpClientSessions lets FTPS data connections resume the control
+// connection's TLS session, which servers such as vsftpd require.
+var ftpClientSessions = tls.NewLRUClientSessionCache(16)
+
+type ftpClient struct {
+	conn      net.Conn
+	text      *textproto.Conn
+	host      string
+	tlsConfig *tls.Config // nil for plain FTP
+	timeout   time.Duration
+}
+
+// dialFTP logs in to address, a host with an optional port, and changes to
+// dir. tlsMode is none, explicit (AUTH TLS on port 21) or implicit (TLS from
+// the start, on port 990).
+func dialFTP(address, username, password, dir, tlsMode string, timeout time.Duration) (*ftpClient, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+		port := "21"
+		if tlsMode == "implicit" {
+			port = "990"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+	c := &ftpClient{host: host, timeout: timeout}
+	if tlsMode != "none" {
+		c.tlsConfig = &tls.Config{ServerName: host, ClientSessionCache: ftpClientSessions, MinVersion: tls.VersionTLS12}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsMode == "implicit" {
+		c.conn, err = tls.DialWithDialer(dialer, "tcp", address, c.tlsConfig)
+	} else {
+		c.conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.text = textproto.NewConn(c.conn)
+	if _, err := c.response(2); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if err := c.login(username, password, dir, tlsMode); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ftpClient) login(username, password, dir, tlsMode string) error {
+	if tlsMode == "explicit" {
+		if _, err := c.cmd(2, "AUTH TLS"); err != nil {
+			return err
+		}
+		c.conn = tls.Client(c.conn, c.tlsConfig)
+		c.text = textproto.NewConn(c.conn)
+	}
+	code, err := c.cmd(0, "USER %s", username)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, err := c.cmd(2, "PASS %s", password); err != nil {
+			return err
+		}
+	} else if code/100 != 2 {
+		return fmt.Errorf("USER: unexpected reply %d", code)
+	}
+	if c.tlsConfig != nil {
+		if _, err := c.cmd(2, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, err := c.cmd(2, "PROT P"); err != nil {
+			return err
+		}
+	}
+	if _, err := c.cmd(2, "TYPE I"); err != nil {
+		return err
+	}
+	if dir != "" {
+		if _, err := c.cmd(2, "CWD %s", dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmd sends a command and reads its reply, which must be in the class
+// expect (1-5) unless expect is 0.
+func (c *ftpClient) cmd(expect int, format string, args ...any) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, err
+	}
+	code, err := c.response(expect)
+	if err != nil {
+		verb, _, _ := strings.Cut(format, " ")
+		return code, fmt.Errorf("FTP %s: %w", verb, err)
+	}
+	return code, nil
+}
+
+func (c *ftpClient) response(expect int) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	code, _, err := c.text.ReadResponse(expect)
+	return code, err
+}
+
+// dataConn opens a passive data connection, with EPSV or else PASV. Only
+// the port of the reply is used, so a server behind NAT that advertises its
+// private address still works.
+func (c *ftpClient) dataConn() (net.Conn, error) {
+	port, err := c.epsv()
+	if err != nil {
+		if port, err = c.pasv(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.host, strconv.Itoa(port)), c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if c.tlsConfig != nil {
+		return tls.Client(conn, c.tlsConfig), nil
+	}
+	return conn, nil
+}
+
+func (c *ftpClient) epsv() (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.text.PrintfLine("EPSV"); err != nil {
+		return 0, err
+	}
+	_, msg, err := c.text.ReadResponse(229)
+	if err != nil {
+		return 0, err
+	}
+	// 229 Entering Extended Passive Mode (|||6446|)
+	start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+	if start < 0 || end < start+4 {
+		return 0, fmt.Errorf("FTP EPSV: unexpected reply %q", msg)
+	}
+	return strconv.Atoi(msg[start+4 : end])
+}
+
+func (c *ftpClient) pasv() (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.text.PrintfLine("PASV"); err != nil {
+		return 0, err
+	}
+	_, msg, err := c.text.ReadResponse(227)
+	if err != nil {
+		return 0, fmt.Errorf("FTP PASV: %w", err)
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("FTP PASV: unexpected reply %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("FTP PASV: unexpected reply %q", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("FTP PASV: unexpected reply %q", msg)
+	}
+	return p1<<8 | p2, nil
+}
+
+// transfer runs a command that uses a data connection, passing the
+// connection to fn, and reads the reply that ends the transfer.
+func (c *ftpClient) transfer(fn func(net.Conn) error, format string, args ...any) error {
+	data, err := c.dataConn()
+	if err != nil {
+		return err
+	}
+	if _, err := c.cmd(1, format, args...); err != nil {
+		data.Close()
+		return err
+	}
+	err = fn(data)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, replyErr := c.response(2); err == nil {
+		err = replyErr
+	}
+	return err
+}
+
+// List returns the names in the current folder. Servers that answer an
+// empty folder with 450 or 550 return no names.
+func (c *ftpClient) List() ([]string, error) {
+	var names []string
+	err := c.transfer(func(conn net.Conn) error {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if name := path.Base(strings.TrimSpace(scanner.Text())); name != "" && name != "." && name != ".." {
+				names = append(names, name)
+			}
+		}
+		return scanner.Err()
+	}, "NLST")
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && (protoErr.Code == 450 || protoErr.Code == 550) {
+		return nil, nil
+	}
+	return names, err
+}
+
+func (c *ftpClient) Size(name string) (int64, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.text.PrintfLine("SIZE %s", name); err != nil {
+		return 0, err
+	}
+	_, msg, err := c.text.ReadResponse(213)
+	if err != nil {
+		return 0, fmt.Errorf("FTP SIZE %s: %w", name, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+func (c *ftpClient) Get(name string) ([]byte, error) {
+	var data []byte
+	err := c.transfer(func(conn net.Conn) error {
+		var err error
+		data, err = io.ReadAll(conn)
+		return err
+	}, "RETR %s", name)
+	return data, err
+}
+
+func (c *ftpClient) Put(name string, data []byte) error {
+	return c.transfer(func(conn net.Conn) error {
+		_, err := conn.Write(data)
+		return err
+	}, "STOR %s", name)
+}
+
+func (c *ftpClient) Rename(from, to string) error {
+	if _, err := c.cmd(3, "RNFR %s", from); err != nil {
+		return err
+	}
+	_, err := c.cmd(2, "RNTO %s", to)
+	return err
+}
+
+func (c *ftpClient) Delete(name string) error {
+	_, err := c.cmd(2, "DELE %s", name)
+	return err
+}
+
+func (c *ftpClient) Close() error {
+	c.cmd(0, "QUIT")
+	return c.conn.Close()
+}
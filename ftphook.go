@@ -0,0 +1,102 @@
+package main
+
+import (
+	"expvar"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SFTPGo, which serves the queue directory over FTP, can call an HTTP hook
+// once an upload has finished ("actions" with execute_on ["upload"]). Files
+// reported there are handled straight away instead of waiting for
+// FILE_SETTLE_TIME; fsnotify still picks up files dropped into the directory
+// by other means.
+
+// ftpUploadAction is the part of SFTPGo's action notification we use.
+type ftpUploadAction struct {
+	Action      string `json:"action"`       // "upload", "download", "delete", ...
+	Username    string `json:"username"`     // authenticated FTP user
+	Path        string `json:"path"`         // path as seen by SFTPGo
+	VirtualPath string `json:"virtual_path"` // path relative to the user's home, which is FTP_ROOT
+	Status      int    `json:"status"`       // 1 = ok, 2 = error, 3 = quota exceeded
+	FileSize    int64  `json:"file_size"`
+}
+
+// Uploads by FTP user, for capacity planning. Every finished upload SFTPGo
+// reports counts, not just queue files.
+var (
+	ftpUploadsByUser     = expvar.NewMap("ftp_uploads")      // user -> uploads
+	ftpUploadBytesByUser = expvar.NewMap("ftp_upload_bytes") // user -> bytes
+)
+
+// completedUploads feeds finished uploads to the queue watcher, so they are
+// handled on the same goroutine as fsnotify events.
+var completedUploads = make(chan string)
+
+// uploaders remembers which FTP user uploaded each queue file until it is
+// handled. An .sfc without a user: line is attributed to its FTP user.
+var uploaders = struct {
+	sync.Mutex
+	users map[string]string // path -> FTP user
+}{users: make(map[string]string)}
+
+// takeUploader returns and forgets the FTP user that uploaded path, if known.
+func takeUploader(path string) string {
+	uploaders.Lock()
+	defer uploaders.Unlock()
+	user := uploaders.users[path]
+	delete(uploaders.users, path)
+	return user
+}
+
+// registerFTPHookRoutes adds POST /ftp-upload for SFTPGo's upload action.
+func registerFTPHookRoutes(app *iris.Application) {
+	documentRoute(app.Post("/ftp-upload", func(ctx iris.Context) {
+		var action ftpUploadAction
+		if err := ctx.ReadJSON(&action); err != nil {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": err.Error()})
+			return
+		}
+		if action.Action != "upload" || action.Status != 1 {
+			ctx.StatusCode(iris.StatusNoContent)
+			return
+		}
+		ftpUploadsByUser.Add(action.Username, 1)
+		ftpUploadBytesByUser.Add(action.Username, action.FileSize)
+
+		// Only files directly in a queue directory are ours.
+		path := filepath.Join(config().FTPRoot, filepath.FromSlash(action.VirtualPath))
+		if !slices.Contains(queueDirPaths(), filepath.Dir(path)) {
+			ctx.StatusCode(iris.StatusNoContent)
+			return
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".sfc", ".pdf", ".cmd", ".kill":
+		default:
+			ctx.StatusCode(iris.StatusNoContent)
+			return
+		}
+
+		if strings.EqualFold(filepath.Ext(path), ".sfc") {
+			uploaders.Lock()
+			uploaders.users[path] = action.Username
+			uploaders.Unlock()
+		}
+
+		select {
+		case completedUploads <- path:
+			slog.Info("FTP upload finished", "user", action.Username, "file", path)
+			ctx.StatusCode(iris.StatusNoContent)
+		case <-time.After(10 * time.Second):
+			// The watcher is busy or stopped; fsnotify will still see the file.
+			ctx.StatusCode(iris.StatusServiceUnavailable)
+			ctx.JSON(iris.Map{"error": "queue watcher not accepting uploads"})
+		}
+	}), apiDoc{Summary: "SFTPGo upload action: handle a finished queue upload now", Request: ftpUploadAction{}, Status: iris.StatusNoContent})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUploaderAttribution(t *testing.T) {
+	tests := []struct {
+		name     string
+		sfc      string
+		uploader string
+		want     string
+	}{
+		{name: "user line", sfc: "6045551234\nfax0001.pdf\nuser: jsmith\n", uploader: "clinic-a", want: "jsmith"},
+		{name: "FTP user", sfc: "6045551234\nfax0001.pdf\n", uploader: "clinic-a", want: "clinic-a"},
+		{name: "neither", sfc: "6045551234\nfax0001.pdf\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			sfcPath := filepath.Join(dir, "fax0001.sfc")
+			writeTestFile(t, sfcPath, tt.sfc)
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+			if tt.uploader != "" {
+				uploaders.Lock()
+				uploaders.users[sfcPath] = tt.uploader
+				uploaders.Unlock()
+			}
+
+			handleSfcFile(sfcPath)
+
+			outboundQueue.Lock()
+			defer outboundQueue.Unlock()
+			if len(outboundQueue.items) != 1 {
+				t.Fatalf("%d jobs queued, want 1", len(outboundQueue.items))
+			}
+			if got := outboundQueue.items[0].Sfc.User; got != tt.want {
+				t.Errorf("user = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
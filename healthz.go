@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// /healthz checks what the service depends on rather than just answering:
+// the queue directory must exist and accept a probe file (an unmounted share
+// fails here), the queue watcher must be running, and, when configured, the
+// FTP server must accept connections on HEALTH_FTP_ADDRESS and SEND_WEBHOOK_URL
+// must answer a HEAD request (HEALTH_PROBE_WEBHOOK=true). In the ftp-client
+// and sftp-client delivery modes the last synchronization with the remote
+// folder must have succeeded. Any failing check makes the response 503 and is named in
+// "failing". "ftp_passive" shows the passive FTP settings Docker Compose
+// hands SFTPGo, for troubleshooting transfers that fail behind a firewall,
+// and "certificates" the days left on each certificate the certificate
+// monitor watches.
+
+// healthCheckTimeout bounds each network check.
+const healthCheckTimeout = 3 * time.Second
+
+// queueWatcherAlive is set while watchFaxFolder is handling events.
+var queueWatcherAlive atomic.Bool
+
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status     string                 `json:"status"` // "ok" or "unhealthy"
+	Checks     map[string]healthCheck `json:"checks"`
+	Failing    []string               `json:"failing,omitempty"`
+	FTPPassive ftpPassive             `json:"ftp_passive"`
+
+	// Days until expiry of every monitored certificate, as of the last check.
+	Certificates []monitoredCert `json:"certificates,omitempty"`
+}
+
+type ftpPassive struct {
+	PortRange string `json:"port_range"`
+	Ports     int    `json:"ports"`
+	PublicIP  string `json:"public_ip"` // "" leaves SFTPGo's force_passive_ip in effect
+}
+
+func registerHealthRoutes(app *iris.Application) {
+	documentRoute(app.Get("/healthz", func(ctx iris.Context) {
+		report := runHealthChecks(ctx.Request().Context())
+		if len(report.Failing) > 0 {
+			ctx.StatusCode(iris.StatusServiceUnavailable)
+		}
+		ctx.JSON(report)
+	}), apiDoc{Summary: "Dependency health checks; 503 naming the failing checks", Response: healthReport{}})
+}
+
+func runHealthChecks(ctx context.Context) healthReport {
+	checks := map[string]healthCheck{
+		"queue_dir":     checkQueueDirsWritable(queueDirPaths()),
+		"queue_watcher": checkQueueWatcher(),
+		"ftp":           checkFTPListener(ctx, config().HealthFTPAddress),
+		"send_webhook":  checkSendWebhook(ctx),
+		"remote_queue":  checkRemoteSync(),
+	}
+	cfg := config()
+	report := healthReport{Status: "ok", Checks: checks, FTPPassive: ftpPassive{
+		PortRange: fmt.Sprintf("%d-%d", cfg.ftpPassivePorts[0], cfg.ftpPassivePorts[1]),
+		Ports:     cfg.ftpPassivePorts[1] - cfg.ftpPassivePorts[0] + 1,
+		PublicIP:  cfg.FTPPublicIP,
+	}, Certificates: monitoredCerts()}
+	for _, name := range []string{"queue_dir", "queue_watcher", "ftp", "send_webhook", "remote_queue"} {
+		if !checks[name].OK {
+			report.Failing = append(report.Failing, name)
+		}
+	}
+	if len(report.Failing) > 0 {
+		report.Status = "unhealthy"
+	}
+	return report
+}
+
+func healthFailed(err error) healthCheck {
+	return healthCheck{Error: err.Error()}
+}
+
+// checkQueueDirsWritable checks every queue directory, reporting the first
+// that fails.
+func checkQueueDirsWritable(dirs []string) healthCheck {
+	for _, dir := range dirs {
+		if check := checkQueueDirWritable(dir); !check.OK {
+			return check
+		}
+	}
+	return healthCheck{OK: true}
+}
+
+// checkQueueDirWritable creates and removes a probe file in dir. The name is
+// a queue temp file name, so the watcher ignores it.
+func checkQueueDirWritable(dir string) healthCheck {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return healthFailed(err)
+	}
+	if !info.IsDir() {
+		return healthFailed(fmt.Errorf("%s is not a directory", dir))
+	}
+	probe, err := os.CreateTemp(dir, ".healthz.*.tmp")
+	if err != nil {
+		return healthFailed(err)
+	}
+	name := probe.Name()
+	_, err = probe.WriteString("ok")
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(name); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return healthFailed(err)
+	}
+	return healthCheck{OK: true}
+}
+
+func checkQueueWatcher() healthCheck {
+	if !queueWatcherAlive.Load() {
+		return healthCheck{Error: "queue watcher is not running"}
+	}
+	return healthCheck{OK: true}
+}
+
+// checkFTPListener connects to the FTP server, which runs outside this
+// process, at address. The check is skipped when address is empty.
+func checkFTPListener(ctx context.Context, address string) healthCheck {
+	if address == "" {
+		return healthCheck{OK: true, Skipped: true}
+	}
+	dialer := net.Dialer{Timeout: healthCheckTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return healthFailed(err)
+	}
+	conn.Close()
+	return healthCheck{OK: true}
+}
+
+// checkSendWebhook sends a HEAD request to SEND_WEBHOOK_URL when
+// HEALTH_PROBE_WEBHOOK=true. Any answer below 500 counts as reachable, since
+// the endpoint only has to accept POSTs, as does 501 from servers without HEAD.
+func checkSendWebhook(ctx context.Context) healthCheck {
+	postURL := config().SendWebhookURL
+	if !config().HealthProbeWebhook || postURL == "" {
+		return healthCheck{OK: true, Skipped: true}
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, postURL, nil)
+	if err != nil {
+		return healthFailed(err)
+	}
+	setWebhookHeaders(req, "")
+	client := &http.Client{Transport: sendTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return healthFailed(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented {
+		return healthCheck{Error: fmt.Sprintf("HEAD %s returned %s", postURL, resp.Status)}
+	}
+	return healthCheck{OK: true}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every component that parks a job in memory records it as a heldJob. Holds
+// are saved with the fax records in state.json on every change and at
+// shutdown, and on startup each one is handed back to the component named in
+// it. A hold that no component can take back fails explicitly instead of
+// being forgotten.
+
+// heldJob is one job parked by a component.
+type heldJob struct {
+	Component string          `json:"component"`             // key into holdRestorers
+	ID        string          `json:"id"`                    // unique within the component
+	HylaJobID string          `json:"hyla_job_id,omitempty"` // set once a Hylafax job ID was issued
+	SfcPath   string          `json:"sfc_path,omitempty"`
+	PdfPath   string          `json:"pdf_path,omitempty"`
+	Reason    string          `json:"reason"`  // why the job is held
+	Release   string          `json:"release"` // what releases it
+	HeldAt    time.Time       `json:"held_at"`
+	Data      json.RawMessage `json:"data,omitempty"` // component-specific state
+}
+
+// Hold components.
+const (
+	holdApproval = "approval" // outbound job awaiting an approver
+	holdPdfWait  = "pdf-wait" // .sfc waiting for its PDF to be uploaded
+	holdSchedule = "schedule" // outbound job waiting for its send-after time
+
+	holdOutboundQueue = "outbound-queue" // outbound job waiting for a worker
+)
+
+// holdRestorers take a persisted hold back at startup. A restorer returns an
+// error when it can no longer hold the job, e.g. because its feature is now disabled.
+var holdRestorers = map[string]func(h heldJob) error{
+	holdApproval: restoreApprovalHold,
+	holdPdfWait:  restorePdfWaitHold,
+	holdSchedule: restoreScheduleHold,
+
+	holdOutboundQueue: restoreOutboundHold,
+}
+
+var holds = struct {
+	sync.Mutex
+	entries map[string]heldJob // component + "/" + ID -> hold
+}{entries: make(map[string]heldJob)}
+
+// putHold records or updates a hold and persists it. data is stored as JSON.
+// Callers must not hold faxRecordsMutex or jobQueue.
+func putHold(h heldJob, data any) {
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			slog.Error("Error encoding hold", "component", h.Component, "hold", h.ID, "err", err)
+		}
+		h.Data = raw
+	}
+	if h.HeldAt.IsZero() {
+		h.HeldAt = time.Now()
+	}
+	holds.Lock()
+	holds.entries[h.Component+"/"+h.ID] = h
+	holds.Unlock()
+	saveState()
+}
+
+// releaseHold forgets a hold once its component has let the job go.
+func releaseHold(component, id string) {
+	holds.Lock()
+	_, ok := holds.entries[component+"/"+id]
+	delete(holds.entries, component+"/"+id)
+	holds.Unlock()
+	if ok {
+		saveState()
+	}
+}
+
+// heldJobs returns the current holds sorted by age, for persistence and reporting.
+func heldJobs() []heldJob {
+	holds.Lock()
+	defer holds.Unlock()
+	list := make([]heldJob, 0, len(holds.entries))
+	for _, h := range holds.entries {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].HeldAt.Before(list[j].HeldAt) })
+	return list
+}
+
+// restoreHolds routes every persisted hold back to its component and fails
+// the ones that are not claimed.
+func restoreHolds(persisted []heldJob) {
+	// Keep every hold on record until its component has dealt with it, so a
+	// save during restoration cannot drop the ones not yet restored.
+	holds.Lock()
+	for _, h := range persisted {
+		holds.entries[h.Component+"/"+h.ID] = h
+	}
+	holds.Unlock()
+
+	claimed := 0
+	for _, h := range persisted {
+		if h.HylaJobID != "" && h.SfcPath != "" {
+			setJobDir(h.HylaJobID, filepath.Dir(h.SfcPath))
+		}
+		restore, ok := holdRestorers[h.Component]
+		if !ok {
+			failHeldJob(h, fmt.Sprintf("failed: %s holds are no longer supported", h.Component))
+			continue
+		}
+		if err := restore(h); err != nil {
+			failHeldJob(h, "failed: "+err.Error())
+			continue
+		}
+		claimed++
+	}
+	if len(persisted) > 0 {
+		slog.Info("Restored held jobs", "restored", claimed, "held", len(persisted))
+	}
+}
+
+// failHeldJob reports a hold that could not be restored. Jobs that already
+// have a Hylafax job ID are failed towards Synergy.
+func failHeldJob(h heldJob, reason string) {
+	slog.Error("Held job could not be restored", "component", h.Component, "hold", h.ID,
+		"held_at", h.HeldAt.Format(time.RFC3339), "held_for", h.Reason, "reason", reason)
+	releaseHold(h.Component, h.ID)
+	if h.HylaJobID == "" {
+		return
+	}
+	failJob(h.HylaJobID, reason, h.SfcPath, h.PdfPath)
+}
+
+// restorePdfWaitHold re-reads the .sfc, which either waits for its PDF again
+// or is submitted if the PDF arrived while the daemon was down.
+func restorePdfWaitHold(h heldJob) error {
+	if _, err := os.Stat(h.SfcPath); err != nil {
+		return fmt.Errorf("%s no longer exists", filepath.Base(h.SfcPath))
+	}
+	releaseHold(h.Component, h.ID)
+	handleSfcFile(h.SfcPath)
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// restartService drops everything a restart loses, applies change to the
+// configuration, and restores the state saved on disk the way startup does.
+func restartService(t *testing.T, change func(cfg *Config)) {
+	t.Helper()
+	cfg := *config()
+	if change != nil {
+		change(&cfg)
+	}
+	currentConfig.Store(&cfg)
+
+	holds.Lock()
+	holds.entries = make(map[string]heldJob)
+	holds.Unlock()
+	cache.Lock()
+	cache.sfc, cache.pdf, cache.inFlight = make(map[string]sfcFile), make(map[string]cachedPdf), make(map[string]bool)
+	cache.Unlock()
+	outboundQueue.Lock()
+	outboundQueue.items = nil
+	outboundQueue.Unlock()
+	approvals.Lock()
+	approvals.pending = make(map[string]*pendingApproval)
+	approvals.Unlock()
+	scheduled.Lock()
+	scheduled.jobs = make(map[string]*scheduledFax)
+	scheduled.Unlock()
+	faxRecordsMutex.Lock()
+	faxRecords = make(map[string]*FaxJobRecord)
+	faxRecordsMutex.Unlock()
+	inboundContent.Lock()
+	inboundContent.seen = make(map[string]inboundContentEntry)
+	inboundContent.Unlock()
+	resolvedNotifies.Lock()
+	resolvedNotifies.at = make(map[string]time.Time)
+	resolvedNotifies.Unlock()
+	jobDirs.Lock()
+	jobDirs.dirs = make(map[string]string)
+	jobDirs.Unlock()
+
+	if err := loadState(); err != nil {
+		t.Fatalf("loadState() = %v", err)
+	}
+}
+
+func TestHoldsSurviveRestart(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		park    func(t *testing.T, dir string) string // parks a job, returning its Hylafax job ID
+		down    func(t *testing.T, dir string)        // happens while the service is down
+		restart func(cfg *Config)
+		want    string // component holding the job after the restart
+		failed  bool
+	}{
+		{name: "waiting for its PDF", park: parkSfc(false), want: holdPdfWait},
+		{name: "PDF uploaded while down", park: parkSfc(false), want: holdOutboundQueue,
+			down: func(t *testing.T, dir string) { writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n") }},
+		{name: ".sfc removed while down", park: parkSfc(false), failed: true,
+			down: func(t *testing.T, dir string) { removeTestFile(t, filepath.Join(dir, "fax0001.sfc")) }},
+		{name: "queued for a worker", park: parkSfc(true), want: holdOutboundQueue},
+		{name: "awaiting approval", env: map[string]string{"APPROVAL_REQUIRED": "true"}, park: parkApproval, want: holdApproval},
+		{name: "approval turned off", env: map[string]string{"APPROVAL_REQUIRED": "true"}, park: parkApproval, failed: true,
+			restart: func(cfg *Config) { cfg.ApprovalRequired = false }},
+		{name: "scheduled", park: parkScheduled, want: holdSchedule},
+		{name: "component gone", park: func(t *testing.T, dir string) string {
+			setJobDir("42", dir)
+			putHold(heldJob{Component: "rate-limit", ID: "42", HylaJobID: "42", Reason: "rate limited"}, nil)
+			return "42"
+		}, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"MIN_FREE_DISK_MB": "0"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			cfg := useTestConfig(t, env)
+			t.Cleanup(func() {
+				approvals.Lock()
+				approvals.pending = make(map[string]*pendingApproval)
+				approvals.Unlock()
+				scheduled.Lock()
+				scheduled.jobs = make(map[string]*scheduledFax)
+				scheduled.Unlock()
+			})
+			dir := cfg.FTPRoot + FaxDir
+			jobID := tt.park(t, dir)
+			if len(heldJobs()) != 1 {
+				t.Fatalf("%d holds before the restart, want 1: %+v", len(heldJobs()), heldJobs())
+			}
+			if tt.down != nil {
+				tt.down(t, dir)
+			}
+
+			restartService(t, tt.restart)
+
+			held := heldJobs()
+			failed := fileExists(jobFile(jobID, "q"+jobID+".fail"))
+			if failed != tt.failed {
+				t.Errorf("job failed = %v, want %v", failed, tt.failed)
+			}
+			switch {
+			case tt.failed && len(held) != 0:
+				t.Errorf("failed job is still held: %+v", held)
+			case !tt.failed && (len(held) != 1 || held[0].Component != tt.want || held[0].HylaJobID != jobID):
+				t.Errorf("holds after the restart %+v, want one %s hold of job %s", held, tt.want, jobID)
+			}
+			if tt.failed {
+				return
+			}
+
+			// The owning component has the job back, not just the record.
+			var owned bool
+			switch tt.want {
+			case holdPdfWait:
+				cache.Lock()
+				_, owned = cache.sfc["fax0001.pdf"]
+				cache.Unlock()
+			case holdOutboundQueue:
+				outboundQueue.Lock()
+				owned = len(outboundQueue.items) == 1 && outboundQueue.items[0].HylaJobID == jobID
+				outboundQueue.Unlock()
+			case holdApproval:
+				approvals.Lock()
+				_, owned = approvals.pending[jobID]
+				approvals.Unlock()
+			case holdSchedule:
+				scheduled.Lock()
+				_, owned = scheduled.jobs[jobID]
+				scheduled.Unlock()
+			}
+			if !owned {
+				t.Errorf("%s component did not take job %s back", tt.want, jobID)
+			}
+		})
+	}
+}
+
+// parkSfc uploads fax0001.sfc, with its PDF first if withPdf.
+func parkSfc(withPdf bool) func(t *testing.T, dir string) string {
+	return func(t *testing.T, dir string) string {
+		if withPdf {
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+		}
+		writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+		handleSfcFile(filepath.Join(dir, "fax0001.sfc"))
+		return readJobID(t, dir)
+	}
+}
+
+func parkApproval(t *testing.T, dir string) string {
+	setJobDir("42", dir)
+	pdfPath := filepath.Join(dir, "fax0001.pdf")
+	writeTestFile(t, pdfPath, "%PDF-1.4\n")
+	writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+	holdForApproval(pendingApproval{HylaJobID: "42", JobID: "fax0001", FaxNumber: "6045551234",
+		PdfFile: "fax0001.pdf", PdfPath: pdfPath, SfcFileName: "fax0001.sfc"})
+	return "42"
+}
+
+func parkScheduled(t *testing.T, dir string) string {
+	setJobDir("42", dir)
+	pdfPath := filepath.Join(dir, "fax0001.pdf")
+	writeTestFile(t, pdfPath, "%PDF-1.4\n")
+	writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+	scheduleFax(scheduledFax{HylaJobID: "42", JobID: "fax0001", PdfPath: pdfPath, SfcFileName: "fax0001.sfc",
+		Sfc: SfcJob{FaxNumber: "6045551234", PdfFile: "fax0001.pdf", NotBefore: time.Now().Add(time.Hour)}})
+	return "42"
+}
+
+// readJobID returns the Hylafax job ID written to fax0001.jobid.
+func readJobID(t *testing.T, dir string) string {
+	t.Helper()
+	id := readTestFile(t, filepath.Join(dir, "fax0001.jobid"))
+	if len(id) < 2 {
+		t.Fatalf("fax0001.jobid = %q", id)
+	}
+	return id[:len(id)-1]
+}
+
+// removeTestFile removes path, which must exist.
+func removeTestFile(t *testing.T, path string) {
+	t.Helper()
+	if !fileExists(path) {
+		t.Fatalf("%s does not exist", path)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
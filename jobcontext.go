@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// errJobCancelled is returned by the pipeline when a job's context was
+// cancelled, so callers can tell a cancelled job from a failed one.
+var errJobCancelled = errors.New("fax job cancelled")
+
+// pipelineCtx is the parent of every job context; it is cancelled on shutdown.
+var pipelineCtx, stopPipeline = context.WithCancel(context.Background())
+
+// jobContexts holds the context of every outbound job between acceptance and
+// hand-off to the provider, keyed by Hylafax job ID.
+var jobContexts = struct {
+	sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}{cancels: make(map[string]context.CancelCauseFunc)}
+
+var jobsCancelled = expvar.NewInt("jobs_cancelled")
+
+// submissions counts the goroutines submitting jobs, so shutdown can wait for them.
+var submissions sync.WaitGroup
+
+// goSubmit runs a submission in the background and tracks it for drainPipeline.
+func goSubmit(submit func()) {
+	submissions.Add(1)
+	go func() {
+		defer submissions.Done()
+		submit()
+	}()
+}
+
+// drainPipeline waits for submissions in progress until ctx expires, then
+// cancels the remaining ones and gives them a moment to write their
+// cancelled state. It must only be called once nothing can start new submissions.
+func drainPipeline(ctx context.Context) {
+	drained := make(chan struct{})
+	go func() {
+		submissions.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return
+	case <-ctx.Done():
+	}
+
+	slog.Warn("Shutdown deadline reached; cancelling jobs still being submitted")
+	stopPipeline()
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		slog.Warn("Jobs still being submitted at exit were left unfinished")
+	}
+}
+
+// startJobContext returns the context for a job's trip through the pipeline.
+// endJobContext must be called once the job has left it.
+func startJobContext(hylaJobID string) context.Context {
+	ctx, cancel := context.WithCancelCause(pipelineCtx)
+	jobContexts.Lock()
+	jobContexts.cancels[hylaJobID] = cancel
+	jobContexts.Unlock()
+	return ctx
+}
+
+func endJobContext(hylaJobID string) {
+	jobContexts.Lock()
+	cancel, ok := jobContexts.cancels[hylaJobID]
+	delete(jobContexts.cancels, hylaJobID)
+	jobContexts.Unlock()
+	if ok {
+		cancel(nil)
+	}
+}
+
+// cancelJobContext cancels a job that is still in the pipeline. It reports
+// whether the job was found.
+func cancelJobContext(hylaJobID, reason string) bool {
+	jobContexts.Lock()
+	cancel, ok := jobContexts.cancels[hylaJobID]
+	jobContexts.Unlock()
+	if ok {
+		cancel(errors.New(reason))
+	}
+	return ok
+}
+
+// jobCancelled reports whether ctx was cancelled, by request or by shutdown.
+func jobCancelled(ctx context.Context) bool {
+	return ctx.Err() != nil
+}
+
+// cancelledJob writes the cancelled state for a job that left the pipeline
+// early.
+func cancelledJob(ctx context.Context, hylaJobID, sfcFileName, pdfFile string) error {
+	reason := cancelReason(ctx)
+	slog.Info("Fax job cancelled", "job_id", hylaJobID, "reason", reason)
+	recordCancelledJob(hylaJobID, reason, jobFile(hylaJobID, sfcFileName), jobFile(hylaJobID, pdfFile))
+	return errJobCancelled
+}
+
+// recordCancelledJob reports a cancelled job to Synergy: the .sts gets the
+// failed state, which is where Hylafax leaves a removed job, with reason as
+// its status line, and q<jobid>.cancelled is created instead of a .fail.
+// The job's files are removed. It is entered in the fax history as
+// cancelled, and does not count as a failure in SLA, status or event figures.
+func recordCancelledJob(hylaJobID, reason string, paths ...string) {
+	jobsCancelled.Add(1)
+	slaJobExcluded(hylaJobID, "cancelled")
+	if err := createStsFile(hylaJobID, stsStateFailed, "", "", reason); err != nil {
+		slog.Error("Error updating .sts for cancelled job", "job_id", hylaJobID, "err", err)
+	}
+	recordFaxHistory(faxHistoryEntry{
+		Direction:   "outbound",
+		ID:          hylaJobID,
+		To:          sfcNumber(paths),
+		Result:      "cancelled",
+		ResultText:  reason,
+		CompletedAt: time.Now(),
+	})
+	// Written before the .sfc goes, so its removal is not taken for a cancel.
+	if err := createFile(jobFile(hylaJobID, fmt.Sprintf("q%s.cancelled", hylaJobID)), "\r"); err != nil {
+		slog.Error("Error creating .cancelled", "job_id", hylaJobID, "err", err)
+	}
+	for _, path := range paths {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+}
+
+// cancelRequested reports whether ctx was cancelled by a request, such as
+// DELETE /jobs/{id} or Synergy, rather than by shutdown.
+func cancelRequested(ctx context.Context) bool {
+	return jobCancelled(ctx) && context.Cause(ctx) != context.Canceled
+}
+
+// cancelReason is the status recorded for a job whose ctx was cancelled.
+func cancelReason(ctx context.Context) string {
+	if cause := context.Cause(ctx); cause != context.Canceled {
+		return cause.Error()
+	}
+	return "cancelled: shutting down"
+}
+
+// Outcomes of cancelJob.
+type cancelOutcome int
+
+const (
+	cancelNotPending cancelOutcome = iota // finished, or with the provider and not cancellable
+	cancelDone                            // taken out before submission and cancelled
+	cancelSignalled                       // being submitted; the pipeline writes its cancelled state
+	cancelUpstream                        // cancelled by the provider after accepting it
+	cancelRefused                         // the provider did not cancel it
+)
+
+// cancelJob cancels the job hylaJobID wherever it is: waiting for its PDF,
+// awaiting approval, queued, scheduled, being submitted, or accepted by the provider when
+// SEND_CANCEL_URL is set. reason becomes the job's status.
+func cancelJob(hylaJobID, reason string) (cancelOutcome, error) {
+	if entry, ok := takeWaitingSfc(hylaJobID); ok {
+		slog.Info("Fax job waiting for its PDF cancelled", "job_id", hylaJobID, "reason", reason)
+		recordCancelledJob(hylaJobID, reason, entry.sfcFile)
+		return cancelDone, nil
+	}
+	if job, ok := takeApproval(hylaJobID); ok {
+		slog.Info("Fax job awaiting approval cancelled", "job_id", hylaJobID, "reason", reason)
+		releaseInFlight(job.SfcFileName)
+		recordCancelledJob(hylaJobID, reason, jobFile(hylaJobID, job.SfcFileName), jobFile(hylaJobID, job.PdfFile))
+		return cancelDone, nil
+	}
+	if item, ok := takeQueuedOutbound(hylaJobID); ok {
+		slog.Info("Queued fax job cancelled", "job_id", hylaJobID, "reason", reason)
+		releaseInFlight(item.SfcFileName)
+		recordCancelledJob(hylaJobID, reason, jobFile(hylaJobID, item.SfcFileName), item.PdfPath)
+		return cancelDone, nil
+	}
+	if job, ok := takeScheduled(hylaJobID); ok {
+		slog.Info("Scheduled fax job cancelled", "job_id", hylaJobID, "reason", reason)
+		releaseInFlight(job.SfcFileName)
+		recordCancelledJob(hylaJobID, reason, jobFile(hylaJobID, job.SfcFileName), job.PdfPath)
+		return cancelDone, nil
+	}
+	if cancelJobContext(hylaJobID, reason) {
+		// A broadcast may have destinations with the provider already.
+		cancelSubmittedJob(hylaJobID, reason)
+		return cancelSignalled, nil
+	}
+	return cancelSubmittedJob(hylaJobID, reason)
+}
+
+// registerJobCancelRoutes adds DELETE /jobs/{id} for jobs that have not
+// finished.
+func registerJobCancelRoutes(admin iris.Party) {
+	documentRoute(admin.Delete("/jobs/{id}", func(ctx iris.Context) {
+		id := ctx.Params().Get("id")
+		actor := requestActor(ctx)
+		if actor == "" {
+			actor = ctx.RemoteAddr()
+		}
+
+		outcome, err := cancelJob(id, "cancelled by "+actor)
+		switch outcome {
+		case cancelDone, cancelUpstream:
+			ctx.JSON(iris.Map{"hyla_job_id": id, "cancelled": true})
+		case cancelSignalled:
+			ctx.StatusCode(iris.StatusAccepted)
+			ctx.JSON(iris.Map{"hyla_job_id": id, "cancelled": true})
+		case cancelRefused:
+			ctx.StatusCode(iris.StatusBadGateway)
+			ctx.JSON(iris.Map{"error": "the provider did not cancel the job: " + err.Error()})
+		default:
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.JSON(iris.Map{"error": "job is not pending; it was already handed to the provider or has finished"})
+		}
+	}), apiDoc{Summary: "Cancel a job that is waiting for its PDF, queued, awaiting approval or waiting for its send-after time (200), still being submitted (202), or accepted by the provider when SEND_CANCEL_URL is set (200, or 502 if the provider refuses)", Response: struct {
+		HylaJobID string `json:"hyla_job_id"`
+		Cancelled bool   `json:"cancelled"`
+	}{}})
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestWorkers starts the outbound workers and stops them at cleanup.
+func startTestWorkers(t *testing.T) {
+	t.Helper()
+	startOutboundWorkers()
+	t.Cleanup(func() {
+		stopOutboundWorkers()
+		submissions.Wait()
+		outboundQueue.Lock()
+		outboundQueue.stopped = false
+		outboundQueue.Unlock()
+	})
+}
+
+// resetEventQueue empties the fax event queue before and after the test.
+func resetEventQueue(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		eventQueue.Lock()
+		eventQueue.events = nil
+		eventQueue.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+// deleteJob sends DELETE /jobs/{id} with admin credentials.
+func deleteJob(t *testing.T, jobID string) int {
+	t.Helper()
+	return serveTestRequest(t, registerAdminRoutes, asAdmin(httptest.NewRequest("DELETE", "/jobs/"+jobID, nil))).Code
+}
+
+// checkCancelled checks the state a cancelled job leaves behind: a
+// .cancelled marker and no .done or .fail, the reason as its .sts status,
+// its files gone, a single cancelled history entry and no fax events.
+func checkCancelled(t *testing.T, dir, jobID, reason string) {
+	t.Helper()
+	if !fileExists(jobFile(jobID, "q"+jobID+".cancelled")) {
+		t.Errorf("no q%s.cancelled", jobID)
+	}
+	for _, ext := range []string{".done", ".fail"} {
+		if fileExists(jobFile(jobID, "q"+jobID+ext)) {
+			t.Errorf("cancelled job has a %s", ext)
+		}
+	}
+	if sts := stsFields(t, jobID); sts["state"] != stsStateFailed || sts["status"] != reason {
+		t.Errorf(".sts state %q status %q, want %q and %q", sts["state"], sts["status"], stsStateFailed, reason)
+	}
+	for _, name := range []string{"fax0001.sfc", "fax0001.pdf"} {
+		if fileExists(filepath.Join(dir, name)) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	var results []string
+	now := time.Now()
+	readFaxHistory(now.Add(-time.Hour), now.Add(time.Hour), func(e faxHistoryEntry) error {
+		if e.ID == jobID {
+			results = append(results, e.Result)
+		}
+		return nil
+	})
+	if len(results) != 1 || results[0] != "cancelled" {
+		t.Errorf("history results %v, want [cancelled]", results)
+	}
+	checkNoJobEvents(t, jobID)
+}
+
+func checkNoJobEvents(t *testing.T, jobID string) {
+	t.Helper()
+	eventQueue.Lock()
+	defer eventQueue.Unlock()
+	for _, e := range eventQueue.events {
+		if e.JobID == jobID {
+			t.Errorf("cancelled job has a %s event", e.Type)
+		}
+	}
+}
+
+// TestCancelWaitingJob cancels a job at each stage before submission and
+// checks that it goes no further once the stage would have released it.
+func TestCancelWaitingJob(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		park  func(t *testing.T, dir string) string
+		after func(t *testing.T, dir, jobID string) // what would have moved the job on
+	}{
+		{name: "waiting for its PDF", park: parkSfc(false), after: func(t *testing.T, dir, jobID string) {
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+			handlePdfFile(filepath.Join(dir, "fax0001.pdf"))
+		}},
+		{name: "queued", park: parkSfc(true), after: func(t *testing.T, dir, jobID string) {
+			startTestWorkers(t)
+			stopOutboundWorkers()
+			submissions.Wait()
+		}},
+		{name: "awaiting approval", env: map[string]string{"APPROVAL_REQUIRED": "true"}, park: parkApproval,
+			after: func(t *testing.T, dir, jobID string) {
+				rec := serveTestRequest(t, registerAdminRoutes, asAdmin(httptest.NewRequest("POST", "/jobs/"+jobID+"/approve", nil)))
+				if rec.Code != 404 {
+					t.Errorf("approve after cancel: status %d, want 404", rec.Code)
+				}
+			}},
+		{name: "scheduled", park: parkScheduled, after: func(t *testing.T, dir, jobID string) {
+			releaseDueFaxes(time.Now().Add(2 * time.Hour))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				fmt.Fprint(w, `{"job_uuid":"job-uuid"}`)
+			}))
+			defer server.Close()
+			env := map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL, "SEND_WEBHOOK_RETRIES": "1",
+				"EVENT_WEBHOOK_URL": "http://127.0.0.1:9/events", "EVENT_WEBHOOK_TYPES": "submitted,retrying,sent,failed"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			cfg := useTestConfig(t, env)
+			resetEventQueue(t)
+			t.Cleanup(func() {
+				approvals.Lock()
+				approvals.pending = make(map[string]*pendingApproval)
+				approvals.Unlock()
+				scheduled.Lock()
+				scheduled.jobs = make(map[string]*scheduledFax)
+				scheduled.Unlock()
+			})
+			dir := cfg.FTPRoot + FaxDir
+			jobID := tt.park(t, dir)
+
+			if code := deleteJob(t, jobID); code != 200 {
+				t.Fatalf("DELETE status %d, want 200", code)
+			}
+			reason := "cancelled by " + adminTokenPrincipal
+			checkCancelled(t, dir, jobID, reason)
+
+			tt.after(t, dir, jobID)
+			if n := calls.Load(); n != 0 {
+				t.Errorf("send webhook called %d times after the cancel", n)
+			}
+			outboundQueue.Lock()
+			queued := len(outboundQueue.items)
+			outboundQueue.Unlock()
+			if queued != 0 {
+				t.Errorf("%d jobs queued after the cancel", queued)
+			}
+			if sts := stsFields(t, jobID); sts["status"] != reason {
+				t.Errorf(".sts status %q after the cancel, want %q", sts["status"], reason)
+			}
+			checkNoJobEvents(t, jobID)
+		})
+	}
+}
+
+// TestCancelSubmittingJob cancels a job while the send webhook is answering
+// it, or while the submission waits to be retried, and checks that the
+// submission is abandoned and not retried, with nothing recorded as submitted.
+func TestCancelSubmittingJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int  // of the send webhook
+		block   bool // the send webhook answers once the job is cancelled
+		backoff bool // cancel once the job waits to be retried
+	}{
+		{name: "during the request", status: 200, block: true},
+		{name: "waiting to retry", status: 503, backoff: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan struct{}, 4)
+			release := make(chan struct{})
+			var sends atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sends.Add(1)
+				received <- struct{}{}
+				if tt.block {
+					select {
+					case <-release:
+					case <-r.Context().Done():
+					}
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, `{"job_uuid":"job-uuid"}`)
+			}))
+			defer server.Close()
+			defer close(release)
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL,
+				"SEND_WEBHOOK_RETRIES": "3", "SEND_WEBHOOK_RETRY_BACKOFF": "1m", "EVENT_WEBHOOK_URL": "http://127.0.0.1:9/events", "EVENT_WEBHOOK_TYPES": "submitted,retrying,sent,failed"})
+			resetEventQueue(t)
+			dir := cfg.FTPRoot + FaxDir
+			startTestWorkers(t)
+			jobID := parkSfc(true)(t, dir)
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("job never reached the send webhook")
+			}
+			if tt.backoff {
+				deadline := time.Now().Add(5 * time.Second)
+				for !strings.HasPrefix(stsFields(t, jobID)["status"], "retrying") {
+					if time.Now().After(deadline) {
+						t.Fatal("job never waited to be retried")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			if code := deleteJob(t, jobID); code != 202 {
+				t.Fatalf("DELETE status %d, want 202", code)
+			}
+			stopOutboundWorkers()
+			submissions.Wait()
+
+			if n := sends.Load(); n != 1 {
+				t.Errorf("send webhook called %d times, want 1", n)
+			}
+			jobQueue.Lock()
+			waiting := len(jobQueue.entries)
+			jobQueue.Unlock()
+			if waiting != 0 {
+				t.Errorf("%d dials waiting for their result", waiting)
+			}
+			checkCancelled(t, dir, jobID, "cancelled by "+adminTokenPrincipal)
+		})
+	}
+}
+
+// TestCancelAcceptedJob cancels a job the provider has accepted and checks
+// that its later result is ignored.
+func TestCancelAcceptedJob(t *testing.T) {
+	var cancels atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancels.Add(1)
+	}))
+	defer server.Close()
+	cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_CANCEL_URL": server.URL + "/{job_uuid}",
+		"EVENT_WEBHOOK_URL": "http://127.0.0.1:9/events", "EVENT_WEBHOOK_TYPES": "submitted,retrying,sent,failed"})
+	dir := cfg.FTPRoot + FaxDir
+	setJobDir("42", dir)
+	queueSentJob(t, cfg, "job-uuid", jobQ{hylaJobID: "42"})
+	resetEventQueue(t) // its submitted event came before the cancel
+
+	if code := deleteJob(t, "42"); code != 200 {
+		t.Fatalf("DELETE status %d, want 200", code)
+	}
+	if n := cancels.Load(); n != 1 {
+		t.Errorf("cancel URL called %d times, want 1", n)
+	}
+	checkCancelled(t, dir, "42", "cancelled by "+adminTokenPrincipal)
+
+	postNotify(t, `"uuid":"job-uuid"`, `"uuid":"job-uuid"`)
+	if fileExists(jobFile("42", "q42.done")) {
+		t.Error("late result completed the cancelled job")
+	}
+	checkNoJobEvents(t, "42")
+}
+
+// TestBackgroundTasksStopOnCancel cancels the context of each background
+// task while its request is in progress, and checks that the task returns
+// with its work left pending and the attempt not counted.
+func TestBackgroundTasksStopOnCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		smtp    bool // the server is an SMTP listener rather than HTTP
+		env     func(url string) map[string]string
+		setup   func(t *testing.T, pdfPath string)
+		run     func(ctx context.Context)
+		pending func() bool
+	}{
+		{
+			name: "forward",
+			env:  func(url string) map[string]string { return map[string]string{"RECEIVE_FORWARD_URL": url} },
+			setup: func(t *testing.T, pdfPath string) {
+				faxRecords["fax-uuid"] = &FaxJobRecord{PdfPath: pdfPath, ForwardStatus: forwardPending}
+			},
+			run: func(ctx context.Context) { runForward(ctx, "fax-uuid") },
+			pending: func() bool {
+				faxRecordsMutex.Lock()
+				defer faxRecordsMutex.Unlock()
+				r := faxRecords["fax-uuid"]
+				return r.ForwardStatus == forwardPending && r.ForwardAttempts == 0
+			},
+		},
+		{
+			name: "email",
+			smtp: true,
+			env: func(addr string) map[string]string {
+				host, port, _ := net.SplitHostPort(addr)
+				return map[string]string{"SMTP_HOST": host, "SMTP_PORT": port, "SMTP_FROM": "fax@example.com"}
+			},
+			setup: func(t *testing.T, pdfPath string) {
+				faxRecords["fax-uuid"] = &FaxJobRecord{PdfPath: pdfPath, EmailStatus: emailPending, EmailTo: "clinic@example.com"}
+			},
+			run: func(ctx context.Context) { runEmail(ctx, "fax-uuid") },
+			pending: func() bool {
+				faxRecordsMutex.Lock()
+				defer faxRecordsMutex.Unlock()
+				r := faxRecords["fax-uuid"]
+				return r.EmailStatus == emailPending && r.EmailAttempts == 0
+			},
+		},
+		{
+			name: "archive",
+			env: func(url string) map[string]string {
+				return map[string]string{"ARCHIVE_S3_BUCKET": "faxes", "ARCHIVE_S3_ENDPOINT": url,
+					"ARCHIVE_S3_ACCESS_KEY_ID": "key", "ARCHIVE_S3_SECRET_ACCESS_KEY": "secret"}
+			},
+			setup: func(t *testing.T, pdfPath string) {
+				archiveFax("outbound-42", "42", pdfPath, archiveMetadata{Direction: "outbound", HylaJobID: "42"})
+			},
+			run: func(ctx context.Context) { runArchiver(ctx, time.Now()) },
+			pending: func() bool {
+				entries := readArchiveJournal()
+				return len(entries) == 1 && entries[0].Status == archivePending && entries[0].Attempts == 0
+			},
+		},
+		{
+			name: "event webhook",
+			env:  func(url string) map[string]string { return map[string]string{"EVENT_WEBHOOK_URL": url} },
+			setup: func(t *testing.T, pdfPath string) {
+				queueFaxEvent(faxEvent{Type: eventFailed, Direction: "outbound", JobID: "42"})
+			},
+			run: func(ctx context.Context) { runEventWebhook(ctx) },
+			pending: func() bool {
+				eventQueue.Lock()
+				defer eventQueue.Unlock()
+				return len(eventQueue.events) == 1
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan struct{}, 1)
+			var addr string
+			if tt.smtp {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ln.Close()
+				go func() {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					received <- struct{}{}
+					conn.Read(make([]byte, 1)) // never greets; returns when the client closes
+				}()
+				addr = ln.Addr().String()
+			} else {
+				stop := make(chan struct{})
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					received <- struct{}{}
+					select {
+					case <-r.Context().Done():
+					case <-stop:
+					}
+				}))
+				defer server.Close()
+				defer close(stop)
+				addr = server.URL
+			}
+			cfg := useTestConfig(t, tt.env(addr))
+			resetEventQueue(t)
+			pdfPath := filepath.Join(cfg.FTPRoot, "fax-uuid.pdf")
+			writeTestFile(t, pdfPath, "%PDF-1.4\n")
+			tt.setup(t, pdfPath)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				tt.run(ctx)
+				close(done)
+			}()
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("task never made its request")
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("task did not return once cancelled")
+			}
+			if !tt.pending() {
+				t.Error("cancelled task did not leave its work pending")
+			}
+			if _, err := os.Stat(pdfPath); err != nil {
+				t.Errorf("PDF of the pending task: %v", err)
+			}
+		})
+	}
+}
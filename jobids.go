@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Hylafax job IDs come from a sequence file, like Hylafax's own seqf: the
+// last ID handed out is kept in FTP_ROOT/seqf and incremented under an
+// exclusive file lock, wrapping to 1 after JOB_ID_MAX. An ID whose q<id>.sts,
+// .done or .fail file is still in a queue directory is skipped, so a new job
+// never overwrites the status of an older one.
+
+const jobSeqFileName = "seqf"
+
+// jobSeqMutex serializes allocations within the process; the file lock
+// covers other processes sharing the sequence file.
+var jobSeqMutex sync.Mutex
+
+var errJobIDsExhausted = errors.New("every job ID up to JOB_ID_MAX is in use")
+
+// allocateJobID returns the next free Hylafax job ID.
+func allocateJobID() (string, error) {
+	cfg := config()
+	return allocateJobIDIn(filepath.Join(cfg.FTPRoot, jobSeqFileName), queueDirPaths(), cfg.JobIDMax)
+}
+
+func allocateJobIDIn(seqPath string, queueDirs []string, max int) (string, error) {
+	jobSeqMutex.Lock()
+	defer jobSeqMutex.Unlock()
+
+	f, err := os.OpenFile(seqPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", fmt.Errorf("error opening job sequence file: %w", err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return "", fmt.Errorf("error locking job sequence file: %w", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("error reading job sequence file: %w", err)
+	}
+	last := 0
+	if s := strings.TrimSpace(string(data)); s != "" {
+		if last, err = strconv.Atoi(s); err != nil || last < 0 {
+			return "", fmt.Errorf("job sequence file %s holds %q, not a job ID", seqPath, s)
+		}
+	}
+
+	next := last
+	for tries := 0; ; tries++ {
+		if tries == max {
+			return "", errJobIDsExhausted
+		}
+		if next++; next > max {
+			next = 1
+		}
+		if !jobIDInUse(queueDirs, strconv.Itoa(next)) {
+			break
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return "", fmt.Errorf("error writing job sequence file: %w", err)
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(next)+"\n"), 0); err != nil {
+		return "", fmt.Errorf("error writing job sequence file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("error writing job sequence file: %w", err)
+	}
+	return strconv.Itoa(next), nil
+}
+
+// jobIDInUse reports whether a queue directory still has status files for id.
+func jobIDInUse(queueDirs []string, id string) bool {
+	for _, dir := range queueDirs {
+		for _, ext := range []string{".sts", ".done", ".fail", ".cancelled"} {
+			if _, err := os.Stat(filepath.Join(dir, "q"+id+ext)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAllocateJobIDIn(t *testing.T) {
+	tests := []struct {
+		name    string
+		seq     string   // content of seqf; "" for none
+		inUse   []string // files in the second queue directory
+		max     int
+		want    []string // IDs of successive allocations
+		wantSeq string
+		wantErr error
+	}{
+		{name: "first ID", max: 100, want: []string{"1", "2", "3"}, wantSeq: "3\n"},
+		{name: "continues the sequence", seq: "41\n", max: 100, want: []string{"42", "43"}, wantSeq: "43\n"},
+		{name: "wraps at the maximum", seq: "98", max: 100, want: []string{"99", "100", "1", "2"}, wantSeq: "2\n"},
+		{name: "skips IDs with status files", seq: "41", inUse: []string{"q42.sts", "q43.done", "q44.fail", "q46.sts"}, max: 100,
+			want: []string{"45", "47"}, wantSeq: "47\n"},
+		{name: "skips in-use IDs across the wrap", seq: "99", inUse: []string{"q100.sts", "q1.done"}, max: 100,
+			want: []string{"2"}, wantSeq: "2\n"},
+		{name: "other files do not reserve an ID", seq: "41", inUse: []string{"q42.pdf", "fax42.sts", "q420.sts"}, max: 100,
+			want: []string{"42"}, wantSeq: "42\n"},
+		{name: "every ID in use", seq: "1", inUse: []string{"q1.sts", "q2.sts", "q3.done"}, max: 3, wantSeq: "1", wantErr: errJobIDsExhausted},
+		{name: "corrupt sequence file", seq: "forty-one", max: 100, wantSeq: "forty-one", wantErr: errors.New("not a job ID")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dirs := []string{filepath.Join(root, "synergyfaxq"), filepath.Join(root, "quebec")}
+			seqPath := filepath.Join(root, jobSeqFileName)
+			writeTestFile(t, filepath.Join(dirs[0], "fax0001.sfc"), "")
+			if tt.seq != "" {
+				writeTestFile(t, seqPath, tt.seq)
+			}
+			for _, name := range tt.inUse {
+				writeTestFile(t, filepath.Join(dirs[1], name), "")
+			}
+
+			var got []string
+			for range max(len(tt.want), 1) {
+				id, err := allocateJobIDIn(seqPath, dirs, tt.max)
+				if tt.wantErr != nil {
+					if err == nil || !errors.Is(err, tt.wantErr) && !strings.Contains(err.Error(), tt.wantErr.Error()) {
+						t.Errorf("err = %v, want %v", err, tt.wantErr)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, id)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("allocated %v, want %v", got, tt.want)
+			}
+			if seq := readTestFile(t, seqPath); seq != tt.wantSeq {
+				t.Errorf("seqf = %q, want %q", seq, tt.wantSeq)
+			}
+		})
+	}
+}
+
+func TestAllocateJobIDConcurrent(t *testing.T) {
+	root := t.TempDir()
+	seqPath := filepath.Join(root, jobSeqFileName)
+	const n = 50
+	ids := make(chan string, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := allocateJobIDIn(seqPath, []string{root}, 1000)
+			if err != nil {
+				t.Error(err)
+			}
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("job ID %s allocated twice", id)
+		}
+		seen[id] = true
+	}
+	if seq := readTestFile(t, seqPath); seq != "50\n" {
+		t.Errorf("seqf = %q, want %q", seq, "50\n")
+	}
+}
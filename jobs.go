@@ -0,0 +1,371 @@
+package main
+
+import (
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// queuedJobView is a jobQueue entry as returned by the jobs endpoints.
+type queuedJobView struct {
+	JobUUID      string    `json:"job_uuid"`
+	SynergyJobID string    `json:"synergy_job_id"`
+	HylaJobID    string    `json:"hyla_job_id"`
+	User         string    `json:"user,omitempty"`
+	Route        string    `json:"route,omitempty"` // send route the job went to
+	Pages        int       `json:"pages,omitempty"`
+	Dials        int       `json:"dials,omitempty"` // dials made, this one included
+	Status       string    `json:"status"`          // always "queued": accepted by the provider, waiting for its notify
+	AcceptedAt   time.Time `json:"accepted_at"`
+	AgeSeconds   int64     `json:"age_seconds"`
+	PdfPath      string    `json:"pdf_path"`
+	SfcPath      string    `json:"sfc_path"`
+	FaxUUID      string    `json:"fax_uuid,omitempty"`
+	CallUUID     string    `json:"call_uuid,omitempty"`
+
+	BroadcastDestination int `json:"broadcast_destination,omitempty"` // 1-based, for one destination of a broadcast
+}
+
+// faxRecordView is a FaxJobRecord as returned by the jobs endpoints.
+type faxRecordView struct {
+	Key           string     `json:"key"`
+	Direction     string     `json:"direction"`
+	Status        string     `json:"status"`
+	User          string     `json:"user,omitempty"` // originating user of an outbound job
+	CallUUID      string     `json:"call_uuid,omitempty"`
+	HylafaxJobID  string     `json:"hylafax_job_id,omitempty"`
+	PdfPath       string     `json:"pdf_path,omitempty"`
+	RecvPath      string     `json:"recv_path,omitempty"`
+	TenantDir     string     `json:"tenant_dir,omitempty"` // RECEIVE_TENANT_MAP folder, relative to FTP_ROOT
+	Pages         int        `json:"pages,omitempty"`
+	SHA256        string     `json:"sha256,omitempty"`         // of the stored PDF of a received fax
+	ContentSHA256 string     `json:"content_sha256,omitempty"` // of the document as received, before any TIFF conversion
+	DuplicateOf   string     `json:"duplicate_of,omitempty"`
+	Replayed      bool       `json:"replayed,omitempty"`
+	ForwardStatus string     `json:"forward_status,omitempty"` // RECEIVE_FORWARD_URL delivery: pending, forwarded or failed
+	ForwardError  string     `json:"forward_error,omitempty"`
+	EmailStatus   string     `json:"email_status,omitempty"` // RECEIVE_EMAIL_MAP delivery: pending, sent or failed
+	EmailError    string     `json:"email_error,omitempty"`
+	ArchiveStatus string     `json:"archive_status,omitempty"` // ARCHIVE_S3_BUCKET upload: pending, archived or failed
+	ArchiveKey    string     `json:"archive_key,omitempty"`
+	FaxTime       *time.Time `json:"fax_time,omitempty"`  // provider's time for a received fax
+	JobUUIDs      []string   `json:"job_uuids,omitempty"` // provider UUIDs of an outbound job's dials
+	ReceivedAt    time.Time  `json:"received_at"`
+	LastUpdatedAt time.Time  `json:"last_updated_at"`
+
+	// Only in GET /jobs/{id}.
+	History        []statusChange `json:"history,omitempty"`
+	HistoryDropped int            `json:"history_dropped,omitempty"` // older entries dropped past the cap
+}
+
+func viewQueuedJob(jobUUID string, job jobQ, now time.Time) queuedJobView {
+	return queuedJobView{
+		JobUUID:      jobUUID,
+		SynergyJobID: job.synergyJobID,
+		HylaJobID:    job.hylaJobID,
+		User:         job.user,
+		Route:        job.route,
+		Pages:        job.pages,
+		Dials:        job.dials,
+		Status:       "queued",
+		AcceptedAt:   job.acceptedAt,
+		AgeSeconds:   int64(now.Sub(job.acceptedAt).Seconds()),
+		PdfPath:      job.pdfPath,
+		SfcPath:      job.sfcPath,
+		FaxUUID:      job.faxUUID,
+		CallUUID:     job.callUUID,
+
+		BroadcastDestination: job.broadcastIndex,
+	}
+}
+
+func viewFaxRecord(key string, r *FaxJobRecord) faxRecordView {
+	var faxTime *time.Time
+	if !r.FaxTime.IsZero() {
+		faxTime = &r.FaxTime
+	}
+	return faxRecordView{
+		FaxTime:       faxTime,
+		Key:           key,
+		Direction:     r.Direction,
+		Status:        r.LastStatus,
+		User:          r.User,
+		CallUUID:      r.CallUUID,
+		HylafaxJobID:  r.HylafaxJobID,
+		PdfPath:       r.PdfPath,
+		RecvPath:      r.RecvPath,
+		TenantDir:     r.TenantDir,
+		Pages:         r.Pages,
+		SHA256:        r.SHA256,
+		ContentSHA256: r.ContentHash,
+		DuplicateOf:   r.DuplicateOf,
+		Replayed:      r.Replayed,
+		ForwardStatus: r.ForwardStatus,
+		ForwardError:  r.ForwardError,
+		EmailStatus:   r.EmailStatus,
+		EmailError:    r.EmailError,
+		ArchiveStatus: r.ArchiveStatus,
+		ArchiveKey:    r.ArchiveKey,
+		JobUUIDs:      slices.Clone(r.JobUUIDs),
+		ReceivedAt:    r.ReceivedAt,
+		LastUpdatedAt: r.LastUpdatedAt,
+	}
+}
+
+// parseSince accepts an RFC 3339 time or a duration back from now, e.g. "2h".
+func parseSince(v string, now time.Time) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), true
+	}
+	return time.Time{}, false
+}
+
+// page returns the [offset, offset+limit) window of n items.
+func page(n, offset, limit int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := offset + limit
+	if end > n {
+		end = n
+	}
+	return offset, end
+}
+
+const maxJobsPageSize = 1000
+
+// resolveRequest is the body of POST /jobs/{id}/resolve.
+type resolveRequest struct {
+	Result string `json:"result"` // "success" or "failed"
+	Reason string `json:"reason"`
+}
+
+// takeQueuedJob removes and returns the queued job with the given UUID.
+func takeQueuedJob(jobUUID string) (jobQ, bool) {
+	jobQueue.Lock()
+	defer jobQueue.Unlock()
+	job, ok := jobQueue.entries[jobUUID]
+	if ok {
+		delete(jobQueue.entries, jobUUID)
+	}
+	return job, ok
+}
+
+// registerJobRoutes adds the read-only view of queued jobs and fax records.
+func registerJobRoutes(admin iris.Party) {
+	documentRoute(admin.Get("/jobs", func(ctx iris.Context) {
+		applyJobStatuses()
+		now := time.Now()
+		status := strings.ToLower(ctx.URLParam("status"))
+		user := ctx.URLParam("user")
+		var since time.Time
+		if v := ctx.URLParam("since"); v != "" {
+			t, ok := parseSince(v, now)
+			if !ok {
+				ctx.StatusCode(iris.StatusBadRequest)
+				ctx.JSON(iris.Map{"error": "since must be an RFC 3339 time or a duration such as 2h"})
+				return
+			}
+			since = t
+		}
+		limit := ctx.URLParamIntDefault("limit", 100)
+		offset := ctx.URLParamIntDefault("offset", 0)
+		if limit <= 0 || limit > maxJobsPageSize || offset < 0 {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": "limit must be 1-1000 and offset non-negative"})
+			return
+		}
+
+		jobs := []queuedJobView{}
+		jobQueue.Lock()
+		for jobUUID, job := range jobQueue.entries {
+			if (status != "" && status != "queued") || (user != "" && job.user != user) || job.acceptedAt.Before(since) {
+				continue
+			}
+			jobs = append(jobs, viewQueuedJob(jobUUID, job, now))
+		}
+		jobQueue.Unlock()
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].AcceptedAt.After(jobs[j].AcceptedAt) })
+
+		records := []faxRecordView{}
+		faxRecordsMutex.Lock()
+		for key, r := range faxRecords {
+			if (status != "" && strings.ToLower(r.LastStatus) != status) || (user != "" && r.User != user) || r.LastUpdatedAt.Before(since) {
+				continue
+			}
+			records = append(records, viewFaxRecord(key, r))
+		}
+		faxRecordsMutex.Unlock()
+		sort.Slice(records, func(i, j int) bool { return records[i].LastUpdatedAt.After(records[j].LastUpdatedAt) })
+
+		jobsFrom, jobsTo := page(len(jobs), offset, limit)
+		recordsFrom, recordsTo := page(len(records), offset, limit)
+		ctx.JSON(iris.Map{
+			"jobs":          jobs[jobsFrom:jobsTo],
+			"records":       records[recordsFrom:recordsTo],
+			"total_jobs":    len(jobs),
+			"total_records": len(records),
+			"offset":        offset,
+			"limit":         limit,
+		})
+	}), apiDoc{
+		Summary: "Outbound jobs waiting for their notify and fax records, newest first",
+		Query: map[string]string{
+			"status": "only jobs or records with this status; queued jobs have status \"queued\"",
+			"user":   "only outbound jobs and records of this originating user",
+			"since":  "only entries accepted or updated since this RFC 3339 time or duration ago, e.g. 2h",
+			"limit":  "page size for each list, 1-1000, default 100",
+			"offset": "entries to skip in each list",
+		},
+		Response: struct {
+			Jobs         []queuedJobView `json:"jobs"`
+			Records      []faxRecordView `json:"records"`
+			TotalJobs    int             `json:"total_jobs"`
+			TotalRecords int             `json:"total_records"`
+			Offset       int             `json:"offset"`
+			Limit        int             `json:"limit"`
+		}{},
+	})
+
+	type jobDetail struct {
+		Job     *queuedJobView `json:"job,omitempty"`
+		Record  *faxRecordView `json:"record,omitempty"`
+		Failure *failureInfo   `json:"failure,omitempty"` // q<id>.info, when id is the Hylafax job ID of a failed job
+		Archive *archiveEntry  `json:"archive,omitempty"` // archive journal entry, by UUID of a received fax or Hylafax job ID of a sent one
+	}
+	documentRoute(admin.Get("/jobs/{id}", func(ctx iris.Context) {
+		id := ctx.Params().Get("id")
+		var detail jobDetail
+		applyJobStatuses()
+
+		recordKey := id
+		jobQueue.Lock()
+		if job, ok := jobQueue.entries[id]; ok {
+			view := viewQueuedJob(id, job, time.Now())
+			detail.Job = &view
+			recordKey = job.hylaJobID
+		}
+		jobQueue.Unlock()
+		faxRecordsMutex.Lock()
+		if _, ok := faxRecords[recordKey]; !ok {
+			recordKey, _ = findJobRecord(id)
+		}
+		if r, ok := faxRecords[recordKey]; ok {
+			view := viewFaxRecord(recordKey, r)
+			view.History = slices.Clone(r.History)
+			view.HistoryDropped = r.HistoryDropped
+			detail.Record = &view
+		}
+		faxRecordsMutex.Unlock()
+		if info, err := readFailureInfo(id); err == nil {
+			detail.Failure = &info
+		}
+		if entry, err := readArchiveEntry(id); err == nil {
+			detail.Archive = &entry
+		}
+
+		if detail.Job == nil && detail.Record == nil && detail.Failure == nil && detail.Archive == nil {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "no queued job or fax record with that UUID, and no failed job with that Hylafax job ID"})
+			return
+		}
+		ctx.JSON(detail)
+	}), apiDoc{Summary: "One queued job and/or fax record by UUID or Hylafax job ID, with the record's status history, or why the job with that Hylafax job ID failed", Response: jobDetail{}})
+
+	// Support staff download what a customer received without shell access.
+	// Every download is logged and emitted as a document_access event.
+	documentRoute(admin.Get("/fax/{uuid}/pdf", func(ctx iris.Context) {
+		id := ctx.Params().Get("uuid")
+		actor := requestActor(ctx)
+		faxRecordsMutex.Lock()
+		var record FaxJobRecord
+		r, ok := faxRecords[id]
+		if ok {
+			record = *r
+		}
+		faxRecordsMutex.Unlock()
+
+		ev := securityEventForRequest(ctx, secEventDocumentAccess, "failure", "")
+		ev.Target = id
+		defer func() { emitSecurityEvent(ev) }()
+		if !ok || record.PdfPath == "" {
+			ev.Detail = "no stored PDF"
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "no fax record with a stored PDF for that UUID"})
+			return
+		}
+		if _, err := os.Stat(record.PdfPath); err != nil {
+			if record.ArchiveStatus == archiveUploaded {
+				location, _, _, _ := s3ObjectURL(record.ArchiveKey)
+				ev.Detail = "archived"
+				slog.Info("Fax PDF requested, but only in the archive", "uuid", id, "actor", actor, "client", ctx.RemoteAddr(), "archive_key", record.ArchiveKey)
+				ctx.StatusCode(iris.StatusGone)
+				ctx.JSON(iris.Map{"error": "the PDF was removed from the queue directory and is in the archive",
+					"archive_bucket": config().ArchiveS3Bucket, "archive_key": record.ArchiveKey, "archive_url": location})
+				return
+			}
+			ev.Detail = "cleaned up"
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "the PDF is no longer in the queue directory"})
+			return
+		}
+
+		slog.Info("Fax PDF downloaded", "uuid", id, "direction", record.Direction, "actor", actor, "client", ctx.RemoteAddr(), "file", record.PdfPath)
+		ev.Outcome, ev.Detail = "success", ftpRootPath(record.PdfPath)
+		ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(record.PdfPath)}))
+		ctx.ContentType(contentTypePDF)
+		if err := ctx.ServeFile(record.PdfPath); err != nil {
+			ev.Outcome = "failure"
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "the PDF is no longer in the queue directory"})
+		}
+	}), apiDoc{Summary: "Download the stored PDF of a fax record: 404 when it was cleaned up, 410 with its location when only the archive has it",
+		ContentType: contentTypePDF})
+
+	// A job whose notify never arrives stays queued forever; resolving it
+	// writes the .sts and .done/.fail files a notify would have.
+	documentRoute(admin.Post("/jobs/{id}/resolve", func(ctx iris.Context) {
+		id := ctx.Params().Get("id")
+		var req resolveRequest
+		if err := ctx.ReadJSON(&req); err != nil {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": err.Error()})
+			return
+		}
+		success := false
+		switch strings.ToLower(req.Result) {
+		case "success":
+			success = true
+		case "failed":
+		default:
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.JSON(iris.Map{"error": `result must be "success" or "failed"`})
+			return
+		}
+
+		job, ok := takeQueuedJob(id)
+		if !ok {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "no queued job with that UUID"})
+			return
+		}
+		slog.Info("Fax job manually resolved", "uuid", id, "job_id", job.hylaJobID, "result", req.Result,
+			"actor", requestActor(ctx), "client", ctx.RemoteAddr(), "reason", req.Reason)
+		completeOutboundJob(job, FaxJob{UUID: id, Status: req.Result, Result: FaxResult{Success: success, ResultText: req.Reason}}, statusSourceManual)
+		saveState()
+		ctx.JSON(iris.Map{"job_uuid": id, "hyla_job_id": job.hylaJobID, "result": strings.ToLower(req.Result)})
+	}), apiDoc{Summary: "Complete a queued job by hand, as if its notify had arrived", Request: resolveRequest{}, Response: struct {
+		JobUUID   string `json:"job_uuid"`
+		HylaJobID string `json:"hyla_job_id"`
+		Result    string `json:"result"`
+	}{}})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFaxPDFDownload(t *testing.T) {
+	const doc = "%PDF-1.4\n1 0 obj<<>>endobj\n%%EOF\n"
+	tests := []struct {
+		name   string
+		auth   func(req *http.Request)
+		status int
+		event  string // security event type
+		actor  string
+	}{
+		{name: "no credentials", status: 401, event: secEventAdminRejected},
+		{name: "claimed user", auth: basic("support", ""), status: 401, event: secEventAdminRejected},
+		{name: "read token", auth: bearer("read-secret"), status: 200, event: secEventDocumentAccess, actor: adminReadTokenPrincipal},
+		{name: "support user", auth: basic("support", "pw"), status: 200, event: secEventDocumentAccess, actor: "support"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"ADMIN_READ_TOKEN": "read-secret",
+				"ADMIN_BASIC_USER": "support", "ADMIN_BASIC_PASS": "pw"})
+			events := captureSecurityEvents(t)
+			path := filepath.Join(cfg.FTPRoot, "in", "fax-a.pdf")
+			writeTestFile(t, path, doc)
+			faxRecordsMutex.Lock()
+			faxRecords["fax-a"] = &FaxJobRecord{ReceivedUUID: "fax-a", Direction: "inbound", PdfPath: path}
+			faxRecordsMutex.Unlock()
+
+			req := httptest.NewRequest("GET", "/fax/fax-a/pdf", nil)
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := serveTestRequest(t, registerAdminRoutes, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if served := strings.Contains(rec.Body.String(), "%PDF"); served != (tt.status == 200) {
+				t.Errorf("PDF served = %v with status %d", served, rec.Code)
+			}
+			got := events()
+			if len(got) != 1 || got[0].Type != tt.event || got[0].Actor != tt.actor {
+				t.Errorf("events %+v, want one %s by %q", got, tt.event, tt.actor)
+			}
+		})
+	}
+}
+
+func TestResolveJob(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     func(req *http.Request)
+		status   int
+		resolved bool
+		event    string // security event type
+		actor    string
+	}{
+		{name: "no credentials", status: 401, event: secEventAdminRejected},
+		{name: "wrong token", auth: bearer("wrong"), status: 401, event: secEventAdminRejected},
+		{name: "read token", auth: bearer("read-secret"), status: 403, event: secEventAdminRejected, actor: adminReadTokenPrincipal},
+		{name: "manage token", auth: bearer(testAdminToken), status: 200, resolved: true, event: secEventAdminAction, actor: adminTokenPrincipal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "ADMIN_READ_TOKEN": "read-secret"})
+			queueSentJob(t, cfg, "job-uuid", jobQ{})
+			events := captureSecurityEvents(t)
+
+			req := httptest.NewRequest("POST", "/jobs/job-uuid/resolve", strings.NewReader(`{"result":"success","reason":"confirmed by phone"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := serveTestRequest(t, registerAdminRoutes, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			jobQueue.Lock()
+			_, queued := jobQueue.entries["job-uuid"]
+			jobQueue.Unlock()
+			if queued == tt.resolved {
+				t.Errorf("job still queued = %v, want %v", queued, !tt.resolved)
+			}
+			wantState := stsStateSleeping
+			if tt.resolved {
+				wantState = stsStateDone
+			}
+			if sts := stsFields(t, "42"); sts["state"] != wantState {
+				t.Errorf(".sts state %q, want %q", sts["state"], wantState)
+			}
+			got := events()
+			if len(got) != 1 || got[0].Type != tt.event || got[0].Actor != tt.actor {
+				t.Errorf("events %+v, want one %s by %q", got, tt.event, tt.actor)
+			}
+		})
+	}
+}
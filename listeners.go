@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Route groups that can be assigned to a listener.
+const (
+	routeGroupProvider = "provider" // /fax-receive, /fax-notify
+	routeGroupAdmin    = "admin"    // operator endpoints
+	routeGroupMetrics  = "metrics"  // /metrics, /healthz
+	routeGroupPublic   = "public"   // /status/public
+	routeGroupFTP      = "ftp"      // /ftp-upload
+)
+
+// routeGroupRegistrars maps each route group to the function that registers its routes.
+var routeGroupRegistrars map[string]func(app *iris.Application)
+
+func init() {
+	// Assigned here rather than in the declaration because /openapi.json,
+	// itself an admin route, registers every group to describe it.
+	routeGroupRegistrars = map[string]func(app *iris.Application){
+		routeGroupProvider: registerProviderRoutes,
+		routeGroupAdmin:    registerAdminRoutes,
+		routeGroupMetrics:  registerMetricsRoutes,
+		routeGroupPublic:   registerPublicRoutes,
+		routeGroupFTP:      registerFTPHookRoutes,
+	}
+}
+
+// listenerConfig describes one HTTP listener as read from HTTP_LISTENERS_FILE.
+type listenerConfig struct {
+	Name         string   `json:"name"`
+	Address      string   `json:"address"`        // "host:port", "[::]:8443" or "unix:/path/to.sock"
+	TLSCertFile  string   `json:"tls_cert_file"`  // enables TLS when set together with TLSKeyFile
+	TLSKeyFile   string   `json:"tls_key_file"`   //
+	ClientCAFile string   `json:"client_ca_file"` // requires and verifies client certificates (mTLS)
+	Groups       []string `json:"groups"`         // route groups served on this listener
+}
+
+// httpListener is a running listener with its own router and server, so that
+// shutdown and state reporting are independent of the other listeners.
+type httpListener struct {
+	cfg    listenerConfig
+	server *http.Server
+	ln     net.Listener
+	cert   *listenerCert // nil without TLS
+
+	mu    sync.Mutex
+	state string // "serving", "stopped" or "failed"
+	err   string
+}
+
+// activeListeners holds the listeners started by startListeners, for reporting.
+var (
+	activeListeners      []*httpListener
+	activeListenersMutex sync.Mutex
+)
+
+// loadListenerConfigs reads the listener definitions from HTTP_LISTENERS_FILE.
+// Without a file, every route group is served on a plain listener on
+// HTTP_LISTEN (default :8080) and, when TLS_CERT_FILE and TLS_KEY_FILE are set, on an HTTPS listener on
+// HTTPS_PORT (default 8443). HTTP_PLAIN_ENABLED=false then drops the plain one.
+func loadListenerConfigs() ([]listenerConfig, error) {
+	path := config().HTTPListenersFile
+	if path == "" {
+		allGroups := []string{routeGroupProvider, routeGroupAdmin, routeGroupMetrics, routeGroupPublic, routeGroupFTP}
+		plain := listenerConfig{Name: "default", Address: config().HTTPListen, Groups: allGroups}
+		if config().TLSCertFile == "" {
+			return []listenerConfig{plain}, nil
+		}
+
+		address := ":" + strconv.Itoa(config().HTTPSPort)
+		configs := []listenerConfig{{Name: "https", Address: address, TLSCertFile: config().TLSCertFile, TLSKeyFile: config().TLSKeyFile, Groups: allGroups}}
+		if config().HTTPPlainEnabled {
+			configs = append(configs, plain)
+		}
+		if err := validateListenerConfigs(configs); err != nil {
+			return nil, err
+		}
+		return configs, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var configs []listenerConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if err := validateListenerConfigs(configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// validateListenerConfigs checks every listener definition and rejects
+// two listeners claiming the same route group on overlapping addresses: the
+// same port on the same host, or on any host when one of them listens on
+// every address (":8080", "0.0.0.0:8080" or "[::]:8080").
+func validateListenerConfigs(configs []listenerConfig) error {
+	if len(configs) == 0 {
+		return errors.New("no listeners configured")
+	}
+
+	type claim struct {
+		endpoint listenEndpoint
+		group    string
+		name     string
+	}
+	names := make(map[string]bool)
+	var claimed []claim
+	for i := range configs {
+		cfg := &configs[i]
+		if cfg.Address == "" {
+			return fmt.Errorf("listener %d: address is required", i)
+		}
+		if cfg.Name == "" {
+			cfg.Name = cfg.Address
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("listener %q: duplicate name", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+			return fmt.Errorf("listener %q: tls_cert_file and tls_key_file must be set together", cfg.Name)
+		}
+		if cfg.ClientCAFile != "" && cfg.TLSCertFile == "" {
+			return fmt.Errorf("listener %q: client_ca_file requires TLS", cfg.Name)
+		}
+		if len(cfg.Groups) == 0 {
+			return fmt.Errorf("listener %q: at least one route group is required", cfg.Name)
+		}
+
+		endpoint, err := resolveListenAddress(cfg.Address)
+		if err != nil {
+			return fmt.Errorf("listener %q: %w", cfg.Name, err)
+		}
+		for _, group := range cfg.Groups {
+			if _, ok := routeGroupRegistrars[group]; !ok {
+				return fmt.Errorf("listener %q: unknown route group %q", cfg.Name, group)
+			}
+			for _, c := range claimed {
+				if c.group == group && c.endpoint.overlaps(endpoint) {
+					return fmt.Errorf("listeners %q and %q both serve route group %q on %s", c.name, cfg.Name, group, cfg.Address)
+				}
+			}
+			claimed = append(claimed, claim{endpoint: endpoint, group: group, name: cfg.Name})
+		}
+	}
+	return nil
+}
+
+// listenEndpoint is a listener address resolved for the overlap check.
+type listenEndpoint struct {
+	unix     string // socket path of a unix: address
+	port     int
+	wildcard bool     // every local address
+	hosts    []string // the host's addresses, or the host itself if it does not resolve
+}
+
+// resolveListenAddress resolves the host and port of a listener address. A
+// named port is looked up, and a host name is resolved to its addresses.
+func resolveListenAddress(address string) (listenEndpoint, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return listenEndpoint{unix: filepath.Clean(path)}, nil
+	}
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return listenEndpoint{}, fmt.Errorf("address %q: %w", address, err)
+	}
+	port, err := net.LookupPort("tcp", portName)
+	if err != nil {
+		return listenEndpoint{}, fmt.Errorf("address %q: %w", address, err)
+	}
+	endpoint := listenEndpoint{port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		endpoint.wildcard = ip.IsUnspecified()
+		endpoint.hosts = []string{ip.String()}
+		return endpoint, nil
+	}
+	if host == "" {
+		endpoint.wildcard = true
+		return endpoint, nil
+	}
+	if ips, err := net.LookupIP(host); err == nil {
+		for _, ip := range ips {
+			endpoint.hosts = append(endpoint.hosts, ip.String())
+		}
+	} else {
+		endpoint.hosts = []string{strings.ToLower(host)}
+	}
+	return endpoint, nil
+}
+
+// overlaps reports whether listeners on a and b would take the same
+// connections.
+func (a listenEndpoint) overlaps(b listenEndpoint) bool {
+	if a.unix != "" || b.unix != "" {
+		return a.unix == b.unix
+	}
+	if a.port != b.port {
+		return false
+	}
+	if a.wildcard || b.wildcard {
+		return true
+	}
+	for _, host := range a.hosts {
+		if slices.Contains(b.hosts, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// startListeners binds every configured listener and serves it in the background.
+// Binding happens synchronously so configuration errors are reported at startup.
+func startListeners(configs []listenerConfig) ([]*httpListener, error) {
+	var listeners []*httpListener
+	for _, cfg := range configs {
+		l, err := newHTTPListener(cfg)
+		if err != nil {
+			for _, started := range listeners {
+				started.ln.Close()
+			}
+			return nil, fmt.Errorf("listener %q: %w", cfg.Name, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	for _, l := range listeners {
+		go l.serve()
+	}
+
+	activeListenersMutex.Lock()
+	activeListeners = listeners
+	activeListenersMutex.Unlock()
+	return listeners, nil
+}
+
+func newHTTPListener(cfg listenerConfig) (*httpListener, error) {
+	app := iris.New()
+	for _, group := range cfg.Groups {
+		routeGroupRegistrars[group](app)
+	}
+	if err := app.Build(); err != nil {
+		return nil, fmt.Errorf("error building routes: %w", err)
+	}
+
+	network, address := "tcp", cfg.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		// Remove a stale socket left behind by an unclean exit.
+		os.Remove(address)
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("error binding %s: %w", cfg.Address, err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0660); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("error setting socket permissions: %w", err)
+		}
+	}
+
+	var cert *listenerCert
+	if cfg.TLSCertFile != "" {
+		cert = &listenerCert{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile}
+		tlsConfig, err := listenerTLSConfig(cfg, cert)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	return &httpListener{
+		cfg:    cfg,
+		server: &http.Server{Handler: app},
+		ln:     ln,
+		cert:   cert,
+		state:  "serving",
+	}, nil
+}
+
+// listenerCert is a listener's key pair, re-read on SIGHUP so that renewed
+// certificates are served without a restart.
+type listenerCert struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// load reads the key pair, keeping the current one if that fails.
+func (c *listenerCert) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS key pair: %w", err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *listenerCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// reloadListenerCertificates re-reads the key pair of every TLS listener.
+func reloadListenerCertificates() {
+	activeListenersMutex.Lock()
+	defer activeListenersMutex.Unlock()
+	for _, l := range activeListeners {
+		if l.cert == nil {
+			continue
+		}
+		if err := l.cert.load(); err != nil {
+			slog.Error("HTTP listener keeps its previous certificate", "listener", l.cfg.Name, "err", err)
+			continue
+		}
+		slog.Info("HTTP listener reloaded its certificate", "listener", l.cfg.Name, "file", l.cfg.TLSCertFile)
+	}
+}
+
+func listenerTLSConfig(cfg listenerConfig, cert *listenerCert) (*tls.Config, error) {
+	if err := cert.load(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: cert.get,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func (l *httpListener) serve() {
+	slog.Info("HTTP listener serving", "listener", l.cfg.Name, "groups", l.cfg.Groups, "address", l.cfg.Address,
+		"tls", l.cfg.TLSCertFile != "", "mtls", l.cfg.ClientCAFile != "")
+
+	err := l.server.Serve(l.ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP listener failed", "listener", l.cfg.Name, "err", err)
+		l.setState("failed", err)
+		return
+	}
+	l.setState("stopped", nil)
+}
+
+func (l *httpListener) setState(state string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state = state
+	l.err = ""
+	if err != nil {
+		l.err = err.Error()
+	}
+}
+
+// shutdownListeners gracefully stops every listener in parallel; a slow or
+// failed listener does not hold up the others beyond the context deadline.
+func shutdownListeners(ctx context.Context, listeners []*httpListener) {
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *httpListener) {
+			defer wg.Done()
+			if err := l.server.Shutdown(ctx); err != nil {
+				slog.Warn("HTTP listener did not shut down cleanly", "listener", l.cfg.Name, "err", err)
+				l.server.Close()
+			}
+			if strings.HasPrefix(l.cfg.Address, "unix:") {
+				os.Remove(strings.TrimPrefix(l.cfg.Address, "unix:"))
+			}
+		}(l)
+	}
+	wg.Wait()
+}
+
+// listenerStatus is the per-listener view returned by /admin/listeners and /metrics.
+type listenerStatus struct {
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	Groups  []string `json:"groups"`
+	TLS     bool     `json:"tls"`
+	MTLS    bool     `json:"mtls"`
+	State   string   `json:"state"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func listenerStatuses() []listenerStatus {
+	activeListenersMutex.Lock()
+	defer activeListenersMutex.Unlock()
+
+	statuses := make([]listenerStatus, 0, len(activeListeners))
+	for _, l := range activeListeners {
+		l.mu.Lock()
+		statuses = append(statuses, listenerStatus{
+			Name:    l.cfg.Name,
+			Address: l.cfg.Address,
+			Groups:  l.cfg.Groups,
+			TLS:     l.cfg.TLSCertFile != "",
+			MTLS:    l.cfg.ClientCAFile != "",
+			State:   l.state,
+			Error:   l.err,
+		})
+		l.mu.Unlock()
+	}
+	return statuses
+}
+
+func init() {
+	expvar.Publish("listeners", expvar.Func(func() any { return listenerStatuses() }))
+}
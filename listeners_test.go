@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateListenerConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []listenerConfig
+		wantErr string // substring of the error, or "" for none
+	}{
+		{name: "separate ports", configs: []listenerConfig{
+			{Name: "a", Address: ":8080", Groups: []string{routeGroupProvider}},
+			{Name: "b", Address: ":9090", Groups: []string{routeGroupProvider}},
+		}},
+		{name: "same address, other groups", configs: []listenerConfig{
+			{Name: "a", Address: "127.0.0.1:8080", Groups: []string{routeGroupProvider}},
+			{Name: "b", Address: "127.0.0.1:8080", Groups: []string{routeGroupAdmin}},
+		}},
+		{name: "same address", configs: []listenerConfig{
+			{Name: "a", Address: "127.0.0.1:8080", Groups: []string{routeGroupProvider}},
+			{Name: "b", Address: "127.0.0.1:8080", Groups: []string{routeGroupProvider}},
+		}, wantErr: `"a" and "b" both serve route group "provider"`},
+		{name: "empty host and specific host", configs: []listenerConfig{
+			{Name: "a", Address: ":8080", Groups: []string{routeGroupAdmin}},
+			{Name: "b", Address: "10.0.0.5:8080", Groups: []string{routeGroupAdmin}},
+		}, wantErr: "both serve"},
+		{name: "IPv4 wildcard and specific host", configs: []listenerConfig{
+			{Name: "a", Address: "10.0.0.5:8080", Groups: []string{routeGroupAdmin}},
+			{Name: "b", Address: "0.0.0.0:8080", Groups: []string{routeGroupAdmin}},
+		}, wantErr: "both serve"},
+		{name: "IPv6 wildcard and IPv4 wildcard", configs: []listenerConfig{
+			{Name: "a", Address: "[::]:8080", Groups: []string{routeGroupMetrics}},
+			{Name: "b", Address: "0.0.0.0:8080", Groups: []string{routeGroupMetrics}},
+		}, wantErr: "both serve"},
+		{name: "wildcard on another port", configs: []listenerConfig{
+			{Name: "a", Address: "[::]:8080", Groups: []string{routeGroupMetrics}},
+			{Name: "b", Address: "127.0.0.1:9090", Groups: []string{routeGroupMetrics}},
+		}},
+		{name: "two specific hosts", configs: []listenerConfig{
+			{Name: "a", Address: "10.0.0.5:8080", Groups: []string{routeGroupPublic}},
+			{Name: "b", Address: "10.0.0.6:8080", Groups: []string{routeGroupPublic}},
+		}},
+		{name: "IPv6 spellings", configs: []listenerConfig{
+			{Name: "a", Address: "[::1]:8080", Groups: []string{routeGroupPublic}},
+			{Name: "b", Address: "[0:0:0:0:0:0:0:1]:8080", Groups: []string{routeGroupPublic}},
+		}, wantErr: "both serve"},
+		{name: "named port", configs: []listenerConfig{
+			{Name: "a", Address: "127.0.0.1:http", Groups: []string{routeGroupPublic}},
+			{Name: "b", Address: "127.0.0.1:80", Groups: []string{routeGroupPublic}},
+		}, wantErr: "both serve"},
+		{name: "host name", configs: []listenerConfig{
+			{Name: "a", Address: "localhost:8080", Groups: []string{routeGroupFTP}},
+			{Name: "b", Address: "127.0.0.1:8080", Groups: []string{routeGroupFTP}},
+		}, wantErr: "both serve"},
+		{name: "unix sockets", configs: []listenerConfig{
+			{Name: "a", Address: "unix:/run/fax.sock", Groups: []string{routeGroupFTP}},
+			{Name: "b", Address: "unix:/run//fax.sock", Groups: []string{routeGroupFTP}},
+		}, wantErr: "both serve"},
+		{name: "unix socket and wildcard", configs: []listenerConfig{
+			{Name: "a", Address: "unix:/run/fax.sock", Groups: []string{routeGroupFTP}},
+			{Name: "b", Address: ":8080", Groups: []string{routeGroupFTP}},
+		}},
+		{name: "bad port", configs: []listenerConfig{
+			{Name: "a", Address: "127.0.0.1:nope", Groups: []string{routeGroupFTP}},
+		}, wantErr: `listener "a"`},
+		{name: "no port", configs: []listenerConfig{
+			{Name: "a", Address: "127.0.0.1", Groups: []string{routeGroupFTP}},
+		}, wantErr: `listener "a"`},
+		{name: "unknown group", configs: []listenerConfig{
+			{Name: "a", Address: ":8080", Groups: []string{"nope"}},
+		}, wantErr: "unknown route group"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateListenerConfigs(tt.configs)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validateListenerConfigs() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validateListenerConfigs() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Log records are written with log/slog. LOG_LEVEL (debug, info, warn or
+// error; default info) sets the threshold and LOG_FORMAT=json switches from
+// text to JSON lines for log shippers. The same attribute names are used
+// throughout:
+//
+//	job_id          Hylafax job ID (q<job_id>.sts)
+//	synergy_job_id  .sfc name without its extension
+//	uuid            provider job or fax UUID
+//	call_uuid       provider call UUID
+//	direction       "inbound" or "outbound"
+//	file            path of the queue file concerned
+//	number          destination fax number
+//	cidnum          caller ID number
+//	user            Synergy or FTP user
+//	err             the error, when there is one
+
+// initLogging installs the default logger from LOG_LEVEL and LOG_FORMAT. It
+// also routes the stdlib log package, used by iris, through the same handler.
+// Invalid values fall back to info and text; Config.validate reports them.
+func initLogging() {
+	level := slog.LevelInfo
+	level.UnmarshalText([]byte(config().LogLevel))
+	opts := &slog.HandlerOptions{Level: level}
+	if config().LogRedactPII {
+		opts.ReplaceAttr = redactPII
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(config().LogFormat, "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// With LOG_REDACT_PII (on unless set to false), phone numbers and caller
+// names are masked in every log record: the attributes below are rewritten by
+// the handler, so no log site has to remember to do it.
+var (
+	phoneAttrs   = map[string]bool{"number": true, "cidnum": true}
+	nameAttrs    = map[string]bool{"cidname": true}
+	payloadAttrs = map[string]bool{"content": true, "body": true} // debug-level dumps
+)
+
+// phoneLike matches digit runs long enough to be a phone number, allowing the
+// usual separators.
+var phoneLike = regexp.MustCompile(`\+?\d[\d\-. ()]{5,}\d`)
+
+func redactPII(_ []string, a slog.Attr) slog.Attr {
+	switch {
+	case phoneAttrs[a.Key]:
+		return slog.String(a.Key, maskPhoneNumber(a.Value.String()))
+	case nameAttrs[a.Key] && a.Value.String() != "":
+		return slog.String(a.Key, "[redacted]")
+	case payloadAttrs[a.Key]:
+		return slog.String(a.Key, phoneLike.ReplaceAllStringFunc(a.Value.String(), maskPhoneNumber))
+	}
+	return a
+}
+
+// maskPhoneNumber replaces every digit but the last four with '*', keeping
+// any separators, e.g. "+1 604-555-1234" becomes "+* ***-***-1234".
+func maskPhoneNumber(number string) string {
+	digits := 0
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	masked := []rune(number)
+	for i, r := range masked {
+		if digits <= 4 {
+			break
+		}
+		if r >= '0' && r <= '9' {
+			masked[i] = '*'
+			digits--
+		}
+	}
+	return string(masked)
+}
+
+// fatal logs at error level and exits, in place of log.Fatalf.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaskPhoneNumber(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{number: "6045551234", want: "******1234"},
+		{number: "+1 604-555-1234", want: "+* ***-***-1234"},
+		{number: "(604) 555.1234", want: "(***) ***.1234"},
+		{number: "1234", want: "1234"},
+		{number: "55", want: "55"},
+		{number: "", want: ""},
+		{number: "anonymous", want: "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			if got := maskPhoneNumber(tt.number); got != tt.want {
+				t.Errorf("maskPhoneNumber(%q) = %q, want %q", tt.number, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactPII(t *testing.T) {
+	tests := []struct {
+		name string
+		attr slog.Attr
+		want string // the attribute as the text handler writes it
+	}{
+		{name: "number", attr: slog.String("number", "+16045551234"), want: "number=+*******1234"},
+		{name: "cidnum", attr: slog.String("cidnum", "604-555-1234"), want: "cidnum=***-***-1234"},
+		{name: "cidname", attr: slog.String("cidname", "Jane Smith"), want: "cidname=[redacted]"},
+		{name: "empty cidname", attr: slog.String("cidname", ""), want: `cidname=""`},
+		{name: "content", attr: slog.String("content", "6045551234\nfax0001.pdf\n"), want: `content="******1234\nfax0001.pdf\n"`},
+		{name: "body", attr: slog.String("body", `{"cidnum":"+1 (604) 555-1234","pages":3}`),
+			want: `body="{\"cidnum\":\"+* (***) ***-1234\",\"pages\":3}"`},
+		{name: "other attribute", attr: slog.String("file", "/ftp/6045551234.pdf"), want: "file=/ftp/6045551234.pdf"},
+		{name: "job ID", attr: slog.String("job_id", "1234567"), want: "job_id=1234567"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactPII})).Info("test", tt.attr)
+			if got := strings.TrimSpace(buf.String()); !strings.HasSuffix(got, " "+tt.want) {
+				t.Errorf("logged %q, want it to end with %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLogSitesRedacted logs a received fax and an outbound job at debug level
+// and checks that neither number appears in full.
+func TestLogSitesRedacted(t *testing.T) {
+	cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false"})
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: redactPII})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	if rec := receiveRequest(t, "pdf", []byte("%PDF-1.4\n")); rec.Code != 200 {
+		t.Fatalf("receive status %d: %s", rec.Code, rec.Body)
+	}
+	dir := cfg.FTPRoot + FaxDir
+	writeTestFile(t, filepath.Join(dir, "fax0002.sfc"), "604-555-9876\nfax0002.pdf\n")
+	writeTestFile(t, filepath.Join(dir, "fax0002.pdf"), "%PDF-1.4\n")
+	processFile(filepath.Join(dir, "fax0002.sfc"))
+	writeTestFile(t, filepath.Join(dir, "fax0003.sfc"), "6045559876\n")
+	processFile(filepath.Join(dir, "fax0003.sfc"))
+
+	logged := buf.String()
+	for _, number := range []string{"6045551234", "604-555-9876", "6045559876", "6045550100"} {
+		if strings.Contains(logged, number) {
+			t.Errorf("%s logged in full", number)
+		}
+	}
+	if !strings.Contains(logged, "1234") || !strings.Contains(logged, "9876") {
+		t.Error("the last four digits of the numbers were not logged")
+	}
+}
@@ -2,23 +2,22 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
-	"github.com/google/uuid"
-	"github.com/joho/godotenv"
 	"github.com/kataras/iris/v12"
 	"io"
 	"io/ioutil"
-	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -30,62 +29,64 @@ const (
 	JobIDPrefix = ""
 )
 
-// --- Approach 1: Using part of the UUID ---
-
-// getJobIdFromUUID extracts the last section of a UUID string,
-// converts it from hex, and returns a number in the range 1 to 32000.
-func getJobIdFromUUID(uuidStr string) (int, error) {
-	parts := strings.Split(uuidStr, "-")
-	if len(parts) == 0 {
-		return 0, errors.New("invalid uuid format")
-	}
-	lastPart := parts[len(parts)-1]
-	// Convert the last section from hex to an integer.
-	num, err := strconv.ParseInt(lastPart, 16, 64)
-	if err != nil {
-		return 0, err
-	}
-	// Calculate jobId as modulo 32000. If the result is zero, set to 1.
-	jobId := int(num % 32000)
-	if jobId == 0 {
-		jobId = 1
-	}
-	return jobId, nil
-}
-
-// --- Approach 2: Global Counter with Reset ---
-
-var (
-	jobCounter = 0
-	jobMutex   sync.Mutex
+// Hylafax job states written to the state: line of q<jobid>.sts.
+const (
+	stsStateSuspended = "1" // held, e.g. awaiting approval
+	stsStateSleeping  = "3" // queued or waiting between attempts
+	stsStateActive    = "6" // being transmitted
+	stsStateDone      = "7" // completed successfully
+	stsStateFailed    = "8" // failed permanently
 )
 
-// getNextJobId returns a new job id by incrementing a global counter.
-// It resets to 1 if the counter exceeds 32000.
-func getNextJobId() int {
-	jobMutex.Lock()
-	defer jobMutex.Unlock()
-	jobCounter++
-	if jobCounter >= 32000 {
-		jobCounter = 1
-	}
-	return jobCounter
-}
-
 // -------------------------------------
 // IN-MEMORY TRACKING STRUCTURES
 // -------------------------------------
 
 // FaxJobRecord tracks a fax job (sent or received).
 type FaxJobRecord struct {
-	ReceivedUUID  string    // For received faxes
-	CallUUID      string    // Unique key (from payload) used to correlate notifications
-	HylafaxJobID  string    // Generated Hylafax job ID (e.g. "fax1234")
-	PdfPath       string    // Local path of saved PDF file
-	RecvPath      string    // Local path of created .recv file
-	LastStatus    string    // Status (e.g. "received", "sent", "completed", "failed", etc.)
-	ReceivedAt    time.Time // When the fax was received/submitted
-	LastUpdatedAt time.Time // Last update time
+	ReceivedUUID   string         // For received faxes
+	Direction      string         // "inbound" or "outbound"
+	CallUUID       string         // Unique key (from payload) used to correlate notifications
+	HylafaxJobID   string         // Generated Hylafax job ID (e.g. "fax1234")
+	PdfPath        string         // Local path of saved PDF file
+	RecvPath       string         // Local path of created .recv file
+	CIDNum         string         // Caller number of a received fax
+	CIDName        string         // Caller name of a received fax
+	User           string         // Originating user of an outbound job
+	Number         string         // Number a received fax was sent to
+	TenantDir      string         // RECEIVE_TENANT_MAP folder a received fax went to; empty for the default queue
+	ContentHash    string         // SHA-256 of the received document
+	SHA256         string         // SHA-256 of the stored PDF; differs from ContentHash for a converted TIFF
+	Pages          int            // Pages in the document, 0 if unknown
+	DuplicateOf    string         // UUID of the original fax when this delivery was a content duplicate
+	Replayed       bool           // Delivered by the replay tool rather than the provider
+	LastStatus     string         // Status (e.g. "received", "sent", "completed", "failed", etc.)
+	History        []statusChange // Every status, oldest first; see statushistory.go
+	HistoryDropped int            // Entries dropped from History past maxStatusHistory
+	JobUUIDs       []string       // UUIDs the provider gave the dials of an outbound job
+	FaxTime        time.Time      // When the provider says a received fax came in, from ts or fax_source_info; zero if not given
+	FaxTimestamp   string         // The timestamp FaxTime was parsed from, as sent
+	ReceivedAt     time.Time      // When the fax was received/submitted
+	LastUpdatedAt  time.Time      // Last update time
+
+	// Forwarding of a received fax to RECEIVE_FORWARD_URL; see forward.go.
+	ForwardStatus   string    // "pending", "forwarded" or "failed"; empty when not forwarded
+	ForwardAttempts int       // Attempts made so far
+	ForwardError    string    // Error of the last attempt
+	ForwardedAt     time.Time // When the downstream system accepted it
+
+	// Email delivery of a received fax under RECEIVE_EMAIL_MAP; see email.go.
+	DstTenantID   int       // Tenant the fax was sent to
+	EmailTo       string    // Addresses, comma-separated; empty when not emailed
+	EmailStatus   string    // "pending", "sent" or "failed"
+	EmailAttempts int       // Attempts made so far
+	EmailError    string    // Error of the last attempt
+	EmailedAt     time.Time // When the SMTP server accepted it
+
+	// Archiving to ARCHIVE_S3_BUCKET; see archive.go.
+	ArchiveStatus string // "pending", "archived" or "failed"; empty when not archived
+	ArchiveKey    string // Object key of the PDF
+	ArchiveError  string // Error of the last attempt
 }
 
 // Global map to track received and sent faxes by a unique key (here CallUUID)
@@ -151,6 +152,7 @@ type FaxReceive struct {
 	TotTries      int           `json:"tottries"`
 	Ts            string        `json:"ts"`
 	FileData      string        `json:"file_data"`
+	FileSHA256    string        `json:"file_sha256"` // optional hex SHA-256 of the decoded document, checked before it is stored
 }
 
 type Endpoint struct {
@@ -169,6 +171,8 @@ type FaxResult struct {
 	Success    bool   `json:"success"`
 	ResultCode int    `json:"result_code"`
 	ResultText string `json:"result_text"`
+	PagesSent  int    `json:"pages_sent,omitempty"`  // pages transmitted, when the provider reports them
+	TotalPages int    `json:"total_pages,omitempty"` // pages in the document, when the provider reports them
 }
 
 type FaxSourceInfo struct {
@@ -184,32 +188,47 @@ type FaxSourceInfo struct {
 
 // sfcFile holds details from an .sfc file.
 type sfcFile struct {
+	SfcJob
 	jobID     string
+	hylaJobID string // issued by acceptSfc
 	sfcFile   string
-	pdfFile   string
-	faxNumber string
+	uploader  string    // FTP user that uploaded the .sfc, if reported by the FTP server
+	cachedAt  time.Time // when it began waiting for its PDF
+	alerted   bool      // waited past PAIR_ALERT_AFTER
+}
+
+// cachedPdf is a PDF waiting for its .sfc.
+type cachedPdf struct {
+	path     string
+	cachedAt time.Time
+	alerted  bool // waited past PAIR_ALERT_AFTER
 }
 
 // cache for SFC and PDF file info while matching pairs.
 var cache = struct {
 	sync.Mutex
-	sfc map[string]sfcFile // pdf filename -> sfcFile details
-	pdf map[string]string  // pdf filename -> local file path
-}{sfc: make(map[string]sfcFile), pdf: make(map[string]string)}
+	sfc      map[string]sfcFile   // pdf filename -> sfcFile details
+	pdf      map[string]cachedPdf // pdf filename -> local file
+	inFlight map[string]bool      // .sfc filename -> being submitted or awaiting approval
+}{sfc: make(map[string]sfcFile), pdf: make(map[string]cachedPdf), inFlight: make(map[string]bool)}
 
 // -------------------------------------
 // MAIN FUNCTION
 // -------------------------------------
 
 func main() {
-	// Load env variables.
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found; proceeding with defaults")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "--dump-openapi" {
+		os.Exit(dumpOpenAPI(os.Args[2:]))
 	}
 
+	mustLoadConfig(os.Args[1:])
+
 	// Shut down receiving lines when killed
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 	// Start background FTP server and folder watcher.
 	/*go startFtp()
@@ -218,92 +237,282 @@ func main() {
 	// go monitorDoneFiles(os.Getenv("FTP_ROOT") + FaxDir)
 	// go monitorStatusFiles(os.Getenv("FTP_ROOT") + FaxDir)
 
-	app := iris.New()
+	initFaults()
+
+	if err := prepareQueueDirs(); err != nil {
+		fatal("Queue directory is not usable", "err", err)
+	}
+
+	if err := initSecurityEvents(); err != nil {
+		fatal("Invalid security event configuration", "err", err)
+	}
+
+	if err := loadRecvFormat(); err != nil {
+		fatal("Invalid .recv format configuration", "err", err)
+	}
+
+	if err := loadWebhookCredentials(); err != nil {
+		fatal("Invalid send webhook credentials", "err", err)
+	}
+	logAdminAuth()
+
+	if err := loadWebhookHeaders(); err != nil {
+		fatal("Invalid send webhook headers", "err", err)
+	}
+
+	if err := loadOutboundRules(); err != nil {
+		fatal("Invalid outbound rules", "err", err)
+	}
+
+	if err := loadSendRoutes(); err != nil {
+		fatal("Invalid send routes", "err", err)
+	}
+
+	if err := loadStatusMap(); err != nil {
+		fatal("Invalid status map", "err", err)
+	}
+
+	if err := loadEmailMap(); err != nil {
+		fatal("Invalid receive email map", "err", err)
+	}
+
+	if err := loadTenantMap(); err != nil {
+		fatal("Invalid receive tenant map", "err", err)
+	}
+
+	if err := loadUserQuotas(); err != nil {
+		fatal("Invalid user quota configuration", "err", err)
+	}
+
+	startApprovalChecks()
+	startRetentionJanitor()
+	startDiskMonitor()
+
+	if err := loadSLAs(); err != nil {
+		fatal("Invalid SLA configuration", "err", err)
+	}
+
+	if err := loadState(); err != nil {
+		fatal("Unable to restore fax state", "err", err)
+	}
+	startJobWatchdog()
+	startPairExpiry()
+	startScheduler()
+	startOutboundWorkers()
+
+	resumeBackfills()
+	resumeForwards()
+	resumeEmails()
+	startArchiver()
+	startEventWebhook()
+	if err := startRemoteSync(); err != nil {
+		fatal("Unable to restore remote queue state", "err", err)
+	}
+
+	if config().DeadLetterResubmitOnStart {
+		resubmitDeadLetters()
+	}
 
+	configs, err := loadListenerConfigs()
+	if err != nil {
+		fatal("Invalid HTTP listener configuration", "err", err)
+	}
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		watchFaxFolder(watchCtx, queueDirPaths())
+	}()
+
+	listeners, err := startListeners(configs)
+	if err != nil {
+		fatal("Failed to start HTTP listeners", "err", err)
+	}
+
+	startCertMonitor(configs)
+
+	for sig := range sigchan {
+		if sig == syscall.SIGHUP {
+			slog.Info("Received SIGHUP, re-reading the configuration, certificates, webhook credentials and headers, outbound rules, send routes and status map")
+			reloadConfig()
+			reloadListenerCertificates()
+			refreshCertMonitor()
+			if err := loadWebhookCredentials(); err != nil {
+				slog.Error("Keeping previous webhook credentials", "err", err)
+			}
+			if err := loadWebhookHeaders(); err != nil {
+				slog.Error("Keeping previous webhook headers", "err", err)
+			}
+			if err := loadOutboundRules(); err != nil {
+				slog.Error("Keeping previous outbound rules", "err", err)
+			}
+			if err := loadSendRoutes(); err != nil {
+				slog.Error("Keeping previous send routes", "err", err)
+			}
+			if err := loadStatusMap(); err != nil {
+				slog.Error("Keeping previous status map", "err", err)
+			}
+			if err := loadEmailMap(); err != nil {
+				slog.Error("Keeping previous receive email map", "err", err)
+			}
+			if err := loadTenantMap(); err != nil {
+				slog.Error("Keeping previous receive tenant map", "err", err)
+			}
+			continue
+		}
+
+		// Stop taking new work, then let the jobs already accepted finish
+		// writing their queue files before the state is saved.
+		slog.Info("Shutting down", "signal", sig.String(), "deadline", config().ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), config().ShutdownTimeout)
+		stopWatching()
+		<-watcherDone
+		shutdownListeners(ctx, listeners)
+		stopScheduler()
+		stopOutboundWorkers()
+		drainPipeline(ctx)
+		cancel()
+		saveState()
+		slog.Info("Shutdown complete")
+		//logger.Logger.Print("Terminating")
+		os.Exit(0)
+	}
+}
+
+// registerProviderRoutes registers the endpoints called by the fax provider.
+func registerProviderRoutes(app *iris.Application) {
 	// -----------------------------
 	// RECEIVING FAXES
 	// -----------------------------
 	// This endpoint is called when a fax is received.
-	app.Post("/fax-receive", func(ctx iris.Context) {
-		var fax FaxReceive
-		if err := ctx.ReadJSON(&fax); err != nil {
-			ctx.StatusCode(iris.StatusBadRequest)
+	documentRoute(app.Post("/fax-receive", requireWebhookAuth("/fax-receive", receiveAuth), captureWebhook("fax-receive"), requireWebhookSignature(true), func(ctx iris.Context) {
+		queueDir := config().FTPRoot + FaxDir
+		if err := makeQueueDir(queueDir); err != nil {
+			recordDeliveryOutcome(true, false, 0)
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(iris.Map{"error": "failed to create local directory: " + err.Error()})
+			return
+		}
+
+		if err := checkDiskSpace(); err != nil {
+			slog.Error("Refusing received fax", "direction", "inbound", "err", err)
+			recordDeliveryOutcome(true, false, 0)
+			ctx.StatusCode(iris.StatusInsufficientStorage)
 			ctx.JSON(iris.Map{"error": err.Error()})
 			return
 		}
 
-		// Decode the incoming base64-encoded file data (actual PDF data).
-		pdfBytes, err := base64.StdEncoding.DecodeString(fax.FileData)
+		// Read the metadata and stage the document, whichever form it came in.
+		fax, staged, status, err := readReceivedFax(ctx, queueDir)
 		if err != nil {
-			ctx.StatusCode(iris.StatusBadRequest)
-			ctx.JSON(iris.Map{"error": "failed to decode file_data: " + err.Error()})
+			if verifyStreamedSignature(ctx) == errBadSignature {
+				rejectWebhook(ctx, iris.StatusUnauthorized, errBadSignature.Error())
+				return
+			}
+			if errors.Is(err, errChecksumMismatch) {
+				slog.Warn("Refusing received fax", "uuid", fax.UUID, "direction", "inbound", "err", err)
+				ctx.StatusCode(iris.StatusUnprocessableEntity)
+				ctx.JSON(iris.Map{"error": err.Error(), "code": "checksum_mismatch"})
+				return
+			}
+			if status >= iris.StatusInternalServerError {
+				recordDeliveryOutcome(true, false, 0)
+				ctx.StatusCode(status)
+				if errors.Is(err, errConversionFailed) {
+					ctx.JSON(iris.Map{"error": err.Error()})
+				} else {
+					ctx.JSON(iris.Map{"error": "failed to write PDF file: " + err.Error()})
+				}
+				return
+			}
+			rejectWebhook(ctx, status, err.Error())
 			return
 		}
-
-		// hylafaxJobID := generateJobID()
-
-		uuidParts := strings.Split(fax.UUID, "-")
-		if len(uuidParts) == 0 {
-			// handle error: invalid UUID format
+		if err := verifyStreamedSignature(ctx); err != nil {
+			staged.discard()
+			rejectWebhook(ctx, iris.StatusUnauthorized, err.Error())
+			return
 		}
-		baseName := uuidParts[len(uuidParts)-1]
-
-		t := time.Now()
-		fileTimestamp := t.Format("20060102150405")
 
-		// Change the file extension to .pdf even if fax.Filename ends with .tiff.
-		pdfName := "{" + baseName + "}" + fileTimestamp
-		pdfLocalPath := filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, pdfName+".pdf")
-
-		if err := os.MkdirAll(filepath.Dir(pdfLocalPath), 0755); err != nil {
-			ctx.StatusCode(iris.StatusInternalServerError)
-			ctx.JSON(iris.Map{"error": "failed to create local directory: " + err.Error()})
+		// A provider retrying a delivery that timed out sends the same UUID
+		// again; acknowledge it without writing the fax a second time.
+		if id, pending := pendingReceive(fax.UUID); pending && config().ReceiveAsync {
+			staged.discard()
+			slog.Info("Received fax is already being written; skipping redelivery", "uuid", fax.UUID, "direction", "inbound", "tracking_id", id)
+			inboundDuplicatesByUUID.Add(1)
+			ctx.StatusCode(iris.StatusAccepted)
+			ctx.JSON(receiveAccepted{ID: id, StatusURL: "/received/" + id})
 			return
 		}
-		if err := ioutil.WriteFile(pdfLocalPath, pdfBytes, 0644); err != nil {
-			ctx.StatusCode(iris.StatusInternalServerError)
-			ctx.JSON(iris.Map{"error": "failed to write PDF file: " + err.Error()})
+		if inboundStored(fax.UUID) {
+			staged.discard()
+			slog.Info("Received fax was already stored; skipping redelivery", "uuid", fax.UUID, "direction", "inbound")
+			inboundDuplicatesByUUID.Add(1)
+			ctx.StatusCode(iris.StatusOK)
+			ctx.JSON(iris.Map{"duplicate": true, "duplicate_of": fax.UUID})
 			return
 		}
-		log.Printf("Saved PDF file to: %s", pdfLocalPath)
 
-		loc, err := time.LoadLocation("America/Vancouver")
-		if err != nil {
-			log.Fatalf("Failed to load location: %v", err)
-		}
-		recvTime := time.Now().In(loc).Format("01/02/06 15:04")
-
-		// Create a .recv file which will be used to signal fax receiving.
-		recvFilename := pdfName + ".recv"
-		recvLocalPath := filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, recvFilename)
-		recvContent := fmt.Sprintf("%s\n%s\n%s\n%s\n",
-			recvTime,
-			"ttyS0", // Used to correlate sessions.
-			pdfName,
-			fax.CIDNum,
-		)
-		if err := ioutil.WriteFile(recvLocalPath, []byte(recvContent), 0644); err != nil {
-			ctx.StatusCode(iris.StatusInternalServerError)
-			ctx.JSON(iris.Map{"error": "failed to write recv file: " + err.Error()})
+		// The provider can deliver the same fax twice under different UUIDs; acknowledge
+		// the repeat but don't hand it to Synergy a second time.
+		contentHash := staged.sha256
+		if originalUUID, duplicate := inboundDuplicateOf(fax.CIDNum, contentHash); duplicate {
+			staged.discard()
+			slog.Info("Received fax has the same content as an earlier one; skipping queue files", "uuid", fax.UUID,
+				"direction", "inbound", "cidnum", fax.CIDNum, "duplicate_of", originalUUID)
+			recordDuplicateReceive(fax, contentHash, originalUUID)
+			ctx.StatusCode(iris.StatusOK)
+			ctx.JSON(iris.Map{"duplicate": true, "duplicate_of": originalUUID})
 			return
 		}
-		log.Printf("Created recv file: %s", recvLocalPath)
 
-		// Store this received fax in the tracker.
-		/*record := &FaxJobRecord{
-			ReceivedUUID:  fax.UUID,
-			CallUUID:      fax.CallUUID,
-			HylafaxJobID:  hylafaxJobID,
-			PdfPath:       pdfLocalPath,
-			RecvPath:      recvLocalPath,
-			LastStatus:    "received",
-			ReceivedAt:    time.Now(),
-			LastUpdatedAt: time.Now(),
+		// With RECEIVE_ASYNC the staged document is written out in the
+		// background, and the provider gets a status URL to follow it.
+		receivedAt := time.Now()
+		replayed := ctx.GetHeader("X-Replayed") == "true"
+		if t, err := time.Parse(time.RFC3339Nano, ctx.GetHeader("X-Replay-Original-Time")); replayed && err == nil {
+			// A replayed fax is filed under the time it first arrived.
+			receivedAt = t
 		}
-		*/
-		ctx.StatusCode(iris.StatusOK)
+		if !config().ReceiveAsync {
+			result, status, err := storeReceivedFax(fax, staged, receivedAt, replayed)
+			if err != nil {
+				ctx.StatusCode(status)
+				ctx.JSON(iris.Map{"error": err.Error()})
+				return
+			}
+			ctx.JSON(result)
+			return
+		}
+		id := trackReceive(fax.UUID, receivedAt)
+		goSubmit(func() {
+			result, _, err := storeReceivedFax(fax, staged, receivedAt, replayed)
+			finishReceive(id, result, err)
+		})
+		ctx.StatusCode(iris.StatusAccepted)
+		ctx.JSON(receiveAccepted{ID: id, StatusURL: "/received/" + id})
+	}), apiDoc{
+		Summary: "Deliver a received fax as JSON with base64 file_data, a raw application/pdf body with the fields as query parameters, or multipart/form-data; answered 202 with a status URL under RECEIVE_ASYNC, and otherwise 200 with the files written, unless the fax duplicates an earlier one",
+		Request: FaxReceive{},
+		Response: struct {
+			receiveAccepted
+			*receiveResult
+			Duplicate   bool   `json:"duplicate,omitempty"`
+			DuplicateOf string `json:"duplicate_of,omitempty"`
+		}{},
 	})
 
+	documentRoute(app.Get("/received/{id}", requireWebhookAuth("/received", receiveAuth), func(ctx iris.Context) {
+		status, ok := receiveStatus(ctx.Params().Get("id"))
+		if !ok {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "no received fax with that tracking ID"})
+			return
+		}
+		ctx.JSON(status)
+	}), apiDoc{Summary: "Whether a fax accepted with 202 has been written to the queue directory: pending, written or failed, with the error", Response: receivedStatus{}})
+
 	// -----------------------------
 	// NOTIFICATION ENDPOINT
 	// -----------------------------
@@ -311,106 +520,95 @@ func main() {
 	// is updated. Use the CallUUID (or similar unique identifier) to match the notification
 	// to an existing fax record.
 	// In your /fax-notify endpoint, after updating the in-memory records:
-	app.Post("/fax-notify", func(ctx iris.Context) {
+	documentRoute(app.Post("/fax-notify", requireWebhookAuth("/fax-notify", notifyAuth), captureWebhook("fax-notify"), requireWebhookSignature(false), func(ctx iris.Context) {
+		injectNotifyDelay()
+
 		var payload WebhookPayload
 		if err := ctx.ReadJSON(&payload); err != nil {
-			ctx.StatusCode(iris.StatusBadRequest)
-			ctx.JSON(iris.Map{"error": err.Error()})
+			rejectWebhook(ctx, iris.StatusBadRequest, err.Error())
 			return
 		}
 
 		// Process each fax job from the notify payload.
+		processed, ignored := 0, 0
 		for key, job := range payload.FaxJobResults.Results {
+			if notifyResolved(job.UUID) {
+				slog.Debug("Ignoring notify result for a job already completed", "uuid", job.UUID, "result", key, "status", job.Status)
+				notifiesAlreadyProcessed.Add(1)
+				ignored++
+				continue
+			}
+			processed++
 			faxRecordsMutex.Lock()
 			if record, exists := faxRecords[job.UUID]; exists {
-				record.LastStatus = job.Status
-				record.LastUpdatedAt = time.Now()
-				log.Printf("Updated fax job %s: new status %s", key, job.Status)
+				record.setStatus(job.Status, statusSourceNotify, time.Now())
+				slog.Info("Updated fax record", "uuid", job.UUID, "direction", record.Direction, "result", key, "status", job.Status)
 			} else {
-				log.Printf("No record found for fax job with UUID: %s", job.UUID)
+				slog.Debug("No fax record for notify result", "uuid", job.UUID)
 			}
 			faxRecordsMutex.Unlock()
 
-			success := false
-			var jobQq jobQ
+			// Progress updates only refresh the .sts of a job still in flight.
+			mapping := mapNotifyStatus(job)
+			if !mapping.Terminal {
+				updateJobProgress(job, payload.FaxJobResults.FaxJob, mapping)
+				continue
+			}
 
 			// For outbound faxes, check if this notify corresponds to a job in our jobQueue.
-			jobQueue.Lock()
-			for jobUUID, jobQf := range jobQueue.entries {
-				// Assuming that you can correlate based on the fax UUID or CallUUID,
-				// here we check if the notify's UUID matches.
-				if job.UUID == jobUUID { // Adjust matching logic as needed.
-					// Based on the notify result, create .done or .fail.
-					if job.Result.Success {
-						success = true
-						jobQq = jobQf
-
-						// Remove job from queue since we've processed it.
-						delete(jobQueue.entries, jobUUID)
-						break
-					}
-				}
+			jobUUID, jobQq, matchedBy, outbound := takeOutboundJob(job, payload.FaxJobResults.FaxJob)
+			if mapping.unmapped {
+				recordProviderError(jobQq.route, job.Result.ResultText, job.UUID)
 			}
-			if success {
-				log.Printf("Notify indicates fax completed for job %s", job.UUID)
-				createStsFile(jobQq.hylaJobID, "7", "0", "0", "success")
-				createFile(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, fmt.Sprintf("q%s.done", jobQq.hylaJobID)), "\r")
-				os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, jobQq.sfcPath))
-				os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, jobQq.pdfPath))
-			} else {
-				log.Printf("Notify indicates fax failed for job %s", job.UUID)
-				createStsFile(jobQq.hylaJobID, "3", "0", "0", "failed")
-				createFile(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, fmt.Sprintf("q%s.fail", jobQq.hylaJobID)), "\r")
-				os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, jobQq.sfcPath))
-				os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, jobQq.pdfPath))
+			if !outbound {
+				if !isInboundFax(job.UUID) {
+					// The submission may not have registered the job yet.
+					bufferNotify(job, payload.FaxJobResults.FaxJob)
+				}
+				continue
 			}
-
-			jobQueue.Unlock()
+			slog.Info("Notify result matched fax job", "uuid", job.UUID, "call_uuid", job.CallUUID,
+				"job_uuid", jobUUID, "job_id", jobQq.hylaJobID, "direction", "outbound", "matched_by", matchedBy)
+			completeOutboundJob(jobQq, job, statusSourceNotify)
 		}
 
 		// Also update the overall FaxJob status if present.
 		overall := payload.FaxJobResults.FaxJob
 		faxRecordsMutex.Lock()
-		if record, exists := faxRecords[overall.CallUUID]; exists {
-			record.LastStatus = overall.Status
-			record.LastUpdatedAt = time.Now()
-			log.Printf("Updated overall fax job with CallUUID %s: new status %s", overall.CallUUID, overall.Status)
+		if record, exists := faxRecords[overall.CallUUID]; exists && (processed > 0 || ignored == 0) {
+			record.setStatus(overall.Status, statusSourceNotify, time.Now())
+			slog.Info("Updated fax record from overall fax job", "call_uuid", overall.CallUUID, "status", overall.Status)
 		}
 		faxRecordsMutex.Unlock()
+		saveState()
 
 		ctx.StatusCode(iris.StatusOK)
+		if ignored > 0 && processed == 0 {
+			ctx.JSON(iris.Map{"already_processed": true})
+		}
+	}), apiDoc{
+		Summary: "Report the result of an outbound fax; results for a job already completed are ignored, and a payload of only those is answered with already_processed",
+		Request: WebhookPayload{},
+		Response: struct {
+			AlreadyProcessed bool `json:"already_processed"`
+		}{},
 	})
 
-	go watchFaxFolder(os.Getenv("FTP_ROOT") + FaxDir)
-
-	app.Listen(":8080")
-	select {
-	case sig := <-sigchan:
-		fmt.Print("Received ", sig, ", killing all channels")
-		time.Sleep(3 * time.Second)
-		//logger.Logger.Print("Terminating")
-		os.Exit(0)
-	}
 }
 
+// createStsFile writes the state and status lines of q<jobID>.sts. An empty
+// npages or totpages keeps the value already in the file, 0 for a new one.
 func createStsFile(jobID, state, npages, totpages, status string) error {
-	stsFilePath := filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, fmt.Sprintf("q%s.sts", jobID))
-
-	// Open (or create) the file in read-write mode.
-	file, err := os.OpenFile(stsFilePath, os.O_RDWR|os.O_CREATE, 0660)
-	if err != nil {
-		return fmt.Errorf("error opening .sts file: %w", err)
-	}
-	defer file.Close()
+	stsFilePath := jobFile(jobID, fmt.Sprintf("q%s.sts", jobID))
 
-	// Read current file contents.
-	content, err := ioutil.ReadAll(file)
-	if err != nil {
+	// Read the current contents, if any; the update is written atomically.
+	content, err := os.ReadFile(stsFilePath)
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("error reading .sts file: %w", err)
 	}
 
 	// Split the file content into lines.
-	lines := strings.Split(string(content), "\n")
+	lines := stsLines(content)
 
 	// We'll update the known keys and mark which ones we've seen.
 	keysFound := map[string]bool{
@@ -426,10 +624,14 @@ func createStsFile(jobID, state, npages, totpages, status string) error {
 			lines[i] = "state:" + state
 			keysFound["state"] = true
 		} else if strings.HasPrefix(line, "npages:") {
-			lines[i] = "npages:" + npages
+			if npages != "" {
+				lines[i] = "npages:" + npages
+			}
 			keysFound["npages"] = true
 		} else if strings.HasPrefix(line, "totpages:") {
-			lines[i] = "totpages:" + totpages
+			if totpages != "" {
+				lines[i] = "totpages:" + totpages
+			}
 			keysFound["totpages"] = true
 		} else if strings.HasPrefix(line, "status:") {
 			lines[i] = "status:" + status
@@ -442,10 +644,10 @@ func createStsFile(jobID, state, npages, totpages, status string) error {
 		lines = append(lines, "state:"+state)
 	}
 	if !keysFound["npages"] {
-		lines = append(lines, "npages:"+npages)
+		lines = append(lines, "npages:"+cmp.Or(npages, "0"))
 	}
 	if !keysFound["totpages"] {
-		lines = append(lines, "totpages:"+totpages)
+		lines = append(lines, "totpages:"+cmp.Or(totpages, "0"))
 	}
 	if !keysFound["status"] {
 		lines = append(lines, "status:"+status)
@@ -453,54 +655,160 @@ func createStsFile(jobID, state, npages, totpages, status string) error {
 
 	newContent := strings.Join(lines, "\n")
 
-	// Seek to the beginning and truncate the file.
-	if _, err := file.Seek(0, 0); err != nil {
-		return fmt.Errorf("error seeking in .sts file: %w", err)
-	}
-	if err := file.Truncate(0); err != nil {
-		return fmt.Errorf("error truncating .sts file: %w", err)
+	if err := writeQueueFile(stsFilePath, []byte(newContent), 0660); err != nil {
+		return fmt.Errorf("error writing .sts file: %w", err)
 	}
 
-	// Write the updated content back to the file.
-	if _, err := file.WriteString(newContent); err != nil {
-		return fmt.Errorf("error writing to .sts file: %w", err)
+	slog.Debug(".sts file updated", "job_id", jobID, "file", stsFilePath, "state", state, "status", status)
+	noteJobStatus(jobID, status, statusSourceSts)
+	return nil
+}
+
+// setStsLines sets further key:value lines of q<jobID>.sts, such as the dial
+// counts, leaving the others as they are. kv holds keys and values in turn.
+func setStsLines(jobID string, kv ...string) error {
+	stsFilePath := jobFile(jobID, fmt.Sprintf("q%s.sts", jobID))
+	content, err := os.ReadFile(stsFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading .sts file: %w", err)
 	}
-	if err := file.Sync(); err != nil {
-		return fmt.Errorf("error syncing .sts file: %w", err)
+	lines := stsLines(content)
+	for i := 0; i+1 < len(kv); i += 2 {
+		line, found := kv[i]+":"+kv[i+1], false
+		for j := range lines {
+			if strings.HasPrefix(lines[j], kv[i]+":") {
+				lines[j], found = line, true
+			}
+		}
+		if !found {
+			lines = append(lines, line)
+		}
+	}
+	if err := writeQueueFile(stsFilePath, []byte(strings.Join(lines, "\n")), 0660); err != nil {
+		return fmt.Errorf("error writing .sts file: %w", err)
 	}
-
-	log.Printf(".sts file updated: %s", stsFilePath)
 	return nil
 }
 
-func watchFaxFolder(dir string) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("Error creating watcher: %v", err)
-	}
-	defer watcher.Close()
+// queueFile returns the path of a file in the fax queue directory.
+func queueFile(name string) string {
+	return filepath.Join(config().FTPRoot+FaxDir, name)
+}
 
-	err = watcher.Add(dir)
-	if err != nil {
-		log.Fatalf("Error adding directory to watcher: %v", err)
+// failJob reports a job to Synergy as failed: the .sts file gets the failed
+// state with status as its status line, q<jobid>.info records why,
+// q<jobid>.fail is created, and the job's files are removed. A failed job
+// never gets a .done file.
+func failJob(hylaJobID, status string, paths ...string) {
+	if err := createStsFile(hylaJobID, stsStateFailed, "", "", status); err != nil {
+		slog.Error("Error updating .sts for failed job", "job_id", hylaJobID, "err", err)
+	}
+	number := sfcNumber(paths)
+	defer recordFailedJobHistory(hylaJobID, status, number)()
+	updateFailureInfo(hylaJobID, func(info *failureInfo) {
+		info.Status = status
+		info.Number = cmp.Or(number, info.Number)
+		info.Error = cmp.Or(info.Error, status)
+	})
+	if err := createFile(jobFile(hylaJobID, fmt.Sprintf("q%s.fail", hylaJobID)), "\r"); err != nil {
+		slog.Error("Error creating .fail", "job_id", hylaJobID, "err", err)
+	}
+	for _, path := range paths {
+		if path != "" {
+			os.Remove(path)
+		}
 	}
+}
 
-	log.Printf("Watching directory: %s", dir)
+// watchFaxFolder handles the events of the queue directories, or polls them
+// as WATCH_MODE says, until ctx is cancelled. The first is the default queue
+// directory; prepareQueueDirs has created them all.
+func watchFaxFolder(ctx context.Context, dirs []string) {
+	mode := config().WatchMode
+
+	// events and watchErrors stay nil while polling.
+	var watcher *fsnotify.Watcher
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if mode != watchPoll {
+		var err error
+		watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			fatal("Error creating watcher", "err", err)
+		}
+		defer func() {
+			if watcher != nil {
+				watcher.Close()
+			}
+		}()
+		for _, dir := range dirs {
+			if err := watcher.Add(dir); err != nil {
+				fatal("Error adding directory to watcher", "file", dir, "err", err)
+			}
+		}
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+	for _, dir := range dirs {
+		slog.Info("Watching queue directory", "file", dir, "mode", mode)
+	}
+	queueWatcherAlive.Store(true)
+	defer queueWatcherAlive.Store(false)
 
+	settler := newFileSettler(ctx, config().FileSettleTime)
+	for _, dir := range dirs {
+		scanQueueDir(dir, settler)
+	}
+	var poller *queuePoller
+	var polls <-chan time.Time
+	if mode != watchFsnotify {
+		poller = newQueuePoller(dirs, settler)
+		ticker := time.NewTicker(config().WatchPollInterval)
+		defer ticker.Stop()
+		polls = ticker.C
+	}
 	for {
 		select {
-		case event, ok := <-watcher.Events:
+		case <-ctx.Done():
+			slog.Info("Stopped watching queue directories", "dirs", len(dirs))
+			return
+		case event, ok := <-events:
 			if !ok {
 				return
 			}
+			if isQueueTempFile(event.Name) {
+				continue
+			}
 			if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
-				processFile(event.Name)
+				if poller != nil {
+					poller.eventFor(event.Name)
+				}
+				settler.changed(event.Name)
+			} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				settler.forget(event.Name)
+				fileRemoved(event.Name)
+			}
+		case <-polls:
+			if watcher == nil {
+				poller.poll()
+			} else if poller.probe() {
+				slog.Warn("Queue files arrived without file events; switching to polling", "interval", config().WatchPollInterval)
+				watcher.Close()
+				watcher, events, watchErrors = nil, nil, nil
+				poller.takeOver()
+			}
+		case path := <-settler.ready:
+			processFile(path)
+		case path := <-completedUploads:
+			settler.forget(path)
+			if poller != nil {
+				poller.uploaded(path)
 			}
-		case err, ok := <-watcher.Errors:
+			processFile(path)
+		case err, ok := <-watchErrors:
 			if !ok {
 				return
 			}
-			log.Printf("Watcher error: %v", err)
+			slog.Error("Watcher error", "err", err)
 		}
 	}
 }
@@ -510,188 +818,773 @@ func processFile(filePath string) {
 	switch ext {
 	case ".sfc":
 		handleSfcFile(filePath)
+	case ".pdf":
+		handlePdfFile(filePath)
 	case ".cmd":
-		log.Printf("removing .cmd file: %s", filePath)
+		slog.Info("Removing .cmd file", "file", filePath)
 		os.Remove(filePath)
+	case ".kill":
+		handleKillFile(filePath)
+	}
+}
+
+// fileRemoved handles a queue file that was removed or renamed away.
+func fileRemoved(filePath string) {
+	if strings.EqualFold(filepath.Ext(filePath), ".sfc") {
+		sfcRemoved(filePath)
 	}
 }
 
 func handleSfcFile(filePath string) {
 	content, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Printf("Error reading SFC file: %v", err)
+		slog.Error("Error reading SFC file", "file", filePath, "err", err)
 		return
 	}
-	log.Printf("SFC Content: %s", string(content))
+	slog.Debug("SFC content", "file", filePath, "content", string(content))
 
-	lines := strings.Split(string(content), "\n")
-	if len(lines) < 2 {
-		log.Printf("Invalid SFC file format (len = %d): %s - content: %s", len(lines), filePath, string(content))
+	job, err := parseSfcFile(filePath, string(content))
+	if err != nil {
+		slog.Error("Invalid SFC file", "file", filePath, "err", err)
+		slog.Debug("Invalid SFC content", "file", filePath, "content", string(content))
 		return
 	}
+	pdfFile := job.PdfFile
+	logArgs := []any{"file", filePath, "number", job.FaxNumber, "pdf", pdfFile, "user", job.User}
+	if job.CallerID != "" {
+		logArgs = append(logArgs, "cidnum", job.CallerID)
+	}
+	if job.Priority != defaultSfcPriority {
+		logArgs = append(logArgs, "priority", job.Priority)
+	}
+	if !job.NotBefore.IsZero() {
+		logArgs = append(logArgs, "not_before", job.NotBefore.Format(time.RFC3339))
+	}
+	slog.Info("SFC file processed", logArgs...)
 
-	faxNumber := strings.ReplaceAll(lines[0], "\r", "")
-	pdfFile := strings.ReplaceAll(lines[1], "\r", "")
-	log.Printf("SFC file processed: FaxNumber=%s, PDFFile=%s", faxNumber, pdfFile)
+	entry := sfcFile{
+		SfcJob:   job,
+		jobID:    strings.TrimSuffix(filepath.Base(filePath), ".sfc"),
+		sfcFile:  filePath,
+		uploader: takeUploader(filePath),
+	}
+	if entry.User == "" && entry.uploader != "" {
+		// Without a user: line, quotas, SLAs and records go by the FTP user.
+		entry.User = entry.uploader
+		slog.Debug("Attributing fax to its FTP user", "file", filePath, "user", entry.User)
+	}
 
+	sfcFileName := filepath.Base(filePath)
 	cache.Lock()
-	defer cache.Unlock()
-	fax, err := submitFax(faxNumber, pdfFile, filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, pdfFile), filepath.Base(filePath))
-	if err != nil {
-		log.Printf("Unable to send fax: %s", err)
-		return
+	if cache.inFlight[sfcFileName] {
+		cache.Unlock()
+		return // repeated event for a job already being handled
+	}
+	if prev, waiting := cache.sfc[pdfFile]; waiting && prev.sfcFile == filePath {
+		entry.hylaJobID = prev.hylaJobID
+	} else {
+		// Reserve the .sfc while its job ID and queue files are written
+		// without the lock; repeated events skip it meanwhile.
+		cache.inFlight[sfcFileName] = true
+		cache.Unlock()
+		accepted := acceptSfc(&entry)
+		cache.Lock()
+		delete(cache.inFlight, sfcFileName)
+		if !accepted {
+			cache.Unlock()
+			return
+		}
+		if !fileExists(filePath) {
+			// Synergy removed the .sfc before the job could be published.
+			cache.Unlock()
+			slog.Info(".sfc was removed while it was accepted; cancelling it", "job_id", entry.hylaJobID, "file", filePath)
+			recordCancelledJob(entry.hylaJobID, synergyCancelReason)
+			return
+		}
 	}
-	cache.sfc[fax] = sfcFile{
-		jobID:     fax,
-		sfcFile:   filePath,
-		pdfFile:   pdfFile,
-		faxNumber: faxNumber,
+	// Synergy may upload the PDF after the .sfc; wait for it if it isn't there yet.
+	if _, cached := cache.pdf[pdfFile]; !cached {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(filePath), pdfFile)); err != nil {
+			slog.Info("Waiting for PDF", "file", filePath, "pdf", pdfFile)
+			entry.cachedAt = time.Now()
+			cache.sfc[pdfFile] = entry
+			putHold(heldJob{
+				Component: holdPdfWait,
+				ID:        pdfFile,
+				HylaJobID: entry.hylaJobID,
+				SfcPath:   filePath,
+				Reason:    "waiting for " + pdfFile,
+				Release:   "upload of " + pdfFile,
+			}, nil)
+			cache.Unlock()
+			return
+		}
 	}
+	delete(cache.pdf, pdfFile)
+	if _, waiting := cache.sfc[pdfFile]; waiting {
+		delete(cache.sfc, pdfFile)
+		releaseHold(holdPdfWait, pdfFile)
+	}
+	cache.inFlight[sfcFileName] = true
+	cache.Unlock()
+	captureJobFiles(filePath, filepath.Join(filepath.Dir(filePath), pdfFile))
+	queueOutbound(entry)
+}
+
+// handlePdfFile submits the .sfc waiting for this PDF, or remembers the PDF
+// until its .sfc arrives.
+func handlePdfFile(filePath string) {
+	pdfFile := filepath.Base(filePath)
+	if _, err := os.Stat(filePath); err != nil {
+		return // already submitted and removed
+	}
+	if fileExists(strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".recv") {
+		return // a received fax, not a document to send
+	}
+
+	cache.Lock()
+	entry, ok := cache.sfc[pdfFile]
+	if !ok {
+		cache.pdf[pdfFile] = cachedPdf{path: filePath, cachedAt: time.Now()}
+		cache.Unlock()
+		return
+	}
+	delete(cache.sfc, pdfFile)
+	releaseHold(holdPdfWait, pdfFile)
+	cache.inFlight[filepath.Base(entry.sfcFile)] = true
+	cache.Unlock()
+	slog.Info("PDF arrived", "file", entry.sfcFile, "pdf", pdfFile)
+	captureJobFiles(entry.sfcFile, filePath)
+	queueOutbound(entry)
+}
+
+// releaseInFlight allows events for the .sfc to be handled again.
+func releaseInFlight(sfcFileName string) {
+	cache.Lock()
+	delete(cache.inFlight, sfcFileName)
+	cache.Unlock()
 }
 
 // OutboundResponse represents the expected JSON response structure from the PUT request.
 type OutboundResponse struct {
-	JobUUID string `json:"job_uuid"`
-	Message string `json:"message"`
+	JobUUID  string `json:"job_uuid"`
+	FaxUUID  string `json:"uuid"`      // optional: UUID of the fax itself, when it differs from the job
+	CallUUID string `json:"call_uuid"` // optional: call the fax is sent on, if already known
+	Message  string `json:"message"`
 }
 
 // submitFax sends the fax via an HTTP POST multipart/form-data request and returns the submitted job UUID.
 // If the POST fails (or returns a non-200 response), a .fail file is created immediately.
-func submitFax(faxNumber, pdfFile, pdfPath, sfcFileName string) (string, error) {
-	jobID := strings.TrimSuffix(sfcFileName, ".sfc")
-	hylaJobID := generateJobID() // e.g. "12345678"
-
-	// Create a .jobid file with the generated Hylafax job ID.
-	err := createFile(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, fmt.Sprintf("%s.jobid", jobID)), hylaJobID+"\r")
-	if err != nil {
-		log.Printf("Error creating .jobid file: %v", err)
-		// Continue even if file creation fails.
+// The job's Hylafax job ID was issued when it was queued.
+func submitFax(job SfcJob, pdfPath, sfcFileName, jobID, hylaJobID string) (string, error) {
+	// SLA timing starts when Synergy wrote the .sfc file.
+	uploadedAt := time.Now()
+	if info, err := os.Stat(jobFile(hylaJobID, sfcFileName)); err == nil {
+		uploadedAt = info.ModTime()
 	}
+	slaJobUploaded(hylaJobID, job.User, uploadedAt)
 
-	fileData, err := os.ReadFile(pdfPath)
+	// Numbers that cannot be dialled fail before anything is submitted.
+	number, err := normalizeDestinations(job.FaxNumber)
 	if err != nil {
-		log.Printf("Error reading PDF file: %v", err)
+		slog.Warn("Fax number rejected", "job_id", hylaJobID, "number", job.FaxNumber, "err", err)
+		slaJobCompleted(hylaJobID, false)
+		failJob(hylaJobID, "failed: invalid fax number "+err.Error(), jobFile(hylaJobID, sfcFileName), jobFile(hylaJobID, job.PdfFile))
 		return "", err
 	}
+	if number != job.FaxNumber {
+		slog.Debug("Fax number normalized", "job_id", hylaJobID, "number", number)
+		job.FaxNumber = number
+	}
 
-	// Build the multipart form data.
-	var b bytes.Buffer
-	writer := multipart.NewWriter(&b)
-	// Write form fields.
-	if err := writer.WriteField("callee_number", faxNumber); err != nil {
-		return "", err
+	// Destinations the outbound rules forbid fail before submission.
+	if blocked, rule := checkDestinations(job.FaxNumber); blocked != "" {
+		faxesBlocked.Add(1)
+		slog.Warn("Fax destination blocked by policy", "job_id", hylaJobID, "number", blocked, "rule", rule, "user", job.User)
+		emitSecurityEvent(SecurityEvent{Type: secEventDestinationBlocked, Actor: job.User, Target: hylaJobID, Outcome: "denied", Detail: rule})
+		slaJobExcluded(hylaJobID, "policy")
+		slaJobCompleted(hylaJobID, false)
+		failJob(hylaJobID, "destination blocked by policy", jobFile(hylaJobID, sfcFileName), jobFile(hylaJobID, job.PdfFile))
+		return "", errDestinationBlocked
+	}
+
+	// Jobs with a send-after time wait in the scheduler.
+	if time.Now().Before(job.NotBefore) {
+		slaJobExcluded(hylaJobID, "scheduled")
+		scheduleFax(scheduledFax{HylaJobID: hylaJobID, JobID: jobID, Sfc: job, PdfPath: pdfPath, SfcFileName: sfcFileName})
+		return "", errScheduled
 	}
-	if err := writer.WriteField("caller_number", os.Getenv("FAX_NUMBER")); err != nil {
+	return dispatchFax(job, pdfPath, sfcFileName, jobID, hylaJobID)
+}
+
+// dispatchFax applies the user quota and approval to a job that has its
+// Hylafax job ID, and submits it if neither holds it back.
+func dispatchFax(job SfcJob, pdfPath, sfcFileName, jobID, hylaJobID string) (string, error) {
+	faxNumber, pdfFile, user := job.FaxNumber, job.PdfFile, job.User
+
+	// Refuse a job already over the originating user's daily quota before
+	// it waits for approval; deliverFax reserves the quota when it submits.
+	if err := checkUserQuota(user, countFilePages(pdfPath)); err != nil {
+		slog.Warn("Fax rejected by user quota", "job_id", hylaJobID, "user", user, "err", err)
+		slaJobExcluded(hylaJobID, "quota")
+		slaJobCompleted(hylaJobID, false)
+		failJob(hylaJobID, "failed: "+err.Error(), jobFile(hylaJobID, sfcFileName), jobFile(hylaJobID, pdfFile))
 		return "", err
 	}
-	// Create the file field.
-	part, err := writer.CreateFormFile("file", pdfFile)
+
+	// Supervised queues hold the job until it is approved.
+	if holdForApproval(pendingApproval{
+		HylaJobID:   hylaJobID,
+		JobID:       jobID,
+		FaxNumber:   faxNumber,
+		PdfFile:     pdfFile,
+		PdfPath:     pdfPath,
+		SfcFileName: sfcFileName,
+		User:        user,
+		CallerID:    job.CallerID,
+	}) {
+		slaJobExcluded(hylaJobID, "approval")
+		return "", errAwaitingApproval
+	}
+
+	return deliverFax(faxNumber, job.CallerID, pdfFile, pdfPath, sfcFileName, user, jobID, hylaJobID, 1, 0)
+}
+
+// errFaxTooLarge is returned for an outbound document over MAX_FAX_SIZE_MB.
+var errFaxTooLarge = errors.New("document exceeds MAX_FAX_SIZE_MB")
+
+// readFaxDocument reads an outbound document. One over MAX_FAX_SIZE_MB is
+// refused without being read into memory, as is anything but a PDF or TIFF.
+func readFaxDocument(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	max := config().maxFaxBytes
+	info, err := f.Stat()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if _, err := part.Write(fileData); err != nil {
-		return "", err
+	if info.Size() > max {
+		return nil, fmt.Errorf("%w: %s is %d bytes", errFaxTooLarge, filepath.Base(path), info.Size())
+	}
+	data, err := io.ReadAll(io.LimitReader(f, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%w: %s grew while being read", errFaxTooLarge, filepath.Base(path))
+	}
+
+	// Only PDFs and TIFFs are sent, converted to OUTBOUND_FORMAT where a
+	// converter is set.
+	contentType, err := checkDocumentType(data)
+	if err != nil {
+		return nil, err
+	}
+	return convertOutbound(path, contentType, data)
+}
+
+// documentErrorStatus is the .sts status for a document that could not be read.
+func documentErrorStatus(err error) string {
+	switch {
+	case errors.Is(err, errFaxTooLarge):
+		return "failed: document exceeds MAX_FAX_SIZE_MB"
+	case errors.Is(err, errNotPDF), errors.Is(err, errConversionFailed):
+		return "failed: " + err.Error()
 	}
-	writer.Close()
+	return "failed: unable to read document"
+}
+
+// deliverFax performs the webhook submission for an accepted job. callerID
+// replaces FAX_NUMBER as the caller number when set. dial counts from 1, and
+// tries are the transmission attempts of earlier dials; see redial.go.
+func deliverFax(faxNumber, callerID, pdfFile, pdfPath, sfcFileName, user, jobID, hylaJobID string, dial, tries int) (jobUUID string, err error) {
+	if numbers := splitFaxNumbers(faxNumber); len(numbers) > 1 {
+		return deliverBroadcast(numbers, callerID, pdfFile, pdfPath, sfcFileName, user, jobID, hylaJobID)
+	}
+
+	ctx := startJobContext(hylaJobID)
+	defer endJobContext(hylaJobID)
+	defer func() {
+		if err != nil && !errors.Is(err, errJobCancelled) {
+			slaJobCompleted(hylaJobID, false)
+			if !errors.Is(err, errOverQuota) {
+				recordDeliveryOutcome(false, false, 0)
+			}
+		}
+	}()
 
-	// Construct the POST request URL (no query parameters needed now).
-	postURL := os.Getenv("SEND_WEBHOOK_URL")
-	req, err := http.NewRequest("POST", postURL, &b)
+	fileData, err := readFaxDocument(pdfPath)
 	if err != nil {
-		createFile(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, fmt.Sprintf("q%s.fail", hylaJobID)), "\r")
-		log.Printf("Error creating POST request: %v", err)
+		slog.Error("Error reading PDF file", "job_id", hylaJobID, "file", pdfPath, "err", err)
+		deadLetterJob(hylaJobID, documentErrorStatus(err), err.Error(), jobFile(hylaJobID, sfcFileName), jobFile(hylaJobID, pdfFile))
 		return "", err
 	}
-	// Set Basic Auth using credentials from environment variables.
-	req.SetBasicAuth(os.Getenv("SEND_WEBHOOK_USERNAME"), os.Getenv("SEND_WEBHOOK_PASSWORD"))
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	pages := countDocumentPages(fileData)
+
+	// A redial was counted against the quota with its first dial.
+	var reservation quotaReservation
+	if dial <= 1 {
+		if reservation, err = reserveUserQuota(user, pages); err != nil {
+			slog.Warn("Fax rejected by user quota", "job_id", hylaJobID, "user", user, "err", err)
+			slaJobExcluded(hylaJobID, "quota")
+			failJob(hylaJobID, "failed: "+err.Error(), jobFile(hylaJobID, sfcFileName), jobFile(hylaJobID, pdfFile))
+			return "", err
+		}
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	sub, status, err := postFaxSubmission(ctx, faxNumber, callerID, pdfFile, pdfPath, hylaJobID, fileData)
+	if err != nil {
+		reservation.release()
+	}
+	if errors.Is(err, errJobCancelled) {
+		return "", cancelledJob(ctx, hylaJobID, sfcFileName, pdfFile)
+	}
 	if err != nil {
-		log.Printf("Error sending POST request: %v \n %s", err, req.Body)
-		// Create the .fail file immediately if the send fails.
-		createFile(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, fmt.Sprintf("q%s.fail", hylaJobID)), "\r")
-		os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, sfcFileName))
-		os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, pdfFile))
+		if status != "" {
+			deadLetterJob(hylaJobID, status, err.Error(), jobFile(hylaJobID, sfcFileName), jobFile(hylaJobID, pdfFile))
+		}
 		return "", err
 	}
-	defer resp.Body.Close()
+
+	// A cancel that came while the provider was accepting the job is passed
+	// on to it, and the job's submitted side effects are skipped.
+	job := jobQ{
+		pdfPath:      pdfPath,
+		sfcPath:      jobFile(hylaJobID, sfcFileName),
+		user:         user,
+		partFilename: sub.partFilename,
+		partType:     sub.partType,
+		credential:   sub.credential,
+		route:        sub.route,
+		pages:        pages,
+		dials:        dial,
+		tries:        tries,
+		faxUUID:      sub.resp.FaxUUID,
+		callUUID:     sub.resp.CallUUID,
+		hylaJobID:    hylaJobID,
+	}
+	if cancelRequested(ctx) {
+		reason := cancelReason(ctx)
+		err := errors.New("SEND_CANCEL_URL is not set")
+		if config().SendCancelURL != "" {
+			err = requestProviderCancel(sub.resp.JobUUID, job)
+		}
+		if err == nil {
+			reservation.release()
+			markNotifyResolved(sub.resp.JobUUID)
+			slog.Info("Fax job cancelled as the provider accepted it", "job_id", hylaJobID, "uuid", sub.resp.JobUUID, "reason", reason)
+			recordCancelledJob(hylaJobID, reason, job.sfcPath, jobFile(hylaJobID, pdfFile))
+			return "", errJobCancelled
+		}
+		slog.Warn("The provider accepted the fax job as it was cancelled and did not cancel it; it carries on",
+			"job_id", hylaJobID, "uuid", sub.resp.JobUUID, "err", err)
+		noteJobStatus(hylaJobID, "cancel not accepted: "+err.Error(), statusSourceManual)
+	}
 
 	// Create a .sts file to indicate the fax has been sent.
-	if err := createStsFile(hylaJobID, "3", "0", "0", "Sent to WebHook"); err != nil {
-		return "", err
+	if err := createStsFile(hylaJobID, stsStateSleeping, "", pagesField(pages), "Sent to WebHook"); err != nil {
+		slog.Error("Error updating .sts", "job_id", hylaJobID, "err", err)
+	}
+	writeStsDials(hylaJobID, dial, tries)
+
+	// For outbound faxes, add the job to the queue for later notify updates.
+	addFaxJob(sub.resp.JobUUID, jobID, hylaJobID, job)
+	if dial <= 1 {
+		slaJobSubmitted(hylaJobID)
+	}
+	slog.Info("Fax submitted successfully", "job_id", hylaJobID, "synergy_job_id", jobID, "uuid", sub.resp.JobUUID,
+		"direction", "outbound", "number", faxNumber, "file", pdfPath, "user", user, "dial", dial)
+
+	// The .sfc and PDF stay until the result arrives; see cleanUpSentJob.
+	return sub.resp.JobUUID, nil
+}
+
+// faxSubmission is a document the send webhook accepted for one destination.
+type faxSubmission struct {
+	resp         OutboundResponse
+	partFilename string
+	partType     string
+	credential   string
+	route        string
+}
+
+// postFaxSubmission submits the document for one destination to the send
+// webhook of its route, in its protocol, retrying transient failures. An empty callerID sends
+// the route's caller number, or FAX_NUMBER. It does not touch the job's queue
+// files other than the "retrying" .sts; on failure it returns the status to
+// record, which is empty when the form itself could not be built, and
+// errJobCancelled when ctx was cancelled.
+func postFaxSubmission(ctx context.Context, faxNumber, callerID, pdfFile, pdfPath, hylaJobID string, fileData []byte) (faxSubmission, string, error) {
+	route, prefix := routeFor(faxNumber)
+	dir := queueDirFor(jobDir(hylaJobID))
+	if dir.Route != "" {
+		if r, ok := routeNamed(dir.Route); ok {
+			route, prefix = r, ""
+		}
+	}
+	sub := faxSubmission{route: route.Name}
+
+	if callerID == "" {
+		callerID = dir.FaxNumber
+	}
+	if callerID == "" {
+		callerID = route.CallerNumber
+	}
+	if callerID == "" {
+		callerID = config().FaxNumber
+	}
+	protocol := cmp.Or(route.Protocol, config().SendProtocol)
+	sr, err := submitterFor(protocol).encode(route.URL, submitForm{
+		calleeNumber: faxNumber,
+		callerNumber: callerID,
+		pdfFile:      pdfFile,
+		hylaJobID:    hylaJobID,
+		data:         fileData,
+	})
+	if err != nil {
+		return sub, "", err
 	}
+	sub.partFilename, sub.partType = sr.partFilename, sr.partType
+	slog.Info("Submitting fax", "job_id", hylaJobID, "file", pdfPath, "part_filename", sub.partFilename, "part_type", sub.partType,
+		"route", route.Name, "route_prefix", prefix, "protocol", protocol)
+
+	body := sr.body
+	if jobCancelled(ctx) {
+		return sub, "", errJobCancelled
+	}
+	req, err := http.NewRequestWithContext(ctx, sr.method, sr.url, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Error creating send webhook request", "job_id", hylaJobID, "err", err)
+		return sub, "failed: invalid send webhook URL", err
+	}
+	req.Header.Set("Content-Type", sr.contentType)
+
+	// The default route's Basic Auth uses the primary webhook credential, falling back to the secondary during a rotation.
+	// Transient failures are retried with exponential backoff.
+	client := &http.Client{Transport: submitTransport(), Timeout: config().SendWebhookTimeout}
+	attempts := config().SendWebhookRetries
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		if err := waitOutboundRate(ctx, hylaJobID); err != nil {
+			return sub, "", err
+		}
+		attemptReq := req.Clone(ctx)
+		attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+		resp, sub.credential, err = route.do(client, attemptReq, body, hylaJobID)
+		if err != nil && jobCancelled(ctx) {
+			return sub, "", errJobCancelled
+		}
+		if attempt >= attempts || !retryableSubmit(resp, err) {
+			break
+		}
+
+		var reason string
+		delay := sendWebhookBackoff(attempt)
+		status := fmt.Sprintf("retrying (%d/%d)", attempt+1, attempts)
+		if err != nil {
+			reason = err.Error()
+			if errors.Is(err, errTokenFetch) {
+				status = errTokenFetch.Error() + ", " + status
+			}
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			// Honour the wait the webhook asks for; a 429 holds back every submission.
+			if d, ok := retryAfter(resp, time.Now()); ok {
+				delay = d
+				if resp.StatusCode == http.StatusTooManyRequests {
+					outboundLimiter.holdOff(time.Now().Add(d))
+				}
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				status = "rate limited by provider, " + status
+			}
+		}
+		slog.Warn("Submission attempt failed; retrying", "job_id", hylaJobID, "attempt", attempt, "attempts", attempts, "reason", reason, "delay", delay)
+		createStsFile(hylaJobID, stsStateSleeping, "", "", status)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return sub, "", errJobCancelled
+		}
+	}
+	if errors.Is(err, errTokenFetch) {
+		return sub, "failed: " + errTokenFetch.Error(), err
+	}
+	if err != nil && isTLSHandshakeError(err) {
+		slog.Error("TLS handshake with the send webhook failed", "job_id", hylaJobID, "err", err)
+		return sub, "failed: TLS handshake with send webhook failed", err
+	}
+	if err != nil {
+		slog.Error("Error sending to the send webhook", "job_id", hylaJobID, "err", err)
+		return sub, "failed: send webhook unreachable", err
+	}
+	defer resp.Body.Close()
 
 	// Read and decode the response.
 	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil && jobCancelled(ctx) {
+		return sub, "", errJobCancelled
+	}
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return "", err
+		slog.Error("Error reading send webhook response", "job_id", hylaJobID, "err", err)
+		return sub, "failed: unreadable send webhook response", err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("POST request failed with status: %s \n %s", resp.Status, bodyBytes)
-		createFile(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, fmt.Sprintf("q%s.fail", hylaJobID)), "\r")
-		os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, sfcFileName))
-		os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, pdfFile))
-		return "", fmt.Errorf("fax submission failed with status: %s", resp.Status)
-	}
-	var outResp OutboundResponse
-	if err := json.Unmarshal(bodyBytes, &outResp); err != nil {
-		log.Printf("Error decoding response JSON: %v \n %s", err, bodyBytes)
-		return "", err
+		slog.Error("Send webhook rejected the fax", "job_id", hylaJobID, "status", resp.Status)
+		slog.Debug("Send webhook response", "job_id", hylaJobID, "body", string(bodyBytes))
+		return sub, "failed: send webhook returned " + resp.Status, fmt.Errorf("fax submission failed with status: %s", resp.Status)
 	}
+	if err := json.Unmarshal(bodyBytes, &sub.resp); err != nil {
+		slog.Error("Error decoding send webhook response", "job_id", hylaJobID, "err", err)
+		slog.Debug("Send webhook response", "job_id", hylaJobID, "body", string(bodyBytes))
+		return sub, "failed: unreadable send webhook response", err
+	}
+	return sub, "", nil
+}
 
-	// For outbound faxes, add the job to the queue for later notify updates.
-	addFaxJob(outResp.JobUUID, jobID, hylaJobID, pdfPath, filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, sfcFileName))
-	log.Printf("Fax submitted successfully: FaxNumber=%s, PDFFile=%s, JobID=%s, Returned Job UUID=%s",
-		faxNumber, pdfFile, jobID, outResp.JobUUID)
-
-	os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, sfcFileName))
-	os.Remove(filepath.Join(os.Getenv("FTP_ROOT")+FaxDir, pdfFile))
+func createFile(filePath, content string) error {
+	if err := writeQueueFile(filePath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error creating file %s: %w", filePath, err)
+	}
 
-	return outResp.JobUUID, nil
+	slog.Debug("Queue file created", "file", filePath, "content", content)
+	return nil
 }
 
-func createFile(filePath, content string) error {
-	f, err := os.Create(filePath)
+// writeQueueFile writes data to a file in the fax queue directory so that FTP
+// clients never see it partially written: the data goes to a dot-prefixed
+// temporary file (hidden from Synergy's globs and most FTP listings), is synced
+// to disk, and is then renamed into place. Callers write a PDF before the .recv
+// that names it, so the PDF is complete by the time the .recv is visible.
+func writeQueueFile(filePath string, data []byte, perm os.FileMode) error {
+	staged, err := stageQueueFile(filepath.Dir(filePath), filepath.Base(filePath), bytes.NewReader(data), perm)
 	if err != nil {
-		return fmt.Errorf("error creating file %s: %w", filePath, err)
+		return err
 	}
-	defer f.Close()
+	if err := staged.commit(filePath); err != nil {
+		staged.discard()
+		return err
+	}
+	return nil
+}
+
+// isQueueTempFile reports whether path is one of writeQueueFile's temporary
+// files, which are renamed into place once complete.
+func isQueueTempFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp")
+}
 
-	_, err = f.WriteString(content)
+// stagedFile is a queue file written and synced under its temporary name but
+// not yet renamed into place.
+type stagedFile struct {
+	tmpPath   string
+	size      int64
+	sha256    string
+	pdfSHA256 string // of a PDF converted from the staged document, if any
+}
+
+// stageQueueFile copies r to a hidden temporary file in dir, hashing it on the
+// way, for writeQueueFile and for documents streamed from a request.
+func stageQueueFile(dir, name string, r io.Reader, perm os.FileMode) (*stagedFile, error) {
+	if err := injectWriteFault(filepath.Join(dir, name)); err != nil {
+		return nil, err
+	}
+	if err := checkDiskSpace(); err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err == nil {
+		err = tmp.Chmod(queueFileMode(tmp.Name(), perm))
+	}
+	if err == nil {
+		err = chownQueuePath(tmp.Name())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("error writing content to file %s: %w", filePath, err)
+		os.Remove(tmp.Name())
+		return nil, err
 	}
+	return &stagedFile{tmpPath: tmp.Name(), size: n, sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
 
-	log.Printf("File created with content: %s content: %s", filePath, string(content))
+// commit renames the staged file to filePath, which must be in the same directory.
+func (f *stagedFile) commit(filePath string) error {
+	if err := os.Rename(f.tmpPath, filePath); err != nil {
+		return err
+	}
+
+	// Persist the rename itself before the next file is written.
+	if d, err := os.Open(filepath.Dir(filePath)); err == nil {
+		d.Sync()
+		d.Close()
+	}
 	return nil
 }
 
+// discard removes a staged file that will not be committed.
+func (f *stagedFile) discard() {
+	os.Remove(f.tmpPath)
+}
+
 type jobQ struct {
-	hylaJobID string
-	pdfPath   string
-	sfcPath   string
+	hylaJobID    string
+	synergyJobID string // .sfc name without its extension
+	pdfPath      string
+	sfcPath      string
+	user         string // originating Synergy user, if known
+
+	partFilename string // filename sent in the multipart file part
+	partType     string // Content-Type sent in the multipart file part
+	credential   string // label of the webhook credential that was accepted
+	route        string // send route the job went to
+	pages        int    // pages in the document, 0 if unknown
+	dials        int    // dials made, this one included; 0 for jobs from before redialling
+	tries        int    // transmission attempts of earlier dials
+	acceptedAt   time.Time
+
+	// Notifies may identify the fax by any of these besides the job UUID.
+	faxUUID  string
+	callUUID string
+
+	broadcastIndex int // 1-based destination in a broadcast; 0 for a single destination
+}
+
+func addFaxJob(jobUUID, synergyJobID, hylafaxJobID string, job jobQ) {
+	jobQueue.Lock()
+	job.hylaJobID = hylafaxJobID
+	job.synergyJobID = synergyJobID
+	job.acceptedAt = time.Now()
+	jobQueue.entries[jobUUID] = job
+	jobQueue.Unlock()
+	noteJobUUID(hylafaxJobID, jobUUID, job.user)
+	queueJobEvent(eventSubmitted, job, FaxJob{UUID: jobUUID}, eventSubmitted)
+	saveState()
+	slog.Info("Fax job added to queue", "uuid", jobUUID, "synergy_job_id", synergyJobID, "job_id", hylafaxJobID,
+		"user", job.user, "part_filename", job.partFilename, "part_type", job.partType, "credential", job.credential, "route", job.route,
+		"pages", job.pages, "fax_uuid", job.faxUUID, "call_uuid", job.callUUID)
+	replayBufferedNotifies()
 }
 
-func addFaxJob(jobUUID, synergyJobID, hylafaxJobID, pdfPath, sfcFilePath string) {
+// completeOutboundJob writes the final state of an outbound job from its
+// notify result, as mapped by mapNotifyStatus. source is where the result
+// came from, for the job's status history.
+func completeOutboundJob(jobQq jobQ, job FaxJob, source string) {
+	markNotifyResolved(job.UUID)
+	if jobQq.broadcastIndex > 0 {
+		noteJobStatus(jobQq.hylaJobID, fmt.Sprintf("destination %d: %s", jobQq.broadcastIndex, job.Status), source)
+	} else {
+		noteJobStatus(jobQq.hylaJobID, job.Status, source)
+	}
+	if jobQq.broadcastIndex > 0 {
+		defer recordSentFaxHistory(jobQq, job, mapNotifyStatus(job).success())()
+		completeBroadcastDestination(jobQq, job)
+		return
+	}
+	mapping := mapNotifyStatus(job)
+	job.Result.Success = mapping.success()
+	if !job.Result.Success && redialJob(jobQq, job, mapping) {
+		return
+	}
+	defer recordSentFaxHistory(jobQq, job, job.Result.Success)()
+	writeStsDials(jobQq.hylaJobID, max(jobQq.dials, 1), jobQq.tries+resultTries(job))
+	if job.Result.Success {
+		slog.Info("Notify indicates fax completed", "uuid", job.UUID, "job_id", jobQq.hylaJobID, "direction", "outbound")
+		createStsFile(jobQq.hylaJobID, stsStateDone, pagesField(pagesSent(jobQq.pages, job.Result)), pagesField(job.Result.TotalPages), mapping.Message)
+		slaJobCompleted(jobQq.hylaJobID, true)
+		recordDeliveryOutcome(false, true, time.Since(jobQq.acceptedAt))
+		createFile(jobFile(jobQq.hylaJobID, fmt.Sprintf("q%s.done", jobQq.hylaJobID)), "\r")
+		cleanUpSentJob(jobQq.hylaJobID, jobQq.sfcPath, jobQq.pdfPath)
+	} else {
+		slog.Info("Notify indicates fax failed", "uuid", job.UUID, "job_id", jobQq.hylaJobID, "direction", "outbound",
+			"reason", job.Result.ResultText, "status", job.Status, "result_code", job.Result.ResultCode, "retryable", mapping.Retryable)
+		slaJobCompleted(jobQq.hylaJobID, false)
+		recordDeliveryOutcome(false, false, 0)
+		status := failureStatus(mapping.Message, job.Result)
+		if job.Result.PagesSent > 0 || job.Result.TotalPages > 0 {
+			createStsFile(jobQq.hylaJobID, stsStateFailed, pagesField(job.Result.PagesSent), pagesField(job.Result.TotalPages), status)
+		}
+		deadLetterJob(jobQq.hylaJobID, status, job.Result.ResultText, jobQq.sfcPath, jobQq.pdfPath)
+		updateFailureInfo(jobQq.hylaJobID, func(info *failureInfo) {
+			info.Dials = max(jobQq.dials, 1)
+			info.ResultCode = job.Result.ResultCode
+			info.AcceptedAt = jobQq.acceptedAt
+		})
+	}
+}
+
+// pagesSent returns the pages transmitted according to a notify result: the
+// count the provider reports, or on success the whole document.
+func pagesSent(pages int, result FaxResult) int {
+	switch {
+	case result.PagesSent > 0:
+		return result.PagesSent
+	case result.Success && result.TotalPages > 0:
+		return result.TotalPages
+	case result.Success:
+		return pages
+	}
+	return 0
+}
+
+// isInboundFax reports whether uuid is a received fax, whose notifies never match an outbound job.
+func isInboundFax(uuid string) bool {
+	faxRecordsMutex.Lock()
+	defer faxRecordsMutex.Unlock()
+	record, ok := faxRecords[uuid]
+	return ok && record.Direction == "inbound"
+}
+
+// takeOutboundJob finds and removes the queued job a notify result refers to.
+// Results are matched by their UUID against the job UUID, then by the UUID
+// of the enclosing fax_job, then by call UUID and fax UUID. matchedBy names
+// the key that matched.
+func takeOutboundJob(result, overall FaxJob) (jobUUID string, job jobQ, matchedBy string, ok bool) {
 	jobQueue.Lock()
 	defer jobQueue.Unlock()
-	jobQueue.entries[jobUUID] = jobQ{hylaJobID: hylafaxJobID, pdfPath: pdfPath, sfcPath: sfcFilePath}
-	log.Printf("Fax job added to queue: JobUUID=%s SynergyJobID=%s, HylaFaxJobID=%s", jobUUID, synergyJobID, hylafaxJobID)
+
+	jobUUID, matchedBy = matchOutboundJob(result, overall)
+	if matchedBy == "" {
+		return "", jobQ{}, "", false
+	}
+	job = jobQueue.entries[jobUUID]
+	delete(jobQueue.entries, jobUUID)
+	return jobUUID, job, matchedBy, true
 }
 
-// generateJobID returns the last 6 characters of a newly generated UUID.
-func generateJobID() string {
-	// Generate a new UUID.
-	id := uuid.New().String() // Example: "123e4567-e89b-12d3-a456-426614174000"
-	// Remove hyphens.
-	id = strings.ReplaceAll(id, "-", "")
-	// Return the last 6 characters.
-	if len(id) >= 6 {
-		return id[len(id)-6:]
+// matchOutboundJob returns the jobQueue key a notify result refers to, as
+// described for takeOutboundJob, or an empty matchedBy. Callers hold jobQueue.
+func matchOutboundJob(result, overall FaxJob) (jobUUID, matchedBy string) {
+	if _, ok := jobQueue.entries[result.UUID]; ok && result.UUID != "" {
+		return result.UUID, "uuid"
+	}
+	if _, ok := jobQueue.entries[overall.UUID]; ok && overall.UUID != "" {
+		return overall.UUID, "fax_job uuid"
+	}
+	for key, q := range jobQueue.entries {
+		if q.callUUID != "" && (q.callUUID == result.CallUUID || q.callUUID == overall.CallUUID) {
+			return key, "call_uuid"
+		}
+		if q.faxUUID != "" && (q.faxUUID == result.UUID || q.faxUUID == overall.UUID) {
+			return key, "fax uuid"
+		}
 	}
-	return id
+	return "", ""
 }
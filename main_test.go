@@ -0,0 +1,517 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// useTestConfig puts a configuration read from env, over the defaults, in
+// effect for the test. FTP_ROOT and DATA_DIR are in a temporary directory,
+// with the queue directory created, and ADMIN_AUTH_TOKEN is testAdminToken.
+// The previous configuration and the
+// pairing cache, outbound queue, holds, fax records and submitted jobs are
+// restored when the test ends.
+func useTestConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	root := t.TempDir()
+	settings := map[string]string{
+		"FTP_ROOT":         root,
+		"DATA_DIR":         filepath.Join(root, "data"),
+		"FAX_NUMBER":       "6045550100",
+		"SEND_WEBHOOK_URL": "http://127.0.0.1:1/send",
+		"ADMIN_AUTH_TOKEN": testAdminToken,
+	}
+	for k, v := range env {
+		settings[k] = v
+	}
+	cfg, problems := readConfig(func(env string) string { return settings[env] })
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		t.Fatalf("invalid test configuration: %v", problems)
+	}
+	for _, dir := range []string{cfg.DataDir, root + FaxDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prev := config()
+	currentConfig.Store(&cfg)
+	t.Cleanup(func() {
+		currentConfig.Store(prev)
+		cache.Lock()
+		cache.sfc, cache.pdf, cache.inFlight = make(map[string]sfcFile), make(map[string]cachedPdf), make(map[string]bool)
+		cache.Unlock()
+		outboundQueue.Lock()
+		outboundQueue.items = nil
+		outboundQueue.Unlock()
+		holds.Lock()
+		holds.entries = make(map[string]heldJob)
+		holds.Unlock()
+		jobDirs.Lock()
+		jobDirs.dirs = make(map[string]string)
+		jobDirs.Unlock()
+		faxRecordsMutex.Lock()
+		faxRecords = make(map[string]*FaxJobRecord)
+		faxRecordsMutex.Unlock()
+		inboundContent.Lock()
+		inboundContent.seen = make(map[string]inboundContentEntry)
+		inboundContent.Unlock()
+		jobQueue.Lock()
+		jobQueue.entries = make(map[string]jobQ)
+		jobQueue.Unlock()
+		notifyBuffer.Lock()
+		notifyBuffer.entries = make(map[*bufferedNotify]bool)
+		notifyBuffer.Unlock()
+		resolvedNotifies.Lock()
+		resolvedNotifies.at = make(map[string]time.Time)
+		resolvedNotifies.Unlock()
+	})
+	return &cfg
+}
+
+// writeTestFile writes content to path, creating its directory.
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the content of path, or "" if it does not exist.
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// stsFields returns the key:value lines of q<jobID>.sts.
+func stsFields(t *testing.T, jobID string) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for _, line := range strings.Split(readTestFile(t, jobFile(jobID, "q"+jobID+".sts")), "\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// serveTestRequest answers req with the routes register adds.
+func serveTestRequest(t *testing.T, register func(app *iris.Application), req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	app := iris.New()
+	register(app)
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWriteQueueFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		existed string // content of the file before the write, if any
+		data    string
+	}{
+		{name: "new file", data: "state:3\n"},
+		{name: "replaced file", existed: "state:3\n", data: "state:7\n"},
+		{name: "empty file", data: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			path := filepath.Join(dir, "q42.sts")
+			if tt.existed != "" {
+				writeTestFile(t, path, tt.existed)
+			}
+			if err := writeQueueFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFile(t, path); got != tt.data {
+				t.Errorf("content %q, want %q", got, tt.data)
+			}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if isQueueTempFile(e.Name()) {
+					t.Errorf("temporary file %s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+// TestReceiveVisibility polls the queue directory the way Synergy does over
+// FTP, skipping dot files, while faxes are received, and fails if it ever
+// sees a .recv whose PDF is missing or incomplete.
+func TestReceiveVisibility(t *testing.T) {
+	cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false"})
+	dir := cfg.FTPRoot + FaxDir
+	app := iris.New()
+	registerProviderRoutes(app)
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	const faxes = 40
+	done := make(chan struct{})
+	polled := make(chan int)
+	go func() {
+		polls := 0
+		defer func() { polled <- polls }()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			polls++
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				name := e.Name()
+				if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".recv") {
+					continue
+				}
+				pdfName := strings.TrimSuffix(name, ".recv") + ".pdf"
+				data, err := os.ReadFile(filepath.Join(dir, pdfName))
+				if err != nil {
+					t.Errorf("%s is listed but %s cannot be read: %v", name, pdfName, err)
+					continue
+				}
+				// Each document gives its own size on its second line.
+				var size int
+				if lines := strings.SplitN(string(data), "\n", 3); len(lines) == 3 {
+					fmt.Sscanf(lines[1], "%%size %d", &size)
+				}
+				if size == 0 || len(data) != size {
+					t.Errorf("%s is listed but %s has %d bytes, want %d", name, pdfName, len(data), size)
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < faxes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			size := 4096 + i*9973
+			doc := fmt.Sprintf("%%PDF-1.4\n%%size %010d\n", size)
+			doc += strings.Repeat("x", size-len(doc))
+			query := url.Values{"uuid": {fmt.Sprintf("fax-%d", i)}, "cidnum": {fmt.Sprintf("60455512%02d", i)}, "number": {"6045550100"}}
+			req := httptest.NewRequest("POST", "/fax-receive?"+query.Encode(), strings.NewReader(doc))
+			req.Header.Set("Content-Type", contentTypePDF)
+			rec := httptest.NewRecorder()
+			app.ServeHTTP(rec, req)
+			if rec.Code != 200 {
+				t.Errorf("fax %d: status %d: %s", i, rec.Code, rec.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	if polls := <-polled; polls < faxes {
+		t.Logf("only %d polls during %d receives", polls, faxes)
+	}
+	recvs, _ := filepath.Glob(filepath.Join(dir, "[^.]*.recv"))
+	if len(recvs) != faxes {
+		t.Errorf("%d .recv files, want %d", len(recvs), faxes)
+	}
+}
+
+func TestProcessFilePairing(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string // queue files, written and processed in this order
+		want   []string // .sfc files of the queued jobs, in queue order
+	}{
+		{name: ".sfc first", events: []string{"fax0001.sfc", "fax0001.pdf"}, want: []string{"fax0001.sfc"}},
+		{name: "PDF first", events: []string{"fax0001.pdf", "fax0001.sfc"}, want: []string{"fax0001.sfc"}},
+		{name: ".sfc without its PDF", events: []string{"fax0001.sfc"}},
+		{name: "PDF without its .sfc", events: []string{"fax0001.pdf"}},
+		{name: "back to back", events: []string{"fax0001.sfc", "fax0001.pdf", "fax0002.sfc", "fax0002.pdf", "fax0003.pdf", "fax0003.sfc"},
+			want: []string{"fax0001.sfc", "fax0002.sfc", "fax0003.sfc"}},
+		{name: "interleaved", events: []string{"fax0001.sfc", "fax0002.pdf", "fax0003.sfc", "fax0002.sfc", "fax0001.pdf", "fax0003.pdf"},
+			want: []string{"fax0002.sfc", "fax0001.sfc", "fax0003.sfc"}},
+		{name: "all .sfc files first", events: []string{"fax0001.sfc", "fax0002.sfc", "fax0003.sfc", "fax0003.pdf", "fax0002.pdf", "fax0001.pdf"},
+			want: []string{"fax0003.sfc", "fax0002.sfc", "fax0001.sfc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			for _, name := range tt.events {
+				base := strings.TrimSuffix(name, filepath.Ext(name))
+				content := "%PDF-1.4\n"
+				if filepath.Ext(name) == ".sfc" {
+					content = "6045551234\n" + base + ".pdf\n"
+				}
+				writeTestFile(t, filepath.Join(dir, name), content)
+				processFile(filepath.Join(dir, name))
+			}
+
+			outboundQueue.Lock()
+			var got []string
+			for _, item := range outboundQueue.items {
+				got = append(got, item.SfcFileName)
+			}
+			outboundQueue.Unlock()
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliverFaxMarkers(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int // webhook response; 0 closes the server first
+		state  string
+		sts    string // .sts status line
+		fail   bool   // q<jobid>.fail exists afterwards
+	}{
+		{name: "200", status: 200, state: stsStateSleeping, sts: "Sent to WebHook"},
+		{name: "400", status: 400, state: stsStateFailed, sts: "failed: send webhook returned 400 Bad Request", fail: true},
+		{name: "404", status: 404, state: stsStateFailed, sts: "failed: send webhook returned 404 Not Found", fail: true},
+		{name: "500", status: 500, state: stsStateFailed, sts: "failed: send webhook returned 500 Internal Server Error", fail: true},
+		{name: "503", status: 503, state: stsStateFailed, sts: "failed: send webhook returned 503 Service Unavailable", fail: true},
+		{name: "network error", state: stsStateFailed, sts: "failed: send webhook unreachable", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, `{"job_uuid":"job-1"}`)
+			}))
+			defer server.Close()
+			if tt.status == 0 {
+				server.Close()
+			}
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL, "SEND_WEBHOOK_RETRIES": "1"})
+			dir := cfg.FTPRoot + FaxDir
+			sfcPath, pdfPath := filepath.Join(dir, "fax0001.sfc"), filepath.Join(dir, "fax0001.pdf")
+			writeTestFile(t, sfcPath, "6045551234\nfax0001.pdf\n")
+			writeTestFile(t, pdfPath, "%PDF-1.4\n")
+
+			_, err := deliverFax("6045551234", "", "fax0001.pdf", pdfPath, "fax0001.sfc", "", "fax0001", "42", 1, 0)
+			if (err != nil) != tt.fail {
+				t.Errorf("err = %v, want failure %v", err, tt.fail)
+			}
+			if fileExists(filepath.Join(dir, "q42.done")) {
+				t.Error("q42.done exists")
+			}
+			if got := fileExists(filepath.Join(dir, "q42.fail")); got != tt.fail {
+				t.Errorf("q42.fail exists = %v, want %v", got, tt.fail)
+			}
+			if sts := stsFields(t, "42"); sts["state"] != tt.state || sts["status"] != tt.sts {
+				t.Errorf(".sts state %q status %q, want %q %q", sts["state"], sts["status"], tt.state, tt.sts)
+			}
+			// A failed job's files are removed; a submitted one keeps them
+			// until its result arrives.
+			if got := fileExists(sfcPath) && fileExists(pdfPath); got == tt.fail {
+				t.Errorf("job files kept = %v, want %v", got, !tt.fail)
+			}
+		})
+	}
+}
+
+// queueSentJob writes the .sfc and PDF of job fax0001 and registers it as
+// submitted under Hylafax job 42, with the given UUIDs.
+func queueSentJob(t *testing.T, cfg *Config, jobUUID string, q jobQ) {
+	t.Helper()
+	dir := cfg.FTPRoot + FaxDir
+	q.sfcPath, q.pdfPath = filepath.Join(dir, "fax0001.sfc"), filepath.Join(dir, "fax0001.pdf")
+	writeTestFile(t, q.sfcPath, "6045551234\nfax0001.pdf\n")
+	writeTestFile(t, q.pdfPath, "%PDF-1.4\n")
+	if err := createStsFile("42", stsStateSleeping, "", "", "Sent to WebHook"); err != nil {
+		t.Fatal(err)
+	}
+	addFaxJob(jobUUID, "fax0001", "42", q)
+}
+
+// postNotify sends a /fax-notify with one completed result.
+func postNotify(t *testing.T, overall, result string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := fmt.Sprintf(`{"fax_job_results":{"fax_job":{%s,"status":"completed"},"results":{"1":{%s,"status":"completed","result":{"success":true}}}}}`,
+		overall, result)
+	req := httptest.NewRequest("POST", "/fax-notify", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := serveTestRequest(t, registerProviderRoutes, req)
+	if rec.Code != 200 {
+		t.Fatalf("notify status %d: %s", rec.Code, rec.Body)
+	}
+	return rec
+}
+
+func TestNotifyCorrelation(t *testing.T) {
+	tests := []struct {
+		name    string
+		overall string // fields of the fax_job
+		result  string // fields of the result
+		done    bool
+	}{
+		{name: "result UUID", overall: `"uuid":"other"`, result: `"uuid":"job-uuid"`, done: true},
+		{name: "fax_job UUID", overall: `"uuid":"job-uuid"`, result: `"uuid":"result-uuid"`, done: true},
+		{name: "call UUID only", overall: `"uuid":""`, result: `"call_uuid":"call-uuid"`, done: true},
+		{name: "call UUID on the fax_job", overall: `"call_uuid":"call-uuid"`, result: `"uuid":"result-uuid"`, done: true},
+		{name: "fax UUID", overall: `"uuid":""`, result: `"uuid":"fax-uuid"`, done: true},
+		{name: "no key matches", overall: `"uuid":"other"`, result: `"uuid":"result-uuid","call_uuid":"other-call"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			queueSentJob(t, cfg, "job-uuid", jobQ{faxUUID: "fax-uuid", callUUID: "call-uuid"})
+
+			postNotify(t, tt.overall, tt.result)
+
+			if got := fileExists(filepath.Join(cfg.FTPRoot+FaxDir, "q42.done")); got != tt.done {
+				t.Errorf("q42.done exists = %v, want %v", got, tt.done)
+			}
+			jobQueue.Lock()
+			_, queued := jobQueue.entries["job-uuid"]
+			jobQueue.Unlock()
+			if queued == tt.done {
+				t.Errorf("job still queued = %v, want %v", queued, !tt.done)
+			}
+		})
+	}
+}
+
+// slowReader returns its data a chunk at a time, calling before ahead of
+// each chunk.
+type slowReader struct {
+	data   []byte
+	chunk  int
+	before func()
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	r.before()
+	time.Sleep(time.Millisecond)
+	n := copy(p[:min(len(p), r.chunk)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestStageQueueFileSlowWrite lists the queue directory throughout a slow
+// write and checks that only a temporary file the watcher ignores is visible
+// until the complete file is renamed into place.
+func TestStageQueueFileSlowWrite(t *testing.T) {
+	for _, name := range []string{"fax0001.pdf", "fax0001.recv", "q42.sts", "fax0001.jobid", "q42.done", "q42.fail"} {
+		t.Run(name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			content := strings.Repeat(name+"\n", 200)
+			checks := 0
+			r := &slowReader{data: []byte(content), chunk: 100, before: func() {
+				checks++
+				entries, _ := os.ReadDir(dir)
+				for _, e := range entries {
+					if !isQueueTempFile(e.Name()) || isPolledFile(e.Name()) {
+						t.Errorf("%s is visible during the write", e.Name())
+					}
+				}
+			}}
+
+			staged, err := stageQueueFile(dir, name, r, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileExists(filepath.Join(dir, name)) {
+				t.Errorf("%s exists before the commit", name)
+			}
+			if err := staged.commit(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+			if checks < 10 {
+				t.Errorf("directory listed only %d times", checks)
+			}
+			if got := readTestFile(t, filepath.Join(dir, name)); got != content {
+				t.Errorf("%s has %d bytes, want %d", name, len(got), len(content))
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 {
+				t.Errorf("%d files in the queue directory, want only %s", len(entries), name)
+			}
+		})
+	}
+}
+
+func TestReadFaxDocumentMaxSize(t *testing.T) {
+	const max = 1 << 20 // MAX_FAX_SIZE_MB=1
+	tests := []struct {
+		name     string
+		size     int
+		tooLarge bool
+	}{
+		{name: "just under", size: max - 1},
+		{name: "at the limit", size: max},
+		{name: "just over", size: max + 1, tooLarge: true},
+		{name: "far over", size: 8 * max, tooLarge: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "MAX_FAX_SIZE_MB": "1", "SEND_WEBHOOK_RETRIES": "1"})
+			dir := cfg.FTPRoot + FaxDir
+			pdfPath := filepath.Join(dir, "fax0001.pdf")
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+			writeTestFile(t, pdfPath, "%PDF-1.4\n"+strings.Repeat("x", tt.size-len("%PDF-1.4\n")))
+
+			data, err := readFaxDocument(pdfPath)
+			if got := errors.Is(err, errFaxTooLarge); got != tt.tooLarge {
+				t.Fatalf("err = %v, want too large %v", err, tt.tooLarge)
+			}
+			if !tt.tooLarge {
+				if len(data) != tt.size {
+					t.Errorf("read %d bytes, want %d", len(data), tt.size)
+				}
+				return
+			}
+
+			if _, err := deliverFax("+16045551234", "", "fax0001.pdf", pdfPath, "fax0001.sfc", "", "fax0001", "42", 1, 0); !errors.Is(err, errFaxTooLarge) {
+				t.Errorf("deliverFax() = %v, want %v", err, errFaxTooLarge)
+			}
+			if sts := stsFields(t, "42"); sts["state"] != stsStateFailed || sts["status"] != "failed: document exceeds MAX_FAX_SIZE_MB" {
+				t.Errorf(".sts state %q status %q", sts["state"], sts["status"])
+			}
+			if !fileExists(filepath.Join(dir, "q42.fail")) {
+				t.Error("no q42.fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"expvar"
+	"github.com/kataras/iris/v12"
+)
+
+// registerMetricsRoutes exposes every published expvar variable as JSON on
+// /metrics, alongside the /healthz dependency checks.
+func registerMetricsRoutes(app *iris.Application) {
+	documentRoute(app.Get("/metrics", iris.FromStd(expvar.Handler())),
+		apiDoc{Summary: "Every published expvar variable", Response: map[string]any{}})
+	registerHealthRoutes(app)
+}
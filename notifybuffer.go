@@ -0,0 +1,85 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// The provider can notify a result before the submission that created the
+// job has read the webhook response and queued it. Such results are kept for
+// NOTIFY_BUFFER_WINDOW and replayed as soon as a matching job is queued.
+
+type bufferedNotify struct {
+	result   FaxJob
+	overall  FaxJob // the enclosing fax_job, which may carry the job UUID
+	received time.Time
+}
+
+var notifyBuffer = struct {
+	sync.Mutex
+	entries map[*bufferedNotify]bool
+}{entries: make(map[*bufferedNotify]bool)}
+
+var (
+	notifiesBuffered = expvar.NewInt("notifies_buffered")
+	notifiesReplayed = expvar.NewInt("notifies_replayed")
+	notifiesExpired  = expvar.NewInt("notifies_expired")
+)
+
+// bufferNotify keeps an unmatched result until a job claims it or the window passes.
+func bufferNotify(result, overall FaxJob) {
+	n := &bufferedNotify{result: result, overall: overall, received: time.Now()}
+	window := config().NotifyBufferWindow
+
+	notifyBuffer.Lock()
+	notifyBuffer.entries[n] = true
+	notifyBuffer.Unlock()
+	notifiesBuffered.Add(1)
+	slog.Info("No queued job for notify result yet; holding it", "uuid", result.UUID, "call_uuid", result.CallUUID, "window", window)
+
+	time.AfterFunc(window, func() {
+		notifyBuffer.Lock()
+		pending := notifyBuffer.entries[n]
+		delete(notifyBuffer.entries, n)
+		notifyBuffer.Unlock()
+		if pending {
+			notifiesExpired.Add(1)
+			slog.Warn("Dropping notify result: no job matched it", "uuid", result.UUID,
+				"call_uuid", result.CallUUID, "status", result.Status, "window", window)
+		}
+	})
+}
+
+// replayBufferedNotifies completes the jobs that buffered results belong to.
+// It is called whenever a job is queued.
+func replayBufferedNotifies() {
+	type match struct {
+		n       *bufferedNotify
+		jobUUID string
+		job     jobQ
+		by      string
+	}
+	var matches []match
+
+	notifyBuffer.Lock()
+	for n := range notifyBuffer.entries {
+		if jobUUID, job, by, ok := takeOutboundJob(n.result, n.overall); ok {
+			delete(notifyBuffer.entries, n)
+			matches = append(matches, match{n, jobUUID, job, by})
+		}
+	}
+	notifyBuffer.Unlock()
+
+	for _, m := range matches {
+		notifiesReplayed.Add(1)
+		slog.Info("Replaying notify result received before its fax job was queued", "uuid", m.n.result.UUID,
+			"call_uuid", m.n.result.CallUUID, "early_by", time.Since(m.n.received).Round(time.Millisecond),
+			"job_uuid", m.jobUUID, "job_id", m.job.hylaJobID, "matched_by", m.by)
+		completeOutboundJob(m.job, m.n.result, statusSourceNotify)
+	}
+	if len(matches) > 0 {
+		saveState()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestNotifyBeforeJob delivers the notify first and queues the job after it.
+func TestNotifyBeforeJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  string        // fields of the notify result
+		inbound bool          // the result is for a received fax
+		wait    time.Duration // between the notify and the job being queued
+		done    bool
+		expired int64
+	}{
+		{name: "job UUID", result: `"uuid":"job-uuid"`, done: true},
+		{name: "call UUID", result: `"call_uuid":"call-uuid"`, done: true},
+		{name: "late within the window", result: `"uuid":"job-uuid"`, wait: 50 * time.Millisecond, done: true},
+		{name: "after the window", result: `"uuid":"job-uuid"`, wait: 300 * time.Millisecond, expired: 1},
+		{name: "received fax", result: `"uuid":"job-uuid"`, inbound: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "NOTIFY_BUFFER_WINDOW": "150ms"})
+			if tt.inbound {
+				faxRecordsMutex.Lock()
+				faxRecords["job-uuid"] = &FaxJobRecord{Direction: "inbound"}
+				faxRecordsMutex.Unlock()
+			}
+			expired, replayed := notifiesExpired.Value(), notifiesReplayed.Value()
+
+			postNotify(t, `"uuid":""`, tt.result)
+			time.Sleep(tt.wait)
+			queueSentJob(t, cfg, "job-uuid", jobQ{callUUID: "call-uuid"})
+
+			if got := fileExists(filepath.Join(cfg.FTPRoot+FaxDir, "q42.done")); got != tt.done {
+				t.Errorf("q42.done exists = %v, want %v", got, tt.done)
+			}
+			if got := notifiesExpired.Value() - expired; got != tt.expired {
+				t.Errorf("%d results expired, want %d", got, tt.expired)
+			}
+			if got := notifiesReplayed.Value() - replayed; got != map[bool]int64{true: 1}[tt.done] {
+				t.Errorf("%d results replayed", got)
+			}
+			notifyBuffer.Lock()
+			held := len(notifyBuffer.entries)
+			notifyBuffer.Unlock()
+			if held != 0 && (tt.done || tt.expired > 0) {
+				t.Errorf("%d results still held", held)
+			}
+		})
+	}
+}
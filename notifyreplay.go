@@ -0,0 +1,65 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// The provider retries notify deliveries, and replay tools resend them. Once
+// a notify result has completed a job, its UUID is recorded, and further
+// results with that UUID are ignored, so a failure replayed after a success
+// cannot rewrite the job's .sts. The UUIDs are kept in DATA_DIR/state.json
+// for JOB_STATE_TTL.
+
+var resolvedNotifies = struct {
+	sync.Mutex
+	at map[string]time.Time // result UUID -> when it completed its job
+}{at: make(map[string]time.Time)}
+
+var notifiesAlreadyProcessed = expvar.NewInt("notifies_already_processed")
+
+// markNotifyResolved records that the result with this UUID completed its job.
+func markNotifyResolved(uuid string) {
+	if uuid == "" {
+		return
+	}
+	resolvedNotifies.Lock()
+	resolvedNotifies.at[uuid] = time.Now()
+	resolvedNotifies.Unlock()
+}
+
+// notifyResolved reports whether a result with this UUID already completed
+// its job.
+func notifyResolved(uuid string) bool {
+	resolvedNotifies.Lock()
+	defer resolvedNotifies.Unlock()
+	_, ok := resolvedNotifies.at[uuid]
+	return ok
+}
+
+// snapshotResolvedNotifies returns the resolved UUIDs for saveState,
+// dropping those older than JOB_STATE_TTL.
+func snapshotResolvedNotifies() map[string]time.Time {
+	cutoff := time.Now().Add(-config().JobStateTTL)
+	resolvedNotifies.Lock()
+	defer resolvedNotifies.Unlock()
+	out := make(map[string]time.Time, len(resolvedNotifies.at))
+	for uuid, at := range resolvedNotifies.at {
+		if at.Before(cutoff) {
+			delete(resolvedNotifies.at, uuid)
+			continue
+		}
+		out[uuid] = at
+	}
+	return out
+}
+
+// restoreResolvedNotifies reloads the resolved UUIDs at startup.
+func restoreResolvedNotifies(at map[string]time.Time) {
+	resolvedNotifies.Lock()
+	defer resolvedNotifies.Unlock()
+	for uuid, t := range at {
+		resolvedNotifies.at[uuid] = t
+	}
+}
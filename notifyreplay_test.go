@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueSnapshot returns the size, modification time and content of every
+// file in dir.
+func queueSnapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = fmt.Sprintf("%d %s %q", info.Size(), info.ModTime().Format(time.RFC3339Nano), readTestFile(t, filepath.Join(dir, e.Name())))
+	}
+	return files
+}
+
+func TestNotifyReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		replays []bool // success of each replayed result, after the first, a success
+		restart bool   // the service restarts before the replays
+	}{
+		{name: "success replayed", replays: []bool{true, true}},
+		{name: "failure replayed after success", replays: []bool{false, false}},
+		{name: "replayed after a restart", replays: []bool{true, false}, restart: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			queueSentJob(t, cfg, "job-uuid", jobQ{})
+			notify := func(success bool) map[string]any {
+				t.Helper()
+				result := `"success":true`
+				if !success {
+					result = `"success":false,"result_text":"NO_ANSWER"`
+				}
+				body := `{"fax_job_results":{"fax_job":{"uuid":"job-uuid","status":"completed"},` +
+					`"results":{"1":{"uuid":"job-uuid","status":"completed","result":{` + result + `}}}}}`
+				req := httptest.NewRequest("POST", "/fax-notify", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rec := serveTestRequest(t, registerProviderRoutes, req)
+				if rec.Code != 200 {
+					t.Fatalf("notify status %d: %s", rec.Code, rec.Body)
+				}
+				resp := map[string]any{}
+				json.Unmarshal(rec.Body.Bytes(), &resp)
+				return resp
+			}
+
+			if resp := notify(true); resp["already_processed"] != nil {
+				t.Fatalf("first notify answered %v", resp)
+			}
+			// Back-date the files, so a rewrite with the same content shows.
+			past := time.Now().Add(-time.Hour)
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				os.Chtimes(filepath.Join(dir, e.Name()), past, past)
+			}
+			written := queueSnapshot(t, dir)
+			if sts := stsFields(t, "42"); sts["state"] != stsStateDone {
+				t.Fatalf(".sts state %q after the first notify, want %q", sts["state"], stsStateDone)
+			}
+			if tt.restart {
+				restartService(t, nil)
+			}
+
+			before := notifiesAlreadyProcessed.Value()
+			for i, success := range tt.replays {
+				if resp := notify(success); resp["already_processed"] != true {
+					t.Errorf("replay %d answered %v, want already_processed", i+1, resp)
+				}
+			}
+			if got := notifiesAlreadyProcessed.Value() - before; got != int64(len(tt.replays)) {
+				t.Errorf("notifies_already_processed rose by %d, want %d", got, len(tt.replays))
+			}
+			after := queueSnapshot(t, dir)
+			for name, want := range written {
+				if after[name] != want {
+					t.Errorf("replays rewrote %s: %s, want %s", name, after[name], want)
+				}
+			}
+			for name := range after {
+				if _, ok := written[name]; !ok {
+					t.Errorf("replays wrote %s", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Destination numbers are normalized to E.164 before submission, since Synergy
+// passes on whatever the user typed: "9,16045551234", "(604) 555-1234",
+// "011 44 20 7946 0000". Separators are dropped, as is a DIAL_STRIP_PREFIXES
+// entry followed by a pause (",") or without which the number does not
+// otherwise make sense. Numbers starting with "+" or the international prefix
+// (011 in DEFAULT_COUNTRY_CODE 1, 00 elsewhere) are international. Otherwise
+// DEFAULT_COUNTRY_CODE applies: in 1 (NANP) a number is 10 digits, optionally
+// after a 1; elsewhere a leading trunk 0 is replaced by the country code. A
+// number that cannot be normalized fails the job before submission.
+
+// Bounds on the digits of an E.164 number, country code included.
+const (
+	minE164Digits = 7
+	maxE164Digits = 15
+)
+
+var (
+	errNumberEmpty    = errors.New("no number")
+	errNumberLetters  = errors.New("contains letters")
+	errNumberTooShort = errors.New("too short")
+	errNumberTooLong  = errors.New("too long")
+)
+
+// numberSeparators may appear between the digits of a number.
+const numberSeparators = " -.()/,"
+
+// normalizeDestinations normalizes every destination on a .sfc number line
+// and returns them joined as a broadcast line. With NORMALIZE_FAX_NUMBERS=false
+// the line is only trimmed.
+func normalizeDestinations(line string) (string, error) {
+	cfg := config()
+	if !cfg.NormalizeFaxNumbers {
+		return strings.TrimSpace(line), nil
+	}
+	numbers := splitFaxNumbers(line)
+	if len(numbers) == 0 {
+		return "", errNumberEmpty
+	}
+	for i, number := range numbers {
+		n, err := normalizeFaxNumber(number, cfg.dialStripPrefixes, cfg.DefaultCountryCode)
+		if err != nil {
+			return "", fmt.Errorf("%q: %w", number, err)
+		}
+		numbers[i] = n
+	}
+	return strings.Join(numbers, ", "), nil
+}
+
+// normalizeFaxNumber returns number in E.164 form.
+func normalizeFaxNumber(number string, stripPrefixes []string, countryCode string) (string, error) {
+	s := strings.TrimSpace(number)
+	if s == "" {
+		return "", errNumberEmpty
+	}
+	if strings.IndexFunc(s, unicode.IsLetter) >= 0 {
+		return "", errNumberLetters
+	}
+	international := strings.HasPrefix(s, "+")
+	if !international {
+		for _, prefix := range stripPrefixes {
+			if strings.HasPrefix(s, prefix+",") {
+				s = strings.TrimLeft(s[len(prefix):], ", ")
+				break
+			}
+		}
+	}
+
+	var digits strings.Builder
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0, strings.ContainsRune(numberSeparators, r):
+		default:
+			return "", fmt.Errorf("contains %q", r)
+		}
+	}
+	if international {
+		return e164(digits.String())
+	}
+
+	e164Number, err := nationalToE164(digits.String(), countryCode)
+	if err == nil {
+		return e164Number, nil
+	}
+	for _, prefix := range stripPrefixes {
+		if rest, ok := strings.CutPrefix(digits.String(), prefix); ok {
+			if n, stripErr := nationalToE164(rest, countryCode); stripErr == nil {
+				return n, nil
+			}
+		}
+	}
+	return "", err
+}
+
+// nationalToE164 converts a number dialled from countryCode.
+func nationalToE164(digits, countryCode string) (string, error) {
+	intl := "00"
+	if countryCode == "1" {
+		intl = "011"
+	}
+	switch {
+	case digits == "":
+		return "", errNumberEmpty
+	case strings.HasPrefix(digits, intl):
+		return e164(digits[len(intl):])
+	case countryCode == "1":
+		if len(digits) == 11 && digits[0] == '1' {
+			digits = digits[1:]
+		}
+		if len(digits) < 10 {
+			return "", errNumberTooShort
+		}
+		if len(digits) > 10 {
+			return "", errNumberTooLong
+		}
+		if digits[0] < '2' {
+			return "", errors.New("not a valid area code")
+		}
+		return e164("1" + digits)
+	default:
+		return e164(countryCode + strings.TrimPrefix(digits, "0"))
+	}
+}
+
+func e164(digits string) (string, error) {
+	switch {
+	case len(digits) < minE164Digits:
+		return "", errNumberTooShort
+	case len(digits) > maxE164Digits:
+		return "", errNumberTooLong
+	}
+	return "+" + digits, nil
+}
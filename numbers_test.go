@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeFaxNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		number  string
+		strip   []string
+		country string
+		want    string
+		wantErr error // nil for any error when want is ""
+	}{
+		// NANP
+		{name: "local", number: "6045551234", country: "1", want: "+16045551234"},
+		{name: "local with separators", number: "(604) 555-1234", country: "1", want: "+16045551234"},
+		{name: "dots and spaces", number: " 604.555.1234 ", country: "1", want: "+16045551234"},
+		{name: "1+", number: "1-604-555-1234", country: "1", want: "+16045551234"},
+		{name: "already E.164", number: "+1 604 555 1234", country: "1", want: "+16045551234"},
+		{name: "outside line with pause", number: "9,16045551234", strip: []string{"9"}, country: "1", want: "+16045551234"},
+		{name: "outside line without pause", number: "916045551234", strip: []string{"9"}, country: "1", want: "+16045551234"},
+		{name: "outside line and local", number: "9, 604 555 1234", strip: []string{"9"}, country: "1", want: "+16045551234"},
+		{name: "prefix not configured", number: "9,16045551234", country: "1", wantErr: errNumberTooLong},
+		{name: "too short", number: "555-1234", country: "1", wantErr: errNumberTooShort},
+		{name: "too long", number: "160455512345", country: "1", wantErr: errNumberTooLong},
+		{name: "area code starting with 1", number: "1045551234", country: "1"},
+		// International
+		{name: "011", number: "011 44 20 7946 0000", country: "1", want: "+442079460000"},
+		{name: "011 after outside line", number: "9,011 33 1 23 45 67 89", strip: []string{"9"}, country: "1", want: "+33123456789"},
+		{name: "00 outside NANP", number: "00 1 604 555 1234", country: "44", want: "+16045551234"},
+		{name: "trunk 0", number: "020 7946 0000", country: "44", want: "+442079460000"},
+		{name: "international too long", number: "+1234567890123456", country: "1", wantErr: errNumberTooLong},
+		{name: "international too short", number: "+44 123", country: "1", wantErr: errNumberTooShort},
+		// Not a number
+		{name: "empty", number: "  ", country: "1", wantErr: errNumberEmpty},
+		{name: "letters", number: "1-800-FAX-ME", country: "1", wantErr: errNumberLetters},
+		{name: "extension", number: "6045551234#12", country: "1"},
+		{name: "plus in the middle", number: "604+5551234", country: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeFaxNumber(tt.number, tt.strip, tt.country)
+			if tt.want != "" {
+				if err != nil || got != tt.want {
+					t.Errorf("normalizeFaxNumber(%q) = %q, %v; want %q", tt.number, got, err, tt.want)
+				}
+				return
+			}
+			if err == nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("normalizeFaxNumber(%q) = %q, %v; want error %v", tt.number, got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeDestinations(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		line string
+		want string // "" for an error
+	}{
+		{name: "single", line: "604-555-1234", want: "+16045551234"},
+		{name: "broadcast", env: map[string]string{"DIAL_STRIP_PREFIXES": "9"}, line: "9,6045551234; 011 44 20 7946 0000",
+			want: "+16045551234, +442079460000"},
+		{name: "one bad destination fails the line", line: "6045551234,5551234"},
+		{name: "normalization off", env: map[string]string{"NORMALIZE_FAX_NUMBERS": "false"}, line: " 9,(604) 555-1234 ",
+			want: "9,(604) 555-1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, tt.env)
+			got, err := normalizeDestinations(tt.line)
+			if (err != nil) != (tt.want == "") || got != tt.want {
+				t.Errorf("normalizeDestinations(%q) = %q, %v; want %q", tt.line, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestSubmitFaxInvalidNumber checks that a number that cannot be normalized
+// fails its job before anything is submitted.
+func TestSubmitFaxInvalidNumber(t *testing.T) {
+	for _, number := range []string{"555-1234", "FAX-ME", ""} {
+		t.Run(number, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), number+"\nfax0001.pdf\n")
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+
+			job := SfcJob{FaxNumber: number, PdfFile: "fax0001.pdf"}
+			if _, err := submitFax(job, filepath.Join(dir, "fax0001.pdf"), "fax0001.sfc", "fax0001", "42"); err == nil {
+				t.Fatal("submitFax() succeeded")
+			}
+			if !fileExists(filepath.Join(dir, "q42.fail")) || fileExists(filepath.Join(dir, "q42.done")) {
+				t.Error("job did not fail with q42.fail alone")
+			}
+			sts := stsFields(t, "42")
+			if sts["state"] != stsStateFailed || !strings.HasPrefix(sts["status"], "failed: invalid fax number") {
+				t.Errorf(".sts state %q status %q, want a failed invalid fax number", sts["state"], sts["status"])
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SEND_WEBHOOK_AUTH chooses how the default route authenticates to the send
+// webhook:
+//
+//   - basic sends the send webhook credentials as Basic Auth, falling back
+//     to the secondary; see credentials.go.
+//   - header sends no credentials of its own, for providers that take a
+//     static Authorization or API key header from SEND_WEBHOOK_HEADERS.
+//   - oauth2 gets a bearer token from SEND_WEBHOOK_OAUTH_TOKEN_URL with the
+//     client credentials grant, authenticating with the client ID and secret
+//     as Basic Auth. The token is cached and fetched again shortly before it
+//     expires. A submission the webhook answers 401 is sent once more with a
+//     fresh token.
+//
+// A token that cannot be fetched fails the attempt with
+// "failed: OAuth2 token request failed", which is retried like an
+// unreachable webhook.
+
+// Send webhook auth modes kept in Config.SendWebhookAuth.
+const (
+	webhookAuthBasic  = "basic"
+	webhookAuthHeader = "header"
+	webhookAuthOAuth2 = "oauth2"
+)
+
+// oauthRefreshMargin is how long before its expiry a token is replaced.
+const oauthRefreshMargin = time.Minute
+
+// errTokenFetch wraps failures to get an OAuth2 token.
+var errTokenFetch = errors.New("OAuth2 token request failed")
+
+var (
+	oauthTokenFetches  = expvar.NewInt("webhook_oauth_token_fetches")
+	oauthTokenFailures = expvar.NewInt("webhook_oauth_token_failures")
+)
+
+// oauthToken caches the send webhook's bearer token. key identifies the
+// settings it was fetched with, so a change on SIGHUP fetches a new one.
+var oauthToken = struct {
+	sync.Mutex
+	key     string
+	token   string
+	expires time.Time // zero when the server gave no lifetime
+}{}
+
+// oauthTokenResponse is the token endpoint's answer.
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// doWithOAuth2 sends req with a bearer token, and once more with a fresh
+// token if the webhook answers 401. body must be the request body so it can
+// be replayed.
+func doWithOAuth2(client *http.Client, req *http.Request, body []byte, hylaJobID string) (*http.Response, string, error) {
+	token, err := webhookToken(client, false)
+	if err != nil {
+		return nil, webhookAuthOAuth2, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, webhookAuthOAuth2, err
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err := req.Context().Err(); err != nil {
+		return nil, webhookAuthOAuth2, err
+	}
+	slog.Warn("Send webhook rejected the OAuth2 token; retrying with a new one", "job_id", hylaJobID)
+	token, err = webhookToken(client, true)
+	if err != nil {
+		return nil, webhookAuthOAuth2, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = io.NopCloser(bytes.NewReader(body))
+	retry.Header.Set("Authorization", "Bearer "+token)
+	resp, err = client.Do(retry)
+	return resp, webhookAuthOAuth2, err
+}
+
+// webhookToken returns the cached token, fetching a new one when there is
+// none, it is about to expire, or renew is set.
+func webhookToken(client *http.Client, renew bool) (string, error) {
+	cfg := config()
+	key := strings.Join([]string{cfg.SendWebhookOAuthTokenURL, cfg.SendWebhookOAuthClientID, cfg.SendWebhookOAuthClientSecret, cfg.SendWebhookOAuthScopes}, "\n")
+
+	oauthToken.Lock()
+	defer oauthToken.Unlock()
+	fresh := oauthToken.key == key && oauthToken.token != "" &&
+		(oauthToken.expires.IsZero() || time.Until(oauthToken.expires) > oauthRefreshMargin)
+	if fresh && !renew {
+		return oauthToken.token, nil
+	}
+
+	oauthTokenFetches.Add(1)
+	token, lifetime, err := fetchOAuthToken(client)
+	if err != nil {
+		oauthTokenFailures.Add(1)
+		slog.Error("Error fetching OAuth2 token for the send webhook", "token_url", cfg.SendWebhookOAuthTokenURL, "err", err)
+		return "", fmt.Errorf("%w: %w", errTokenFetch, err)
+	}
+	oauthToken.key, oauthToken.token, oauthToken.expires = key, token, time.Time{}
+	if lifetime > 0 {
+		oauthToken.expires = time.Now().Add(lifetime)
+	}
+	slog.Info("Fetched OAuth2 token for the send webhook", "expires_in", lifetime)
+	return token, nil
+}
+
+// fetchOAuthToken requests a token with the client credentials grant.
+func fetchOAuthToken(client *http.Client) (string, time.Duration, error) {
+	cfg := config()
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if scopes := strings.Fields(strings.ReplaceAll(cfg.SendWebhookOAuthScopes, ",", " ")); len(scopes) > 0 {
+		form.Set("scope", strings.Join(scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.SendWebhookOAuthTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	req.SetBasicAuth(url.QueryEscape(cfg.SendWebhookOAuthClientID), url.QueryEscape(cfg.SendWebhookOAuthClientSecret))
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		slog.Debug("OAuth2 token response", "status", resp.Status, "body", string(data))
+		return "", 0, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tr oauthTokenResponse
+	if err := json.Unmarshal(data, &tr); err != nil {
+		return "", 0, fmt.Errorf("unreadable token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, errors.New("token response has no access_token")
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("token type %q is not bearer", tr.TokenType)
+	}
+	return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/core/router"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OpenAPI document is generated from the routes the route groups actually
+// register, so a route cannot be served without appearing in it. Request and
+// response types are attached where the route is registered, with documentRoute.
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiDoc describes one route for the OpenAPI document.
+type apiDoc struct {
+	Summary     string
+	Request     any               // JSON request body, nil when the route takes none
+	Response    any               // JSON body of the success response, nil when it has none
+	Status      int               // success status, default 200
+	ContentType string            // success content type when the response is not JSON
+	Query       map[string]string // query parameter -> description
+}
+
+var apiDocs = struct {
+	sync.Mutex
+	routes map[string]apiDoc // route name (method + path template) -> doc
+}{routes: make(map[string]apiDoc)}
+
+// documentRoute attaches doc to a registered route and returns the route.
+func documentRoute(r *router.Route, doc apiDoc) *router.Route {
+	r.Describe(doc.Summary)
+	apiDocs.Lock()
+	apiDocs.routes[r.Name] = doc
+	apiDocs.Unlock()
+	return r
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)(:[^}]*)?\}`)
+
+// buildOpenAPISpec registers every route group on a scratch application and
+// describes the routes it ends up with.
+func buildOpenAPISpec() map[string]any {
+	groups := make([]string, 0, len(routeGroupRegistrars))
+	for group := range routeGroupRegistrars {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	schemas := newSchemaBuilder()
+	paths := map[string]map[string]any{}
+	for _, group := range groups {
+		app := iris.New()
+		routeGroupRegistrars[group](app)
+		for _, r := range app.GetRoutes() {
+			path := pathParamPattern.ReplaceAllString(r.Tmpl().Src, "{$1}")
+			if paths[path] == nil {
+				paths[path] = map[string]any{}
+			}
+			apiDocs.Lock()
+			doc, documented := apiDocs.routes[r.Name]
+			apiDocs.Unlock()
+			if !documented {
+				doc.Summary = r.Description
+			}
+			paths[path][strings.ToLower(r.Method)] = openAPIOperation(schemas, group, r, doc)
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Synergy Matters fax gateway",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas.components},
+	}
+}
+
+func openAPIOperation(schemas *schemaBuilder, group string, r *router.Route, doc apiDoc) map[string]any {
+	op := map[string]any{
+		"tags":        []string{group},
+		"operationId": strings.ToLower(r.Method) + pathParamPattern.ReplaceAllString(strings.ReplaceAll(r.Tmpl().Src, "/", "_"), "$1"),
+	}
+	if doc.Summary != "" {
+		op["summary"] = doc.Summary
+	}
+
+	var params []map[string]any
+	for _, p := range r.Tmpl().Params {
+		params = append(params, map[string]any{"name": p.Name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	query := make([]string, 0, len(doc.Query))
+	for name := range doc.Query {
+		query = append(query, name)
+	}
+	sort.Strings(query)
+	for _, name := range query {
+		params = append(params, map[string]any{"name": name, "in": "query", "description": doc.Query[name], "schema": map[string]any{"type": "string"}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if doc.Request != nil {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(doc.Request))}},
+		}
+	}
+
+	status := doc.Status
+	if status == 0 {
+		status = iris.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case doc.ContentType != "":
+		success["content"] = map[string]any{doc.ContentType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+	case doc.Response != nil:
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(doc.Response))}}
+	}
+	op["responses"] = map[string]any{
+		strconv.Itoa(status): success,
+		"default": map[string]any{
+			"description": "Error",
+			"content":     map[string]any{"application/json": map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(apiError{}))}},
+		},
+	}
+	return op
+}
+
+// schemaBuilder turns Go types into JSON schemas following encoding/json's
+// rules. Named structs are collected under components/schemas.
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{components: map[string]any{}}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			b.components[t.Name()] = map[string]any{} // placeholder for recursive types
+			b.components[t.Name()] = b.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if embedded := f.Type; f.Anonymous && name == "" {
+			// encoding/json promotes the fields of an embedded struct.
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for key, schema := range b.structSchema(embedded)["properties"].(map[string]any) {
+					properties[key] = schema
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = b.schemaFor(f.Type)
+	}
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+var openAPISpec struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// openAPIJSON returns the encoded document. It is built once, on first use,
+// after every route group has registered its documentation.
+func openAPIJSON() ([]byte, error) {
+	openAPISpec.once.Do(func() {
+		openAPISpec.data, openAPISpec.err = json.MarshalIndent(buildOpenAPISpec(), "", "  ")
+	})
+	return openAPISpec.data, openAPISpec.err
+}
+
+// registerOpenAPIRoutes serves the document on GET /openapi.json.
+func registerOpenAPIRoutes(admin iris.Party) {
+	documentRoute(admin.Get("/openapi.json", func(ctx iris.Context) {
+		data, err := openAPIJSON()
+		if err != nil {
+			ctx.StatusCode(iris.StatusInternalServerError)
+			ctx.JSON(apiError{Error: err.Error()})
+			return
+		}
+		ctx.ContentType("application/json")
+		ctx.Write(data)
+	}), apiDoc{Summary: "This OpenAPI document", Response: map[string]any{}})
+}
+
+// dumpOpenAPI writes the document to args[0], or to stdout, for
+// `synergymatters_fax --dump-openapi [file]`. Routes that depend on
+// configuration, such as the fault endpoints, follow the environment.
+func dumpOpenAPI(args []string) int {
+	cfg, _ := readConfig(os.Getenv)
+	currentConfig.Store(&cfg)
+	initFaults()
+	data, err := openAPIJSON()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dump-openapi: %v\n", err)
+		return 1
+	}
+	data = append(data, '\n')
+	if len(args) == 0 || args[0] == "-" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(args[0], data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "dump-openapi: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// testOpenAPISpec builds the document with every optional route enabled.
+func testOpenAPISpec(t *testing.T) map[string]any {
+	t.Helper()
+	useTestConfig(t, map[string]string{"FAULTS_ENABLED": "true"})
+	initFaults()
+	t.Cleanup(initFaults)
+	data, err := json.Marshal(buildOpenAPISpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	spec := testOpenAPISpec(t)
+	paths := spec["paths"].(map[string]any)
+
+	groups := make([]string, 0, len(routeGroupRegistrars))
+	for group := range routeGroupRegistrars {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		app := iris.New()
+		routeGroupRegistrars[group](app)
+		for _, r := range app.GetRoutes() {
+			path := pathParamPattern.ReplaceAllString(r.Tmpl().Src, "{$1}")
+			ops, _ := paths[path].(map[string]any)
+			op, ok := ops[strings.ToLower(r.Method)].(map[string]any)
+			if !ok {
+				t.Errorf("%s %s (%s) is not in the document", r.Method, path, group)
+				continue
+			}
+			apiDocs.Lock()
+			_, documented := apiDocs.routes[r.Name]
+			apiDocs.Unlock()
+			if !documented || op["summary"] == nil {
+				t.Errorf("%s %s (%s) is not registered with documentRoute", r.Method, path, group)
+			}
+		}
+	}
+}
+
+func TestOpenAPIFixtures(t *testing.T) {
+	spec := testOpenAPISpec(t)
+	files, _ := filepath.Glob(filepath.Join("testdata", "openapi", "*.json"))
+	if len(files) == 0 {
+		t.Fatal("no fixtures in testdata/openapi")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			opID, kind, _ := strings.Cut(strings.TrimSuffix(filepath.Base(file), ".json"), ".")
+			schema := operationSchema(t, spec, opID, kind)
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v any
+			if err := json.Unmarshal(data, &v); err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range validateSchema(spec, schema, v, "$") {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+// TestOpenAPIValidator checks that the validator the fixtures rely on
+// catches the drift it is there for.
+func TestOpenAPIValidator(t *testing.T) {
+	spec := testOpenAPISpec(t)
+	tests := []struct {
+		name    string
+		opID    string
+		kind    string
+		payload string
+		wantErr string // substring of the first problem, or "" for none
+	}{
+		{name: "valid", opID: "post_jobs_id_approve", kind: "request", payload: `{"comment":"Confirmed with the pharmacy"}`},
+		{name: "renamed field", opID: "post_jobs_id_approve", kind: "request", payload: `{"approved_by":"jsmith"}`, wantErr: "$.approved_by"},
+		{name: "wrong type", opID: "post_fax-receive", kind: "request", payload: `{"uuid":"x","totdials":"1"}`, wantErr: "$.totdials"},
+		{name: "fraction for an integer", opID: "post_fax-receive", kind: "request", payload: `{"totdials":1.5}`, wantErr: "$.totdials"},
+		{name: "nested", opID: "post_fax-notify", kind: "request", payload: `{"fax_job_results":{"results":{"1":{"result":{"success":"yes"}}}}}`,
+			wantErr: "$.fax_job_results.results.1.result.success"},
+		{name: "bad date-time", opID: "post_fax-receive", kind: "response", payload: `{"received_at":"yesterday"}`, wantErr: "$.received_at"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			if err := json.Unmarshal([]byte(tt.payload), &v); err != nil {
+				t.Fatal(err)
+			}
+			problems := validateSchema(spec, operationSchema(t, spec, tt.opID, tt.kind), v, "$")
+			switch {
+			case tt.wantErr == "" && len(problems) > 0:
+				t.Errorf("problems %q, want none", problems)
+			case tt.wantErr != "" && (len(problems) == 0 || !strings.Contains(problems[0], tt.wantErr)):
+				t.Errorf("problems %q, want one about %s", problems, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestOpenAPIResponses validates responses the handlers actually send.
+func TestOpenAPIResponses(t *testing.T) {
+	spec := testOpenAPISpec(t)
+	recordDeliveryOutcome(false, true, 42*time.Second)
+	t.Cleanup(func() {
+		deliveryOutcomes.Lock()
+		deliveryOutcomes.outcomes = nil
+		deliveryOutcomes.Unlock()
+	})
+	tests := []struct {
+		opID     string
+		register func(app *iris.Application)
+		path     string
+	}{
+		{opID: "get_status_public", register: registerPublicRoutes, path: "/status/public"},
+		{opID: "get_admin_holds", register: registerAdminRoutes, path: "/admin/holds"},
+		{opID: "get_cache", register: registerAdminRoutes, path: "/cache"},
+		{opID: "get_jobs", register: registerAdminRoutes, path: "/jobs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.opID, func(t *testing.T) {
+			rec := serveTestRequest(t, tt.register, asAdmin(httptest.NewRequest("GET", tt.path, nil)))
+			if rec.Code != 200 {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var v any
+			if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range validateSchema(spec, operationSchema(t, spec, tt.opID, "response"), v, "$") {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+// operationSchema returns the JSON request or success response schema of
+// the operation with the given ID.
+func operationSchema(t *testing.T, spec map[string]any, opID, kind string) map[string]any {
+	t.Helper()
+	for _, ops := range spec["paths"].(map[string]any) {
+		for _, op := range ops.(map[string]any) {
+			op := op.(map[string]any)
+			if op["operationId"] != opID {
+				continue
+			}
+			var body map[string]any
+			switch kind {
+			case "request":
+				body, _ = op["requestBody"].(map[string]any)
+			case "response":
+				for status, resp := range op["responses"].(map[string]any) {
+					if status != "default" {
+						body = resp.(map[string]any)
+					}
+				}
+			}
+			content, _ := body["content"].(map[string]any)
+			media, _ := content["application/json"].(map[string]any)
+			schema, ok := media["schema"].(map[string]any)
+			if !ok {
+				t.Fatalf("%s has no JSON %s schema", opID, kind)
+			}
+			return schema
+		}
+	}
+	t.Fatalf("no operation %s", opID)
+	return nil
+}
+
+// validateSchema checks v against the subset of JSON Schema the document
+// uses. Properties a schema does not list are reported, so renamed and
+// removed fields show up.
+func validateSchema(spec, schema map[string]any, v any, path string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := spec["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: unresolved %s", path, ref)}
+		}
+		return validateSchema(spec, resolved, v, path)
+	}
+	if v == nil {
+		return nil // encoding/json writes nil slices, maps and pointers as null
+	}
+	mismatch := func() []string {
+		return []string{fmt.Sprintf("%s: %v does not match %v", path, v, schema)}
+	}
+	switch schema["type"] {
+	case nil:
+		return nil
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		props, _ := schema["properties"].(map[string]any)
+		extra, _ := schema["additionalProperties"].(map[string]any)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var problems []string
+		for _, key := range keys {
+			child, ok := props[key].(map[string]any)
+			if !ok {
+				child = extra
+			}
+			if child == nil {
+				problems = append(problems, fmt.Sprintf("%s.%s: not in the schema", path, key))
+				continue
+			}
+			problems = append(problems, validateSchema(spec, child, obj[key], path+"."+key)...)
+		}
+		return problems
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return mismatch()
+		}
+		var problems []string
+		for i, item := range items {
+			problems = append(problems, validateSchema(spec, schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return problems
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return mismatch()
+		}
+		switch schema["format"] {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return mismatch()
+			}
+		case "byte":
+			if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+				return mismatch()
+			}
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			return mismatch()
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return mismatch()
+		}
+	}
+	return nil
+}
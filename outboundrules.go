@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// OUTBOUND_RULES_FILE restricts where faxes may be sent. The file is JSON:
+//
+//	{
+//	  "deny":  [{"prefix": "+1900"}, {"regex": "^\\+88[0-9]", "comment": "satellite"}],
+//	  "allow": [{"prefix": "+1"}],
+//	  "default": "deny"
+//	}
+//
+// Destinations, normalized to E.164, are checked against the deny rules first
+// and then the allow rules; the first rule that matches decides. A destination
+// no rule matches gets "default", which is "deny" when there are allow rules
+// and "allow" otherwise. The file is re-read on SIGHUP.
+
+// outboundRule is one entry of the rules file. Exactly one of Prefix and
+// Regex is set.
+type outboundRule struct {
+	Prefix  string `json:"prefix,omitempty"`
+	Regex   string `json:"regex,omitempty"`
+	Comment string `json:"comment,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type outboundRulesFile struct {
+	Deny    []outboundRule `json:"deny"`
+	Allow   []outboundRule `json:"allow"`
+	Default string         `json:"default"` // "allow" or "deny"
+}
+
+func (r outboundRule) String() string {
+	if r.re != nil {
+		return "regex " + r.Regex
+	}
+	return "prefix " + r.Prefix
+}
+
+func (r outboundRule) matches(number string) bool {
+	if r.re != nil {
+		return r.re.MatchString(number)
+	}
+	return strings.HasPrefix(number, r.Prefix)
+}
+
+var outboundRules = struct {
+	sync.Mutex
+	rules *outboundRulesFile // nil when OUTBOUND_RULES_FILE is not set
+}{}
+
+var faxesBlocked = expvar.NewInt("faxes_blocked_by_policy")
+
+// errDestinationBlocked is returned by submitFax for a blocked destination.
+var errDestinationBlocked = errors.New("destination blocked by policy")
+
+// loadOutboundRules reads OUTBOUND_RULES_FILE, if set. On error the rules in
+// effect are kept.
+func loadOutboundRules() error {
+	path := config().OutboundRulesFile
+	if path == "" {
+		outboundRules.Lock()
+		outboundRules.rules = nil
+		outboundRules.Unlock()
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var rules outboundRulesFile
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	for _, list := range []struct {
+		name  string
+		rules []outboundRule
+	}{{"deny", rules.Deny}, {"allow", rules.Allow}} {
+		for i := range list.rules {
+			r := &list.rules[i]
+			if (r.Prefix == "") == (r.Regex == "") {
+				return fmt.Errorf("%s: %s rule %d must have either prefix or regex", path, list.name, i+1)
+			}
+			if r.Regex != "" {
+				if r.re, err = regexp.Compile(r.Regex); err != nil {
+					return fmt.Errorf("%s: %s rule %d: %w", path, list.name, i+1, err)
+				}
+			}
+		}
+	}
+	switch rules.Default {
+	case "":
+		rules.Default = "allow"
+		if len(rules.Allow) > 0 {
+			rules.Default = "deny"
+		}
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("%s: default must be allow or deny, not %q", path, rules.Default)
+	}
+
+	outboundRules.Lock()
+	outboundRules.rules = &rules
+	outboundRules.Unlock()
+	slog.Info("Loaded outbound rules", "deny", len(rules.Deny), "allow", len(rules.Allow), "default", rules.Default, "file", path)
+	return nil
+}
+
+// checkDestination reports whether number may be dialled, and why.
+func checkDestination(number string) (bool, string) {
+	outboundRules.Lock()
+	rules := outboundRules.rules
+	outboundRules.Unlock()
+	if rules == nil {
+		return true, ""
+	}
+	for _, r := range rules.Deny {
+		if r.matches(number) {
+			return false, "deny " + r.String()
+		}
+	}
+	for _, r := range rules.Allow {
+		if r.matches(number) {
+			return true, "allow " + r.String()
+		}
+	}
+	return rules.Default == "allow", "default " + rules.Default
+}
+
+// checkDestinations checks every destination on a normalized number line. It
+// returns the first blocked number and the rule that blocked it.
+func checkDestinations(line string) (blocked, rule string) {
+	for _, number := range splitFaxNumbers(line) {
+		if ok, rule := checkDestination(number); !ok {
+			return number, rule
+		}
+	}
+	return "", ""
+}
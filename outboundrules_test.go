@@ -0,0 +1,147 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestOutboundRules puts a configuration read from env in effect, like
+// useTestConfig, and loads rules, a JSON rules file, for the test.
+func useTestOutboundRules(t *testing.T, env map[string]string, rules string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeTestFile(t, path, rules)
+	settings := map[string]string{"MIN_FREE_DISK_MB": "0", "OUTBOUND_RULES_FILE": path}
+	for k, v := range env {
+		settings[k] = v
+	}
+	cfg := useTestConfig(t, settings)
+	t.Cleanup(func() {
+		outboundRules.Lock()
+		outboundRules.rules = nil
+		outboundRules.Unlock()
+	})
+	if err := loadOutboundRules(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestCheckDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		number  string
+		allowed bool
+		rule    string
+	}{
+		{name: "deny before allow", rules: `{"deny":[{"prefix":"+1900"}],"allow":[{"prefix":"+1"}]}`,
+			number: "+19005551234", rule: "deny prefix +1900"},
+		{name: "allowed", rules: `{"deny":[{"prefix":"+1900"}],"allow":[{"prefix":"+1"}]}`,
+			number: "+16045551234", allowed: true, rule: "allow prefix +1"},
+		{name: "allow list implies default deny", rules: `{"allow":[{"prefix":"+1"}]}`,
+			number: "+442079460000", rule: "default deny"},
+		{name: "deny list implies default allow", rules: `{"deny":[{"prefix":"+1900"}]}`,
+			number: "+442079460000", allowed: true, rule: "default allow"},
+		{name: "explicit default", rules: `{"deny":[{"prefix":"+1900"}],"default":"deny"}`,
+			number: "+16045551234", rule: "default deny"},
+		{name: "first deny rule wins", rules: `{"deny":[{"regex":"^\\+88[0-9]"},{"prefix":"+881"}]}`,
+			number: "+8816123456", rule: "deny regex ^\\+88[0-9]"},
+		{name: "first allow rule wins", rules: `{"allow":[{"prefix":"+1604"},{"prefix":"+1"}]}`,
+			number: "+16045551234", allowed: true, rule: "allow prefix +1604"},
+		{name: "allow cannot override deny", rules: `{"allow":[{"prefix":"+1900555"}],"deny":[{"prefix":"+1900"}]}`,
+			number: "+19005551234", rule: "deny prefix +1900"},
+		{name: "regex allow", rules: `{"allow":[{"regex":"^\\+1(604|778)"}]}`,
+			number: "+17785551234", allowed: true, rule: "allow regex ^\\+1(604|778)"},
+		{name: "no rules", rules: `{}`, number: "+19005551234", allowed: true, rule: "default allow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestOutboundRules(t, nil, tt.rules)
+			allowed, rule := checkDestination(tt.number)
+			if allowed != tt.allowed || rule != tt.rule {
+				t.Errorf("checkDestination(%q) = %v, %q; want %v, %q", tt.number, allowed, rule, tt.allowed, tt.rule)
+			}
+		})
+	}
+}
+
+func TestLoadOutboundRulesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{name: "not JSON", rules: `deny +1900`},
+		{name: "prefix and regex", rules: `{"deny":[{"prefix":"+1900","regex":"^\\+1900"}]}`},
+		{name: "neither prefix nor regex", rules: `{"allow":[{"comment":"empty"}]}`},
+		{name: "bad regex", rules: `{"deny":[{"regex":"^(+1900"}]}`},
+		{name: "bad default", rules: `{"default":"block"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestOutboundRules(t, nil, `{"deny":[{"prefix":"+1900"}]}`)
+			writeTestFile(t, cfg.OutboundRulesFile, tt.rules)
+			if err := loadOutboundRules(); err == nil {
+				t.Fatal("loadOutboundRules() succeeded")
+			}
+			if allowed, _ := checkDestination("+19005551234"); allowed {
+				t.Error("the rules in effect were dropped")
+			}
+		})
+	}
+}
+
+// TestOutboundRulesReload changes the rules file and reloads it, as SIGHUP does.
+func TestOutboundRulesReload(t *testing.T) {
+	cfg := useTestOutboundRules(t, nil, `{"deny":[{"prefix":"+1900"}]}`)
+	if allowed, _ := checkDestination("+442079460000"); !allowed {
+		t.Fatal("blocked before the reload")
+	}
+	writeTestFile(t, cfg.OutboundRulesFile, `{"allow":[{"prefix":"+1"}]}`)
+	if err := loadOutboundRules(); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _ := checkDestination("+442079460000"); allowed {
+		t.Error("allowed after the reload")
+	}
+}
+
+func TestSubmitFaxBlocked(t *testing.T) {
+	tests := []struct {
+		name    string
+		number  string
+		blocked bool
+	}{
+		{name: "blocked", number: "1-900-555-1234", blocked: true},
+		{name: "one destination of a broadcast", number: "6045551234,19005551234", blocked: true},
+		{name: "allowed", number: "6045551234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestOutboundRules(t, map[string]string{"SEND_WEBHOOK_RETRIES": "1"}, `{"deny":[{"prefix":"+1900"}]}`)
+			dir := cfg.FTPRoot + FaxDir
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), tt.number+"\nfax0001.pdf\n")
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+			blocked := faxesBlocked.Value()
+
+			job := SfcJob{FaxNumber: tt.number, PdfFile: "fax0001.pdf"}
+			_, err := submitFax(job, filepath.Join(dir, "fax0001.pdf"), "fax0001.sfc", "fax0001", "42")
+			if got := err == errDestinationBlocked; got != tt.blocked {
+				t.Fatalf("err = %v, want blocked %v", err, tt.blocked)
+			}
+			if got := faxesBlocked.Value() - blocked; got != map[bool]int64{true: 1}[tt.blocked] {
+				t.Errorf("faxes_blocked_by_policy went up by %d", got)
+			}
+			if !tt.blocked {
+				return
+			}
+			if !fileExists(filepath.Join(dir, "q42.fail")) {
+				t.Error("no q42.fail")
+			}
+			if sts := stsFields(t, "42"); sts["state"] != stsStateFailed || !strings.Contains(sts["status"], "destination blocked by policy") {
+				t.Errorf(".sts state %q status %q", sts["state"], sts["status"])
+			}
+		})
+	}
+}
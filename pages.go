@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// Page counts fill the npages and totpages lines of the .sts. A PDF is
+// counted by its /Type /Page objects, or failing that by the largest /Count
+// of its page tree, since objects packed in compressed object streams cannot
+// be seen without a full parser. A TIFF is counted by its chain of image file
+// directories. 0 means the count is unknown.
+
+var (
+	pdfPageObject = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfPageCount  = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+)
+
+// maxTIFFPages bounds the IFD walk of a malformed TIFF.
+const maxTIFFPages = 10000
+
+// countDocumentPages returns the number of pages of a PDF or TIFF.
+func countDocumentPages(data []byte) int {
+	switch sniffDocumentType(data) {
+	case contentTypePDF:
+		return countPDFPages(data)
+	case contentTypeTIFF:
+		return countTIFFPages(data)
+	}
+	return 0
+}
+
+func countPDFPages(data []byte) int {
+	if n := len(pdfPageObject.FindAllIndex(data, -1)); n > 0 {
+		return n
+	}
+	pages := 0
+	for _, m := range pdfPageCount.FindAllSubmatch(data, -1) {
+		count := m[1]
+		if count == nil {
+			count = m[2]
+		}
+		if n, err := strconv.Atoi(string(count)); err == nil && n > pages {
+			pages = n
+		}
+	}
+	return pages
+}
+
+func countTIFFPages(data []byte) int {
+	if len(data) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if bytes.HasPrefix(data, []byte("MM")) {
+		order = binary.BigEndian
+	}
+	pages := 0
+	seen := make(map[uint32]bool)
+	for offset := order.Uint32(data[4:8]); offset != 0 && pages < maxTIFFPages; pages++ {
+		if seen[offset] || int(offset)+2 > len(data) {
+			break
+		}
+		seen[offset] = true
+		entries := int(order.Uint16(data[offset:]))
+		next := int(offset) + 2 + entries*12
+		if next+4 > len(data) {
+			pages++
+			break
+		}
+		offset = order.Uint32(data[next:])
+	}
+	return pages
+}
+
+// countFilePages returns the number of pages of the document at path.
+func countFilePages(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	return countDocumentPages(data)
+}
+
+// pagesField formats a page count for the .sts, leaving an unknown count
+// unchanged.
+func pagesField(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCountDocumentPages(t *testing.T) {
+	tests := []struct {
+		file  string
+		pages int
+	}{
+		{file: "one-page.pdf", pages: 1},
+		{file: "three-pages.pdf", pages: 3},
+		{file: "forty-pages.pdf", pages: 40},
+		// Page objects packed in a compressed object stream are counted by
+		// the page tree's /Count.
+		{file: "twelve-pages-objstm.pdf", pages: 12},
+		{file: "two-pages.tif", pages: 2},
+		{file: "three-pages-be.tif", pages: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join("testdata", "pages", tt.file)
+			if got := countFilePages(path); got != tt.pages {
+				t.Errorf("countFilePages() = %d, want %d", got, tt.pages)
+			}
+		})
+	}
+}
+
+func TestCountDocumentPagesUnknown(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "not a document", data: "hello"},
+		{name: "PDF without pages", data: "%PDF-1.4\n"},
+		{name: "truncated TIFF", data: "II*\x00"},
+		{name: "TIFF without IFDs", data: "II*\x00\x00\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countDocumentPages([]byte(tt.data)); got != 0 {
+				t.Errorf("countDocumentPages() = %d, want 0", got)
+			}
+		})
+	}
+	// An IFD chain that loops back on itself stops at the repeated IFD.
+	loop := []byte("II*\x00\x08\x00\x00\x00\x00\x00\x08\x00\x00\x00")
+	if got := countDocumentPages(loop); got != 1 {
+		t.Errorf("looping TIFF counted %d pages, want 1", got)
+	}
+}
+
+func TestStsPages(t *testing.T) {
+	tests := []struct {
+		file     string
+		result   string // result fields of the notify
+		npages   string
+		totpages string
+	}{
+		{file: "three-pages.pdf", result: `"pages_sent":3,"total_pages":3`, npages: "3", totpages: "3"},
+		{file: "forty-pages.pdf", result: `"pages_sent":40,"total_pages":40`, npages: "40", totpages: "40"},
+		// Without provider counts a success sends the pages counted on submit.
+		{file: "twelve-pages-objstm.pdf", npages: "12", totpages: "12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"job_uuid":"job-uuid"}`)
+			}))
+			defer server.Close()
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL, "SEND_WEBHOOK_RETRIES": "1"})
+			dir := cfg.FTPRoot + FaxDir
+			data, err := os.ReadFile(filepath.Join("testdata", "pages", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pdfPath := filepath.Join(dir, "fax0001.pdf")
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+			writeTestFile(t, pdfPath, string(data))
+
+			if _, err := deliverFax("+16045551234", "", "fax0001.pdf", pdfPath, "fax0001.sfc", "", "fax0001", "42", 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			if sts := stsFields(t, "42"); sts["totpages"] != tt.totpages {
+				t.Errorf("after submit .sts totpages %q, want %q", sts["totpages"], tt.totpages)
+			}
+
+			result := `"success":true`
+			if tt.result != "" {
+				result += "," + tt.result
+			}
+			body := `{"fax_job_results":{"fax_job":{"uuid":"job-uuid","status":"completed"},` +
+				`"results":{"1":{"uuid":"job-uuid","status":"completed","result":{` + result + `}}}}}`
+			req := httptest.NewRequest("POST", "/fax-notify", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if rec := serveTestRequest(t, registerProviderRoutes, req); rec.Code != 200 {
+				t.Fatalf("notify status %d: %s", rec.Code, rec.Body)
+			}
+			sts := stsFields(t, "42")
+			if sts["state"] != stsStateDone || sts["npages"] != tt.npages || sts["totpages"] != tt.totpages {
+				t.Errorf(".sts state %q npages %q totpages %q, want %q %q %q",
+					sts["state"], sts["npages"], sts["totpages"], stsStateDone, tt.npages, tt.totpages)
+			}
+		})
+	}
+}
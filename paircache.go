@@ -0,0 +1,233 @@
+package main
+
+import (
+	"expvar"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// An .sfc whose PDF has not been uploaded waits in cache.sfc, and a PDF whose
+// .sfc has not, in cache.pdf. A pair that never completes, such as an .sfc
+// naming a PDF with a typo, is evicted after PAIR_TIMEOUT: the orphan .sfc
+// is failed with "missing PDF <name>", so Synergy sees a .fail, and an orphan
+// PDF is forgotten and left for the retention janitor. GET /cache lists the
+// unmatched entries and DELETE /cache/{key} evicts one straight away.
+//
+// Well before that, an entry unmatched for PAIR_ALERT_AFTER raises an alert,
+// once: an error naming the file Synergy has not uploaded, the metric
+// pair_cache_alerts and an "unmatched" event for EVENT_WEBHOOK_URL.
+
+var (
+	pairCacheEvictions = expvar.NewInt("pair_cache_evictions")
+	pairCacheAlerts    = expvar.NewInt("pair_cache_alerts")
+)
+
+func init() {
+	expvar.Publish("pair_cache_sfc", expvar.Func(func() any {
+		cache.Lock()
+		defer cache.Unlock()
+		return len(cache.sfc)
+	}))
+	expvar.Publish("pair_cache_pdf", expvar.Func(func() any {
+		cache.Lock()
+		defer cache.Unlock()
+		return len(cache.pdf)
+	}))
+}
+
+// pairCacheEntry is an unmatched entry as GET /cache shows it.
+type pairCacheEntry struct {
+	Key        string    `json:"key"` // the PDF file name
+	File       string    `json:"file"`
+	Number     string    `json:"number,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Since      time.Time `json:"since"`
+	AgeSeconds int64     `json:"age_seconds"`
+}
+
+// startPairExpiry alerts on unmatched entries older than PAIR_ALERT_AFTER
+// and evicts those older than PAIR_TIMEOUT, every minute.
+func startPairExpiry() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			cfg := config()
+			if cfg.PairAlertAfter > 0 {
+				alertUnmatchedPairs(time.Now().Add(-cfg.PairAlertAfter))
+			}
+			if cfg.PairTimeout > 0 {
+				expirePairCache(time.Now().Add(-cfg.PairTimeout))
+			}
+		}
+	}()
+}
+
+// alertUnmatchedPairs raises the alert for each entry cached before cutoff
+// that has not had one.
+func alertUnmatchedPairs(cutoff time.Time) {
+	var events []faxEvent
+	cache.Lock()
+	for key, entry := range cache.sfc {
+		if entry.alerted || !entry.cachedAt.Before(cutoff) {
+			continue
+		}
+		entry.alerted = true
+		cache.sfc[key] = entry
+		slog.Error("PDF has not been uploaded for .sfc", "file", entry.sfcFile, "pdf", key, "number", entry.FaxNumber,
+			"user", entry.User, "waited", time.Since(entry.cachedAt).Round(time.Second))
+		events = append(events, faxEvent{Type: eventUnmatched, Direction: "outbound", SynergyJobID: entry.jobID,
+			User: entry.User, To: entry.FaxNumber, File: filepath.Base(entry.sfcFile), Status: "waiting for " + key,
+			Error: "missing PDF " + key})
+	}
+	for key, pdf := range cache.pdf {
+		if pdf.alerted || !pdf.cachedAt.Before(cutoff) {
+			continue
+		}
+		pdf.alerted = true
+		cache.pdf[key] = pdf
+		slog.Error("No .sfc has been uploaded for PDF", "file", pdf.path, "waited", time.Since(pdf.cachedAt).Round(time.Second))
+		events = append(events, faxEvent{Type: eventUnmatched, Direction: "outbound", File: key,
+			Status: "waiting for its .sfc", Error: "missing .sfc for " + key})
+	}
+	cache.Unlock()
+
+	for _, e := range events {
+		pairCacheAlerts.Add(1)
+		queueFaxEvent(e)
+	}
+}
+
+// expirePairCache evicts the entries cached before cutoff.
+func expirePairCache(cutoff time.Time) {
+	var sfcs []sfcFile
+	var pdfs []string
+	cache.Lock()
+	for key, entry := range cache.sfc {
+		if entry.cachedAt.Before(cutoff) {
+			sfcs = append(sfcs, takeCachedSfc(key))
+		}
+	}
+	for key, pdf := range cache.pdf {
+		if pdf.cachedAt.Before(cutoff) {
+			delete(cache.pdf, key)
+			pdfs = append(pdfs, pdf.path)
+		}
+	}
+	cache.Unlock()
+
+	for _, entry := range sfcs {
+		slog.Warn("PDF never arrived; failing the .sfc", "file", entry.sfcFile, "pdf", entry.PdfFile,
+			"waited", time.Since(entry.cachedAt).Round(time.Second))
+		failOrphanSfc(entry)
+	}
+	for _, path := range pdfs {
+		pairCacheEvictions.Add(1)
+		slog.Warn("No .sfc arrived for PDF; forgetting it", "file", path)
+	}
+}
+
+// takeCachedSfc removes the .sfc waiting for the PDF key and marks it in
+// flight until failOrphanSfc is done with it. Callers hold cache.
+func takeCachedSfc(key string) sfcFile {
+	entry := cache.sfc[key]
+	delete(cache.sfc, key)
+	releaseHold(holdPdfWait, key)
+	cache.inFlight[filepath.Base(entry.sfcFile)] = true
+	return entry
+}
+
+// takeWaitingSfc removes the .sfc of hylaJobID if it is waiting for its PDF.
+func takeWaitingSfc(hylaJobID string) (sfcFile, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	for key, entry := range cache.sfc {
+		if entry.hylaJobID == hylaJobID {
+			delete(cache.sfc, key)
+			releaseHold(holdPdfWait, key)
+			return entry, true
+		}
+	}
+	return sfcFile{}, false
+}
+
+// failOrphanSfc fails an .sfc whose PDF never arrived under the Hylafax job
+// ID it was given on arrival. It returns false if the .sfc is gone.
+func failOrphanSfc(entry sfcFile) bool {
+	sfcFileName := filepath.Base(entry.sfcFile)
+	defer releaseInFlight(sfcFileName)
+	pairCacheEvictions.Add(1)
+	if _, err := os.Stat(entry.sfcFile); err != nil {
+		return false // removed by Synergy meanwhile
+	}
+	failJob(entry.hylaJobID, "missing PDF "+entry.PdfFile, entry.sfcFile)
+	return true
+}
+
+// pairCacheEntries returns the unmatched .sfc and PDF entries, oldest first.
+func pairCacheEntries() (sfcs, pdfs []pairCacheEntry) {
+	now := time.Now()
+	sfcs, pdfs = []pairCacheEntry{}, []pairCacheEntry{}
+	cache.Lock()
+	for key, entry := range cache.sfc {
+		sfcs = append(sfcs, pairCacheEntry{Key: key, File: entry.sfcFile, Number: entry.FaxNumber, User: entry.User,
+			Since: entry.cachedAt, AgeSeconds: int64(now.Sub(entry.cachedAt).Seconds())})
+	}
+	for key, pdf := range cache.pdf {
+		pdfs = append(pdfs, pairCacheEntry{Key: key, File: pdf.path, Since: pdf.cachedAt,
+			AgeSeconds: int64(now.Sub(pdf.cachedAt).Seconds())})
+	}
+	cache.Unlock()
+	for _, entries := range [][]pairCacheEntry{sfcs, pdfs} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Since.Before(entries[j].Since) })
+	}
+	return sfcs, pdfs
+}
+
+func registerPairCacheRoutes(admin iris.Party) {
+	documentRoute(admin.Get("/cache", func(ctx iris.Context) {
+		sfcs, pdfs := pairCacheEntries()
+		ctx.JSON(iris.Map{"sfc": sfcs, "pdf": pdfs})
+	}), apiDoc{Summary: "The .sfc files waiting for their PDF and the PDFs waiting for their .sfc, oldest first", Response: struct {
+		Sfc []pairCacheEntry `json:"sfc"`
+		Pdf []pairCacheEntry `json:"pdf"`
+	}{}})
+
+	documentRoute(admin.Delete("/cache/{key}", func(ctx iris.Context) {
+		key := ctx.Params().Get("key")
+		actor := requestActor(ctx)
+		if actor == "" {
+			actor = ctx.RemoteAddr()
+		}
+		cache.Lock()
+		_, isSfc := cache.sfc[key]
+		var entry sfcFile
+		if isSfc {
+			entry = takeCachedSfc(key)
+		}
+		pdf, isPdf := cache.pdf[key]
+		delete(cache.pdf, key)
+		cache.Unlock()
+
+		if !isSfc && !isPdf {
+			ctx.StatusCode(iris.StatusNotFound)
+			ctx.JSON(iris.Map{"error": "no unmatched .sfc or PDF for " + key})
+			return
+		}
+		var evicted []string
+		failed := false
+		if isSfc {
+			slog.Warn("Unmatched .sfc removed from the pairing cache; failing it", "file", entry.sfcFile, "pdf", key, "actor", actor)
+			failed = failOrphanSfc(entry)
+			evicted = append(evicted, entry.sfcFile)
+		}
+		if isPdf {
+			pairCacheEvictions.Add(1)
+			slog.Warn("Unmatched PDF removed from the pairing cache", "file", pdf.path, "actor", actor)
+			evicted = append(evicted, pdf.path)
+		}
+		ctx.JSON(iris.Map{"key": key, "evicted": evicted, "sfc_failed": failed})
+	}), apiDoc{Summary: "Evict an unmatched entry by PDF file name, failing a waiting .sfc with \"missing PDF\"", Response: iris.Map{}})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fax records, in-flight outbound jobs, open broadcasts, held jobs and the
+// UUIDs of notify results that completed a job are persisted to
+// DATA_DIR/state.json after every change, so a notify that arrives after a
+// restart still finds its job and produces the .done or .fail file Synergy is
+// waiting for, and held jobs are handed back to their components.
+
+// persistedJob is a jobQueue entry as stored on disk.
+type persistedJob struct {
+	JobUUID      string    `json:"job_uuid"`
+	HylaJobID    string    `json:"hyla_job_id"`
+	SynergyJobID string    `json:"synergy_job_id,omitempty"`
+	PdfPath      string    `json:"pdf_path"`
+	SfcPath      string    `json:"sfc_path"`
+	User         string    `json:"user,omitempty"`
+	PartFilename string    `json:"part_filename,omitempty"`
+	PartType     string    `json:"part_type,omitempty"`
+	Credential   string    `json:"credential,omitempty"`
+	Route        string    `json:"route,omitempty"`
+	Pages        int       `json:"pages,omitempty"`
+	Dials        int       `json:"dials,omitempty"`
+	Tries        int       `json:"tries,omitempty"`
+	AcceptedAt   time.Time `json:"accepted_at"`
+	FaxUUID      string    `json:"fax_uuid,omitempty"`
+	CallUUID     string    `json:"call_uuid,omitempty"`
+
+	BroadcastIndex int `json:"broadcast_index,omitempty"`
+}
+
+type persistedState struct {
+	Records map[string]*FaxJobRecord `json:"records"`
+	Jobs    []persistedJob           `json:"jobs"`
+	Holds   []heldJob                `json:"holds"`
+
+	Broadcasts []broadcastJob       `json:"broadcasts,omitempty"`
+	Resolved   map[string]time.Time `json:"resolved_notifies,omitempty"`
+}
+
+// stateSaveMutex serializes writers of the state file.
+var stateSaveMutex sync.Mutex
+
+func statePath() string {
+	return filepath.Join(config().DataDir, "state.json")
+}
+
+// saveState writes faxRecords, jobQueue, the open broadcasts and the held
+// jobs to disk. Callers must not hold faxRecordsMutex, jobQueue, broadcasts or
+// holds.
+func saveState() {
+	stateSaveMutex.Lock()
+	defer stateSaveMutex.Unlock()
+	applyJobStatuses()
+
+	faxRecordsMutex.Lock()
+	jobQueue.Lock()
+	state := persistedState{Records: faxRecords, Jobs: make([]persistedJob, 0, len(jobQueue.entries))}
+	for jobUUID, job := range jobQueue.entries {
+		state.Jobs = append(state.Jobs, persistedJob{
+			JobUUID:      jobUUID,
+			HylaJobID:    job.hylaJobID,
+			SynergyJobID: job.synergyJobID,
+			PdfPath:      job.pdfPath,
+			SfcPath:      job.sfcPath,
+			User:         job.user,
+			PartFilename: job.partFilename,
+			PartType:     job.partType,
+			Credential:   job.credential,
+			Route:        job.route,
+			Pages:        job.pages,
+			Dials:        job.dials,
+			Tries:        job.tries,
+			AcceptedAt:   job.acceptedAt,
+			FaxUUID:      job.faxUUID,
+			CallUUID:     job.callUUID,
+
+			BroadcastIndex: job.broadcastIndex,
+		})
+	}
+	state.Holds = heldJobs()
+	state.Broadcasts = snapshotBroadcasts()
+	state.Resolved = snapshotResolvedNotifies()
+	data, err := json.Marshal(state)
+	jobQueue.Unlock()
+	faxRecordsMutex.Unlock()
+	if err != nil {
+		slog.Error("Error encoding fax state", "err", err)
+		return
+	}
+
+	if err := os.MkdirAll(config().DataDir, 0755); err != nil {
+		slog.Error("Error saving fax state", "err", err)
+		return
+	}
+	tmp := statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		slog.Error("Error saving fax state", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, statePath()); err != nil {
+		slog.Error("Error saving fax state", "err", err)
+	}
+}
+
+// loadState restores faxRecords, jobQueue, broadcasts and held jobs. Outbound jobs accepted
+// more than JOB_STATE_TTL ago are failed, and records last updated before then
+// are dropped.
+func loadState() error {
+	data, err := os.ReadFile(statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", statePath(), err)
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("error parsing %s: %w", statePath(), err)
+	}
+
+	cutoff := time.Now().Add(-config().JobStateTTL)
+	var expired []persistedJob
+
+	faxRecordsMutex.Lock()
+	for key, record := range state.Records {
+		if record.LastUpdatedAt.Before(cutoff) {
+			continue
+		}
+		faxRecords[key] = record
+	}
+	restoreInboundContent()
+	restoredRecords := len(faxRecords)
+	faxRecordsMutex.Unlock()
+
+	jobQueue.Lock()
+	for _, job := range state.Jobs {
+		setJobDir(job.HylaJobID, filepath.Dir(job.SfcPath))
+		if job.AcceptedAt.Before(cutoff) {
+			expired = append(expired, job)
+			continue
+		}
+		jobQueue.entries[job.JobUUID] = jobQ{
+			hylaJobID:    job.HylaJobID,
+			synergyJobID: job.SynergyJobID,
+			pdfPath:      job.PdfPath,
+			sfcPath:      job.SfcPath,
+			user:         job.User,
+			partFilename: job.PartFilename,
+			partType:     job.PartType,
+			credential:   job.Credential,
+			route:        job.Route,
+			pages:        job.Pages,
+			dials:        job.Dials,
+			tries:        job.Tries,
+			acceptedAt:   job.AcceptedAt,
+			faxUUID:      job.FaxUUID,
+			callUUID:     job.CallUUID,
+
+			broadcastIndex: job.BroadcastIndex,
+		}
+	}
+	restoredJobs := len(jobQueue.entries)
+	jobQueue.Unlock()
+
+	slog.Info("Restored fax state", "records", restoredRecords, "jobs", restoredJobs, "file", statePath())
+
+	restoreBroadcasts(state.Broadcasts)
+	restoreResolvedNotifies(state.Resolved)
+
+	for _, job := range expired {
+		slog.Warn("Fax job got no notify before JOB_STATE_TTL; marking failed", "job_id", job.HylaJobID, "uuid", job.JobUUID, "ttl", config().JobStateTTL)
+		if job.BroadcastIndex > 0 {
+			resolveBroadcastDestination(job.HylaJobID, job.BroadcastIndex-1, false, "failed: no result from provider")
+			continue
+		}
+		deadLetterJob(job.HylaJobID, "failed: no result from provider", "", job.SfcPath, job.PdfPath)
+	}
+	if len(expired) > 0 {
+		saveState()
+	}
+
+	restoreHolds(state.Holds)
+	return nil
+}
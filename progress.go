@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// The provider notifies progress while a fax is transmitted, not only its
+// result. NOTIFY_PROGRESS_STATES maps those status strings to the Hylafax
+// state written to the job's .sts, e.g. "dialing=3,sending=6"; statuses are
+// matched case-insensitively. A notify whose status is in the map updates the
+// .sts of the job it refers to and leaves the job queued; any other status is
+// the job's result, as before. STATUS_MAP_FILE entries take precedence (see
+// statusmap.go). Broadcasts keep their destination summary, so their progress
+// is only logged.
+
+// notifyProgressState returns the .sts state for a progress status.
+func notifyProgressState(status string) (string, bool) {
+	state, ok := config().notifyProgressStates[strings.ToLower(strings.TrimSpace(status))]
+	return state, ok
+}
+
+// parseProgressStates parses NOTIFY_PROGRESS_STATES.
+func parseProgressStates(v string) (map[string]string, error) {
+	states := make(map[string]string)
+	for _, entry := range splitConfigList(v) {
+		status, state, ok := strings.Cut(entry, "=")
+		status, state = strings.ToLower(strings.TrimSpace(status)), strings.TrimSpace(state)
+		if !ok || status == "" || len(state) != 1 || state < "0" || state > "9" {
+			return nil, fmt.Errorf("NOTIFY_PROGRESS_STATES entry %q must be status=state with a Hylafax state 0-9", entry)
+		}
+		states[status] = state
+	}
+	return states, nil
+}
+
+// updateJobProgress writes a progress notify to the .sts of its job. The job
+// stays in jobQueue, and jobQueue is held while the .sts is written so that a
+// result being handled at the same time cannot be overwritten.
+func updateJobProgress(result, overall FaxJob, m statusMapping) {
+	jobQueue.Lock()
+	defer jobQueue.Unlock()
+
+	jobUUID, matchedBy := matchOutboundJob(result, overall)
+	if matchedBy == "" {
+		slog.Debug("No queued job for progress notify", "uuid", result.UUID, "call_uuid", result.CallUUID, "status", result.Status)
+		return
+	}
+	job := jobQueue.entries[jobUUID]
+	if job.broadcastIndex > 0 {
+		noteJobStatus(job.hylaJobID, fmt.Sprintf("destination %d: %s", job.broadcastIndex, result.Status), statusSourceNotify)
+		slog.Info("Broadcast destination progress", "uuid", result.UUID, "job_id", job.hylaJobID,
+			"destination", job.broadcastIndex, "status", result.Status, "pages_sent", result.Result.PagesSent)
+		return
+	}
+
+	noteJobStatus(job.hylaJobID, result.Status, statusSourceNotify)
+
+	state := m.State
+	status := cmp.Or(m.Message, strings.ToLower(strings.TrimSpace(result.Status)))
+	if state == stsStateActive && result.Result.PagesSent > 0 {
+		status = fmt.Sprintf("sending page %d", result.Result.PagesSent)
+		if total := cmp.Or(result.Result.TotalPages, job.pages); total > 0 {
+			status += fmt.Sprintf(" of %d", total)
+		}
+	}
+	if err := createStsFile(job.hylaJobID, state, pagesField(result.Result.PagesSent), pagesField(result.Result.TotalPages), status); err != nil {
+		slog.Error("Error updating .sts", "job_id", job.hylaJobID, "err", err)
+		return
+	}
+	slog.Info("Notify progress for fax job", "uuid", result.UUID, "job_id", job.hylaJobID, "direction", "outbound",
+		"matched_by", matchedBy, "state", state, "status", status)
+}
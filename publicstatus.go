@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"github.com/kataras/iris/v12"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The public status payload is deliberately coarse: per direction it reports
+// a state, a success rate rounded to whole percent, and a median delivery
+// time rounded to 10 seconds. Rates and medians are withheld until the last
+// hour holds PUBLIC_STATUS_MIN_SAMPLES outcomes, so a quiet tenant's activity
+// cannot be inferred. No job, number or count ever appears in it. A direction
+// whose /healthz checks fail is at least degraded, whatever its rate says.
+
+const publicStatusWindow = time.Hour
+
+// publicHealthTTL is how long /status/public reuses a health check result,
+// so its callers cannot make the service probe its dependencies at will.
+const publicHealthTTL = 30 * time.Second
+
+// publicDirectionChecks are the /healthz checks each direction depends on:
+// sending on all of them, receiving on the queue folder, the FTP server
+// Synergy collects received faxes from, and the remote folder synchronization.
+var publicDirectionChecks = map[bool][]string{
+	false: {"queue_dir", "queue_watcher", "ftp", "send_webhook", "remote_queue"},
+	true:  {"queue_dir", "ftp", "remote_queue"},
+}
+
+var publicHealth = struct {
+	sync.Mutex
+	at      time.Time
+	failing map[string]bool
+}{}
+
+// publicStatusFields are the only fields the payload can contain.
+// PUBLIC_STATUS_FIELDS selects a subset of them.
+var publicStatusFields = []string{"state", "success_rate", "median_delivery_seconds"}
+
+// deliveryOutcome is one finished fax, kept for the public status window.
+type deliveryOutcome struct {
+	at       time.Time
+	inbound  bool
+	success  bool
+	duration time.Duration // webhook acceptance -> final result; outbound only
+}
+
+var deliveryOutcomes = struct {
+	sync.Mutex
+	outcomes []deliveryOutcome
+}{}
+
+// recordDeliveryOutcome records a finished inbound or outbound fax.
+func recordDeliveryOutcome(inbound, success bool, duration time.Duration) {
+	deliveryOutcomes.Lock()
+	defer deliveryOutcomes.Unlock()
+	now := time.Now()
+	deliveryOutcomes.outcomes = append(deliveryOutcomes.outcomes, deliveryOutcome{at: now, inbound: inbound, success: success, duration: duration})
+
+	cut := 0
+	for cut < len(deliveryOutcomes.outcomes) && now.Sub(deliveryOutcomes.outcomes[cut].at) > publicStatusWindow {
+		cut++
+	}
+	deliveryOutcomes.outcomes = deliveryOutcomes.outcomes[cut:]
+}
+
+// publicStatusConfig is read once at startup.
+type publicStatusConfig struct {
+	fields     map[string]bool
+	minSamples int
+	ratePerMin int
+}
+
+func loadPublicStatusConfig() publicStatusConfig {
+	cfg := publicStatusConfig{fields: make(map[string]bool), minSamples: config().PublicStatusMinSamples, ratePerMin: config().PublicStatusRateLimit}
+	for _, field := range config().publicStatusFields {
+		cfg.fields[field] = true
+	}
+	return cfg
+}
+
+// publicHealthFailing returns the failing health checks, run again at most
+// every publicHealthTTL.
+func publicHealthFailing() map[string]bool {
+	publicHealth.Lock()
+	defer publicHealth.Unlock()
+	if time.Since(publicHealth.at) < publicHealthTTL {
+		return publicHealth.failing
+	}
+	failing := make(map[string]bool)
+	for _, name := range runHealthChecks(context.Background()).Failing {
+		failing[name] = true
+	}
+	publicHealth.at, publicHealth.failing = time.Now(), failing
+	return failing
+}
+
+// publicDirectionStatus summarizes one direction. Success rate and median are
+// only filled in when there are enough samples. failing names the failing
+// health checks.
+func publicDirectionStatus(cfg publicStatusConfig, inbound bool, failing map[string]bool) iris.Map {
+	deliveryOutcomes.Lock()
+	var total, succeeded int
+	var durations []time.Duration
+	for _, o := range deliveryOutcomes.outcomes {
+		if o.inbound != inbound || time.Since(o.at) > publicStatusWindow {
+			continue
+		}
+		total++
+		if o.success {
+			succeeded++
+			if o.duration > 0 {
+				durations = append(durations, o.duration)
+			}
+		}
+	}
+	deliveryOutcomes.Unlock()
+
+	status := iris.Map{}
+	enough := total >= cfg.minSamples
+	rate := 100.0
+	if total > 0 {
+		rate = float64(succeeded) * 100 / float64(total)
+	}
+	if cfg.fields["state"] {
+		unhealthy := slices.ContainsFunc(publicDirectionChecks[inbound], func(name string) bool { return failing[name] })
+		switch {
+		case enough && rate < 50:
+			status["state"] = "down"
+		case enough && rate < 90, unhealthy:
+			status["state"] = "degraded"
+		default:
+			status["state"] = "operational"
+		}
+	}
+	if cfg.fields["success_rate"] && enough {
+		status["success_rate"] = math.Round(rate)
+	}
+	if cfg.fields["median_delivery_seconds"] && !inbound && len(durations) >= cfg.minSamples {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		median := durations[len(durations)/2]
+		status["median_delivery_seconds"] = math.Round(median.Seconds()/10) * 10
+	}
+	return status
+}
+
+// publicRateLimiter allows ratePerMin requests per client IP per minute.
+type publicRateLimiter struct {
+	sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+func (l *publicRateLimiter) allow(ip string, ratePerMin int) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now().Truncate(time.Minute)
+	if !now.Equal(l.window) {
+		l.window = now
+		l.counts = make(map[string]int)
+	}
+	l.counts[ip]++
+	return l.counts[ip] <= ratePerMin
+}
+
+// publicDirectionFields documents the per-direction object of /status/public;
+// fields not listed in PUBLIC_STATUS_FIELDS, or lacking samples, are left out.
+type publicDirectionFields struct {
+	State                 string  `json:"state,omitempty"` // "operational", "degraded" or "down"
+	SuccessRate           float64 `json:"success_rate,omitempty"`
+	MedianDeliverySeconds float64 `json:"median_delivery_seconds,omitempty"`
+}
+
+// registerPublicRoutes registers the unauthenticated status endpoint.
+func registerPublicRoutes(app *iris.Application) {
+	cfg := loadPublicStatusConfig()
+	limiter := &publicRateLimiter{}
+
+	documentRoute(app.Get("/status/public", func(ctx iris.Context) {
+		if !limiter.allow(ctx.RemoteAddr(), cfg.ratePerMin) {
+			ctx.StatusCode(iris.StatusTooManyRequests)
+			ctx.Header("Retry-After", "60")
+			ctx.JSON(iris.Map{"error": "rate limit exceeded"})
+			return
+		}
+
+		var failing map[string]bool
+		if cfg.fields["state"] {
+			failing = publicHealthFailing()
+		}
+		sending := publicDirectionStatus(cfg, false, failing)
+		receiving := publicDirectionStatus(cfg, true, failing)
+		payload := iris.Map{
+			"sending":    sending,
+			"receiving":  receiving,
+			"updated_at": time.Now().UTC().Truncate(time.Minute).Format(time.RFC3339),
+		}
+		if cfg.fields["state"] {
+			overall := "operational"
+			for _, s := range []iris.Map{sending, receiving} {
+				if s["state"] == "down" {
+					overall = "down"
+				} else if s["state"] == "degraded" && overall == "operational" {
+					overall = "degraded"
+				}
+			}
+			payload["status"] = overall
+		}
+
+		ctx.Header("Cache-Control", "public, max-age=30")
+		ctx.JSON(payload)
+	}), apiDoc{Summary: "Coarse service status; fields follow PUBLIC_STATUS_FIELDS", Response: struct {
+		Status    string                `json:"status"`
+		Sending   publicDirectionFields `json:"sending"`
+		Receiving publicDirectionFields `json:"receiving"`
+		UpdatedAt time.Time             `json:"updated_at"`
+	}{}})
+}
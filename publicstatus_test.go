@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+func TestPublicStatusLeaksNothing(t *testing.T) {
+	// Values that identify a tenant or its activity; none may appear in any payload.
+	secrets := []string{"6045551234", "6045550100", "Dr Smith Clinic", "fax-uuid-1", "jsmith", "fax0001"}
+	allowed := map[string]bool{"status": true, "sending": true, "receiving": true, "updated_at": true,
+		"state": true, "success_rate": true, "median_delivery_seconds": true}
+	states := []string{"operational", "degraded", "down"}
+
+	fieldSets := []string{"state,success_rate,median_delivery_seconds", "state", "success_rate", "median_delivery_seconds", "state,success_rate"}
+	outcomeSets := []struct {
+		name     string
+		inbound  int
+		outbound int
+		failed   int
+	}{
+		{name: "idle"},
+		{name: "one fax", outbound: 1},
+		{name: "quiet hour", inbound: 3, outbound: 4, failed: 1},
+		{name: "busy hour", inbound: 40, outbound: 37, failed: 3},
+		{name: "outage", outbound: 25, failed: 20},
+	}
+	for _, fields := range fieldSets {
+		for _, minSamples := range []string{"1", "20"} {
+			for _, outcomes := range outcomeSets {
+				t.Run(fields+"/"+minSamples+"/"+outcomes.name, func(t *testing.T) {
+					useTestConfig(t, map[string]string{"PUBLIC_STATUS_FIELDS": fields, "PUBLIC_STATUS_MIN_SAMPLES": minSamples})
+					useTestOutcomes(t)
+					for i := 0; i < outcomes.inbound; i++ {
+						recordDeliveryOutcome(true, true, 0)
+					}
+					for i := 0; i < outcomes.outbound; i++ {
+						recordDeliveryOutcome(false, i >= outcomes.failed, time.Duration(37+i)*time.Second)
+					}
+					faxRecordsMutex.Lock()
+					faxRecords["fax-uuid-1"] = &FaxJobRecord{ReceivedUUID: "fax-uuid-1", Direction: "inbound", CIDNum: "6045551234",
+						CIDName: "Dr Smith Clinic", PdfPath: "/srv/ftp/faxes/fax0001.pdf", ReceivedAt: time.Now()}
+					faxRecordsMutex.Unlock()
+
+					rec := serveTestRequest(t, registerPublicRoutes, httptest.NewRequest("GET", "/status/public", nil))
+					if rec.Code != 200 {
+						t.Fatalf("status %d: %s", rec.Code, rec.Body)
+					}
+					body := rec.Body.String()
+					for _, secret := range secrets {
+						if strings.Contains(body, secret) {
+							t.Errorf("payload contains %q: %s", secret, body)
+						}
+					}
+
+					var payload map[string]any
+					if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+						t.Fatal(err)
+					}
+					configured := map[string]bool{}
+					for _, f := range splitConfigList(fields) {
+						configured[f] = true
+					}
+					var check func(key string, v any)
+					check = func(key string, v any) {
+						if !allowed[key] {
+							t.Errorf("payload has field %q: %s", key, body)
+						}
+						switch key {
+						case "state", "success_rate", "median_delivery_seconds":
+							if !configured[key] {
+								t.Errorf("payload has %q, which PUBLIC_STATUS_FIELDS=%q leaves out", key, fields)
+							}
+						}
+						switch v := v.(type) {
+						case map[string]any:
+							for k, child := range v {
+								check(k, child)
+							}
+						case float64:
+							if key == "success_rate" && v != math.Round(v) || key == "median_delivery_seconds" && math.Mod(v, 10) != 0 {
+								t.Errorf("%s = %v is not rounded", key, v)
+							}
+						case string:
+							if (key == "state" || key == "status") && !slices.Contains(states, v) {
+								t.Errorf("%s = %q", key, v)
+							}
+						}
+					}
+					for k, v := range payload {
+						check(k, v)
+					}
+					if minSamples == "20" && outcomes.outbound+outcomes.inbound < 20 && strings.Contains(body, "success_rate") {
+						t.Errorf("success rate of fewer than 20 faxes is published: %s", body)
+					}
+				})
+			}
+		}
+	}
+}
+
+// useTestOutcomes starts the test with no delivery outcomes recorded.
+func useTestOutcomes(t *testing.T) {
+	deliveryOutcomes.Lock()
+	deliveryOutcomes.outcomes = nil
+	deliveryOutcomes.Unlock()
+	t.Cleanup(func() {
+		deliveryOutcomes.Lock()
+		deliveryOutcomes.outcomes = nil
+		deliveryOutcomes.Unlock()
+	})
+}
+
+func TestPublicDirectionStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		succeeded int
+		failed    int
+		failing   []string // health checks
+		want      iris.Map
+	}{
+		{name: "too few samples", succeeded: 3, failed: 3, want: iris.Map{"state": "operational"}},
+		{name: "healthy", succeeded: 19, failed: 1, want: iris.Map{"state": "operational", "success_rate": 95.0, "median_delivery_seconds": 50.0}},
+		{name: "degraded", succeeded: 14, failed: 6, want: iris.Map{"state": "degraded", "success_rate": 70.0, "median_delivery_seconds": 50.0}},
+		{name: "down", succeeded: 4, failed: 16, want: iris.Map{"state": "down", "success_rate": 20.0}},
+		{name: "failing health check", succeeded: 19, failed: 1, failing: []string{"send_webhook"},
+			want: iris.Map{"state": "degraded", "success_rate": 95.0, "median_delivery_seconds": 50.0}},
+		{name: "failing health check, too few samples", failing: []string{"queue_dir"}, want: iris.Map{"state": "degraded"}},
+		{name: "failing health check and down", succeeded: 4, failed: 16, failing: []string{"queue_watcher"},
+			want: iris.Map{"state": "down", "success_rate": 20.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, map[string]string{"PUBLIC_STATUS_MIN_SAMPLES": "10"})
+			useTestOutcomes(t)
+			for i := 0; i < tt.succeeded; i++ {
+				recordDeliveryOutcome(false, true, time.Duration(40+i)*time.Second)
+			}
+			for i := 0; i < tt.failed; i++ {
+				recordDeliveryOutcome(false, false, 0)
+			}
+
+			failing := make(map[string]bool)
+			for _, name := range tt.failing {
+				failing[name] = true
+			}
+			got := publicDirectionStatus(loadPublicStatusConfig(), false, failing)
+			if len(got) != len(tt.want) {
+				t.Fatalf("publicDirectionStatus() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// TestPublicStatusHealth checks that a failing health check degrades the
+// directions that depend on it, and only those.
+func TestPublicStatusHealth(t *testing.T) {
+	tests := []struct {
+		name      string
+		watcher   bool // queue watcher running
+		queueDir  bool // queue folder present
+		sending   string
+		receiving string
+		status    string
+	}{
+		{name: "healthy", watcher: true, queueDir: true, sending: "operational", receiving: "operational", status: "operational"},
+		{name: "queue watcher stopped", queueDir: true, sending: "degraded", receiving: "operational", status: "degraded"},
+		{name: "queue folder gone", watcher: true, sending: "degraded", receiving: "degraded", status: "degraded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, nil)
+			useTestOutcomes(t)
+			for i := 0; i < 20; i++ {
+				recordDeliveryOutcome(false, true, time.Minute)
+				recordDeliveryOutcome(true, true, 0)
+			}
+			prev := queueWatcherAlive.Load()
+			queueWatcherAlive.Store(tt.watcher)
+			resetHealth := func() {
+				publicHealth.Lock()
+				publicHealth.at = time.Time{}
+				publicHealth.Unlock()
+			}
+			resetHealth()
+			t.Cleanup(func() {
+				queueWatcherAlive.Store(prev)
+				resetHealth()
+			})
+			if !tt.queueDir {
+				if err := os.RemoveAll(cfg.FTPRoot + FaxDir); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := serveTestRequest(t, registerPublicRoutes, httptest.NewRequest("GET", "/status/public", nil))
+			var payload struct {
+				Status    string `json:"status"`
+				Sending   struct{ State string }
+				Receiving struct{ State string }
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Sending.State != tt.sending || payload.Receiving.State != tt.receiving || payload.Status != tt.status {
+				t.Errorf("sending %q, receiving %q, status %q; want %q, %q, %q", payload.Sending.State, payload.Receiving.State,
+					payload.Status, tt.sending, tt.receiving, tt.status)
+			}
+			if strings.Contains(rec.Body.String(), "queue") {
+				t.Errorf("payload names a health check: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestPublicStatusRateLimit(t *testing.T) {
+	useTestConfig(t, map[string]string{"PUBLIC_STATUS_RATE_LIMIT": "2"})
+	app := iris.New()
+	registerPublicRoutes(app)
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+	var codes []int
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, httptest.NewRequest("GET", "/status/public", nil))
+		codes = append(codes, rec.Code)
+	}
+	// The limit is per clock minute, so a minute boundary between the
+	// requests resets it.
+	if want := []int{200, 200, 429}; !slices.Equal(codes, want) && time.Now().Second() != 0 {
+		t.Errorf("status codes %v, want %v", codes, want)
+	}
+}
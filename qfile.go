@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Synergy reads more of q<jobid>.sts than state and npages: like a Hylafax
+// queue file it carries the job's number, sender, page size, resolution and
+// dial string. createQueueFile writes those when the job is accepted,
+//
+//	state:3
+//	npages:0
+//	totpages:0
+//	status:queued
+//	jobid:42
+//	jobtag:fax0001
+//	jobtype:facsimile
+//	owner:jsmith
+//	sender:jsmith
+//	number:604-555-1234
+//	external:604-555-1234
+//	dialstring:+16045551234
+//	priority:127
+//	pagewidth:215
+//	pagelength:279
+//	resolution:196
+//
+// with tts, the send-after time in Unix seconds, when the .sfc gives one.
+// A broadcast is one Hylafax job, so its number, external and dialstring are
+// those of its first destination. The sender is the .sfc user, or
+// QFILE_SENDER; the page size (mm) and resolution (lines per inch) come from
+// QFILE_PAGE_WIDTH, QFILE_PAGE_LENGTH and QFILE_RESOLUTION. Every later
+// update rewrites only its own keys, so keys Synergy appends, and keys this
+// service does not know, are kept.
+
+// createQueueFile writes the initial q<hylaJobID>.sts of an accepted job in
+// one write. The state and status are set; other keys the file already has
+// keep their values.
+func createQueueFile(hylaJobID string, entry sfcFile) error {
+	cfg := config()
+	number := strings.TrimSpace(entry.FaxNumber)
+	if numbers := splitFaxNumbers(entry.FaxNumber); len(numbers) > 0 {
+		number = numbers[0]
+	}
+	dialString := number
+	if n, err := normalizeDestinations(number); err == nil {
+		dialString = n
+	}
+	owner := entry.User
+	if owner == "" {
+		owner = cfg.QFileSender
+	}
+	kv := []string{
+		"state", stsStateSleeping,
+		"npages", "0",
+		"totpages", "0",
+		"status", "queued",
+		"jobid", hylaJobID,
+		"jobtag", entry.jobID,
+		"jobtype", "facsimile",
+		"owner", owner,
+		"sender", owner,
+		"number", number,
+		"external", number,
+		"dialstring", dialString,
+		"priority", strconv.Itoa(entry.Priority),
+		"pagewidth", strconv.Itoa(cfg.QFilePageWidth),
+		"pagelength", strconv.Itoa(cfg.QFilePageLength),
+		"resolution", strconv.Itoa(cfg.QFileResolution),
+	}
+	if !entry.NotBefore.IsZero() {
+		kv = append(kv, "tts", strconv.FormatInt(entry.NotBefore.Unix(), 10))
+	}
+
+	stsFilePath := jobFile(hylaJobID, fmt.Sprintf("q%s.sts", hylaJobID))
+	content, err := os.ReadFile(stsFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading .sts file: %w", err)
+	}
+	lines := stsLines(content)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, line := kv[i], kv[i]+":"+kv[i+1]
+		j := slices.IndexFunc(lines, func(l string) bool { return strings.HasPrefix(l, key+":") })
+		switch {
+		case j < 0:
+			lines = append(lines, line)
+		case key == "state" || key == "status":
+			lines[j] = line
+		}
+	}
+	if err := writeQueueFile(stsFilePath, []byte(strings.Join(lines, "\n")), 0660); err != nil {
+		return fmt.Errorf("error writing .sts file: %w", err)
+	}
+	noteJobStatus(hylaJobID, "queued", statusSourceSts)
+	return nil
+}
+
+// stsLines splits the content of a .sts file into lines, without the empty
+// lines a trailing newline leaves, so keys appended after them stay in one
+// block.
+func stsLines(content []byte) []string {
+	lines := strings.Split(string(content), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateQueueFile(t *testing.T) {
+	tests := []struct {
+		name     string // fixture in testdata/qfile
+		existing string // .sts content before the job is accepted
+		entry    sfcFile
+	}{
+		{name: "single", entry: sfcFile{SfcJob: SfcJob{FaxNumber: "604-555-1234", User: "jsmith", Priority: defaultSfcPriority}, jobID: "fax0001"}},
+		{name: "broadcast", entry: sfcFile{SfcJob: SfcJob{FaxNumber: "604-555-1234, 604-555-9876", Priority: 10,
+			NotBefore: time.Unix(1790000000, 0)}, jobID: "fax0001"}},
+		{name: "existing", existing: "state:6\nnpages:4\ntotpages:4\nstatus:sending\nsynergy:kept\n",
+			entry: sfcFile{SfcJob: SfcJob{FaxNumber: "604-555-1234", User: "jsmith", Priority: defaultSfcPriority}, jobID: "fax0001"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, nil)
+			stsPath := jobFile("42", "q42.sts")
+			if tt.existing != "" {
+				writeTestFile(t, stsPath, tt.existing)
+			}
+
+			if err := createQueueFile("42", tt.entry); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.TrimSuffix(readTestFile(t, filepath.Join("testdata", "qfile", tt.name+".sts")), "\n")
+			if got := readTestFile(t, stsPath); got != want {
+				t.Errorf("q42.sts =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+// TestQueueFileUpdates follows a queue file through a job: accepted, then
+// completed. The hylafax fixture is a queue file as Hylafax writes it, whose
+// keys this service does not know must survive every update in place.
+func TestQueueFileUpdates(t *testing.T) {
+	tests := []struct {
+		start    string // fixture in testdata/qfile the job starts from, if any
+		appended string // keys Synergy appends once the job is accepted
+		accepted string // fixture after createQueueFile
+		done     string // fixture after the job completes
+		pages    string
+	}{
+		{start: "hylafax", accepted: "hylafax-accepted", done: "hylafax-done", pages: "3"},
+		{accepted: "single", appended: "synergy:imported\n", done: "single-done", pages: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.done, func(t *testing.T) {
+			useTestConfig(t, nil)
+			stsPath := jobFile("42", "q42.sts")
+			fixture := func(name string) string {
+				return strings.TrimSuffix(readTestFile(t, filepath.Join("testdata", "qfile", name+".sts")), "\n")
+			}
+			if tt.start != "" {
+				writeTestFile(t, stsPath, fixture(tt.start)+"\n")
+			}
+
+			entry := sfcFile{SfcJob: SfcJob{FaxNumber: "604-555-1234", User: "jsmith", Priority: defaultSfcPriority}, jobID: "fax0001"}
+			if err := createQueueFile("42", entry); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readTestFile(t, stsPath), fixture(tt.accepted); got != want {
+				t.Errorf("accepted q42.sts =\n%s\nwant\n%s", got, want)
+			}
+			if tt.appended != "" {
+				writeTestFile(t, stsPath, readTestFile(t, stsPath)+"\n"+tt.appended)
+			}
+			if err := createStsFile("42", stsStateDone, tt.pages, tt.pages, "success"); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readTestFile(t, stsPath), fixture(tt.done); got != want {
+				t.Errorf("completed q42.sts =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FAX_QUEUE_DIRS adds outbound queue folders under FTP_ROOT, for a Synergy
+// server that hosts several companies, each with its own folder and caller
+// ID. It is a comma-separated list of folders, each optionally followed by
+// ;fax_number=<number>, ;route=<SEND_ROUTES_FILE route name>,
+// ;approval=true and the .recv format options ;recv_time_format=<layout>,
+// ;recv_decimal_mark=<name> and ;recv_thousands_separator=<name>:
+//
+//	FAX_QUEUE_DIRS=clinic-a/synergyfaxq;fax_number=6045550100,clinic-b/synergyfaxq;route=local;approval=true
+//	FAX_QUEUE_DIRS=quebec/synergyfaxq;recv_time_format=02/01/06 15:04;recv_decimal_mark=comma;recv_thousands_separator=space
+//
+// /synergyfaxq is always watched and may be listed to give it overrides. The
+// watcher, startup scan and submission pipeline handle every folder alike. A
+// job's .jobid, .sts, .done, .fail and .info go to the folder its .sfc came
+// from, which is looked up by Hylafax job ID; job IDs come from one sequence,
+// so they are unique across folders. File names are assumed unique across
+// folders too, as one Synergy server names them. fax_number replaces
+// FAX_NUMBER as the caller number of the folder's jobs, unless the .sfc gives
+// one, and route sends them to that route whatever their number. approval
+// holds the folder's jobs for approval as APPROVAL_REQUIRED does for every
+// folder. The recv_* options write the .recv files of faxes received into the
+// folder, through RECEIVE_TENANT_MAP, in the site's conventions.
+
+// queueDir is one outbound queue folder.
+type queueDir struct {
+	Path      string // absolute
+	FaxNumber string
+	Route     string
+	Approval  bool // jobs wait for approval
+
+	// Override RECV_TIME_FORMAT, RECV_DECIMAL_MARK and
+	// RECV_THOUSANDS_SEPARATOR for faxes received into the folder.
+	RecvTimeFormat         string
+	RecvDecimalMark        string // separator name, see recvSeparators
+	RecvThousandsSeparator string
+}
+
+// parseQueueDirs parses FAX_QUEUE_DIRS. The default queue directory is
+// always first.
+func parseQueueDirs(ftpRoot, v string) ([]queueDir, error) {
+	dirs := []queueDir{{Path: filepath.Clean(ftpRoot + FaxDir)}}
+	for _, entry := range splitConfigList(v) {
+		fields := strings.Split(entry, ";")
+		rel := filepath.Clean(strings.Trim(strings.TrimSpace(fields[0]), "/"))
+		if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("FAX_QUEUE_DIRS entry %q must be a folder under FTP_ROOT", entry)
+		}
+		dir := queueDir{Path: filepath.Join(ftpRoot, rel)}
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			key = strings.TrimSpace(key)
+			switch key {
+			case "fax_number":
+				dir.FaxNumber = strings.TrimSpace(value)
+			case "route":
+				dir.Route = strings.TrimSpace(value)
+			case "approval":
+				b, err := strconv.ParseBool(strings.TrimSpace(value))
+				if err != nil {
+					return nil, fmt.Errorf("FAX_QUEUE_DIRS entry %q: approval must be true or false", entry)
+				}
+				dir.Approval = b
+			case "recv_time_format":
+				value = strings.TrimSpace(value)
+				if err := validateTimeLayout(value); err != nil {
+					return nil, fmt.Errorf("FAX_QUEUE_DIRS entry %q: recv_time_format %q: %w", entry, value, err)
+				}
+				dir.RecvTimeFormat = value
+			case "recv_decimal_mark", "recv_thousands_separator":
+				name := strings.ToLower(strings.TrimSpace(value))
+				if _, err := parseNumberSeparator(key, name); err != nil {
+					return nil, fmt.Errorf("FAX_QUEUE_DIRS entry %q: %w", entry, err)
+				}
+				if key == "recv_decimal_mark" {
+					dir.RecvDecimalMark = name
+				} else {
+					dir.RecvThousandsSeparator = name
+				}
+			default:
+				return nil, fmt.Errorf("FAX_QUEUE_DIRS entry %q: unknown option %q; use fax_number, route, approval, recv_time_format, recv_decimal_mark or recv_thousands_separator", entry, field)
+			}
+		}
+		if dir.Path == dirs[0].Path {
+			dirs[0] = dir
+			continue
+		}
+		for _, d := range dirs {
+			if d.Path == dir.Path {
+				return nil, fmt.Errorf("FAX_QUEUE_DIRS lists %q twice", entry)
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// queueDirPaths returns the folders to watch.
+func queueDirPaths() []string {
+	var paths []string
+	for _, d := range config().queueDirs {
+		paths = append(paths, d.Path)
+	}
+	return paths
+}
+
+// queueDirFor returns the settings of the folder path, or of the default
+// queue directory.
+func queueDirFor(path string) queueDir {
+	dirs := config().queueDirs
+	for _, d := range dirs {
+		if d.Path == filepath.Clean(path) {
+			return d
+		}
+	}
+	if len(dirs) > 0 {
+		return dirs[0]
+	}
+	return queueDir{Path: filepath.Clean(config().FTPRoot + FaxDir)}
+}
+
+// jobDirs maps the Hylafax job IDs of jobs outside the default queue
+// directory to their folder. A job ID is mapped when its job is queued and
+// again when its state is restored at startup.
+var jobDirs = struct {
+	sync.Mutex
+	dirs map[string]string
+}{dirs: make(map[string]string)}
+
+// setJobDir records the folder of a job. Job IDs wrap around, so the default
+// folder is recorded by removing any earlier mapping.
+func setJobDir(hylaJobID, dir string) {
+	if hylaJobID == "" || dir == "" {
+		return
+	}
+	dir = filepath.Clean(dir)
+	jobDirs.Lock()
+	if dir == filepath.Clean(config().FTPRoot+FaxDir) {
+		delete(jobDirs.dirs, hylaJobID)
+	} else {
+		jobDirs.dirs[hylaJobID] = dir
+	}
+	jobDirs.Unlock()
+}
+
+// jobDir returns the queue folder of a job.
+func jobDir(hylaJobID string) string {
+	jobDirs.Lock()
+	dir, ok := jobDirs.dirs[hylaJobID]
+	jobDirs.Unlock()
+	if ok {
+		return dir
+	}
+	return config().FTPRoot + FaxDir
+}
+
+// jobFile returns the path of a file in a job's queue folder.
+func jobFile(hylaJobID, name string) string {
+	return filepath.Join(jobDir(hylaJobID), name)
+}
+
+// prepareQueueDirs creates FTP_ROOT, the queue folders and the subfolders
+// the settings in effect write to, with QUEUE_DIR_MODE permissions, and
+// checks that each can be written to. It runs at startup, so a missing or
+// read-only folder stops the service there rather than failing the first
+// fax.
+func prepareQueueDirs() error {
+	cfg := config()
+	dirs := []string{cfg.FTPRoot}
+	for _, d := range cfg.queueDirs {
+		dirs = append(dirs, d.Path)
+		if cfg.SentArchiveMode == cleanupArchive {
+			dirs = append(dirs, filepath.Join(d.Path, sentDirName))
+		}
+	}
+	if cfg.DeadLetterEnabled {
+		dirs = append(dirs, deadLetterDir())
+	}
+	if cfg.RetentionAction == cleanupArchive {
+		dirs = append(dirs, queueFile(archiveDirName))
+	}
+	if cfg.ReceiveEmailMap != "" {
+		dirs = append(dirs, queueFile(emailDir))
+	}
+	for _, dir := range dirs {
+		if err := makeQueueDir(dir); errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("cannot create %s: %w; create it, or give the service's user write access to its parent", dir, err)
+		} else if err != nil {
+			return err
+		}
+		if check := checkQueueDirWritable(dir); !check.OK {
+			return fmt.Errorf("cannot write to %s: %s; give the service's user write access to it", dir, check.Error)
+		}
+	}
+	if cfg.queueOwner != nil && os.Geteuid() != 0 {
+		slog.Warn("QUEUE_OWNER is ignored when not running as root", "owner", cfg.QueueOwner)
+	}
+	return nil
+}
+
+// makeQueueDir creates dir and any missing parents with QUEUE_DIR_MODE
+// permissions, which unlike os.MkdirAll are not narrowed by the umask, and
+// gives them to QUEUE_OWNER. Folders that exist are left as they are.
+func makeQueueDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory; move it aside", dir)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := makeQueueDir(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, config().queueDirMode); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Chmod(dir, config().queueDirMode); err != nil {
+		return err
+	}
+	return chownQueuePath(dir)
+}
+
+// queueFileMode returns the permissions of a new file under FTP_ROOT:
+// QUEUE_FILE_MODE if set, and otherwise perm.
+func queueFileMode(path string, perm os.FileMode) os.FileMode {
+	if config().queueFileMode != 0 && inFTPRoot(path) {
+		return config().queueFileMode
+	}
+	return perm
+}
+
+// chownQueuePath gives a file or folder under FTP_ROOT to QUEUE_OWNER, so
+// that Synergy, running as another user, can remove what the service wrote.
+// Only root can give files away, so it does nothing otherwise.
+func chownQueuePath(path string) error {
+	owner := config().queueOwner
+	if owner == nil || os.Geteuid() != 0 || !inFTPRoot(path) {
+		return nil
+	}
+	return os.Lchown(path, owner[0], owner[1])
+}
+
+// inFTPRoot reports whether path is FTP_ROOT or under it.
+func inFTPRoot(path string) bool {
+	root, err := filepath.Abs(config().FTPRoot)
+	if err != nil {
+		return false
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
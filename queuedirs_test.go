@@ -0,0 +1,232 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseQueueDirs(t *testing.T) {
+	root := "/srv/ftp"
+	def := queueDir{Path: filepath.Clean(root + FaxDir)}
+	tests := []struct {
+		name    string
+		value   string
+		want    []queueDir
+		wantErr bool
+	}{
+		{name: "unset", want: []queueDir{def}},
+		{name: "options", value: "clinic-a/synergyfaxq;fax_number=6045550101;route=local;approval=true",
+			want: []queueDir{def, {Path: "/srv/ftp/clinic-a/synergyfaxq", FaxNumber: "6045550101", Route: "local", Approval: true}}},
+		{name: "approval off", value: "clinic-a/synergyfaxq;approval=false",
+			want: []queueDir{def, {Path: "/srv/ftp/clinic-a/synergyfaxq"}}},
+		{name: "default folder options", value: FaxDir + ";approval=1",
+			want: []queueDir{{Path: def.Path, Approval: true}}},
+		{name: ".recv format", value: "quebec/synergyfaxq; recv_time_format=02/01/06 15:04;recv_decimal_mark=Comma;recv_thousands_separator=space",
+			want: []queueDir{def, {Path: "/srv/ftp/quebec/synergyfaxq", RecvTimeFormat: "02/01/06 15:04", RecvDecimalMark: "comma", RecvThousandsSeparator: "space"}}},
+		{name: "bad approval", value: "clinic-a;approval=maybe", wantErr: true},
+		{name: "ambiguous recv_time_format", value: "quebec;recv_time_format=01/06 15:04", wantErr: true},
+		{name: "unknown separator", value: "quebec;recv_thousands_separator=dot", wantErr: true},
+		{name: "unknown option", value: "clinic-a;owner=x", wantErr: true},
+		{name: "outside FTP_ROOT", value: "../etc", wantErr: true},
+		{name: "listed twice", value: "clinic-a,clinic-a/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseQueueDirs(root, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseQueueDirs(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseQueueDirs(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueFileMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileMode string // QUEUE_FILE_MODE
+		file     os.FileMode
+		sts      os.FileMode
+		received os.FileMode
+	}{
+		{name: "unset", file: 0644, sts: 0660, received: 0644},
+		{name: "group writable", fileMode: "0664", file: 0664, sts: 0664, received: 0664},
+		{name: "owner only", fileMode: "600", file: 0600, sts: 0600, received: 0600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false",
+				"QUEUE_FILE_MODE": tt.fileMode})
+			dir := cfg.FTPRoot + FaxDir
+			if err := createFile(filepath.Join(dir, "fax0001.jobid"), "42\r"); err != nil {
+				t.Fatal(err)
+			}
+			if err := createStsFile("42", stsStateSleeping, "", "", "queued"); err != nil {
+				t.Fatal(err)
+			}
+			if rec := receiveRequest(t, "json", []byte("%PDF-1.4\n")); rec.Code != 200 {
+				t.Fatalf("receive status %d: %s", rec.Code, rec.Body)
+			}
+
+			want := map[string]os.FileMode{"fax0001.jobid": tt.file, "q42.sts": tt.sts}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if ext := filepath.Ext(e.Name()); ext == ".recv" || ext == ".pdf" {
+					want[e.Name()] = tt.received
+				}
+			}
+			if len(want) != 4 {
+				t.Fatalf("queue folder has %d files, want a .jobid, a .sts and a received .recv and PDF", len(entries))
+			}
+			for name, mode := range want {
+				info, err := os.Stat(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := info.Mode().Perm(); got != mode {
+					t.Errorf("%s mode %#o, want %#o", name, got, mode)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueFileModeOutsideFTPRoot(t *testing.T) {
+	cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "QUEUE_FILE_MODE": "0666"})
+	path := filepath.Join(t.TempDir(), "state.json")
+	if inFTPRoot(path) {
+		t.Fatalf("%s is under FTP_ROOT %s", path, cfg.FTPRoot)
+	}
+	if err := writeQueueFile(path, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file outside FTP_ROOT has mode %v (err %v), want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestMakeQueueDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		dirMode string // QUEUE_DIR_MODE
+		want    os.FileMode
+	}{
+		{name: "default", want: 0755},
+		{name: "group writable", dirMode: "0775", want: 0775},
+		{name: "owner and group", dirMode: "0770", want: 0770},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"QUEUE_DIR_MODE": tt.dirMode})
+			existing := filepath.Join(cfg.FTPRoot, "clinic-a")
+			if err := os.Mkdir(existing, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := makeQueueDir(filepath.Join(existing, "tenant", FaxDir)); err != nil {
+				t.Fatal(err)
+			}
+			// New folders take the mode whatever the umask; existing ones keep theirs.
+			for dir, mode := range map[string]os.FileMode{
+				existing:                          0700,
+				filepath.Join(existing, "tenant"): tt.want,
+				filepath.Join(existing, "tenant", FaxDir): tt.want,
+			} {
+				info, err := os.Stat(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := info.Mode().Perm(); got != mode {
+					t.Errorf("%s mode %#o, want %#o", dir, got, mode)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueOwner(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner string // QUEUE_OWNER
+		uid   int
+		gid   int
+	}{
+		{name: "unset", uid: os.Geteuid(), gid: os.Getegid()},
+		{name: "other user", owner: "1001:1002", uid: 1001, gid: 1002},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.owner != "" && os.Geteuid() != 0 {
+				t.Skip("giving files away needs root")
+			}
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "QUEUE_OWNER": tt.owner})
+			dir := cfg.FTPRoot + FaxDir
+			if err := createFile(filepath.Join(dir, "fax0001.jobid"), "42\r"); err != nil {
+				t.Fatal(err)
+			}
+			if err := makeQueueDir(filepath.Join(cfg.FTPRoot, "clinic-a")); err != nil {
+				t.Fatal(err)
+			}
+			outside := filepath.Join(t.TempDir(), "state.json")
+			if err := writeQueueFile(outside, []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			for path, want := range map[string][2]int{
+				filepath.Join(dir, "fax0001.jobid"):    {tt.uid, tt.gid},
+				filepath.Join(cfg.FTPRoot, "clinic-a"): {tt.uid, tt.gid},
+				outside:                                {os.Geteuid(), os.Getegid()},
+			} {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				st := info.Sys().(*syscall.Stat_t)
+				if got := [2]int{int(st.Uid), int(st.Gid)}; got != want {
+					t.Errorf("%s owner %d:%d, want %d:%d", path, got[0], got[1], want[0], want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestQueueModeSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "defaults", env: map[string]string{}},
+		{name: "valid", env: map[string]string{"QUEUE_DIR_MODE": "0770", "QUEUE_FILE_MODE": "0660", "QUEUE_OWNER": "1001:1001"}},
+		{name: "decimal dir mode", env: map[string]string{"QUEUE_DIR_MODE": "755a"}, wantErr: "QUEUE_DIR_MODE"},
+		{name: "file mode too wide", env: map[string]string{"QUEUE_FILE_MODE": "01777"}, wantErr: "QUEUE_FILE_MODE"},
+		{name: "owner by name", env: map[string]string{"QUEUE_OWNER": "synergy:synergy"}, wantErr: "QUEUE_OWNER"},
+		{name: "owner without group", env: map[string]string{"QUEUE_OWNER": "1001"}, wantErr: "QUEUE_OWNER"},
+		{name: "negative owner", env: map[string]string{"QUEUE_OWNER": "-1:1001"}, wantErr: "QUEUE_OWNER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := map[string]string{"FTP_ROOT": "/srv/ftp", "FAX_NUMBER": "6045550100", "SEND_WEBHOOK_URL": "http://127.0.0.1:1/send"}
+			for k, v := range tt.env {
+				settings[k] = v
+			}
+			cfg, problems := readConfig(func(env string) string { return settings[env] })
+			problems = append(problems, cfg.validate()...)
+			var found bool
+			for _, p := range problems {
+				if strings.Contains(p.Error(), tt.wantErr) {
+					found = true
+				}
+			}
+			if tt.wantErr == "" && len(problems) > 0 {
+				t.Errorf("problems %v, want none", problems)
+			} else if tt.wantErr != "" && !found {
+				t.Errorf("problems %v, want one about %s", problems, tt.wantErr)
+			}
+		})
+	}
+}
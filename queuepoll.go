@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// On some network filesystems, NFS among them, changes made by another host
+// raise no inotify events, so fsnotify never sees an upload. WATCH_MODE=poll
+// reads the queue folders every WATCH_POLL_INTERVAL instead and hands each
+// new or changed file to the settler, which handles it once its size and
+// modification time stop changing, as it does for events.
+//
+// WATCH_MODE=auto watches with fsnotify and polls alongside without handling
+// what it finds. A file that a poll finds and no event has named by the next
+// poll means events are not arriving: the watcher is closed, the files found
+// are handled and polling takes over.
+
+// Watch modes kept in Config.WatchMode.
+const (
+	watchFsnotify = "fsnotify"
+	watchPoll     = "poll"
+	watchAuto     = "auto"
+)
+
+type polledFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// queuePoller finds queue files by reading the folders.
+type queuePoller struct {
+	dirs    []string
+	settler *fileSettler
+
+	seen    map[string]polledFile
+	failing map[string]bool // folders the last poll could not read
+
+	// In auto mode, the files events named and the files probes found that
+	// no event has named.
+	named   map[string]bool
+	unnamed map[string]bool
+}
+
+func newQueuePoller(dirs []string, settler *fileSettler) *queuePoller {
+	p := &queuePoller{
+		dirs:    dirs,
+		settler: settler,
+		seen:    make(map[string]polledFile),
+		failing: make(map[string]bool),
+		named:   make(map[string]bool),
+		unnamed: make(map[string]bool),
+	}
+	p.scan() // the startup scan has the files already there
+	return p
+}
+
+// isPolledFile reports whether name is a file processFile handles.
+func isPolledFile(name string) bool {
+	if isQueueTempFile(name) {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".sfc", ".pdf", ".cmd", ".kill":
+		return true
+	}
+	return false
+}
+
+// scan reads the folders and returns the files that are new or changed since
+// the last scan, and those that are gone, which are forgotten.
+func (p *queuePoller) scan() (changed, removed []string) {
+	found := make(map[string]bool)
+	for _, dir := range p.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !p.failing[dir] {
+				slog.Error("Error polling queue directory", "file", dir, "err", err)
+				p.failing[dir] = true
+			}
+			continue
+		}
+		if p.failing[dir] {
+			slog.Info("Polling queue directory again", "file", dir)
+			delete(p.failing, dir)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isPolledFile(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue // removed since the read
+			}
+			path := filepath.Join(dir, entry.Name())
+			found[path] = true
+			f := polledFile{size: info.Size(), modTime: info.ModTime()}
+			if prev, ok := p.seen[path]; !ok || prev != f {
+				p.seen[path] = f
+				changed = append(changed, path)
+			}
+		}
+	}
+	for path := range p.seen {
+		if !found[path] && !p.failing[filepath.Dir(path)] {
+			delete(p.seen, path)
+			delete(p.unnamed, path)
+			p.settler.forget(path)
+			removed = append(removed, path)
+		}
+	}
+	for path := range p.named {
+		if !found[path] {
+			delete(p.named, path)
+		}
+	}
+	return changed, removed
+}
+
+// poll hands the new and changed files to the settler and reports removed
+// .sfc files.
+func (p *queuePoller) poll() {
+	changed, removed := p.scan()
+	for _, path := range changed {
+		p.settler.changed(path)
+	}
+	for _, path := range removed {
+		fileRemoved(path)
+	}
+}
+
+// uploaded records a file the FTP upload hook reported, which is handled
+// then, so later polls do not hand it to the settler again.
+func (p *queuePoller) uploaded(path string) {
+	if info, err := os.Stat(path); err == nil && isPolledFile(path) {
+		p.seen[path] = polledFile{size: info.Size(), modTime: info.ModTime()}
+		delete(p.unnamed, path)
+	}
+}
+
+// eventFor records that an event named path.
+func (p *queuePoller) eventFor(path string) {
+	if isPolledFile(path) {
+		p.named[path] = true
+		delete(p.unnamed, path)
+	}
+}
+
+// probe scans the folders without handling the files. It reports whether a
+// file an earlier probe found is still one no event has named.
+func (p *queuePoller) probe() bool {
+	var earlier []string
+	for path := range p.unnamed {
+		earlier = append(earlier, path)
+	}
+	changed, _ := p.scan()
+	for _, path := range changed {
+		if !p.named[path] {
+			p.unnamed[path] = true
+		}
+	}
+	for _, path := range earlier {
+		if p.unnamed[path] {
+			return true
+		}
+	}
+	return false
+}
+
+// takeOver hands the files no event named to the settler.
+func (p *queuePoller) takeOver() {
+	for path := range p.unnamed {
+		p.settler.changed(path)
+	}
+	clear(p.unnamed)
+	clear(p.named)
+}
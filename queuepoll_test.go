@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIsPolledFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "fax0001.sfc", want: true},
+		{name: "fax0001.SFC", want: true},
+		{name: "fax0001.pdf", want: true},
+		{name: "fax0001.cmd", want: true},
+		{name: "fax0001.kill", want: true},
+		{name: "fax0001.recv"},
+		{name: "q42.sts"},
+		{name: "fax0001.jobid"},
+		{name: ".fax0001.pdf.tmp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPolledFile(tt.name); got != tt.want {
+				t.Errorf("isPolledFile(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// settlingPaths returns the base names of the files the settler is waiting
+// on, stopping their timers.
+func settlingPaths(settler *fileSettler) []string {
+	settler.mu.Lock()
+	defer settler.mu.Unlock()
+	var names []string
+	for path, f := range settler.pending {
+		f.timer.Stop()
+		names = append(names, filepath.Base(path))
+		delete(settler.pending, path)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestQueuePoller(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial []string // files the startup scan finds
+		change  func(t *testing.T, dir string)
+		want    []string // files the next poll hands to the settler
+	}{
+		{name: "new files", change: func(t *testing.T, dir string) {
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+			writeTestFile(t, filepath.Join(dir, "fax0001.recv"), "")
+		}, want: []string{"fax0001.pdf", "fax0001.sfc"}},
+		{name: "unchanged files", initial: []string{"fax0001.sfc"}, change: func(t *testing.T, dir string) {}},
+		{name: "grown file", initial: []string{"fax0001.pdf"}, change: func(t *testing.T, dir string) {
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\nmore\n")
+		}, want: []string{"fax0001.pdf"}},
+		{name: "touched file", initial: []string{"fax0001.pdf"}, change: func(t *testing.T, dir string) {
+			now := time.Now()
+			os.Chtimes(filepath.Join(dir, "fax0001.pdf"), now, now)
+		}, want: []string{"fax0001.pdf"}},
+		{name: "removed file", initial: []string{"fax0001.pdf"}, change: func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "fax0001.pdf"))
+		}},
+		{name: "temporary file", change: func(t *testing.T, dir string) {
+			writeTestFile(t, filepath.Join(dir, ".fax0001.pdf.tmp"), "%PDF-1.4\n")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			past := time.Now().Add(-time.Hour)
+			for _, name := range tt.initial {
+				writeTestFile(t, filepath.Join(dir, name), "x")
+				os.Chtimes(filepath.Join(dir, name), past, past)
+			}
+			settler := newFileSettler(context.Background(), time.Hour)
+			poller := newQueuePoller([]string{dir}, settler)
+			if got := settlingPaths(settler); got != nil {
+				t.Fatalf("startup scan handed %q to the settler", got)
+			}
+
+			tt.change(t, dir)
+			poller.poll()
+			if got := settlingPaths(settler); !slices.Equal(got, tt.want) {
+				t.Errorf("poll handed %q, want %q", got, tt.want)
+			}
+			poller.poll()
+			if got := settlingPaths(settler); got != nil {
+				t.Errorf("second poll handed %q again", got)
+			}
+		})
+	}
+}
+
+func TestQueuePollerProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    bool // an event names the file between the probes
+		fallback bool
+	}{
+		{name: "events arriving", event: true},
+		{name: "no events", fallback: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			settler := newFileSettler(context.Background(), time.Hour)
+			poller := newQueuePoller([]string{dir}, settler)
+			path := filepath.Join(dir, "fax0001.sfc")
+			writeTestFile(t, path, "6045551234\nfax0001.pdf\n")
+
+			if poller.probe() {
+				t.Fatal("first probe to find the file fell back to polling")
+			}
+			if tt.event {
+				poller.eventFor(path)
+			}
+			if got := poller.probe(); got != tt.fallback {
+				t.Fatalf("second probe = %v, want %v", got, tt.fallback)
+			}
+			if got := settlingPaths(settler); got != nil {
+				t.Errorf("probes handed %q to the settler", got)
+			}
+			poller.takeOver()
+			var want []string
+			if tt.fallback {
+				want = []string{"fax0001.sfc"}
+			}
+			if got := settlingPaths(settler); !slices.Equal(got, want) {
+				t.Errorf("takeOver handed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestWatchModes runs the queue watcher on a temp directory and checks that
+// an uploaded .sfc is handled in each mode.
+func TestWatchModes(t *testing.T) {
+	for _, mode := range []string{watchFsnotify, watchPoll, watchAuto} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "WATCH_MODE": mode,
+				"WATCH_POLL_INTERVAL": "20ms", "FILE_SETTLE_TIME": "20ms"})
+			dir := cfg.FTPRoot + FaxDir
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				watchFaxFolder(ctx, []string{dir})
+			}()
+			t.Cleanup(func() {
+				cancel()
+				<-done
+			})
+			for deadline := time.Now().Add(5 * time.Second); !queueWatcherAlive.Load(); time.Sleep(5 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("watcher did not start")
+				}
+			}
+
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				cache.Lock()
+				_, waiting := cache.sfc["fax0001.pdf"]
+				cache.Unlock()
+				if waiting {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal(".sfc was not handled")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userQuotas enforces per-user daily send limits for outbound faxes, in
+// faxes and in pages. Counters are persisted to DATA_DIR/quotas.json so they
+// survive restarts and reset when the local clock crosses QUOTA_RESET_TIME.
+// A submission reserves its fax and pages before it is sent, checking and
+// counting in one step so that concurrent submissions cannot both take the
+// last of an allowance, and gives them back if the submission fails.
+var userQuotas = struct {
+	sync.Mutex
+	defaultMax      int            // QUOTA_MAX_FAXES_PER_DAY, 0 means unlimited
+	defaultMaxPages int            // QUOTA_MAX_PAGES_PER_DAY, 0 means unlimited
+	perUser         map[string]int // USER_QUOTAS overrides: user -> max faxes per day
+	perUserPages    map[string]int // USER_PAGE_QUOTAS overrides: user -> max pages per day
+	resetAfter      time.Duration  // offset of the daily reset from local midnight
+	path            string
+	state           quotaState
+}{perUser: make(map[string]int), perUserPages: make(map[string]int)}
+
+type quotaState struct {
+	Day   string         `json:"day"`             // quota day the counters belong to (YYYY-MM-DD)
+	Faxes map[string]int `json:"faxes"`           // user -> faxes submitted during Day
+	Pages map[string]int `json:"pages,omitempty"` // user -> pages submitted during Day
+}
+
+// errOverQuota wraps the reason a fax was refused by its user's quota.
+var errOverQuota = errors.New("over quota")
+
+// quotaReservation is a fax counted against its user's quota before it was
+// submitted, so that it can be given back.
+type quotaReservation struct {
+	user  string
+	day   string
+	pages int
+}
+
+// loadUserQuotas reads the quota settings and the persisted counters.
+func loadUserQuotas() error {
+	userQuotas.Lock()
+	defer userQuotas.Unlock()
+
+	cfg := config()
+	userQuotas.defaultMax = cfg.QuotaMaxFaxesPerDay
+	userQuotas.defaultMaxPages = cfg.QuotaMaxPagesPerDay
+
+	// USER_QUOTAS="alice=50,bob=10", USER_PAGE_QUOTAS="alice=500"
+	var err error
+	if userQuotas.perUser, err = parseUserQuotas("USER_QUOTAS", cfg.UserQuotas); err != nil {
+		return err
+	}
+	if userQuotas.perUserPages, err = parseUserQuotas("USER_PAGE_QUOTAS", cfg.UserPageQuotas); err != nil {
+		return err
+	}
+
+	userQuotas.resetAfter = 0
+	if v := cfg.QuotaResetTime; v != "" {
+		t, err := time.Parse("15:04", v)
+		if err != nil {
+			return fmt.Errorf("QUOTA_RESET_TIME must be HH:MM, got %q", v)
+		}
+		userQuotas.resetAfter = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	userQuotas.path = filepath.Join(cfg.DataDir, "quotas.json")
+	userQuotas.state = quotaState{Faxes: make(map[string]int), Pages: make(map[string]int)}
+	data, err := os.ReadFile(userQuotas.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", userQuotas.path, err)
+	}
+	if err := json.Unmarshal(data, &userQuotas.state); err != nil {
+		return fmt.Errorf("error parsing %s: %w", userQuotas.path, err)
+	}
+	if userQuotas.state.Faxes == nil {
+		userQuotas.state.Faxes = make(map[string]int)
+	}
+	if userQuotas.state.Pages == nil {
+		userQuotas.state.Pages = make(map[string]int)
+	}
+	return nil
+}
+
+// parseUserQuotas parses a list of user=max entries.
+func parseUserQuotas(setting, v string) (map[string]int, error) {
+	quotas := make(map[string]int)
+	for _, entry := range splitConfigList(v) {
+		user, max, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(max))
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s entry %q", setting, entry)
+		}
+		quotas[strings.TrimSpace(user)] = n
+	}
+	return quotas, nil
+}
+
+// quotaDay returns the quota day that t falls into, honoring the reset time.
+func quotaDay(t time.Time) string {
+	return t.Add(-userQuotas.resetAfter).Format("2006-01-02")
+}
+
+// rollQuotaDay clears the counters when a new quota day has started.
+// Callers must hold userQuotas.
+func rollQuotaDay() {
+	today := quotaDay(time.Now())
+	if userQuotas.state.Day != today {
+		userQuotas.state = quotaState{Day: today, Faxes: make(map[string]int), Pages: make(map[string]int)}
+	}
+}
+
+func maxFaxesFor(user string) int {
+	if max, ok := userQuotas.perUser[user]; ok {
+		return max
+	}
+	return userQuotas.defaultMax
+}
+
+func maxPagesFor(user string) int {
+	if max, ok := userQuotas.perUserPages[user]; ok {
+		return max
+	}
+	return userQuotas.defaultMaxPages
+}
+
+// quotaBreach describes why one more fax of pages pages would take user over
+// their daily allowance, or returns nil. An unknown page count (0) only
+// needs pages left. Callers must hold userQuotas and have rolled the day.
+func quotaBreach(user string, pages int) error {
+	if max := maxFaxesFor(user); max > 0 {
+		if used := userQuotas.state.Faxes[user]; used >= max {
+			return fmt.Errorf("%w: user %s has sent %d of %d faxes today", errOverQuota, user, used, max)
+		}
+	}
+	if max := maxPagesFor(user); max > 0 {
+		used := userQuotas.state.Pages[user]
+		if used >= max {
+			return fmt.Errorf("%w: user %s has sent %d of %d pages today", errOverQuota, user, used, max)
+		}
+		if used+pages > max {
+			return fmt.Errorf("%w: user %s has sent %d of %d pages today and the fax has %d", errOverQuota, user, used, max, pages)
+		}
+	}
+	return nil
+}
+
+// checkUserQuota returns an error describing the breach when a fax of pages
+// pages would take user over their daily allowance, without counting it.
+// Unknown users are not limited.
+func checkUserQuota(user string, pages int) error {
+	if user == "" {
+		return nil
+	}
+	userQuotas.Lock()
+	defer userQuotas.Unlock()
+
+	rollQuotaDay()
+	return quotaBreach(user, pages)
+}
+
+// reserveUserQuota counts one fax of pages pages against user's allowance,
+// or returns an error describing the breach and counts nothing. Release the
+// reservation if the fax is not submitted after all.
+func reserveUserQuota(user string, pages int) (quotaReservation, error) {
+	if user == "" {
+		return quotaReservation{}, nil
+	}
+	userQuotas.Lock()
+	defer userQuotas.Unlock()
+
+	rollQuotaDay()
+	if err := quotaBreach(user, pages); err != nil {
+		return quotaReservation{}, err
+	}
+	userQuotas.state.Faxes[user]++
+	userQuotas.state.Pages[user] += pages
+	if err := saveQuotaState(); err != nil {
+		slog.Error("Error saving quota counters", "err", err)
+	}
+	return quotaReservation{user: user, day: userQuotas.state.Day, pages: pages}, nil
+}
+
+// release gives back a reservation whose fax was not submitted. Counters of
+// an earlier quota day are left as they are.
+func (r quotaReservation) release() {
+	if r.user == "" {
+		return
+	}
+	userQuotas.Lock()
+	defer userQuotas.Unlock()
+
+	rollQuotaDay()
+	if userQuotas.state.Day != r.day {
+		return
+	}
+	userQuotas.state.Faxes[r.user] = max(userQuotas.state.Faxes[r.user]-1, 0)
+	userQuotas.state.Pages[r.user] = max(userQuotas.state.Pages[r.user]-r.pages, 0)
+	if err := saveQuotaState(); err != nil {
+		slog.Error("Error saving quota counters", "err", err)
+	}
+}
+
+// quotaUsage returns what user has used of their allowance today.
+func quotaUsage(user string) (faxes, pages, maxFaxes, maxPages int) {
+	userQuotas.Lock()
+	defer userQuotas.Unlock()
+
+	rollQuotaDay()
+	return userQuotas.state.Faxes[user], userQuotas.state.Pages[user], maxFaxesFor(user), maxPagesFor(user)
+}
+
+// saveQuotaState writes the counters via a temp file and rename.
+// Callers must hold userQuotas.
+func saveQuotaState() error {
+	data, err := json.Marshal(userQuotas.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(userQuotas.path), 0755); err != nil {
+		return err
+	}
+	tmp := userQuotas.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, userQuotas.path)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// useTestQuotas loads the quota settings of env with no counters.
+func useTestQuotas(t *testing.T, env map[string]string) {
+	t.Helper()
+	useTestConfig(t, env)
+	if err := loadUserQuotas(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveUserQuota(t *testing.T) {
+	env := map[string]string{
+		"QUOTA_MAX_FAXES_PER_DAY": "3",
+		"QUOTA_MAX_PAGES_PER_DAY": "10",
+		"USER_QUOTAS":             "carol=0",
+		"USER_PAGE_QUOTAS":        "bob=4,carol=0",
+	}
+	tests := []struct {
+		name    string
+		user    string
+		pages   []int // earlier faxes, reserved in turn
+		fax     int   // pages of the fax to reserve
+		release bool  // the last earlier fax was not submitted
+		over    bool
+	}{
+		{name: "first fax", user: "alice", fax: 2},
+		{name: "no user", fax: 100},
+		{name: "fax limit", user: "alice", pages: []int{1, 1, 1}, fax: 1, over: true},
+		{name: "fax given back", user: "alice", pages: []int{1, 1, 1}, fax: 1, release: true},
+		{name: "page limit", user: "alice", pages: []int{6}, fax: 5, over: true},
+		{name: "exactly the page limit", user: "alice", pages: []int{6}, fax: 4},
+		{name: "per-user page limit", user: "bob", pages: []int{3}, fax: 2, over: true},
+		{name: "pages used up, count unknown", user: "bob", pages: []int{4}, over: true},
+		{name: "unlimited user", user: "carol", pages: []int{5, 5, 5}, fax: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestQuotas(t, env)
+			var last quotaReservation
+			for _, pages := range tt.pages {
+				r, err := reserveUserQuota(tt.user, pages)
+				if err != nil {
+					t.Fatalf("reserving an earlier fax: %v", err)
+				}
+				last = r
+			}
+			if tt.release {
+				last.release()
+			}
+
+			if err := checkUserQuota(tt.user, tt.fax); (err != nil) != tt.over {
+				t.Errorf("checkUserQuota() = %v, over quota %v", err, tt.over)
+			}
+			_, err := reserveUserQuota(tt.user, tt.fax)
+			if (err != nil) != tt.over {
+				t.Fatalf("reserveUserQuota() = %v, over quota %v", err, tt.over)
+			}
+			if err != nil && !errors.Is(err, errOverQuota) {
+				t.Errorf("error %v does not wrap errOverQuota", err)
+			}
+		})
+	}
+}
+
+func TestReserveUserQuotaConcurrent(t *testing.T) {
+	useTestQuotas(t, map[string]string{"QUOTA_MAX_FAXES_PER_DAY": "5"})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := reserveUserQuota("alice", 1); err == nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 5 {
+		t.Errorf("%d faxes reserved, want 5", reserved)
+	}
+}
+
+func TestQuotaCountersPersist(t *testing.T) {
+	useTestQuotas(t, map[string]string{"QUOTA_MAX_FAXES_PER_DAY": "2", "QUOTA_MAX_PAGES_PER_DAY": "10"})
+	if _, err := reserveUserQuota("alice", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadUserQuotas(); err != nil {
+		t.Fatal(err)
+	}
+	faxes, pages, maxFaxes, maxPages := quotaUsage("alice")
+	if faxes != 1 || pages != 3 || maxFaxes != 2 || maxPages != 10 {
+		t.Errorf("quotaUsage() = %d, %d, %d, %d; want 1, 3, 2, 10", faxes, pages, maxFaxes, maxPages)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// OUTBOUND_RATE caps submissions to the send webhooks, e.g. at a provider's
+// limit of 10 per minute. Every webhook request, retries included, takes a
+// token from a bucket that refills at OUTBOUND_RATE per minute and holds up
+// to OUTBOUND_BURST tokens. A job waiting for a token shows "rate limited,
+// queued" in its .sts. A 429 answer with Retry-After holds back every
+// submission until then, with or without OUTBOUND_RATE.
+
+type tokenBucket struct {
+	sync.Mutex
+	tokens    float64
+	last      time.Time
+	holdUntil time.Time
+}
+
+var outboundLimiter tokenBucket
+
+var rateLimitedSubmissions = expvar.NewInt("rate_limited_submissions")
+
+// reserve takes a token and returns how long the caller must wait before
+// using it. Tokens may go negative; later callers then wait longer.
+func (b *tokenBucket) reserve(now time.Time, perMinute, burst int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	rate := float64(perMinute) / float64(time.Minute)
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += float64(now.Sub(b.last)) * rate
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	b.tokens--
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / rate)
+	}
+	if hold := b.holdUntil.Sub(now); hold > wait {
+		wait = hold
+	}
+	return wait
+}
+
+// release returns a reserved token that was not used.
+func (b *tokenBucket) release() {
+	b.Lock()
+	b.tokens++
+	b.Unlock()
+}
+
+// held returns how long submissions are still held off.
+func (b *tokenBucket) held(now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	return b.holdUntil.Sub(now)
+}
+
+// holdOff delays every submission until t.
+func (b *tokenBucket) holdOff(t time.Time) {
+	b.Lock()
+	if t.After(b.holdUntil) {
+		b.holdUntil = t
+	}
+	b.Unlock()
+}
+
+// waitOutboundRate blocks until the job may make a webhook request. It
+// returns errJobCancelled if ctx ends first.
+func waitOutboundRate(ctx context.Context, hylaJobID string) error {
+	cfg := config()
+	var wait time.Duration
+	if cfg.OutboundRate > 0 {
+		wait = outboundLimiter.reserve(time.Now(), cfg.OutboundRate, cfg.OutboundBurst)
+	} else {
+		wait = outboundLimiter.held(time.Now())
+	}
+	if wait <= 0 {
+		return nil
+	}
+	rateLimitedSubmissions.Add(1)
+	slog.Info("Submission rate limited", "job_id", hylaJobID, "wait", wait.Round(time.Millisecond))
+	createStsFile(hylaJobID, stsStateSleeping, "", "", "rate limited, queued")
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		if cfg.OutboundRate > 0 {
+			outboundLimiter.release()
+		}
+		return errJobCancelled
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// /fax-receive takes the fax in one of three forms:
+//
+//   - application/json: a FaxReceive with the document base64-encoded in file_data
+//   - application/pdf: the document as the raw body, with the FaxReceive fields
+//     (uuid, call_uuid, cidnum, number, ...) as query parameters
+//   - multipart/form-data: the document as a file part, with the fields as form fields
+//
+// The raw and multipart bodies are streamed straight to the queue directory
+// rather than held in memory.
+
+// maxReceiveFieldBytes bounds each multipart metadata field.
+const maxReceiveFieldBytes = 64 << 10
+
+// errChecksumMismatch is returned when the document does not match the
+// file_sha256 sent with it.
+var errChecksumMismatch = errors.New("fax document does not match file_sha256")
+
+// errReceiveTooLarge is returned when the document exceeds MAX_FAX_SIZE_MB
+// (or RECEIVE_MAX_BYTES).
+var errReceiveTooLarge = errors.New("fax document exceeds the maximum fax size")
+
+// readReceivedFax reads the fax metadata and stages its document in dir. The
+// returned status is the one to answer with when err is not nil.
+func readReceivedFax(ctx iris.Context, dir string) (FaxReceive, *stagedFile, int, error) {
+	max := config().receiveMaxBytes
+	mediaType, params, _ := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+
+	var (
+		fax    FaxReceive
+		staged *stagedFile
+		err    error
+	)
+	switch mediaType {
+	case contentTypePDF:
+		fax = faxReceiveFromValues(ctx.Request().URL.Query())
+		body := http.MaxBytesReader(ctx.ResponseWriter(), ctx.Request().Body, max)
+		staged, err = stageQueueFile(dir, "fax-receive", body, 0644)
+	case "multipart/form-data":
+		// Allow for the metadata fields and part headers on top of the document.
+		body := http.MaxBytesReader(ctx.ResponseWriter(), ctx.Request().Body, max+1<<20)
+		fax, staged, err = readMultipartFax(body, params["boundary"], dir, max)
+	default:
+		// base64 grows the document by a third.
+		body := http.MaxBytesReader(ctx.ResponseWriter(), ctx.Request().Body, max/3*4+1<<20)
+		fax, staged, err = readJSONFax(body, dir, max)
+	}
+	if err != nil {
+		status := receiveErrorStatus(err)
+		if status == iris.StatusRequestEntityTooLarge {
+			err = fmt.Errorf("%w of %d bytes", errReceiveTooLarge, max)
+		}
+		return fax, nil, status, err
+	}
+	if staged == nil || staged.size == 0 {
+		if staged != nil {
+			staged.discard()
+		}
+		return fax, nil, iris.StatusBadRequest, errors.New("no fax document in the request")
+	}
+	if staged.size > max {
+		staged.discard()
+		return fax, nil, iris.StatusRequestEntityTooLarge, fmt.Errorf("%w of %d bytes", errReceiveTooLarge, max)
+	}
+	if want := strings.TrimSpace(fax.FileSHA256); want != "" && !strings.EqualFold(want, staged.sha256) {
+		staged.discard()
+		return fax, nil, iris.StatusUnprocessableEntity, fmt.Errorf("%w: got %s", errChecksumMismatch, staged.sha256)
+	}
+	return checkReceivedDocument(fax, staged, dir)
+}
+
+// checkReceivedDocument makes sure a staged document is a PDF. A TIFF is
+// converted when TIFF_CONVERT_COMMAND is set; anything else is refused.
+func checkReceivedDocument(fax FaxReceive, staged *stagedFile, dir string) (FaxReceive, *stagedFile, int, error) {
+	head := make([]byte, pdfHeaderWindow)
+	f, err := os.Open(staged.tmpPath)
+	if err != nil {
+		staged.discard()
+		return fax, nil, iris.StatusInternalServerError, err
+	}
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+
+	contentType, err := checkDocumentType(head[:n])
+	if err != nil {
+		staged.discard()
+		return fax, nil, iris.StatusUnsupportedMediaType, fmt.Errorf("fax %w", err)
+	}
+	if contentType == contentTypePDF {
+		return fax, staged, 0, nil
+	}
+	if config().TIFFConvertCommand == "" {
+		staged.discard()
+		return fax, nil, iris.StatusUnsupportedMediaType, fmt.Errorf("fax %w: it is a TIFF and TIFF_CONVERT_COMMAND is not set", errNotPDF)
+	}
+
+	pdfPath, err := convertTIFFToPDF(dir, staged.tmpPath)
+	staged.discard()
+	if err != nil {
+		return fax, nil, iris.StatusInternalServerError, err
+	}
+	info, err := os.Stat(pdfPath)
+	if err != nil {
+		os.Remove(pdfPath)
+		return fax, nil, iris.StatusInternalServerError, err
+	}
+	pdfHash, err := fileSHA256(pdfPath)
+	if err != nil {
+		os.Remove(pdfPath)
+		return fax, nil, iris.StatusInternalServerError, err
+	}
+	slog.Info("Converted received TIFF to PDF", "uuid", fax.UUID, "direction", "inbound", "tiff_bytes", staged.size, "pdf_bytes", info.Size())
+	// The hash stays that of the document as received, for duplicate detection.
+	return fax, &stagedFile{tmpPath: pdfPath, size: info.Size(), sha256: staged.sha256, pdfSHA256: pdfHash}, 0, nil
+}
+
+// receiveErrorStatus maps a read or staging error to a response status.
+func receiveErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge), errors.Is(err, errReceiveTooLarge):
+		return iris.StatusRequestEntityTooLarge
+	case errors.As(err, new(base64.CorruptInputError)):
+		return iris.StatusBadRequest
+	case errors.Is(err, errInsufficientDisk), errors.Is(err, syscall.ENOSPC):
+		return iris.StatusInsufficientStorage
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return iris.StatusInternalServerError
+	}
+	return iris.StatusBadRequest
+}
+
+// readJSONFax reads a FaxReceive object field by field, decoding file_data
+// straight from the body into a staged file so that neither the base64 text
+// nor the document is ever held in memory whole.
+func readJSONFax(body io.Reader, dir string, max int64) (FaxReceive, *stagedFile, error) {
+	var fax FaxReceive
+	var staged *stagedFile
+	fail := func(err error) (FaxReceive, *stagedFile, error) {
+		if staged != nil {
+			staged.discard()
+		}
+		return FaxReceive{}, nil, err
+	}
+
+	r := bufio.NewReader(body)
+	if err := expectJSONByte(r, '{'); err != nil {
+		return fail(err)
+	}
+	fields := map[string]json.RawMessage{}
+	for first := true; ; first = false {
+		c, err := nextJSONByte(r)
+		if err != nil {
+			return fail(err)
+		}
+		if c == '}' && first {
+			break
+		}
+		if !first {
+			if c == '}' {
+				break
+			}
+			if c != ',' {
+				return fail(fmt.Errorf("invalid character %q after object value", c))
+			}
+			if c, err = nextJSONByte(r); err != nil {
+				return fail(err)
+			}
+		}
+		if c != '"' {
+			return fail(fmt.Errorf("invalid character %q looking for object key", c))
+		}
+		r.UnreadByte()
+		var key string
+		if r, err = decodeJSONValue(r, &key); err != nil {
+			return fail(err)
+		}
+		if err := expectJSONByte(r, ':'); err != nil {
+			return fail(err)
+		}
+
+		if key != "file_data" {
+			var raw json.RawMessage
+			if r, err = decodeJSONValue(r, &raw); err != nil {
+				return fail(err)
+			}
+			fields[key] = raw
+			continue
+		}
+		if staged != nil {
+			return fail(errors.New("file_data given more than once"))
+		}
+		if err := expectJSONByte(r, '"'); err != nil {
+			return fail(fmt.Errorf("file_data must be a string: %w", err))
+		}
+		decoder := base64.NewDecoder(base64.StdEncoding, &jsonStringReader{r: r})
+		if staged, err = stageQueueFile(dir, "fax-receive", io.LimitReader(decoder, max+1), 0644); err != nil {
+			if errors.As(err, new(base64.CorruptInputError)) {
+				err = fmt.Errorf("failed to decode file_data: %w", err)
+			}
+			return fail(err)
+		}
+		if staged.size > max {
+			return fail(errReceiveTooLarge)
+		}
+	}
+
+	metadata, err := json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(metadata, &fax)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return fax, staged, nil
+}
+
+// nextJSONByte returns the next byte of r that is not JSON whitespace.
+func nextJSONByte(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c, nil
+	}
+}
+
+func expectJSONByte(r *bufio.Reader, want byte) error {
+	c, err := nextJSONByte(r)
+	if err != nil {
+		return err
+	}
+	if c != want {
+		return fmt.Errorf("invalid character %q looking for %q", c, want)
+	}
+	return nil
+}
+
+// decodeJSONValue decodes the next value of r into v and returns a reader
+// for what follows it, since the decoder reads ahead.
+func decodeJSONValue(r *bufio.Reader, v any) (*bufio.Reader, error) {
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return r, err
+	}
+	return bufio.NewReader(io.MultiReader(dec.Buffered(), r)), nil
+}
+
+// jsonStringReader reads the contents of a JSON string whose opening quote
+// has been consumed, up to the closing quote. Only the escapes that can occur
+// in base64 text are accepted: \/ and the line breaks some encoders insert.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (s *jsonStringReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !s.done {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		switch c {
+		case '"':
+			s.done = true
+			continue
+		case '\\':
+			if c, err = s.r.ReadByte(); err != nil {
+				return n, io.ErrUnexpectedEOF
+			}
+			switch c {
+			case '/':
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			default:
+				return n, fmt.Errorf("unsupported escape \\%c in file_data", c)
+			}
+		}
+		p[n] = c
+		n++
+		if s.r.Buffered() == 0 && n > 0 {
+			break
+		}
+	}
+	if n == 0 && s.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// readMultipartFax streams the file part of a multipart body to dir and
+// collects the other parts as FaxReceive fields.
+func readMultipartFax(body io.Reader, boundary, dir string, max int64) (FaxReceive, *stagedFile, error) {
+	if boundary == "" {
+		return FaxReceive{}, nil, errors.New("multipart body without a boundary")
+	}
+	reader := multipart.NewReader(body, boundary)
+	values := url.Values{}
+	var staged *stagedFile
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if staged != nil {
+				staged.discard()
+			}
+			return FaxReceive{}, nil, err
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxReceiveFieldBytes))
+			part.Close()
+			if err != nil {
+				if staged != nil {
+					staged.discard()
+				}
+				return FaxReceive{}, nil, err
+			}
+			values.Add(part.FormName(), string(value))
+			continue
+		}
+
+		if staged != nil {
+			staged.discard()
+			part.Close()
+			return FaxReceive{}, nil, errors.New("more than one file part")
+		}
+		staged, err = stageQueueFile(dir, "fax-receive", io.LimitReader(part, max+1), 0644)
+		part.Close()
+		if err != nil {
+			return FaxReceive{}, nil, err
+		}
+		if staged.size > max {
+			staged.discard()
+			return FaxReceive{}, nil, errReceiveTooLarge
+		}
+	}
+	if staged == nil {
+		return FaxReceive{}, nil, errors.New("no file part in the multipart body")
+	}
+	return faxReceiveFromValues(values), staged, nil
+}
+
+// faxReceiveFromValues fills the top-level FaxReceive fields from form or
+// query values named like their JSON fields.
+func faxReceiveFromValues(values url.Values) FaxReceive {
+	atoi := func(name string) int {
+		n, _ := strconv.Atoi(values.Get(name))
+		return n
+	}
+	return FaxReceive{
+		UUID:        values.Get("uuid"),
+		CallUUID:    values.Get("call_uuid"),
+		SrcTenantID: atoi("src_tenant_id"),
+		DstTenantID: atoi("dst_tenant_id"),
+		Number:      values.Get("number"),
+		CIDNum:      values.Get("cidnum"),
+		CIDName:     values.Get("cidname"),
+		Filename:    values.Get("filename"),
+		Ident:       values.Get("ident"),
+		Header:      values.Get("header"),
+		Status:      values.Get("status"),
+		TotDials:    atoi("totdials"),
+		NDials:      atoi("ndials"),
+		TotTries:    atoi("tottries"),
+		Ts:          values.Get("ts"),
+		FileSHA256:  values.Get("file_sha256"),
+	}
+}
+
+// receiveResult is the body of a 200 from /fax-receive, and the result
+// GET /received/{id} shows once the fax is written. Providers keep it for
+// audit, so its field names must not change.
+type receiveResult struct {
+	BaseName   string    `json:"base_name"`           // file name without extension, e.g. {1111}20240101120000
+	PdfPath    string    `json:"pdf_path"`            // relative to FTP_ROOT, e.g. synergyfaxq/{1111}20240101120000.pdf
+	RecvPath   string    `json:"recv_path,omitempty"` // relative to FTP_ROOT; empty for a fax only e-mailed
+	RecordID   string    `json:"record_id"`           // fax record key, for GET /jobs/{id}
+	SHA256     string    `json:"sha256"`              // of the stored PDF
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// ftpRootPath returns path relative to FTP_ROOT, with forward slashes.
+func ftpRootPath(path string) string {
+	if rel, err := filepath.Rel(config().FTPRoot, path); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+// storeReceivedFax commits the staged document of a received fax to the
+// queue folder, writes its .recv and records it. The returned status is the
+// one to answer with when err is not nil.
+func storeReceivedFax(fax FaxReceive, staged *stagedFile, receivedAt time.Time, replayed bool) (receiveResult, int, error) {
+	contentHash := staged.sha256
+	pdfHash := cmp.Or(staged.pdfSHA256, contentHash)
+	t := receivedAt.In(recvLocation)
+
+	// RECEIVE_TENANT_MAP may send the fax to its tenant's own queue folder.
+	recvDir, tenant, err := receiveDir(fax.Number, fax.DstTenantID)
+	if err != nil {
+		staged.discard()
+		recordDeliveryOutcome(true, false, 0)
+		return receiveResult{}, iris.StatusInternalServerError, fmt.Errorf("failed to create local directory: %w", err)
+	}
+
+	// A fax RECEIVE_EMAIL_MAP sends only to email is kept out of Synergy's folder.
+	route, emailed := matchEmailRoute(fax.Number, fax.DstTenantID)
+	emailOnly := emailed && !route.Queue
+	pdfDir := recvDir
+	if emailOnly {
+		if pdfDir, err = emailDirPath(recvDir); err != nil {
+			staged.discard()
+			recordDeliveryOutcome(true, false, 0)
+			return receiveResult{}, iris.StatusInternalServerError, fmt.Errorf("failed to create local directory: %w", err)
+		}
+	}
+
+	// Change the file extension to .pdf even if fax.Filename ends with .tiff.
+	pdfName, err := reserveReceivedName(fax, t, pdfDir, recvDir)
+	if err != nil {
+		staged.discard()
+		recordDeliveryOutcome(true, false, 0)
+		return receiveResult{}, iris.StatusInternalServerError, fmt.Errorf("failed to name received file: %w", err)
+	}
+	pdfLocalPath := filepath.Join(pdfDir, pdfName+".pdf")
+	defer releaseReceivedName(pdfLocalPath)
+
+	if err := staged.commit(pdfLocalPath); err != nil {
+		staged.discard()
+		recordDeliveryOutcome(true, false, 0)
+		return receiveResult{}, iris.StatusInternalServerError, fmt.Errorf("failed to write PDF file: %w", err)
+	}
+	pages := countFilePages(pdfLocalPath)
+	slog.Info("Saved received PDF", "uuid", fax.UUID, "direction", "inbound", "file", pdfLocalPath, "bytes", staged.size, "pages", pages,
+		"tenant_dir", tenant)
+
+	// The .recv carries the time the provider gives for the fax, which
+	// differs from the delivery time when deliveries are batched or retried.
+	faxTime, faxTimestamp := receivedFaxTime(fax)
+
+	// Create a .recv file which will be used to signal fax receiving.
+	var recvLocalPath string
+	if !emailOnly {
+		layout := recvFormatFor(recvDir).timeLayout
+		recvTime := t.Format(layout)
+		if !faxTime.IsZero() {
+			recvTime = faxTime.In(recvLocation).Format(layout)
+		}
+
+		recvFilename := pdfName + ".recv"
+		recvLocalPath = filepath.Join(recvDir, recvFilename)
+		content, err := recvContent(recvDir, recvData{
+			Time:     recvTime,
+			BaseName: pdfName,
+			CIDNum:   fax.CIDNum,
+			CIDName:  fax.CIDName,
+			Ident:    fax.Ident,
+			Number:   fax.Number,
+			Pages:    pages,
+			SizeKB:   float64(staged.size) / 1024,
+		})
+		if err == nil {
+			err = writeQueueFile(recvLocalPath, []byte(content), 0644)
+		}
+		if err != nil {
+			// Without its .recv Synergy never imports the PDF, and the
+			// provider's retry writes another.
+			os.Remove(pdfLocalPath)
+			recordDeliveryOutcome(true, false, 0)
+			return receiveResult{}, iris.StatusInternalServerError, fmt.Errorf("failed to write recv file: %w", err)
+		}
+		slog.Info("Created recv file", "uuid", fax.UUID, "direction", "inbound", "file", recvLocalPath)
+	}
+
+	rememberInboundContent(fax.CIDNum, contentHash, fax.UUID)
+
+	// Store this received fax in the tracker.
+	record := &FaxJobRecord{
+		ReceivedUUID: fax.UUID,
+		CallUUID:     fax.CallUUID,
+		Direction:    "inbound",
+		PdfPath:      pdfLocalPath,
+		RecvPath:     recvLocalPath,
+		CIDNum:       fax.CIDNum,
+		CIDName:      fax.CIDName,
+		Number:       fax.Number,
+		DstTenantID:  fax.DstTenantID,
+		TenantDir:    tenant,
+		ContentHash:  contentHash,
+		SHA256:       pdfHash,
+		Pages:        pages,
+		Replayed:     replayed,
+		FaxTime:      faxTime,
+		FaxTimestamp: faxTimestamp,
+		ReceivedAt:   receivedAt,
+	}
+	record.setStatus("received", statusSourceReceive, time.Now())
+	faxRecordsMutex.Lock()
+	faxRecords[fax.UUID] = record
+	faxRecordsMutex.Unlock()
+	recordReceivedFaxHistory(fax, pages, receivedAt)
+	archiveReceivedFax(fax, pdfLocalPath, pages, contentHash)
+	forwardReceivedFax(fax.UUID)
+	if emailed {
+		emailReceivedFax(fax.UUID, route)
+	}
+	saveState()
+	recordDeliveryOutcome(true, true, 0)
+	result := receiveResult{
+		BaseName:   pdfName,
+		PdfPath:    ftpRootPath(pdfLocalPath),
+		RecordID:   fax.UUID,
+		SHA256:     pdfHash,
+		ReceivedAt: receivedAt,
+	}
+	if recvLocalPath != "" {
+		result.RecvPath = ftpRootPath(recvLocalPath)
+	}
+	return result, iris.StatusOK, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// receiveRequest builds a /fax-receive request carrying doc in the given
+// encoding, with the fax's metadata alongside it.
+func receiveRequest(t *testing.T, encoding string, doc []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	meta := map[string]string{"uuid": "00000000-0000-0000-0000-0123456789ab", "cidnum": "6045551234", "number": "6045550100"}
+	var req *http.Request
+	switch encoding {
+	case "json":
+		fields := map[string]string{"file_data": base64.StdEncoding.EncodeToString(doc)}
+		for k, v := range meta {
+			fields[k] = v
+		}
+		body, _ := json.Marshal(fields)
+		req = httptest.NewRequest("POST", "/fax-receive", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	case "pdf":
+		query := make([]string, 0, len(meta))
+		for k, v := range meta {
+			query = append(query, k+"="+v)
+		}
+		req = httptest.NewRequest("POST", "/fax-receive?"+strings.Join(query, "&"), bytes.NewReader(doc))
+		req.Header.Set("Content-Type", contentTypePDF)
+	case "multipart":
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		for k, v := range meta {
+			w.WriteField(k, v)
+		}
+		part, _ := w.CreateFormFile("file", "fax.pdf")
+		part.Write(doc)
+		w.Close()
+		req = httptest.NewRequest("POST", "/fax-receive", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+	}
+	return serveTestRequest(t, registerProviderRoutes, req)
+}
+
+func TestReceiveContentTypes(t *testing.T) {
+	const max = 4096
+	tests := []struct {
+		encoding string
+		size     int
+		status   int
+	}{
+		{encoding: "json", size: 1000, status: 200},
+		{encoding: "json", size: max, status: 200},
+		{encoding: "json", size: max + 1, status: 413},
+		{encoding: "pdf", size: 1000, status: 200},
+		{encoding: "pdf", size: max, status: 200},
+		{encoding: "pdf", size: max + 1, status: 413},
+		{encoding: "multipart", size: 1000, status: 200},
+		{encoding: "multipart", size: max, status: 200},
+		{encoding: "multipart", size: max + 1, status: 413},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d bytes", tt.encoding, tt.size), func(t *testing.T) {
+			cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false",
+				"RECEIVE_MAX_BYTES": fmt.Sprint(max)})
+			dir := cfg.FTPRoot + FaxDir
+			doc := []byte("%PDF-1.4\n")
+			doc = append(doc, bytes.Repeat([]byte{'x'}, tt.size-len(doc))...)
+
+			rec := receiveRequest(t, tt.encoding, doc)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != 200 {
+				entries, _ := os.ReadDir(dir)
+				for _, e := range entries {
+					t.Errorf("%s left in the queue directory", e.Name())
+				}
+				return
+			}
+			var result receiveResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFile(t, filepath.Join(cfg.FTPRoot, result.PdfPath)); got != string(doc) {
+				t.Errorf("stored %d bytes, want the %d sent", len(got), len(doc))
+			}
+			if recv := readTestFile(t, filepath.Join(cfg.FTPRoot, result.RecvPath)); !strings.Contains(recv, "6045551234") {
+				t.Errorf(".recv %q does not carry the caller number", recv)
+			}
+		})
+	}
+}
+
+// jsonFaxBody returns a JSON /fax-receive body whose file_data is a PDF of
+// size bytes, generated as it is read so that the body itself takes no memory.
+func jsonFaxBody(size int64) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		enc := base64.NewEncoder(base64.StdEncoding, pw)
+		doc := io.MultiReader(strings.NewReader("%PDF-1.4\n"), io.LimitReader(zeroReader{}, size-int64(len("%PDF-1.4\n"))))
+		_, err := io.Copy(enc, doc)
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return io.MultiReader(strings.NewReader(`{"uuid":"00000000-0000-0000-0000-0123456789ab","file_data":"`), pr, strings.NewReader(`","cidnum":"6045551234"}`))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// TestReadJSONFaxMemory checks that decoding file_data allocates about the
+// same whatever the size of the fax.
+func TestReadJSONFaxMemory(t *testing.T) {
+	for _, size := range []int64{1 << 20, 8 << 20, 32 << 20} {
+		t.Run(fmt.Sprintf("%d MB", size>>20), func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			fax, staged, err := readJSONFax(jsonFaxBody(size), dir, size)
+			runtime.ReadMemStats(&after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer staged.discard()
+			if staged.size != size || fax.CIDNum != "6045551234" {
+				t.Errorf("staged %d bytes with cidnum %q, want %d and 6045551234", staged.size, fax.CIDNum, size)
+			}
+			// Buffering the body or the document would allocate at least size.
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+				t.Errorf("allocated %d bytes for a %d-byte fax", allocated, size)
+			}
+		})
+	}
+}
+
+func BenchmarkReadJSONFax(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("%d MB", size>>20), func(b *testing.B) {
+			dir := b.TempDir()
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				_, staged, err := readJSONFax(jsonFaxBody(size), dir, size)
+				if err != nil {
+					b.Fatal(err)
+				}
+				staged.discard()
+			}
+		})
+	}
+}
+
+func TestReceiveMaxFaxSize(t *testing.T) {
+	const max = 1 << 20 // MAX_FAX_SIZE_MB=1
+	tests := []struct {
+		encoding string
+		size     int
+		status   int
+	}{
+		{encoding: "json", size: max, status: 200},
+		{encoding: "json", size: max + 1, status: 413},
+		{encoding: "pdf", size: max, status: 200},
+		{encoding: "pdf", size: max + 1, status: 413},
+		{encoding: "pdf", size: 4 * max, status: 413},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d bytes", tt.encoding, tt.size), func(t *testing.T) {
+			useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false", "MAX_FAX_SIZE_MB": "1"})
+			doc := []byte("%PDF-1.4\n")
+			doc = append(doc, bytes.Repeat([]byte{'x'}, tt.size-len(doc))...)
+
+			rec := receiveRequest(t, tt.encoding, doc)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == 200 {
+				return
+			}
+			var body apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || !strings.Contains(body.Error, "maximum fax size") {
+				t.Errorf("body %q, want a JSON error about the maximum fax size", rec.Body)
+			}
+		})
+	}
+}
+
+func TestReceiveDocumentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		status  int
+		wantErr string
+	}{
+		{name: "PDF", doc: "%PDF-1.4\n", status: 200},
+		{name: "TIFF without a converter", doc: "II*\x00\x08\x00\x00\x00", status: 415, wantErr: "TIFF_CONVERT_COMMAND is not set"},
+		{name: "Word", doc: "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1", status: 415, wantErr: "legacy Office document"},
+		{name: "text", doc: "not a fax", status: 415, wantErr: "no %PDF- header"},
+	}
+	for _, tt := range tests {
+		for _, encoding := range []string{"json", "pdf", "multipart"} {
+			t.Run(tt.name+" "+encoding, func(t *testing.T) {
+				cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false"})
+				rec := receiveRequest(t, encoding, []byte(tt.doc))
+				if rec.Code != tt.status {
+					t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+				}
+				if tt.status == 200 {
+					return
+				}
+				var body apiError
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || !strings.Contains(body.Error, tt.wantErr) {
+					t.Errorf("body %q, want an error saying %q", rec.Body, tt.wantErr)
+				}
+				entries, _ := os.ReadDir(cfg.FTPRoot + FaxDir)
+				for _, e := range entries {
+					t.Errorf("%s left in the queue directory", e.Name())
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Received faxes are named from RECEIVED_NAME_TEMPLATE, by default the last
+// group of the UUID in braces followed by the timestamp, e.g.
+// {5f3a9c0d1e2b}20240101120000. Two faxes can still end up with the same
+// name, for instance when a provider's UUIDs share their last group, so a
+// name already on disk, or being written by another delivery, gets -1, -2
+// and so on appended rather than replacing the earlier fax.
+
+const defaultReceivedNameTemplate = "{{.UUIDTag}}{{.Time}}"
+
+// maxReceivedNameSuffix bounds the search for a free name.
+const maxReceivedNameSuffix = 1000
+
+var (
+	receivedNameTemplate *template.Template
+	receivedNameSeq      atomic.Uint64
+
+	receivedNameCollisions = expvar.NewInt("received_name_collisions")
+
+	// receivedNamesTaken holds the names being written, so two deliveries
+	// completing together cannot both find the same name free.
+	receivedNamesTaken = struct {
+		sync.Mutex
+		names map[string]bool
+	}{names: make(map[string]bool)}
+)
+
+// receivedNameData holds the fields RECEIVED_NAME_TEMPLATE can use.
+type receivedNameData struct {
+	UUID       string
+	UUIDSuffix string // last group of the UUID
+	UUIDTag    string // UUIDSuffix in braces
+	Time       string // formatted with the file name timestamp format
+	CIDNum     string // digits only
+	Number     string // digits only
+	Seq        uint64 // counts up from 1 from each start
+}
+
+// loadReceivedNameTemplate parses RECEIVED_NAME_TEMPLATE and renders it once
+// with sample values, so a mistake stops the service at startup.
+func loadReceivedNameTemplate() error {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(cmp.Or(config().ReceivedNameTemplate, defaultReceivedNameTemplate))
+	if err != nil {
+		return fmt.Errorf("RECEIVED_NAME_TEMPLATE: %w", err)
+	}
+	sample, err := renderReceivedName(tmpl, receivedNameData{
+		UUID: "00000000-0000-0000-0000-000000000000", UUIDSuffix: "000000000000", UUIDTag: "{000000000000}",
+		Time: time.Now().Format(recvDefaultFormat.filenameLayout), CIDNum: "6045550100", Number: "6045550101", Seq: 1,
+	})
+	if err != nil {
+		return fmt.Errorf("RECEIVED_NAME_TEMPLATE: %w", err)
+	}
+	if sample == "" {
+		return errors.New("RECEIVED_NAME_TEMPLATE produces an empty file name")
+	}
+	receivedNameTemplate = tmpl
+	return nil
+}
+
+// renderReceivedName renders a base name, replacing the characters that are
+// not valid in a file name with underscores.
+func renderReceivedName(tmpl *template.Template, data receivedNameData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(b.String()))
+	if name == "." || name == ".." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// reserveReceivedName picks the base name of a received fax whose PDF goes in
+// pdfDir and whose .recv goes in recvDir, neither of which may hold a file of
+// that name yet. The name must be released once the files are written.
+func reserveReceivedName(fax FaxReceive, t time.Time, pdfDir, recvDir string) (string, error) {
+	uuidParts := strings.Split(fax.UUID, "-")
+	suffix := uuidParts[len(uuidParts)-1]
+	base, err := renderReceivedName(receivedNameTemplate, receivedNameData{
+		UUID:       fax.UUID,
+		UUIDSuffix: suffix,
+		UUIDTag:    "{" + suffix + "}",
+		Time:       t.Format(recvFormatFor(recvDir).filenameLayout),
+		CIDNum:     digitsOnly(fax.CIDNum),
+		Number:     digitsOnly(fax.Number),
+		Seq:        receivedNameSeq.Add(1),
+	})
+	if err != nil {
+		return "", fmt.Errorf("RECEIVED_NAME_TEMPLATE: %w", err)
+	}
+	if base == "" {
+		return "", errors.New("RECEIVED_NAME_TEMPLATE produced an empty file name")
+	}
+
+	receivedNamesTaken.Lock()
+	defer receivedNamesTaken.Unlock()
+	for n := 0; n <= maxReceivedNameSuffix; n++ {
+		name := base
+		if n > 0 {
+			name = base + "-" + strconv.Itoa(n)
+		}
+		pdfPath, recvPath := filepath.Join(pdfDir, name+".pdf"), filepath.Join(recvDir, name+".recv")
+		if receivedNamesTaken.names[pdfPath] || fileExists(pdfPath) || fileExists(recvPath) {
+			continue
+		}
+		if n > 0 {
+			receivedNameCollisions.Add(1)
+			slog.Warn("Received file name already in use; adding a suffix", "uuid", fax.UUID, "direction", "inbound",
+				"name", base, "used", name)
+		}
+		receivedNamesTaken.names[pdfPath] = true
+		return name, nil
+	}
+	return "", fmt.Errorf("no free file name for %s in %s", base, pdfDir)
+}
+
+// releaseReceivedName ends the reservation of the name whose PDF is pdfPath.
+func releaseReceivedName(pdfPath string) {
+	receivedNamesTaken.Lock()
+	delete(receivedNamesTaken.names, pdfPath)
+	receivedNamesTaken.Unlock()
+}
+
+// fileExists reports whether anything, even a broken link, is at path.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
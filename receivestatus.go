@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// With RECEIVE_ASYNC, /fax-receive answers 202 Accepted as soon as the
+// document is staged in the queue folder, so a slow disk does not run into
+// the provider's webhook timeout and a redelivery. The PDF is then committed
+// and the .recv written in the background, and GET /received/{id} reports how
+// that went. Outcomes are kept in memory for JOB_STATE_TTL.
+
+// States of a received fax accepted with 202.
+const (
+	receivePending = "pending"
+	receiveWritten = "written"
+	receiveFailed  = "failed"
+)
+
+var receiveWriteFailures = expvar.NewInt("receive_write_failures")
+
+// receiveAccepted is the body of a 202 from /fax-receive.
+type receiveAccepted struct {
+	ID        string `json:"id,omitempty"`
+	StatusURL string `json:"status_url,omitempty"`
+}
+
+// receivedStatus is what GET /received/{id} reports.
+type receivedStatus struct {
+	ID         string         `json:"id"`
+	UUID       string         `json:"uuid"`
+	State      string         `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	Result     *receiveResult `json:"result,omitempty"` // once written
+	ReceivedAt time.Time      `json:"received_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+var receiveTracking = struct {
+	sync.Mutex
+	entries map[string]*receivedStatus
+}{entries: make(map[string]*receivedStatus)}
+
+// trackReceive records a received fax as pending and returns its tracking
+// ID. Outcomes older than JOB_STATE_TTL are dropped.
+func trackReceive(uuid string, receivedAt time.Time) string {
+	var b [12]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+
+	receiveTracking.Lock()
+	defer receiveTracking.Unlock()
+	cutoff := time.Now().Add(-config().JobStateTTL)
+	for key, status := range receiveTracking.entries {
+		if status.State != receivePending && status.UpdatedAt.Before(cutoff) {
+			delete(receiveTracking.entries, key)
+		}
+	}
+	receiveTracking.entries[id] = &receivedStatus{ID: id, UUID: uuid, State: receivePending, ReceivedAt: receivedAt, UpdatedAt: receivedAt}
+	return id
+}
+
+// pendingReceive returns the tracking ID of a fax with this UUID still being
+// written, so a redelivery gets the same one.
+func pendingReceive(uuid string) (string, bool) {
+	receiveTracking.Lock()
+	defer receiveTracking.Unlock()
+	for id, status := range receiveTracking.entries {
+		if status.UUID == uuid && status.State == receivePending {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// finishReceive records the outcome of writing a received fax.
+func finishReceive(id string, result receiveResult, err error) {
+	receiveTracking.Lock()
+	defer receiveTracking.Unlock()
+	status, ok := receiveTracking.entries[id]
+	if !ok {
+		return
+	}
+	status.UpdatedAt = time.Now()
+	if err != nil {
+		status.State, status.Error = receiveFailed, err.Error()
+		receiveWriteFailures.Add(1)
+		slog.Error("Unable to write received fax", "uuid", status.UUID, "direction", "inbound", "tracking_id", id, "err", err)
+		return
+	}
+	status.State, status.Result = receiveWritten, &result
+}
+
+// receiveStatus returns the state of the received fax with tracking ID id.
+func receiveStatus(id string) (receivedStatus, bool) {
+	receiveTracking.Lock()
+	defer receiveTracking.Unlock()
+	status, ok := receiveTracking.entries[id]
+	if !ok {
+		return receivedStatus{}, false
+	}
+	return *status, true
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	_ "time/tzdata" // FAX_TIMEZONE must resolve in containers without a zoneinfo database
+)
+
+const (
+	defaultRecvTimeFormat     = "01/02/06 15:04" // date line Synergy reads from the .recv file
+	defaultFilenameTimeFormat = "20060102150405" // timestamp part of received file names
+	defaultRecvTemplate       = `{{.Time}}\n{{.Device}}\n{{.BaseName}}\n{{.CIDNum}}\n`
+	defaultRecvDevice         = "ttyS0" // Used to correlate sessions.
+)
+
+var (
+	recvLocation      = time.Local
+	recvTemplate      *template.Template
+	recvDevices       map[string]string // called number, digits only -> device
+	recvDefaultFormat = recvFormat{timeLayout: defaultRecvTimeFormat, filenameLayout: defaultFilenameTimeFormat, decimalMark: "."}
+	recvFolderFormats map[string]recvFormat // queue folder -> format, for FAX_QUEUE_DIRS entries with recv_* options
+)
+
+// recvFormat is how the .recv files and received file names of a queue folder
+// are written: RECV_TIME_FORMAT, RECV_DECIMAL_MARK and
+// RECV_THOUSANDS_SEPARATOR, overridden by the folder's recv_time_format,
+// recv_decimal_mark and recv_thousands_separator options in FAX_QUEUE_DIRS.
+type recvFormat struct {
+	timeLayout     string // date line of the .recv
+	filenameLayout string // timestamp in received file names
+	decimalMark    string
+	thousandsSep   string
+}
+
+// recvSeparators names the decimal marks and thousands separators the
+// settings accept. Names rather than the characters themselves keep commas
+// out of FAX_QUEUE_DIRS entries.
+var recvSeparators = map[string]string{"none": "", "point": ".", "comma": ",", "space": " ", "apostrophe": "'"}
+
+// parseNumberSeparator returns the separator a setting names.
+func parseNumberSeparator(setting, name string) (string, error) {
+	sep, ok := recvSeparators[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return "", fmt.Errorf("%s %q must be none, point, comma, space or apostrophe", setting, name)
+	}
+	return sep, nil
+}
+
+// recvData holds the fields RECV_TEMPLATE can use.
+type recvData struct {
+	Time     string // formatted with the folder's time layout
+	Device   string // from RECV_DEVICE_MAP, or ttyS0
+	BaseName string // PDF file name without .pdf
+	CIDNum   string
+	CIDName  string
+	Ident    string  // remote station ident (CSID)
+	Number   string  // number the fax was sent to
+	Pages    int     // 0 if unknown
+	SizeKB   float64 // size of the PDF
+}
+
+// loadRecvFormat reads RECV_TIME_FORMAT (a Go time layout) and, when
+// RECV_FILENAME_USE_TIME_FORMAT=true, applies it to received file names too,
+// then RECV_DECIMAL_MARK, RECV_THOUSANDS_SEPARATOR and the recv_* options of
+// the FAX_QUEUE_DIRS entries, which Config.validate has checked, then
+// RECV_TEMPLATE, RECV_DEVICE_MAP and RECEIVED_NAME_TEMPLATE.
+// Timestamps are written in FAX_TIMEZONE, which Config.validate has resolved.
+func loadRecvFormat() error {
+	cfg := config()
+	recvLocation = cfg.faxLocation
+
+	format := recvFormat{timeLayout: defaultRecvTimeFormat, filenameLayout: defaultFilenameTimeFormat}
+	if layout := cfg.RecvTimeFormat; layout != "" {
+		if err := validateTimeLayout(layout); err != nil {
+			return fmt.Errorf("RECV_TIME_FORMAT %q: %w", layout, err)
+		}
+		format.timeLayout = layout
+	}
+	var err error
+	if format.decimalMark, err = parseNumberSeparator("RECV_DECIMAL_MARK", cfg.RecvDecimalMark); err != nil {
+		return err
+	}
+	if format.thousandsSep, err = parseNumberSeparator("RECV_THOUSANDS_SEPARATOR", cfg.RecvThousandsSeparator); err != nil {
+		return err
+	}
+	if format.decimalMark == "" || format.decimalMark == format.thousandsSep {
+		return fmt.Errorf("RECV_DECIMAL_MARK %q must be point or comma and differ from RECV_THOUSANDS_SEPARATOR", cfg.RecvDecimalMark)
+	}
+	if err := format.useForFilenames("RECV_TIME_FORMAT"); err != nil {
+		return err
+	}
+
+	folders := make(map[string]recvFormat)
+	for _, dir := range cfg.queueDirs {
+		if dir.RecvTimeFormat == "" && dir.RecvDecimalMark == "" && dir.RecvThousandsSeparator == "" {
+			continue
+		}
+		f := format
+		if dir.RecvTimeFormat != "" {
+			f.timeLayout = dir.RecvTimeFormat
+			if err := f.useForFilenames("FAX_QUEUE_DIRS recv_time_format for " + dir.Path); err != nil {
+				return err
+			}
+		}
+		if dir.RecvDecimalMark != "" {
+			f.decimalMark = recvSeparators[dir.RecvDecimalMark]
+		}
+		if dir.RecvThousandsSeparator != "" {
+			f.thousandsSep = recvSeparators[dir.RecvThousandsSeparator]
+		}
+		if f.decimalMark == "" || f.decimalMark == f.thousandsSep {
+			return fmt.Errorf("FAX_QUEUE_DIRS entry for %s: the decimal mark must be point or comma and differ from the thousands separator", dir.Path)
+		}
+		folders[dir.Path] = f
+	}
+	recvDefaultFormat, recvFolderFormats = format, folders
+
+	// Environment files cannot hold line breaks, so \n stands for one.
+	text := strings.ReplaceAll(cmp.Or(cfg.RecvTemplate, defaultRecvTemplate), `\n`, "\n")
+	tmpl, err := template.New("recv").Option("missingkey=error").Funcs(template.FuncMap{"number": format.number}).Parse(text)
+	if err != nil {
+		return fmt.Errorf("RECV_TEMPLATE: %w", err)
+	}
+	if _, err := renderRecv(tmpl, recvData{}); err != nil {
+		return fmt.Errorf("RECV_TEMPLATE: %w", err)
+	}
+	recvTemplate = tmpl
+
+	devices := make(map[string]string)
+	for _, entry := range splitConfigList(cfg.RecvDeviceMap) {
+		number, device, ok := strings.Cut(entry, "=")
+		number, device = digitsOnly(number), strings.TrimSpace(device)
+		if !ok || number == "" || device == "" || strings.ContainsAny(device, "\r\n") {
+			return fmt.Errorf("RECV_DEVICE_MAP entry %q must be number=device", entry)
+		}
+		devices[number] = device
+	}
+	recvDevices = devices
+	return loadReceivedNameTemplate()
+}
+
+// useForFilenames makes the time layout the file name timestamp format when
+// RECV_FILENAME_USE_TIME_FORMAT=true, if it is valid in a file name.
+func (f *recvFormat) useForFilenames(setting string) error {
+	if !config().RecvFilenameUseTimeFormat {
+		return nil
+	}
+	if sample := time.Now().Format(f.timeLayout); strings.ContainsAny(sample, `/\:*?"<>|`) {
+		return fmt.Errorf("%s %q produces %q, which is not valid in a file name", setting, f.timeLayout, sample)
+	}
+	f.filenameLayout = f.timeLayout
+	return nil
+}
+
+// recvFormatFor returns the format of the queue folder dir.
+func recvFormatFor(dir string) recvFormat {
+	if f, ok := recvFolderFormats[filepath.Clean(dir)]; ok {
+		return f
+	}
+	return recvDefaultFormat
+}
+
+// number formats v, an integer or a float, with decimals digits after the
+// decimal mark (none unless given) and the thousands separator between groups
+// of three digits. RECV_TEMPLATE calls it as {{number .SizeKB 1}}.
+func (f recvFormat) number(v any, decimals ...int) (string, error) {
+	var x float64
+	switch n := v.(type) {
+	case int:
+		x = float64(n)
+	case int64:
+		x = float64(n)
+	case float64:
+		x = n
+	default:
+		return "", fmt.Errorf("number: %v is not a number", v)
+	}
+	prec := 0
+	if len(decimals) > 0 {
+		prec = decimals[0]
+	}
+	digits := strconv.FormatFloat(math.Abs(x), 'f', prec, 64)
+	whole, frac, _ := strings.Cut(digits, ".")
+
+	var b strings.Builder
+	if x < 0 && strings.Trim(digits, "0.") != "" {
+		b.WriteByte('-')
+	}
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(f.thousandsSep)
+		}
+		b.WriteRune(d)
+	}
+	if frac != "" {
+		b.WriteString(f.decimalMark)
+		b.WriteString(frac)
+	}
+	return b.String(), nil
+}
+
+func renderRecv(tmpl *template.Template, data recvData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// recvContent renders the .recv file of a received fax in the format of the
+// queue folder dir.
+func recvContent(dir string, data recvData) (string, error) {
+	data.Device = defaultRecvDevice
+	for number, device := range recvDevices {
+		if sameNumber(number, digitsOnly(data.Number)) {
+			data.Device = device
+			break
+		}
+	}
+	tmpl, err := recvTemplate.Clone()
+	if err != nil {
+		return "", err
+	}
+	return renderRecv(tmpl.Funcs(template.FuncMap{"number": recvFormatFor(dir).number}), data)
+}
+
+// validateTimeLayout checks that layout formats and re-parses a probe time
+// and that it actually distinguishes the day, month, hour and minute.
+func validateTimeLayout(layout string) error {
+	// Day 23 cannot be mistaken for a month, so a DD/MM vs MM/DD mix-up fails the round trip.
+	probe := time.Date(2009, time.November, 23, 14, 5, 0, 0, time.UTC)
+	formatted := probe.Format(layout)
+	parsed, err := time.Parse(layout, formatted)
+	if err != nil {
+		return fmt.Errorf("cannot re-parse %q: %w", formatted, err)
+	}
+	if parsed.Format(layout) != formatted {
+		return fmt.Errorf("round trip of %q produced %q", formatted, parsed.Format(layout))
+	}
+
+	for _, other := range []time.Time{
+		probe.AddDate(0, 0, 1),
+		probe.AddDate(0, 1, 0),
+		probe.Add(time.Hour),
+		probe.Add(time.Minute),
+	} {
+		if other.Format(layout) == formatted {
+			return fmt.Errorf("layout does not include the day, month, hour and minute")
+		}
+	}
+	return nil
+}
+
+// faxTimeLayouts are the timestamp forms accepted in ts and
+// fax_source_info.timestamp, besides Unix seconds or milliseconds. Times
+// without a zone are taken as UTC.
+var faxTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05", "2006-01-02T15:04:05"}
+
+// parseFaxTime parses a provider timestamp.
+func parseFaxTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if n > 1e11 { // milliseconds
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range faxTimeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", v)
+}
+
+// receivedFaxTime returns when the provider says the fax came in: its ts, or
+// else its fax_source_info.timestamp. A missing or malformed timestamp,
+// which is logged, gives the zero time, and the delivery time is used.
+func receivedFaxTime(fax FaxReceive) (time.Time, string) {
+	for _, field := range []struct{ name, value string }{
+		{"ts", fax.Ts},
+		{"fax_source_info.timestamp", fax.FaxSourceInfo.Timestamp},
+	} {
+		if strings.TrimSpace(field.value) == "" {
+			continue
+		}
+		t, err := parseFaxTime(field.value)
+		if err != nil {
+			slog.Warn("Ignoring malformed fax timestamp", "uuid", fax.UUID, "direction", "inbound", "field", field.name, "err", err)
+			continue
+		}
+		return t, field.value
+	}
+	return time.Time{}, ""
+}
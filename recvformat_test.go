@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// useTestRecvFormat puts a configuration read from env in effect, like
+// useTestConfig, and loads its .recv format, which is restored when the test
+// ends.
+func useTestRecvFormat(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	cfg := useTestConfig(t, env)
+	prevDefault, prevFolders, prevTemplate, prevDevices, prevLocation, prevName :=
+		recvDefaultFormat, recvFolderFormats, recvTemplate, recvDevices, recvLocation, receivedNameTemplate
+	t.Cleanup(func() {
+		recvDefaultFormat, recvFolderFormats, recvTemplate, recvDevices, recvLocation, receivedNameTemplate =
+			prevDefault, prevFolders, prevTemplate, prevDevices, prevLocation, prevName
+	})
+	if err := loadRecvFormat(); err != nil {
+		t.Fatalf("loadRecvFormat() = %v", err)
+	}
+	return cfg
+}
+
+func TestRecvNumber(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   recvFormat
+		v        any
+		decimals []int
+		want     string
+	}{
+		{name: "default int", format: recvFormat{decimalMark: "."}, v: 1234567, want: "1234567"},
+		{name: "default float", format: recvFormat{decimalMark: "."}, v: 1205.63, decimals: []int{1}, want: "1205.6"},
+		{name: "comma thousands", format: recvFormat{decimalMark: ".", thousandsSep: ","}, v: 1234567.891, decimals: []int{2}, want: "1,234,567.89"},
+		{name: "Quebec", format: recvFormat{decimalMark: ",", thousandsSep: " "}, v: 1205.63, decimals: []int{1}, want: "1 205,6"},
+		{name: "German", format: recvFormat{decimalMark: ",", thousandsSep: "."}, v: int64(1000), want: "1.000"},
+		{name: "Swiss", format: recvFormat{decimalMark: ".", thousandsSep: "'"}, v: -98765.4, decimals: []int{1}, want: "-98'765.4"},
+		{name: "three digits", format: recvFormat{decimalMark: ",", thousandsSep: " "}, v: 999, want: "999"},
+		{name: "rounds to zero", format: recvFormat{decimalMark: "."}, v: -0.04, decimals: []int{1}, want: "0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.format.number(tt.v, tt.decimals...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("number(%v) = %q, want %q", tt.v, got, tt.want)
+			}
+		})
+	}
+	if _, err := (recvFormat{}).number("12"); err == nil {
+		t.Error("number(\"12\") did not fail")
+	}
+}
+
+func TestLoadRecvFormatErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "ambiguous layout", env: map[string]string{"RECV_TIME_FORMAT": "01/06 15:04"}},
+		{name: "unknown decimal mark", env: map[string]string{"RECV_DECIMAL_MARK": "dot"}},
+		{name: "no decimal mark", env: map[string]string{"RECV_DECIMAL_MARK": "none"}},
+		{name: "same separators", env: map[string]string{"RECV_DECIMAL_MARK": "comma", "RECV_THOUSANDS_SEPARATOR": "comma"}},
+		{name: "folder separators clash", env: map[string]string{"RECV_THOUSANDS_SEPARATOR": "comma",
+			"FAX_QUEUE_DIRS": "quebec;recv_decimal_mark=comma"}},
+		{name: "folder layout in file names", env: map[string]string{"RECV_FILENAME_USE_TIME_FORMAT": "true", "RECV_TIME_FORMAT": "20060102 1504",
+			"FAX_QUEUE_DIRS": "quebec;recv_time_format=02/01/06 15:04"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, tt.env)
+			prevDefault, prevFolders := recvDefaultFormat, recvFolderFormats
+			defer func() { recvDefaultFormat, recvFolderFormats = prevDefault, prevFolders }()
+			if err := loadRecvFormat(); err == nil {
+				t.Error("loadRecvFormat() succeeded")
+			}
+		})
+	}
+}
+
+func TestRecvGolden(t *testing.T) {
+	extended := `{{.Time}}\n{{.Device}}\n{{.BaseName}}\n{{.CIDNum}}\n{{number .Pages}}\n{{number .SizeKB 1}}\n`
+	quebec := "quebec/synergyfaxq;recv_time_format=02/01/06 15:04;recv_decimal_mark=comma;recv_thousands_separator=space"
+	tests := []struct {
+		name     string // golden file in testdata/recv
+		env      map[string]string
+		tenant   bool // the fax goes to quebec/synergyfaxq
+		baseName string
+	}{
+		{name: "default", baseName: "{0123456789ab}20091123140500"},
+		{name: "dd-mm-yy", env: map[string]string{"RECV_TIME_FORMAT": "02/01/06 15:04"}, baseName: "{0123456789ab}20091123140500"},
+		{name: "extended", env: map[string]string{"RECV_TEMPLATE": extended, "RECV_THOUSANDS_SEPARATOR": "comma"},
+			baseName: "{0123456789ab}20091123140500"},
+		{name: "quebec-folder", env: map[string]string{"RECV_TEMPLATE": extended, "FAX_QUEUE_DIRS": quebec},
+			tenant: true, baseName: "{0123456789ab}20091123140500"},
+		{name: "quebec-default-folder", env: map[string]string{"RECV_TEMPLATE": extended, "FAX_QUEUE_DIRS": quebec},
+			baseName: "{0123456789ab}20091123140500"},
+		{name: "folder-file-names", env: map[string]string{"RECV_FILENAME_USE_TIME_FORMAT": "true", "RECV_TIME_FORMAT": "20060102 1504",
+			"FAX_QUEUE_DIRS": "quebec/synergyfaxq;recv_time_format=2006-01-02_15h04"},
+			tenant: true, baseName: "{0123456789ab}2009-11-23_14h05"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"MIN_FREE_DISK_MB": "0", "FAX_TIMEZONE": "America/Vancouver"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			cfg := useTestRecvFormat(t, env)
+			dir := cfg.FTPRoot + FaxDir
+			if tt.tenant {
+				tenantDirs.Lock()
+				tenantDirs.entries = []tenantDir{{Number: "6045550100", Dir: "quebec/synergyfaxq"}}
+				tenantDirs.Unlock()
+				t.Cleanup(func() {
+					tenantDirs.Lock()
+					tenantDirs.entries = nil
+					tenantDirs.Unlock()
+				})
+				dir = filepath.Join(cfg.FTPRoot, "quebec/synergyfaxq")
+			}
+			fax := FaxReceive{UUID: "00000000-0000-0000-0000-0123456789ab", Number: "6045550100", CIDNum: "6045551234",
+				Ts: "2009-11-23T22:05:00Z"}
+			t.Cleanup(func() {
+				faxRecordsMutex.Lock()
+				delete(faxRecords, fax.UUID)
+				faxRecordsMutex.Unlock()
+			})
+			// Three pages, 1,234,567 bytes.
+			doc := []byte("%PDF-1.4\n" + strings.Repeat("<< /Type /Page >>\n", 3))
+			doc = append(doc, bytes.Repeat([]byte{' '}, 1234567-len(doc))...)
+			staged, err := stageQueueFile(cfg.FTPRoot+FaxDir, "fax-receive", bytes.NewReader(doc), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, _, err := storeReceivedFax(fax, staged, time.Date(2009, time.November, 23, 22, 5, 0, 0, time.UTC), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.BaseName != tt.baseName {
+				t.Errorf("received as %q, want %q", result.BaseName, tt.baseName)
+			}
+			got := readTestFile(t, filepath.Join(dir, result.BaseName+".recv"))
+			golden := filepath.Join("testdata", "recv", tt.name+".recv")
+			if *updateGolden {
+				writeTestFile(t, golden, got)
+			}
+			if want := readTestFile(t, golden); got != want {
+				t.Errorf(".recv =\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestRecvTemplateNumberFunc(t *testing.T) {
+	// The template parsed at startup keeps working when RECV_TEMPLATE does not call number.
+	useTestRecvFormat(t, map[string]string{"RECV_TEMPLATE": `{{.Time}}\n{{.Pages}}\n`})
+	got, err := recvContent(os.TempDir(), recvData{Time: "11/23/09 14:05", Pages: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "11/23/09 14:05\n1234\n" {
+		t.Errorf("recvContent() = %q", got)
+	}
+}
+
+func TestFaxTimezone(t *testing.T) {
+	tests := []struct {
+		name     string
+		zone     string
+		layout   string // RECV_TIME_FORMAT
+		noTZData bool   // ZONEINFO names an empty directory
+		want     string // date line of the .recv
+	}{
+		{name: "default", want: "11/23/09 14:05"},
+		{name: "Berlin", zone: "Europe/Berlin", want: "11/23/09 23:05"},
+		{name: "UTC", zone: "UTC", want: "11/23/09 22:05"},
+		{name: "custom format", zone: "Asia/Kolkata", layout: "2006-01-02 15:04 -0700", want: "2009-11-24 03:35 +0530"},
+		{name: "custom format with month name", zone: "UTC", layout: "Jan _2 15:04", want: "Nov 23 22:05"},
+		{name: "no zone database", zone: "America/Vancouver", noTZData: true, want: "11/23/09 14:05"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.noTZData {
+				t.Setenv("ZONEINFO", t.TempDir())
+			}
+			cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "FAX_TIMEZONE": tt.zone, "RECV_TIME_FORMAT": tt.layout})
+			fax := FaxReceive{UUID: "00000000-0000-0000-0000-0123456789ab", Number: "6045550100", CIDNum: "6045551234",
+				Ts: "2009-11-23T22:05:00Z"}
+			staged, err := stageQueueFile(cfg.FTPRoot+FaxDir, "fax-receive", strings.NewReader("%PDF-1.4\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, _, err := storeReceivedFax(fax, staged, time.Now(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recv := readTestFile(t, filepath.Join(cfg.FTPRoot+FaxDir, result.BaseName+".recv"))
+			if got, _, _ := strings.Cut(recv, "\n"); got != tt.want {
+				t.Errorf("date line %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUnknownFaxTimezone checks that a zone that cannot be loaded is a
+// configuration problem, reported at startup, with the local zone in effect.
+func TestUnknownFaxTimezone(t *testing.T) {
+	cfg, problems := readConfig(func(env string) string {
+		if env == "FAX_TIMEZONE" {
+			return "Mars/Olympus_Mons"
+		}
+		return ""
+	})
+	problems = append(problems, cfg.validate()...)
+	var reported bool
+	for _, err := range problems {
+		reported = reported || strings.HasPrefix(err.Error(), "FAX_TIMEZONE")
+	}
+	if !reported {
+		t.Errorf("problems %v, want one for FAX_TIMEZONE", problems)
+	}
+	if cfg.faxLocation != time.Local {
+		t.Errorf("zone %v, want the local zone", cfg.faxLocation)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A result that STATUS_MAP_FILE marks retryable, such as busy or no answer,
+// does not fail the job at once: like a Hylafax queue, the service dials
+// again after REDIAL_WAIT, up to MAX_DIALS dials in all. The job waits in the
+// scheduler, so it survives restarts and can be cancelled, with a .sts status
+// such as "busy, will retry (2/5)". A redial goes straight to the send
+// webhook; the quota and approval were settled by the first dial. The .sts
+// counts dials in totdials (of maxdials) and the provider's transmission
+// attempts in tottries. Broadcast destinations are not redialled.
+
+var jobsRedialled = expvar.NewInt("jobs_redialled")
+
+// redialJob schedules the next dial of a job whose result was a retryable
+// failure. It returns false when the job has no dials left, or cannot be
+// redialled, and should fail.
+func redialJob(jobQq jobQ, result FaxJob, mapping statusMapping) bool {
+	cfg := config()
+	dials := max(jobQq.dials, 1)
+	if !mapping.Retryable || dials >= cfg.MaxDials || jobQq.broadcastIndex > 0 {
+		return false
+	}
+	content, err := os.ReadFile(jobQq.sfcPath)
+	if err != nil {
+		slog.Error("Unable to redial fax job", "job_id", jobQq.hylaJobID, "file", jobQq.sfcPath, "err", err)
+		return false
+	}
+	sfc, err := parseSfcFile(jobQq.sfcPath, string(content))
+	if err != nil {
+		slog.Error("Unable to redial fax job", "job_id", jobQq.hylaJobID, "file", jobQq.sfcPath, "err", err)
+		return false
+	}
+	if number, err := normalizeDestinations(sfc.FaxNumber); err == nil {
+		sfc.FaxNumber = number
+	}
+	sfc.NotBefore = time.Now().Add(cfg.RedialWait)
+
+	job := scheduledFax{
+		HylaJobID:   jobQq.hylaJobID,
+		JobID:       jobQq.synergyJobID,
+		Sfc:         sfc,
+		PdfPath:     jobQq.pdfPath,
+		SfcFileName: filepath.Base(jobQq.sfcPath),
+		Dial:        dials + 1,
+		Tries:       jobQq.tries + resultTries(result),
+	}
+	scheduled.Lock()
+	scheduled.jobs[job.HylaJobID] = &job
+	scheduled.Unlock()
+	persistSchedule(job)
+	cache.Lock()
+	cache.inFlight[job.SfcFileName] = true
+	cache.Unlock()
+
+	status := fmt.Sprintf("%s, will retry (%d/%d)", mapping.Message, job.Dial, cfg.MaxDials)
+	createStsFile(job.HylaJobID, stsStateSleeping, "", "", status)
+	writeStsDials(job.HylaJobID, dials, job.Tries)
+	queueJobEvent(eventRetrying, jobQq, result, status)
+	jobsRedialled.Add(1)
+	slog.Info("Fax will be redialled", "job_id", job.HylaJobID, "uuid", result.UUID, "status", result.Status,
+		"reason", result.Result.ResultText, "dial", job.Dial, "max_dials", cfg.MaxDials, "at", sfc.NotBefore.Format(time.RFC3339))
+	return true
+}
+
+// writeStsDials records the dials made so far and the transmission attempts
+// in the .sts.
+func writeStsDials(hylaJobID string, dials, tries int) {
+	err := setStsLines(hylaJobID, "totdials", strconv.Itoa(dials), "maxdials", strconv.Itoa(config().MaxDials),
+		"tottries", strconv.Itoa(tries))
+	if err != nil {
+		slog.Error("Error updating .sts", "job_id", hylaJobID, "err", err)
+	}
+}
+
+// redialFax makes the next dial of a job released by the scheduler.
+func redialFax(item *outboundItem) (string, error) {
+	job := item.Sfc
+	return deliverFax(job.FaxNumber, job.CallerID, job.PdfFile, item.PdfPath, item.SfcFileName, job.User, item.JobID, item.HylaJobID,
+		item.Dial, item.Tries)
+}
+
+// resultTries returns the transmission attempts a notify result reports, at
+// least one.
+func resultTries(result FaxJob) int {
+	return max(result.TotTries, 1)
+}
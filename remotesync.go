@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DELIVERY_MODE=ftp-client is for a Synergy server that keeps its fax queue
+// behind its own FTP service, so the fax service logs in to it rather than
+// hosting FTP; sftp-client does the same over SFTP. The local /synergyfaxq is then a mirror of the remote folder
+// REMOTE_DIR, synchronized every REMOTE_POLL_INTERVAL, and the watcher and
+// everything after it work on it as in local mode:
+//
+//   - .sfc, .pdf, .cmd and .kill files Synergy uploads are downloaded once their size
+//     is the same at two passes, and written locally under a temporary name
+//     that is renamed into place.
+//   - Files written here (.jobid, .sts, .done, .fail, .info, and received
+//     PDFs and .recv files) are uploaded when they are new or have changed,
+//     to a temporary name that is then renamed, .recv files last, so Synergy
+//     never sees a .recv before its PDF.
+//   - A file removed on one side is removed on the other.
+//
+// A pass that fails, for example because the server is down, is retried
+// REMOTE_RETRY_BACKOFF later, doubling. Which files came from which side is
+// kept in DATA_DIR/remote-sync.json, so a restart neither downloads a
+// finished job again nor loses track of an upload.
+
+// Delivery modes kept in Config.DeliveryMode.
+const (
+	deliveryLocal      = "local"
+	deliveryFTPClient  = "ftp-client"
+	deliverySFTPClient = "sftp-client"
+)
+
+// maxRemoteBackoff caps the wait after failed passes.
+const maxRemoteBackoff = 10 * time.Minute
+
+var (
+	remoteDownloads    = expvar.NewInt("remote_downloads")
+	remoteUploads      = expvar.NewInt("remote_uploads")
+	remoteSyncFailures = expvar.NewInt("remote_sync_failures")
+)
+
+// remoteConn is a session with the remote queue folder.
+type remoteConn interface {
+	List() ([]string, error)
+	Size(name string) (int64, error)
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	Rename(from, to string) error
+	Delete(name string) error
+	Close() error
+}
+
+// Sides a synchronized file came from.
+const (
+	originRemote = "remote"
+	originLocal  = "local"
+)
+
+// syncedFile is a file present on both sides.
+type syncedFile struct {
+	Origin  string    `json:"origin"`
+	Size    int64     `json:"size"`     // of the local copy
+	ModTime time.Time `json:"mod_time"` // of the local copy
+}
+
+// remoteSync is the synchronization state. Only the pass goroutine uses files
+// and arriving; the mutex guards the outcome of the last pass.
+var remoteSync = struct {
+	files    map[string]syncedFile
+	arriving map[string]int64 // remote files seen once, by size
+
+	sync.Mutex
+	lastErr error
+}{files: make(map[string]syncedFile), arriving: make(map[string]int64)}
+
+func remoteSyncPath() string {
+	return filepath.Join(config().DataDir, "remote-sync.json")
+}
+
+// startRemoteSync loads the synchronization state and starts the passes,
+// unless DELIVERY_MODE is local.
+func startRemoteSync() error {
+	if config().DeliveryMode == deliveryLocal {
+		return nil
+	}
+	data, err := os.ReadFile(remoteSyncPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &remoteSync.files); err != nil {
+			return fmt.Errorf("error parsing %s: %w", remoteSyncPath(), err)
+		}
+	}
+	slog.Info("Mirroring remote queue folder", "mode", config().DeliveryMode, "host", config().RemoteHost,
+		"dir", config().RemoteDir, "files", len(remoteSync.files))
+	go func() {
+		failures := 0
+		for {
+			wait := config().RemotePollInterval
+			if err := runRemoteSync(); err != nil {
+				failures++
+				remoteSyncFailures.Add(1)
+				wait = remoteBackoff(failures)
+				slog.Warn("Remote queue synchronization failed; retrying", "host", config().RemoteHost,
+					"attempt", failures, "retry_in", wait, "err", err)
+			} else if failures > 0 {
+				slog.Info("Remote queue synchronization recovered", "host", config().RemoteHost, "failed_passes", failures)
+				failures = 0
+			}
+			time.Sleep(wait)
+		}
+	}()
+	return nil
+}
+
+// remoteBackoff is the wait after the given number of failed passes.
+func remoteBackoff(failures int) time.Duration {
+	delay := config().RemoteRetryBackoff
+	for i := 1; i < failures && delay < maxRemoteBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRemoteBackoff)
+}
+
+func dialRemote() (remoteConn, error) {
+	cfg := config()
+	if cfg.DeliveryMode == deliverySFTPClient {
+		return dialSFTP(cfg.RemoteHost, cfg.RemoteUsername, cfg.RemotePassword, cfg.RemotePrivateKey, cfg.RemoteKnownHosts, cfg.RemoteDir, cfg.RemoteTimeout)
+	}
+	return dialFTP(cfg.RemoteHost, cfg.RemoteUsername, cfg.RemotePassword, cfg.RemoteDir, cfg.RemoteTLS, cfg.RemoteTimeout)
+}
+
+// runRemoteSync makes one pass and records its outcome.
+func runRemoteSync() error {
+	err := syncRemote()
+	remoteSync.Lock()
+	remoteSync.lastErr = err
+	remoteSync.Unlock()
+	if saveErr := saveRemoteSync(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func syncRemote() error {
+	conn, err := dialRemote()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	names, err := conn.List()
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]bool)
+	for _, name := range names {
+		if !isQueueTempFile(name) {
+			remote[name] = true
+		}
+	}
+	localDir := config().FTPRoot + FaxDir
+	local := make(map[string]os.FileInfo)
+	entries, err := os.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || isQueueTempFile(entry.Name()) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			local[entry.Name()] = info
+		}
+	}
+
+	files := remoteSync.files
+
+	// Removals first, from what both sides held at the last pass.
+	for name, f := range files {
+		_, onLocal := local[name]
+		switch {
+		case !onLocal && remote[name]:
+			if err := conn.Delete(name); err != nil {
+				return err
+			}
+			slog.Info("Removed remote queue file", "file", name)
+			delete(remote, name)
+			delete(files, name)
+		case onLocal && !remote[name]:
+			if f.Origin == originLocal && !local[name].ModTime().Equal(f.ModTime) {
+				continue // rewritten here since the upload; it goes up again below
+			}
+			if err := os.Remove(filepath.Join(localDir, name)); err != nil {
+				return err
+			}
+			slog.Info("Removed queue file deleted on the remote server", "file", name)
+			delete(local, name)
+			delete(files, name)
+		case !onLocal && !remote[name]:
+			delete(files, name)
+		}
+	}
+
+	// Synergy's uploads, once they stop growing.
+	for name := range remote {
+		if _, known := files[name]; known || !isPolledFile(name) {
+			continue
+		}
+		if info, ok := local[name]; ok {
+			// Both sides have it but no pass recorded it, as after losing
+			// remote-sync.json: take it as already downloaded.
+			files[name] = syncedFile{Origin: originRemote, Size: info.Size(), ModTime: info.ModTime()}
+			continue
+		}
+		size, err := conn.Size(name)
+		if err != nil {
+			return err
+		}
+		if prev, ok := remoteSync.arriving[name]; !ok || prev != size {
+			remoteSync.arriving[name] = size
+			continue
+		}
+		data, err := conn.Get(name)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != size {
+			remoteSync.arriving[name] = int64(len(data))
+			continue
+		}
+		path := filepath.Join(localDir, name)
+		if err := writeQueueFile(path, data, 0644); err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		delete(remoteSync.arriving, name)
+		files[name] = syncedFile{Origin: originRemote, Size: info.Size(), ModTime: info.ModTime()}
+		local[name] = info
+		remoteDownloads.Add(1)
+		slog.Info("Downloaded remote queue file", "file", name, "size", size)
+	}
+	for name := range remoteSync.arriving {
+		if !remote[name] {
+			delete(remoteSync.arriving, name)
+		}
+	}
+
+	// Files written here, .recv files last.
+	var uploads []string
+	for name, info := range local {
+		f, known := files[name]
+		if known && (f.Origin == originRemote || (f.Size == info.Size() && f.ModTime.Equal(info.ModTime()))) {
+			continue
+		}
+		uploads = append(uploads, name)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		iRecv, jRecv := strings.EqualFold(filepath.Ext(uploads[i]), ".recv"), strings.EqualFold(filepath.Ext(uploads[j]), ".recv")
+		if iRecv != jRecv {
+			return jRecv
+		}
+		return uploads[i] < uploads[j]
+	})
+	for _, name := range uploads {
+		if err := uploadRemote(conn, localDir, name, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadRemote puts a local file under a temporary name and renames it into
+// place, replacing an older copy. A server that will not rename over an
+// existing file has it removed first.
+func uploadRemote(conn remoteConn, localDir, name string, files map[string]syncedFile) error {
+	path := filepath.Join(localDir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil // removed since the listing
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tmp := "." + name + ".tmp"
+	if err := conn.Put(tmp, data); err != nil {
+		return err
+	}
+	if err := conn.Rename(tmp, name); err != nil {
+		if delErr := conn.Delete(name); delErr != nil {
+			conn.Delete(tmp)
+			return err
+		}
+		if err := conn.Rename(tmp, name); err != nil {
+			conn.Delete(tmp)
+			return err
+		}
+	}
+	files[name] = syncedFile{Origin: originLocal, Size: info.Size(), ModTime: info.ModTime()}
+	remoteUploads.Add(1)
+	slog.Info("Uploaded queue file to the remote server", "file", name, "size", len(data))
+	return nil
+}
+
+func saveRemoteSync() error {
+	data, err := json.MarshalIndent(remoteSync.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config().DataDir, 0755); err != nil {
+		return err
+	}
+	return writeQueueFile(remoteSyncPath(), data, 0644)
+}
+
+// checkRemoteSync fails while the last pass failed. It is skipped in local
+// mode.
+func checkRemoteSync() healthCheck {
+	if config().DeliveryMode == deliveryLocal {
+		return healthCheck{OK: true, Skipped: true}
+	}
+	remoteSync.Lock()
+	defer remoteSync.Unlock()
+	if remoteSync.lastErr != nil {
+		return healthFailed(remoteSync.lastErr)
+	}
+	return healthCheck{OK: true}
+}
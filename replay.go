@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// captureEntry is one captured input in a replay capture directory. Each
+// *.json file in the directory holds one entry; entries are replayed in Seq order.
+type captureEntry struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"` // when the original input arrived
+	Kind string    `json:"kind"` // "fax-receive", "fax-notify" or "file"
+	Key  string    `json:"key"`  // correlation key used in the outcome diff (fax UUID or file name)
+
+	Body        json.RawMessage `json:"body,omitempty"`         // JSON webhook body for fax-receive / fax-notify
+	ContentType string          `json:"content_type,omitempty"` // of a webhook body, when not JSON
+	Query       string          `json:"query,omitempty"`        // webhook query string
+	Name        string          `json:"name,omitempty"`         // queue file name for kind "file" (.sfc / .pdf)
+	Data        string          `json:"data,omitempty"`         // base64 file content for kind "file", or a webhook body that is not JSON
+}
+
+// replayOutcome is the result of replaying one captured entry: how the
+// request or queue file was taken, and what became of its job once the
+// target settled.
+type replayOutcome struct {
+	Seq    int    `json:"seq"`
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Status int    `json:"status"` // HTTP status, or 0 for queue files written
+	Error  string `json:"error,omitempty"`
+
+	HylaJobID    string `json:"hyla_job_id,omitempty"`   // of an .sfc's job; differs between instances, so not diffed
+	State        string `json:"state,omitempty"`         // q<id>.sts state of an .sfc's job
+	Result       string `json:"result,omitempty"`        // "done" or "fail" once the job has a q<id>.done or .fail
+	RecordStatus string `json:"record_status,omitempty"` // fax record status from GET /jobs/{id}; comma-separated for a notify
+}
+
+// runReplay implements `synergymatters_fax replay`. It returns the process exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := fs.String("from", "", "capture directory to replay")
+	against := fs.String("against", "", "base URL of the instance to replay against, e.g. http://staging:8080")
+	queueDir := fs.String("queue-dir", "", "queue directory of the target instance, for captured .sfc/.pdf files")
+	reference := fs.String("reference", "", "outcomes file from a previous run to diff against")
+	admin := fs.String("admin", "", "base URL of the target's admin routes, for the job records; defaults to --against")
+	out := fs.String("out", "", "write outcomes to this file instead of stdout")
+	realtime := fs.Bool("realtime", false, "preserve the original spacing between captured entries")
+	settle := fs.Duration("settle", 30*time.Second, "how long to let the target process the replayed inputs before reading job outcomes")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *from == "" || *against == "" {
+		fmt.Fprintln(os.Stderr, "replay: --from and --against are required")
+		return 2
+	}
+	// The webhook credentials and signing secret come from the environment.
+	cfg, problems := readConfig(os.Getenv)
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", errors.Join(problems...))
+		return 2
+	}
+	currentConfig.Store(&cfg)
+
+	entries, err := loadCapture(*from)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	outcomes := make([]replayOutcome, 0, len(entries))
+	for i, entry := range entries {
+		if *realtime && i > 0 {
+			if gap := entry.Time.Sub(entries[i-1].Time); gap > 0 {
+				time.Sleep(gap)
+			}
+		}
+		outcomes = append(outcomes, replayEntry(client, *against, *queueDir, entry))
+	}
+	time.Sleep(*settle)
+	if *admin == "" {
+		*admin = *against
+	}
+	for i := range outcomes {
+		collectJobOutcome(client, *admin, *queueDir, &outcomes[i])
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	for _, o := range outcomes {
+		enc.Encode(o)
+	}
+
+	if *reference == "" {
+		return 0
+	}
+	diffs, err := diffReplayOutcomes(*reference, outcomes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	if len(diffs) > 0 {
+		fmt.Fprintf(os.Stderr, "replay: %d outcome(s) differ from %s\n", len(diffs), *reference)
+		return 1
+	}
+	return 0
+}
+
+func loadCapture(dir string) ([]captureEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]captureEntry, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var entry captureEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Seq != entries[j].Seq {
+			return entries[i].Seq < entries[j].Seq
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+func replayEntry(client *http.Client, against, queueDir string, entry captureEntry) replayOutcome {
+	outcome := replayOutcome{Seq: entry.Seq, Kind: entry.Kind, Key: entry.Key}
+
+	switch entry.Kind {
+	case "fax-receive", "fax-notify":
+		url := strings.TrimSuffix(against, "/") + "/" + entry.Kind
+		if entry.Query != "" {
+			url += "?" + entry.Query
+		}
+		body, contentType := []byte(entry.Body), "application/json"
+		if entry.Data != "" {
+			data, err := base64.StdEncoding.DecodeString(entry.Data)
+			if err != nil {
+				outcome.Error = err.Error()
+				return outcome
+			}
+			body, contentType = data, entry.ContentType
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			outcome.Error = err.Error()
+			return outcome
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Replayed", "true")
+		if entry.Kind == "fax-receive" {
+			// The target files the fax under the time it first arrived.
+			req.Header.Set("X-Replay-Original-Time", entry.Time.Format(time.RFC3339Nano))
+			receiveAuth().apply(req)
+		} else {
+			notifyAuth().apply(req)
+		}
+		signWebhookBody(req, body)
+		resp, err := client.Do(req)
+		if err != nil {
+			outcome.Error = err.Error()
+			return outcome
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		outcome.Status = resp.StatusCode
+
+	case "file":
+		if queueDir == "" {
+			outcome.Error = "captured queue file requires --queue-dir"
+			return outcome
+		}
+		data, err := base64.StdEncoding.DecodeString(entry.Data)
+		if err != nil {
+			outcome.Error = err.Error()
+			return outcome
+		}
+		// Written like every other queue file, so the target never sees it
+		// partially written.
+		if err := writeQueueFile(filepath.Join(queueDir, filepath.Base(entry.Name)), data, 0644); err != nil {
+			outcome.Error = err.Error()
+		}
+
+	default:
+		outcome.Error = "unknown capture kind " + entry.Kind
+	}
+	return outcome
+}
+
+// collectJobOutcome fills in what became of the job behind o: for an .sfc,
+// its Hylafax job ID from the .jobid, the state in q<id>.sts and whether it
+// has a q<id>.done, .fail or .cancelled; for an .sfc, a received fax or a notify, the
+// status of its fax record on the target.
+func collectJobOutcome(client *http.Client, admin, queueDir string, o *replayOutcome) {
+	var ids []string
+	switch {
+	case o.Kind == "file" && strings.HasSuffix(o.Key, ".sfc"):
+		if queueDir == "" {
+			return
+		}
+		data, err := os.ReadFile(filepath.Join(queueDir, strings.TrimSuffix(o.Key, ".sfc")+".jobid"))
+		if err != nil {
+			return
+		}
+		o.HylaJobID = strings.TrimSpace(string(data))
+		sts, _ := os.ReadFile(filepath.Join(queueDir, "q"+o.HylaJobID+".sts"))
+		for _, line := range stsLines(sts) {
+			if value, ok := strings.CutPrefix(line, "state:"); ok {
+				o.State = strings.TrimSpace(value)
+			}
+		}
+		for _, result := range []string{"done", "fail", "cancelled"} {
+			if fileExists(filepath.Join(queueDir, "q"+o.HylaJobID+"."+result)) {
+				o.Result = result
+			}
+		}
+		ids = []string{o.HylaJobID}
+	case o.Kind == "fax-receive":
+		ids = []string{o.Key}
+	case o.Kind == "fax-notify":
+		ids = strings.Split(o.Key, ",")
+	}
+
+	var statuses []string
+	for _, id := range ids {
+		statuses = append(statuses, replayRecordStatus(client, admin, id))
+	}
+	if strings.Join(statuses, "") != "" {
+		o.RecordStatus = strings.Join(statuses, ",")
+	}
+}
+
+// replayRecordStatus returns the status of the target's fax record for id,
+// or "" if it has none.
+func replayRecordStatus(client *http.Client, admin, id string) string {
+	if id == "" {
+		return ""
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(admin, "/")+"/jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return ""
+	}
+	adminAuth().apply(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	var detail struct {
+		Record *faxRecordView `json:"record"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&detail) != nil || detail.Record == nil {
+		return ""
+	}
+	return detail.Record.Status
+}
+
+// sameJobOutcome reports whether two outcomes agree on everything but the
+// instance-specific Hylafax job ID.
+func sameJobOutcome(a, b replayOutcome) bool {
+	return a.Status == b.Status && a.Error == b.Error && a.State == b.State && a.Result == b.Result && a.RecordStatus == b.RecordStatus
+}
+
+// describeOutcome summarises an outcome for the diff.
+func describeOutcome(o replayOutcome) string {
+	s := fmt.Sprintf("status=%d", o.Status)
+	if o.Error != "" {
+		s += fmt.Sprintf(" error=%q", o.Error)
+	}
+	if o.State != "" {
+		s += " state=" + o.State
+	}
+	if o.Result != "" {
+		s += " result=" + o.Result
+	}
+	if o.RecordStatus != "" {
+		s += fmt.Sprintf(" record=%q", o.RecordStatus)
+	}
+	return s
+}
+
+// diffReplayOutcomes compares outcomes with a reference outcomes file by Kind
+// and Key: the HTTP status and error of each input, and the state, result
+// and record status of its job.
+func diffReplayOutcomes(referencePath string, outcomes []replayOutcome) ([]string, error) {
+	data, err := os.ReadFile(referencePath)
+	if err != nil {
+		return nil, err
+	}
+	reference := make(map[string]replayOutcome)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var o replayOutcome
+		if err := dec.Decode(&o); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", referencePath, err)
+		}
+		reference[o.Kind+"|"+o.Key] = o
+	}
+
+	var diffs []string
+	for _, o := range outcomes {
+		key := o.Kind + "|" + o.Key
+		ref, ok := reference[key]
+		delete(reference, key)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("+ %s %s: %s (not in reference)", o.Kind, o.Key, describeOutcome(o)))
+		case !sameJobOutcome(ref, o):
+			diffs = append(diffs, fmt.Sprintf("~ %s %s: %s -> %s", o.Kind, o.Key, describeOutcome(ref), describeOutcome(o)))
+		}
+	}
+	for _, ref := range reference {
+		diffs = append(diffs, fmt.Sprintf("- %s %s: %s (missing from replay)", ref.Kind, ref.Key, describeOutcome(ref)))
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayEntryFile(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+	entry := captureEntry{Seq: 1, Kind: "file", Key: "fax0001.sfc", Name: "../fax0001.sfc",
+		Data: base64.StdEncoding.EncodeToString([]byte("6045551234\nfax0001.pdf\n"))}
+
+	o := replayEntry(http.DefaultClient, "http://127.0.0.1:1", dir, entry)
+	if o.Error != "" {
+		t.Fatalf("replayEntry() error %q", o.Error)
+	}
+	if got := readTestFile(t, filepath.Join(dir, "fax0001.sfc")); got != "6045551234\nfax0001.pdf\n" {
+		t.Errorf("fax0001.sfc = %q", got)
+	}
+	names, _ := os.ReadDir(dir)
+	if len(names) != 1 {
+		t.Errorf("queue dir has %d files, want only fax0001.sfc", len(names))
+	}
+}
+
+func TestCollectJobOutcome(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+		statuses := map[string]string{"42": "sent", "fax-uuid": "received", "job-a": "sent", "job-b": "failed"}
+		status, ok := statuses[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"record": faxRecordView{Key: id, Status: status}})
+	}))
+	defer admin.Close()
+
+	tests := []struct {
+		name  string
+		files map[string]string // queue dir content
+		in    replayOutcome
+		want  replayOutcome
+	}{
+		{name: "sent job", files: map[string]string{"fax0001.jobid": "42\r", "q42.sts": "state:7\nstatus:sent\n", "q42.done": ""},
+			in:   replayOutcome{Kind: "file", Key: "fax0001.sfc"},
+			want: replayOutcome{Kind: "file", Key: "fax0001.sfc", HylaJobID: "42", State: "7", Result: "done", RecordStatus: "sent"}},
+		{name: ".sfc never accepted", in: replayOutcome{Kind: "file", Key: "fax0002.sfc"},
+			want: replayOutcome{Kind: "file", Key: "fax0002.sfc"}},
+		{name: "PDF", in: replayOutcome{Kind: "file", Key: "fax0001.pdf"},
+			want: replayOutcome{Kind: "file", Key: "fax0001.pdf"}},
+		{name: "received fax", in: replayOutcome{Kind: "fax-receive", Key: "fax-uuid", Status: 200},
+			want: replayOutcome{Kind: "fax-receive", Key: "fax-uuid", Status: 200, RecordStatus: "received"}},
+		{name: "notify", in: replayOutcome{Kind: "fax-notify", Key: "job-a,job-b", Status: 200},
+			want: replayOutcome{Kind: "fax-notify", Key: "job-a,job-b", Status: 200, RecordStatus: "sent,failed"}},
+		{name: "unknown notify", in: replayOutcome{Kind: "fax-notify", Key: "job-c", Status: 200},
+			want: replayOutcome{Kind: "fax-notify", Key: "job-c", Status: 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				writeTestFile(t, filepath.Join(dir, name), content)
+			}
+			got := tt.in
+			collectJobOutcome(http.DefaultClient, admin.URL, dir, &got)
+			if got != tt.want {
+				t.Errorf("collectJobOutcome() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffReplayOutcomes(t *testing.T) {
+	reference := []replayOutcome{
+		{Kind: "file", Key: "fax0001.sfc", HylaJobID: "42", State: "7", Result: "done", RecordStatus: "sent"},
+		{Kind: "fax-receive", Key: "fax-uuid", Status: 200, RecordStatus: "received"},
+	}
+	tests := []struct {
+		name     string
+		outcomes []replayOutcome
+		want     []string // prefixes of the expected diff lines
+	}{
+		{name: "same outcomes, other job IDs", outcomes: []replayOutcome{
+			{Kind: "file", Key: "fax0001.sfc", HylaJobID: "1", State: "7", Result: "done", RecordStatus: "sent"},
+			{Kind: "fax-receive", Key: "fax-uuid", Status: 200, RecordStatus: "received"},
+		}},
+		{name: "job failed", outcomes: []replayOutcome{
+			{Kind: "file", Key: "fax0001.sfc", HylaJobID: "42", State: "8", Result: "fail", RecordStatus: "failed"},
+			{Kind: "fax-receive", Key: "fax-uuid", Status: 200, RecordStatus: "received"},
+		}, want: []string{"~ file fax0001.sfc: status=0 state=7 result=done"}},
+		{name: "missing and extra", outcomes: []replayOutcome{
+			{Kind: "file", Key: "fax0001.sfc", HylaJobID: "42", State: "7", Result: "done", RecordStatus: "sent"},
+			{Kind: "fax-notify", Key: "job-a", Status: 200},
+		}, want: []string{"+ fax-notify job-a", "- fax-receive fax-uuid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "reference.jsonl")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, o := range reference {
+				json.NewEncoder(f).Encode(o)
+			}
+			f.Close()
+
+			diffs, err := diffReplayOutcomes(path, tt.outcomes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diffs) != len(tt.want) {
+				t.Fatalf("diffs = %q, want %d", diffs, len(tt.want))
+			}
+			for i, prefix := range tt.want {
+				if !strings.HasPrefix(diffs[i], prefix) {
+					t.Errorf("diff %d = %q, want prefix %q", i, diffs[i], prefix)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The retention janitor keeps the queue directory from filling up with files
+// Synergy has long since picked up. Every RETENTION_CHECK_INTERVAL it removes
+// received faxes (the .recv and its PDF) older than RECEIVED_RETENTION_DAYS
+// and marker files (.done, .fail, .cancelled, .info, .jobid, .sts) older than
+// MARKER_RETENTION_DAYS; 0 keeps them forever. With RETENTION_ACTION=archive
+// they move to archive/<yyyy-mm>/ instead. Files of jobs the service is still
+// tracking are left alone. RETENTION_DRY_RUN logs what would be cleaned up
+// without touching anything.
+
+const archiveDirName = "archive"
+
+var (
+	retentionRemoved  = expvar.NewInt("retention_files_removed")
+	retentionArchived = expvar.NewInt("retention_files_archived")
+	retentionDryRun   = expvar.NewInt("retention_files_dry_run") // files a dry run would have cleaned up
+	retentionBytes    = expvar.NewInt("retention_bytes_freed")
+)
+
+// startRetentionJanitor cleans up the queue directory now and then every
+// RETENTION_CHECK_INTERVAL.
+func startRetentionJanitor() {
+	go func() {
+		for {
+			runRetention(time.Now())
+			time.Sleep(config().RetentionCheckInterval)
+		}
+	}()
+}
+
+// retentionSummary counts one janitor pass.
+type retentionSummary struct {
+	received, markers, files, skipped int
+	bytes                             int64
+}
+
+// runRetention makes one pass over the queue directory.
+func runRetention(now time.Time) {
+	cfg := config()
+	if cfg.ReceivedRetentionDays == 0 && cfg.MarkerRetentionDays == 0 {
+		return
+	}
+	dir := cfg.FTPRoot + FaxDir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Retention janitor cannot read queue directory", "file", dir, "err", err)
+		return
+	}
+	active := activeQueueFiles()
+
+	var s retentionSummary
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		var days int
+		received := false
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".recv":
+			days, received = cfg.ReceivedRetentionDays, true
+		case ".done", ".fail", ".cancelled", ".info", ".jobid", ".sts":
+			days = cfg.MarkerRetentionDays
+		default:
+			continue
+		}
+		info, err := e.Info()
+		if days == 0 || err != nil || now.Sub(info.ModTime()) < time.Duration(days)*24*time.Hour {
+			continue
+		}
+
+		files := []string{name}
+		if received {
+			pdf := strings.TrimSuffix(name, filepath.Ext(name)) + ".pdf"
+			if _, err := os.Stat(queueFile(pdf)); err == nil {
+				files = append(files, pdf)
+			}
+		}
+		if active[name] || active[files[len(files)-1]] {
+			s.skipped++
+			continue
+		}
+		for _, f := range files {
+			cleanUpRetainedFile(f, info.ModTime(), cfg.RetentionAction, cfg.RetentionDryRun, &s)
+		}
+		if received {
+			s.received++
+		} else {
+			s.markers++
+		}
+	}
+
+	if s.files == 0 && s.skipped == 0 {
+		return
+	}
+	msg := "Retention cleanup"
+	if cfg.RetentionDryRun {
+		msg = "Retention dry run; nothing was changed"
+	}
+	slog.Info(msg, "action", cfg.RetentionAction, "received_faxes", s.received, "markers", s.markers,
+		"files", s.files, "bytes", s.bytes, "skipped_active", s.skipped)
+}
+
+// cleanUpRetainedFile removes or archives one queue file, or only logs it on
+// a dry run.
+func cleanUpRetainedFile(name string, modTime time.Time, action string, dryRun bool, s *retentionSummary) {
+	path := queueFile(name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if dryRun {
+		slog.Info("Retention would clean up file", "file", path, "action", action, "modified", modTime.Format(time.RFC3339))
+		retentionDryRun.Add(1)
+		s.files++
+		s.bytes += info.Size()
+		return
+	}
+
+	if action == cleanupArchive {
+		dir := queueFile(filepath.Join(archiveDirName, modTime.In(config().faxLocation).Format("2006-01")))
+		if err := makeQueueDir(dir); err != nil {
+			slog.Error("Unable to create archive directory", "file", dir, "err", err)
+			return
+		}
+		if err := os.Rename(path, filepath.Join(dir, name)); err != nil {
+			slog.Error("Unable to archive file", "file", path, "err", err)
+			return
+		}
+		retentionArchived.Add(1)
+	} else {
+		if err := os.Remove(path); err != nil {
+			slog.Error("Unable to remove file", "file", path, "err", err)
+			return
+		}
+		retentionRemoved.Add(1)
+	}
+	retentionBytes.Add(info.Size())
+	s.files++
+	s.bytes += info.Size()
+	slog.Debug("Retention cleaned up file", "file", path, "action", action)
+
+	cache.Lock()
+	delete(cache.pdf, name)
+	cache.Unlock()
+}
+
+// activeQueueFiles returns the names of queue files that belong to jobs the
+// service is still tracking.
+func activeQueueFiles() map[string]bool {
+	active := make(map[string]bool)
+	addSfc := func(sfcName string) {
+		if sfcName != "" {
+			sfcName = filepath.Base(sfcName)
+			active[sfcName] = true
+			active[strings.TrimSuffix(sfcName, filepath.Ext(sfcName))+".jobid"] = true
+		}
+	}
+	addJob := func(hylaJobID string) {
+		if hylaJobID != "" {
+			for _, ext := range []string{".sts", ".done", ".fail", ".cancelled", ".info"} {
+				active["q"+hylaJobID+ext] = true
+			}
+		}
+	}
+	addFile := func(path string) {
+		if path != "" {
+			active[filepath.Base(path)] = true
+		}
+	}
+
+	jobQueue.Lock()
+	for _, job := range jobQueue.entries {
+		addJob(job.hylaJobID)
+		addSfc(job.sfcPath)
+		addFile(job.pdfPath)
+	}
+	jobQueue.Unlock()
+
+	for _, h := range heldJobs() {
+		addJob(h.HylaJobID)
+		addSfc(h.SfcPath)
+		addFile(h.PdfPath)
+	}
+
+	broadcasts.Lock()
+	for id, b := range broadcasts.jobs {
+		addJob(id)
+		addSfc(b.SfcPath)
+		addFile(b.PdfPath)
+	}
+	broadcasts.Unlock()
+
+	jobContexts.Lock()
+	for id := range jobContexts.cancels {
+		addJob(id)
+	}
+	jobContexts.Unlock()
+
+	cache.Lock()
+	for name := range cache.inFlight {
+		addSfc(name)
+	}
+	for pdf, entry := range cache.sfc {
+		addSfc(entry.sfcFile)
+		addFile(pdf)
+	}
+	cache.Unlock()
+
+	faxRecordsMutex.Lock()
+	for _, rec := range faxRecords {
+		addFile(rec.PdfPath)
+		addFile(rec.RecvPath)
+	}
+	faxRecordsMutex.Unlock()
+
+	return active
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SEND_ROUTES_FILE sends some destinations to a different send webhook, e.g.
+// local calls to an on-prem FreeSWITCH and long distance to a hosted
+// provider. The file is a JSON array of routes:
+//
+//	[{"name": "local", "prefixes": ["+1604", "+1778"], "url": "https://pbx.local/fax",
+//	  "auth": "bearer", "token": "...", "caller_number": "6045550100"}]
+//
+// auth is "basic" (username and password), "bearer" (token) or "none"; it
+// defaults to basic when a username is given. protocol, multipart or
+// put-binary, replaces SEND_PROTOCOL for the route. The route with the longest
+// prefix matching the normalized number is used. Numbers no route matches
+// use the "default" route: SEND_WEBHOOK_URL with the send webhook credentials.
+// The file is re-read on SIGHUP.
+
+const defaultRouteName = "default"
+
+type sendRoute struct {
+	Name         string   `json:"name"`
+	Prefixes     []string `json:"prefixes"`
+	URL          string   `json:"url"`
+	Auth         string   `json:"auth,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	Password     string   `json:"password,omitempty"`
+	Token        string   `json:"token,omitempty"`
+	CallerNumber string   `json:"caller_number,omitempty"` // sent instead of FAX_NUMBER
+	Protocol     string   `json:"protocol,omitempty"`      // replaces SEND_PROTOCOL
+}
+
+var sendRoutes = struct {
+	sync.Mutex
+	routes []sendRoute
+}{}
+
+// loadSendRoutes reads SEND_ROUTES_FILE, if set. On error the routes in
+// effect are kept.
+func loadSendRoutes() error {
+	path := config().SendRoutesFile
+	if path == "" {
+		if err := checkQueueDirRoutes(map[string]bool{defaultRouteName: true}); err != nil {
+			return err
+		}
+		sendRoutes.Lock()
+		sendRoutes.routes = nil
+		sendRoutes.Unlock()
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var routes []sendRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	names := map[string]bool{defaultRouteName: true}
+	for i := range routes {
+		r := &routes[i]
+		if r.Name == "" || names[r.Name] {
+			return fmt.Errorf("%s: route %d needs a unique name other than %q", path, i+1, defaultRouteName)
+		}
+		names[r.Name] = true
+		if len(r.Prefixes) == 0 {
+			return fmt.Errorf("%s: route %s has no prefixes", path, r.Name)
+		}
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: route %s url %q must be an http or https URL", path, r.Name, r.URL)
+		}
+		if r.Auth == "" {
+			r.Auth = "none"
+			if r.Username != "" {
+				r.Auth = "basic"
+			}
+		}
+		switch r.Auth {
+		case "basic", "none":
+		case "bearer":
+			if r.Token == "" {
+				return fmt.Errorf("%s: route %s uses bearer auth without a token", path, r.Name)
+			}
+		default:
+			return fmt.Errorf("%s: route %s auth must be basic, bearer or none, not %q", path, r.Name, r.Auth)
+		}
+		switch r.Protocol {
+		case "", sendProtocolMultipart, sendProtocolPutBinary:
+		default:
+			return fmt.Errorf("%s: route %s protocol must be multipart or put-binary, not %q", path, r.Name, r.Protocol)
+		}
+	}
+	if err := checkQueueDirRoutes(names); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	sendRoutes.Lock()
+	sendRoutes.routes = routes
+	sendRoutes.Unlock()
+	slog.Info("Loaded send routes", "routes", len(routes), "file", path)
+	return nil
+}
+
+// routeFor returns the route for number and the prefix that selected it.
+// The default route has no prefix.
+func routeFor(number string) (sendRoute, string) {
+	sendRoutes.Lock()
+	defer sendRoutes.Unlock()
+	var best sendRoute
+	var bestPrefix string
+	for _, r := range sendRoutes.routes {
+		for _, prefix := range r.Prefixes {
+			if strings.HasPrefix(number, prefix) && len(prefix) > len(bestPrefix) {
+				best, bestPrefix = r, prefix
+			}
+		}
+	}
+	if bestPrefix == "" {
+		return sendRoute{Name: defaultRouteName, URL: config().SendWebhookURL}, ""
+	}
+	return best, bestPrefix
+}
+
+// routeNamed returns the route called name; "default" is SEND_WEBHOOK_URL.
+func routeNamed(name string) (sendRoute, bool) {
+	if name == defaultRouteName {
+		return sendRoute{Name: defaultRouteName, URL: config().SendWebhookURL}, true
+	}
+	sendRoutes.Lock()
+	defer sendRoutes.Unlock()
+	for _, r := range sendRoutes.routes {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return sendRoute{}, false
+}
+
+// checkQueueDirRoutes reports a FAX_QUEUE_DIRS route that is not among names.
+func checkQueueDirRoutes(names map[string]bool) error {
+	for _, d := range config().queueDirs {
+		if d.Route != "" && !names[d.Route] {
+			return fmt.Errorf("FAX_QUEUE_DIRS folder %s uses unknown route %q", d.Path, d.Route)
+		}
+	}
+	return nil
+}
+
+// do sends req with the route's credentials and the send webhook headers.
+// The default route authenticates as SEND_WEBHOOK_AUTH says. It returns the
+// label of the credential used.
+func (r sendRoute) do(client *http.Client, req *http.Request, body []byte, hylaJobID string) (*http.Response, string, error) {
+	setWebhookHeaders(req, hylaJobID)
+	switch r.Auth {
+	case "":
+		switch config().SendWebhookAuth {
+		case webhookAuthOAuth2:
+			return doWithOAuth2(client, req, body, hylaJobID)
+		case webhookAuthHeader:
+			resp, err := client.Do(req)
+			return resp, webhookAuthHeader, err
+		}
+		return doWithCredentialFallback(client, req, body, hylaJobID)
+	case "basic":
+		req.SetBasicAuth(r.Username, r.Password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	resp, err := client.Do(req)
+	return resp, "route " + r.Name, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// useTestSendRoutes loads routes, a JSON routes file, for the test.
+func useTestSendRoutes(t *testing.T, env map[string]string, routes string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeTestFile(t, path, routes)
+	settings := map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_ROUTES_FILE": path}
+	for k, v := range env {
+		settings[k] = v
+	}
+	cfg := useTestConfig(t, settings)
+	t.Cleanup(func() {
+		sendRoutes.Lock()
+		sendRoutes.routes = nil
+		sendRoutes.Unlock()
+	})
+	if err := loadSendRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRouteFor(t *testing.T) {
+	routes := `[
+		{"name": "bc", "prefixes": ["+1604", "+1778"], "url": "https://pbx.example/fax"},
+		{"name": "vancouver-core", "prefixes": ["+1604555"], "url": "https://core.example/fax"},
+		{"name": "nanp", "prefixes": ["+1"], "url": "https://hosted.example/fax", "auth": "bearer", "token": "t"}
+	]`
+	tests := []struct {
+		number string
+		route  string
+		prefix string
+	}{
+		{number: "+16045551234", route: "vancouver-core", prefix: "+1604555"},
+		{number: "+16045561234", route: "bc", prefix: "+1604"},
+		{number: "+17785551234", route: "bc", prefix: "+1778"},
+		{number: "+14165551234", route: "nanp", prefix: "+1"},
+		{number: "+442079460000", route: defaultRouteName},
+		{number: "", route: defaultRouteName},
+	}
+	useTestSendRoutes(t, map[string]string{"SEND_WEBHOOK_URL": "https://default.example/send"}, routes)
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			route, prefix := routeFor(tt.number)
+			if route.Name != tt.route || prefix != tt.prefix {
+				t.Errorf("routeFor(%q) = %s, %q; want %s, %q", tt.number, route.Name, prefix, tt.route, tt.prefix)
+			}
+			if tt.route == defaultRouteName && route.URL != "https://default.example/send" {
+				t.Errorf("default route URL %q, want SEND_WEBHOOK_URL", route.URL)
+			}
+		})
+	}
+}
+
+func TestLoadSendRoutesErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string
+	}{
+		{name: "not JSON", routes: `{"name":"local"}`},
+		{name: "no name", routes: `[{"prefixes":["+1604"],"url":"https://pbx.example/fax"}]`},
+		{name: "named default", routes: `[{"name":"default","prefixes":["+1604"],"url":"https://pbx.example/fax"}]`},
+		{name: "duplicate name", routes: `[{"name":"a","prefixes":["+1604"],"url":"https://a.example/"},{"name":"a","prefixes":["+1"],"url":"https://b.example/"}]`},
+		{name: "no prefixes", routes: `[{"name":"local","url":"https://pbx.example/fax"}]`},
+		{name: "bad URL", routes: `[{"name":"local","prefixes":["+1604"],"url":"pbx.example/fax"}]`},
+		{name: "bearer without token", routes: `[{"name":"local","prefixes":["+1604"],"url":"https://pbx.example/fax","auth":"bearer"}]`},
+		{name: "unknown auth", routes: `[{"name":"local","prefixes":["+1604"],"url":"https://pbx.example/fax","auth":"digest"}]`},
+		{name: "unknown protocol", routes: `[{"name":"local","prefixes":["+1604"],"url":"https://pbx.example/fax","protocol":"soap"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestSendRoutes(t, nil, `[{"name":"local","prefixes":["+1604"],"url":"https://pbx.example/fax"}]`)
+			writeTestFile(t, cfg.SendRoutesFile, tt.routes)
+			if err := loadSendRoutes(); err == nil {
+				t.Fatal("loadSendRoutes() succeeded")
+			}
+			if route, _ := routeFor("+16045551234"); route.Name != "local" {
+				t.Errorf("route %s after a failed reload, want the routes in effect kept", route.Name)
+			}
+		})
+	}
+}
+
+// TestSendRouteSubmission submits jobs to three webhooks and checks that each
+// gets its destinations with its own credentials and caller number, and that
+// /jobs shows the route.
+func TestSendRouteSubmission(t *testing.T) {
+	type received struct{ auth, caller string }
+	var mu sync.Mutex
+	got := map[string]received{}
+	webhook := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			got[name] = received{auth: r.Header.Get("Authorization"), caller: r.FormValue("caller_number")}
+			mu.Unlock()
+			fmt.Fprintf(w, `{"job_uuid":"%s-job"}`, name)
+		}))
+	}
+	local, hosted, fallback := webhook("local"), webhook("hosted"), webhook("default")
+	defer local.Close()
+	defer hosted.Close()
+	defer fallback.Close()
+	routes := fmt.Sprintf(`[
+		{"name": "local", "prefixes": ["+1604"], "url": %q, "caller_number": "6045550199"},
+		{"name": "hosted", "prefixes": ["+1"], "url": %q, "auth": "bearer", "token": "hosted-token"}
+	]`, local.URL, hosted.URL)
+
+	tests := []struct {
+		number string
+		route  string
+		auth   string
+		caller string
+	}{
+		{number: "+16045551234", route: "local", caller: "6045550199"},
+		{number: "+14165551234", route: "hosted", auth: "Bearer hosted-token", caller: "6045550100"},
+		{number: "+442079460000", route: "default", auth: "Basic ZmF4OnNlY3JldA==", caller: "6045550100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			cfg := useTestSendRoutes(t, map[string]string{"SEND_WEBHOOK_URL": fallback.URL, "SEND_WEBHOOK_RETRIES": "1",
+				"SEND_WEBHOOK_USERNAME": "fax", "SEND_WEBHOOK_PASSWORD": "secret"}, routes)
+			t.Cleanup(func() {
+				webhookCredentials.Lock()
+				webhookCredentials.primary, webhookCredentials.secondary = webhookCredential{}, nil
+				webhookCredentials.Unlock()
+			})
+			if err := loadWebhookCredentials(); err != nil {
+				t.Fatal(err)
+			}
+			dir := cfg.FTPRoot + FaxDir
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), tt.number+"\nfax0001.pdf\n")
+			writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+			if _, err := deliverFax(tt.number, "", "fax0001.pdf", filepath.Join(dir, "fax0001.pdf"), "fax0001.sfc", "", "fax0001", "42", 1, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			mu.Lock()
+			req, ok := got[tt.route]
+			delete(got, tt.route)
+			others := len(got)
+			mu.Unlock()
+			if !ok || others > 0 {
+				t.Fatalf("%s webhook called = %v, other webhooks called %d times", tt.route, ok, others)
+			}
+			if req.auth != tt.auth || req.caller != tt.caller {
+				t.Errorf("Authorization %q caller %q, want %q %q", req.auth, req.caller, tt.auth, tt.caller)
+			}
+
+			rec := serveTestRequest(t, registerAdminRoutes, asAdmin(httptest.NewRequest("GET", "/jobs", nil)))
+			var jobs struct {
+				Jobs []queuedJobView `json:"jobs"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &jobs); err != nil {
+				t.Fatal(err)
+			}
+			if len(jobs.Jobs) != 1 || jobs.Jobs[0].Route != tt.route {
+				t.Errorf("/jobs lists %+v, want one job on route %s", jobs.Jobs, tt.route)
+			}
+		})
+	}
+}
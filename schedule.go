@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Jobs whose .sfc has a send-after time get their Hylafax job ID straight
+// away, so Synergy sees them as queued, and then wait here until the time
+// comes. Each one is recorded as a "schedule" hold so it survives restarts;
+// a job whose time passed while the daemon was down is sent right after
+// startup. Due jobs join the outbound queue, which takes the most urgent first.
+
+// errScheduled is returned by submitFax when a job was scheduled for later.
+var errScheduled = errors.New("fax is scheduled for later")
+
+// scheduledFax is an outbound job waiting for its send-after time.
+type scheduledFax struct {
+	HylaJobID   string `json:"hyla_job_id"`
+	JobID       string `json:"job_id"` // Synergy job ID (.sfc name without extension)
+	Sfc         SfcJob `json:"sfc"`
+	PdfPath     string `json:"pdf_path"`
+	SfcFileName string `json:"sfc_file_name"`
+	Dial        int    `json:"dial,omitempty"`  // the dial this is, for a redial
+	Tries       int    `json:"tries,omitempty"` // transmission attempts so far, for a redial
+}
+
+var scheduled = struct {
+	sync.Mutex
+	jobs map[string]*scheduledFax // Hylafax job ID -> job
+}{jobs: make(map[string]*scheduledFax)}
+
+var (
+	schedulerStop = make(chan struct{})
+	schedulerDone = make(chan struct{})
+)
+
+// startScheduler starts releasing scheduled jobs as they fall due.
+func startScheduler() {
+	go func() {
+		defer close(schedulerDone)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-schedulerStop:
+				return
+			case now := <-ticker.C:
+				releaseDueFaxes(now)
+			}
+		}
+	}()
+}
+
+// stopScheduler stops releasing jobs, so none starts during shutdown. The
+// jobs still waiting stay on record as holds.
+func stopScheduler() {
+	close(schedulerStop)
+	<-schedulerDone
+}
+
+// scheduleFax parks a job until its send-after time.
+func scheduleFax(job scheduledFax) {
+	scheduled.Lock()
+	scheduled.jobs[job.HylaJobID] = &job
+	scheduled.Unlock()
+	persistSchedule(job)
+
+	at := job.Sfc.NotBefore.In(config().faxLocation).Format("2006-01-02 15:04:05 MST")
+	createStsFile(job.HylaJobID, stsStateSleeping, "", "", "scheduled for "+at)
+	slog.Info("Fax scheduled", "job_id", job.HylaJobID, "synergy_job_id", job.JobID, "not_before", job.Sfc.NotBefore.Format(time.RFC3339),
+		"priority", job.Sfc.Priority)
+}
+
+// persistSchedule records the job's schedule hold.
+func persistSchedule(job scheduledFax) {
+	reason := "scheduled for " + job.Sfc.NotBefore.Format(time.RFC3339)
+	if job.Dial > 1 {
+		reason = fmt.Sprintf("redial %d scheduled for %s", job.Dial, job.Sfc.NotBefore.Format(time.RFC3339))
+	}
+	putHold(heldJob{
+		Component: holdSchedule,
+		ID:        job.HylaJobID,
+		HylaJobID: job.HylaJobID,
+		SfcPath:   jobFile(job.HylaJobID, job.SfcFileName),
+		PdfPath:   job.PdfPath,
+		Reason:    reason,
+		Release:   "send-after time, or DELETE /jobs/{id}",
+	}, job)
+}
+
+// restoreScheduleHold puts a persisted job back in the scheduler.
+func restoreScheduleHold(h heldJob) error {
+	var job scheduledFax
+	if err := json.Unmarshal(h.Data, &job); err != nil {
+		return fmt.Errorf("unreadable schedule: %w", err)
+	}
+	scheduled.Lock()
+	scheduled.jobs[job.HylaJobID] = &job
+	scheduled.Unlock()
+	cache.Lock()
+	cache.inFlight[job.SfcFileName] = true
+	cache.Unlock()
+	return nil
+}
+
+// takeScheduled removes and returns the scheduled job, if there is one.
+func takeScheduled(hylaJobID string) (*scheduledFax, bool) {
+	scheduled.Lock()
+	job, ok := scheduled.jobs[hylaJobID]
+	delete(scheduled.jobs, hylaJobID)
+	scheduled.Unlock()
+	if ok {
+		releaseHold(holdSchedule, hylaJobID)
+	}
+	return job, ok
+}
+
+// releaseDueFaxes moves the jobs whose time has come to the outbound queue.
+func releaseDueFaxes(now time.Time) {
+	var due []*scheduledFax
+	scheduled.Lock()
+	for id, job := range scheduled.jobs {
+		if !now.Before(job.Sfc.NotBefore) {
+			due = append(due, job)
+			delete(scheduled.jobs, id)
+		}
+	}
+	scheduled.Unlock()
+
+	for _, job := range due {
+		releaseHold(holdSchedule, job.HylaJobID)
+		slog.Info("Scheduled fax is due", "job_id", job.HylaJobID, "not_before", job.Sfc.NotBefore.Format(time.RFC3339))
+		pushOutbound(&outboundItem{
+			HylaJobID:   job.HylaJobID,
+			JobID:       job.JobID,
+			Sfc:         job.Sfc,
+			PdfPath:     job.PdfPath,
+			SfcFileName: job.SfcFileName,
+			QueuedAt:    now,
+			Due:         true,
+			Dial:        job.Dial,
+			Tries:       job.Tries,
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SecurityEventSchemaVersion is bumped whenever a field of SecurityEvent
+// changes meaning or is removed. Adding fields does not bump it.
+const SecurityEventSchemaVersion = 1
+
+// Security event types.
+const (
+	secEventAdminAction        = "admin_action"        // mutating request to an admin endpoint
+	secEventAdminRejected      = "admin_rejected"      // admin request refused for its credentials or scope
+	secEventWebhookRejected    = "webhook_rejected"    // provider webhook refused before processing
+	secEventApprovalDecision   = "approval_decision"   // outbound fax approved or rejected
+	secEventDestinationBlocked = "destination_blocked" // outbound fax refused by OUTBOUND_RULES_FILE
+	secEventDocumentAccess     = "document_access"     // stored fax PDF downloaded
+	secEventCertExpiring       = "cert_expiring"       // monitored certificate crossed a CERT_WARN_DAYS threshold
+)
+
+// SecurityEvent is one entry of the security event stream shipped to the SIEM.
+type SecurityEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Timestamp     time.Time `json:"timestamp"`
+	Type          string    `json:"type"`
+	Actor         string    `json:"actor,omitempty"`     // authenticated user or client identity
+	SourceIP      string    `json:"source_ip,omitempty"` //
+	Target        string    `json:"target,omitempty"`    // endpoint, file or job the event concerns
+	Outcome       string    `json:"outcome"`             // "success", "failure" or "denied"
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Detail        string    `json:"detail,omitempty"`
+}
+
+// securityEvents writes events to SIEM_EVENT_FILE (JSON Lines, rotated at
+// SIEM_EVENT_FILE_MAX_MB) and/or forwards them as syslog over UDP to SIEM_SYSLOG_ADDR.
+var securityEvents = struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+	syslog   net.Conn
+}{keep: 5}
+
+// initSecurityEvents opens the configured security event sinks.
+func initSecurityEvents() error {
+	securityEvents.Lock()
+	defer securityEvents.Unlock()
+
+	securityEvents.maxBytes = int64(config().SIEMEventFileMaxMB) << 20
+
+	if path := config().SIEMEventFile; path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("error opening SIEM_EVENT_FILE: %w", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("error opening SIEM_EVENT_FILE: %w", err)
+		}
+		securityEvents.path = path
+		securityEvents.file = f
+		securityEvents.size = info.Size()
+	}
+
+	if addr := config().SIEMSyslogAddr; addr != "" {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return fmt.Errorf("error resolving SIEM_SYSLOG_ADDR: %w", err)
+		}
+		securityEvents.syslog = conn
+	}
+	return nil
+}
+
+// emitSecurityEvent records ev on every configured sink.
+func emitSecurityEvent(ev SecurityEvent) {
+	ev.SchemaVersion = SecurityEventSchemaVersion
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Error encoding security event", "err", err)
+		return
+	}
+
+	securityEvents.Lock()
+	defer securityEvents.Unlock()
+
+	if securityEvents.file != nil {
+		if securityEvents.size+int64(len(line))+1 > securityEvents.maxBytes {
+			rotateSecurityEventFile()
+		}
+		if securityEvents.file != nil {
+			n, err := securityEvents.file.Write(append(line, '\n'))
+			securityEvents.size += int64(n)
+			if err != nil {
+				slog.Error("Error writing security event", "err", err)
+			}
+		}
+	}
+
+	if securityEvents.syslog != nil {
+		// RFC 5424: facility auth (4), severity notice (5) -> PRI 37.
+		hostname, _ := os.Hostname()
+		msg := fmt.Sprintf("<37>1 %s %s synergymattersfax %d %s - %s",
+			ev.Timestamp.Format(time.RFC3339Nano), hostname, os.Getpid(), ev.Type, line)
+		if _, err := securityEvents.syslog.Write([]byte(msg)); err != nil {
+			slog.Error("Error forwarding security event", "err", err)
+		}
+	}
+}
+
+// rotateSecurityEventFile shifts path -> path.1 -> ... -> path.<keep>.
+// Callers must hold securityEvents.
+func rotateSecurityEventFile() {
+	securityEvents.file.Close()
+	securityEvents.file = nil
+	for i := securityEvents.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", securityEvents.path, i), fmt.Sprintf("%s.%d", securityEvents.path, i+1))
+	}
+	os.Rename(securityEvents.path, securityEvents.path+".1")
+
+	f, err := os.OpenFile(securityEvents.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		slog.Error("Error reopening security event file", "err", err)
+		return
+	}
+	securityEvents.file = f
+	securityEvents.size = 0
+}
+
+// requestCorrelationID returns the caller's X-Request-ID, or a new one.
+func requestCorrelationID(ctx iris.Context) string {
+	if id := ctx.GetHeader("X-Request-ID"); id != "" {
+		return id
+	}
+	id := uuid.New().String()
+	ctx.Request().Header.Set("X-Request-ID", id)
+	return id
+}
+
+// requestActor identifies the client behind a request: the principal an
+// admin request authenticated as, or "" when it did not.
+func requestActor(ctx iris.Context) string {
+	if principal, ok := ctx.Values().Get(adminPrincipalKey).(adminPrincipal); ok {
+		return principal.Name
+	}
+	return ""
+}
+
+// securityEventForRequest fills in the request-derived fields of an event.
+func securityEventForRequest(ctx iris.Context, eventType, outcome, detail string) SecurityEvent {
+	return SecurityEvent{
+		Type:          eventType,
+		Actor:         requestActor(ctx),
+		SourceIP:      ctx.RemoteAddr(),
+		Target:        ctx.Method() + " " + ctx.Path(),
+		Outcome:       outcome,
+		CorrelationID: requestCorrelationID(ctx),
+		Detail:        detail,
+	}
+}
+
+// auditAdminActions emits an admin_action event for every mutating admin request.
+func auditAdminActions(ctx iris.Context) {
+	ctx.Next()
+
+	switch ctx.Method() {
+	case iris.MethodGet, iris.MethodHead, iris.MethodOptions:
+		return
+	}
+	outcome := "success"
+	if ctx.GetStatusCode() >= 400 {
+		outcome = "failure"
+	}
+	emitSecurityEvent(securityEventForRequest(ctx, secEventAdminAction, outcome, strconv.Itoa(ctx.GetStatusCode())))
+}
+
+// rejectWebhook emits a webhook_rejected event and answers the provider with status.
+func rejectWebhook(ctx iris.Context, status int, message string) {
+	emitSecurityEvent(securityEventForRequest(ctx, secEventWebhookRejected, "denied", message))
+	ctx.StatusCode(status)
+	ctx.JSON(iris.Map{"error": message})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kataras/iris/v12"
+)
+
+// captureSecurityEvents sends security events to a file for the test and
+// returns a function reading the events written so far. Lines that do not
+// decode strictly as a SecurityEvent fail the test.
+func captureSecurityEvents(t *testing.T) func() []SecurityEvent {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "siem.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	securityEvents.Lock()
+	securityEvents.file, securityEvents.maxBytes = f, 1<<20
+	securityEvents.Unlock()
+	t.Cleanup(func() {
+		securityEvents.Lock()
+		securityEvents.file, securityEvents.size = nil, 0
+		securityEvents.Unlock()
+		f.Close()
+	})
+	return func() []SecurityEvent {
+		var events []SecurityEvent
+		for _, line := range strings.Split(readTestFile(t, path), "\n") {
+			if line == "" {
+				continue
+			}
+			dec := json.NewDecoder(strings.NewReader(line))
+			dec.DisallowUnknownFields()
+			var ev SecurityEvent
+			if err := dec.Decode(&ev); err != nil {
+				t.Fatalf("malformed security event %s: %v", line, err)
+			}
+			events = append(events, ev)
+		}
+		return events
+	}
+}
+
+func TestSecurityEventPaths(t *testing.T) {
+	notPDF := base64.StdEncoding.EncodeToString([]byte("PK\x03\x04"))
+	adminHeaders := map[string]string{"Authorization": "Bearer " + testAdminToken}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		method  string
+		path    string
+		body    string
+		headers map[string]string
+		want    []string // event types, in order
+		outcome string   // of every event
+		target  string   // of every event; the method and path if empty
+	}{
+		{name: "notify without credentials", env: map[string]string{"NOTIFY_AUTH_TOKEN": "secret"},
+			method: "POST", path: "/fax-notify", body: `{}`, want: []string{secEventWebhookRejected}, outcome: "denied"},
+		{name: "notify with wrong token", env: map[string]string{"NOTIFY_AUTH_TOKEN": "secret"},
+			method: "POST", path: "/fax-notify", body: `{}`, headers: map[string]string{"Authorization": "Bearer wrong"},
+			want: []string{secEventWebhookRejected}, outcome: "denied"},
+		{name: "receive without credentials", env: map[string]string{"RECEIVE_BASIC_USER": "provider", "RECEIVE_BASIC_PASS": "pw"},
+			method: "POST", path: "/fax-receive", body: `{}`, want: []string{secEventWebhookRejected}, outcome: "denied"},
+		{name: "notify with bad signature", env: map[string]string{"WEBHOOK_HMAC_SECRET": "key"},
+			method: "POST", path: "/fax-notify", body: `{}`, headers: map[string]string{"X-Signature": "sha256=00"},
+			want: []string{secEventWebhookRejected}, outcome: "denied"},
+		{name: "receive without signature", env: map[string]string{"WEBHOOK_HMAC_SECRET": "key"},
+			method: "POST", path: "/fax-receive", body: `{}`, want: []string{secEventWebhookRejected}, outcome: "denied"},
+		{name: "receive of a non-PDF", method: "POST", path: "/fax-receive", body: `{"uuid":"fax-a","file_data":"` + notPDF + `"}`,
+			want: []string{secEventWebhookRejected}, outcome: "denied"},
+		{name: "malformed notify", method: "POST", path: "/fax-notify", body: `{`,
+			want: []string{secEventWebhookRejected}, outcome: "denied"},
+		{name: "admin change", method: "DELETE", path: "/cache/fax0001.sfc", headers: adminHeaders,
+			want: []string{secEventAdminAction}, outcome: "failure"},
+		{name: "admin read", method: "GET", path: "/cache", headers: adminHeaders},
+		{name: "admin without credentials", method: "DELETE", path: "/cache/fax0001.sfc",
+			want: []string{secEventAdminRejected}, outcome: "denied"},
+		{name: "document download", method: "GET", path: "/fax/fax-a/pdf", headers: adminHeaders,
+			want: []string{secEventDocumentAccess}, outcome: "failure", target: "fax-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			useTestConfig(t, env)
+			events := captureSecurityEvents(t)
+
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader([]byte(tt.body)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Request-ID", "req-1")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			serveTestRequest(t, func(app *iris.Application) {
+				registerProviderRoutes(app)
+				registerAdminRoutes(app)
+			}, req)
+
+			got := events()
+			var types []string
+			for _, ev := range got {
+				types = append(types, ev.Type)
+			}
+			if !slices.Equal(types, tt.want) {
+				t.Fatalf("events %v, want %v", types, tt.want)
+			}
+			target := tt.target
+			if target == "" {
+				target = tt.method + " " + tt.path
+			}
+			for _, ev := range got {
+				if ev.SchemaVersion != SecurityEventSchemaVersion || ev.Timestamp.IsZero() || ev.Outcome != tt.outcome ||
+					ev.SourceIP == "" || ev.CorrelationID != "req-1" || ev.Target != target {
+					t.Errorf("event %+v is missing fields, or has an outcome other than %q or a target other than %q", ev, tt.outcome, target)
+				}
+			}
+		})
+	}
+}
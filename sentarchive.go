@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Once a job is done, that is its .done file is written after the provider
+// reported success, its .sfc and PDF leave the queue directory. With
+// SENT_ARCHIVE_MODE=delete they are removed; with "archive" they move to
+// sent/<yyyy-mm>/ along with a copy of the final .sts. Nothing is cleaned
+// up when the send webhook accepts a job, only when it reaches a final state.
+
+// Cleanup actions, for SENT_ARCHIVE_MODE and RETENTION_ACTION.
+const (
+	cleanupDelete  = "delete"
+	cleanupArchive = "archive"
+)
+
+const sentDirName = "sent"
+
+var sentArchivedFiles = expvar.NewInt("sent_archived_files")
+
+// cleanUpSentJob removes or archives the files of a job that completed.
+func cleanUpSentJob(hylaJobID, sfcPath, pdfPath string) {
+	archiveSentJob(hylaJobID, sfcPath, pdfPath, "success", "")
+	if config().SentArchiveMode != cleanupArchive {
+		os.Remove(sfcPath)
+		os.Remove(pdfPath)
+		return
+	}
+
+	dir := jobFile(hylaJobID, filepath.Join(sentDirName, time.Now().In(config().faxLocation).Format("2006-01")))
+	if err := makeQueueDir(dir); err != nil {
+		slog.Error("Unable to create archive directory; removing job files", "job_id", hylaJobID, "file", dir, "err", err)
+		os.Remove(sfcPath)
+		os.Remove(pdfPath)
+		return
+	}
+	for _, path := range []string{sfcPath, pdfPath} {
+		if path == "" {
+			continue
+		}
+		if err := os.Rename(path, archivePath(dir, hylaJobID, filepath.Base(path))); err != nil {
+			slog.Error("Unable to archive job file", "job_id", hylaJobID, "file", path, "err", err)
+			continue
+		}
+		sentArchivedFiles.Add(1)
+	}
+	sts := "q" + hylaJobID + ".sts"
+	if data, err := os.ReadFile(jobFile(hylaJobID, sts)); err == nil {
+		if err := os.WriteFile(archivePath(dir, hylaJobID, sts), data, 0644); err != nil {
+			slog.Error("Unable to archive .sts", "job_id", hylaJobID, "file", dir, "err", err)
+		}
+	}
+	slog.Debug("Sent job archived", "job_id", hylaJobID, "file", dir)
+}
+
+// archivePath returns where name is archived in dir. Synergy may reuse a file
+// name within a month; a name already taken gets the Hylafax job ID in front.
+func archivePath(dir, hylaJobID, name string) string {
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		path = filepath.Join(dir, hylaJobID+"-"+name)
+	}
+	return path
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FTP uploads produce a burst of Create and Write events per file. Rather
+// than handling each one, the watcher waits until a file has stopped changing
+// for FILE_SETTLE_TIME and then handles it once.
+
+// scanQueueDir queues the .sfc and .pdf files already in dir, which arrived
+// while the daemon was down. It runs once the watcher is armed, so a file
+// that is still being written is seen both here and by fsnotify; the settler
+// handles it once. An .sfc whose .jobid is at least as new as itself was
+// already taken as a job and is skipped. A PDF is queued only for an .sfc
+// restored as waiting for it: an .sfc found here or uploaded later finds its
+// PDF on disk, and the other PDFs include received faxes whose .recv Synergy
+// has already imported, which would otherwise wait for an .sfc that never
+// comes.
+func scanQueueDir(dir string, settler *fileSettler) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Error scanning queue directory", "file", dir, "err", err)
+		return
+	}
+	queued := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".sfc":
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			jobIDFile := filepath.Join(dir, strings.TrimSuffix(name, filepath.Ext(name))+".jobid")
+			if jobID, err := os.Stat(jobIDFile); err == nil && !jobID.ModTime().Before(info.ModTime()) {
+				slog.Info("Skipping queue file that already has a job ID", "file", name)
+				continue
+			}
+		case ".pdf":
+			cache.Lock()
+			_, waiting := cache.sfc[name]
+			cache.Unlock()
+			if !waiting {
+				continue
+			}
+		default:
+			continue
+		}
+		settler.changed(filepath.Join(dir, name))
+		queued++
+	}
+	if queued > 0 {
+		slog.Info("Found queue files from before startup", "count", queued)
+	}
+}
+
+type settlingFile struct {
+	timer   *time.Timer
+	size    int64
+	modTime time.Time
+}
+
+// fileSettler reports each changed path on ready once its size and
+// modification time have been stable for the settle time.
+type fileSettler struct {
+	ctx   context.Context
+	quiet time.Duration
+	ready chan string
+
+	mu      sync.Mutex
+	pending map[string]*settlingFile
+}
+
+func newFileSettler(ctx context.Context, quiet time.Duration) *fileSettler {
+	return &fileSettler{ctx: ctx, quiet: quiet, ready: make(chan string), pending: make(map[string]*settlingFile)}
+}
+
+// changed records the current size of path and restarts its quiet period.
+func (s *fileSettler) changed(path string) {
+	size, modTime := int64(-1), time.Time{}
+	if info, err := os.Stat(path); err == nil {
+		size, modTime = info.Size(), info.ModTime()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.pending[path]
+	if !ok {
+		f = &settlingFile{}
+		f.timer = time.AfterFunc(s.quiet, func() { s.check(path, f) })
+		s.pending[path] = f
+	} else {
+		f.timer.Reset(s.quiet)
+	}
+	f.size, f.modTime = size, modTime
+}
+
+// forget drops a path that was removed or renamed away.
+func (s *fileSettler) forget(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.pending[path]; ok {
+		f.timer.Stop()
+		delete(s.pending, path)
+	}
+}
+
+func (s *fileSettler) check(path string, f *settlingFile) {
+	info, err := os.Stat(path)
+
+	s.mu.Lock()
+	if s.pending[path] != f {
+		s.mu.Unlock()
+		return
+	}
+	if err != nil {
+		delete(s.pending, path)
+		s.mu.Unlock()
+		return
+	}
+	if info.Size() != f.size || !info.ModTime().Equal(f.modTime) {
+		// Changed without an event we saw: look again after another quiet period.
+		f.size, f.modTime = info.Size(), info.ModTime()
+		f.timer.Reset(s.quiet)
+		s.mu.Unlock()
+		return
+	}
+	delete(s.pending, path)
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- path:
+	case <-s.ctx.Done():
+	}
+}
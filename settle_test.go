@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanQueueDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		jobID   bool // fax0001.jobid is newer than fax0001.sfc
+		waiting bool // a restored .sfc is waiting for fax0001.pdf
+		want    []string
+	}{
+		{name: "new .sfc and PDF", files: []string{"fax0001.sfc", "fax0001.pdf"}, want: []string{"fax0001.sfc"}},
+		{name: ".sfc already taken", files: []string{"fax0001.sfc", "fax0001.pdf"}, jobID: true},
+		{name: "PDF an .sfc waits for", files: []string{"fax0001.pdf"}, waiting: true, want: []string{"fax0001.pdf"}},
+		{name: "received fax already imported", files: []string{"{0123456789ab}20091123140500.pdf"}},
+		{name: "other files", files: []string{"fax0001.recv", "q42.sts", "fax0001.cmd"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, nil)
+			dir := cfg.FTPRoot + FaxDir
+			past := time.Now().Add(-time.Hour)
+			for _, name := range tt.files {
+				writeTestFile(t, filepath.Join(dir, name), "x")
+				os.Chtimes(filepath.Join(dir, name), past, past)
+			}
+			if tt.jobID {
+				writeTestFile(t, filepath.Join(dir, "fax0001.jobid"), "42\r")
+			}
+			if tt.waiting {
+				cache.sfc["fax0001.pdf"] = sfcFile{SfcJob: SfcJob{PdfFile: "fax0001.pdf"}, jobID: "fax0001", sfcFile: filepath.Join(dir, "fax0001.sfc")}
+			}
+
+			settler := newFileSettler(context.Background(), time.Hour)
+			scanQueueDir(dir, settler)
+			var got []string
+			settler.mu.Lock()
+			for path, f := range settler.pending {
+				f.timer.Stop()
+				got = append(got, filepath.Base(path))
+			}
+			settler.mu.Unlock()
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("queued %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestFileSettler writes files in chunks, the way an FTP upload arrives, and
+// checks that each is reported once, with its complete content.
+func TestFileSettler(t *testing.T) {
+	const quiet = 100 * time.Millisecond
+	tests := []struct {
+		name   string
+		chunks int
+		events bool // every chunk raises an event, not only the first
+		remove bool // the file is removed before it settles
+		want   int  // times the file is reported
+	}{
+		{name: "single write", chunks: 1, events: true, want: 1},
+		{name: "event per chunk", chunks: 20, events: true, want: 1},
+		{name: "event for the first chunk only", chunks: 20, want: 1},
+		{name: "removed while settling", chunks: 5, events: true, remove: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fax0001.sfc")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			settler := newFileSettler(ctx, quiet)
+			var reported []string
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case p := <-settler.ready:
+						data, _ := os.ReadFile(p)
+						reported = append(reported, string(data))
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want strings.Builder
+			for i := 0; i < tt.chunks; i++ {
+				chunk := fmt.Sprintf("line %02d\n", i)
+				want.WriteString(chunk)
+				f.WriteString(chunk)
+				if i == 0 || tt.events {
+					settler.changed(path)
+				}
+				time.Sleep(quiet / 10)
+			}
+			f.Close()
+			if tt.remove {
+				os.Remove(path)
+				settler.forget(path)
+			}
+			time.Sleep(4 * quiet)
+			cancel()
+			<-done
+
+			if len(reported) != tt.want {
+				t.Fatalf("reported %d times, want %d", len(reported), tt.want)
+			}
+			for _, got := range reported {
+				if got != want.String() {
+					t.Errorf("reported with %d bytes, want %d", len(got), want.Len())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A .sfc file has the destination number on line 1 and the PDF name on line
+// 2. Our Synergy build may add an override caller ID on line 3 and a "send
+// after" time on line 4. Lines may instead be written as "key: value", which
+// is also how the originating user is given:
+//
+//	user:       originating Synergy user
+//	caller_id:  caller number sent instead of FAX_NUMBER
+//	priority:   0-255, lower is more urgent, as in Hylafax (default 127)
+//	not_before: do not submit before this time
+//
+// Times are RFC 3339, "2006-01-02 15:04[:05]" in FAX_TIMEZONE, or Unix
+// seconds. Lines that are not understood are ignored, so newer Synergy builds
+// can add more.
+
+// defaultSfcPriority is Hylafax's default job priority.
+const defaultSfcPriority = 127
+
+// SfcJob is the content of a .sfc file.
+type SfcJob struct {
+	FaxNumber string    `json:"fax_number"`
+	PdfFile   string    `json:"pdf_file"`
+	User      string    `json:"user,omitempty"`
+	CallerID  string    `json:"caller_id,omitempty"`
+	Priority  int       `json:"priority"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+}
+
+var (
+	sfcKeyLine  = regexp.MustCompile(`^([A-Za-z_-]+):\s*(.*)$`)
+	sfcCallerID = regexp.MustCompile(`^\+?[\d\-. ()]+$`)
+)
+
+var (
+	errSfcTooShort = errors.New("invalid SFC file format")
+	errSfcNoPdf    = errors.New("invalid SFC file format: no PDF file name")
+)
+
+// parseSfcFile parses the content of a .sfc file. file is only used in logs.
+func parseSfcFile(file, content string) (SfcJob, error) {
+	lines := strings.Split(content, "\n")
+	if len(lines) < 2 {
+		return SfcJob{}, errSfcTooShort
+	}
+	job := SfcJob{
+		FaxNumber: strings.ReplaceAll(lines[0], "\r", ""),
+		PdfFile:   strings.ReplaceAll(lines[1], "\r", ""),
+		Priority:  defaultSfcPriority,
+	}
+	if job.PdfFile == "" {
+		return SfcJob{}, errSfcNoPdf
+	}
+
+	for i, line := range lines[2:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m := sfcKeyLine.FindStringSubmatch(line); m != nil {
+			key, value := strings.ReplaceAll(strings.ToLower(m[1]), "-", "_"), strings.TrimSpace(m[2])
+			switch key {
+			case "user":
+				job.User = value
+			case "caller_id", "callerid":
+				job.setCallerID(file, value)
+			case "priority":
+				p, err := strconv.Atoi(value)
+				if err != nil || p < 0 || p > 255 {
+					slog.Warn("Ignoring invalid SFC priority", "file", file, "priority", value)
+					continue
+				}
+				job.Priority = p
+			case "not_before", "send_after":
+				job.setNotBefore(file, value)
+			default:
+				slog.Debug("Ignoring unknown SFC line", "file", file, "key", key)
+			}
+			continue
+		}
+		switch i + 3 {
+		case 3:
+			job.setCallerID(file, line)
+		case 4:
+			job.setNotBefore(file, line)
+		default:
+			slog.Debug("Ignoring unknown SFC line", "file", file, "line", i+3)
+		}
+	}
+	return job, nil
+}
+
+func (j *SfcJob) setCallerID(file, value string) {
+	if !sfcCallerID.MatchString(value) {
+		slog.Warn("Ignoring invalid SFC caller ID", "file", file, "cidnum", value)
+		return
+	}
+	j.CallerID = value
+}
+
+func (j *SfcJob) setNotBefore(file, value string) {
+	t, err := parseSfcTime(value)
+	if err != nil {
+		slog.Warn("Ignoring unreadable SFC send-after time", "file", file, "value", value)
+		return
+	}
+	j.NotBefore = t
+}
+
+// parseSfcTime parses a send-after time; local times are in FAX_TIMEZONE.
+func parseSfcTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, config().faxLocation); err == nil {
+			return t, nil
+		}
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0), nil
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+// sftpClient is the small SFTP (version 3) client DELIVERY_MODE=sftp-client
+// needs, over golang.org/x/crypto/ssh. Requests are sent one at a time. The
+// server's host key must be in REMOTE_KNOWN_HOSTS; login is with
+// REMOTE_PRIVATE_KEY, REMOTE_PASSWORD or both.
+
+// SFTP packet types.
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+	sshFxpExtended = 200
+)
+
+// SFTP status codes and open flags.
+const (
+	sshFxOK  = 0
+	sshFxEOF = 1
+
+	sshFxfRead  = 0x01
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+)
+
+// sftpChunk is the most data read or written per request.
+const sftpChunk = 32 * 1024
+
+type sftpClient struct {
+	ssh     *ssh.Client
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	dir     string
+	nextID  uint32
+	timeout time.Duration
+	conn    net.Conn
+
+	posixRename bool // the server has posix-rename@openssh.com
+}
+
+// sftpStatusError is an SSH_FXP_STATUS reply other than OK.
+type sftpStatusError struct {
+	Op   string
+	Code uint32
+	Msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("SFTP %s: %s (status %d)", e.Op, e.Msg, e.Code)
+}
+
+// dialSFTP logs in to address, a host with an optional port, and works in
+// dir.
+func dialSFTP(address, username, password, keyFile, knownHostsFile, dir string, timeout time.Duration) (*sftpClient, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	var auth []ssh.AuthMethod
+	if keyFile != "" {
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         timeout,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &sftpClient{ssh: ssh.NewClient(sshConn, chans, reqs), dir: dir, timeout: timeout, conn: conn}
+	if err := c.start(); err != nil {
+		c.ssh.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sftpClient) start() error {
+	var err error
+	if c.session, err = c.ssh.NewSession(); err != nil {
+		return err
+	}
+	if c.w, err = c.session.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := c.session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	c.r = stdout
+	if err := c.session.RequestSubsystem("sftp"); err != nil {
+		return err
+	}
+
+	var init []byte
+	init = binary.BigEndian.AppendUint32(init, 3)
+	if err := c.send(sshFxpInit, init); err != nil {
+		return err
+	}
+	typ, payload, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if typ != sshFxpVersion || len(payload) < 4 {
+		return fmt.Errorf("SFTP: unexpected reply %d to INIT", typ)
+	}
+	payload = payload[4:]
+	for len(payload) > 0 {
+		var name, data string
+		if name, payload, err = sftpString(payload); err != nil {
+			return err
+		}
+		if data, payload, err = sftpString(payload); err != nil {
+			return err
+		}
+		if name == "posix-rename@openssh.com" && data == "1" {
+			c.posixRename = true
+		}
+	}
+	return nil
+}
+
+func (c *sftpClient) send(typ byte, payload []byte) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err := c.w.Write(append(packet, payload...))
+	return err
+}
+
+func (c *sftpClient) recv() (byte, []byte, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("SFTP: bad packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// request sends a request with a new ID and returns the reply, which must
+// carry the same ID. A STATUS reply other than OK is returned as an
+// *sftpStatusError.
+func (c *sftpClient) request(op string, typ byte, fields ...any) (byte, []byte, error) {
+	c.nextID++
+	payload := binary.BigEndian.AppendUint32(nil, c.nextID)
+	for _, field := range fields {
+		switch v := field.(type) {
+		case string:
+			payload = appendSFTPString(payload, []byte(v))
+		case []byte:
+			payload = appendSFTPString(payload, v)
+		case uint32:
+			payload = binary.BigEndian.AppendUint32(payload, v)
+		case uint64:
+			payload = binary.BigEndian.AppendUint64(payload, v)
+		}
+	}
+	if err := c.send(typ, payload); err != nil {
+		return 0, nil, err
+	}
+	replyType, reply, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(reply) < 4 || binary.BigEndian.Uint32(reply) != c.nextID {
+		return 0, nil, fmt.Errorf("SFTP %s: reply out of sequence", op)
+	}
+	reply = reply[4:]
+	if replyType == sshFxpStatus {
+		if len(reply) < 4 {
+			return 0, nil, fmt.Errorf("SFTP %s: short status", op)
+		}
+		code := binary.BigEndian.Uint32(reply)
+		if code != sshFxOK {
+			msg, _, _ := sftpString(reply[4:])
+			return replyType, nil, &sftpStatusError{Op: op, Code: code, Msg: msg}
+		}
+	}
+	return replyType, reply, nil
+}
+
+func appendSFTPString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func sftpString(b []byte) (string, []byte, error) {
+	if len(b) < 4 || uint32(len(b)-4) < binary.BigEndian.Uint32(b) {
+		return "", nil, errors.New("SFTP: short string")
+	}
+	n := binary.BigEndian.Uint32(b)
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
+
+// sftpAttrs reads the size and permissions of an ATTRS structure, returning
+// what follows it.
+func sftpAttrs(b []byte) (size int64, mode uint32, rest []byte, err error) {
+	short := errors.New("SFTP: short attributes")
+	if len(b) < 4 {
+		return 0, 0, nil, short
+	}
+	flags := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if flags&0x1 != 0 { // size
+		if len(b) < 8 {
+			return 0, 0, nil, short
+		}
+		size, b = int64(binary.BigEndian.Uint64(b)), b[8:]
+	}
+	if flags&0x2 != 0 { // uid, gid
+		if len(b) < 8 {
+			return 0, 0, nil, short
+		}
+		b = b[8:]
+	}
+	if flags&0x4 != 0 { // permissions
+		if len(b) < 4 {
+			return 0, 0, nil, short
+		}
+		mode, b = binary.BigEndian.Uint32(b), b[4:]
+	}
+	if flags&0x8 != 0 { // atime, mtime
+		if len(b) < 8 {
+			return 0, 0, nil, short
+		}
+		b = b[8:]
+	}
+	if flags&0x80000000 != 0 { // extended
+		if len(b) < 4 {
+			return 0, 0, nil, short
+		}
+		count := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		for i := uint32(0); i < count*2; i++ {
+			if _, b, err = sftpString(b); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+	}
+	return size, mode, b, nil
+}
+
+func (c *sftpClient) path(name string) string {
+	return path.Join(c.dir, name)
+}
+
+func (c *sftpClient) handle(op string, typ byte, fields ...any) (string, error) {
+	replyType, reply, err := c.request(op, typ, fields...)
+	if err != nil {
+		return "", err
+	}
+	if replyType != sshFxpHandle {
+		return "", fmt.Errorf("SFTP %s: unexpected reply %d", op, replyType)
+	}
+	h, _, err := sftpString(reply)
+	return h, err
+}
+
+func (c *sftpClient) closeHandle(h string) error {
+	_, _, err := c.request("CLOSE", sshFxpClose, h)
+	return err
+}
+
+// List returns the names of the regular files in the folder.
+func (c *sftpClient) List() ([]string, error) {
+	h, err := c.handle("OPENDIR", sshFxpOpendir, c.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(h)
+	var names []string
+	for {
+		replyType, reply, err := c.request("READDIR", sshFxpReaddir, h)
+		var statusErr *sftpStatusError
+		if errors.As(err, &statusErr) && statusErr.Code == sshFxEOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if replyType != sshFxpName || len(reply) < 4 {
+			return nil, fmt.Errorf("SFTP READDIR: unexpected reply %d", replyType)
+		}
+		count := binary.BigEndian.Uint32(reply)
+		reply = reply[4:]
+		for i := uint32(0); i < count; i++ {
+			var name string
+			var mode uint32
+			if name, reply, err = sftpString(reply); err != nil {
+				return nil, err
+			}
+			if _, reply, err = sftpString(reply); err != nil { // long name
+				return nil, err
+			}
+			if _, mode, reply, err = sftpAttrs(reply); err != nil {
+				return nil, err
+			}
+			if mode&0o170000 == 0o100000 || mode == 0 { // regular file, or not given
+				names = append(names, name)
+			}
+		}
+	}
+}
+
+func (c *sftpClient) Size(name string) (int64, error) {
+	replyType, reply, err := c.request("STAT", sshFxpStat, c.path(name))
+	if err != nil {
+		return 0, err
+	}
+	if replyType != sshFxpAttrs {
+		return 0, fmt.Errorf("SFTP STAT: unexpected reply %d", replyType)
+	}
+	size, _, _, err := sftpAttrs(reply)
+	return size, err
+}
+
+func (c *sftpClient) Get(name string) ([]byte, error) {
+	h, err := c.handle("OPEN", sshFxpOpen, c.path(name), uint32(sshFxfRead), uint32(0))
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(h)
+	var data []byte
+	for {
+		replyType, reply, err := c.request("READ", sshFxpRead, h, uint64(len(data)), uint32(sftpChunk))
+		var statusErr *sftpStatusError
+		if errors.As(err, &statusErr) && statusErr.Code == sshFxEOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if replyType != sshFxpData {
+			return nil, fmt.Errorf("SFTP READ: unexpected reply %d", replyType)
+		}
+		chunk, _, err := sftpString(reply)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func (c *sftpClient) Put(name string, data []byte) error {
+	h, err := c.handle("OPEN", sshFxpOpen, c.path(name), uint32(sshFxfWrite|sshFxfCreat|sshFxfTrunc), uint32(0))
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += sftpChunk {
+		chunk := data[offset:min(offset+sftpChunk, len(data))]
+		if _, _, err := c.request("WRITE", sshFxpWrite, h, uint64(offset), chunk); err != nil {
+			c.closeHandle(h)
+			return err
+		}
+	}
+	return c.closeHandle(h)
+}
+
+// Rename replaces to where the server has posix-rename@openssh.com, and
+// otherwise fails if to exists.
+func (c *sftpClient) Rename(from, to string) error {
+	if c.posixRename {
+		_, _, err := c.request("RENAME", sshFxpExtended, "posix-rename@openssh.com", c.path(from), c.path(to))
+		return err
+	}
+	_, _, err := c.request("RENAME", sshFxpRename, c.path(from), c.path(to))
+	return err
+}
+
+func (c *sftpClient) Delete(name string) error {
+	_, _, err := c.request("REMOVE", sshFxpRemove, c.path(name))
+	return err
+}
+
+func (c *sftpClient) Close() error {
+	c.w.Close()
+	c.session.Close()
+	return c.ssh.Close()
+}
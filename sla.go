@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slaConfig is one SLA definition as read from SLA_FILE.
+type slaConfig struct {
+	Name                string   `json:"name"`
+	Users               []string `json:"users"`                 // restrict to these Synergy users; empty means every job
+	SubmitWithin        string   `json:"submit_within"`         // upload -> accepted by the webhook, e.g. "2m"
+	CompleteWithin      string   `json:"complete_within"`       // upload -> final notify, e.g. "15m"
+	TargetPercent       float64  `json:"target_percent"`        // share of jobs that must meet both targets, e.g. 95
+	SuccessFloorPercent float64  `json:"success_floor_percent"` // minimum share of successful jobs
+	Window              string   `json:"window"`                // evaluation window, e.g. "1h"
+}
+
+// slaDefinition is a parsed slaConfig.
+type slaDefinition struct {
+	slaConfig
+	submitWithin   time.Duration
+	completeWithin time.Duration
+	window         time.Duration
+	users          map[string]bool
+}
+
+// slaTiming records when an outbound job passed each stage.
+type slaTiming struct {
+	User        string
+	UploadedAt  time.Time // .sfc file written by Synergy
+	SubmittedAt time.Time // accepted by the send webhook
+	CompletedAt time.Time // final result known
+	Success     bool
+	Excluded    string // reason the job does not count towards the SLA, e.g. "approval"
+}
+
+// slaCompliance is the evaluation of one SLA over its current window.
+type slaCompliance struct {
+	Name            string    `json:"name"`
+	WindowStart     time.Time `json:"window_start"`
+	Jobs            int       `json:"jobs"`     // completed jobs counted in the window
+	Excluded        int       `json:"excluded"` // completed jobs in the window that were filtered out
+	SubmitPercent   float64   `json:"submit_percent"`
+	CompletePercent float64   `json:"complete_percent"`
+	SuccessPercent  float64   `json:"success_percent"`
+	Breached        bool      `json:"breached"`
+	Reasons         []string  `json:"reasons,omitempty"`
+}
+
+var slas = struct {
+	sync.Mutex
+	definitions []slaDefinition
+	jobs        map[string]*slaTiming // Hylafax job ID -> timing
+	compliance  []slaCompliance
+	breached    map[string]bool // SLA name -> currently in breach
+}{jobs: make(map[string]*slaTiming), breached: make(map[string]bool)}
+
+func init() {
+	expvar.Publish("sla", expvar.Func(func() any { return slaStatus() }))
+}
+
+// loadSLAs reads the SLA definitions from SLA_FILE and starts evaluating them every minute.
+func loadSLAs() error {
+	path := config().SLAFile
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var configs []slaConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	definitions := make([]slaDefinition, 0, len(configs))
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			return fmt.Errorf("sla %d: name is required", i)
+		}
+		def := slaDefinition{slaConfig: cfg, users: make(map[string]bool)}
+		for _, field := range []struct {
+			name  string
+			value string
+			dst   *time.Duration
+		}{
+			{"submit_within", cfg.SubmitWithin, &def.submitWithin},
+			{"complete_within", cfg.CompleteWithin, &def.completeWithin},
+			{"window", cfg.Window, &def.window},
+		} {
+			if field.value == "" {
+				continue
+			}
+			d, err := time.ParseDuration(field.value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("sla %s: invalid %s %q", cfg.Name, field.name, field.value)
+			}
+			*field.dst = d
+		}
+		if def.window == 0 {
+			return fmt.Errorf("sla %s: window is required", cfg.Name)
+		}
+		if def.TargetPercent == 0 {
+			def.TargetPercent = 100
+		}
+		for _, user := range cfg.Users {
+			def.users[user] = true
+		}
+		definitions = append(definitions, def)
+	}
+
+	slas.Lock()
+	slas.definitions = definitions
+	slas.Unlock()
+	slog.Info("Loaded SLA definitions", "count", len(definitions), "file", path)
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			evaluateSLAs(time.Now())
+		}
+	}()
+	return nil
+}
+
+// slaJobUploaded starts the timing of an outbound job.
+func slaJobUploaded(hylaJobID, user string, uploadedAt time.Time) {
+	slas.Lock()
+	defer slas.Unlock()
+	if len(slas.definitions) == 0 {
+		return
+	}
+	slas.jobs[hylaJobID] = &slaTiming{User: user, UploadedAt: uploadedAt}
+}
+
+// slaJobExcluded keeps the job out of SLA figures, e.g. while it waited on a human.
+func slaJobExcluded(hylaJobID, reason string) {
+	slas.Lock()
+	defer slas.Unlock()
+	if t, ok := slas.jobs[hylaJobID]; ok && t.Excluded == "" {
+		t.Excluded = reason
+	}
+}
+
+// slaJobSubmitted records that the send webhook accepted the job.
+func slaJobSubmitted(hylaJobID string) {
+	slas.Lock()
+	defer slas.Unlock()
+	if t, ok := slas.jobs[hylaJobID]; ok {
+		t.SubmittedAt = time.Now()
+	}
+}
+
+// slaJobCompleted records the final result of the job.
+func slaJobCompleted(hylaJobID string, success bool) {
+	slas.Lock()
+	defer slas.Unlock()
+	if t, ok := slas.jobs[hylaJobID]; ok && t.CompletedAt.IsZero() {
+		t.CompletedAt = time.Now()
+		t.Success = success
+	}
+}
+
+// evaluateSLAs computes compliance for every definition over the window ending
+// at now, logs a warning when an SLA enters or leaves breach, and drops
+// timings older than the longest window. Jobs that never received a final
+// result are dropped a day after leaving the window.
+func evaluateSLAs(now time.Time) {
+	slas.Lock()
+	defer slas.Unlock()
+
+	var longest time.Duration
+	compliance := make([]slaCompliance, 0, len(slas.definitions))
+	for _, def := range slas.definitions {
+		if def.window > longest {
+			longest = def.window
+		}
+		c := evaluateSLA(def, slas.jobs, now)
+		compliance = append(compliance, c)
+
+		if c.Breached && !slas.breached[def.Name] {
+			slog.Warn("SLA breached", "sla", def.Name, "window", def.window, "reasons", strings.Join(c.Reasons, "; "))
+		} else if !c.Breached && slas.breached[def.Name] {
+			slog.Info("SLA is compliant again", "sla", def.Name)
+		}
+		slas.breached[def.Name] = c.Breached
+	}
+	slas.compliance = compliance
+
+	for id, t := range slas.jobs {
+		if !t.CompletedAt.IsZero() && now.Sub(t.CompletedAt) > longest ||
+			t.CompletedAt.IsZero() && now.Sub(t.UploadedAt) > longest+24*time.Hour {
+			delete(slas.jobs, id)
+		}
+	}
+}
+
+// evaluateSLA counts the jobs that completed inside the definition's window.
+func evaluateSLA(def slaDefinition, jobs map[string]*slaTiming, now time.Time) slaCompliance {
+	c := slaCompliance{Name: def.Name, WindowStart: now.Add(-def.window)}
+	var submitted, completed, succeeded int
+	for _, t := range jobs {
+		if t.CompletedAt.IsZero() || t.CompletedAt.Before(c.WindowStart) {
+			continue
+		}
+		if len(def.users) > 0 && !def.users[t.User] {
+			continue
+		}
+		if t.Excluded != "" {
+			c.Excluded++
+			continue
+		}
+		c.Jobs++
+		if !t.SubmittedAt.IsZero() && (def.submitWithin == 0 || t.SubmittedAt.Sub(t.UploadedAt) <= def.submitWithin) {
+			submitted++
+		}
+		if t.Success && (def.completeWithin == 0 || t.CompletedAt.Sub(t.UploadedAt) <= def.completeWithin) {
+			completed++
+		}
+		if t.Success {
+			succeeded++
+		}
+	}
+	if c.Jobs == 0 {
+		c.SubmitPercent, c.CompletePercent, c.SuccessPercent = 100, 100, 100
+		return c
+	}
+
+	percent := func(n int) float64 { return float64(n) * 100 / float64(c.Jobs) }
+	c.SubmitPercent = percent(submitted)
+	c.CompletePercent = percent(completed)
+	c.SuccessPercent = percent(succeeded)
+	if def.submitWithin > 0 && c.SubmitPercent < def.TargetPercent {
+		c.Reasons = append(c.Reasons, fmt.Sprintf("%.1f%% submitted within %s (target %.1f%%)", c.SubmitPercent, def.submitWithin, def.TargetPercent))
+	}
+	if def.completeWithin > 0 && c.CompletePercent < def.TargetPercent {
+		c.Reasons = append(c.Reasons, fmt.Sprintf("%.1f%% completed within %s (target %.1f%%)", c.CompletePercent, def.completeWithin, def.TargetPercent))
+	}
+	if def.SuccessFloorPercent > 0 && c.SuccessPercent < def.SuccessFloorPercent {
+		c.Reasons = append(c.Reasons, fmt.Sprintf("%.1f%% successful (floor %.1f%%)", c.SuccessPercent, def.SuccessFloorPercent))
+	}
+	c.Breached = len(c.Reasons) > 0
+	return c
+}
+
+func slaStatus() []slaCompliance {
+	slas.Lock()
+	defer slas.Unlock()
+	return append([]slaCompliance(nil), slas.compliance...)
+}
+
+// registerSLARoutes adds the SLA compliance endpoint.
+func registerSLARoutes(admin iris.Party) {
+	documentRoute(admin.Get("/sla", func(ctx iris.Context) {
+		evaluateSLAs(time.Now())
+		ctx.JSON(iris.Map{"sla": slaStatus()})
+	}), apiDoc{Summary: "Compliance of every configured SLA", Response: struct {
+		SLA []slaCompliance `json:"sla"`
+	}{}})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEvaluateSLA(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	def := slaDefinition{
+		slaConfig:      slaConfig{Name: "standard", TargetPercent: 95, SuccessFloorPercent: 90},
+		submitWithin:   2 * time.Minute,
+		completeWithin: 15 * time.Minute,
+		window:         time.Hour,
+	}
+	// job uploads at now-ago and takes submit and complete to pass those stages.
+	job := func(ago, submit, complete time.Duration, success bool) *slaTiming {
+		uploaded := now.Add(-ago)
+		return &slaTiming{User: "jsmith", UploadedAt: uploaded, SubmittedAt: uploaded.Add(submit), CompletedAt: uploaded.Add(complete), Success: success}
+	}
+	// fast returns n jobs that meet every target.
+	fast := func(n int) []*slaTiming {
+		var jobs []*slaTiming
+		for i := 0; i < n; i++ {
+			jobs = append(jobs, job(30*time.Minute, 30*time.Second, 5*time.Minute, true))
+		}
+		return jobs
+	}
+
+	tests := []struct {
+		name     string
+		def      func(slaDefinition) slaDefinition
+		jobs     []*slaTiming
+		want     slaCompliance
+		breached bool
+	}{
+		{name: "empty window", want: slaCompliance{SubmitPercent: 100, CompletePercent: 100, SuccessPercent: 100}},
+		{name: "all compliant", jobs: fast(20),
+			want: slaCompliance{Jobs: 20, SubmitPercent: 100, CompletePercent: 100, SuccessPercent: 100}},
+		{name: "one slow submit in twenty", jobs: append(fast(19), job(30*time.Minute, 3*time.Minute, 5*time.Minute, true)),
+			want: slaCompliance{Jobs: 20, SubmitPercent: 95, CompletePercent: 100, SuccessPercent: 100}},
+		{name: "slow submits", jobs: append(fast(8), job(30*time.Minute, 3*time.Minute, 5*time.Minute, true), job(30*time.Minute, 5*time.Minute, 10*time.Minute, true)),
+			want: slaCompliance{Jobs: 10, SubmitPercent: 80, CompletePercent: 100, SuccessPercent: 100}, breached: true},
+		{name: "slow completions", jobs: append(fast(9), job(40*time.Minute, time.Minute, 20*time.Minute, true)),
+			want: slaCompliance{Jobs: 10, SubmitPercent: 100, CompletePercent: 90, SuccessPercent: 100}, breached: true},
+		{name: "failures under the floor", jobs: append(fast(8), job(30*time.Minute, time.Minute, 5*time.Minute, false), job(30*time.Minute, time.Minute, 5*time.Minute, false)),
+			want: slaCompliance{Jobs: 10, SubmitPercent: 100, CompletePercent: 80, SuccessPercent: 80}, breached: true},
+		{name: "never submitted", jobs: append(fast(9), &slaTiming{User: "jsmith", UploadedAt: now.Add(-10 * time.Minute), CompletedAt: now.Add(-9 * time.Minute)}),
+			want: slaCompliance{Jobs: 10, SubmitPercent: 90, CompletePercent: 90, SuccessPercent: 90}, breached: true},
+		{name: "slow jobs before the window", jobs: append(fast(5), job(4*time.Hour, time.Hour, 2*time.Hour, false)),
+			want: slaCompliance{Jobs: 5, SubmitPercent: 100, CompletePercent: 100, SuccessPercent: 100}},
+		{name: "unfinished jobs", jobs: append(fast(5), &slaTiming{User: "jsmith", UploadedAt: now.Add(-50 * time.Minute)}),
+			want: slaCompliance{Jobs: 5, SubmitPercent: 100, CompletePercent: 100, SuccessPercent: 100}},
+		{name: "approval waits excluded", jobs: append(fast(5), &slaTiming{User: "jsmith", UploadedAt: now.Add(-50 * time.Minute),
+			SubmittedAt: now.Add(-10 * time.Minute), CompletedAt: now.Add(-5 * time.Minute), Success: true, Excluded: "approval"}),
+			want: slaCompliance{Jobs: 5, Excluded: 1, SubmitPercent: 100, CompletePercent: 100, SuccessPercent: 100}},
+		{name: "other users", def: func(d slaDefinition) slaDefinition {
+			d.users = map[string]bool{"clinic-a": true}
+			return d
+		}, jobs: append(fast(5), &slaTiming{User: "clinic-a", UploadedAt: now.Add(-30 * time.Minute), SubmittedAt: now.Add(-20 * time.Minute),
+			CompletedAt: now.Add(-5 * time.Minute), Success: true}),
+			want: slaCompliance{Jobs: 1, SubmitPercent: 0, CompletePercent: 0, SuccessPercent: 100}, breached: true},
+		{name: "completion target only", def: func(d slaDefinition) slaDefinition {
+			d.submitWithin, d.SuccessFloorPercent = 0, 0
+			return d
+		}, jobs: append(fast(19), job(30*time.Minute, 10*time.Minute, 14*time.Minute, true)),
+			want: slaCompliance{Jobs: 20, SubmitPercent: 100, CompletePercent: 100, SuccessPercent: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := def
+			if tt.def != nil {
+				d = tt.def(d)
+			}
+			jobs := make(map[string]*slaTiming)
+			for i, j := range tt.jobs {
+				jobs[string(rune('a'+i))] = j
+			}
+
+			got := evaluateSLA(d, jobs, now)
+			if got.Jobs != tt.want.Jobs || got.Excluded != tt.want.Excluded || got.SubmitPercent != tt.want.SubmitPercent ||
+				got.CompletePercent != tt.want.CompletePercent || got.SuccessPercent != tt.want.SuccessPercent {
+				t.Errorf("evaluateSLA() = %+v, want %+v", got, tt.want)
+			}
+			if got.Breached != tt.breached || got.Breached != (len(got.Reasons) > 0) {
+				t.Errorf("breached = %v with reasons %q, want %v", got.Breached, got.Reasons, tt.breached)
+			}
+		})
+	}
+}
+
+func TestEvaluateSLAsWindows(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	slas.Lock()
+	prev := slas.definitions
+	slas.definitions = []slaDefinition{{slaConfig: slaConfig{Name: "standard", TargetPercent: 95}, submitWithin: 2 * time.Minute, window: time.Hour}}
+	slas.jobs, slas.breached = make(map[string]*slaTiming), make(map[string]bool)
+	slas.Unlock()
+	t.Cleanup(func() {
+		slas.Lock()
+		slas.definitions, slas.compliance = prev, nil
+		slas.jobs, slas.breached = make(map[string]*slaTiming), make(map[string]bool)
+		slas.Unlock()
+	})
+
+	// A job every minute for three hours: submitted in 30s, except for a
+	// ten-minute stretch of 5-minute submits starting at 10:00. Each
+	// evaluation sees the jobs completed by then.
+	var timings []*slaTiming
+	for i := 0; i < 180; i++ {
+		uploaded := start.Add(time.Duration(i) * time.Minute)
+		submit := 30 * time.Second
+		if i >= 60 && i < 70 {
+			submit = 5 * time.Minute
+		}
+		timings = append(timings, &slaTiming{UploadedAt: uploaded, SubmittedAt: uploaded.Add(submit),
+			CompletedAt: uploaded.Add(submit + time.Minute), Success: true})
+	}
+
+	var breached []bool
+	added := make(map[int]bool)
+	for _, at := range []time.Duration{time.Hour, 90 * time.Minute, 2*time.Hour + 30*time.Minute} {
+		now := start.Add(at)
+		slas.Lock()
+		for i, timing := range timings {
+			if !added[i] && !timing.CompletedAt.After(now) {
+				added[i] = true
+				slas.jobs[string(rune(0x100+i))] = timing
+			}
+		}
+		slas.Unlock()
+		evaluateSLAs(now)
+		status := slaStatus()
+		if len(status) != 1 {
+			t.Fatalf("%d SLA results, want 1", len(status))
+		}
+		breached = append(breached, status[0].Breached)
+	}
+	if want := []bool{false, true, false}; !slices.Equal(breached, want) {
+		t.Errorf("breached at 10:00, 10:30 and 11:30 = %v, want %v", breached, want)
+	}
+	slas.Lock()
+	kept := len(slas.jobs)
+	slas.Unlock()
+	if kept >= 180 {
+		t.Errorf("%d timings kept after the window moved on, want fewer than 180", kept)
+	}
+}
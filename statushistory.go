@@ -0,0 +1,126 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// A fax record keeps every status it goes through in History, oldest first,
+// with when and from where: the provider's notify, a status line the service
+// wrote to an outbound job's .sts, an administrator's decision, or the
+// service storing a received fax. An outbound job gets a record of its own,
+// keyed by its Hylafax job ID so that it spans redials, when its first status
+// is written. History is saved with the record in state.json. Past
+// maxStatusHistory changes, the oldest after the first are dropped and
+// counted, so a job stuck reporting progress cannot grow without bound.
+
+// Sources of a status change.
+const (
+	statusSourceNotify  = "notify"
+	statusSourceSts     = "sts"
+	statusSourceManual  = "manual"
+	statusSourceReceive = "receive"
+)
+
+const maxStatusHistory = 100
+
+// statusChange is one entry of a record's History.
+type statusChange struct {
+	Status string    `json:"status"`
+	Source string    `json:"source"` // notify, sts, manual or receive
+	At     time.Time `json:"at"`
+}
+
+// setStatus makes status the record's current status and appends it to its
+// history, unless it repeats the last entry. Callers hold faxRecordsMutex.
+func (r *FaxJobRecord) setStatus(status, source string, at time.Time) {
+	r.LastStatus = status
+	r.LastUpdatedAt = at
+	if n := len(r.History); n > 0 && r.History[n-1].Status == status && r.History[n-1].Source == source {
+		return
+	}
+	r.History = append(r.History, statusChange{Status: status, Source: source, At: at})
+	if len(r.History) > maxStatusHistory {
+		r.History = append(r.History[:1], r.History[2:]...)
+		r.HistoryDropped++
+	}
+}
+
+// jobStatus is an outbound status waiting to be applied to its record.
+type jobStatus struct {
+	hylaJobID string
+	jobUUID   string // set when the provider accepted a dial
+	user      string // originating user, set with jobUUID
+	change    statusChange
+}
+
+// jobStatuses holds outbound statuses until saveState or the jobs endpoints
+// apply them. They are noted by code that may hold jobQueue or broadcasts,
+// which must not then take faxRecordsMutex.
+var jobStatuses = struct {
+	sync.Mutex
+	pending []jobStatus
+}{}
+
+// noteJobStatus records a status of the outbound job hylaJobID.
+func noteJobStatus(hylaJobID, status, source string) {
+	jobStatuses.Lock()
+	jobStatuses.pending = append(jobStatuses.pending, jobStatus{hylaJobID: hylaJobID,
+		change: statusChange{Status: status, Source: source, At: time.Now()}})
+	jobStatuses.Unlock()
+}
+
+// noteJobUUID records the UUID the provider gave a dial of hylaJobID, and
+// the job's originating user.
+func noteJobUUID(hylaJobID, jobUUID, user string) {
+	jobStatuses.Lock()
+	jobStatuses.pending = append(jobStatuses.pending, jobStatus{hylaJobID: hylaJobID, jobUUID: jobUUID, user: user,
+		change: statusChange{At: time.Now()}})
+	jobStatuses.Unlock()
+}
+
+// applyJobStatuses moves the noted statuses to their records. Callers must
+// not hold faxRecordsMutex.
+func applyJobStatuses() {
+	jobStatuses.Lock()
+	pending := jobStatuses.pending
+	jobStatuses.pending = nil
+	jobStatuses.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	faxRecordsMutex.Lock()
+	defer faxRecordsMutex.Unlock()
+	for _, s := range pending {
+		record, ok := faxRecords[s.hylaJobID]
+		if !ok {
+			record = &FaxJobRecord{Direction: "outbound", HylafaxJobID: s.hylaJobID, ReceivedAt: s.change.At, LastUpdatedAt: s.change.At}
+			faxRecords[s.hylaJobID] = record
+		}
+		if s.jobUUID != "" && !slices.Contains(record.JobUUIDs, s.jobUUID) {
+			record.JobUUIDs = append(record.JobUUIDs, s.jobUUID)
+		}
+		if s.user != "" {
+			record.User = s.user
+		}
+		if s.change.Status != "" {
+			record.setStatus(s.change.Status, s.change.Source, s.change.At)
+		}
+	}
+}
+
+// findJobRecord returns the key of the record for id: a record key, or the
+// UUID of a dial of an outbound job. Callers hold faxRecordsMutex.
+func findJobRecord(id string) (string, bool) {
+	if _, ok := faxRecords[id]; ok {
+		return id, true
+	}
+	for key, r := range faxRecords {
+		if slices.Contains(r.JobUUIDs, id) {
+			return key, true
+		}
+	}
+	return "", false
+}
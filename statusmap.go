@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// STATUS_MAP_FILE maps the statuses and result codes of notify results to
+// what the job does next, for providers whose vocabulary differs from the
+// defaults. The file is a JSON object:
+//
+//	{"statuses": {"SUCCESS": {"state": "7", "terminal": true, "message": "success"},
+//	              "BUSY": {"state": "8", "terminal": true, "retryable": true, "message": "busy"},
+//	              "DIALING": {"state": "3"}},
+//	 "result_codes": {"17": {"state": "8", "terminal": true, "message": "receiver not fax"}}}
+//
+// A result_codes entry matching a non-zero result_code comes before a
+// statuses entry; statuses match case-insensitively. A terminal entry with
+// state 7 completes the job and any other terminal state fails it, with
+// message as the .sts status. A non-terminal entry is progress (see
+// progress.go). Results no entry matches use the defaults: the
+// NOTIFY_PROGRESS_STATES statuses are progress, and anything else completes
+// or fails the job by its success flag, a busy or no-answer failure being
+// retryable. The file is re-read on SIGHUP.
+
+// statusMapping is what a notify status or result code means.
+type statusMapping struct {
+	State     string `json:"state"`
+	Terminal  bool   `json:"terminal"`
+	Retryable bool   `json:"retryable,omitempty"`
+	Message   string `json:"message,omitempty"` // .sts status line
+	unmapped  bool   // a failure no STATUS_MAP_FILE entry or built-in rule accounts for
+}
+
+// success reports whether a terminal mapping completes the job.
+func (m statusMapping) success() bool {
+	return m.Terminal && m.State == stsStateDone
+}
+
+type statusMapFile struct {
+	Statuses    map[string]statusMapping `json:"statuses"`
+	ResultCodes map[string]statusMapping `json:"result_codes"`
+}
+
+var statusMap = struct {
+	sync.Mutex
+	statusMapFile
+}{}
+
+// loadStatusMap reads STATUS_MAP_FILE, if set. On error the map in effect is
+// kept.
+func loadStatusMap() error {
+	path := config().StatusMapFile
+	if path == "" {
+		statusMap.Lock()
+		statusMap.statusMapFile = statusMapFile{}
+		statusMap.Unlock()
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var m statusMapFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	statuses := make(map[string]statusMapping, len(m.Statuses))
+	for status, mapping := range m.Statuses {
+		if err := checkStatusMapping(mapping); err != nil {
+			return fmt.Errorf("%s: status %q: %w", path, status, err)
+		}
+		statuses[strings.ToLower(strings.TrimSpace(status))] = mapping
+	}
+	for code, mapping := range m.ResultCodes {
+		if _, err := strconv.Atoi(code); err != nil {
+			return fmt.Errorf("%s: result code %q is not a number", path, code)
+		}
+		if err := checkStatusMapping(mapping); err != nil {
+			return fmt.Errorf("%s: result code %s: %w", path, code, err)
+		}
+	}
+	m.Statuses = statuses
+
+	statusMap.Lock()
+	statusMap.statusMapFile = m
+	statusMap.Unlock()
+	slog.Info("Loaded status map", "statuses", len(m.Statuses), "result_codes", len(m.ResultCodes), "file", path)
+	return nil
+}
+
+func checkStatusMapping(m statusMapping) error {
+	switch {
+	case len(m.State) != 1 || m.State < "0" || m.State > "9":
+		return fmt.Errorf("state %q must be a Hylafax state 0-9", m.State)
+	case m.Terminal && m.State != stsStateDone && m.State != stsStateFailed:
+		return fmt.Errorf("terminal state %q must be %s (done) or %s (failed)", m.State, stsStateDone, stsStateFailed)
+	case !m.Terminal && (m.State == stsStateDone || m.State == stsStateFailed):
+		return fmt.Errorf("state %q is final, so the entry must be terminal", m.State)
+	case !m.Terminal && m.Retryable:
+		return fmt.Errorf("only a terminal entry can be retryable")
+	}
+	return nil
+}
+
+// mapNotifyStatus returns what a notify result means for its job.
+func mapNotifyStatus(result FaxJob) statusMapping {
+	statusMap.Lock()
+	m, ok := statusMap.ResultCodes[strconv.Itoa(result.Result.ResultCode)]
+	ok = ok && result.Result.ResultCode != 0
+	if !ok {
+		m, ok = statusMap.Statuses[strings.ToLower(strings.TrimSpace(result.Status))]
+	}
+	statusMap.Unlock()
+	if ok {
+		if m.Message == "" && m.success() {
+			m.Message = "success"
+		} else if m.Message == "" && m.Terminal {
+			m.Message = "failed"
+		}
+		return m
+	}
+
+	if state, progress := notifyProgressState(result.Status); progress {
+		return statusMapping{State: state}
+	}
+	if result.Result.Success {
+		return statusMapping{State: stsStateDone, Terminal: true, Message: "success"}
+	}
+	for _, text := range []string{result.Status, result.Result.ResultText} {
+		if reason, ok := retryableResults[strings.Join(strings.FieldsFunc(strings.ToLower(text), isResultSeparator), " ")]; ok {
+			return statusMapping{State: stsStateFailed, Terminal: true, Retryable: true, Message: reason}
+		}
+	}
+	return statusMapping{State: stsStateFailed, Terminal: true, Message: "failed", unmapped: true}
+}
+
+// retryableResults are the failed statuses or result texts that are redialled
+// when no STATUS_MAP_FILE entry says otherwise, with their .sts message.
+var retryableResults = map[string]string{
+	"busy":        "busy",
+	"user busy":   "busy",
+	"no answer":   "no answer",
+	"noanswer":    "no answer",
+	"no response": "no answer",
+}
+
+func isResultSeparator(r rune) bool {
+	return r == ' ' || r == '_' || r == '-'
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// SEND_PROTOCOL chooses how a document is submitted to the send webhook:
+//
+//   - multipart POSTs multipart/form-data with the callee_number and
+//     caller_number fields and the document as the file part.
+//   - put-binary is the older protocol: a PUT to the webhook URL with
+//     ?source=<caller>&destination=<callee> added and the document itself as
+//     the body, with its Content-Type.
+//
+// Both expect the same JSON answer, and everything else (retries, timeouts,
+// the job ID and the .sts, .done and .fail files) is shared. A route in
+// SEND_ROUTES_FILE may name its own protocol.
+
+// Submission protocols kept in Config.SendProtocol.
+const (
+	sendProtocolMultipart = "multipart"
+	sendProtocolPutBinary = "put-binary"
+)
+
+// submitForm is what is submitted for one destination.
+type submitForm struct {
+	calleeNumber string
+	callerNumber string
+	pdfFile      string // the document's name in the .sfc
+	hylaJobID    string
+	data         []byte
+}
+
+// submitRequest is a submission ready to be sent, and the name and type the
+// document was given in it.
+type submitRequest struct {
+	method       string
+	url          string
+	contentType  string
+	body         []byte
+	partFilename string
+	partType     string
+}
+
+// submitter encodes submissions for one protocol.
+type submitter interface {
+	encode(target string, form submitForm) (submitRequest, error)
+}
+
+// submitterFor returns the submitter for protocol, a SEND_PROTOCOL value.
+func submitterFor(protocol string) submitter {
+	if protocol == sendProtocolPutBinary {
+		return putBinarySubmitter{}
+	}
+	return multipartSubmitter{}
+}
+
+type multipartSubmitter struct{}
+
+func (multipartSubmitter) encode(target string, form submitForm) (submitRequest, error) {
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+	if err := writer.WriteField("callee_number", form.calleeNumber); err != nil {
+		return submitRequest{}, err
+	}
+	if err := writer.WriteField("caller_number", form.callerNumber); err != nil {
+		return submitRequest{}, err
+	}
+	partFilename, partType, err := createDocumentPart(writer, form.pdfFile, form.hylaJobID, form.data)
+	if err != nil {
+		return submitRequest{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return submitRequest{}, err
+	}
+	return submitRequest{
+		method:       http.MethodPost,
+		url:          target,
+		contentType:  writer.FormDataContentType(),
+		body:         b.Bytes(),
+		partFilename: partFilename,
+		partType:     partType,
+	}, nil
+}
+
+type putBinarySubmitter struct{}
+
+func (putBinarySubmitter) encode(target string, form submitForm) (submitRequest, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return submitRequest{}, err
+	}
+	q := u.Query()
+	q.Set("source", form.callerNumber)
+	q.Set("destination", form.calleeNumber)
+	u.RawQuery = q.Encode()
+	contentType := sniffDocumentType(form.data)
+	return submitRequest{
+		method:      http.MethodPut,
+		url:         u.String(),
+		contentType: contentType,
+		body:        form.data,
+		partType:    contentType,
+	}, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// capturedRequest is what the send webhook received.
+type capturedRequest struct {
+	method, path, query, contentType string
+	body                             []byte
+}
+
+func TestSubmitWireFormat(t *testing.T) {
+	pdf, err := os.ReadFile(filepath.Join("testdata", "pages", "one-page.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiff, err := os.ReadFile(filepath.Join("testdata", "pages", "two-pages.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		protocol string // SEND_PROTOCOL
+		query    string // already on SEND_WEBHOOK_URL
+		doc      []byte
+		docType  string
+		method   string
+		wantURL  string // path and query the webhook sees
+		filename string // filename parameters of the file part
+	}{
+		{name: "multipart PDF", protocol: sendProtocolMultipart, doc: pdf, docType: contentTypePDF,
+			method: "POST", wantURL: "/send", filename: `filename="fax0001.pdf"`},
+		{name: "multipart TIFF", protocol: sendProtocolMultipart, doc: tiff, docType: contentTypeTIFF,
+			method: "POST", wantURL: "/send", filename: `filename="fax0001.tif"; filename*=UTF-8''fax0001.pdf`},
+		{name: "put-binary PDF", protocol: sendProtocolPutBinary, doc: pdf, docType: contentTypePDF,
+			method: "PUT", wantURL: "/send?destination=%2B16045551234&source=6045550100"},
+		{name: "put-binary TIFF", protocol: sendProtocolPutBinary, doc: tiff, docType: contentTypeTIFF,
+			method: "PUT", wantURL: "/send?destination=%2B16045551234&source=6045550100"},
+		{name: "put-binary keeps the URL's query", protocol: sendProtocolPutBinary, query: "?key=abc", doc: pdf, docType: contentTypePDF,
+			method: "PUT", wantURL: "/send?destination=%2B16045551234&key=abc&source=6045550100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(chan capturedRequest, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				got <- capturedRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery,
+					contentType: r.Header.Get("Content-Type"), body: body}
+				fmt.Fprint(w, `{"job_uuid":"job-uuid"}`)
+			}))
+			defer server.Close()
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL + "/send" + tt.query,
+				"SEND_WEBHOOK_RETRIES": "1", "SEND_PROTOCOL": tt.protocol})
+			dir := cfg.FTPRoot + FaxDir
+			pdfPath := filepath.Join(dir, "fax0001.pdf")
+			writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+			writeTestFile(t, pdfPath, string(tt.doc))
+
+			if _, err := deliverFax("+16045551234", "", "fax0001.pdf", pdfPath, "fax0001.sfc", "", "fax0001", "42", 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			req := <-got
+			gotURL := req.path
+			if req.query != "" {
+				gotURL += "?" + req.query
+			}
+			if req.method != tt.method || gotURL != tt.wantURL {
+				t.Errorf("request %s %s, want %s %s", req.method, gotURL, tt.method, tt.wantURL)
+			}
+
+			if tt.protocol == sendProtocolPutBinary {
+				if req.contentType != tt.docType {
+					t.Errorf("Content-Type %q, want %q", req.contentType, tt.docType)
+				}
+				if string(req.body) != string(tt.doc) {
+					t.Errorf("body is %d bytes, want the %d-byte document", len(req.body), len(tt.doc))
+				}
+				return
+			}
+			mediaType, params, err := mime.ParseMediaType(req.contentType)
+			if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+				t.Fatalf("Content-Type %q, want multipart/form-data with a boundary", req.contentType)
+			}
+			b := params["boundary"]
+			want := "--" + b + "\r\n" +
+				"Content-Disposition: form-data; name=\"callee_number\"\r\n\r\n+16045551234\r\n" +
+				"--" + b + "\r\n" +
+				"Content-Disposition: form-data; name=\"caller_number\"\r\n\r\n6045550100\r\n" +
+				"--" + b + "\r\n" +
+				"Content-Disposition: form-data; name=\"file\"; " + tt.filename + "\r\n" +
+				"Content-Type: " + tt.docType + "\r\n\r\n" + string(tt.doc) + "\r\n" +
+				"--" + b + "--\r\n"
+			if string(req.body) != want {
+				t.Errorf("body\n%q\nwant\n%q", req.body, want)
+			}
+		})
+	}
+}
+
+// TestSubmitProtocolMarkers checks that both protocols leave the same .sts
+// and .fail files.
+func TestSubmitProtocolMarkers(t *testing.T) {
+	tests := []struct {
+		status int
+		state  string
+		sts    string
+		fail   bool
+	}{
+		{status: 200, state: stsStateSleeping, sts: "Sent to WebHook"},
+		{status: 400, state: stsStateFailed, sts: "failed: send webhook returned 400 Bad Request", fail: true},
+		{status: 503, state: stsStateFailed, sts: "failed: send webhook returned 503 Service Unavailable", fail: true},
+	}
+	for _, protocol := range []string{sendProtocolMultipart, sendProtocolPutBinary} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s %d", protocol, tt.status), func(t *testing.T) {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tt.status)
+					fmt.Fprint(w, `{"job_uuid":"job-uuid"}`)
+				}))
+				defer server.Close()
+				cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL,
+					"SEND_WEBHOOK_RETRIES": "1", "SEND_PROTOCOL": protocol})
+				dir := cfg.FTPRoot + FaxDir
+				pdfPath := filepath.Join(dir, "fax0001.pdf")
+				writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+				writeTestFile(t, pdfPath, "%PDF-1.4\n")
+
+				_, err := deliverFax("+16045551234", "", "fax0001.pdf", pdfPath, "fax0001.sfc", "", "fax0001", "42", 1, 0)
+				if (err != nil) != tt.fail {
+					t.Errorf("err = %v, want failure %v", err, tt.fail)
+				}
+				if got := fileExists(filepath.Join(dir, "q42.fail")); got != tt.fail {
+					t.Errorf("q42.fail exists = %v, want %v", got, tt.fail)
+				}
+				if sts := stsFields(t, "42"); sts["state"] != tt.state || sts["status"] != tt.sts {
+					t.Errorf(".sts state %q status %q, want %q %q", sts["state"], sts["status"], tt.state, tt.sts)
+				}
+			})
+		}
+	}
+}
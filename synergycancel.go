@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Synergy cancels a fax by deleting its .sfc, or in some versions by writing
+// q<jobid>.kill. Either cancels the job like DELETE /jobs/{id}: a job still
+// waiting here is taken out and gets a .cancelled with "cancelled by
+// Synergy", and a job being submitted is stopped. A job the provider has
+// accepted is cancelled there with a request to SEND_CANCEL_URL, if set; when
+// the provider agrees the job is cancelled, otherwise it carries on and the
+// refusal is logged and kept in its status history. An .sfc still waiting for
+// its PDF is cancelled the same way. Removing the .sfc of a finished job does
+// nothing, and neither do the service's own removals, which come after the
+// .done, .fail or .cancelled.
+
+const synergyCancelReason = "cancelled by Synergy"
+
+// sfcRemoved handles an .sfc that disappeared from a queue directory.
+func sfcRemoved(path string) {
+	cache.Lock()
+	for key, entry := range cache.sfc {
+		if entry.sfcFile == path {
+			delete(cache.sfc, key)
+			releaseHold(holdPdfWait, key)
+			cache.Unlock()
+			slog.Info(".sfc waiting for its PDF was removed; cancelling it", "job_id", entry.hylaJobID, "file", path, "pdf", key)
+			recordCancelledJob(entry.hylaJobID, synergyCancelReason)
+			return
+		}
+	}
+	cache.Unlock()
+
+	hylaJobID := sfcJobID(path)
+	if hylaJobID == "" || jobFinished(hylaJobID) {
+		slog.Debug("Removed .sfc belongs to no pending job", "file", path, "job_id", hylaJobID)
+		return
+	}
+	slog.Info("Synergy removed the .sfc of a pending job; cancelling it", "job_id", hylaJobID, "file", path)
+	cancelFromSynergy(hylaJobID)
+}
+
+// handleKillFile cancels the job a q<jobid>.kill file names, and removes it.
+func handleKillFile(path string) {
+	defer os.Remove(path)
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	hylaJobID := strings.TrimPrefix(name, "q")
+	if hylaJobID == "" || strings.Trim(hylaJobID, "0123456789") != "" {
+		slog.Warn("Ignoring .kill file that names no job ID", "file", path)
+		return
+	}
+	if jobFinished(hylaJobID) {
+		slog.Info("Fax job named by .kill file has already finished; nothing to cancel", "job_id", hylaJobID, "file", path)
+		return
+	}
+	slog.Info("Synergy asked to cancel fax job", "job_id", hylaJobID, "file", path)
+	cancelFromSynergy(hylaJobID)
+}
+
+func cancelFromSynergy(hylaJobID string) {
+	outcome, err := cancelJob(hylaJobID, synergyCancelReason)
+	switch outcome {
+	case cancelNotPending:
+		slog.Info("Fax job is not pending; nothing to cancel", "job_id", hylaJobID)
+	case cancelRefused:
+		slog.Warn("The provider did not cancel the fax job; it carries on", "job_id", hylaJobID, "err", err)
+	}
+}
+
+// sfcJobID returns the Hylafax job ID issued for the .sfc at path: from the
+// .jobid next to it, or failing that from the jobs held in memory.
+func sfcJobID(path string) string {
+	jobIDPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".jobid"
+	if data, err := os.ReadFile(jobIDPath); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id
+		}
+	}
+	name := filepath.Base(path)
+	outboundQueue.Lock()
+	for _, item := range outboundQueue.items {
+		if item.SfcFileName == name {
+			outboundQueue.Unlock()
+			return item.HylaJobID
+		}
+	}
+	outboundQueue.Unlock()
+	scheduled.Lock()
+	for id, job := range scheduled.jobs {
+		if job.SfcFileName == name {
+			scheduled.Unlock()
+			return id
+		}
+	}
+	scheduled.Unlock()
+	approvals.Lock()
+	for id, job := range approvals.pending {
+		if job.SfcFileName == name {
+			approvals.Unlock()
+			return id
+		}
+	}
+	approvals.Unlock()
+	jobQueue.Lock()
+	defer jobQueue.Unlock()
+	for _, job := range jobQueue.entries {
+		if job.sfcPath == path {
+			return job.hylaJobID
+		}
+	}
+	return ""
+}
+
+// jobFinished reports whether the job's .done, .fail or .cancelled has been written.
+func jobFinished(hylaJobID string) bool {
+	for _, ext := range []string{".done", ".fail", ".cancelled"} {
+		if fileExists(jobFile(hylaJobID, "q"+hylaJobID+ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cancelSubmittedJob asks the provider to cancel every dial of hylaJobID it
+// has accepted. A dial it cancels is failed with reason. It reports
+// cancelNotPending when no dial is with the provider or SEND_CANCEL_URL is
+// not set.
+func cancelSubmittedJob(hylaJobID, reason string) (cancelOutcome, error) {
+	jobQueue.Lock()
+	dials := make(map[string]jobQ)
+	for jobUUID, job := range jobQueue.entries {
+		if job.hylaJobID == hylaJobID {
+			dials[jobUUID] = job
+		}
+	}
+	jobQueue.Unlock()
+	if len(dials) == 0 {
+		return cancelNotPending, nil
+	}
+	if config().SendCancelURL == "" {
+		slog.Info("Fax job is with the provider and SEND_CANCEL_URL is not set; it cannot be cancelled", "job_id", hylaJobID)
+		return cancelNotPending, nil
+	}
+
+	var errs []error
+	for jobUUID, job := range dials {
+		if err := requestProviderCancel(jobUUID, job); err != nil {
+			errs = append(errs, err)
+			noteJobStatus(hylaJobID, "cancel not accepted: "+err.Error(), statusSourceManual)
+			continue
+		}
+		jobQueue.Lock()
+		_, waiting := jobQueue.entries[jobUUID]
+		delete(jobQueue.entries, jobUUID)
+		jobQueue.Unlock()
+		if !waiting {
+			continue // its result arrived meanwhile
+		}
+		markNotifyResolved(jobUUID)
+		slog.Info("Provider cancelled fax job", "job_id", hylaJobID, "uuid", jobUUID, "reason", reason)
+		if job.broadcastIndex > 0 {
+			jobsCancelled.Add(1)
+			resolveBroadcastDestination(hylaJobID, job.broadcastIndex-1, false, reason)
+			continue
+		}
+		recordCancelledJob(hylaJobID, reason, job.sfcPath, job.pdfPath)
+	}
+	saveState()
+	if len(errs) > 0 {
+		return cancelRefused, errors.Join(errs...)
+	}
+	return cancelUpstream, nil
+}
+
+// requestProviderCancel sends SEND_CANCEL_URL for one accepted dial, with the
+// credentials of the route it was sent on.
+func requestProviderCancel(jobUUID string, job jobQ) error {
+	cfg := config()
+	route, ok := routeNamed(job.route)
+	if !ok {
+		route, _ = routeNamed(defaultRouteName)
+	}
+	target := strings.NewReplacer(
+		"{url}", strings.TrimSuffix(route.URL, "/"),
+		"{job_uuid}", url.PathEscape(jobUUID),
+		"{call_uuid}", url.PathEscape(job.callUUID),
+		"{jobid}", url.PathEscape(job.hylaJobID),
+	).Replace(cfg.SendCancelURL)
+	req, err := http.NewRequest(cfg.SendCancelMethod, target, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: sendTransport(), Timeout: cfg.SendWebhookTimeout}
+	resp, _, err := route.do(client, req, nil, job.hylaJobID)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	slog.Debug("Cancel response", "job_id", job.hylaJobID, "uuid", jobUUID, "status", resp.Status, "body", string(body))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("cancel URL returned %s", resp.Status)
+	}
+	return nil
+}
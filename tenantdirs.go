@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// RECEIVE_TENANT_MAP puts the received faxes of some tenants or numbers in
+// their own queue folder under FTP_ROOT, for a Synergy server that hosts
+// several companies. The file is a JSON array of entries:
+//
+//	[{"tenant_id": 12, "dir": "clinic-a/synergyfaxq"},
+//	 {"number": "6045550100", "dir": "clinic-b/synergyfaxq"}]
+//
+// A number entry (digits only, a leading country code optional) matching
+// the number the fax was sent to comes before a tenant entry matching its
+// dst_tenant_id. The PDF and .recv both go to the entry's folder, which is
+// created if need be; faxes no entry matches go to /synergyfaxq as before.
+// The file is re-read on SIGHUP.
+
+type tenantDir struct {
+	Number   string `json:"number,omitempty"`
+	TenantID int    `json:"tenant_id,omitempty"`
+	Dir      string `json:"dir"` // relative to FTP_ROOT
+}
+
+var tenantDirs = struct {
+	sync.Mutex
+	entries []tenantDir
+}{}
+
+// loadTenantMap reads RECEIVE_TENANT_MAP, if set. On error the map in effect
+// is kept.
+func loadTenantMap() error {
+	path := config().ReceiveTenantMap
+	if path == "" {
+		tenantDirs.Lock()
+		tenantDirs.entries = nil
+		tenantDirs.Unlock()
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	var entries []tenantDir
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		e.Number = digitsOnly(e.Number)
+		if (e.Number == "") == (e.TenantID == 0) {
+			return fmt.Errorf("%s: entry %d needs either a number or a tenant_id", path, i+1)
+		}
+		dir := filepath.Clean(strings.Trim(e.Dir, "/"))
+		if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+			return fmt.Errorf("%s: entry %d: dir %q must be a folder under FTP_ROOT", path, i+1, e.Dir)
+		}
+		e.Dir = dir
+	}
+
+	tenantDirs.Lock()
+	tenantDirs.entries = entries
+	tenantDirs.Unlock()
+	slog.Info("Loaded receive tenant map", "entries", len(entries), "file", path)
+	return nil
+}
+
+// receiveDir returns the queue folder for a fax sent to number or tenantID,
+// creating it if need be, and the RECEIVE_TENANT_MAP folder it came from, ""
+// for the default queue directory.
+func receiveDir(number string, tenantID int) (dir, tenant string, err error) {
+	tenant = matchTenantDir(digitsOnly(number), tenantID)
+	if tenant == "" {
+		return config().FTPRoot + FaxDir, "", nil
+	}
+	dir = filepath.Join(config().FTPRoot, tenant)
+	return dir, tenant, makeQueueDir(dir)
+}
+
+func matchTenantDir(number string, tenantID int) string {
+	tenantDirs.Lock()
+	defer tenantDirs.Unlock()
+	if number != "" {
+		for _, e := range tenantDirs.entries {
+			if e.Number != "" && sameNumber(e.Number, number) {
+				return e.Dir
+			}
+		}
+	}
+	if tenantID != 0 {
+		for _, e := range tenantDirs.entries {
+			if e.Number == "" && e.TenantID == tenantID {
+				return e.Dir
+			}
+		}
+	}
+	return ""
+}
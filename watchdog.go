@@ -0,0 +1,57 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"time"
+)
+
+// If the provider accepts a submission and then never notifies, the job
+// would stay queued and show as pending in Synergy forever. The watchdog
+// fails jobs that have waited longer than JOB_TIMEOUT. It takes the job out
+// of jobQueue under the same lock as takeOutboundJob, so a job is completed
+// either by its notify or by the watchdog, never both; a notify arriving
+// after the timeout finds no job and is buffered until it expires.
+
+var jobsTimedOut = expvar.NewInt("jobs_timed_out")
+
+// startJobWatchdog checks jobQueue for timed-out jobs every minute.
+func startJobWatchdog() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			failTimedOutJobs(config().JobTimeout)
+		}
+	}()
+}
+
+func failTimedOutJobs(timeout time.Duration) {
+	type timedOut struct {
+		jobUUID string
+		job     jobQ
+	}
+	var expired []timedOut
+
+	jobQueue.Lock()
+	for jobUUID, job := range jobQueue.entries {
+		if time.Since(job.acceptedAt) > timeout {
+			delete(jobQueue.entries, jobUUID)
+			expired = append(expired, timedOut{jobUUID, job})
+		}
+	}
+	jobQueue.Unlock()
+
+	for _, t := range expired {
+		jobsTimedOut.Add(1)
+		slog.Warn("Fax job got no notify within JOB_TIMEOUT; marking failed", "uuid", t.jobUUID, "job_id", t.job.hylaJobID, "timeout", timeout)
+		recordDeliveryOutcome(false, false, 0)
+		if t.job.broadcastIndex > 0 {
+			resolveBroadcastDestination(t.job.hylaJobID, t.job.broadcastIndex-1, false, "failed: timeout waiting for result")
+			continue
+		}
+		slaJobCompleted(t.job.hylaJobID, false)
+		deadLetterJob(t.job.hylaJobID, "failed: timeout waiting for result", "", t.job.sfcPath, t.job.pdfPath)
+	}
+	if len(expired) > 0 {
+		saveState()
+	}
+}
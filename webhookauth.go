@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/kataras/iris/v12"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// The provider webhooks can require a bearer token and/or HTTP basic
+// credentials. /fax-notify uses NOTIFY_AUTH_TOKEN and NOTIFY_BASIC_USER/PASS;
+// /fax-receive uses RECEIVE_AUTH_TOKEN and RECEIVE_BASIC_USER/PASS, or the
+// NOTIFY_ settings when none of its own are set. With nothing configured the
+// endpoint is open, as before.
+
+// webhookAuth holds the credentials accepted on one endpoint. Either kind may
+// be used when both are set.
+type webhookAuth struct {
+	token    string
+	user     string
+	password string
+}
+
+func (a webhookAuth) configured() bool {
+	return a.token != "" || a.user != ""
+}
+
+// describe names the accepted kinds for the startup log.
+func (a webhookAuth) describe() string {
+	var kinds []string
+	if a.token != "" {
+		kinds = append(kinds, "bearer token")
+	}
+	if a.user != "" {
+		kinds = append(kinds, "basic auth")
+	}
+	return strings.Join(kinds, " or ")
+}
+
+func notifyAuth() webhookAuth {
+	return webhookAuth{token: config().NotifyAuthToken, user: config().NotifyBasicUser, password: config().NotifyBasicPass}
+}
+
+func receiveAuth() webhookAuth {
+	if auth := (webhookAuth{token: config().ReceiveAuthToken, user: config().ReceiveBasicUser, password: config().ReceiveBasicPass}); auth.configured() {
+		return auth
+	}
+	return notifyAuth()
+}
+
+// check reports whether the request carries accepted credentials.
+func (a webhookAuth) check(r *http.Request) bool {
+	_, ok := a.authenticate(r)
+	return ok
+}
+
+// authenticate reports whether the request carries accepted credentials, and
+// the basic auth user they name; the user is empty for the bearer token.
+func (a webhookAuth) authenticate(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if a.token != "" && len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		if subtle.ConstantTimeCompare([]byte(header[len("Bearer "):]), []byte(a.token)) == 1 {
+			return "", true
+		}
+	}
+	if a.user != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+			passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+			if userOK && passwordOK {
+				return a.user, true
+			}
+		}
+	}
+	return "", false
+}
+
+// apply adds the credentials to an outgoing request, for the replay tool.
+func (a webhookAuth) apply(req *http.Request) {
+	switch {
+	case a.token != "":
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case a.user != "":
+		req.SetBasicAuth(a.user, a.password)
+	}
+}
+
+// requireWebhookAuth rejects requests to endpoint without the credentials
+// currently returned by auth, which change when the configuration is reloaded.
+func requireWebhookAuth(endpoint string, auth func() webhookAuth) iris.Handler {
+	if current := auth(); current.configured() {
+		slog.Info("Webhook requires authentication", "endpoint", endpoint, "accepts", current.describe())
+	} else {
+		slog.Warn("Webhook accepts unauthenticated requests", "endpoint", endpoint)
+	}
+	return func(ctx iris.Context) {
+		auth := auth()
+		if !auth.configured() {
+			ctx.Next()
+			return
+		}
+		if !auth.check(ctx.Request()) {
+			if auth.user != "" {
+				ctx.Header("WWW-Authenticate", `Basic realm="synergymattersfax"`)
+			}
+			rejectWebhook(ctx, iris.StatusUnauthorized, "missing or invalid credentials")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// When WEBHOOK_HMAC_SECRET is set, both webhooks must carry the hex
+// HMAC-SHA256 of the raw body (optionally prefixed "sha256=") in
+// WEBHOOK_HMAC_HEADER (default X-Signature). /fax-notify bodies are checked
+// before they are parsed. /fax-receive bodies are hashed as they stream to a
+// staged file and checked before that file is renamed into the queue.
+
+const maxSignedNotifyBytes = 10 << 20
+
+// signedBodyKey is the context key of a /fax-receive body being hashed.
+const signedBodyKey = "signedBody"
+
+var errBadSignature = errors.New("invalid webhook signature")
+
+// requestSignature decodes the signature header of r.
+func requestSignature(r *http.Request) ([]byte, error) {
+	value := strings.TrimSpace(r.Header.Get(config().WebhookHMACHeader))
+	if value == "" {
+		return nil, errors.New("missing " + config().WebhookHMACHeader + " header")
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(value, "sha256="))
+	if err != nil {
+		return nil, errBadSignature
+	}
+	return sig, nil
+}
+
+// signWebhookBody sets the signature header for body on req when
+// WEBHOOK_HMAC_SECRET is set, for the replay tool.
+func signWebhookBody(req *http.Request, body []byte) {
+	secret := config().WebhookHMACSecret
+	if secret == "" {
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	req.Header.Set(config().WebhookHMACHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// signedBody hashes a request body as it is read.
+type signedBody struct {
+	io.ReadCloser
+	mac       hash.Hash
+	signature []byte
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mac.Write(p[:n])
+	return n, err
+}
+
+// verify reads the rest of the body, which after a parsed document is at
+// most trailing whitespace or a multipart epilogue, and checks the signature
+// over all of it.
+func (b *signedBody) verify() error {
+	if n, err := io.Copy(io.Discard, io.LimitReader(b, 1<<20)); err != nil {
+		return err
+	} else if n == 1<<20 {
+		return errors.New("unexpected data after the fax document")
+	}
+	if !hmac.Equal(b.mac.Sum(nil), b.signature) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// requireWebhookSignature checks the body signature when WEBHOOK_HMAC_SECRET
+// is set. With streamed, the check is left to the handler, which calls
+// verifyStreamedSignature once it has read the body.
+func requireWebhookSignature(streamed bool) iris.Handler {
+	return func(ctx iris.Context) {
+		secret := config().WebhookHMACSecret
+		if secret == "" {
+			ctx.Next()
+			return
+		}
+		signature, err := requestSignature(ctx.Request())
+		if err != nil {
+			rejectWebhook(ctx, iris.StatusUnauthorized, err.Error())
+			return
+		}
+		body := &signedBody{ReadCloser: ctx.Request().Body, mac: hmac.New(sha256.New, []byte(secret)), signature: signature}
+		if streamed {
+			ctx.Request().Body = body
+			ctx.Values().Set(signedBodyKey, body)
+			ctx.Next()
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(body, maxSignedNotifyBytes+1))
+		if err != nil || len(data) > maxSignedNotifyBytes {
+			rejectWebhook(ctx, iris.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		if !hmac.Equal(body.mac.Sum(nil), signature) {
+			rejectWebhook(ctx, iris.StatusUnauthorized, errBadSignature.Error())
+			return
+		}
+		ctx.Request().Body = io.NopCloser(bytes.NewReader(data))
+		ctx.Next()
+	}
+}
+
+// verifyStreamedSignature checks the signature of a body wrapped by
+// requireWebhookSignature(true); it passes when signatures are not required.
+func verifyStreamedSignature(ctx iris.Context) error {
+	body, ok := ctx.Values().Get(signedBodyKey).(*signedBody)
+	if !ok {
+		return nil
+	}
+	return body.verify()
+}
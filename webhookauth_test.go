@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// webhookRequest returns a valid request to the /fax-receive or /fax-notify
+// endpoint.
+func webhookRequest(endpoint string) *http.Request {
+	if endpoint == "/fax-receive" {
+		req := httptest.NewRequest("POST", "/fax-receive?uuid=00000000-0000-0000-0000-0123456789ab&cidnum=6045551234", strings.NewReader("%PDF-1.4\n"))
+		req.Header.Set("Content-Type", contentTypePDF)
+		return req
+	}
+	req := httptest.NewRequest("POST", "/fax-notify", strings.NewReader(`{"fax_job_results":{"results":{}}}`))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestWebhookAuth(t *testing.T) {
+	notifyOnly := map[string]string{"NOTIFY_AUTH_TOKEN": "n-token", "NOTIFY_BASIC_USER": "notify", "NOTIFY_BASIC_PASS": "n-pass"}
+	both := map[string]string{"NOTIFY_AUTH_TOKEN": "n-token", "NOTIFY_BASIC_USER": "notify", "NOTIFY_BASIC_PASS": "n-pass",
+		"RECEIVE_AUTH_TOKEN": "r-token", "RECEIVE_BASIC_USER": "receive", "RECEIVE_BASIC_PASS": "r-pass"}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(user, pass string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+	}
+	tests := []struct {
+		name     string
+		endpoint string
+		env      map[string]string
+		auth     func(*http.Request) // nil sends no credentials
+		status   int
+	}{
+		{name: "open notify", endpoint: "/fax-notify", status: 200},
+		{name: "open receive", endpoint: "/fax-receive", status: 200},
+		{name: "notify missing", endpoint: "/fax-notify", env: notifyOnly, status: 401},
+		{name: "notify wrong token", endpoint: "/fax-notify", env: notifyOnly, auth: bearer("x-token"), status: 401},
+		{name: "notify wrong password", endpoint: "/fax-notify", env: notifyOnly, auth: basic("notify", "x"), status: 401},
+		{name: "notify wrong user", endpoint: "/fax-notify", env: notifyOnly, auth: basic("x", "n-pass"), status: 401},
+		{name: "notify token", endpoint: "/fax-notify", env: notifyOnly, auth: bearer("n-token"), status: 200},
+		{name: "notify lower-case scheme", endpoint: "/fax-notify", env: notifyOnly,
+			auth: func(r *http.Request) { r.Header.Set("Authorization", "bearer n-token") }, status: 200},
+		{name: "notify basic", endpoint: "/fax-notify", env: notifyOnly, auth: basic("notify", "n-pass"), status: 200},
+		{name: "receive falls back to notify", endpoint: "/fax-receive", env: notifyOnly, auth: bearer("n-token"), status: 200},
+		{name: "receive missing", endpoint: "/fax-receive", env: both, status: 401},
+		{name: "receive with notify token", endpoint: "/fax-receive", env: both, auth: bearer("n-token"), status: 401},
+		{name: "receive token", endpoint: "/fax-receive", env: both, auth: bearer("r-token"), status: 200},
+		{name: "receive basic", endpoint: "/fax-receive", env: both, auth: basic("receive", "r-pass"), status: 200},
+		{name: "notify with receive token", endpoint: "/fax-notify", env: both, auth: bearer("r-token"), status: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			useTestRecvFormat(t, env)
+			req := webhookRequest(tt.endpoint)
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+
+			rec := serveTestRequest(t, registerProviderRoutes, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != 401 {
+				return
+			}
+			var body apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+				t.Errorf("body %q is not a JSON error", rec.Body)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); !strings.HasPrefix(challenge, "Basic ") {
+				t.Errorf("WWW-Authenticate %q, want a Basic challenge", challenge)
+			}
+		})
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	tests := []struct {
+		name      string
+		endpoint  string
+		header    string // WEBHOOK_HMAC_HEADER, if not the default
+		signature func(body string) string
+		tamper    bool   // the body is changed after signing
+		body      string // replaces the endpoint's valid body
+		status    int
+	}{
+		{name: "notify valid", endpoint: "/fax-notify", signature: func(b string) string { return sign("secret", b) }, status: 200},
+		{name: "notify prefixed", endpoint: "/fax-notify", signature: func(b string) string { return "sha256=" + sign("secret", b) }, status: 200},
+		{name: "notify custom header", endpoint: "/fax-notify", header: "X-Provider-Signature",
+			signature: func(b string) string { return sign("secret", b) }, status: 200},
+		{name: "notify tampered", endpoint: "/fax-notify", signature: func(b string) string { return sign("secret", b) }, tamper: true, status: 401},
+		{name: "notify wrong secret", endpoint: "/fax-notify", signature: func(b string) string { return sign("other", b) }, status: 401},
+		{name: "notify not hex", endpoint: "/fax-notify", signature: func(string) string { return "not-a-signature" }, status: 401},
+		{name: "notify missing", endpoint: "/fax-notify", status: 401},
+		{name: "notify missing on a malformed body", endpoint: "/fax-notify", body: "{", status: 401},
+		{name: "receive valid", endpoint: "/fax-receive", signature: func(b string) string { return sign("secret", b) }, status: 200},
+		{name: "receive tampered", endpoint: "/fax-receive", signature: func(b string) string { return sign("secret", b) }, tamper: true, status: 401},
+		{name: "receive wrong secret", endpoint: "/fax-receive", signature: func(b string) string { return sign("other", b) }, status: 401},
+		{name: "receive missing", endpoint: "/fax-receive", status: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestRecvFormat(t, map[string]string{"MIN_FREE_DISK_MB": "0", "RECEIVE_ASYNC": "false",
+				"WEBHOOK_HMAC_SECRET": "secret", "WEBHOOK_HMAC_HEADER": tt.header})
+			req := webhookRequest(tt.endpoint)
+			data, _ := io.ReadAll(req.Body)
+			body := string(data)
+			if tt.body != "" {
+				body = tt.body
+			}
+			if tt.signature != nil {
+				req.Header.Set(cfg.WebhookHMACHeader, tt.signature(body))
+			}
+			if tt.tamper {
+				body += " "
+			}
+			req.Body = io.NopCloser(strings.NewReader(body))
+			req.ContentLength = int64(len(body))
+
+			rec := serveTestRequest(t, registerProviderRoutes, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.endpoint == "/fax-receive" && tt.status != 200 {
+				entries, _ := os.ReadDir(cfg.FTPRoot + FaxDir)
+				for _, e := range entries {
+					t.Errorf("%s written for a rejected fax", e.Name())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SEND_WEBHOOK_HEADERS adds headers to every request to the send webhook,
+// submissions and cancels alike, e.g. an X-Account-ID the provider requires.
+// It holds a JSON object, {"X-Account-ID": "1234"}, or "Key: Value" lines;
+// SEND_WEBHOOK_HEADERS_FILE names a file in either form instead. Every
+// request also carries USER_AGENT and an X-Request-ID with the Hylafax job
+// ID, so the provider's logs can be matched with ours. The headers are
+// re-read on SIGHUP. Only their names are logged, with the values of those
+// that look like credentials masked.
+
+// webhookHeaders holds the headers added to send webhook requests.
+var webhookHeaders = struct {
+	sync.Mutex
+	header http.Header
+}{}
+
+// loadWebhookHeaders reads SEND_WEBHOOK_HEADERS_FILE if set, otherwise
+// SEND_WEBHOOK_HEADERS. On error the headers in effect are kept.
+func loadWebhookHeaders() error {
+	source, v := "SEND_WEBHOOK_HEADERS", config().SendWebhookHeaders
+	if path := config().SendWebhookHeadersFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", path, err)
+		}
+		source, v = path, string(data)
+	}
+	header, err := parseWebhookHeaders(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+
+	webhookHeaders.Lock()
+	webhookHeaders.header = header
+	webhookHeaders.Unlock()
+
+	if len(header) > 0 {
+		slog.Info("Send webhook headers loaded", "headers", maskedHeaders(header))
+	}
+	return nil
+}
+
+// parseWebhookHeaders parses a JSON object of header values or "Key: Value"
+// lines. Blank lines and lines starting with # are skipped.
+func parseWebhookHeaders(v string) (http.Header, error) {
+	header := make(http.Header)
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		var values map[string]string
+		if err := json.Unmarshal([]byte(v), &values); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		for name, value := range values {
+			if err := checkWebhookHeader(name, value); err != nil {
+				return nil, err
+			}
+			header.Set(name, value)
+		}
+		return header, nil
+	}
+	for i, line := range strings.Split(v, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d is not \"Key: Value\"", i+1)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if err := checkWebhookHeader(name, value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		header.Add(name, value)
+	}
+	return header, nil
+}
+
+// checkWebhookHeader reports a header that cannot be sent, or that the
+// service sets itself.
+func checkWebhookHeader(name, value string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header %s has a line break in its value", name)
+	}
+	switch textproto.CanonicalMIMEHeaderKey(name) {
+	case "Content-Type", "Content-Length", "Host", "User-Agent", "X-Request-Id":
+		return fmt.Errorf("header %s is set by the service", name)
+	}
+	return nil
+}
+
+// setWebhookHeaders adds the configured headers, the user agent and the
+// request ID to req, a request to the send webhook for hylaJobID.
+func setWebhookHeaders(req *http.Request, hylaJobID string) {
+	webhookHeaders.Lock()
+	for name, values := range webhookHeaders.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	webhookHeaders.Unlock()
+	req.Header.Set("User-Agent", config().UserAgent)
+	if hylaJobID != "" {
+		req.Header.Set("X-Request-ID", hylaJobID)
+	}
+}
+
+// maskedHeaders lists header for the log, masking the values of headers
+// that look like credentials.
+func maskedHeaders(header http.Header) []string {
+	var list []string
+	for name, values := range header {
+		for _, value := range values {
+			if sensitiveHeader(name) {
+				value = "********"
+			}
+			list = append(list, name+": "+value)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// sensitiveHeader reports whether the header name suggests a secret value.
+func sensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"auth", "token", "secret", "key", "password", "cookie", "signature", "session"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxSendWebhookBackoff caps the wait between submission attempts.
+const maxSendWebhookBackoff = time.Minute
+
+// sendWebhookBackoff is the wait before attempt+1: SEND_WEBHOOK_RETRY_BACKOFF
+// (default 2s) doubled after every attempt, capped at a minute.
+func sendWebhookBackoff(attempt int) time.Duration {
+	delay := config().SendWebhookRetryBackoff
+	for i := 1; i < attempt && delay < maxSendWebhookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxSendWebhookBackoff {
+		delay = maxSendWebhookBackoff
+	}
+	return delay
+}
+
+// retryableSubmit reports whether a submission attempt failed transiently:
+// the request did not complete (connection refused, timeout, reset), or the
+// webhook answered 5xx or 429. Other 4xx answers and failed TLS handshakes
+// are permanent and fail the job straight away.
+func retryableSubmit(resp *http.Response, err error) bool {
+	if err != nil {
+		return !isTLSHandshakeError(err)
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// maxRetryAfter caps the wait a Retry-After header can ask for.
+const maxRetryAfter = 5 * time.Minute
+
+// retryAfter returns the wait requested by resp's Retry-After header, given
+// as seconds or as an HTTP date, capped at five minutes.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d, true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Requests to the send webhook (submissions, cancels, OAuth2 tokens and the
+// /healthz probe) can present a client certificate, SEND_WEBHOOK_CLIENT_CERT
+// and SEND_WEBHOOK_CLIENT_KEY, and trust the CAs in SEND_WEBHOOK_CA_FILE
+// instead of the system's. The PEM files are checked when the configuration
+// is loaded and read again on SIGHUP. A submission whose TLS handshake fails,
+// for example because the provider rejects the certificate, fails at once
+// with "failed: TLS handshake with send webhook failed".
+// SEND_WEBHOOK_INSECURE_SKIP_VERIFY turns server verification off, for lab
+// use only.
+
+// sendTransports caches the transport built for the TLS configuration and
+// proxy, so connections are reused until either changes.
+var sendTransports = struct {
+	sync.Mutex
+	tls       *tls.Config
+	proxy     *url.URL
+	transport *http.Transport
+}{}
+
+// loadWebhookTLS builds the TLS configuration for the send webhook from the
+// settings, or returns nil when they leave the defaults.
+func loadWebhookTLS(c *Config) (*tls.Config, error) {
+	if c.SendWebhookClientCert == "" && c.SendWebhookClientKey == "" && c.SendWebhookCAFile == "" && !c.SendWebhookInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.SendWebhookInsecureSkipVerify}
+	if (c.SendWebhookClientCert == "") != (c.SendWebhookClientKey == "") {
+		return nil, errors.New("SEND_WEBHOOK_CLIENT_CERT and SEND_WEBHOOK_CLIENT_KEY must be set together")
+	}
+	if c.SendWebhookClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.SendWebhookClientCert, c.SendWebhookClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("SEND_WEBHOOK_CLIENT_CERT/KEY: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.SendWebhookCAFile != "" {
+		data, err := os.ReadFile(c.SendWebhookCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("SEND_WEBHOOK_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("SEND_WEBHOOK_CA_FILE %s holds no PEM certificates", c.SendWebhookCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// sendTransport returns the transport for requests to the send webhook.
+// Submissions go through submitTransport, which adds fault injection.
+func sendTransport() http.RoundTripper {
+	cfg := config()
+	tlsConfig, proxy := cfg.webhookTLS, cfg.outboundProxy
+	sendTransports.Lock()
+	defer sendTransports.Unlock()
+	if sendTransports.transport == nil || sendTransports.tls != tlsConfig || !sameProxy(sendTransports.proxy, proxy) {
+		if sendTransports.transport != nil {
+			sendTransports.transport.CloseIdleConnections()
+		}
+		transport := newProxiedTransport(proxy)
+		transport.TLSClientConfig = tlsConfig
+		sendTransports.tls, sendTransports.proxy, sendTransports.transport = tlsConfig, proxy, transport
+		if tlsConfig != nil && tlsConfig.InsecureSkipVerify {
+			slog.Warn("SEND_WEBHOOK_INSECURE_SKIP_VERIFY is set: the send webhook's certificate is NOT verified; use this only in a lab")
+		}
+	}
+	return sendTransports.transport
+}
+
+// isTLSHandshakeError reports whether err is a failed TLS handshake: the
+// server's certificate was not trusted, or the server refused ours.
+func isTLSHandshakeError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) || errors.As(err, &alertErr) || errors.As(err, &recordErr) ||
+		errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound jobs are submitted by a pool of OUTBOUND_CONCURRENCY workers. The
+// watcher only parses the .sfc, issues the Hylafax job ID and queues the job,
+// whose .sts reads "queued" until a worker takes it. The job ID, its .jobid
+// and the "queued" .sts are written as soon as the .sfc is parsed, even
+// while it waits for its PDF, since Synergy polls for the .jobid right after
+// uploading the .sfc; scheduled jobs join the
+// same queue when they fall due. The queue is not bounded, but when it grows
+// beyond OUTBOUND_QUEUE_WARN_DEPTH a warning is logged and counted. Workers
+// take the most urgent job first (lowest .sfc priority), oldest first within
+// a priority. Every queued job is an "outbound-queue" hold, so jobs still
+// waiting at shutdown are queued again on the next start.
+
+// outboundItem is a job waiting for a worker.
+type outboundItem struct {
+	HylaJobID   string    `json:"hyla_job_id"`
+	JobID       string    `json:"job_id"` // Synergy job ID (.sfc name without extension)
+	Sfc         SfcJob    `json:"sfc"`
+	PdfPath     string    `json:"pdf_path"`
+	SfcFileName string    `json:"sfc_file_name"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Due         bool      `json:"due,omitempty"`   // released by the scheduler; only dispatch is left
+	Dial        int       `json:"dial,omitempty"`  // the dial this is, for a redial
+	Tries       int       `json:"tries,omitempty"` // transmission attempts so far, for a redial
+}
+
+var outboundQueue = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	items   []*outboundItem
+	stopped bool
+	over    bool // depth is above OUTBOUND_QUEUE_WARN_DEPTH
+}{}
+
+var (
+	outboundQueueDepth     = expvar.NewInt("outbound_queue_depth")
+	outboundQueueOverDepth = expvar.NewInt("outbound_queue_over_depth") // times the depth crossed the warning level
+	outboundWorkersDone    sync.WaitGroup
+)
+
+func init() {
+	outboundQueue.cond = sync.NewCond(&outboundQueue.Mutex)
+}
+
+// acceptSfc issues the Hylafax job ID of a parsed .sfc and writes its .jobid
+// and a "queued" .sts; see createQueueFile. An .sfc whose .jobid is at least
+// as new as itself, as when a job waiting for its PDF is restored after a
+// restart, keeps that job ID unless the job has finished. It returns false if
+// the job cannot be accepted yet. The caller has reserved the .sfc in
+// cache.inFlight and does not hold the cache lock, which the file writes
+// here would otherwise hold up.
+func acceptSfc(entry *sfcFile) bool {
+	if err := checkDiskSpace(); err != nil {
+		slog.Error("Not accepting fax until disk space is freed", "file", entry.sfcFile, "err", err)
+		deferForDisk(entry.sfcFile)
+		return false
+	}
+	dir := filepath.Dir(entry.sfcFile)
+	jobIDPath := filepath.Join(dir, entry.jobID+".jobid")
+	if id := currentJobID(entry.sfcFile, jobIDPath); id != "" {
+		entry.hylaJobID = id
+		setJobDir(id, dir)
+		return true
+	}
+	hylaJobID, err := allocateJobID()
+	if err != nil {
+		slog.Error("Unable to send fax", "file", entry.sfcFile, "err", err)
+		return false
+	}
+	entry.hylaJobID = hylaJobID
+
+	// The job's files and status files stay in the folder its .sfc came from.
+	setJobDir(hylaJobID, dir)
+
+	// Create a .jobid file with the allocated Hylafax job ID.
+	if err := createFile(jobIDPath, hylaJobID+"\r"); err != nil {
+		slog.Error("Error creating .jobid file", "job_id", hylaJobID, "err", err)
+		// Continue even if file creation fails.
+	}
+	if err := createQueueFile(hylaJobID, *entry); err != nil {
+		slog.Error("Error creating .sts", "job_id", hylaJobID, "err", err)
+	}
+	slog.Debug("Fax job accepted", "job_id", hylaJobID, "synergy_job_id", entry.jobID, "file", entry.sfcFile)
+	return true
+}
+
+// currentJobID returns the job ID in jobIDPath when it was written for this
+// .sfc, not an earlier one of the same name, and the job has not finished.
+func currentJobID(sfcPath, jobIDPath string) string {
+	sfcInfo, err := os.Stat(sfcPath)
+	if err != nil {
+		return ""
+	}
+	info, err := os.Stat(jobIDPath)
+	if err != nil || info.ModTime().Before(sfcInfo.ModTime()) {
+		return ""
+	}
+	data, err := os.ReadFile(jobIDPath)
+	if err != nil {
+		return ""
+	}
+	id := strings.TrimSpace(string(data))
+	if id == "" || jobFinished(id) {
+		return ""
+	}
+	return id
+}
+
+// queueOutbound queues an accepted job for a worker. The caller has marked
+// the .sfc in flight and released the cache lock, since pushOutbound writes
+// the .sts and the hold.
+func queueOutbound(entry sfcFile) {
+	dir := filepath.Dir(entry.sfcFile)
+	pushOutbound(&outboundItem{
+		HylaJobID:   entry.hylaJobID,
+		JobID:       entry.jobID,
+		Sfc:         entry.SfcJob,
+		PdfPath:     filepath.Join(dir, entry.PdfFile),
+		SfcFileName: filepath.Base(entry.sfcFile),
+		QueuedAt:    time.Now(),
+	})
+}
+
+// pushOutbound adds item to the queue and records its hold. Callers must not
+// hold the cache lock.
+func pushOutbound(item *outboundItem) {
+	createStsFile(item.HylaJobID, stsStateSleeping, "", "", "queued")
+	putHold(heldJob{
+		Component: holdOutboundQueue,
+		ID:        item.HylaJobID,
+		HylaJobID: item.HylaJobID,
+		SfcPath:   jobFile(item.HylaJobID, item.SfcFileName),
+		PdfPath:   item.PdfPath,
+		Reason:    "queued for submission",
+		Release:   "a free outbound worker",
+		HeldAt:    item.QueuedAt,
+	}, item)
+
+	outboundQueue.Lock()
+	outboundQueue.items = append(outboundQueue.items, item)
+	depth := len(outboundQueue.items)
+	outboundQueueDepth.Set(int64(depth))
+	warnDepth := config().OutboundQueueWarnDepth
+	if depth > warnDepth && !outboundQueue.over {
+		outboundQueue.over = true
+		outboundQueueOverDepth.Add(1)
+		slog.Warn("Outbound queue is backing up", "depth", depth, "warn_depth", warnDepth, "workers", config().OutboundConcurrency)
+	}
+	outboundQueue.cond.Signal()
+	outboundQueue.Unlock()
+	slog.Debug("Fax job queued", "job_id", item.HylaJobID, "synergy_job_id", item.JobID, "depth", depth)
+}
+
+// restoreOutboundHold queues a job that was waiting at the last shutdown.
+func restoreOutboundHold(h heldJob) error {
+	var item outboundItem
+	if err := json.Unmarshal(h.Data, &item); err != nil {
+		return fmt.Errorf("unreadable queued job: %w", err)
+	}
+	cache.Lock()
+	cache.inFlight[item.SfcFileName] = true
+	cache.Unlock()
+	pushOutbound(&item)
+	return nil
+}
+
+// takeQueuedOutbound removes a job that no worker has taken yet.
+func takeQueuedOutbound(hylaJobID string) (*outboundItem, bool) {
+	outboundQueue.Lock()
+	var item *outboundItem
+	for i, it := range outboundQueue.items {
+		if it.HylaJobID == hylaJobID {
+			item = it
+			outboundQueue.items = append(outboundQueue.items[:i], outboundQueue.items[i+1:]...)
+			break
+		}
+	}
+	outboundQueueDepth.Set(int64(len(outboundQueue.items)))
+	outboundQueue.Unlock()
+	if item == nil {
+		return nil, false
+	}
+	releaseHold(holdOutboundQueue, hylaJobID)
+	return item, true
+}
+
+// startOutboundWorkers starts OUTBOUND_CONCURRENCY workers.
+func startOutboundWorkers() {
+	n := config().OutboundConcurrency
+	for i := 0; i < n; i++ {
+		outboundWorkersDone.Add(1)
+		go outboundWorker()
+	}
+	slog.Info("Outbound workers started", "workers", n)
+}
+
+// stopOutboundWorkers stops workers from taking new jobs and waits for them
+// to return; jobs in progress are tracked by drainPipeline. Jobs still
+// queued stay on record as holds.
+func stopOutboundWorkers() {
+	outboundQueue.Lock()
+	outboundQueue.stopped = true
+	outboundQueue.cond.Broadcast()
+	left := len(outboundQueue.items)
+	outboundQueue.Unlock()
+	outboundWorkersDone.Wait()
+	if left > 0 {
+		slog.Info("Queued fax jobs will be resumed on the next start", "jobs", left)
+	}
+}
+
+func outboundWorker() {
+	defer outboundWorkersDone.Done()
+	for {
+		item := nextOutbound()
+		if item == nil {
+			return
+		}
+		func() {
+			defer submissions.Done()
+			releaseHold(holdOutboundQueue, item.HylaJobID)
+			submitQueuedFax(item)
+		}()
+	}
+}
+
+// nextOutbound waits for the most urgent queued job. It returns nil once the
+// workers are stopped. The job is counted in submissions before the queue is
+// unlocked, so drainPipeline cannot miss it.
+func nextOutbound() *outboundItem {
+	outboundQueue.Lock()
+	defer outboundQueue.Unlock()
+	for len(outboundQueue.items) == 0 && !outboundQueue.stopped {
+		outboundQueue.cond.Wait()
+	}
+	if outboundQueue.stopped {
+		return nil
+	}
+	best := 0
+	for i, it := range outboundQueue.items {
+		b := outboundQueue.items[best]
+		if it.Sfc.Priority < b.Sfc.Priority || it.Sfc.Priority == b.Sfc.Priority && it.QueuedAt.Before(b.QueuedAt) {
+			best = i
+		}
+	}
+	item := outboundQueue.items[best]
+	outboundQueue.items = append(outboundQueue.items[:best], outboundQueue.items[best+1:]...)
+	depth := len(outboundQueue.items)
+	outboundQueueDepth.Set(int64(depth))
+	if outboundQueue.over && depth <= config().OutboundQueueWarnDepth {
+		outboundQueue.over = false
+		slog.Info("Outbound queue is back under its warning depth", "depth", depth)
+	}
+	submissions.Add(1)
+	return item
+}
+
+// submitQueuedFax submits a job taken from the queue.
+func submitQueuedFax(item *outboundItem) {
+	var fax string
+	var err error
+	if item.Dial > 1 {
+		fax, err = redialFax(item)
+	} else if item.Due {
+		fax, err = dispatchFax(item.Sfc, item.PdfPath, item.SfcFileName, item.JobID, item.HylaJobID)
+	} else {
+		fax, err = submitFax(item.Sfc, item.PdfPath, item.SfcFileName, item.JobID, item.HylaJobID)
+	}
+	if errors.Is(err, errAwaitingApproval) {
+		// Stays in flight until the approval decision releases it.
+		slog.Info("Fax is awaiting approval", "job_id", item.HylaJobID, "number", item.Sfc.FaxNumber)
+		return
+	}
+	if errors.Is(err, errScheduled) {
+		// Stays in flight until the scheduler releases it.
+		return
+	}
+	releaseInFlight(item.SfcFileName)
+	if errors.Is(err, errJobCancelled) {
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to send fax", "job_id", item.HylaJobID, "file", jobFile(item.HylaJobID, item.SfcFileName), "err", err)
+		return
+	}
+	slog.Info("Fax submitted", "job_id", item.HylaJobID, "file", jobFile(item.HylaJobID, item.SfcFileName), "uuid", fax)
+}
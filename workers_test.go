@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcceptSfc(t *testing.T) {
+	tests := []struct {
+		name    string
+		jobID   string // existing .jobid content, if any
+		jobIDAt time.Duration
+		done    bool // the existing job has a .done
+		reuse   bool
+	}{
+		{name: "new .sfc"},
+		{name: "restored .sfc keeps its job ID", jobID: "42", jobIDAt: time.Second, reuse: true},
+		{name: ".jobid of an earlier .sfc", jobID: "42", jobIDAt: -time.Hour},
+		{name: ".jobid of a finished job", jobID: "42", jobIDAt: time.Second, done: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			sfcPath := filepath.Join(dir, "fax0001.sfc")
+			writeTestFile(t, sfcPath, "6045551234\nfax0001.pdf\n")
+			now := time.Now()
+			os.Chtimes(sfcPath, now, now)
+			if tt.jobID != "" {
+				writeTestFile(t, filepath.Join(dir, "fax0001.jobid"), tt.jobID+"\r")
+				os.Chtimes(filepath.Join(dir, "fax0001.jobid"), now.Add(tt.jobIDAt), now.Add(tt.jobIDAt))
+			}
+			if tt.done {
+				writeTestFile(t, filepath.Join(dir, "q"+tt.jobID+".done"), "")
+			}
+
+			entry := sfcFile{SfcJob: SfcJob{FaxNumber: "6045551234", PdfFile: "fax0001.pdf", Priority: defaultSfcPriority},
+				jobID: "fax0001", sfcFile: sfcPath}
+			if !acceptSfc(&entry) {
+				t.Fatal("acceptSfc() = false")
+			}
+			if got := entry.hylaJobID == tt.jobID; got != tt.reuse {
+				t.Errorf("job ID %q, reused = %v, want %v", entry.hylaJobID, got, tt.reuse)
+			}
+			if tt.reuse {
+				return
+			}
+			if got := readTestFile(t, filepath.Join(dir, "fax0001.jobid")); got != entry.hylaJobID+"\r" {
+				t.Errorf(".jobid = %q, want %q", got, entry.hylaJobID+"\r")
+			}
+			sts := stsFields(t, entry.hylaJobID)
+			if sts["state"] != stsStateSleeping || sts["status"] != "queued" {
+				t.Errorf(".sts state %q status %q, want %q and queued", sts["state"], sts["status"], stsStateSleeping)
+			}
+		})
+	}
+}
+
+func TestHandleSfcFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		pdf      bool // the PDF is already uploaded
+		inFlight bool // the .sfc is already being handled
+		queued   bool
+		waiting  bool
+	}{
+		{name: "PDF uploaded first", pdf: true, queued: true},
+		{name: "PDF not uploaded yet", waiting: true},
+		{name: "repeated event", pdf: true, inFlight: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			sfcPath := filepath.Join(dir, "fax0001.sfc")
+			writeTestFile(t, sfcPath, "6045551234\nfax0001.pdf\n")
+			if tt.pdf {
+				writeTestFile(t, filepath.Join(dir, "fax0001.pdf"), "%PDF-1.4\n")
+			}
+			if tt.inFlight {
+				cache.inFlight["fax0001.sfc"] = true
+			}
+
+			handleSfcFile(sfcPath)
+
+			outboundQueue.Lock()
+			queued := len(outboundQueue.items) == 1
+			outboundQueue.Unlock()
+			cache.Lock()
+			waiting, cached := cache.sfc["fax0001.pdf"]
+			inFlight := cache.inFlight["fax0001.sfc"]
+			cache.Unlock()
+			if queued != tt.queued || cached != tt.waiting {
+				t.Fatalf("queued = %v, waiting = %v; want %v, %v", queued, cached, tt.queued, tt.waiting)
+			}
+			if tt.queued && !inFlight {
+				t.Error("queued .sfc is not marked in flight")
+			}
+			if tt.waiting {
+				if inFlight {
+					t.Error(".sfc waiting for its PDF is still reserved")
+				}
+				if waiting.hylaJobID == "" || readTestFile(t, filepath.Join(dir, "fax0001.jobid")) != waiting.hylaJobID+"\r" {
+					t.Errorf("waiting .sfc has job ID %q and .jobid %q", waiting.hylaJobID, readTestFile(t, filepath.Join(dir, "fax0001.jobid")))
+				}
+			}
+			if tt.inFlight && fileExists(filepath.Join(dir, "fax0001.jobid")) {
+				t.Error("repeated event wrote a .jobid")
+			}
+		})
+	}
+}
+
+func TestHandlePdfFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		sfc    bool // the .sfc is waiting for this PDF
+		recv   bool // the PDF is a received fax
+		queued bool
+		cached bool
+	}{
+		{name: ".sfc waiting", sfc: true, queued: true},
+		{name: "PDF uploaded first", cached: true},
+		{name: "received fax", recv: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0"})
+			dir := cfg.FTPRoot + FaxDir
+			if tt.sfc {
+				writeTestFile(t, filepath.Join(dir, "fax0001.sfc"), "6045551234\nfax0001.pdf\n")
+				handleSfcFile(filepath.Join(dir, "fax0001.sfc"))
+			}
+			if tt.recv {
+				writeTestFile(t, filepath.Join(dir, "fax0001.recv"), "")
+			}
+			pdfPath := filepath.Join(dir, "fax0001.pdf")
+			writeTestFile(t, pdfPath, "%PDF-1.4\n")
+
+			handlePdfFile(pdfPath)
+
+			outboundQueue.Lock()
+			var item *outboundItem
+			if len(outboundQueue.items) == 1 {
+				item = outboundQueue.items[0]
+			}
+			outboundQueue.Unlock()
+			cache.Lock()
+			_, cached := cache.pdf["fax0001.pdf"]
+			_, waiting := cache.sfc["fax0001.pdf"]
+			cache.Unlock()
+			if (item != nil) != tt.queued || cached != tt.cached || waiting {
+				t.Fatalf("queued = %v, PDF cached = %v, .sfc waiting = %v; want %v, %v, false", item != nil, cached, waiting, tt.queued, tt.cached)
+			}
+			if item == nil {
+				return
+			}
+			holds.Lock()
+			_, held := holds.entries[holdOutboundQueue+"/"+item.HylaJobID]
+			holds.Unlock()
+			if !held {
+				t.Error("queued job has no outbound-queue hold")
+			}
+			if sts := stsFields(t, item.HylaJobID); sts["status"] != "queued" {
+				t.Errorf(".sts status %q, want queued", sts["status"])
+			}
+		})
+	}
+}
+
+// TestSlowWebhook submits a job to a webhook that takes 10 seconds to answer
+// and checks that the next job is paired and submitted meanwhile.
+func TestSlowWebhook(t *testing.T) {
+	received := make(chan string, 2)
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		if _, header, err := r.FormFile("file"); err == nil {
+			received <- header.Filename
+		}
+		if requests.Add(1) == 1 {
+			select {
+			case <-time.After(10 * time.Second):
+			case <-release:
+			}
+		}
+		fmt.Fprintf(w, `{"job_uuid":"job-%d"}`, time.Now().UnixNano())
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL,
+		"SEND_WEBHOOK_RETRIES": "1", "OUTBOUND_CONCURRENCY": "2"})
+	dir := cfg.FTPRoot + FaxDir
+	startOutboundWorkers()
+	t.Cleanup(func() {
+		stopOutboundWorkers()
+		submissions.Wait()
+		outboundQueue.Lock()
+		outboundQueue.stopped = false
+		outboundQueue.Unlock()
+	})
+	upload := func(name, content string) time.Duration {
+		start := time.Now()
+		writeTestFile(t, filepath.Join(dir, name), content)
+		processFile(filepath.Join(dir, name))
+		return time.Since(start)
+	}
+
+	upload("fax0001.pdf", "%PDF-1.4\n")
+	upload("fax0001.sfc", "6045551234\nfax0001.pdf\n")
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first job never reached the webhook")
+	}
+
+	// The first submission is now stuck in the webhook.
+	if took := upload("fax0002.sfc", "6045551234\nfax0002.pdf\n"); took > time.Second {
+		t.Errorf("second .sfc took %v to handle", took)
+	}
+	cache.Lock()
+	_, waiting := cache.sfc["fax0002.pdf"]
+	cache.Unlock()
+	if !waiting {
+		t.Fatal("second .sfc is not waiting for its PDF")
+	}
+	if took := upload("fax0002.pdf", "%PDF-1.4\n"); took > time.Second {
+		t.Errorf("second PDF took %v to handle", took)
+	}
+	select {
+	case name := <-received:
+		if name != "fax0002.pdf" {
+			t.Errorf("second submission sent %s, want fax0002.pdf", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second job was not submitted while the first was in the webhook")
+	}
+}
+
+// TestJobIDBeforeSubmission checks that the .jobid and a queued .sts are on
+// disk when the send webhook is first called, and already once the .sfc is
+// read when its PDF has not arrived.
+func TestJobIDBeforeSubmission(t *testing.T) {
+	tests := []struct {
+		name     string
+		sfcFirst bool // the .sfc is uploaded before its PDF
+	}{
+		{name: "PDF uploaded first"},
+		{name: ".sfc uploaded first", sfcFirst: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type seen struct {
+				jobID, status string
+			}
+			var dir string
+			calls := make(chan seen, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				jobID := strings.TrimSpace(readTestFile(t, filepath.Join(dir, "fax0001.jobid")))
+				status := ""
+				if jobID != "" {
+					status = stsFields(t, jobID)["status"]
+				}
+				calls <- seen{jobID: jobID, status: status}
+				fmt.Fprint(w, `{"job_uuid":"job-uuid"}`)
+			}))
+			defer server.Close()
+			cfg := useTestConfig(t, map[string]string{"MIN_FREE_DISK_MB": "0", "SEND_WEBHOOK_URL": server.URL, "SEND_WEBHOOK_RETRIES": "1"})
+			dir = cfg.FTPRoot + FaxDir
+			startOutboundWorkers()
+			t.Cleanup(func() {
+				stopOutboundWorkers()
+				submissions.Wait()
+				outboundQueue.Lock()
+				outboundQueue.stopped = false
+				outboundQueue.Unlock()
+			})
+
+			upload := func(name, content string) {
+				writeTestFile(t, filepath.Join(dir, name), content)
+				processFile(filepath.Join(dir, name))
+			}
+			if tt.sfcFirst {
+				upload("fax0001.sfc", "6045551234\nfax0001.pdf\n")
+				if readTestFile(t, filepath.Join(dir, "fax0001.jobid")) == "" {
+					t.Fatal("no .jobid once the .sfc is read")
+				}
+				upload("fax0001.pdf", "%PDF-1.4\n")
+			} else {
+				upload("fax0001.pdf", "%PDF-1.4\n")
+				upload("fax0001.sfc", "6045551234\nfax0001.pdf\n")
+			}
+			select {
+			case got := <-calls:
+				if got.jobID == "" || got.status != "queued" {
+					t.Errorf("at the webhook call .jobid %q, .sts status %q; want a job ID and queued", got.jobID, got.status)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("job never reached the webhook")
+			}
+		})
+	}
+}